@@ -0,0 +1,631 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+const analyzeHelp = `
+Usage: librarian analyze [options] /path/to/librarian.log
+
+Produces an offline report from a librarian log and any compacted segments of it without
+needing a running server.
+
+      -report        =string   Report format: "text" (default), "html", or "json".
+      -o             =string   Write report to this file instead of standard output.
+      -clientnorm    =string   Normalizations of client ids, as for the server.  Default is "trim".
+  -h, -help          (flag)    Show help message
+`
+
+// Upper bounds of the buckets for the hold time distribution.
+var holdBuckets = []struct {
+	name  string
+	limit time.Duration
+}{
+	{"< 1 min", time.Minute},
+	{"1-10 min", 10 * time.Minute},
+	{"10-60 min", time.Hour},
+	{"1-4 hours", 4 * time.Hour},
+	{"4-24 hours", 24 * time.Hour},
+	{"1-7 days", 7 * 24 * time.Hour},
+	{"> 7 days", 1<<63 - 1},
+}
+
+type holdKey struct {
+	uuid  string
+	label uint64
+}
+
+type clientAnalysis struct {
+	Client        string
+	Checkouts     int
+	Checkins      int
+	Expired       int
+	Reset         int // checkouts released by a reset
+	Conflicts     int // refused checkouts
+	Labels        int // distinct labels checked in
+	MedianHold    time.Duration
+	TotalHold     time.Duration
+	ConflictRate  float64
+	holds         []time.Duration
+	checkedInSeen map[holdKey]bool
+}
+
+// contextAnalysis summarizes the ops done in a client's work context.
+// actedForAnalysis counts ops made by an authenticated principal for another client id.
+type actedForAnalysis struct {
+	Principal string
+	Client    string
+	Ops       int
+}
+
+type contextAnalysis struct {
+	ID        string
+	Name      string
+	Client    string
+	Opened    time.Time
+	Closed    *time.Time `json:",omitempty"`
+	Ops       int
+	Checkouts int
+	Checkins  int
+	Conflicts int
+}
+
+type bucketCount struct {
+	Name  string
+	Count int
+}
+
+type hourCount struct {
+	Hour  string
+	Count int
+}
+
+// analysisReport is the result of analyzing a librarian log.
+type analysisReport struct {
+	Files        []string
+	First        time.Time
+	Last         time.Time
+	Ops          int
+	UUIDs        int
+	Checkouts    int
+	Conflicts    int
+	ConflictRate float64
+	MedianHold   time.Duration
+	P90Hold      time.Duration
+	Clients      []*clientAnalysis
+	Contexts     []*contextAnalysis  // work contexts in order opened
+	ActedFor     []*actedForAnalysis `json:",omitempty"` // ops whose -audit principal isn't their client
+	Holds        []bucketCount
+	HoursOfDay   []hourCount // ops by hour of day over the whole log
+	BusiestHours []hourCount // busiest individual hours
+}
+
+type analyzer struct {
+	report   analysisReport
+	uuids    map[string]bool
+	clients  map[string]*clientAnalysis
+	contexts map[string]*contextAnalysis
+	actedFor map[[2]string]*actedForAnalysis // principal, client -> ops
+	open     map[holdKey]checkoutT
+	aliases  map[string]string // clients renamed with history -> current client
+	holds    []time.Duration
+	hours    map[time.Time]int
+	byHour   [24]int
+}
+
+func newAnalyzer() *analyzer {
+	return &analyzer{
+		uuids:    make(map[string]bool),
+		clients:  make(map[string]*clientAnalysis),
+		contexts: make(map[string]*contextAnalysis),
+		actedFor: make(map[[2]string]*actedForAnalysis),
+		open:     make(map[holdKey]checkoutT),
+		aliases:  make(map[string]string),
+		hours:    make(map[time.Time]int),
+	}
+}
+
+func (a *analyzer) client(clientid string) *clientAnalysis {
+	ca, found := a.clients[clientid]
+	if !found {
+		ca = &clientAnalysis{
+			Client:        clientid,
+			checkedInSeen: make(map[holdKey]bool),
+		}
+		a.clients[clientid] = ca
+	}
+	return ca
+}
+
+// Ends a hold on a label, returning the client that held it.
+func (a *analyzer) release(key holdKey, t time.Time) *clientAnalysis {
+	co, found := a.open[key]
+	if !found {
+		return nil
+	}
+	delete(a.open, key)
+	hold := t.Sub(co.t)
+	ca := a.client(co.client)
+	ca.holds = append(ca.holds, hold)
+	ca.TotalHold += hold
+	a.holds = append(a.holds, hold)
+	return ca
+}
+
+// Returns the analysis of a work context, noting it if it hasn't been seen.
+func (a *analyzer) context(op *libraryOp) *contextAnalysis {
+	id := op.attrs["context"]
+	ca, found := a.contexts[id]
+	if !found {
+		ca = &contextAnalysis{ID: id, Name: op.attrs["name"], Client: op.client, Opened: op.t}
+		a.contexts[id] = ca
+	}
+	return ca
+}
+
+// Reassigns a renamed client's open holds and, if renamed with history, notes that its
+// past ops should be reported under the new id.
+func (a *analyzer) rename(op *libraryOp) {
+	from, to := op.client, op.attrs["to"]
+	for key, co := range a.open {
+		if co.client == from {
+			co.client = to
+			a.open[key] = co
+		}
+	}
+	if op.op == ClientAliasRestoreOp || op.attrs["history"] == "true" {
+		for old, current := range a.aliases {
+			if current == from {
+				a.aliases[old] = to
+			}
+		}
+		a.aliases[from] = to
+		delete(a.aliases, to)
+	}
+}
+
+// Merges the analysis of clients renamed with history into their current ids.
+func (a *analyzer) mergeAliases() {
+	for from, to := range a.aliases {
+		old, found := a.clients[from]
+		if !found {
+			continue
+		}
+		ca := a.client(to)
+		ca.Checkouts += old.Checkouts
+		ca.Checkins += old.Checkins
+		ca.Expired += old.Expired
+		ca.Reset += old.Reset
+		ca.Conflicts += old.Conflicts
+		ca.TotalHold += old.TotalHold
+		ca.holds = append(ca.holds, old.holds...)
+		for key := range old.checkedInSeen {
+			ca.checkedInSeen[key] = true
+		}
+		delete(a.clients, from)
+	}
+	for _, ctx := range a.contexts {
+		if to, found := a.aliases[ctx.Client]; found {
+			ctx.Client = to
+		}
+	}
+}
+
+func (a *analyzer) add(op *libraryOp) {
+	if op.op == ClientRenameOp || op.op == ClientAliasRestoreOp {
+		a.rename(op)
+		return
+	}
+	if op.op.viewOp() {
+		return
+	}
+	if op.op.contextOp() {
+		ca := a.context(op)
+		if op.op == ContextCloseOp {
+			closed := op.t
+			ca.Closed = &closed
+		}
+		return
+	}
+	if op.attrs["context"] != "" {
+		ca := a.context(op)
+		ca.Ops++
+		switch op.op {
+		case CheckoutOp:
+			ca.Checkouts++
+		case CheckinOp:
+			ca.Checkins++
+		case ConflictOp:
+			ca.Conflicts++
+		}
+	}
+	if op.op.restore() {
+		// Restored checkouts are only new if we haven't read the earlier segment.
+		key := holdKey{op.uuid, op.label}
+		if _, found := a.open[key]; op.op == RestoreOp && !found {
+			a.open[key] = checkoutT{client: op.client, t: op.t}
+		}
+		return
+	}
+
+	a.report.Ops++
+	if principal := op.attrs["principal"]; principal != "" && principal != op.client && op.client != "n/a" {
+		key := [2]string{principal, op.client}
+		af, found := a.actedFor[key]
+		if !found {
+			af = &actedForAnalysis{Principal: principal, Client: op.client}
+			a.actedFor[key] = af
+		}
+		af.Ops++
+	}
+	if a.report.First.IsZero() || op.t.Before(a.report.First) {
+		a.report.First = op.t
+	}
+	if op.t.After(a.report.Last) {
+		a.report.Last = op.t
+	}
+	a.uuids[op.uuid] = true
+	a.byHour[op.t.Hour()]++
+	a.hours[op.t.Truncate(time.Hour)]++
+
+	key := holdKey{op.uuid, op.label}
+	switch op.op {
+	case CheckoutOp:
+		if _, found := a.open[key]; found {
+			return // renewal by same client
+		}
+		a.open[key] = checkoutT{client: op.client, t: op.t}
+		a.client(op.client).Checkouts++
+		a.report.Checkouts++
+	case CheckinOp:
+		if ca := a.release(key, op.t); ca != nil {
+			ca.Checkins++
+			ca.checkedInSeen[key] = true
+		}
+	case ExpireOp:
+		if ca := a.release(key, op.t); ca != nil {
+			ca.Expired++
+		}
+	case ResetOp, CommitResetOp:
+		for k := range a.open {
+			if k.uuid == op.uuid {
+				if ca := a.release(k, op.t); ca != nil {
+					ca.Reset++
+				}
+			}
+		}
+	case LabelResetOp:
+		for _, label := range op.resetLabels() {
+			if ca := a.release(holdKey{op.uuid, label}, op.t); ca != nil {
+				ca.Reset++
+			}
+		}
+	case ConflictOp:
+		a.client(op.client).Conflicts++
+		a.report.Conflicts++
+	}
+}
+
+func (a *analyzer) addFile(fname string) error {
+	if err := readLogOps(fname, a.add); err != nil {
+		return err
+	}
+	a.report.Files = append(a.report.Files, fname)
+	return nil
+}
+
+// Returns the duration at the given percentile of sorted durations.
+func percentile(sorted []time.Duration, pct float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(pct / 100 * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+func conflictRate(conflicts, checkouts int) float64 {
+	if conflicts+checkouts == 0 {
+		return 0
+	}
+	return float64(conflicts) / float64(conflicts+checkouts)
+}
+
+func (a *analyzer) finish() *analysisReport {
+	rpt := &a.report
+	rpt.UUIDs = len(a.uuids)
+	rpt.ConflictRate = conflictRate(rpt.Conflicts, rpt.Checkouts)
+
+	sort.Slice(a.holds, func(i, j int) bool { return a.holds[i] < a.holds[j] })
+	rpt.MedianHold = percentile(a.holds, 50)
+	rpt.P90Hold = percentile(a.holds, 90)
+	rpt.Holds = make([]bucketCount, len(holdBuckets))
+	for i, bucket := range holdBuckets {
+		rpt.Holds[i].Name = bucket.name
+	}
+	for _, hold := range a.holds {
+		for i, bucket := range holdBuckets {
+			if hold < bucket.limit {
+				rpt.Holds[i].Count++
+				break
+			}
+		}
+	}
+
+	a.mergeAliases()
+	for _, ca := range a.clients {
+		sort.Slice(ca.holds, func(i, j int) bool { return ca.holds[i] < ca.holds[j] })
+		ca.MedianHold = percentile(ca.holds, 50)
+		ca.Labels = len(ca.checkedInSeen)
+		ca.ConflictRate = conflictRate(ca.Conflicts, ca.Checkouts)
+		rpt.Clients = append(rpt.Clients, ca)
+	}
+	sort.Slice(rpt.Clients, func(i, j int) bool {
+		if rpt.Clients[i].Checkins != rpt.Clients[j].Checkins {
+			return rpt.Clients[i].Checkins > rpt.Clients[j].Checkins
+		}
+		return rpt.Clients[i].Client < rpt.Clients[j].Client
+	})
+
+	for _, ca := range a.contexts {
+		rpt.Contexts = append(rpt.Contexts, ca)
+	}
+	sort.Slice(rpt.Contexts, func(i, j int) bool { return rpt.Contexts[i].Opened.Before(rpt.Contexts[j].Opened) })
+
+	for _, af := range a.actedFor {
+		rpt.ActedFor = append(rpt.ActedFor, af)
+	}
+	sort.Slice(rpt.ActedFor, func(i, j int) bool {
+		if rpt.ActedFor[i].Ops != rpt.ActedFor[j].Ops {
+			return rpt.ActedFor[i].Ops > rpt.ActedFor[j].Ops
+		}
+		if rpt.ActedFor[i].Principal != rpt.ActedFor[j].Principal {
+			return rpt.ActedFor[i].Principal < rpt.ActedFor[j].Principal
+		}
+		return rpt.ActedFor[i].Client < rpt.ActedFor[j].Client
+	})
+
+	for hour, count := range a.byHour {
+		rpt.HoursOfDay = append(rpt.HoursOfDay, hourCount{fmt.Sprintf("%02d:00", hour), count})
+	}
+	var busiest []time.Time
+	for hour := range a.hours {
+		busiest = append(busiest, hour)
+	}
+	sort.Slice(busiest, func(i, j int) bool {
+		if a.hours[busiest[i]] != a.hours[busiest[j]] {
+			return a.hours[busiest[i]] > a.hours[busiest[j]]
+		}
+		return busiest[i].Before(busiest[j])
+	})
+	for i := 0; i < len(busiest) && i < 10; i++ {
+		rpt.BusiestHours = append(rpt.BusiestHours, hourCount{busiest[i].Format("2006-01-02 15:00"), a.hours[busiest[i]]})
+	}
+	return rpt
+}
+
+// Analyzes a librarian log including any compacted segments.
+func analyzeLog(fname string) (*analysisReport, error) {
+	segments, err := logSegments(fname)
+	if err != nil {
+		return nil, err
+	}
+	a := newAnalyzer()
+	for _, segment := range append(segments, fname) {
+		if err := a.addFile(segment); err != nil {
+			return nil, err
+		}
+	}
+	return a.finish(), nil
+}
+
+func (rpt *analysisReport) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "Librarian log analysis of %d ops from %s to %s\n", rpt.Ops,
+		rpt.First.Format(time.RFC3339), rpt.Last.Format(time.RFC3339))
+	fmt.Fprintf(w, "UUIDs: %d, checkouts: %d, conflicts: %d (%.1f%%)\n", rpt.UUIDs, rpt.Checkouts,
+		rpt.Conflicts, 100*rpt.ConflictRate)
+	fmt.Fprintf(w, "Hold time median: %s, 90th percentile: %s\n\n", rpt.MedianHold, rpt.P90Hold)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Client\tCheckouts\tCheckins\tLabels\tExpired\tReset\tConflicts\tConflict Rate\tMedian Hold\tTotal Hold\n")
+	for _, ca := range rpt.Clients {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%.1f%%\t%s\t%s\n", ca.Client, ca.Checkouts, ca.Checkins,
+			ca.Labels, ca.Expired, ca.Reset, ca.Conflicts, 100*ca.ConflictRate, ca.MedianHold, ca.TotalHold)
+	}
+	tw.Flush()
+
+	if len(rpt.Contexts) > 0 {
+		fmt.Fprintf(w, "\nWork contexts\n")
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "Context\tClient\tOpened\tClosed\tOps\tCheckouts\tCheckins\tConflicts\n")
+		for _, ca := range rpt.Contexts {
+			closed := "open"
+			if ca.Closed != nil {
+				closed = ca.Closed.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n", ca.Name, ca.Client, ca.Opened.Format(time.RFC3339),
+				closed, ca.Ops, ca.Checkouts, ca.Checkins, ca.Conflicts)
+		}
+		tw.Flush()
+	}
+
+	if len(rpt.ActedFor) > 0 {
+		fmt.Fprintf(w, "\nOps made for other clients\n")
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "Principal\tClient\tOps\n")
+		for _, af := range rpt.ActedFor {
+			fmt.Fprintf(tw, "%s\t%s\t%d\n", af.Principal, af.Client, af.Ops)
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintf(w, "\nHold time distribution\n")
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, bucket := range rpt.Holds {
+		fmt.Fprintf(tw, "%s\t%d\n", bucket.Name, bucket.Count)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nOps by hour of day\n")
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, hour := range rpt.HoursOfDay {
+		fmt.Fprintf(tw, "%s\t%d\n", hour.Hour, hour.Count)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nBusiest hours\n")
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, hour := range rpt.BusiestHours {
+		fmt.Fprintf(tw, "%s\t%d\n", hour.Hour, hour.Count)
+	}
+	return tw.Flush()
+}
+
+var analysisHTML = template.Must(template.New("analysis").Funcs(template.FuncMap{
+	"pct":  func(f float64) string { return fmt.Sprintf("%.1f%%", 100*f) },
+	"time": func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+  <head>
+	<meta charset='utf-8' />
+	<title>Librarian Log Analysis</title>
+	<style>
+		body { font-family: sans-serif; }
+		table { border-collapse: collapse; margin-bottom: 2em; }
+		th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+		th:first-child, td:first-child { text-align: left; }
+	</style>
+  </head>
+  <body>
+	<h2>Librarian log analysis</h2>
+	<p>{{.Ops}} ops from {{time .First}} to {{time .Last}} on {{.UUIDs}} UUIDs.<br/>
+	{{.Checkouts}} checkouts, {{.Conflicts}} conflicts ({{pct .ConflictRate}} conflict rate).<br/>
+	Hold time median {{.MedianHold}}, 90th percentile {{.P90Hold}}.</p>
+
+	<h3>Clients</h3>
+	<table>
+	  <tr><th>Client</th><th>Checkouts</th><th>Checkins</th><th>Labels</th><th>Expired</th><th>Reset</th>
+		<th>Conflicts</th><th>Conflict Rate</th><th>Median Hold</th><th>Total Hold</th></tr>
+	  {{range .Clients}}<tr><td>{{.Client}}</td><td>{{.Checkouts}}</td><td>{{.Checkins}}</td><td>{{.Labels}}</td>
+		<td>{{.Expired}}</td><td>{{.Reset}}</td><td>{{.Conflicts}}</td><td>{{pct .ConflictRate}}</td>
+		<td>{{.MedianHold}}</td><td>{{.TotalHold}}</td></tr>
+	  {{end}}
+	</table>
+
+	{{if .Contexts}}<h3>Work contexts</h3>
+	<table>
+	  <tr><th>Context</th><th>Client</th><th>Opened</th><th>Closed</th><th>Ops</th><th>Checkouts</th>
+		<th>Checkins</th><th>Conflicts</th></tr>
+	  {{range .Contexts}}<tr><td>{{.Name}}</td><td>{{.Client}}</td><td>{{time .Opened}}</td>
+		<td>{{if .Closed}}{{time .Closed}}{{else}}open{{end}}</td><td>{{.Ops}}</td><td>{{.Checkouts}}</td>
+		<td>{{.Checkins}}</td><td>{{.Conflicts}}</td></tr>
+	  {{end}}
+	</table>{{end}}
+
+	{{if .ActedFor}}<h3>Ops made for other clients</h3>
+	<table>
+	  <tr><th>Principal</th><th>Client</th><th>Ops</th></tr>
+	  {{range .ActedFor}}<tr><td>{{.Principal}}</td><td>{{.Client}}</td><td>{{.Ops}}</td></tr>
+	  {{end}}
+	</table>{{end}}
+
+	<h3>Hold time distribution</h3>
+	<table>
+	  {{range .Holds}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>
+	  {{end}}
+	</table>
+
+	<h3>Ops by hour of day</h3>
+	<table>
+	  {{range .HoursOfDay}}<tr><td>{{.Hour}}</td><td>{{.Count}}</td></tr>
+	  {{end}}
+	</table>
+
+	<h3>Busiest hours</h3>
+	<table>
+	  {{range .BusiestHours}}<tr><td>{{.Hour}}</td><td>{{.Count}}</td></tr>
+	  {{end}}
+	</table>
+
+	<p>Files analyzed: {{range .Files}}{{.}} {{end}}</p>
+  </body>
+</html>
+`))
+
+// Parses flags that may come before or after positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// Runs the analyze subcommand and returns the exit code.
+func runAnalyze(args []string) int {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	reportFmt := fs.String("report", "text", "")
+	norms := fs.String("clientnorm", TrimClientIDs, "")
+	outFile := fs.String("o", "", "")
+	fs.Usage = func() {
+		fmt.Printf(analyzeHelp)
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		return 1
+	}
+
+	if err := initClientIDs(*norms, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	rpt, err := analyzeLog(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to analyze librarian log: %v\n", err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create report file: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	switch *reportFmt {
+	case "text":
+		err = rpt.writeText(w)
+	case "html":
+		err = analysisHTML.Execute(w, rpt)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rpt)
+	default:
+		fmt.Fprintf(os.Stderr, "Bad -report %q: must be \"text\", \"html\", or \"json\"\n", *reportFmt)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write report: %v\n", err)
+		return 1
+	}
+	return 0
+}
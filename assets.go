@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Files in the -assets directory that replace or add to the embedded pages.  Each can have
+// language variants chosen by the request's Accept-Language header or "lang" query, e.g.,
+// "help.de.html" or "console.pt-BR.html".
+const (
+	HelpAsset          = "help.html"           // replaces the help page at /
+	HelpHeaderAsset    = "help-header.html"    // added to the top of the embedded help page
+	ConsoleAsset       = "console.html"        // replaces the dashboard at /console
+	ConsoleHeaderAsset = "console-header.html" // added to the top of the embedded dashboard
+)
+
+// assetDataT is passed to pages in the -assets directory, which are HTML templates.
+type assetDataT struct {
+	Hostname string
+	Version  string
+	Lang     string // language of the page found, or "" for the default
+}
+
+// Returns the -assets directory, or "" if pages aren't customized.
+func getAssetsDir() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return *assetsDir
+}
+
+// Returns the languages a request asks for, most preferred first, e.g., "pt-BR" then "pt".
+func requestLangs(r *http.Request) []string {
+	type langQ struct {
+		lang string
+		q    float64
+	}
+	var prefs []langQ
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		prefs = append(prefs, langQ{lang, 2})
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		lang, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		if qStr, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			var err error
+			if q, err = strconv.ParseFloat(qStr, 64); err != nil || q <= 0 {
+				continue
+			}
+		}
+		prefs = append(prefs, langQ{lang, q})
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	var langs []string
+	seen := make(map[string]bool)
+	for _, pref := range prefs {
+		lang := pref.lang
+		for lang != "" {
+			if strings.ContainsAny(lang, `/\.`) {
+				break
+			}
+			if !seen[lang] {
+				seen[lang] = true
+				langs = append(langs, lang)
+			}
+			i := strings.LastIndex(lang, "-")
+			if i < 0 {
+				break
+			}
+			lang = lang[:i]
+		}
+	}
+	return langs
+}
+
+// Reads an asset in the request's most preferred language that has one, falling back to
+// the asset without a language.  Returns the file read and its language, or false if
+// there's no -assets directory or file.
+func readAsset(name string, r *http.Request) (content []byte, fname, lang string, found bool) {
+	dir := getAssetsDir()
+	if dir == "" {
+		return nil, "", "", false
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for _, lang := range append(requestLangs(r), "") {
+		fname = name
+		if lang != "" {
+			fname = base + "." + lang + ext
+		}
+		content, err := os.ReadFile(filepath.Join(dir, fname))
+		if err == nil {
+			return content, fname, lang, true
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: unable to read asset %q: %v\n", fname, err)
+		}
+	}
+	return nil, "", "", false
+}
+
+// Writes a page from the -assets directory, if it has one, executing it as an HTML template.
+// Returns false if the embedded page should be written instead, e.g., because the page has
+// template errors, which are logged.
+func writeAssetPage(w http.ResponseWriter, r *http.Request, name string) bool {
+	content, fname, lang, found := readAsset(name, r)
+	if !found {
+		return false
+	}
+	tmpl, err := template.New(fname).Parse(string(content))
+	if err != nil {
+		log.Printf("ERROR: unable to parse asset %q, so using embedded page: %v\n", fname, err)
+		return false
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "Unknown host"
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, assetDataT{hostname, getVersion().Version, lang}); err != nil {
+		log.Printf("ERROR: unable to execute asset %q, so using embedded page: %v\n", fname, err)
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if lang != "" {
+		w.Header().Set("Content-Language", lang)
+	}
+	w.Write(buf.Bytes())
+	return true
+}
+
+// Adds a header from the -assets directory, if any, after the first occurrence of "after"
+// in an embedded page.
+func addAssetHeader(page, after, name string, r *http.Request) string {
+	header, _, _, found := readAsset(name, r)
+	if !found {
+		return page
+	}
+	return strings.Replace(page, after, after+"\n"+string(header), 1)
+}
+
+// Serves files from the -assets directory, e.g., logos and style sheets for custom pages.
+func assetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	dir := getAssetsDir()
+	name := c.URLParams["name"]
+	if dir == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		NotFound(w, r)
+		return
+	}
+	fname := filepath.Join(dir, name)
+	if fi, err := os.Stat(fname); err != nil || fi.IsDir() {
+		NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, fname)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// taskJSON is one task in an assignment task list.
+type taskJSON struct {
+	ID     string
+	UUID   string
+	Client string
+	Labels []uint64
+	Done   bool
+}
+
+type taskListJSON struct {
+	Tasks []taskJSON
+}
+
+// assignKey identifies a label reserved for a task.
+type assignKey struct {
+	task  string
+	uuid  string
+	label uint64
+}
+
+var assignClient = &http.Client{Timeout: dvidTimeout}
+
+// Reads a task list from an http(s) URL or a file.
+func getTaskList(source string) (*taskListJSON, error) {
+	var r io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := assignClient.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("bad status %d from %s", resp.StatusCode, source)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var tasks taskListJSON
+	if err := json.NewDecoder(r).Decode(&tasks); err != nil {
+		return nil, fmt.Errorf("cannot decode task list from %s: %v", source, err)
+	}
+	return &tasks, nil
+}
+
+// Notes a label reserved for a task so it isn't reserved again if the client checks it in.
+// Must be called with library lock held.
+func (lib *libraryT) noteAssignment(uuid string, label uint64, attrs map[string]string) {
+	if task := attrs["task"]; task != "" {
+		lib.assigned[assignKey{task, uuid, label}] = true
+	}
+}
+
+// Writes the labels reserved for tasks into a compacted log, so they aren't reserved again
+// after a restart.  Must be called with library lock held.
+func (lib *libraryT) writeAssignmentRestores() error {
+	for key := range lib.assigned {
+		op := &libraryOp{
+			op:     AssignRestoreOp,
+			uuid:   key.uuid,
+			label:  key.label,
+			client: "n/a",
+			attrs:  map[string]string{"task": key.task},
+		}
+		if err := lib.write(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Notes a label reserved for a task carried over into a compacted log.
+func restoreAssignment(op *libraryOp) {
+	library.Lock()
+	defer library.Unlock()
+
+	library.noteAssignment(op.uuid, op.label, op.attrs)
+}
+
+// Returns true if the label was already reserved for the task.
+func isAssigned(key assignKey) bool {
+	library.RLock()
+	defer library.RUnlock()
+
+	return library.assigned[key]
+}
+
+// Forgets a task's reservation of a label.
+func unassign(key assignKey) {
+	library.Lock()
+	defer library.Unlock()
+
+	delete(library.assigned, key)
+	if library.db != nil {
+		if err := library.db.unassign(key); err != nil {
+			log.Printf("ERROR: unable to update state db for task %s: %v\n", key.task, err)
+		}
+	}
+	if library.shadow != nil {
+		noteShadowWrite(library.shadow.unassign(key), "task "+key.task)
+	}
+}
+
+// Reserves labels of open tasks for their clients and releases labels of done tasks.
+func applyTaskList(tasks *taskListJSON) {
+	for _, task := range tasks.Tasks {
+		task.Client = normalizeClientID(task.Client)
+		if task.ID == "" || task.UUID == "" || task.Client == "" {
+			log.Printf("WARNING: skipping task without ID, UUID, or Client: %+v\n", task)
+			continue
+		}
+		attrs := map[string]string{"task": task.ID}
+		for _, label := range task.Labels {
+			key := assignKey{task.ID, task.UUID, label}
+			if task.Done {
+				if !isAssigned(key) {
+					continue
+				}
+				if client, found := getCheckout(task.UUID, label); found && client == task.Client {
+					if err := checkin(task.UUID, label, task.Client, attrs, true); err != nil {
+						log.Printf("ERROR: unable to release label %d of uuid %s for done task %s: %v\n", label, task.UUID, task.ID, err)
+						continue
+					}
+				}
+				unassign(key)
+			} else if !isAssigned(key) {
+				if _, err := checkout(task.UUID, label, task.Client, checkoutAttrs(task.UUID, 0, attrs), true); err != nil {
+					log.Printf("WARNING: unable to reserve label %d of uuid %s for task %s: %v\n", label, task.UUID, task.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// Polls the task list at the given interval, reserving labels for assigned tasks.
+func watchTaskList(source string, interval time.Duration) {
+	log.Printf("Pulling assignment task list from %s every %s\n", source, interval)
+	for {
+		if inMaintenance() {
+			time.Sleep(interval)
+			continue
+		}
+		tasks, err := getTaskList(source)
+		if err != nil {
+			log.Printf("WARNING: unable to get task list from %s: %v\n", source, err)
+		} else {
+			applyTaskList(tasks)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+// auditT identifies who made a request for the -audit op attributes.
+type auditT struct {
+	principal string // authenticated JWT subject, if any
+	ip        string // source address of the connection, if any
+}
+
+type auditKeyT struct{}
+
+// Key in request context for the auditT of a request.
+var auditKey auditKeyT
+
+// Returns the source IP of a request, or "" for connections without one, e.g., Unix sockets.
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// auditHandler tags requests with their principal and source IP if -audit is set, so ops
+// record who actually made them whatever client id they were made for.
+func auditHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !*auditOps {
+			h.ServeHTTP(w, r)
+			return
+		}
+		a := auditT{ip: sourceIP(r)}
+		if p := getPrincipal(*c); p != nil {
+			a.principal = p.Client
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auditKey, a)))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Adds the principal and source IP of a request, if known, to op attributes.
+func addAuditAttrs(r *http.Request, attrs map[string]string) {
+	a, ok := r.Context().Value(auditKey).(auditT)
+	if !ok {
+		return
+	}
+	if a.principal != "" {
+		attrs["principal"] = a.principal
+	}
+	if a.ip != "" {
+		attrs["ip"] = a.ip
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Role determines what an authenticated client can do.
+type Role uint8
+
+const (
+	NoRole     Role = iota
+	ReaderRole      // GET requests
+	WriterRole      // checkout/checkin for own client id
+	AdminRole       // resets, admin endpoints, and acting on behalf of other clients
+)
+
+func (r Role) String() string {
+	switch r {
+	case ReaderRole:
+		return "reader"
+	case WriterRole:
+		return "writer"
+	case AdminRole:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+func roleFromString(s string) Role {
+	switch s {
+	case "reader":
+		return ReaderRole
+	case "writer":
+		return WriterRole
+	case "admin":
+		return AdminRole
+	default:
+		return NoRole
+	}
+}
+
+// Principal is the identity established by a validated JWT.
+type Principal struct {
+	Client string // JWT subject
+	Role   Role
+}
+
+// Key in web.C Env for the request's *Principal.
+const principalKey = "principal"
+
+// Minimum time between JWKS refreshes triggered by unknown key ids.
+const jwksRefreshInterval = time.Minute
+
+// Timeout for fetching the JWKS, which can happen while handling a request.
+const jwksTimeout = 10 * time.Second
+
+var jwksClient = &http.Client{Timeout: jwksTimeout}
+
+type jwtAuth struct {
+	secret      []byte
+	jwksURL     string
+	audience    string
+	groupsClaim string
+	groupRoles  map[string]Role
+
+	sync.Mutex
+	keys        map[string]*rsa.PublicKey // JWKS keys by key id
+	keysFetched time.Time
+}
+
+var (
+	// Guards auth and adminToken, which are replaced on reload.
+	authMu sync.RWMutex
+
+	// Non-nil if JWT authentication is enabled.
+	auth *jwtAuth
+
+	// Bearer token from -admintokenfile accepted on admin listeners, or nil if not set.
+	adminToken []byte
+)
+
+// AdminTokenClient is the client id recorded for requests authenticated by the admin token.
+const AdminTokenClient = "admin"
+
+// Sets up JWT authentication from command-line options.  If neither a shared secret
+// nor JWKS URL is given, authentication is disabled.
+func initAuth() error {
+	a, token, err := loadAuth()
+	if err != nil {
+		return err
+	}
+	setAuth(a, token)
+	return nil
+}
+
+func setAuth(a *jwtAuth, token []byte) {
+	authMu.Lock()
+	auth = a
+	adminToken = token
+	authMu.Unlock()
+}
+
+func currentAuth() (*jwtAuth, []byte) {
+	authMu.RLock()
+	defer authMu.RUnlock()
+	return auth, adminToken
+}
+
+// Reads the admin token and JWT settings given by options.  The returned *jwtAuth is
+// nil if JWT authentication is disabled.
+func loadAuth() (*jwtAuth, []byte, error) {
+	var token []byte
+	if *adminTokenFile != "" {
+		contents, err := os.ReadFile(*adminTokenFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read admin token file: %v", err)
+		}
+		token = []byte(strings.TrimSpace(string(contents)))
+		if len(token) == 0 {
+			return nil, nil, fmt.Errorf("admin token file %q is empty", *adminTokenFile)
+		}
+	}
+	if *jwtSecretFile == "" && *jwksURL == "" {
+		return nil, token, nil
+	}
+	a := &jwtAuth{
+		jwksURL:     *jwksURL,
+		audience:    *jwtAudience,
+		groupsClaim: *jwtGroupsClaim,
+		groupRoles:  make(map[string]Role),
+	}
+	if *jwtSecretFile != "" {
+		secret, err := os.ReadFile(*jwtSecretFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read JWT secret file: %v", err)
+		}
+		a.secret = []byte(strings.TrimSpace(string(secret)))
+		if len(a.secret) == 0 {
+			return nil, nil, fmt.Errorf("JWT secret file %q is empty", *jwtSecretFile)
+		}
+	}
+	if *jwtRoles != "" {
+		for _, mapping := range strings.Split(*jwtRoles, ",") {
+			parts := strings.Split(strings.TrimSpace(mapping), ":")
+			if len(parts) != 2 || roleFromString(parts[1]) == NoRole {
+				return nil, nil, fmt.Errorf("bad -jwtroles mapping %q: should be group:role with role reader, writer, or admin", mapping)
+			}
+			a.groupRoles[parts[0]] = roleFromString(parts[1])
+		}
+	}
+	if a.jwksURL != "" {
+		if err := a.fetchKeys(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return a, token, nil
+}
+
+// Returns the highest role granted by the given groups.  Authenticated clients
+// are always at least readers.
+func (a *jwtAuth) roleFor(groups []string) Role {
+	role := ReaderRole
+	for _, group := range groups {
+		if r, found := a.groupRoles[group]; found && r > role {
+			role = r
+		}
+	}
+	return role
+}
+
+func (a *jwtAuth) fetchKeys() error {
+	resp, err := jwksClient.Get(a.jwksURL)
+	if err != nil {
+		return fmt.Errorf("cannot get JWKS from %s: %v", a.jwksURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status %d getting JWKS from %s", resp.StatusCode, a.jwksURL)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("cannot decode JWKS from %s: %v", a.jwksURL, err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("bad modulus for JWKS key %q: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("bad exponent for JWKS key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	a.Lock()
+	a.keys = keys
+	a.keysFetched = time.Now()
+	a.Unlock()
+	return nil
+}
+
+// Returns the JWKS key for a key id, refreshing the key set if the id is unknown.
+func (a *jwtAuth) rsaKey(kid string) (*rsa.PublicKey, error) {
+	a.Lock()
+	key, found := a.keys[kid]
+	stale := time.Since(a.keysFetched) > jwksRefreshInterval
+	a.Unlock()
+	if found {
+		return key, nil
+	}
+	if stale {
+		if err := a.fetchKeys(); err != nil {
+			return nil, err
+		}
+		a.Lock()
+		key, found = a.keys[kid]
+		a.Unlock()
+		if found {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown JWT key id %q", kid)
+}
+
+// Validates a compact JWT and returns the principal it establishes.
+func (a *jwtAuth) validate(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad JWT signature encoding: %v", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Alg {
+	case "HS256":
+		if a.secret == nil {
+			return nil, fmt.Errorf("HS256 JWTs not accepted")
+		}
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, fmt.Errorf("bad JWT signature")
+		}
+	case "RS256", "RS384", "RS512":
+		if a.jwksURL == "" {
+			return nil, fmt.Errorf("%s JWTs not accepted", header.Alg)
+		}
+		key, err := a.rsaKey(header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		var hash crypto.Hash
+		var digest []byte
+		switch header.Alg {
+		case "RS256":
+			sum := sha256.Sum256(signed)
+			hash, digest = crypto.SHA256, sum[:]
+		case "RS384":
+			sum := sha512.Sum384(signed)
+			hash, digest = crypto.SHA384, sum[:]
+		default:
+			sum := sha512.Sum512(signed)
+			hash, digest = crypto.SHA512, sum[:]
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, sig); err != nil {
+			return nil, fmt.Errorf("bad JWT signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := float64(time.Now().Unix())
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("JWT has no expiration")
+	}
+	if now >= exp {
+		return nil, fmt.Errorf("JWT has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, fmt.Errorf("JWT not yet valid")
+	}
+	if a.audience != "" && !hasClaimValue(claims["aud"], a.audience) {
+		return nil, fmt.Errorf("JWT audience does not include %q", a.audience)
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("JWT has no subject")
+	}
+	return &Principal{Client: normalizeClientID(sub), Role: a.roleFor(claimStrings(claims[a.groupsClaim]))}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("bad JWT encoding: %v", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("bad JWT JSON: %v", err)
+	}
+	return nil
+}
+
+// Claims like "aud" and "groups" can be either a single string or a list of strings.
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, elem := range v {
+			if s, ok := elem.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	default:
+		return nil
+	}
+}
+
+func hasClaimValue(claim interface{}, value string) bool {
+	for _, s := range claimStrings(claim) {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the minimum role needed for a request.
+func requiredRole(r *http.Request) Role {
+	switch {
+	case r.URL.Path == "/", r.URL.Path == "/healthz", r.URL.Path == "/healthz/", r.URL.Path == "/console", r.URL.Path == "/console/":
+		return NoRole // the console page sends the user's token with its own requests
+	case strings.HasPrefix(r.URL.Path, "/assets/"):
+		return NoRole // logos and style sheets of the help page and console
+	case r.URL.Path == "/notice", r.URL.Path == "/notice/":
+		return NoRole // banners are shown before users sign in
+	case r.URL.Path == "/login", strings.HasPrefix(r.URL.Path, "/login/"), r.URL.Path == "/session", r.URL.Path == "/session/":
+		return NoRole // login links and sessions authenticate themselves
+	case strings.HasPrefix(r.URL.Path, "/admin/"), r.URL.Path == "/reset", strings.HasPrefix(r.URL.Path, "/reset/"):
+		return AdminRole
+	case strings.HasPrefix(r.URL.Path, "/replicate/"):
+		return AdminRole // replicas get all state
+	case strings.HasPrefix(r.URL.Path, "/hooks/"):
+		return AdminRole // mutations move any client's locks
+	case strings.HasPrefix(r.URL.Path, "/ws/"):
+		return WriterRole // commands over the WebSocket check out and check in labels
+	case r.Method == "GET", r.Method == "HEAD", r.Method == "OPTIONS":
+		return ReaderRole
+	case r.URL.Path == "/graphql", r.URL.Path == "/graphql/":
+		return ReaderRole // queries are read-only
+	default:
+		return WriterRole
+	}
+}
+
+// Returns the authenticated principal for a request or nil if auth is disabled.
+func getPrincipal(c web.C) *Principal {
+	if c.Env == nil {
+		return nil
+	}
+	p, _ := c.Env[principalKey].(*Principal)
+	return p
+}
+
+func setPrincipal(c *web.C, p *Principal) {
+	if c.Env == nil {
+		c.Env = make(map[interface{}]interface{})
+	}
+	c.Env[principalKey] = p
+}
+
+// Returns the client id to record for requests that have no client in the URL.
+func requestClient(c web.C) string {
+	if p := getPrincipal(c); p != nil {
+		return p.Client
+	}
+	return "n/a"
+}
+
+// Returns an error if the request's principal may not act as the given client.
+func authorizeClient(c web.C, client string) error {
+	p := getPrincipal(c)
+	if p == nil || p.Role == AdminRole || p.Client == client {
+		return nil
+	}
+	return fmt.Errorf("%s may not act for client %s", p.Client, client)
+}
+
+// authHandler validates any bearer JWT or guest token and enforces the role needed for the
+// request.
+func authHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		auth, adminToken := currentAuth()
+		if adminToken != nil && listenerAdmin(r) && !listenerNoAuth(r) {
+			adminTokenAuth(c, w, r, h, adminToken)
+			return
+		}
+		if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found && strings.HasPrefix(token, GuestTokenPrefix) && requiredRole(r) != NoRole {
+			p := guestPrincipal(w, r, token)
+			if p == nil {
+				return
+			}
+			setPrincipal(c, p)
+			h.ServeHTTP(w, r)
+			return
+		}
+		if auth == nil || listenerNoAuth(r) {
+			// Without auth, a login session only attributes requests to its client.
+			if p := sessionPrincipal(r); p != nil {
+				setPrincipal(c, p)
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		needed := requiredRole(r)
+		if needed == NoRole {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if p := sessionPrincipal(r); p != nil {
+			if p.Role < needed {
+				Forbidden(w, r, "%s has role %s but %s is required", p.Client, p.Role, needed)
+				return
+			}
+			setPrincipal(c, p)
+			h.ServeHTTP(w, r)
+			return
+		}
+		authz := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authz, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="librarian"`)
+			writeError(w, http.StatusUnauthorized, "bearer token required")
+			return
+		}
+		p, err := auth.validate(strings.TrimPrefix(authz, "Bearer "))
+		if err != nil {
+			log.Printf("ERROR: rejected JWT for %s: %v\n", r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="librarian", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, fmt.Sprintf("invalid token: %v", err))
+			return
+		}
+		if p.Role < needed {
+			Forbidden(w, r, "%s has role %s but %s is required", p.Client, p.Role, needed)
+			return
+		}
+		setPrincipal(c, p)
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Requires the -admintokenfile token, which grants the admin role, for all but the help page.
+func adminTokenAuth(c *web.C, w http.ResponseWriter, r *http.Request, h http.Handler, adminToken []byte) {
+	if requiredRole(r) == NoRole {
+		h.ServeHTTP(w, r)
+		return
+	}
+	authz := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authz, "Bearer ")
+	if !strings.HasPrefix(authz, "Bearer ") || subtle.ConstantTimeCompare([]byte(token), adminToken) != 1 {
+		log.Printf("ERROR: rejected admin token for %s\n", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="librarian-admin"`)
+		writeError(w, http.StatusUnauthorized, "admin token required")
+		return
+	}
+	setPrincipal(c, &Principal{Client: AdminTokenClient, Role: AdminRole})
+	h.ServeHTTP(w, r)
+}
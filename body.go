@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// MaxOpBodySize is the largest JSON request body accepted in place of path parameters.
+const MaxOpBodySize = 1 << 20
+
+// opBodyJSON is the JSON request body of PUT /checkout, PUT /checkin, and PUT /reset.
+// Field names are matched case-insensitively, so "uuid" and "UUID" both work.
+type opBodyJSON struct {
+	UUID   string
+	Label  json.RawMessage // number or string in a format accepted by the uuid's policy
+	Client string
+	TTL    string            // checkout lease, e.g., "2h"
+	Meta   map[string]string // metadata set on the uuid after a checkout
+	OpID   string            // same as the X-Op-ID header
+	Ref    string            // same as the X-Op-Ref header
+}
+
+// Decodes the JSON body of an op request.  Returns false if an error response has been
+// written.  An op id or reference in the body is handled as if given in the X-Op-ID or
+// X-Op-Ref header.
+func decodeOpBody(w http.ResponseWriter, r *http.Request) (*opBodyJSON, bool) {
+	var body opBodyJSON
+	dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		BadRequest(w, r, "bad JSON request body: %v", err)
+		return nil, false
+	}
+	if body.UUID == "" {
+		BadRequest(w, r, "JSON request body must include a uuid")
+		return nil, false
+	}
+	if body.OpID != "" {
+		if id := r.Header.Get(OpIDHeader); id != "" && id != body.OpID {
+			BadRequest(w, r, "op id %q in request body does not match %s header %q", body.OpID, OpIDHeader, id)
+			return nil, false
+		}
+		r.Header.Set(OpIDHeader, body.OpID)
+	}
+	if body.Ref != "" {
+		if ref := r.Header.Get(OpRefHeader); ref != "" && ref != body.Ref {
+			BadRequest(w, r, "op reference %q in request body does not match %s header %q", body.Ref, OpRefHeader, ref)
+			return nil, false
+		}
+		if err := checkOpRef(body.Ref); err != nil {
+			BadRequest(w, r, "bad ref in JSON request body: %v", err)
+			return nil, false
+		}
+		r.Header.Set(OpRefHeader, body.Ref)
+	}
+	return &body, true
+}
+
+func (body *opBodyJSON) label() (uint64, error) {
+	if len(body.Label) == 0 {
+		return 0, fmt.Errorf("JSON request body must include a label")
+	}
+	return parseLabelJSON(body.UUID, body.Label)
+}
+
+// Parses a label given in JSON as a number or a string in a format accepted by the uuid's
+// policy.
+func parseLabelJSON(uuid string, raw json.RawMessage) (uint64, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		s = string(raw) // JSON number
+	}
+	return parseLabel(uuid, s)
+}
+
+// Returns the label and normalized client of a checkout or checkin body.  Returns false
+// if an error response has been written.
+func (body *opBodyJSON) labelClient(w http.ResponseWriter, r *http.Request) (uint64, string, bool) {
+	label, err := body.label()
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return 0, "", false
+	}
+	client, err := checkClientID(body.Client)
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return 0, "", false
+	}
+	return label, client, true
+}
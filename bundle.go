@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigBundleVersion is the version of config bundles written by GET /admin/export-config.
+// Bundles of other versions are refused by POST /admin/import-config.
+const ConfigBundleVersion = 1
+
+// MaxConfigBundleSize is the largest config bundle accepted by POST /admin/import-config.
+const MaxConfigBundleSize = 64 << 20
+
+// configBundleJSON is the configuration of a librarian that is copied between servers:
+// UUID policies, pinned labels, and reloadable options such as -digestwebhook and the
+// -dailyclear and -backup schedules.
+type configBundleJSON struct {
+	Version  int
+	Exported time.Time
+	Policies map[string]*policyJSON       // UUID -> policy
+	Pins     map[string][]pinnedLabelJSON // UUID -> pinned labels
+	Options  map[string]string            // reloadable option -> value
+}
+
+type importConfigJSON struct {
+	Policies  int      // policies set
+	Pinned    int      // labels pinned
+	Unpinned  int      // labels unpinned because they weren't in the bundle, with replace
+	Reset     []string // UUIDs whose policies were reset to the default, with replace
+	Differing []string // options with different values on this server, skipped with skipoptions
+}
+
+// Returns the current configuration bundle.
+func exportConfig() configBundleJSON {
+	bundle := configBundleJSON{
+		Version:  ConfigBundleVersion,
+		Exported: clock.Now(),
+		Policies: make(map[string]*policyJSON),
+		Pins:     make(map[string][]pinnedLabelJSON),
+		Options:  currentReloadableOptions(),
+	}
+	library.RLock()
+	var uuids []string
+	for uuid, policy := range library.policies {
+		bundle.Policies[uuid] = policy
+	}
+	for uuid := range library.pins {
+		uuids = append(uuids, uuid)
+	}
+	library.RUnlock()
+
+	for _, uuid := range uuids {
+		if pins := getPins(uuid); len(pins) > 0 {
+			bundle.Pins[uuid] = pins
+		}
+	}
+	return bundle
+}
+
+// Returns the values of the reloadable options.
+func currentReloadableOptions() map[string]string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	options := make(map[string]string, len(reloadableOptions))
+	for name := range reloadableOptions {
+		if f := flag.Lookup(name); f != nil {
+			options[name] = f.Value.String()
+		}
+	}
+	return options
+}
+
+// Decodes a config bundle, checking its version and parsing labels by each UUID's policy
+// in the bundle.  Returns the bundle's pinned labels by UUID.
+func decodeConfigBundle(r io.Reader) (*configBundleJSON, map[string]map[uint64]pinJSON, error) {
+	var raw struct {
+		Version  int
+		Exported time.Time
+		Policies map[string]json.RawMessage
+		Pins     map[string][]struct {
+			Label  json.RawMessage
+			Reason string
+			Client string    // pinning client, which isn't imported
+			Since  time.Time // when pinned, which isn't imported
+		}
+		Options map[string]string
+	}
+	// Anything this librarian can't import, e.g., a section added by a newer version, is
+	// refused rather than skipped.
+	dec := json.NewDecoder(io.LimitReader(r, MaxConfigBundleSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, nil, fmt.Errorf("bad config bundle: %v", err)
+	}
+	if raw.Version != ConfigBundleVersion {
+		return nil, nil, fmt.Errorf("config bundle version %d is not the supported version %d", raw.Version, ConfigBundleVersion)
+	}
+	bundle := &configBundleJSON{
+		Version:  raw.Version,
+		Exported: raw.Exported,
+		Policies: make(map[string]*policyJSON, len(raw.Policies)),
+		Options:  raw.Options,
+	}
+	for uuid, policyBytes := range raw.Policies {
+		policy, err := parsePolicy(string(policyBytes))
+		if err != nil {
+			return nil, nil, fmt.Errorf("policy for uuid %s: %v", uuid, err)
+		}
+		bundle.Policies[uuid] = policy
+	}
+	pins := make(map[string]map[uint64]pinJSON, len(raw.Pins))
+	for uuid, list := range raw.Pins {
+		pins[uuid] = make(map[uint64]pinJSON, len(list))
+		for i, p := range list {
+			if len(p.Reason) > MaxPinReasonLength {
+				return nil, nil, fmt.Errorf("pin %d of uuid %s: reason is over %d bytes", i, uuid, MaxPinReasonLength)
+			}
+			label, err := parseBundleLabel(bundle.Policies[uuid], uuid, p.Label)
+			if err != nil {
+				return nil, nil, fmt.Errorf("pin %d of uuid %s: %v", i, uuid, err)
+			}
+			pins[uuid][label] = pinJSON{Reason: p.Reason}
+		}
+	}
+	return bundle, pins, nil
+}
+
+// Parses a label written with the output format of the bundle's policy for a uuid, or
+// by this server's policy if the bundle has none for it.
+func parseBundleLabel(policy *policyJSON, uuid string, raw json.RawMessage) (uint64, error) {
+	if policy == nil {
+		return parseLabelJSON(uuid, raw)
+	}
+	var n uint64
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, fmt.Errorf("label must be a number or string, not %s", raw)
+	}
+	format := policy.labelOutput()
+	if format == "" {
+		format = DecimalLabels
+	}
+	if label, ok := parseLabelAs(s, format); ok {
+		return label, nil
+	}
+	return 0, fmt.Errorf("label %q is not in the %s format of the bundle's policy for uuid %s", s, format, uuid)
+}
+
+// Returns the options of a config bundle with different values on this server, sorted.
+func differingOptions(bundle *configBundleJSON) []string {
+	current := currentReloadableOptions()
+	differing := []string{}
+	for name, value := range bundle.Options {
+		if currentValue, found := current[name]; !found || currentValue != value {
+			differing = append(differing, name)
+		}
+	}
+	sort.Strings(differing)
+	return differing
+}
+
+// Applies the policies and pins of a config bundle all at once.  If replace, pins and
+// policies not in the bundle are removed, with removed policies reset to the default.
+// Options aren't applied since the -config file is their source, so a bundle with options
+// that differ here is refused unless skipOptions.  If any change can't be logged, those
+// already made are undone.
+func importConfig(bundle *configBundleJSON, pins map[string]map[uint64]pinJSON, replace, skipOptions bool, clientid string, attrs map[string]string) (importConfigJSON, error) {
+	result := importConfigJSON{Reset: []string{}, Differing: differingOptions(bundle)}
+	if len(result.Differing) > 0 && !skipOptions {
+		return result, fmt.Errorf("options %s differ here but are set by the -config file, so the bundle isn't imported without skipoptions",
+			strings.Join(result.Differing, ", "))
+	}
+
+	// The op id, if any, can't be recorded for the many ops of an import.
+	attrs = mergeAttrs(attrs, nil)
+	delete(attrs, "opid")
+
+	library.Lock()
+	defer library.Unlock()
+
+	var undo []func() error
+	rollback := func(err error) (importConfigJSON, error) {
+		var failed []string
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil {
+				failed = append(failed, undoErr.Error())
+			}
+		}
+		if len(failed) > 0 {
+			log.Printf("ERROR: unable to undo %d of %d changes of a failed config import: %s\n", len(failed), len(undo), strings.Join(failed, "; "))
+			return result, fmt.Errorf("%v, and %d of %d changes already made couldn't be undone", err, len(failed), len(undo))
+		}
+		return result, err
+	}
+	setPolicy := func(uuid string, policy *policyJSON) error {
+		prev, found := library.policies[uuid]
+		if err := library.setPolicy(uuid, policy, clientid, attrs, true); err != nil {
+			return fmt.Errorf("policy for uuid %s: %v", uuid, err)
+		}
+		if !found {
+			prev = &policyJSON{}
+		}
+		undo = append(undo, func() error { return library.setPolicy(uuid, prev, clientid, attrs, true) })
+		return nil
+	}
+	setPin := func(uuid string, label uint64, reason string) error {
+		prev, found := library.pins[uuid][label]
+		if err := library.setPin(PinOp, clock.Now(), uuid, label, reason, clientid, attrs, true); err != nil {
+			return fmt.Errorf("pin of uuid %s, label %d: %v", uuid, label, err)
+		}
+		undo = append(undo, func() error {
+			if found {
+				return library.setPin(PinOp, clock.Now(), uuid, label, prev.reason, clientid, attrs, true)
+			}
+			return library.unpin(clock.Now(), uuid, label, clientid, attrs, true)
+		})
+		return nil
+	}
+
+	for uuid, policy := range bundle.Policies {
+		if old, found := library.policies[uuid]; found && samePolicy(old, policy) {
+			continue
+		}
+		if err := setPolicy(uuid, policy); err != nil {
+			return rollback(err)
+		}
+		result.Policies++
+	}
+	for uuid, m := range pins {
+		for label, p := range m {
+			if pin, found := library.pins[uuid][label]; found && pin.reason == p.Reason {
+				continue
+			}
+			if err := setPin(uuid, label, p.Reason); err != nil {
+				return rollback(err)
+			}
+			result.Pinned++
+		}
+	}
+	if replace {
+		for uuid, m := range library.pins {
+			for label, prev := range m {
+				if _, found := pins[uuid][label]; found {
+					continue
+				}
+				if err := library.unpin(clock.Now(), uuid, label, clientid, attrs, true); err != nil {
+					return rollback(fmt.Errorf("unpin of uuid %s, label %d: %v", uuid, label, err))
+				}
+				uuid, label, prev := uuid, label, prev
+				undo = append(undo, func() error {
+					return library.setPin(PinOp, clock.Now(), uuid, label, prev.reason, clientid, attrs, true)
+				})
+				result.Unpinned++
+			}
+		}
+		for uuid, policy := range library.policies {
+			if _, found := bundle.Policies[uuid]; found || samePolicy(policy, &policyJSON{}) {
+				continue
+			}
+			if err := setPolicy(uuid, &policyJSON{}); err != nil {
+				return rollback(err)
+			}
+			result.Reset = append(result.Reset, uuid)
+		}
+		sort.Strings(result.Reset)
+	}
+	return result, nil
+}
+
+// Returns true if two policies have the same JSON.
+func samePolicy(a, b *policyJSON) bool {
+	aBytes, errA := json.Marshal(a)
+	bBytes, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(aBytes) == string(bBytes)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cacheHelp = `
+Usage: librarian cache [options]
+
+Serves a nearby read cache of a librarian for remote sites where every request to it is
+slow.  GET /state/{UUID} and GET /checkout/{UUID}/{Label}, with or without the /v1 prefix,
+are answered from a cache for -ttl.  After that, until -stale, the cached response is still
+answered at once while it's refetched in the background, so reads never wait on the upstream
+once cached.  Older responses are refetched before answering.
+
+All other requests, including checkouts, checkins, resets, and /events streams, are forwarded
+to -upstream unchanged.  A successful change to a UUID, including both UUIDs of a /migrate
+and every UUID of a /checkout-multi, drops its cached responses, so clients of the cache see
+their own changes.  Changes made by clients of the upstream are seen after
+at most -ttl, or -stale while the upstream is slow.  Responses are cached separately for each
+Authorization and Accept header, and only 200 responses are cached.  Responses have an
+X-Librarian-Cache header of "hit", "stale", or "miss", and an Age header if cached.
+
+The cache also serves:
+
+  GET /cache/stats               Counts of hits, stale hits, misses, and revalidations.
+
+      -http          =string   Address for HTTP communication.  Default is "localhost:8000".
+      -upstream      =string   URL of the librarian to cache, e.g., "https://librarian.example.org".
+      -ttl           =duration How long cached responses are answered as is.  Default "2s".
+      -stale         =duration How long after -ttl cached responses are answered while they're
+                                 refetched.  Default "30s".
+      -maxentries    =number   Most responses cached.  Default 10000.
+  -h, -help          (flag)    Show help message
+`
+
+const (
+	// CacheTimeout is the longest the cache waits for the upstream to answer a read.
+	CacheTimeout = 30 * time.Second
+
+	// CacheHeader is the response header telling whether a read came from the cache.
+	CacheHeader = "X-Librarian-Cache"
+)
+
+// Values of CacheHeader.
+const (
+	CacheHit   = "hit"
+	CacheStale = "stale"
+	CacheMiss  = "miss"
+)
+
+// Request headers sent upstream with reads the cache makes.
+var cacheForwardedHeaders = []string{"Authorization", "Accept", "User-Agent", ToolVersionHeader}
+
+// cacheEntryT is a cached 200 response.
+type cacheEntryT struct {
+	uuid         string
+	header       http.Header
+	body         []byte
+	fetched      time.Time
+	revalidating bool
+}
+
+type cacheStatsJSON struct {
+	Upstream      string
+	Entries       int
+	Hits          int
+	StaleHits     int
+	Misses        int
+	Revalidations int
+	Errors        int // failed reads of the upstream
+	Invalidations int // UUIDs whose responses were dropped after a change
+}
+
+// readCacheT answers reads from a cache of an upstream librarian and forwards the rest.
+type readCacheT struct {
+	sync.Mutex
+	entries map[string]*cacheEntryT
+	stats   cacheStatsJSON
+
+	upstream   string
+	ttl        time.Duration
+	stale      time.Duration
+	maxEntries int
+	client     *http.Client
+	proxy      *httputil.ReverseProxy
+}
+
+// Returns the uuid of a cacheable read, or "" if the request isn't one.
+func cachedUUID(r *http.Request) string {
+	if r.Method != http.MethodGet {
+		return ""
+	}
+	path := strings.TrimPrefix(r.URL.Path, EnvelopePrefix)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "state":
+		return parts[1]
+	case len(parts) == 3 && parts[0] == "checkout":
+		return parts[1]
+	}
+	return ""
+}
+
+// cacheUUIDsKey is the request context key of the uuids a forwarded request changes.
+type cacheUUIDsKey struct{}
+
+// Returns the uuids a forwarded change can affect: both uuids of a /migrate, those in the
+// body of a /checkout-multi, or otherwise the uuid the router would forward it by.  A body
+// read is replaced so it can still be forwarded.
+func changedUUIDs(r *http.Request) ([]string, error) {
+	path := strings.TrimPrefix(r.URL.Path, EnvelopePrefix)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "migrate":
+		return []string{parts[1], parts[2]}, nil
+	case len(parts) == 1 && parts[0] == "checkout-multi":
+		body, err := io.ReadAll(io.LimitReader(r.Body, MaxOpBodySize+1))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read request body: %v", err)
+		}
+		if len(body) > MaxOpBodySize {
+			return nil, fmt.Errorf("request body is over %d bytes", MaxOpBodySize)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var multi multiCheckoutBodyJSON
+		if err := json.Unmarshal(body, &multi); err != nil {
+			return nil, nil // refused upstream, so nothing changes
+		}
+		var uuids []string
+		seen := make(map[string]bool, len(multi.Labels))
+		for _, ml := range multi.Labels {
+			if !seen[ml.UUID] {
+				seen[ml.UUID] = true
+				uuids = append(uuids, ml.UUID)
+			}
+		}
+		return uuids, nil
+	}
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = path
+	uuid, err := routedUUID(r2)
+	r.Body = r2.Body // routedUUID may have read the body and replaced it
+	if err != nil || uuid == "" {
+		return nil, err
+	}
+	return []string{uuid}, nil
+}
+
+func cacheKey(r *http.Request) string {
+	return r.URL.RequestURI() + "\n" + r.Header.Get("Accept") + "\n" + r.Header.Get("Authorization")
+}
+
+// Reads a response from the upstream with the headers of a request.  Responses of any
+// status are returned so they can be passed on.
+func (rc *readCacheT) fetch(r *http.Request) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, rc.upstream+r.URL.RequestURI(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range cacheForwardedHeaders {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// Caches a 200 response, dropping the oldest response if the cache is full.  Must be called
+// with the cache locked.
+func (rc *readCacheT) store(key, uuid string, resp *http.Response, body []byte, fetched time.Time) {
+	if _, found := rc.entries[key]; !found && len(rc.entries) >= rc.maxEntries {
+		var oldestKey string
+		var oldest time.Time
+		for k, entry := range rc.entries {
+			if oldestKey == "" || entry.fetched.Before(oldest) {
+				oldestKey, oldest = k, entry.fetched
+			}
+		}
+		delete(rc.entries, oldestKey)
+	}
+	header := resp.Header.Clone()
+	header.Del("Content-Length")
+	header.Del("Date")
+	rc.entries[key] = &cacheEntryT{uuid: uuid, header: header, body: body, fetched: fetched}
+	rc.stats.Entries = len(rc.entries)
+}
+
+// Refetches a cached response in the background, keeping the stale one if it fails.
+func (rc *readCacheT) revalidate(key, uuid string, r *http.Request) {
+	fetched := time.Now()
+	resp, body, err := rc.fetch(r)
+
+	rc.Lock()
+	defer rc.Unlock()
+	entry, found := rc.entries[key]
+	if found {
+		entry.revalidating = false
+	}
+	switch {
+	case err != nil:
+		rc.stats.Errors++
+		log.Printf("ERROR: unable to revalidate %s from %s: %v\n", r.URL.Path, rc.upstream, err)
+	case resp.StatusCode != http.StatusOK:
+		delete(rc.entries, key)
+		rc.stats.Entries = len(rc.entries)
+	case !found || entry.fetched.After(fetched):
+		// Dropped, e.g., after a change to the uuid, while this read was in flight.
+	default:
+		rc.store(key, uuid, resp, body, fetched)
+	}
+}
+
+// Drops the cached responses of a uuid.
+func (rc *readCacheT) invalidate(uuid string) {
+	rc.Lock()
+	defer rc.Unlock()
+	for key, entry := range rc.entries {
+		if entry.uuid == uuid {
+			delete(rc.entries, key)
+		}
+	}
+	rc.stats.Entries = len(rc.entries)
+	rc.stats.Invalidations++
+}
+
+func writeCachedResponse(w http.ResponseWriter, header http.Header, status int, body []byte, state string, age time.Duration) {
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(CacheHeader, state)
+	if state != CacheMiss {
+		w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Answers a cacheable read.
+func (rc *readCacheT) serveCached(w http.ResponseWriter, r *http.Request, uuid string) {
+	key := cacheKey(r)
+	now := time.Now()
+
+	rc.Lock()
+	if entry, found := rc.entries[key]; found {
+		age := now.Sub(entry.fetched)
+		if age < rc.ttl {
+			rc.stats.Hits++
+			header, body := entry.header, entry.body
+			rc.Unlock()
+			writeCachedResponse(w, header, http.StatusOK, body, CacheHit, age)
+			return
+		}
+		if age < rc.ttl+rc.stale {
+			rc.stats.StaleHits++
+			if !entry.revalidating {
+				entry.revalidating = true
+				rc.stats.Revalidations++
+				go rc.revalidate(key, uuid, r.Clone(context.Background()))
+			}
+			header, body := entry.header, entry.body
+			rc.Unlock()
+			writeCachedResponse(w, header, http.StatusOK, body, CacheStale, age)
+			return
+		}
+	}
+	rc.stats.Misses++
+	rc.Unlock()
+
+	resp, body, err := rc.fetch(r)
+	if err != nil {
+		rc.Lock()
+		rc.stats.Errors++
+		rc.Unlock()
+		errorMsg := fmt.Sprintf("unable to reach upstream %s: %v (%s).", rc.upstream, err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusBadGateway, errorMsg)
+		return
+	}
+	if resp.StatusCode == http.StatusOK {
+		rc.Lock()
+		rc.store(key, uuid, resp, body, now)
+		rc.Unlock()
+	}
+	header := resp.Header.Clone()
+	header.Del("Content-Length")
+	writeCachedResponse(w, header, resp.StatusCode, body, CacheMiss, 0)
+}
+
+func (rc *readCacheT) getStats() cacheStatsJSON {
+	rc.Lock()
+	defer rc.Unlock()
+	return rc.stats
+}
+
+func (rc *readCacheT) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.TrimSuffix(r.URL.Path, "/") == "/cache/stats" {
+		writeJSON(w, r, rc.getStats())
+		return
+	}
+	if uuid := cachedUUID(r); uuid != "" {
+		rc.serveCached(w, r, uuid)
+		return
+	}
+
+	// Changes to uuids drop their cached responses once they succeed.
+	var uuids []string
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		var err error
+		if uuids, err = changedUUIDs(r); err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+	}
+	rc.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cacheUUIDsKey{}, uuids)))
+}
+
+func (rc *readCacheT) newProxy(u *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.FlushInterval = -1
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		uuids, _ := resp.Request.Context().Value(cacheUUIDsKey{}).([]string)
+		if resp.StatusCode < 300 {
+			for _, uuid := range uuids {
+				rc.invalidate(uuid)
+			}
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		errorMsg := fmt.Sprintf("unable to reach upstream %s: %v (%s).", rc.upstream, err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusBadGateway, errorMsg)
+	}
+	return proxy
+}
+
+// Runs the cache subcommand and returns the exit code.
+func runCache(args []string) int {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	addr := fs.String("http", "localhost:8000", "")
+	upstream := fs.String("upstream", "", "")
+	ttl := fs.Duration("ttl", 2*time.Second, "")
+	stale := fs.Duration("stale", 30*time.Second, "")
+	maxEntries := fs.Int("maxentries", 10000, "")
+	fs.Usage = func() {
+		fmt.Printf(cacheHelp)
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil || len(positional) != 0 {
+		fs.Usage()
+		return 1
+	}
+	u, err := url.Parse(*upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fmt.Fprintf(os.Stderr, "-upstream must be a URL like \"http://librarian:8000\", not %q\n", *upstream)
+		return 1
+	}
+	if *ttl <= 0 || *stale < 0 || *maxEntries < 1 {
+		fmt.Fprintf(os.Stderr, "-ttl must be positive, -stale 0 or more, and -maxentries at least 1\n")
+		return 1
+	}
+
+	rc := &readCacheT{
+		entries:    make(map[string]*cacheEntryT),
+		upstream:   strings.TrimSuffix(*upstream, "/"),
+		ttl:        *ttl,
+		stale:      *stale,
+		maxEntries: *maxEntries,
+		client:     &http.Client{Timeout: CacheTimeout},
+	}
+	rc.stats.Upstream = rc.upstream
+	rc.proxy = rc.newProxy(u)
+
+	log.Printf("Caching reads of %s on %s for %s, answering stale reads for %s more\n", rc.upstream, *addr, *ttl, *stale)
+	if err := http.ListenAndServe(*addr, rc); err != nil {
+		fmt.Fprintf(os.Stderr, "Cache stopped: %v\n", err)
+		return 1
+	}
+	return 0
+}
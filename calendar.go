@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CalendarEventLength is the duration of each lock expiration event in a calendar.
+const CalendarEventLength = 15 * time.Minute
+
+type leaseT struct {
+	uuid    string
+	label   uint64
+	since   time.Time
+	expires time.Time
+}
+
+// Returns the client's checkouts that have a lease, soonest expiration first.
+func getLeases(clientid string) []leaseT {
+	library.RLock()
+	var leases []leaseT
+	for uuid, checkouts := range library.vchk {
+		for label, co := range checkouts {
+			if co.client == clientid && !co.expires.IsZero() {
+				leases = append(leases, leaseT{uuid, label, co.t, co.expires})
+			}
+		}
+	}
+	library.RUnlock()
+
+	sort.Slice(leases, func(i, j int) bool { return leases[i].expires.Before(leases[j].expires) })
+	return leases
+}
+
+const icalTimeFmt = "20060102T150405Z"
+
+// Escapes text for an iCalendar property value (RFC 5545, section 3.3.11).
+func icalEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// Writes an iCalendar content line, folding it at 75 octets.
+func writeICalLine(w io.Writer, line string) {
+	for len(line) > 75 {
+		n := 75
+		for n > 0 && line[n]&0xc0 == 0x80 {
+			n-- // don't split a UTF-8 character
+		}
+		fmt.Fprintf(w, "%s\r\n ", line[:n])
+		line = line[n:]
+	}
+	fmt.Fprintf(w, "%s\r\n", line)
+}
+
+// Writes an iCalendar feed with an event at the expiration of each of the client's leases.
+func writeCalendar(w io.Writer, clientid string) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "librarian"
+	}
+	now := clock.Now().UTC().Format(icalTimeFmt)
+
+	writeICalLine(w, "BEGIN:VCALENDAR")
+	writeICalLine(w, "VERSION:2.0")
+	writeICalLine(w, "PRODID:-//janelia-flyem//librarian//EN")
+	writeICalLine(w, "CALSCALE:GREGORIAN")
+	writeICalLine(w, "X-WR-CALNAME:"+icalEscape("Librarian locks for "+clientid))
+	for _, lease := range getLeases(clientid) {
+		writeICalLine(w, "BEGIN:VEVENT")
+		writeICalLine(w, fmt.Sprintf("UID:%s-%d@%s", lease.uuid, lease.label, hostname))
+		writeICalLine(w, "DTSTAMP:"+now)
+		writeICalLine(w, "DTSTART:"+lease.expires.UTC().Format(icalTimeFmt))
+		writeICalLine(w, "DTEND:"+lease.expires.Add(CalendarEventLength).UTC().Format(icalTimeFmt))
+		writeICalLine(w, "SUMMARY:"+icalEscape(fmt.Sprintf("Lock on label %d of uuid %s expires", lease.label, lease.uuid)))
+		desc := fmt.Sprintf("Label %d of uuid %s was checked out by %s at %s.\nCheck it out again to renew the lease.",
+			lease.label, lease.uuid, clientid, lease.since.Format(time.RFC3339))
+		writeICalLine(w, "DESCRIPTION:"+icalEscape(desc))
+		writeICalLine(w, "END:VEVENT")
+	}
+	writeICalLine(w, "END:VCALENDAR")
+}
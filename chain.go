@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const verifyHelp = `
+Usage: librarian verify /path/to/librarian.log
+
+Checks the integrity of a librarian log and its compacted segments.  Each compaction starts
+the new log with a "chain" op holding the SHA-256 of the segment it moved the old log into,
+along with the segment's number of lines, range of op times, and CRC-32C, which the server
+also checks at startup.  Since each segment starts with the chain op of the compaction before
+it, the hashes link every segment, so changing, removing, or reordering any line of history
+breaks the chain.  The current log isn't hashed
+since it is still being written, but its chain op must match the latest segment.
+
+Segments compacted before chain ops were added are reported as unchained.  After the first
+chain op, every later log must have one.  Compressed ".gz" segments are hashed as their
+uncompressed contents.  Rewriting segments, e.g., with "librarian normalize", breaks the chain.
+Segments of history imported by POST /admin/import-history aren't chained and are reported
+as imported.
+
+Returns exit code 0 if the chain is intact, or 1 with the broken links listed otherwise.
+
+  -h, -help          (flag)    Show help message
+`
+
+// logDigestT summarizes a log file for its link in the chain.
+type logDigestT struct {
+	sha256 string
+	crc32  uint32 // CRC-32C, also checked at startup
+	lines  int
+	from   time.Time // time of the first op
+	to     time.Time // time of the last op
+}
+
+// Hashes a log file, which can be gzipped, checking that every line is an op.
+func digestLogFile(fname string) (logDigestT, error) {
+	var d logDigestT
+	f, err := openLogFile(fname)
+	if err != nil {
+		return d, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	c := crc32.New(crcTable)
+	r := bufio.NewReader(io.TeeReader(f, io.MultiWriter(h, c)))
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			if line != "" {
+				return d, fmt.Errorf("%s: last line has no terminating newline", fname)
+			}
+			break
+		}
+		if err != nil {
+			return d, err
+		}
+		op, err := parseLogLine(line)
+		if err != nil {
+			return d, fmt.Errorf("%s, line %d: %v", fname, d.lines+1, err)
+		}
+		if d.lines == 0 {
+			d.from = op.t
+		}
+		d.to = op.t
+		d.lines++
+	}
+	d.sha256 = hex.EncodeToString(h.Sum(nil))
+	d.crc32 = c.Sum32()
+	return d, nil
+}
+
+// Returns the chain op written at the start of a log compacted into the given segment.
+func chainOp(segment string, d logDigestT) *libraryOp {
+	attrs := map[string]string{
+		"segment": filepath.Base(segment),
+		"sha256":  d.sha256,
+		"crc32":   formatCRC(d.crc32),
+		"lines":   strconv.Itoa(d.lines),
+	}
+	if d.lines > 0 {
+		from, _ := d.from.UTC().MarshalText()
+		to, _ := d.to.UTC().MarshalText()
+		attrs["from"], attrs["to"] = string(from), string(to)
+	}
+	return &libraryOp{op: ChainOp, uuid: "n/a", client: "n/a", attrs: attrs}
+}
+
+// Returns the chain op at the start of a log file, or nil if it doesn't start with one.
+func readChainOp(fname string) (*libraryOp, error) {
+	f, err := openLogFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	op, err := parseLogLine(line)
+	if err != nil {
+		return nil, fmt.Errorf("%s, line 1: %v", fname, err)
+	}
+	if op.op != ChainOp {
+		return nil, nil
+	}
+	return op, nil
+}
+
+// Returns the problem with the link from a log to the segment before it, or "" if the
+// chain op of the log matches the segment.
+func checkChainLink(chain *libraryOp, segment string, d logDigestT) string {
+	name := strings.TrimSuffix(filepath.Base(segment), gzipSuffix)
+	if chain.attrs["segment"] != name {
+		return fmt.Sprintf("links to segment %q, not %q, which may be missing", chain.attrs["segment"], name)
+	}
+	if chain.attrs["sha256"] != d.sha256 {
+		return fmt.Sprintf("SHA-256 of segment %s is %s, not %s as recorded at compaction", name, d.sha256, chain.attrs["sha256"])
+	}
+	if chain.attrs["lines"] != strconv.Itoa(d.lines) {
+		return fmt.Sprintf("segment %s has %d lines, not %s as recorded at compaction", name, d.lines, chain.attrs["lines"])
+	}
+	return ""
+}
+
+// Checks the chain of a log and its segments, writing a line per file to w.  Returns
+// the number of broken links.
+func verifyChain(fname string, w io.Writer) (int, error) {
+	segments, err := logSegments(fname)
+	if err != nil {
+		return 0, err
+	}
+	files := append(segments, fname)
+	broken := 0
+	chained := false
+	var prev string
+	var prevDigest logDigestT
+	for i, file := range files {
+		chain, err := readChainOp(file)
+		if err != nil {
+			return broken, err
+		}
+		imported := strings.HasSuffix(strings.TrimSuffix(file, gzipSuffix), importSegmentSuffix)
+		var problem string
+		switch {
+		case imported:
+			fmt.Fprintf(w, "IMPORTED   %s: history imported by POST /admin/import-history\n", filepath.Base(file))
+		case chain == nil && chained:
+			problem = "has no chain op though an earlier log does"
+		case chain == nil && i > 0:
+			fmt.Fprintf(w, "UNCHAINED  %s: compacted before chain ops\n", filepath.Base(file))
+		case chain != nil && i == 0:
+			problem = fmt.Sprintf("links to segment %q, which is missing", chain.attrs["segment"])
+		case chain != nil:
+			chained = true
+			problem = checkChainLink(chain, prev, prevDigest)
+		}
+		if problem != "" {
+			broken++
+			fmt.Fprintf(w, "BROKEN     %s: %s\n", filepath.Base(file), problem)
+		}
+
+		if file == fname {
+			if problem == "" && chain != nil {
+				fmt.Fprintf(w, "OK         %s: links to %s\n", filepath.Base(file), chain.attrs["segment"])
+			}
+			break
+		}
+		if prevDigest, err = digestLogFile(file); err != nil {
+			return broken, err
+		}
+		prev = file
+		if problem == "" && !imported && (chain != nil || i == 0) {
+			fmt.Fprintf(w, "OK         %s: %d lines from %s to %s, SHA-256 %s\n", filepath.Base(file), prevDigest.lines,
+				prevDigest.from.Format(time.RFC3339), prevDigest.to.Format(time.RFC3339), prevDigest.sha256)
+		}
+	}
+	return broken, nil
+}
+
+// Runs the verify subcommand and returns the exit code.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf(verifyHelp)
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		return 1
+	}
+	if _, err := os.Stat(positional[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find librarian log: %v\n", err)
+		return 1
+	}
+	broken, err := verifyChain(positional[0], os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to verify librarian log: %v\n", err)
+		return 1
+	}
+	if broken > 0 {
+		fmt.Printf("Chain of %s is broken at %d links\n", positional[0], broken)
+		return 1
+	}
+	fmt.Printf("Chain of %s is intact\n", positional[0])
+	return 0
+}
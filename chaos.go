@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// ChaosHolder is the client given as the holder of conflicts injected by -chaos.
+	ChaosHolder = "chaos"
+
+	// ChaosHeader is the response header naming a failure injected by -chaos, so client
+	// tests can tell injected failures from real ones.
+	ChaosHeader = "X-Librarian-Chaos"
+
+	// DefaultChaosMaxDelay is the longest delay injected by -chaos unless "maxdelay" is given.
+	DefaultChaosMaxDelay = time.Second
+)
+
+// Injected failures, exported via expvar at /debug/vars.
+var (
+	chaosConflictsVar = expvar.NewInt("librarian_chaos_conflicts")
+	chaosDelaysVar    = expvar.NewInt("librarian_chaos_delays")
+	chaosDropsVar     = expvar.NewInt("librarian_chaos_drops")
+)
+
+// chaosT is the misbehavior injected by -chaos so client tools can test their retries and
+// conflict handling.  Rates are the fraction of requests affected.
+type chaosT struct {
+	conflict  float64 // checkouts refused with a 409 status without changing any lock
+	delay     float64 // requests delayed by up to maxDelay
+	maxDelay  time.Duration
+	drop      float64 // connections closed without a response before the request is handled
+	dropAfter float64 // connections closed without a response after the request is handled
+	skew      time.Duration
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// The failures to inject, or nil without -chaos.
+var chaos *chaosT
+
+// Parses a -chaos spec like "conflict=0.1,delay=0.2,maxdelay=2s,drop=0.05,skew=-90s,seed=7".
+func parseChaos(spec string) (*chaosT, error) {
+	c := &chaosT{maxDelay: DefaultChaosMaxDelay}
+	seed := time.Now().UnixNano()
+	for _, part := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			return nil, fmt.Errorf("bad -chaos %q: %q isn't of the form name=value", spec, part)
+		}
+		var err error
+		switch key {
+		case "conflict":
+			c.conflict, err = parseChaosRate(value)
+		case "delay":
+			c.delay, err = parseChaosRate(value)
+		case "drop":
+			c.drop, err = parseChaosRate(value)
+		case "dropafter":
+			c.dropAfter, err = parseChaosRate(value)
+		case "maxdelay":
+			if c.maxDelay, err = time.ParseDuration(value); err == nil && c.maxDelay <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "skew":
+			c.skew, err = time.ParseDuration(value)
+		case "seed":
+			seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("bad -chaos %q: unknown failure %q", spec, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad -chaos %s %q: %v", key, value, err)
+		}
+	}
+	c.rng = rand.New(rand.NewSource(seed))
+	return c, nil
+}
+
+func parseChaosRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("must be a fraction from 0 to 1")
+	}
+	return rate, nil
+}
+
+// Starts injecting failures given by a -chaos spec.
+func initChaos(spec string) error {
+	c, err := parseChaos(spec)
+	if err != nil {
+		return err
+	}
+	chaos = c
+	log.Printf("WARNING: -chaos is injecting failures for testing clients: %s\n", spec)
+	return nil
+}
+
+// Returns true with the given probability.
+func (c *chaosT) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng.Float64() < rate
+}
+
+// Returns a random duration up to max.
+func (c *chaosT) duration(max time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.rng.Int63n(int64(max) + 1))
+}
+
+// Returns how far -chaos skews the times in responses to a request path.
+func chaosSkew(path string) time.Duration {
+	if chaos == nil || chaosExempt(path) {
+		return 0
+	}
+	return chaos.skew
+}
+
+// Returns true for paths that -chaos leaves alone, so tests can still control and check
+// the server.
+func chaosExempt(path string) bool {
+	return isAdminPath(path) || strings.HasPrefix(path, "/healthz") || strings.HasPrefix(path, "/debug/")
+}
+
+// Matches an RFC 3339 time in a JSON string.
+var chaosTimeRegexp = regexp.MustCompile(`"\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})"`)
+
+// Shifts the RFC 3339 times in JSON by a skew.
+func skewTimes(b []byte, skew time.Duration) []byte {
+	return chaosTimeRegexp.ReplaceAllFunc(b, func(quoted []byte) []byte {
+		t, err := time.Parse(time.RFC3339Nano, string(quoted[1:len(quoted)-1]))
+		if err != nil {
+			return quoted
+		}
+		return []byte(`"` + t.Add(skew).Format(time.RFC3339Nano) + `"`)
+	})
+}
+
+// skewWriter shifts the times in JSON and event stream responses by a -chaos skew, as if
+// the server clock were off, without changing the times of logged ops.
+type skewWriter struct {
+	http.ResponseWriter
+	skew time.Duration
+}
+
+func (sw *skewWriter) WriteHeader(status int) {
+	sw.Header().Del("Content-Length") // skewed times can change length
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *skewWriter) Write(p []byte) (int, error) {
+	contentType, _, _ := strings.Cut(sw.Header().Get("Content-Type"), ";")
+	if contentType != "application/json" && contentType != "text/event-stream" {
+		return sw.ResponseWriter.Write(p)
+	}
+	sw.Header().Del("Content-Length")
+	if _, err := sw.ResponseWriter.Write(skewTimes(p, sw.skew)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Lets http.ResponseController flush, hijack, and set deadlines through the writer.
+func (sw *skewWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// Returns true for requests that check out labels.
+func checkoutRequest(r *http.Request) bool {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodPut:
+		return path == "/checkout" || (strings.HasPrefix(path, "/checkout/") && strings.Count(path, "/") == 4)
+	case http.MethodPost:
+		return path == "/checkout-multi"
+	}
+	return false
+}
+
+// Returns the uuid and label of a checkout request, reading a JSON body if needed and
+// leaving it to be handled.
+func chaosCheckoutLabel(r *http.Request) (string, uint64) {
+	if parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(parts) == 4 {
+		label, _ := parseLabel(parts[1], parts[2])
+		return parts[1], label
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxOpBodySize))
+	if err != nil {
+		return "", 0
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var op opBodyJSON
+	var multi multiCheckoutBodyJSON
+	if json.Unmarshal(body, &multi) == nil && len(multi.Labels) > 0 {
+		op.UUID, op.Label = multi.Labels[0].UUID, multi.Labels[0].Label
+	} else if json.Unmarshal(body, &op) != nil {
+		return "", 0
+	}
+	label, _ := op.label()
+	return op.UUID, label
+}
+
+// Writes a 409 response like a real conflict with a label held by ChaosHolder.
+func writeChaosConflict(w http.ResponseWriter, r *http.Request) {
+	uuid, label := chaosCheckoutLabel(r)
+	now := clock.Now()
+	retryAfter := 1 + int(chaos.duration(29*time.Second)/time.Second)
+	conflict := conflictJSON{
+		Error:             fmt.Sprintf("could not do checkout: uuid %s, label %d - already checked out by %s (%s).", uuid, label, ChaosHolder, r.URL.Path),
+		Code:              AlreadyCheckedOutCode,
+		Label:             labelJSON{label, getPolicy(uuid).LabelOutput},
+		Client:            ChaosHolder,
+		Since:             now,
+		HolderLastActive:  now,
+		EstimatedRelease:  now.Add(time.Duration(retryAfter) * time.Second),
+		RetryAfterSeconds: retryAfter,
+	}
+	jsonBytes, err := json.Marshal(conflict)
+	if err != nil {
+		writeErrorCode(w, http.StatusConflict, AlreadyCheckedOutCode, conflict.Error)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusConflict)
+	w.Write(jsonBytes)
+	fmt.Fprintln(w)
+}
+
+// discardWriter swallows a response that -chaos drops after the request is handled.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+// chaosHandler injects the failures given by -chaos into requests other than /admin,
+// /healthz, and /debug ones, so tests can still control and check the server.  Dropped
+// connections abort the request, which closes the connection without a response.
+func chaosHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if chaos == nil || chaosExempt(path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if chaos.skew != 0 {
+			w.Header().Set("Date", clock.Now().Add(chaos.skew).UTC().Format(http.TimeFormat))
+			w = &skewWriter{w, chaos.skew}
+		}
+		if chaos.roll(chaos.delay) {
+			delay := chaos.duration(chaos.maxDelay)
+			chaosDelaysVar.Add(1)
+			log.Printf("Chaos: delaying %s %s by %s\n", r.Method, path, delay)
+			w.Header().Set(ChaosHeader, "delay")
+			time.Sleep(delay)
+		}
+		if chaos.roll(chaos.drop) {
+			chaosDropsVar.Add(1)
+			log.Printf("Chaos: dropping connection of %s %s before handling it\n", r.Method, path)
+			panic(http.ErrAbortHandler)
+		}
+		if checkoutRequest(r) && chaos.roll(chaos.conflict) {
+			chaosConflictsVar.Add(1)
+			log.Printf("Chaos: refusing %s %s with a conflict\n", r.Method, path)
+			w.Header().Set(ChaosHeader, "conflict")
+			writeChaosConflict(w, r)
+			return
+		}
+		if chaos.roll(chaos.dropAfter) {
+			h.ServeHTTP(&discardWriter{header: make(http.Header)}, r)
+			chaosDropsVar.Add(1)
+			log.Printf("Chaos: dropping connection of %s %s after handling it\n", r.Method, path)
+			panic(http.ErrAbortHandler)
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CRC-32 table for log checksums.  Castagnoli is hardware accelerated on most CPUs.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Log checksums and syncs, exported via expvar at /debug/vars.
+var (
+	logCRCVar         = expvar.NewInt("librarian_log_crc32")
+	segmentCRCVar     = expvar.NewMap("librarian_log_segment_crc32")
+	lastFsyncVar      = expvar.NewInt("librarian_log_last_fsync")
+	corruptSegmentVar = expvar.NewInt("librarian_log_segments_corrupt")
+)
+
+var checksums struct {
+	sync.RWMutex
+	segments  map[string]uint32 // segment name without ".gz" -> CRC-32C of its contents
+	corrupt   []string          // segments whose CRC doesn't match the one recorded at compaction
+	lastFsync time.Time
+}
+
+func formatCRC(crc uint32) string {
+	return fmt.Sprintf("%08x", crc)
+}
+
+// Returns the CRC-32C of a log file, which can be gzipped.
+func crcLogFile(fname string) (uint32, error) {
+	f, err := openLogFile(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.New(crcTable)
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// Notes the CRC of a log segment.
+func setSegmentCRC(segment string, crc uint32) {
+	name := strings.TrimSuffix(filepath.Base(segment), gzipSuffix)
+	checksums.Lock()
+	checksums.segments[name] = crc
+	checksums.Unlock()
+
+	v := new(expvar.Int)
+	v.Set(int64(crc))
+	segmentCRCVar.Set(name, v)
+}
+
+// Notes a log file whose contents don't match its recorded CRC.
+func noteCorruptSegment(name, problem string) {
+	log.Printf("ERROR: librarian log %s may be corrupt on disk: %s\n", name, problem)
+	checksums.Lock()
+	checksums.corrupt = append(checksums.corrupt, name)
+	checksums.Unlock()
+	corruptSegmentVar.Add(1)
+}
+
+// Computes the CRC of the current log, which later writes roll forward, and notes the CRC
+// of each segment recorded in the chain op of the log compacted after it, so startup doesn't
+// wait on reading every segment.  The segments are checked against their recorded CRCs in
+// the background.  Returns the CRC of the current log.
+func initLogChecksums(fname string, segments []string) (uint32, error) {
+	checksums.Lock()
+	checksums.segments = make(map[string]uint32, len(segments))
+	checksums.corrupt = nil
+	checksums.Unlock()
+	segmentCRCVar.Init()
+	corruptSegmentVar.Set(0)
+
+	files := append(segments, fname)
+	recorded := make(map[string]string, len(segments))
+	for i, segment := range segments {
+		chain, err := readChainOp(files[i+1])
+		if err != nil {
+			return 0, err
+		}
+		if chain == nil || chain.attrs["crc32"] == "" {
+			continue // compacted before checksums were recorded
+		}
+		crc, err := strconv.ParseUint(chain.attrs["crc32"], 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("bad crc32 %q in chain op of %q: %v", chain.attrs["crc32"], files[i+1], err)
+		}
+		setSegmentCRC(segment, uint32(crc))
+		recorded[segment] = chain.attrs["crc32"]
+	}
+	if len(segments) > 0 {
+		go verifySegments(segments, recorded)
+	}
+	crc, err := crcLogFile(fname)
+	if err != nil {
+		return 0, fmt.Errorf("cannot checksum librarian log: %v", err)
+	}
+	logCRCVar.Set(int64(crc))
+	return crc, nil
+}
+
+// Checks log segments against the CRCs recorded at compaction, noting the CRCs of those
+// compacted before checksums were recorded.  Corrupt segments are logged and counted but
+// don't stop the server, since only history reads use them.
+func verifySegments(segments []string, recorded map[string]string) {
+	for _, segment := range segments {
+		crc, err := crcLogFile(segment)
+		if err != nil {
+			log.Printf("ERROR: cannot checksum log segment %q: %v\n", segment, err)
+			continue
+		}
+		want, found := recorded[segment]
+		if !found {
+			setSegmentCRC(segment, crc)
+		} else if want != formatCRC(crc) {
+			noteCorruptSegment(filepath.Base(segment), fmt.Sprintf("CRC-32C is %s, not %s as recorded at compaction", formatCRC(crc), want))
+		}
+	}
+	log.Printf("Checked the CRCs of %d librarian log segments\n", len(segments))
+}
+
+// Syncs the librarian log to disk.
+func syncLog() error {
+	library.RLock()
+	err := library.f.Sync()
+	library.RUnlock()
+	if err != nil {
+		return err
+	}
+	noteFsync()
+	return nil
+}
+
+// Notes that the librarian log was just synced to disk.
+func noteFsync() {
+	now := clock.Now()
+	checksums.Lock()
+	checksums.lastFsync = now
+	checksums.Unlock()
+	lastFsyncVar.Set(now.Unix())
+}
+
+// Syncs the librarian log every interval so a crash or NFS failover loses at most that
+// much acknowledged history.
+func syncLogEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := syncLog(); err != nil {
+			log.Printf("ERROR: unable to sync librarian log: %v\n", err)
+		}
+	}
+}
+
+// logChecksumsJSON gives the checksums of the log and its segments in GET /admin/storage.
+type logChecksumsJSON struct {
+	LogCRC32        string
+	SegmentCRC32    map[string]string
+	CorruptSegments []string
+	LastFsync       time.Time
+}
+
+func getLogChecksums() logChecksumsJSON {
+	library.RLock()
+	cs := logChecksumsJSON{LogCRC32: formatCRC(library.crc), SegmentCRC32: make(map[string]string)}
+	library.RUnlock()
+
+	checksums.RLock()
+	defer checksums.RUnlock()
+	for name, crc := range checksums.segments {
+		cs.SegmentCRC32[name] = formatCRC(crc)
+	}
+	cs.CorruptSegments = append([]string{}, checksums.corrupt...)
+	sort.Strings(cs.CorruptSegments)
+	cs.LastFsync = checksums.lastFsync
+	return cs
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientNotifySuffix is appended to the librarian log name for the file of clients'
+// notification preferences.
+const clientNotifySuffix = ".clientnotify"
+
+// ClientNotifyQueueSize is the most events waiting for delivery to a client's webhook or
+// email.  Later events are dropped until some are delivered.
+const ClientNotifyQueueSize = 100
+
+// Events dropped because their client's queue was full, exported via expvar at /debug/vars.
+var clientNotifyDroppedVar = expvar.NewInt("librarian_client_notifications_dropped")
+
+// Events a client can have sent to its own webhook or email.
+var clientNotifyEvents = map[string]bool{
+	LeaseExpiringEvent:     true,
+	LeaseExpiredEvent:      true,
+	InactivityWarningEvent: true,
+	InactivityCheckinEvent: true,
+	ReminderEvent:          true,
+	ConflictEvent:          true,
+	LockChangedEvent:       true,
+	FreezeWarningEvent:     true,
+	ForceReleasedEvent:     true,
+	LabelMutatedEvent:      true,
+}
+
+// clientNotifyJSON is where and about which events a client wants to be notified.
+type clientNotifyJSON struct {
+	Client  string
+	Webhook string   `json:",omitempty"` // URL the events are posted to as JSON
+	Email   string   `json:",omitempty"` // address the events are sent to through -smtp
+	Events  []string // e.g., "force-released", "lock-changed", and "lease-expiring"
+	Updated time.Time
+}
+
+// Notification preferences by client, saved beside the librarian log.
+var clientNotify = struct {
+	sync.RWMutex
+	fname string
+	prefs map[string]*clientNotifyJSON
+}{
+	prefs: make(map[string]*clientNotifyJSON),
+}
+
+// Loads the clients' notification preferences saved beside a librarian log.
+func initClientNotify(logfile string) error {
+	clientNotify.Lock()
+	defer clientNotify.Unlock()
+
+	clientNotify.fname = logfile + clientNotifySuffix
+	data, err := os.ReadFile(clientNotify.fname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []*clientNotifyJSON
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("bad client notifications file %q: %v", clientNotify.fname, err)
+	}
+	for _, prefs := range saved {
+		clientNotify.prefs[prefs.Client] = prefs
+	}
+	return nil
+}
+
+// Writes the notification preferences to their file.  Must be called with clientNotify
+// locked.
+func saveClientNotify() {
+	if clientNotify.fname == "" {
+		return
+	}
+	saved := make([]*clientNotifyJSON, 0, len(clientNotify.prefs))
+	for _, prefs := range clientNotify.prefs {
+		saved = append(saved, prefs)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Client < saved[j].Client })
+	data, err := json.Marshal(saved)
+	if err == nil {
+		tmpname := clientNotify.fname + ".tmp"
+		if err = os.WriteFile(tmpname, data, 0664); err == nil {
+			err = os.Rename(tmpname, clientNotify.fname)
+		}
+	}
+	if err != nil {
+		log.Printf("ERROR: unable to save client notifications to %q: %v\n", clientNotify.fname, err)
+	}
+}
+
+// Sets where and about which events a client is notified, replacing earlier preferences.
+func setClientNotify(client string, prefs clientNotifyJSON) (clientNotifyJSON, error) {
+	if prefs.Webhook == "" && prefs.Email == "" {
+		return clientNotifyJSON{}, fmt.Errorf("a Webhook or Email is needed")
+	}
+	if err := checkNotifyTargets(prefs.Webhook, prefs.Email, false); err != nil {
+		return clientNotifyJSON{}, err
+	}
+	if len(prefs.Events) == 0 {
+		return clientNotifyJSON{}, fmt.Errorf("no Events to be notified of")
+	}
+	seen := make(map[string]bool, len(prefs.Events))
+	events := make([]string, 0, len(prefs.Events))
+	for _, event := range prefs.Events {
+		if !clientNotifyEvents[event] {
+			return clientNotifyJSON{}, fmt.Errorf("bad event %q", event)
+		}
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+	sort.Strings(events)
+	prefs.Client, prefs.Events, prefs.Updated = client, events, clock.Now()
+
+	clientNotify.Lock()
+	defer clientNotify.Unlock()
+	clientNotify.prefs[client] = &prefs
+	saveClientNotify()
+	return prefs, nil
+}
+
+// Returns a client's notification preferences, if set.
+func getClientNotify(client string) (clientNotifyJSON, bool) {
+	clientNotify.RLock()
+	defer clientNotify.RUnlock()
+
+	prefs, found := clientNotify.prefs[client]
+	if !found {
+		return clientNotifyJSON{}, false
+	}
+	return *prefs, true
+}
+
+// Stops notifying a client, returning false if it had no preferences.
+func deleteClientNotify(client string) bool {
+	clientNotify.Lock()
+	defer clientNotify.Unlock()
+
+	if _, found := clientNotify.prefs[client]; !found {
+		return false
+	}
+	delete(clientNotify.prefs, client)
+	saveClientNotify()
+	return true
+}
+
+// Returns true if a webhook host or email domain is allowed by -notifyhosts.
+func notifyHostAllowed(host string) bool {
+	configMu.RLock()
+	hosts := *notifyHosts
+	configMu.RUnlock()
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range strings.Split(hosts, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		switch {
+		case allowed == "":
+		case strings.HasPrefix(allowed, "."):
+			if host == allowed[1:] || strings.HasSuffix(host, allowed) {
+				return true
+			}
+		case host == allowed:
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error for addresses of the librarian's own host or its link, e.g., a cloud
+// metadata service, which clients' webhooks mustn't reach.
+func checkNotifyIP(host string, ip net.IP) error {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("webhook host %q is a loopback or link-local address %s", host, ip)
+	}
+	return nil
+}
+
+// Checks a client's webhook URL and email address against -notifyhosts.  Webhooks to
+// loopback or link-local addresses are refused, and if resolve, the webhook host's
+// addresses are looked up and checked too.
+func checkNotifyTargets(webhook, email string, resolve bool) error {
+	if webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("bad Webhook %q: must be an http or https URL", webhook)
+		}
+		host := u.Hostname()
+		if !notifyHostAllowed(host) {
+			return fmt.Errorf("bad Webhook %q: host %q isn't allowed by -notifyhosts", webhook, host)
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if err := checkNotifyIP(host, ip); err != nil {
+				return err
+			}
+		} else if strings.EqualFold(strings.TrimSuffix(host, "."), "localhost") {
+			return fmt.Errorf("webhook host %q is the librarian's own host", host)
+		} else if resolve {
+			// A host that can't be looked up fails delivery, which is retried.
+			ips, _ := net.LookupIP(host)
+			for _, ip := range ips {
+				if err := checkNotifyIP(host, ip); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil {
+			return fmt.Errorf("bad Email %q: %v", email, err)
+		}
+		domain := addr.Address[strings.LastIndex(addr.Address, "@")+1:]
+		if !notifyHostAllowed(domain) {
+			return fmt.Errorf("bad Email %q: domain %q isn't allowed by -notifyhosts", email, domain)
+		}
+	}
+	return nil
+}
+
+// clientEventT is an event queued for delivery to its client's webhook or email.
+type clientEventT struct {
+	ev      eventJSON
+	webhook string
+	email   string
+}
+
+// Events waiting for delivery by client.  A client has an entry while its events are being
+// delivered, one at a time, by its own goroutine.
+var clientQueues = struct {
+	sync.Mutex
+	queued map[string][]clientEventT
+}{queued: make(map[string][]clientEventT)}
+
+// Sends an event to its client's webhook or email if the client asked for it.  Events are
+// queued for delivery in the background since they are sent with library lock held, and
+// dropped if the client already has ClientNotifyQueueSize events waiting.
+func notifyClient(ev eventJSON) {
+	clientNotify.RLock()
+	var webhook, email string
+	wanted := false
+	if prefs, found := clientNotify.prefs[ev.Client]; found {
+		for _, event := range prefs.Events {
+			wanted = wanted || event == ev.Event
+		}
+		webhook, email = prefs.Webhook, prefs.Email
+	}
+	clientNotify.RUnlock()
+	if !wanted {
+		return
+	}
+
+	clientQueues.Lock()
+	defer clientQueues.Unlock()
+	queue, delivering := clientQueues.queued[ev.Client]
+	if len(queue) >= ClientNotifyQueueSize {
+		clientNotifyDroppedVar.Add(1)
+		log.Printf("WARNING: dropped %s event for uuid %s, label %d to %s since %d of its events are waiting\n",
+			ev.Event, ev.UUID, ev.Label.label, ev.Client, len(queue))
+		return
+	}
+	clientQueues.queued[ev.Client] = append(queue, clientEventT{ev, webhook, email})
+	if !delivering {
+		go deliverClientEvents(ev.Client)
+	}
+}
+
+// Delivers a client's queued events in order until none are left.
+func deliverClientEvents(client string) {
+	for {
+		clientQueues.Lock()
+		queue := clientQueues.queued[client]
+		if len(queue) == 0 {
+			delete(clientQueues.queued, client)
+			clientQueues.Unlock()
+			return
+		}
+		ce := queue[0]
+		clientQueues.queued[client] = queue[1:]
+		clientQueues.Unlock()
+
+		ce.deliver()
+	}
+}
+
+func (ce clientEventT) deliver() {
+	ev := ce.ev
+	what := fmt.Sprintf("%s event for uuid %s, label %d to %s", ev.Event, ev.UUID, ev.Label.label, ev.Client)
+	if err := checkNotifyTargets(ce.webhook, ce.email, true); err != nil {
+		log.Printf("ERROR: not sending %s: %v\n", what, err)
+		return
+	}
+	if ce.webhook != "" {
+		if err := notifyWebhook(what, ce.webhook, ev); err != nil {
+			log.Printf("ERROR: unable to post %s: %v\n", what, err)
+		}
+	}
+	if ce.email != "" {
+		if err := emailClientEvent(what, ce.email, ev); err != nil {
+			log.Printf("ERROR: unable to email %s: %v\n", what, err)
+		}
+	}
+}
+
+// Emails an event through the -smtp server.
+func emailClientEvent(what, to string, ev eventJSON) error {
+	configMu.RLock()
+	from := *digestFrom
+	configMu.RUnlock()
+
+	label := strings.Trim(formatLabelJSON(ev.Label.label, ev.Label.format), `"`)
+	body, err := json.MarshalIndent(ev, "", "  ")
+	if err != nil {
+		return err
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: Librarian %s: label %s of %s\r\n", ev.Event, label, ev.UUID)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "The librarian sent a %q event for label %s of uuid %s:\r\n\r\n", ev.Event, label, ev.UUID)
+	msg.WriteString(strings.ReplaceAll(string(body), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return notifyEmail(what, from, []string{to}, []byte(msg.String()))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Client id normalizations for -clientnorm.
+const (
+	TrimClientIDs  = "trim"  // remove leading and trailing whitespace
+	LowerClientIDs = "lower" // fold to lower case
+)
+
+var (
+	clientNormalizers []func(string) string
+	clientCharset     *regexp.Regexp
+)
+
+// Sets up client id normalization from the -clientnorm and -clientchars options.
+func initClientIDs(norms, chars string) error {
+	clientNormalizers = nil
+	for _, norm := range strings.Split(norms, ",") {
+		switch strings.TrimSpace(norm) {
+		case "":
+		case TrimClientIDs:
+			clientNormalizers = append(clientNormalizers, strings.TrimSpace)
+		case LowerClientIDs:
+			clientNormalizers = append(clientNormalizers, strings.ToLower)
+		default:
+			return fmt.Errorf("client id normalization %q must be %q or %q", norm, TrimClientIDs, LowerClientIDs)
+		}
+	}
+	clientCharset = nil
+	if chars != "" {
+		var err error
+		if clientCharset, err = regexp.Compile("^(?:" + chars + ")$"); err != nil {
+			return fmt.Errorf("bad -clientchars regexp: %v", err)
+		}
+	}
+	return nil
+}
+
+// Returns the normalized form of a client id.  The "n/a" id used for ops without a
+// client is left alone.
+func normalizeClientID(clientid string) string {
+	if clientid == "n/a" {
+		return clientid
+	}
+	for _, norm := range clientNormalizers {
+		clientid = norm(clientid)
+	}
+	return clientid
+}
+
+// Normalizes a client id given to the API and checks it can be used.
+func checkClientID(clientid string) (string, error) {
+	clientid = normalizeClientID(clientid)
+	if clientid == "" {
+		return "", fmt.Errorf("client id cannot be empty")
+	}
+	if strings.IndexFunc(clientid, unicode.IsSpace) >= 0 {
+		return "", fmt.Errorf("client id %q cannot contain whitespace", clientid)
+	}
+	if clientCharset != nil && !clientCharset.MatchString(clientid) {
+		return "", fmt.Errorf("client id %q does not match allowed characters %q", clientid, *clientChars)
+	}
+	return clientid, nil
+}
+
+const normalizeHelp = `
+Usage: librarian normalize [options] /path/to/librarian.log
+
+Rewrites a librarian log with client ids normalized as given by -clientnorm.  Run it on
+each segment of a compacted log as well.  Compressed ".gz" segments are read transparently
+but written uncompressed.  Stop the server before replacing its log.  Rewritten segments no
+longer match the hashes checked by "librarian verify".
+
+      -clientnorm    =string   Comma-separated normalizations: "trim" and/or "lower".
+                               Default is "trim,lower".
+      -o             =string   Write the normalized log to this file instead of standard output.
+      -statedb       =string   State db of the server, which is cleared so the server rebuilds
+                               it with normalized client ids from the log when next started.
+  -h, -help          (flag)    Show help message
+`
+
+// Rewrites a log with normalized client ids, returning the number of changed lines.
+func normalizeLog(r io.Reader, w io.Writer) (int, error) {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	changed := 0
+	for {
+		line, err := br.ReadString('\n')
+		last := err == io.EOF
+		if last && line == "" {
+			break
+		}
+		if err != nil && !last {
+			return changed, err
+		}
+		op, err := parseLogLine(line) // normalizes client ids
+		if err != nil && last {
+			// An unterminated final line that doesn't parse is copied as is, so the server
+			// recovers it like any interrupted write.
+			if _, err := bw.WriteString(line); err != nil {
+				return changed, err
+			}
+			break
+		}
+		if err != nil {
+			return changed, err
+		}
+		newLine, err := formatLogLine(op, op.t)
+		if err != nil {
+			return changed, err
+		}
+		if newLine != line {
+			changed++
+		}
+		if _, err := bw.WriteString(newLine); err != nil {
+			return changed, err
+		}
+		if last {
+			break
+		}
+	}
+	return changed, bw.Flush()
+}
+
+func runNormalize(args []string) int {
+	fs := flag.NewFlagSet("normalize", flag.ExitOnError)
+	norms := fs.String("clientnorm", TrimClientIDs+","+LowerClientIDs, "")
+	outFile := fs.String("o", "", "")
+	dbFile := fs.String("statedb", "", "")
+	fs.Usage = func() {
+		fmt.Printf(normalizeHelp)
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		return 1
+	}
+	if err := initClientIDs(*norms, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	in, err := openLogFile(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open librarian log: %v\n", err)
+		return 1
+	}
+	defer in.Close()
+
+	var w io.Writer = os.Stdout
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create normalized log: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	changed, err := normalizeLog(in, w)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to normalize librarian log: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Normalized client ids in %d lines of %s\n", changed, positional[0])
+	if *dbFile != "" {
+		if err := clearStateDB(*dbFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to clear state db %s: %v\n", *dbFile, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Cleared state db %s, which is rebuilt from the log at the next start\n", *dbFile)
+	}
+	return 0
+}
+
+// Replaces the state in a state db with empty state that doesn't match any log, so the
+// server rebuilds it from its log at the next start.
+func clearStateDB(fname string) error {
+	db, err := openStateStore(fname)
+	if err != nil {
+		return err
+	}
+	var lib libraryT
+	lib.init()
+	return db.syncAll(&lib)
+}
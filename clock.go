@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/janelia-flyem/go/cron"
+)
+
+// clockT is the time used for ops, leases, and scheduled jobs.  It is the system clock
+// unless -simclock is given, in which case time only moves when advanced through
+// POST /admin/clock, so leases, -dailyclear, and digests can be tested deterministically.
+type clockT struct {
+	sync.Mutex
+	simulated bool
+	t         time.Time
+	jobs      []*simJobT
+
+	// Held while advancing so scheduled jobs run in order, one advance at a time.
+	advancing sync.Mutex
+}
+
+// cronJobT is a job run on a 6-field cron schedule, e.g., "0 0 2 * * *" for 2 AM daily.
+type cronJobT struct {
+	spec string
+	fn   func()
+}
+
+// simJobT is a scheduled job run by a simulated clock instead of cron.
+type simJobT struct {
+	schedule cron.Schedule
+	next     time.Time
+	fn       func()
+}
+
+type clockJSON struct {
+	Time      time.Time
+	Simulated bool
+}
+
+var clock clockT
+
+// Location of times returned by the API, set by -timezone.  Log times are always UTC.
+var displayZone = time.Local
+
+// Sets the location of times returned by the API, e.g., "UTC" or "America/New_York".
+func initDisplayZone(name string) error {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("bad -timezone %q: %v", name, err)
+	}
+	displayZone = loc
+	return nil
+}
+
+// Starts a simulated clock at the given RFC 3339 time, or the current time if "now".
+func initSimClock(start string) error {
+	t := time.Now()
+	if start != "now" {
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, start); err != nil {
+			return fmt.Errorf("bad -simclock %q: must be \"now\" or an RFC 3339 time", start)
+		}
+	}
+	clock.Lock()
+	clock.simulated = true
+	clock.t = t
+	clock.Unlock()
+	log.Printf("Using simulated clock starting at %s\n", t.Format(time.RFC3339))
+	return nil
+}
+
+// Now returns the current time of the clock in the -timezone.
+func (c *clockT) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	if !c.simulated {
+		return time.Now().In(displayZone)
+	}
+	return c.t.In(displayZone)
+}
+
+func (c *clockT) Simulated() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.simulated
+}
+
+func (c *clockT) state() clockJSON {
+	return clockJSON{c.Now(), c.Simulated()}
+}
+
+// Replaces the jobs run by a simulated clock.
+func (c *clockT) schedule(cronJobs []cronJobT) error {
+	c.Lock()
+	defer c.Unlock()
+
+	var jobs []*simJobT
+	for _, job := range cronJobs {
+		schedule, err := cron.Parse(job.spec)
+		if err != nil {
+			return err
+		}
+		jobs = append(jobs, &simJobT{schedule, schedule.Next(c.t.In(displayZone)), job.fn})
+	}
+	c.jobs = jobs
+	return nil
+}
+
+// Moves a simulated clock forward to t, running each scheduled job at the times it would
+// have run in order.  Jobs run with the clock set to their scheduled time.
+func (c *clockT) advance(t time.Time) error {
+	c.advancing.Lock()
+	defer c.advancing.Unlock()
+
+	for {
+		c.Lock()
+		if !c.simulated {
+			c.Unlock()
+			return fmt.Errorf("clock is not simulated; start the server with -simclock")
+		}
+		if t.Before(c.t) {
+			c.Unlock()
+			return fmt.Errorf("clock can't go back from %s to %s", c.t.Format(time.RFC3339), t.Format(time.RFC3339))
+		}
+		var due *simJobT
+		for _, job := range c.jobs {
+			if !job.next.After(t) && (due == nil || job.next.Before(due.next)) {
+				due = job
+			}
+		}
+		if due == nil {
+			c.t = t
+			c.Unlock()
+			return nil
+		}
+		c.t = due.next
+		due.next = due.schedule.Next(due.next)
+		c.Unlock()
+		due.fn()
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxCommentLength is the longest comment on a label in bytes.
+const MaxCommentLength = 2000
+
+// MaxCommentsPerLabel is the most comments kept on a label.  The oldest are dropped.
+const MaxCommentsPerLabel = 100
+
+// commentT is a note left on a label, e.g., for the next proofreader to check it out.
+type commentT struct {
+	id      int // 1 for a label's first comment
+	replyTo int // id of the comment replied to, or 0
+	client  string
+	t       time.Time
+	text    string
+}
+
+type commentJSON struct {
+	ID      int
+	ReplyTo int `json:",omitempty"`
+	Author  string
+	Time    time.Time
+	Text    string
+}
+
+type commentsJSON struct {
+	UUID     string
+	Label    labelJSON
+	Comments []commentJSON
+}
+
+type commentRequestJSON struct {
+	Text    string
+	ReplyTo int    // id of a comment on the label, or 0 to start a thread
+	Client  string // author, which defaults to the authenticated client
+}
+
+func (cmt commentT) toJSON() commentJSON {
+	return commentJSON{cmt.id, cmt.replyTo, cmt.client, cmt.t, cmt.text}
+}
+
+// Returns the log op attributes of a comment.
+func (cmt commentT) attrs() map[string]string {
+	attrs := map[string]string{"id": strconv.Itoa(cmt.id), "text": cmt.text}
+	if cmt.replyTo != 0 {
+		attrs["reply"] = strconv.Itoa(cmt.replyTo)
+	}
+	return attrs
+}
+
+// Adds a comment to a label, replying to an earlier comment if replyTo isn't 0.
+func addComment(uuid string, label uint64, text string, replyTo int, clientid string, attrs map[string]string) (commentJSON, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return commentJSON{}, fmt.Errorf("comment has no text")
+	}
+	if len(text) > MaxCommentLength {
+		return commentJSON{}, fmt.Errorf("comment is over %d bytes", MaxCommentLength)
+	}
+	t := clock.Now()
+
+	library.Lock()
+	defer library.Unlock()
+
+	thread := library.comments[uuid][label]
+	if replyTo != 0 {
+		i := sort.Search(len(thread), func(i int) bool { return thread[i].id >= replyTo })
+		if i == len(thread) || thread[i].id != replyTo {
+			return commentJSON{}, fmt.Errorf("uuid %s, label %d has no comment %d to reply to", uuid, label, replyTo)
+		}
+	}
+	id := 1
+	if len(thread) > 0 {
+		id = thread[len(thread)-1].id + 1
+	}
+	cmt := commentT{id, replyTo, clientid, t, text}
+	if err := library.setComment(CommentOp, uuid, label, cmt, attrs, true); err != nil {
+		return commentJSON{}, err
+	}
+	return cmt.toJSON(), nil
+}
+
+// Sets a comment on a label, e.g., when replaying the log.  Must be called with library
+// lock held.
+func (lib *libraryT) setComment(opT opType, uuid string, label uint64, cmt commentT, attrs map[string]string, modifyLog bool) error {
+	m, found := lib.comments[uuid]
+	if !found {
+		m = make(map[uint64][]commentT)
+		lib.comments[uuid] = m
+	}
+	prev, prevFound := m[label]
+	thread := append(prev, cmt)
+	if len(thread) > MaxCommentsPerLabel {
+		thread = thread[len(thread)-MaxCommentsPerLabel:]
+	}
+	m[label] = thread
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      cmt.t,
+			op:     opT,
+			uuid:   uuid,
+			label:  label,
+			client: cmt.client,
+			attrs:  mergeAttrs(attrs, cmt.attrs()),
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the comment so state matches the log.
+			if prevFound {
+				m[label] = prev
+			} else if delete(m, label); !found {
+				delete(lib.comments, uuid)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies a comment read from the log.
+func restoreComment(op *libraryOp) error {
+	id, err := strconv.Atoi(op.attrs["id"])
+	if err != nil || id <= 0 {
+		return fmt.Errorf("bad comment id %q for uuid %s, label %d", op.attrs["id"], op.uuid, op.label)
+	}
+	var replyTo int
+	if replyStr, found := op.attrs["reply"]; found {
+		if replyTo, err = strconv.Atoi(replyStr); err != nil {
+			return fmt.Errorf("bad comment reply %q for uuid %s, label %d", replyStr, op.uuid, op.label)
+		}
+	}
+
+	library.Lock()
+	defer library.Unlock()
+	return library.setComment(op.op, op.uuid, op.label, commentT{id, replyTo, op.client, op.t, op.attrs["text"]}, op.attrs, false)
+}
+
+// Returns the comments on a label, oldest first.
+func getComments(uuid string, label uint64) commentsJSON {
+	library.RLock()
+	defer library.RUnlock()
+
+	thread := library.comments[uuid][label]
+	comments := commentsJSON{uuid, labelJSON{label, library.policies[uuid].labelOutput()}, make([]commentJSON, len(thread))}
+	for i, cmt := range thread {
+		comments.Comments[i] = cmt.toJSON()
+	}
+	return comments
+}
+
+// Writes all comments into a compacted log.  Must be called with library lock held.
+func (lib *libraryT) writeCommentRestores() error {
+	for uuid, m := range lib.comments {
+		for label, thread := range m {
+			for _, cmt := range thread {
+				op := &libraryOp{
+					t:      cmt.t,
+					op:     CommentRestoreOp,
+					uuid:   uuid,
+					label:  label,
+					client: cmt.client,
+					attrs:  cmt.attrs(),
+				}
+				if err := lib.write(op); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultConflictWindow is the period summarized by GET /stats/conflicts if no window is given.
+const DefaultConflictWindow = 7 * 24 * time.Hour
+
+// conflictPairJSON counts the conflicts between two clients, whichever held the label.
+// Client1 sorts before Client2.
+type conflictPairJSON struct {
+	Client1   string
+	Client2   string
+	Conflicts int
+	Refused1  int // conflicts where Client1 was refused a label held by Client2
+	Refused2  int // conflicts where Client2 was refused a label held by Client1
+	Labels    int // distinct labels the pair conflicted on
+	Last      time.Time
+}
+
+type conflictStatsJSON struct {
+	Window    string
+	Since     time.Time
+	Until     time.Time
+	Conflicts int
+	Pairs     []conflictPairJSON
+}
+
+// Parses a window like "7d", "36h", or "1d12h".  Days are 24 hours.
+func parseWindow(s string) (time.Duration, error) {
+	var days time.Duration
+	rest := s
+	if i := strings.Index(s, "d"); i >= 0 {
+		n, err := strconv.Atoi(s[:i])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("window must be a duration like \"7d\" or \"36h\", not %q", s)
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		if rest = s[i+1:]; rest == "" {
+			return days, nil
+		}
+	}
+	d, err := time.ParseDuration(rest)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("window must be a duration like \"7d\" or \"36h\", not %q", s)
+	}
+	return days + d, nil
+}
+
+// Summarizes conflicts between each pair of clients over the window ending now, sorted by
+// most conflicts.
+func getConflictStats(window time.Duration, windowStr string) (*conflictStatsJSON, error) {
+	until := clock.Now()
+	stats := &conflictStatsJSON{Window: windowStr, Since: until.Add(-window), Until: until, Pairs: []conflictPairJSON{}}
+
+	type labelKey struct {
+		uuid  string
+		label uint64
+	}
+	pairs := make(map[[2]string]*conflictPairJSON)
+	labels := make(map[[2]string]map[labelKey]bool)
+
+	fnames, err := historyFiles()
+	if err != nil {
+		return nil, err
+	}
+	aliases := getClientAliases()
+	for _, fname := range fnames {
+		err := readLogOps(fname, func(op *libraryOp) {
+			if op.op != ConflictOp || op.t.Before(stats.Since) || op.t.After(until) {
+				return
+			}
+			op = aliases.apply(op)
+			holder := op.attrs["holder"]
+			key := [2]string{op.client, holder}
+			if holder < op.client {
+				key = [2]string{holder, op.client}
+			}
+			pair, found := pairs[key]
+			if !found {
+				pair = &conflictPairJSON{Client1: key[0], Client2: key[1]}
+				pairs[key] = pair
+				labels[key] = make(map[labelKey]bool)
+			}
+			stats.Conflicts++
+			pair.Conflicts++
+			if op.client == key[0] {
+				pair.Refused1++
+			} else {
+				pair.Refused2++
+			}
+			labels[key][labelKey{op.uuid, op.label}] = true
+			if op.t.After(pair.Last) {
+				pair.Last = op.t
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for key, pair := range pairs {
+		pair.Labels = len(labels[key])
+		stats.Pairs = append(stats.Pairs, *pair)
+	}
+	sortConflictPairs(stats.Pairs)
+	return stats, nil
+}
+
+// Sorts client pairs with the most conflicts first.
+func sortConflictPairs(pairs []conflictPairJSON) {
+	sort.Slice(pairs, func(i, j int) bool {
+		pi, pj := pairs[i], pairs[j]
+		if pi.Conflicts != pj.Conflicts {
+			return pi.Conflicts > pj.Conflicts
+		}
+		if pi.Client1 != pj.Client1 {
+			return pi.Client1 < pj.Client1
+		}
+		return pi.Client2 < pj.Client2
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import "net/http"
+
+// ConsoleHTML is a page at /console for checking out, checking in, and looking up a label
+// from a browser, for reading and leaving comments on it, and for running saved views.  It
+// calls the HTTP API with the user's token, if any, or login session.
+const ConsoleHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Librarian Console</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 60em; }
+label { display: inline-block; width: 6em; }
+input { width: 24em; margin: 0.2em 0; }
+button { margin: 0.8em 0.4em 0.8em 0; }
+#status, #notice { padding: 0.5em; border-radius: 4px; }
+.ok { background: #e6f4ea; }
+.error { background: #fce8e6; }
+table { border-collapse: collapse; margin-top: 0.5em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+select { min-width: 24em; }
+textarea { width: 36em; height: 4em; }
+pre { background: #f4f4f4; padding: 0.5em; max-height: 30em; overflow: auto; }
+</style>
+</head>
+<body>
+<h2>Librarian Console</h2>
+<div id="notice" class="error" style="display: none"></div>
+<div id="session"></div>
+<form id="form" onsubmit="return false">
+<div><label for="token">Token</label><input id="token" type="password" placeholder="JWT, if the server requires one"></div>
+<div><label for="uuid">UUID</label><input id="uuid"></div>
+<div><label for="label">Label</label><input id="label"></div>
+<div><label for="client">Client</label><input id="client" placeholder="your client id"></div>
+<button id="lookup">Look up</button>
+<button id="checkout">Check out</button>
+<button id="checkin">Check in</button>
+<button id="login">Send login link</button>
+<button id="logout" style="display: none">Sign out</button>
+</form>
+<div id="status"></div>
+<h3>Current holder</h3>
+<div id="holder">-</div>
+<h3>Name</h3>
+<div id="name">-</div>
+<h3>History</h3>
+<table><thead><tr><th>Time</th><th>Op</th><th>Client</th></tr></thead><tbody id="history"></tbody></table>
+<h3>Comments</h3>
+<table><thead><tr><th>#</th><th>Time</th><th>Author</th><th>Comment</th></tr></thead><tbody id="comments"></tbody></table>
+<div><textarea id="commenttext" placeholder="comment for the next person to check out this label"></textarea></div>
+<div><label for="replyto">Reply to #</label><input id="replyto" style="width: 4em"></div>
+<button id="comment">Add comment</button>
+<h3>Saved views</h3>
+<select id="views"></select>
+<button id="runview">Run</button>
+<div id="viewpath"></div>
+<pre id="viewresult"></pre>
+<script>
+var fields = ["token", "uuid", "label", "client"];
+fields.forEach(function(id) {
+	var el = document.getElementById(id);
+	el.value = sessionStorage.getItem("librarian-" + id) || "";
+	el.addEventListener("change", function() { sessionStorage.setItem("librarian-" + id, el.value); });
+});
+
+function value(id) { return document.getElementById(id).value.trim(); }
+
+function call(method, path, body) {
+	var headers = {"Accept": "application/json"};
+	if (value("token")) {
+		headers["Authorization"] = "Bearer " + value("token");
+	}
+	var init = {method: method, headers: headers};
+	if (body !== undefined) {
+		headers["Content-Type"] = "application/json";
+		init.body = JSON.stringify(body);
+	}
+	return fetch(path, init).then(function(resp) {
+		return resp.json().catch(function() { return {}; }).then(function(body) {
+			return {status: resp.status, body: body};
+		});
+	});
+}
+
+function setStatus(text, ok) {
+	var el = document.getElementById("status");
+	el.textContent = text;
+	el.className = ok ? "ok" : "error";
+}
+
+function labelPath() {
+	return encodeURIComponent(value("uuid")) + "/" + encodeURIComponent(value("label"));
+}
+
+function refresh() {
+	if (!value("uuid") || !value("label")) {
+		setStatus("UUID and label are required.", false);
+		return Promise.resolve();
+	}
+	var holder = call("GET", "/checkout/" + labelPath()).then(function(r) {
+		var el = document.getElementById("holder");
+		if (r.status != 200) {
+			el.textContent = r.body.Error || "status " + r.status;
+		} else {
+			el.textContent = r.body.Client ? r.body.Client : "Not checked out";
+			if (r.body.Pinned) {
+				el.textContent += " (pinned" + (r.body.Pinned.Reason ? ": " + r.body.Pinned.Reason : "") + ")";
+			}
+		}
+	});
+	var history = call("GET", "/history/" + encodeURIComponent(value("uuid")) + "?limit=50&label=" + encodeURIComponent(value("label"))).then(function(r) {
+		var tbody = document.getElementById("history");
+		tbody.textContent = "";
+		(r.body.History || []).slice().reverse().forEach(function(op) {
+			var tr = document.createElement("tr");
+			[op.Time, op.Op, op.Client || ""].forEach(function(text) {
+				var td = document.createElement("td");
+				td.textContent = text;
+				tr.appendChild(td);
+			});
+			tbody.appendChild(tr);
+		});
+	});
+	var name = call("GET", "/names/" + labelPath()).then(function(r) {
+		document.getElementById("name").textContent = r.status == 200 ? r.body.Name : "-";
+	});
+	var comments = call("GET", "/comments/" + labelPath()).then(function(r) {
+		var tbody = document.getElementById("comments");
+		tbody.textContent = "";
+		(r.body.Comments || []).forEach(function(cmt) {
+			var tr = document.createElement("tr");
+			var text = (cmt.ReplyTo ? "re #" + cmt.ReplyTo + ": " : "") + cmt.Text;
+			[cmt.ID, cmt.Time, cmt.Author, text].forEach(function(text) {
+				var td = document.createElement("td");
+				td.textContent = text;
+				tr.appendChild(td);
+			});
+			tbody.appendChild(tr);
+		});
+	});
+	return Promise.all([holder, history, name, comments]);
+}
+
+function comment() {
+	if (!value("uuid") || !value("label") || !value("commenttext")) {
+		setStatus("UUID, label, and comment are required.", false);
+		return;
+	}
+	var body = {Text: value("commenttext"), ReplyTo: parseInt(value("replyto"), 10) || 0};
+	if (value("client")) {
+		body.Client = value("client");
+	}
+	call("POST", "/comments/" + labelPath(), body).then(function(r) {
+		if (r.status == 200) {
+			document.getElementById("commenttext").value = "";
+			document.getElementById("replyto").value = "";
+			setStatus("Added comment #" + r.body.ID + ".", true);
+		} else {
+			setStatus(r.body.Error || "status " + r.status, false);
+		}
+		return refresh();
+	}).catch(function(err) { setStatus(String(err), false); });
+}
+
+function change(op) {
+	if (!value("uuid") || !value("label") || !value("client")) {
+		setStatus("UUID, label, and client are required.", false);
+		return;
+	}
+	call("PUT", "/" + op + "/" + labelPath() + "/" + encodeURIComponent(value("client"))).then(function(r) {
+		if (r.status == 200) {
+			setStatus(op == "checkout" ? "Checked out." : "Checked in.", true);
+		} else if (r.status == 409 && r.body.Client) {
+			setStatus("Conflict: held by " + r.body.Client + " since " + r.body.Since +
+				"; try again in about " + r.body.RetryAfterSeconds + " seconds.", false);
+		} else {
+			setStatus(r.body.Error || "status " + r.status, false);
+		}
+		return refresh();
+	}).catch(function(err) { setStatus(String(err), false); });
+}
+
+function showSession() {
+	call("GET", "/session").then(function(r) {
+		var signedIn = r.status == 200;
+		document.getElementById("session").textContent = signedIn ? "Signed in as " + r.body.Client + "." : "";
+		document.getElementById("login").style.display = signedIn ? "none" : "";
+		document.getElementById("logout").style.display = signedIn ? "" : "none";
+		if (signedIn) {
+			document.getElementById("client").value = r.body.Client;
+		}
+	});
+}
+
+function login() {
+	if (!value("client")) {
+		setStatus("Enter your client id to get a login link.", false);
+		return;
+	}
+	call("POST", "/login?client=" + encodeURIComponent(value("client"))).then(function(r) {
+		if (r.status == 200) {
+			setStatus("A login link was sent to " + value("client") + ".", true);
+		} else {
+			setStatus(r.body.Error || "status " + r.status, false);
+		}
+	}).catch(function(err) { setStatus(String(err), false); });
+}
+
+document.getElementById("login").addEventListener("click", login);
+document.getElementById("logout").addEventListener("click", function() {
+	call("DELETE", "/session").then(showSession);
+});
+showSession();
+
+function showNotice() {
+	call("GET", "/notice").then(function(r) {
+		var el = document.getElementById("notice");
+		el.textContent = r.body.Message || "";
+		el.style.display = r.body.Message ? "" : "none";
+	});
+}
+showNotice();
+setInterval(showNotice, 60000);
+
+document.getElementById("lookup").addEventListener("click", function() {
+	refresh().then(function() { setStatus("", true); }).catch(function(err) { setStatus(String(err), false); });
+});
+document.getElementById("checkout").addEventListener("click", function() { change("checkout"); });
+document.getElementById("checkin").addEventListener("click", function() { change("checkin"); });
+document.getElementById("comment").addEventListener("click", comment);
+
+function loadViews() {
+	call("GET", "/views").then(function(r) {
+		var select = document.getElementById("views");
+		select.textContent = "";
+		(r.body.Views || []).forEach(function(view) {
+			var option = document.createElement("option");
+			option.value = view.Name;
+			option.textContent = view.Name + " (" + view.Owner + ")";
+			option.title = view.Path;
+			select.appendChild(option);
+		});
+	});
+}
+
+document.getElementById("runview").addEventListener("click", function() {
+	var select = document.getElementById("views");
+	if (!select.value) {
+		setStatus("No saved view picked.  Views are saved with POST /views.", false);
+		return;
+	}
+	document.getElementById("viewpath").textContent = select.options[select.selectedIndex].title;
+	call("GET", "/views/" + encodeURIComponent(select.value)).then(function(r) {
+		document.getElementById("viewresult").textContent = JSON.stringify(r.body, null, 2);
+		setStatus(r.status == 200 ? "" : r.body.Error || "status " + r.status, r.status == 200);
+	}).catch(function(err) { setStatus(String(err), false); });
+});
+document.getElementById("token").addEventListener("change", loadViews);
+loadViews();
+</script>
+</body>
+</html>
+`
+
+func consoleHandler(w http.ResponseWriter, r *http.Request) {
+	if writeAssetPage(w, r, ConsoleAsset) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(addAssetHeader(ConsoleHTML, "<body>", ConsoleHeaderAsset, r)))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxContextNameLength is the longest work context name in bytes.
+const MaxContextNameLength = 256
+
+// contextT is a client's open work context, e.g., a proofreading campaign, whose id is
+// attached to the client's ops until it is closed.
+type contextT struct {
+	id     string
+	name   string
+	opened time.Time
+}
+
+type contextJSON struct {
+	Client string
+	ID     string
+	Name   string
+	Opened time.Time
+}
+
+type contextRequestJSON struct {
+	Name string
+}
+
+// Returns true for ops that open or close work contexts.  They are logged with the
+// uuid "n/a" since they aren't part of any uuid's history.
+func (op opType) contextOp() bool {
+	return op == ContextOpenOp || op == ContextCloseOp || op == ContextRestoreOp
+}
+
+// Returns true for ops made by a client that are tagged with its open work context.
+func (op opType) inContext() bool {
+	switch op {
+	case CheckoutOp, CheckinOp, ConflictOp, MetaSetOp, MetaDeleteOp, PolicySetOp, RenewOp:
+		return true
+	}
+	return false
+}
+
+// Opens a work context for a client, replacing any open one.
+func openContext(clientid, name string, attrs map[string]string) (contextJSON, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return contextJSON{}, fmt.Errorf("work context name cannot be empty")
+	}
+	if len(name) > MaxContextNameLength {
+		return contextJSON{}, fmt.Errorf("work context name is over %d bytes", MaxContextNameLength)
+	}
+	t := clock.Now()
+	id := strconv.FormatInt(t.UnixNano(), 36)
+	if err := openContextAt(t, ContextOpenOp, clientid, id, name, attrs, true); err != nil {
+		return contextJSON{}, err
+	}
+	return contextJSON{clientid, id, name, t}, nil
+}
+
+// Opens a work context as of time t, which is the op time when replaying the log.
+func openContextAt(t time.Time, opT opType, clientid, id, name string, attrs map[string]string, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+
+	prev, prevFound := library.contexts[clientid]
+	library.contexts[clientid] = &contextT{id, name, t}
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     opT,
+			uuid:   "n/a",
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"context": id, "name": name}),
+		}
+		if err := library.write(op); err != nil {
+			// Undo the change so state matches the log.
+			if prevFound {
+				library.contexts[clientid] = prev
+			} else {
+				delete(library.contexts, clientid)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func closeContext(clientid string, attrs map[string]string) error {
+	return closeContextAt(clock.Now(), clientid, attrs, true)
+}
+
+// Closes a client's work context as of time t, which is the op time when replaying the log.
+func closeContextAt(t time.Time, clientid string, attrs map[string]string, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+
+	ctx, found := library.contexts[clientid]
+	if !found {
+		return fmt.Errorf("client %s has no open work context", clientid)
+	}
+	delete(library.contexts, clientid)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     ContextCloseOp,
+			uuid:   "n/a",
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"context": ctx.id}),
+		}
+		if err := library.write(op); err != nil {
+			library.contexts[clientid] = ctx // undo so state matches the log
+			return err
+		}
+	}
+	return nil
+}
+
+func getContext(clientid string) (contextJSON, bool) {
+	library.RLock()
+	defer library.RUnlock()
+
+	ctx, found := library.contexts[clientid]
+	if !found {
+		return contextJSON{}, false
+	}
+	return contextJSON{clientid, ctx.id, ctx.name, ctx.opened}, true
+}
+
+// Returns all open work contexts sorted by client.
+func getContexts() []contextJSON {
+	library.RLock()
+	contexts := make([]contextJSON, 0, len(library.contexts))
+	for clientid, ctx := range library.contexts {
+		contexts = append(contexts, contextJSON{clientid, ctx.id, ctx.name, ctx.opened})
+	}
+	library.RUnlock()
+
+	sort.Slice(contexts, func(i, j int) bool { return contexts[i].Client < contexts[j].Client })
+	return contexts
+}
+
+// Tags an op with its client's open work context, if any.  Must be called with library
+// lock held.
+func (lib *libraryT) tagContext(op *libraryOp) {
+	if !op.op.inContext() {
+		return
+	}
+	if ctx, found := lib.contexts[op.client]; found {
+		op.attrs = mergeAttrs(op.attrs, map[string]string{"context": ctx.id})
+	}
+}
+
+// Writes all open work contexts into a compacted log.  Must be called with library lock held.
+func (lib *libraryT) writeContextRestores() error {
+	for clientid, ctx := range lib.contexts {
+		op := &libraryOp{
+			t:      ctx.opened,
+			op:     ContextRestoreOp,
+			uuid:   "n/a",
+			client: clientid,
+			attrs:  map[string]string{"context": ctx.id, "name": ctx.name},
+		}
+		if err := lib.write(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Kinds of lock state changes between two times.
+const (
+	AcquiredChange     = "acquired"      // label was free and is now checked out
+	ReleasedChange     = "released"      // label was checked out and is now free
+	OwnerChangedChange = "changed-owner" // label is checked out by a different client
+)
+
+type labelChangeJSON struct {
+	Label  labelJSON
+	Change string
+	Before string `json:",omitempty"` // client holding the label at the start
+	After  string `json:",omitempty"` // client holding the label at the end
+}
+
+type diffJSON struct {
+	UUID    string
+	From    *time.Time `json:",omitempty"`
+	To      *time.Time `json:",omitempty"`
+	FromSeq *uint64    `json:",omitempty"`
+	ToSeq   *uint64    `json:",omitempty"`
+	Changes []labelChangeJSON
+}
+
+// diffRangeT is the range of ops a diff covers, given by times or, if bySeq, by sequence
+// numbers.  Ops logged before sequence numbers have seq 0 and so come before any range.
+type diffRangeT struct {
+	from, to       time.Time
+	fromSeq, toSeq uint64
+	bySeq          bool
+}
+
+func (dr diffRangeT) afterFrom(op *libraryOp) bool {
+	if dr.bySeq {
+		return op.seq > dr.fromSeq
+	}
+	return op.t.After(dr.from)
+}
+
+func (dr diffRangeT) afterTo(op *libraryOp) bool {
+	if dr.bySeq {
+		return op.seq > dr.toSeq
+	}
+	return op.t.After(dr.to)
+}
+
+// Returns the labels of a uuid whose holder differs between the start and end of a range,
+// computed by replaying the uuid's history.  Labels released and re-acquired by the same
+// client in between aren't listed.
+func diffState(uuid string, dr diffRangeT) (diffJSON, error) {
+	diff := diffJSON{UUID: uuid, Changes: []labelChangeJSON{}}
+	if dr.bySeq {
+		diff.FromSeq, diff.ToSeq = &dr.fromSeq, &dr.toSeq
+	} else {
+		diff.From, diff.To = &dr.from, &dr.to
+	}
+	fnames, err := historyFiles()
+	if err != nil {
+		return diff, err
+	}
+
+	holders := make(map[uint64]string)
+	var before map[uint64]string
+	opIDs := make(map[string]bool)
+	for _, fname := range fnames {
+		err := readFileHx(fname, uuid, opIDs, func(op *libraryOp) error {
+			if dr.afterTo(op) {
+				return nil
+			}
+			if before == nil && dr.afterFrom(op) {
+				before = copyHolders(holders)
+			}
+			switch op.op {
+			case CheckoutOp, RenewOp:
+				holders[op.label] = op.client
+			case CheckinOp, ExpireOp:
+				delete(holders, op.label)
+			case ResetOp, CommitResetOp:
+				holders = make(map[uint64]string)
+			case LabelResetOp:
+				for _, label := range op.resetLabels() {
+					delete(holders, label)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return diff, err
+		}
+	}
+	if before == nil {
+		before = holders
+	}
+
+	format := getPolicy(uuid).LabelOutput
+	for label, client := range before {
+		switch after, found := holders[label]; {
+		case !found:
+			diff.Changes = append(diff.Changes, labelChangeJSON{labelJSON{label, format}, ReleasedChange, client, ""})
+		case after != client:
+			diff.Changes = append(diff.Changes, labelChangeJSON{labelJSON{label, format}, OwnerChangedChange, client, after})
+		}
+	}
+	for label, client := range holders {
+		if _, found := before[label]; !found {
+			diff.Changes = append(diff.Changes, labelChangeJSON{labelJSON{label, format}, AcquiredChange, "", client})
+		}
+	}
+	sort.Slice(diff.Changes, func(i, j int) bool { return diff.Changes[i].Label.label < diff.Changes[j].Label.label })
+	return diff, nil
+}
+
+func copyHolders(holders map[uint64]string) map[uint64]string {
+	cp := make(map[uint64]string, len(holders))
+	for label, client := range holders {
+		cp[label] = client
+	}
+	return cp
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// DigestDateFmt is the format of dates for daily digests.
+	DigestDateFmt = "2006-01-02"
+
+	// OldLockAge is the age beyond which held locks are listed in digests.
+	OldLockAge = 24 * time.Hour
+
+	// Maximum number of clients and conflicts listed in a digest.
+	digestTopClients   = 10
+	digestMaxConflicts = 50
+)
+
+type digestClientJSON struct {
+	Client    string
+	Ops       int
+	Checkouts int
+	Checkins  int
+	Conflicts int
+}
+
+type digestLockJSON struct {
+	UUID     string
+	Label    uint64
+	Client   string
+	Since    time.Time
+	AgeHours float64
+}
+
+type digestConflictJSON struct {
+	Time   time.Time
+	UUID   string
+	Label  uint64
+	Client string
+	Holder string
+}
+
+// digestT summarizes a day of librarian ops along with locks held too long as of
+// when the digest was made.
+type digestT struct {
+	Date        string
+	Made        time.Time
+	Ops         int
+	Checkouts   int
+	Checkins    int
+	Expired     int
+	Resets      int
+	Conflicts   int
+	TopClients  []digestClientJSON
+	OldLocks    []digestLockJSON
+	ConflictOps []digestConflictJSON
+}
+
+// Makes the digest for the day starting at the given local midnight.
+func makeDigest(day time.Time) (*digestT, error) {
+	end := day.AddDate(0, 0, 1)
+	dg := &digestT{Date: day.Format(DigestDateFmt), Made: clock.Now()}
+	clients := make(map[string]*digestClientJSON)
+
+	fnames, err := historyFiles()
+	if err != nil {
+		return nil, err
+	}
+	aliases := getClientAliases()
+	for _, fname := range fnames {
+		err := readLogOps(fname, func(op *libraryOp) {
+			if op.op.restore() || op.op.uuidless() || op.t.Before(day) || !op.t.Before(end) {
+				return
+			}
+			op = aliases.apply(op)
+			dg.Ops++
+			dc, found := clients[op.client]
+			if !found && op.client != "n/a" {
+				dc = &digestClientJSON{Client: op.client}
+				clients[op.client] = dc
+			}
+			if dc == nil {
+				dc = &digestClientJSON{} // ops without a client, e.g., resets
+			}
+			dc.Ops++
+			switch op.op {
+			case CheckoutOp:
+				dg.Checkouts++
+				dc.Checkouts++
+			case CheckinOp:
+				dg.Checkins++
+				dc.Checkins++
+			case ExpireOp:
+				dg.Expired++
+			case ResetOp, CommitResetOp, LabelResetOp:
+				dg.Resets++
+			case ConflictOp:
+				dg.Conflicts++
+				dc.Conflicts++
+				if len(dg.ConflictOps) < digestMaxConflicts {
+					dg.ConflictOps = append(dg.ConflictOps, digestConflictJSON{op.t, op.uuid, op.label, op.client, op.attrs["holder"]})
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, dc := range clients {
+		dg.TopClients = append(dg.TopClients, *dc)
+	}
+	sort.Slice(dg.TopClients, func(i, j int) bool {
+		if dg.TopClients[i].Ops != dg.TopClients[j].Ops {
+			return dg.TopClients[i].Ops > dg.TopClients[j].Ops
+		}
+		return dg.TopClients[i].Client < dg.TopClients[j].Client
+	})
+	if len(dg.TopClients) > digestTopClients {
+		dg.TopClients = dg.TopClients[:digestTopClients]
+	}
+
+	library.RLock()
+	for uuid, checkouts := range library.vchk {
+		for label, co := range checkouts {
+			if age := dg.Made.Sub(co.t); age > OldLockAge {
+				dg.OldLocks = append(dg.OldLocks, digestLockJSON{uuid, label, co.client, co.t, age.Hours()})
+			}
+		}
+	}
+	library.RUnlock()
+	sort.Slice(dg.OldLocks, func(i, j int) bool { return dg.OldLocks[i].Since.Before(dg.OldLocks[j].Since) })
+	return dg, nil
+}
+
+func (dg *digestT) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "Librarian digest for %s\n\n", dg.Date)
+	fmt.Fprintf(w, "Ops: %d  (checkouts %d, checkins %d, expired %d, resets %d, conflicts %d)\n\n",
+		dg.Ops, dg.Checkouts, dg.Checkins, dg.Expired, dg.Resets, dg.Conflicts)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Top clients\tOps\tCheckouts\tCheckins\tConflicts\n")
+	for _, dc := range dg.TopClients {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", dc.Client, dc.Ops, dc.Checkouts, dc.Checkins, dc.Conflicts)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nLocks held over %.0f hours as of %s: %d\n", OldLockAge.Hours(), dg.Made.Format(time.RFC3339), len(dg.OldLocks))
+	tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, lock := range dg.OldLocks {
+		fmt.Fprintf(tw, "  %s\t%d\t%s\t%.1f hours\n", lock.UUID, lock.Label, lock.Client, lock.AgeHours)
+	}
+	tw.Flush()
+
+	if len(dg.ConflictOps) > 0 {
+		fmt.Fprintf(w, "\nConflicts\n")
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, c := range dg.ConflictOps {
+			fmt.Fprintf(tw, "  %s\t%s\t%d\t%s refused, held by %s\n", c.Time.Format("15:04:05"), c.UUID, c.Label, c.Client, c.Holder)
+		}
+		tw.Flush()
+	}
+	return nil
+}
+
+var digestHTML = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Librarian digest for {{.Date}}</title></head>
+<body>
+<h2>Librarian digest for {{.Date}}</h2>
+<p>{{.Ops}} ops: {{.Checkouts}} checkouts, {{.Checkins}} checkins, {{.Expired}} expired,
+{{.Resets}} resets, {{.Conflicts}} conflicts.</p>
+<h3>Top clients</h3>
+<table border="1" cellpadding="4">
+<tr><th>Client</th><th>Ops</th><th>Checkouts</th><th>Checkins</th><th>Conflicts</th></tr>
+{{range .TopClients}}<tr><td>{{.Client}}</td><td>{{.Ops}}</td><td>{{.Checkouts}}</td><td>{{.Checkins}}</td><td>{{.Conflicts}}</td></tr>
+{{end}}</table>
+<h3>Locks held over 24 hours</h3>
+<table border="1" cellpadding="4">
+<tr><th>UUID</th><th>Label</th><th>Client</th><th>Since</th><th>Hours</th></tr>
+{{range .OldLocks}}<tr><td>{{.UUID}}</td><td>{{.Label}}</td><td>{{.Client}}</td><td>{{.Since.Format "2006-01-02 15:04"}}</td><td>{{printf "%.1f" .AgeHours}}</td></tr>
+{{end}}</table>
+{{if .ConflictOps}}<h3>Conflicts</h3>
+<table border="1" cellpadding="4">
+<tr><th>Time</th><th>UUID</th><th>Label</th><th>Client</th><th>Holder</th></tr>
+{{range .ConflictOps}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.UUID}}</td><td>{{.Label}}</td><td>{{.Client}}</td><td>{{.Holder}}</td></tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))
+
+func (dg *digestT) writeHTML(w io.Writer) error {
+	return digestHTML.Execute(w, dg)
+}
+
+// Emails the digest as text and HTML to the -digestemail recipients.
+func (dg *digestT) email() error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		write       func(io.Writer) error
+	}{
+		{"text/plain; charset=utf-8", dg.writeText},
+		{"text/html; charset=utf-8", dg.writeHTML},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return err
+		}
+		if err := part.write(pw); err != nil {
+			return err
+		}
+	}
+	mw.Close()
+
+	to := strings.Split(*digestEmail, ",")
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", *digestFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: Librarian digest for %s\r\n", dg.Date)
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return notifyEmail("daily digest for "+dg.Date, *digestFrom, to, msg.Bytes())
+}
+
+var digestClient = &http.Client{Timeout: dvidTimeout}
+
+// Posts JSON to a webhook URL.
+func postJSON(url string, v interface{}) error {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return postBody(url, jsonBytes)
+}
+
+// Posts encoded JSON to a webhook URL.
+func postBody(url string, jsonBytes []byte) error {
+	resp, err := digestClient.Post(url, "application/json", bytes.NewReader(jsonBytes))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bad status %d from %s", resp.StatusCode, url)
+	}
+	return nil
+}
+
+// Posts the digest as JSON to the -digestwebhook URL.
+func (dg *digestT) post() error {
+	return notifyWebhook("daily digest for "+dg.Date, *digestWebhook, dg)
+}
+
+// Makes yesterday's digest and sends it by email and/or webhook.
+func sendDigest() {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	now := clock.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	dg, err := makeDigest(today.AddDate(0, 0, -1))
+	if err != nil {
+		log.Printf("ERROR: unable to make daily digest: %v\n", err)
+		return
+	}
+	if *digestEmail != "" {
+		if err := dg.email(); err != nil {
+			log.Printf("ERROR: unable to email daily digest to %s: %v\n", *digestEmail, err)
+		} else {
+			log.Printf("Emailed daily digest for %s to %s\n", dg.Date, *digestEmail)
+		}
+	}
+	if *digestWebhook != "" {
+		if err := dg.post(); err != nil {
+			log.Printf("ERROR: unable to post daily digest: %v\n", err)
+		} else {
+			log.Printf("Posted daily digest for %s to %s\n", dg.Date, *digestWebhook)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout for any single request to the DVID server.
+const dvidTimeout = 30 * time.Second
+
+var dvidClient = &http.Client{Timeout: dvidTimeout}
+
+// dvidNode is the subset of DVID's per-node repo info used by the librarian.
+type dvidNode struct {
+	UUID      string
+	Branch    string
+	Locked    bool
+	Note      string
+	VersionID uint32
+	Parents   []uint32 // version ids
+	Children  []uint32
+}
+
+type dvidRepoInfo struct {
+	Root  string
+	Alias string
+	DAG   struct {
+		Nodes map[string]dvidNode
+	}
+}
+
+// Nodes of all repos on the DVID server as of the last poll.
+var dvidRepos struct {
+	sync.RWMutex
+	repos   []*dvidRepoInfo
+	updated time.Time
+}
+
+// Gets the repo info for all repos on the DVID server.
+func getDVIDReposInfo(server string) ([]*dvidRepoInfo, error) {
+	url := fmt.Sprintf("%s/api/repos/info", strings.TrimSuffix(server, "/"))
+	resp, err := dvidClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status %d from %s", resp.StatusCode, url)
+	}
+	var infos map[string]*dvidRepoInfo
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		return nil, fmt.Errorf("cannot decode repos info from %s: %v", url, err)
+	}
+	repos := make([]*dvidRepoInfo, 0, len(infos))
+	for root, repo := range infos {
+		if repo == nil {
+			continue
+		}
+		if repo.Root == "" {
+			repo.Root = root
+		}
+		repos = append(repos, repo)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Root < repos[j].Root })
+	return repos, nil
+}
+
+// Fetches the nodes of all DVID repos for GET /uuids?all=true.  Returns the repos, which
+// are nil if they couldn't be fetched.
+func refreshDVIDRepos(server string) []*dvidRepoInfo {
+	repos, err := getDVIDReposInfo(server)
+	if err != nil {
+		log.Printf("WARNING: unable to get DVID repos from %s: %v\n", server, err)
+		return nil
+	}
+	dvidRepos.Lock()
+	dvidRepos.repos = repos
+	dvidRepos.updated = time.Now()
+	dvidRepos.Unlock()
+	return repos
+}
+
+// Gets the repo info for the repo containing the given uuid, which may be abbreviated.
+func getDVIDRepoInfo(server, uuid string) (*dvidRepoInfo, error) {
+	url := fmt.Sprintf("%s/api/repo/%s/info", strings.TrimSuffix(server, "/"), uuid)
+	resp, err := dvidClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status %d from %s", resp.StatusCode, url)
+	}
+	var info dvidRepoInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("cannot decode repo info from %s: %v", url, err)
+	}
+	return &info, nil
+}
+
+// Finds the node for a possibly abbreviated uuid among the given repos.  Like DVID, an
+// abbreviation only names a node if exactly one node's uuid starts with it.  Returns the
+// number of matching nodes.
+func findDVIDNode(repos []*dvidRepoInfo, uuid string) (node dvidNode, matches int) {
+	matched := make(map[string]bool)
+	for _, repo := range repos {
+		for fullUUID, n := range repo.DAG.Nodes {
+			if strings.HasPrefix(fullUUID, uuid) && !matched[fullUUID] {
+				matched[fullUUID] = true
+				node = n
+			}
+		}
+	}
+	return node, len(matched)
+}
+
+// Resets all checkouts for UUIDs whose DVID node has been committed.  Repo info is
+// fetched for UUIDs not found in the given repos.  UUIDs that match several nodes are
+// skipped, since they can't be told apart.
+func resetCommittedNodes(server string, repos []*dvidRepoInfo) {
+	for _, uuid := range getUUIDs() {
+		node, matches := findDVIDNode(repos, uuid)
+		if matches == 0 {
+			repo, err := getDVIDRepoInfo(server, uuid)
+			if err != nil {
+				log.Printf("WARNING: unable to get DVID info for uuid %s: %v\n", uuid, err)
+				continue
+			}
+			repos = append(repos, repo)
+			if node, matches = findDVIDNode(repos, uuid); matches == 0 {
+				log.Printf("WARNING: DVID repo info does not include uuid %s\n", uuid)
+				continue
+			}
+		}
+		if matches > 1 {
+			log.Printf("WARNING: uuid %s matches %d DVID nodes, so it isn't checked for commits\n", uuid, matches)
+			continue
+		}
+		if !node.Locked {
+			continue
+		}
+		if err := resetAs(CommitResetOp, uuid, nil, true); err != nil {
+			log.Printf("ERROR: unable to reset committed uuid %s: %v\n", uuid, err)
+			continue
+		}
+		log.Printf("Reset all checkouts for uuid %s since DVID node has been committed\n", uuid)
+	}
+}
+
+// Polls the DVID server at the given interval, noting all nodes and releasing locks on
+// committed nodes.
+func watchDVIDCommits(server string, interval time.Duration) {
+	log.Printf("Watching DVID server %s every %s for committed nodes\n", server, interval)
+	for {
+		repos := refreshDVIDRepos(server)
+		if !inMaintenance() {
+			resetCommittedNodes(server, repos)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// uuidNodeJSON describes a UUID for GET /uuids?all=true.
+type uuidNodeJSON struct {
+	UUID         string
+	Repo         string   `json:",omitempty"` // root UUID of the DVID repo
+	RepoAlias    string   `json:",omitempty"`
+	Branch       string   `json:",omitempty"`
+	Committed    bool     // true if the DVID node is locked
+	Note         string   `json:",omitempty"`
+	LibraryUUIDs []string `json:",omitempty"` // UUIDs with checkouts that abbreviate this node's UUID
+	Checkouts    int
+	InDVID       bool
+}
+
+type allUUIDsJSON struct {
+	UUIDs       []string
+	Nodes       []uuidNodeJSON
+	DVIDUpdated *time.Time `json:",omitempty"` // when DVID nodes were last fetched
+}
+
+// Returns all UUIDs with checkouts and all nodes of the DVID repos, if any.  UUIDs with
+// checkouts can be abbreviations of DVID node UUIDs.
+func getAllUUIDs() allUUIDsJSON {
+	counts := make(map[string]int)
+	library.RLock()
+	for uuid, checkouts := range library.vchk {
+		counts[uuid] = len(checkouts)
+	}
+	library.RUnlock()
+
+	dvidRepos.RLock()
+	repos := dvidRepos.repos
+	updated := dvidRepos.updated
+	dvidRepos.RUnlock()
+
+	all := allUUIDsJSON{UUIDs: []string{}, Nodes: []uuidNodeJSON{}}
+	matched := make(map[string]bool)
+	for _, repo := range repos {
+		for fullUUID, node := range repo.DAG.Nodes {
+			un := uuidNodeJSON{
+				UUID:      fullUUID,
+				Repo:      repo.Root,
+				RepoAlias: repo.Alias,
+				Branch:    node.Branch,
+				Committed: node.Locked,
+				Note:      node.Note,
+				InDVID:    true,
+			}
+			for uuid, n := range counts {
+				if strings.HasPrefix(fullUUID, uuid) {
+					un.LibraryUUIDs = append(un.LibraryUUIDs, uuid)
+					un.Checkouts += n
+					matched[uuid] = true
+				}
+			}
+			sort.Strings(un.LibraryUUIDs)
+			if len(un.LibraryUUIDs) == 0 {
+				all.UUIDs = append(all.UUIDs, fullUUID)
+			}
+			all.Nodes = append(all.Nodes, un)
+		}
+	}
+	for uuid, n := range counts {
+		all.UUIDs = append(all.UUIDs, uuid)
+		if !matched[uuid] {
+			all.Nodes = append(all.Nodes, uuidNodeJSON{UUID: uuid, Checkouts: n})
+		}
+	}
+	sort.Strings(all.UUIDs)
+	sort.Slice(all.Nodes, func(i, j int) bool { return all.Nodes[i].UUID < all.Nodes[j].UUID })
+	if !updated.IsZero() {
+		all.DVIDUpdated = &updated
+	}
+	return all
+}
+
+// Returns where each of the given UUIDs, which can be abbreviated, is in the version tree of
+// its DVID repo as of the last poll.  UUIDs not found in DVID are left out.
+func getDVIDPlacements(uuids []string) map[string]*uuidDVIDJSON {
+	dvidRepos.RLock()
+	repos := dvidRepos.repos
+	dvidRepos.RUnlock()
+
+	placed := make(map[string]*uuidDVIDJSON)
+	for _, repo := range repos {
+		byVersion := make(map[uint32]string, len(repo.DAG.Nodes))
+		for fullUUID, node := range repo.DAG.Nodes {
+			byVersion[node.VersionID] = fullUUID
+		}
+		versionUUIDs := func(versions []uint32) []string {
+			fullUUIDs := []string{}
+			for _, v := range versions {
+				if fullUUID, found := byVersion[v]; found {
+					fullUUIDs = append(fullUUIDs, fullUUID)
+				}
+			}
+			sort.Strings(fullUUIDs)
+			return fullUUIDs
+		}
+		for fullUUID, node := range repo.DAG.Nodes {
+			for _, uuid := range uuids {
+				if placed[uuid] != nil || !strings.HasPrefix(fullUUID, uuid) {
+					continue
+				}
+				placed[uuid] = &uuidDVIDJSON{
+					Repo:      repo.Root,
+					RepoAlias: repo.Alias,
+					Node:      fullUUID,
+					Version:   node.VersionID,
+					Branch:    node.Branch,
+					Committed: node.Locked,
+					Parents:   versionUUIDs(node.Parents),
+					Children:  versionUUIDs(node.Children),
+				}
+			}
+		}
+	}
+	return placed
+}
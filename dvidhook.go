@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// DVID labelmap mutations handled by POST /hooks/dvid.
+const (
+	DVIDMergeAction  = "merge"  // Labels were merged into Target
+	DVIDCleaveAction = "cleave" // supervoxels of OrigLabel were cleaved off into CleavedLabel
+	DVIDSplitAction  = "split"  // part of Target was split off into NewLabel
+)
+
+// dvidMutationJSON is a DVID labelmap mutation notification, as written to its mutation
+// log.  Other fields of the notification are ignored.
+type dvidMutationJSON struct {
+	Action       string
+	UUID         string
+	MutationID   uint64
+	User         string
+	Target       uint64   // merged into, or split, label
+	Labels       []uint64 // labels merged into Target
+	OrigLabel    uint64   // cleaved label
+	CleavedLabel uint64   // new label of a cleave
+	NewLabel     uint64   // new label of a split
+}
+
+// transferredJSON is a lock given to the client holding a label changed by a mutation.
+type transferredJSON struct {
+	From        labelJSON
+	To          labelJSON
+	Client      string
+	AlreadyHeld bool   `json:",omitempty"` // client already had the To label
+	Skipped     string `json:",omitempty"` // why To couldn't be checked out, e.g., another holder
+}
+
+type dvidHookJSON struct {
+	UUID        string
+	Action      string
+	MutationID  uint64
+	Ignored     bool              `json:",omitempty"` // not a merge, cleave, or split
+	Released    []releasedJSON    // labels merged away, checked in for their holders
+	Transferred []transferredJSON // locks moved or extended to the new body ids
+}
+
+// Adjusts the locks of a uuid after a DVID mutation: labels merged into another are checked
+// in and their holders get the target label, and the holder of a cleaved or split label
+// also gets the new label, so locks follow the bodies.  Merged labels are also recorded as
+// superseded by the target.  Holders get a label-mutated event.
+func applyDVIDMutation(m dvidMutationJSON, attrs map[string]string) (dvidHookJSON, error) {
+	result := dvidHookJSON{UUID: m.UUID, Action: m.Action, MutationID: m.MutationID, Released: []releasedJSON{}, Transferred: []transferredJSON{}}
+	if m.UUID == "" {
+		return result, fmt.Errorf("mutation has no UUID")
+	}
+	var moves [][2]uint64 // label -> label its holder is given
+	switch m.Action {
+	case DVIDMergeAction:
+		if m.Target == 0 || len(m.Labels) == 0 {
+			return result, fmt.Errorf("merge mutation needs a Target and Labels")
+		}
+		for _, label := range m.Labels {
+			if label != m.Target {
+				moves = append(moves, [2]uint64{label, m.Target})
+			}
+		}
+	case DVIDCleaveAction:
+		if m.OrigLabel == 0 || m.CleavedLabel == 0 {
+			return result, fmt.Errorf("cleave mutation needs an OrigLabel and CleavedLabel")
+		}
+		moves = append(moves, [2]uint64{m.OrigLabel, m.CleavedLabel})
+	case DVIDSplitAction:
+		if m.Target == 0 || m.NewLabel == 0 {
+			return result, fmt.Errorf("split mutation needs a Target and NewLabel")
+		}
+		moves = append(moves, [2]uint64{m.Target, m.NewLabel})
+	default:
+		result.Ignored = true
+		return result, nil
+	}
+	if _, found := attrs["ref"]; !found && m.MutationID != 0 {
+		attrs = mergeAttrs(attrs, map[string]string{"ref": "dvid-mutation-" + strconv.FormatUint(m.MutationID, 10)})
+	}
+	attrs = mergeAttrs(attrs, map[string]string{"mutation": m.Action})
+	now := clock.Now()
+
+	library.Lock()
+	defer library.Unlock()
+
+	format := library.policies[m.UUID].labelOutput()
+	for _, move := range moves {
+		from, to := move[0], move[1]
+		co, found := library.vchk[m.UUID][from]
+		if !found {
+			continue
+		}
+		transferred := transferredJSON{From: labelJSON{from, format}, To: labelJSON{to, format}, Client: co.client}
+		if other, found := library.vchk[m.UUID][to]; found && other.client == co.client {
+			transferred.AlreadyHeld = true
+		} else {
+			checkoutAttrs := mergeAttrs(attrs, map[string]string{"mutated-from": strconv.FormatUint(from, 10)})
+			if !co.expires.IsZero() {
+				expires, _ := co.expires.UTC().MarshalText()
+				checkoutAttrs["expires"] = string(expires)
+			}
+			if _, err := library.checkout(now, m.UUID, to, co.client, checkoutAttrs, true); err != nil {
+				transferred.Skipped = err.Error()
+			}
+		}
+		result.Transferred = append(result.Transferred, transferred)
+
+		if m.Action == DVIDMergeAction {
+			checkinAttrs := mergeAttrs(attrs, map[string]string{"merged-into": strconv.FormatUint(to, 10)})
+			if err := library.checkin(now, m.UUID, from, co.client, checkinAttrs, true); err != nil {
+				return result, fmt.Errorf("unable to check in uuid %s, label %d for %s: %v", m.UUID, from, co.client, err)
+			}
+			result.Released = append(result.Released, releasedJSON{labelJSON{from, format}, co.client})
+		}
+		publishMutationEvent(m.UUID, labelJSON{from, format}, co, m.Action, m.MutationID, transferred)
+	}
+	if m.Action == DVIDMergeAction {
+		for _, move := range moves {
+			if library.resolveLabel(m.UUID, move[1]) != move[0] {
+				if err := library.setSuperseded(SupersedeOp, now, m.UUID, move[0], move[1], "n/a", attrs, true); err != nil {
+					return result, fmt.Errorf("unable to supersede uuid %s, label %d by %d: %w", m.UUID, move[0], move[1], err)
+				}
+			}
+		}
+	}
+	if len(result.Transferred) > 0 {
+		log.Printf("DVID %s mutation %d of uuid %s moved %d locks and released %d labels\n", m.Action, m.MutationID, m.UUID, len(result.Transferred), len(result.Released))
+	}
+	return result, nil
+}
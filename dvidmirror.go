@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DVIDMirrorKey is the key of the -dvidmirror keyvalue instance that holds a node's checkouts.
+const DVIDMirrorKey = "librarian-checkouts"
+
+// UUIDs whose checkouts changed since they were last written to the -dvidmirror instance.
+var dvidMirror = struct {
+	sync.Mutex
+	instance string
+	dirty    map[string]bool
+	wake     chan struct{}
+}{dirty: make(map[string]bool)}
+
+// dvidMirrorJSON is the value written to each node's keyvalue instance.
+type dvidMirrorJSON struct {
+	UUID      string
+	Revision  uint64
+	Updated   time.Time
+	Checkouts []reserveJSON
+	Pinned    []pinnedLabelJSON `json:",omitempty"`
+}
+
+// Returns true if an op changes what's mirrored.  This includes resets of committed nodes,
+// so the mirror doesn't keep listing released checkouts, though DVID may refuse the write
+// to a locked node, which is logged and not retried.
+func mirroredOp(op opType) bool {
+	switch op {
+	case CheckoutOp, RenewOp, CheckinOp, ExpireOp, ResetOp, CommitResetOp, LabelResetOp, PinOp, UnpinOp:
+		return true
+	}
+	return false
+}
+
+// Marks the uuid of an op to be written to the -dvidmirror instance without blocking.
+// Must be called with library lock held.
+func mirrorOp(op *libraryOp) {
+	if dvidMirror.wake == nil || !mirroredOp(op.op) {
+		return
+	}
+	dvidMirror.Lock()
+	dvidMirror.dirty[op.uuid] = true
+	dvidMirror.Unlock()
+	select {
+	case dvidMirror.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Starts writing the checkouts of each uuid to its DVID node's keyvalue instance after
+// each change, beginning with all uuids that have checkouts.
+func startDVIDMirror(server, instance string) {
+	library.RLock()
+	dvidMirror.Lock()
+	dvidMirror.instance = instance
+	dvidMirror.wake = make(chan struct{}, 1)
+	for uuid := range library.vchk {
+		dvidMirror.dirty[uuid] = true
+	}
+	dvidMirror.Unlock()
+	library.RUnlock()
+
+	log.Printf("Mirroring checkouts into keyvalue instance %q of DVID server %s\n", instance, server)
+	dvidMirror.wake <- struct{}{}
+	go runDVIDMirror(server, instance)
+}
+
+// Writes dirty uuids to DVID, retrying with backoff those that couldn't be sent.  Since
+// the whole state of a uuid is written, changes made while a write is pending are merged.
+func runDVIDMirror(server, instance string) {
+	backoff := time.Second
+	for range dvidMirror.wake {
+		dvidMirror.Lock()
+		dirty := dvidMirror.dirty
+		dvidMirror.dirty = make(map[string]bool)
+		dvidMirror.Unlock()
+
+		failed := false
+		for uuid := range dirty {
+			retry, err := writeDVIDMirror(server, instance, uuid)
+			if err == nil {
+				continue
+			}
+			log.Printf("WARNING: unable to mirror checkouts of uuid %s into DVID: %v\n", uuid, err)
+			if retry {
+				failed = true
+				dvidMirror.Lock()
+				dvidMirror.dirty[uuid] = true
+				dvidMirror.Unlock()
+			}
+		}
+		if !failed {
+			backoff = time.Second
+			continue
+		}
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+		select {
+		case dvidMirror.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Writes the current checkouts of a uuid to its node.  Returns true with an error if the
+// write should be retried, i.e., DVID couldn't be reached or had a server error.
+func writeDVIDMirror(server, instance, uuid string) (retry bool, err error) {
+	library.RLock()
+	rev := library.revs[uuid]
+	library.RUnlock()
+	value, err := json.Marshal(dvidMirrorJSON{
+		UUID:      uuid,
+		Revision:  rev,
+		Updated:   clock.Now(),
+		Checkouts: sortedCheckouts(uuid, SortByLabel, false),
+		Pinned:    getPins(uuid),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	url := fmt.Sprintf("%s/api/node/%s/%s/key/%s", strings.TrimSuffix(server, "/"), uuid, instance, DVIDMirrorKey)
+	resp, err := dvidClient.Post(url, "application/json", bytes.NewReader(value))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode >= 500, fmt.Errorf("bad status %d from %s", resp.StatusCode, url)
+	}
+	return false, nil
+}
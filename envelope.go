@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+)
+
+// EnvelopePrefix starts the paths of requests whose JSON responses are wrapped in an
+// envelope, e.g., GET /v1/state/3af902 is GET /state/3af902 with an envelope.
+const EnvelopePrefix = "/v1"
+
+// Resources whose paths give a UUID after the resource, e.g., /state/{UUID}, for the
+// revision in envelopes.
+var envelopeUUIDResources = map[string]bool{
+	"checkin": true, "checkout": true, "comments": true, "diff": true, "history": true,
+	"intent": true, "meta": true, "migrate": true, "names": true, "remind": true, "reset": true,
+	"state": true, "admin/freeze": true, "admin/pin": true, "admin/policy": true,
+	"admin/release-stale": true, "admin/supersede": true, "federated/state": true,
+}
+
+// envelopeJSON wraps a JSON response with metadata common to all requests.
+type envelopeJSON struct {
+	ServerTime time.Time
+	RequestID  string
+	Status     int
+	UUID       string          `json:",omitempty"`
+	Revision   *uint64         `json:",omitempty"` // of the UUID after the request
+	Data       json.RawMessage // the response without the envelope
+}
+
+// envelopeWriter holds a JSON response until the handler is done so it can be wrapped.
+// Other responses, e.g., msgpack or HTML, are passed through as they are written.
+type envelopeWriter struct {
+	w           http.ResponseWriter
+	status      int
+	buf         bytes.Buffer
+	decided     bool
+	passthrough bool
+}
+
+func (ew *envelopeWriter) Header() http.Header {
+	return ew.w.Header()
+}
+
+func (ew *envelopeWriter) decide() {
+	if ew.decided {
+		return
+	}
+	ew.decided = true
+	contentType, _, _ := strings.Cut(ew.w.Header().Get("Content-Type"), ";")
+	ew.passthrough = contentType != "application/json"
+	if ew.passthrough {
+		ew.w.WriteHeader(ew.status)
+	}
+}
+
+func (ew *envelopeWriter) WriteHeader(status int) {
+	if ew.decided {
+		return
+	}
+	ew.status = status
+	ew.decide()
+}
+
+func (ew *envelopeWriter) Write(p []byte) (int, error) {
+	ew.decide()
+	if ew.passthrough {
+		return ew.w.Write(p)
+	}
+	return ew.buf.Write(p)
+}
+
+// Flushes passed through responses.  Wrapped ones are only written when done.
+func (ew *envelopeWriter) FlushError() error {
+	if ew.passthrough {
+		return http.NewResponseController(ew.w).Flush()
+	}
+	return nil
+}
+
+func (ew *envelopeWriter) SetWriteDeadline(deadline time.Time) error {
+	return http.NewResponseController(ew.w).SetWriteDeadline(deadline)
+}
+
+// Returns the UUID given in a request path, if any.
+func envelopeUUID(path string) string {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) >= 2 && envelopeUUIDResources[parts[0]] {
+		return parts[1]
+	}
+	if len(parts) >= 3 && envelopeUUIDResources[parts[0]+"/"+parts[1]] {
+		return parts[2]
+	}
+	return ""
+}
+
+// Writes the envelope around a held JSON response.
+func (ew *envelopeWriter) finish(c web.C, path string) {
+	ew.decide()
+	if ew.passthrough {
+		return
+	}
+	data := ew.buf.Bytes()
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte("null")
+	}
+	if !json.Valid(data) {
+		ew.w.WriteHeader(ew.status)
+		ew.w.Write(ew.buf.Bytes())
+		return
+	}
+	env := envelopeJSON{
+		ServerTime: clock.Now().Add(chaosSkew(path)),
+		RequestID:  middleware.GetReqID(c),
+		Status:     ew.status,
+		UUID:       envelopeUUID(path),
+		Data:       data,
+	}
+	if env.UUID != "" {
+		library.RLock()
+		rev, found := library.revs[env.UUID]
+		library.RUnlock()
+		if found {
+			env.Revision = &rev
+		}
+	}
+	jsonBytes, err := json.Marshal(env)
+	if err != nil {
+		ew.w.WriteHeader(ew.status)
+		ew.w.Write(ew.buf.Bytes())
+		return
+	}
+	ew.w.Header().Del("Content-Length")
+	ew.w.WriteHeader(ew.status)
+	ew.w.Write(jsonBytes)
+	ew.w.Write([]byte("\n"))
+}
+
+// Middleware that serves requests under EnvelopePrefix as the request without it, wrapping
+// JSON responses in an envelope.  Event streams and WebSockets are never wrapped.
+func envelopeHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		path, found := strings.CutPrefix(r.URL.Path, EnvelopePrefix)
+		if !found || (path != "" && path[0] != '/') {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if path == "" {
+			path = "/"
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = path
+		r2.URL.RawPath = ""
+		r2.RequestURI = r2.URL.RequestURI()
+		if strings.HasPrefix(path, "/events/") || strings.HasPrefix(path, "/ws/") {
+			h.ServeHTTP(w, r2)
+			return
+		}
+		ew := &envelopeWriter{w: w, status: http.StatusOK}
+		h.ServeHTTP(ew, r2)
+		ew.finish(*c, path)
+	}
+	return http.HandlerFunc(fn)
+}
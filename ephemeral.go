@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The temporary directory holding the log with -ephemeral, removed at exit.
+var ephemeralDir struct {
+	sync.Mutex
+	path string
+}
+
+// Creates the temporary directory for an -ephemeral log and returns the log's path.
+func initEphemeralDir() (string, error) {
+	dir, err := os.MkdirTemp("", "librarian-")
+	if err != nil {
+		return "", err
+	}
+	ephemeralDir.Lock()
+	ephemeralDir.path = dir
+	ephemeralDir.Unlock()
+	log.Printf("Using ephemeral librarian log in %s, which is removed at exit\n", dir)
+	return filepath.Join(dir, "librarian.log"), nil
+}
+
+// Removes the temporary directory of an -ephemeral log, if any.
+func removeEphemeralDir() {
+	ephemeralDir.Lock()
+	defer ephemeralDir.Unlock()
+	if ephemeralDir.path == "" {
+		return
+	}
+	if err := os.RemoveAll(ephemeralDir.path); err != nil {
+		log.Printf("ERROR: unable to remove ephemeral log directory %s: %v\n", ephemeralDir.path, err)
+	}
+	ephemeralDir.path = ""
+}
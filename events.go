@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Events pushed to a client's subscription at /events/{Client}.
+const (
+	LeaseExpiringEvent = "lease-expiring" // lease will run out within the policy's ExpiryWarning
+	LeaseExpiredEvent  = "lease-expired"  // lease and grace period ran out, so the label was released
+
+	InactivityWarningEvent = "inactivity-warning" // label will be released within ExpiryWarning unless the client is active
+	InactivityCheckinEvent = "inactivity-checkin" // client was inactive for the policy's InactivityCheckin, so the label was released
+
+	ReminderEvent = "reminder" // reminder set with PUT /remind is due and the label is still checked out
+
+	ConflictEvent = "conflict" // another client was refused a checkout of the label
+
+	LockChangedEvent = "lock-changed" // label the client registered an intent for was checked out or released
+
+	FreezeWarningEvent = "freeze-warning" // label's uuid will soon be frozen by an /admin/freeze schedule
+
+	ForceReleasedEvent = "force-released" // label was released by a reset or an admin rather than checked in
+
+	LabelMutatedEvent = "label-mutated" // label was merged, cleaved, or split in DVID (see POST /hooks/dvid)
+
+	ServerClosingEvent = "server-closing" // server is draining for a planned shutdown or stopping, sent to every subscriber
+)
+
+// EventHeartbeat is how often a comment is sent on idle subscriptions to keep them open.
+const EventHeartbeat = 30 * time.Second
+
+// Number of events buffered per subscription.  Events for slow subscribers are dropped.
+const eventBufferSize = 64
+
+type eventJSON struct {
+	Event      string
+	UUID       string
+	Label      labelJSON
+	Client     string
+	Expires    time.Time
+	GraceEnds  *time.Time `json:",omitempty"`
+	CheckinAt  *time.Time `json:",omitempty"` // release for inactivity, only in inactivity events
+	Requester  string     `json:",omitempty"` // client refused the label, only in conflict events
+	Holder     string     `json:",omitempty"` // new holder, only in lock-changed events
+	Freeze     string     `json:",omitempty"` // name of the freeze, only in freeze-warning events
+	Starts     *time.Time `json:",omitempty"` // window of the freeze, only in freeze-warning events
+	Ends       *time.Time `json:",omitempty"`
+	ReleasedBy string     `json:",omitempty"` // client that released the label, only in force-released events
+	Mutation   string     `json:",omitempty"` // "merge", "cleave", or "split", only in label-mutated events
+	MutationID uint64     `json:",omitempty"` // DVID mutation id, only in label-mutated events
+	NewLabel   *labelJSON `json:",omitempty"` // body the label was merged into or split off, only in label-mutated events
+	Moved      bool       `json:",omitempty"` // client now holds NewLabel, only in label-mutated events
+	Notice     string     `json:",omitempty"` // banner at GET /notice, only in server-closing events
+	ClosesAt   *time.Time `json:",omitempty"` // planned shutdown, only in server-closing events
+}
+
+var subscriptions = struct {
+	sync.Mutex
+	clients map[string]map[chan eventJSON]bool
+}{clients: make(map[string]map[chan eventJSON]bool)}
+
+func subscribe(clientid string) chan eventJSON {
+	ch := make(chan eventJSON, eventBufferSize)
+	subscriptions.Lock()
+	defer subscriptions.Unlock()
+
+	subs, found := subscriptions.clients[clientid]
+	if !found {
+		subs = make(map[chan eventJSON]bool)
+		subscriptions.clients[clientid] = subs
+	}
+	subs[ch] = true
+	return ch
+}
+
+func unsubscribe(clientid string, ch chan eventJSON) {
+	subscriptions.Lock()
+	defer subscriptions.Unlock()
+
+	delete(subscriptions.clients[clientid], ch)
+	if len(subscriptions.clients[clientid]) == 0 {
+		delete(subscriptions.clients, clientid)
+	}
+}
+
+// Sends an event about a checkout to its holder's subscriptions without blocking.  Must be
+// called with library lock held.
+func publishEvent(event, uuid string, label labelJSON, co checkoutT) {
+	sendEvent(checkoutEvent(event, uuid, label, co))
+}
+
+// Sends an inactivity event about a checkout that is or will be released at checkinAt.
+// Must be called with library lock held.
+func publishInactivityEvent(event, uuid string, label labelJSON, co checkoutT, checkinAt time.Time) {
+	ev := checkoutEvent(event, uuid, label, co)
+	ev.CheckinAt = &checkinAt
+	sendEvent(ev)
+}
+
+// Warns the holder of a checkout that its uuid will be frozen from start to end.  Must be
+// called with library lock held.
+func publishFreezeEvent(uuid string, label labelJSON, co checkoutT, name string, start, end time.Time) {
+	ev := checkoutEvent(FreezeWarningEvent, uuid, label, co)
+	ev.Freeze = name
+	ev.Starts, ev.Ends = &start, &end
+	sendEvent(ev)
+}
+
+// Tells the holder of a checkout that it was released by a reset or by releasedBy, if
+// known.  Must be called with library lock held.
+func publishReleaseEvent(uuid string, label labelJSON, co checkoutT, releasedBy string) {
+	ev := checkoutEvent(ForceReleasedEvent, uuid, label, co)
+	if releasedBy != "n/a" {
+		ev.ReleasedBy = releasedBy
+	}
+	sendEvent(ev)
+}
+
+// Tells the holder of a label changed by a DVID mutation whether it now holds the new label.
+// Must be called with library lock held.
+func publishMutationEvent(uuid string, label labelJSON, co checkoutT, mutation string, mutationID uint64, transferred transferredJSON) {
+	ev := checkoutEvent(LabelMutatedEvent, uuid, label, co)
+	ev.Mutation, ev.MutationID = mutation, mutationID
+	ev.NewLabel = &transferred.To
+	ev.Moved = transferred.Skipped == ""
+	sendEvent(ev)
+}
+
+func checkoutEvent(event, uuid string, label labelJSON, co checkoutT) eventJSON {
+	ev := eventJSON{Event: event, UUID: uuid, Label: label, Client: co.client, Expires: co.expires}
+	if grace := library.policies[uuid].grace(); grace > 0 && !co.expires.IsZero() {
+		graceEnds := co.expires.Add(grace)
+		ev.GraceEnds = &graceEnds
+	}
+	return ev
+}
+
+// Sends an event to its client's subscriptions without blocking, and to the client's own
+// webhook or email if it asked for the event with PUT /clients/{Client}/notifications.
+func sendEvent(ev eventJSON) {
+	notifyClient(ev)
+
+	subscriptions.Lock()
+	defer subscriptions.Unlock()
+
+	for ch := range subscriptions.clients[ev.Client] {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("WARNING: dropped %s event for uuid %s, label %d to slow subscriber %s\n", ev.Event, ev.UUID, ev.Label.label, ev.Client)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const exportHelp = `
+Usage: librarian export [options] /path/to/librarian.log
+
+Exports the op history of a librarian log and its compacted segments as Parquet files for
+analytics.  Files are partitioned by the UTC date of each op in Hive style, e.g.,
+"date=2015-12-19/ops-0.parquet", so a whole export can be queried at once, e.g., in DuckDB:
+
+	SELECT client, count(*) FROM read_parquet('export/*/*.parquet', hive_partitioning=true)
+	WHERE op = 'checkout' GROUP BY client;
+
+Each op has columns "time" (UTC timestamp), "uuid", "op", "label", "client", and "attrs",
+a JSON object of the op's optional attributes like "agent" and "holder".  Ops that only
+carry state into a compacted log aren't exported.
+
+      -format        =string   Export format.  Only "parquet", the default, is supported.
+      -o             =string   Directory for the exported files.  Required.
+      -from          =string   Only export ops on or after this date, e.g., "2015-12-01".
+      -to            =string   Only export ops on or before this date.
+  -h, -help          (flag)    Show help message
+`
+
+// ExportFormatParquet is the Parquet format of history exports.
+const ExportFormatParquet = "parquet"
+
+// MaxExportFileRows is the most ops in one exported file.  Larger dates get several files.
+const MaxExportFileRows = 1 << 20
+
+// exportDateFmt is the format of export partition dates.
+const exportDateFmt = "2006-01-02"
+
+// historyExporter writes ops, in time order, into Parquet files partitioned by date.
+type historyExporter struct {
+	from, to time.Time // zero for no limit; to is the end of the last date
+	save     func(name string, data []byte) error
+
+	date    string
+	parts   map[string]int // files written per date
+	columns []*parquetColumn
+	files   int
+	ops     int
+}
+
+func newHistoryExporter(from, to time.Time, save func(name string, data []byte) error) *historyExporter {
+	return &historyExporter{
+		from:  from,
+		to:    to,
+		save:  save,
+		parts: make(map[string]int),
+		columns: []*parquetColumn{
+			newParquetColumn("time", parquetInt64, parquetTimestampMicros),
+			newParquetColumn("uuid", parquetByteArray, parquetUTF8),
+			newParquetColumn("op", parquetByteArray, parquetUTF8),
+			newParquetColumn("label", parquetInt64, parquetUint64),
+			newParquetColumn("client", parquetByteArray, parquetUTF8),
+			newParquetColumn("attrs", parquetByteArray, parquetUTF8),
+		},
+	}
+}
+
+// Parses the from and to dates of an export, either of which can be empty.
+func parseExportDates(fromStr, toStr string) (from, to time.Time, err error) {
+	if fromStr != "" {
+		if from, err = time.Parse(exportDateFmt, fromStr); err != nil {
+			return from, to, fmt.Errorf("bad from date %q: must be like %q", fromStr, exportDateFmt)
+		}
+	}
+	if toStr != "" {
+		if to, err = time.Parse(exportDateFmt, toStr); err != nil {
+			return from, to, fmt.Errorf("bad to date %q: must be like %q", toStr, exportDateFmt)
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	return from, to, nil
+}
+
+func (e *historyExporter) addFile(fname string) error {
+	var addErr error
+	err := readLogOps(fname, func(op *libraryOp) {
+		if addErr == nil {
+			addErr = e.add(op)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return addErr
+}
+
+func (e *historyExporter) add(op *libraryOp) error {
+	if op.op.restore() {
+		return nil
+	}
+	t := op.t.UTC()
+	if (!e.from.IsZero() && t.Before(e.from)) || (!e.to.IsZero() && !t.Before(e.to)) {
+		return nil
+	}
+	date := t.Format(exportDateFmt)
+	if date != e.date || e.columns[0].n >= MaxExportFileRows {
+		if err := e.flush(); err != nil {
+			return err
+		}
+		e.date = date
+	}
+	attrs := []byte("{}")
+	if len(op.attrs) > 0 {
+		var err error
+		if attrs, err = json.Marshal(op.attrs); err != nil {
+			return err
+		}
+	}
+	e.columns[0].addInt64(t.UnixMicro())
+	e.columns[1].addString(op.uuid)
+	e.columns[2].addString(op.op.String())
+	e.columns[3].addInt64(int64(op.label))
+	e.columns[4].addString(op.client)
+	e.columns[5].addString(string(attrs))
+	e.ops++
+	return nil
+}
+
+// Writes the ops of the current date, if any, into a new file.
+func (e *historyExporter) flush() error {
+	if e.columns[0].n == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, e.columns, "librarian "+Version); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("date=%s/ops-%d.parquet", e.date, e.parts[e.date])
+	if err := e.save(name, buf.Bytes()); err != nil {
+		return err
+	}
+	e.parts[e.date]++
+	e.files++
+	for _, c := range e.columns {
+		c.reset()
+	}
+	return nil
+}
+
+// Exports the history of the running librarian as a zip archive of Parquet files.
+func exportHistoryZip(from, to time.Time, w io.Writer) error {
+	fnames, err := historyFiles()
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(w)
+	e := newHistoryExporter(from, to, func(name string, data []byte) error {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: clock.Now()})
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(data) // already compressed
+		return err
+	})
+	for _, fname := range fnames {
+		if err := e.addFile(fname); err != nil {
+			return err
+		}
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", ExportFormatParquet, "")
+	outDir := fs.String("o", "", "")
+	fromStr := fs.String("from", "", "")
+	toStr := fs.String("to", "", "")
+	fs.Usage = func() {
+		fmt.Printf(exportHelp)
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil || len(positional) != 1 || *outDir == "" {
+		fs.Usage()
+		return 1
+	}
+	if *format != ExportFormatParquet {
+		fmt.Fprintf(os.Stderr, "Bad -format %q: must be %q\n", *format, ExportFormatParquet)
+		return 1
+	}
+	from, to, err := parseExportDates(*fromStr, *toStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	segments, err := logSegments(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find librarian log segments: %v\n", err)
+		return 1
+	}
+	e := newHistoryExporter(from, to, func(name string, data []byte) error {
+		path := filepath.Join(*outDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			return err
+		}
+		return os.WriteFile(path, data, 0664)
+	})
+	for _, fname := range append(segments, positional[0]) {
+		if err := e.addFile(fname); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to export librarian log: %v\n", err)
+			return 1
+		}
+	}
+	if err := e.flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to export librarian log: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d ops into %d files in %s\n", e.ops, e.files, *outDir)
+	return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// LocalServer is the server name given to this librarian's checkouts in federated views.
+const LocalServer = "local"
+
+// Peer librarians set by -peers whose checkouts are combined by GET /federated/state.
+var federationPeers []string
+
+// federatedCheckoutJSON is a checkout held on one of the federated servers.  Labels are
+// given as each server writes them, which depends on its policy for the UUID.
+type federatedCheckoutJSON struct {
+	Server     string
+	Label      json.RawMessage
+	Client     string
+	Superseded json.RawMessage `json:",omitempty"`
+}
+
+type federatedServerJSON struct {
+	Server    string
+	Checkouts int
+	Error     string `json:",omitempty"` // set if the server couldn't be reached
+}
+
+// peerStateJSON is the part of a peer's GET /state response used in federated views.
+type peerStateJSON struct {
+	Checkouts []federatedCheckoutJSON
+}
+
+type federatedStateJSON struct {
+	UUID      string
+	Checkouts []federatedCheckoutJSON
+	Servers   []federatedServerJSON
+}
+
+// Sets the peer librarians from a comma-separated list of URLs.
+func initPeers(peers string) error {
+	for _, peer := range strings.Split(peers, ",") {
+		peer = strings.TrimSpace(peer)
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("bad -peers URL %q: must be like \"http://other:8000\"", peer)
+		}
+		federationPeers = append(federationPeers, strings.TrimSuffix(peer, "/"))
+	}
+	log.Printf("Federating with %d peer librarians: %s\n", len(federationPeers), strings.Join(federationPeers, ", "))
+	return nil
+}
+
+// Returns the checkouts of a uuid on this server and all peers, in the order of -peers
+// after this server's.  Peers that can't be reached are noted in Servers.
+func getFederatedState(uuid string, r *http.Request) federatedStateJSON {
+	results := make([]peerStateJSON, len(federationPeers))
+	errs := make([]error, len(federationPeers))
+	var wg sync.WaitGroup
+	for i, peer := range federationPeers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			results[i], errs[i] = getPeerState(peer, uuid, r)
+		}(i, peer)
+	}
+
+	state := federatedStateJSON{UUID: uuid, Checkouts: []federatedCheckoutJSON{}}
+	local := sortedCheckouts(uuid, SortByLabel, false)
+	for _, rsv := range local {
+		label, _ := json.Marshal(rsv.Label)
+		fco := federatedCheckoutJSON{Server: LocalServer, Label: label, Client: rsv.Client}
+		if rsv.Superseded != nil {
+			fco.Superseded, _ = json.Marshal(rsv.Superseded)
+		}
+		state.Checkouts = append(state.Checkouts, fco)
+	}
+	state.Servers = append(state.Servers, federatedServerJSON{Server: LocalServer, Checkouts: len(local)})
+
+	wg.Wait()
+	for i, peer := range federationPeers {
+		if errs[i] != nil {
+			log.Printf("ERROR: unable to get state of uuid %s from peer %s: %v\n", uuid, peer, errs[i])
+			state.Servers = append(state.Servers, federatedServerJSON{Server: peer, Error: errs[i].Error()})
+			continue
+		}
+		for _, co := range results[i].Checkouts {
+			co.Server = peer
+			state.Checkouts = append(state.Checkouts, co)
+		}
+		state.Servers = append(state.Servers, federatedServerJSON{Server: peer, Checkouts: len(results[i].Checkouts)})
+	}
+	return state
+}
+
+// Gets the state of a uuid from a peer, passing along the request's Authorization.
+func getPeerState(peer, uuid string, r *http.Request) (peerStateJSON, error) {
+	var state peerStateJSON
+	req, err := http.NewRequest("GET", peer+"/state/"+url.PathEscape(uuid), nil)
+	if err != nil {
+		return state, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		req.Header.Set("Authorization", authz)
+	}
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		return state, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return state, fmt.Errorf("bad status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return state, fmt.Errorf("bad state JSON: %v", err)
+	}
+	return state, nil
+}
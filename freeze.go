@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/janelia-flyem/go/cron"
+)
+
+// FrozenCode is the error code of a checkout refused because its UUID is in a freeze.
+const FrozenCode = "FROZEN"
+
+// DefaultFreezeWarning is how long before a freeze starts its "freeze-warning" event is sent
+// to holders of the UUID's labels if the freeze doesn't give a Warning.
+const DefaultFreezeWarning = 15 * time.Minute
+
+// MaxFreezeDuration is the longest window of a freeze.
+const MaxFreezeDuration = 7 * 24 * time.Hour
+
+var freezeNameRE = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// freezeT is a recurring window during which checkouts of a UUID's labels are refused,
+// e.g., while a release is made from it.
+type freezeT struct {
+	schedule string // cron spec of window starts, e.g., "0 0 14 * * FRI"
+	sched    cron.Schedule
+	duration time.Duration
+	warning  time.Duration // how long before a window starts to warn holders
+	reason   string
+	client   string
+	t        time.Time // when the freeze was set
+	warned   time.Time // start of the last window holders were warned of
+}
+
+type freezeRequestJSON struct {
+	Name     string
+	Schedule string // cron spec with seconds in the server's time zone
+	Duration string
+	Warning  string `json:",omitempty"`
+	Reason   string `json:",omitempty"`
+}
+
+type freezeJSON struct {
+	Name     string
+	Schedule string
+	Duration string
+	Warning  string
+	Reason   string `json:",omitempty"`
+	Client   string
+	Set      time.Time
+	Active   bool
+	Start    time.Time // of the current window if active, else of the next
+	End      time.Time
+}
+
+type freezesJSON struct {
+	UUID    string
+	Freezes []freezeJSON
+}
+
+// frozenError is returned for a checkout of a label while its UUID is frozen.
+type frozenError struct {
+	uuid   string
+	label  uint64
+	name   string
+	reason string
+	end    time.Time
+}
+
+func (e *frozenError) Error() string {
+	msg := fmt.Sprintf("uuid %s, label %d - uuid frozen by %q until %s", e.uuid, e.label, e.name, e.end.In(displayZone).Format(time.RFC3339))
+	if e.reason != "" {
+		msg += " (" + e.reason + ")"
+	}
+	return msg
+}
+
+// Parses a freeze from its schedule and durations.
+func parseFreeze(schedule, durationStr, warningStr string) (*freezeT, error) {
+	sched, err := cron.Parse(schedule)
+	if err != nil {
+		return nil, fmt.Errorf("bad freeze schedule %q: %v", schedule, err)
+	}
+	if _, every := sched.(cron.ConstantDelaySchedule); every {
+		return nil, fmt.Errorf("freeze schedule %q must be a cron spec like \"0 0 14 * * FRI\", not @every", schedule)
+	}
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil || duration <= 0 || duration > MaxFreezeDuration {
+		return nil, fmt.Errorf("bad freeze duration %q: must be positive and at most %s", durationStr, MaxFreezeDuration)
+	}
+	warning := DefaultFreezeWarning
+	if warningStr != "" {
+		if warning, err = time.ParseDuration(warningStr); err != nil || warning < 0 {
+			return nil, fmt.Errorf("bad freeze warning %q: must be a non-negative duration", warningStr)
+		}
+	}
+	return &freezeT{schedule: schedule, sched: sched, duration: duration, warning: warning}, nil
+}
+
+// Returns the window of a freeze in effect at t or, if none is, the next one.  The start is
+// the zero time if the schedule never fires.
+func (f *freezeT) window(t time.Time) (start, end time.Time, active bool) {
+	t = t.In(displayZone)
+	if start = f.sched.Next(t.Add(-f.duration)); start.IsZero() {
+		return start, start, false
+	}
+	return start, start.Add(f.duration), !start.After(t)
+}
+
+func (f *freezeT) toJSON(name string, now time.Time) freezeJSON {
+	start, end, active := f.window(now)
+	return freezeJSON{name, f.schedule, f.duration.String(), f.warning.String(), f.reason, f.client, f.t, active, start, end}
+}
+
+// Returns the op attributes of a freeze.
+func (f *freezeT) attrs(name string) map[string]string {
+	attrs := map[string]string{"name": name, "schedule": f.schedule, "duration": f.duration.String(), "warning": f.warning.String()}
+	if f.reason != "" {
+		attrs["reason"] = f.reason
+	}
+	return attrs
+}
+
+// Returns an error if the uuid is in a freeze at t.  Must be called with library lock held.
+func (lib *libraryT) checkFrozen(t time.Time, uuid string, label uint64) error {
+	for name, f := range lib.freezes[uuid] {
+		if _, end, active := f.window(t); active {
+			return &frozenError{uuid, label, name, f.reason, end}
+		}
+	}
+	return nil
+}
+
+// Sets a freeze on a uuid from an admin request, replacing any of the same name.
+func setFreeze(uuid string, req freezeRequestJSON, clientid string, attrs map[string]string) (freezeJSON, error) {
+	if !freezeNameRE.MatchString(req.Name) {
+		return freezeJSON{}, fmt.Errorf("freeze name %q must be up to 64 letters, digits, '.', '_', or '-'", req.Name)
+	}
+	f, err := parseFreeze(req.Schedule, req.Duration, req.Warning)
+	if err != nil {
+		return freezeJSON{}, err
+	}
+	f.reason, f.client, f.t = req.Reason, clientid, clock.Now()
+
+	library.Lock()
+	defer library.Unlock()
+	if err := library.setFreeze(FreezeSetOp, uuid, req.Name, f, attrs, true); err != nil {
+		return freezeJSON{}, err
+	}
+	return f.toJSON(req.Name, f.t), nil
+}
+
+// Sets a freeze, e.g., when replaying the log.  Must be called with library lock held.
+func (lib *libraryT) setFreeze(opT opType, uuid, name string, f *freezeT, attrs map[string]string, modifyLog bool) error {
+	m, found := lib.freezes[uuid]
+	if !found {
+		m = make(map[string]*freezeT)
+		lib.freezes[uuid] = m
+	}
+	prev, prevFound := m[name]
+	m[name] = f
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      f.t,
+			op:     opT,
+			uuid:   uuid,
+			client: f.client,
+			attrs:  mergeAttrs(attrs, f.attrs(name)),
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the change so state matches the log.
+			if prevFound {
+				m[name] = prev
+			} else if delete(m, name); !found {
+				delete(lib.freezes, uuid)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteFreeze(uuid, name, clientid string, attrs map[string]string) error {
+	return deleteFreezeAt(clock.Now(), uuid, name, clientid, attrs, true)
+}
+
+// Deletes a freeze as of time t, which is the op time when replaying the log.
+func deleteFreezeAt(t time.Time, uuid, name, clientid string, attrs map[string]string, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+
+	m := library.freezes[uuid]
+	f, found := m[name]
+	if !found {
+		return fmt.Errorf("uuid %s has no freeze %q", uuid, name)
+	}
+	delete(m, name)
+	if len(m) == 0 {
+		delete(library.freezes, uuid)
+	}
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     FreezeDeleteOp,
+			uuid:   uuid,
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"name": name}),
+		}
+		if err := library.write(op); err != nil {
+			// Undo the deletion so state matches the log.
+			m[name] = f
+			library.freezes[uuid] = m
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies a freeze read from the log.
+func restoreFreeze(op *libraryOp) error {
+	f, err := parseFreeze(op.attrs["schedule"], op.attrs["duration"], op.attrs["warning"])
+	if err != nil {
+		return err
+	}
+	f.reason, f.client, f.t = op.attrs["reason"], op.client, op.t
+
+	library.Lock()
+	defer library.Unlock()
+	return library.setFreeze(op.op, op.uuid, op.attrs["name"], f, op.attrs, false)
+}
+
+// Returns the freezes of a uuid sorted by name.
+func getFreezes(uuid string) freezesJSON {
+	now := clock.Now()
+	library.RLock()
+	defer library.RUnlock()
+
+	freezes := freezesJSON{uuid, make([]freezeJSON, 0, len(library.freezes[uuid]))}
+	for name, f := range library.freezes[uuid] {
+		freezes.Freezes = append(freezes.Freezes, f.toJSON(name, now))
+	}
+	sort.Slice(freezes.Freezes, func(i, j int) bool { return freezes.Freezes[i].Name < freezes.Freezes[j].Name })
+	return freezes
+}
+
+// Sends a "freeze-warning" event to the holders of a uuid's labels when one of its freezes
+// is about to start.
+func warnFreezes() {
+	library.Lock()
+	defer library.Unlock()
+
+	now := clock.Now()
+	for uuid, m := range library.freezes {
+		for name, f := range m {
+			start, end, active := f.window(now)
+			if active || start.IsZero() || start.Sub(now) > f.warning || start.Equal(f.warned) {
+				continue
+			}
+			f.warned = start
+			format := library.policies[uuid].labelOutput()
+			for label, co := range library.vchk[uuid] {
+				publishFreezeEvent(uuid, labelJSON{label, format}, co, name, start, end)
+			}
+		}
+	}
+}
+
+// Writes all freezes into a compacted log.  Must be called with library lock held.
+func (lib *libraryT) writeFreezeRestores() error {
+	for uuid, m := range lib.freezes {
+		for name, f := range m {
+			op := &libraryOp{
+				t:      f.t,
+				op:     FreezeRestoreOp,
+				uuid:   uuid,
+				client: f.client,
+				attrs:  f.attrs(name),
+			}
+			if err := lib.write(op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const genlogHelp = `
+Usage: librarian genlog [options]
+
+Writes a synthetic but realistic librarian log, e.g., for benchmarks, compaction tests, and
+demos.  Ops are spread over -duration, mostly during weekday working hours.  A few clients
+do most of the work, checkouts are of labels in a pool per UUID, and checkins, conflicts,
+and expirations are of labels that are actually checked out, so the log replays cleanly.
+The same options and -seed always give the same log.
+
+      -uuids         =number   Number of UUIDs.  Default 3.
+      -clients       =number   Number of client ids.  Default 10.
+      -labels        =number   Number of labels in each UUID's pool.  Default 10000.
+      -ops           =number   Number of ops.  Default 10000.
+      -duration      =duration Time spanned by the ops, which end now.  Default "720h".
+      -start         =string   Time the ops start instead, e.g., "2015-12-01" or an RFC 3339
+                                 time, so logs don't depend on when they are generated.
+      -mix           =string   Relative weights of ops.  Default is
+                                 "checkout=50,checkin=42,conflict=5,expire=1,pin=1,unpin=0.8,reset=0.2".
+      -corrupt       =string   Comma-separated damage to inject: "truncate" cuts the last line
+                                 short like a crash mid-write, which the server removes at
+                                 startup, and "garbage" replaces a line in the middle with one
+                                 that can't be parsed.
+      -seed          =number   Seed for the random choices.  Default 1.
+      -o             =string   Write the log to this file instead of standard output.
+  -h, -help          (flag)    Show help message
+`
+
+// DefaultGenlogMix is the op mix of generated logs, roughly that of proofreading.
+const DefaultGenlogMix = "checkout=50,checkin=42,conflict=5,expire=1,pin=1,unpin=0.8,reset=0.2"
+
+// Kinds of damage genlog can inject.
+const (
+	TruncateCorruption = "truncate"
+	GarbageCorruption  = "garbage"
+)
+
+// Tools the generated clients use, recorded as their ops' "agent".
+var genlogAgents = []string{"neu3/1.4.2", "neutu/2.3.1", "librarian-cli/1.0.0", "python-requests/2.31.0"}
+
+type genHold struct {
+	uuid  string
+	label uint64
+}
+
+// genlogT tracks the state of a generated log so every op is one the server would log.
+type genlogT struct {
+	rnd      *rand.Rand
+	uuids    []string
+	clients  []string
+	weights  []float64 // activity of each client
+	pools    map[string][]uint64
+	held     map[genHold]string
+	holds    map[string][]genHold // client -> labels held
+	pinned   map[genHold]bool
+	pins     []genHold
+	mixOps   []opType
+	mixTotal []float64 // cumulative weights of mixOps
+}
+
+// Parses an op mix like "checkout=50,checkin=40".
+func parseGenlogMix(mix string) ([]opType, []float64, error) {
+	var ops []opType
+	var cumulative []float64
+	total := 0.0
+	for _, part := range strings.Split(mix, ",") {
+		name, weightStr, found := strings.Cut(strings.TrimSpace(part), "=")
+		weight, err := strconv.ParseFloat(weightStr, 64)
+		if !found || err != nil || weight < 0 {
+			return nil, nil, fmt.Errorf("bad -mix %q: must be op=weight pairs like \"checkout=50,checkin=40\"", part)
+		}
+		switch opT := opTypeFromString(name); opT {
+		case CheckoutOp, CheckinOp, ConflictOp, ExpireOp, PinOp, UnpinOp, ResetOp:
+			total += weight
+			ops = append(ops, opT)
+			cumulative = append(cumulative, total)
+		default:
+			return nil, nil, fmt.Errorf("bad -mix op %q: must be checkout, checkin, conflict, expire, pin, unpin, or reset", name)
+		}
+	}
+	if total == 0 {
+		return nil, nil, fmt.Errorf("bad -mix %q: some op must have a positive weight", mix)
+	}
+	return ops, cumulative, nil
+}
+
+func newGenlog(seed int64, numUUIDs, numClients, numLabels int, mix string) (*genlogT, error) {
+	g := &genlogT{
+		rnd:    rand.New(rand.NewSource(seed)),
+		pools:  make(map[string][]uint64),
+		held:   make(map[genHold]string),
+		holds:  make(map[string][]genHold),
+		pinned: make(map[genHold]bool),
+	}
+	var err error
+	if g.mixOps, g.mixTotal, err = parseGenlogMix(mix); err != nil {
+		return nil, err
+	}
+	for len(g.uuids) < numUUIDs {
+		uuid := fmt.Sprintf("%06x", g.rnd.Intn(1<<24))
+		if _, found := g.pools[uuid]; found {
+			continue
+		}
+		g.uuids = append(g.uuids, uuid)
+		pool := make([]uint64, numLabels)
+		for j := range pool {
+			pool[j] = 1e9 + uint64(g.rnd.Int63n(9e9)) // body ids are large
+		}
+		g.pools[uuid] = pool
+	}
+	// A few clients do most of the work.
+	total := 0.0
+	for i := 0; i < numClients; i++ {
+		g.clients = append(g.clients, fmt.Sprintf("proofreader%02d", i+1))
+		total += 1 / float64(i+1)
+		g.weights = append(g.weights, total)
+	}
+	return g, nil
+}
+
+// Picks from cumulative weights.
+func (g *genlogT) pick(cumulative []float64) int {
+	x := g.rnd.Float64() * cumulative[len(cumulative)-1]
+	return sort.SearchFloat64s(cumulative, x)
+}
+
+func (g *genlogT) client() string {
+	return g.clients[g.pick(g.weights)]
+}
+
+// Returns n op times from start to start+span in order, mostly on weekdays from 8 to 19.
+func (g *genlogT) times(start time.Time, span time.Duration, n int) []time.Time {
+	times := make([]time.Time, 0, n)
+	for len(times) < n {
+		t := start.Add(time.Duration(g.rnd.Int63n(int64(span) + 1)))
+		weekday, hour := t.Weekday(), t.Hour()
+		working := weekday != time.Saturday && weekday != time.Sunday && hour >= 8 && hour < 19
+		if working || g.rnd.Float64() < 0.1 {
+			times = append(times, t)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times
+}
+
+func (g *genlogT) release(hold genHold) {
+	client := g.held[hold]
+	delete(g.held, hold)
+	holds := g.holds[client]
+	for i, other := range holds {
+		if other == hold {
+			holds[i] = holds[len(holds)-1]
+			g.holds[client] = holds[:len(holds)-1]
+			break
+		}
+	}
+}
+
+func (g *genlogT) unpin(hold genHold) {
+	delete(g.pinned, hold)
+	for i, pin := range g.pins {
+		if pin == hold {
+			g.pins[i] = g.pins[len(g.pins)-1]
+			g.pins = g.pins[:len(g.pins)-1]
+			break
+		}
+	}
+}
+
+// Returns a label of a client's, or of any client's if client is empty.
+func (g *genlogT) heldLabel(client string) (genHold, bool) {
+	if client == "" {
+		if len(g.held) == 0 {
+			return genHold{}, false
+		}
+		for client == "" || len(g.holds[client]) == 0 {
+			client = g.client()
+		}
+	}
+	holds := g.holds[client]
+	if len(holds) == 0 {
+		return genHold{}, false
+	}
+	return holds[g.rnd.Intn(len(holds))], true
+}
+
+// Returns the next op, falling back to a checkout if the chosen op isn't possible.
+func (g *genlogT) next() *libraryOp {
+	client := g.client()
+	switch g.mixOps[g.pick(g.mixTotal)] {
+	case CheckinOp:
+		if hold, found := g.heldLabel(client); found {
+			g.release(hold)
+			return &libraryOp{op: CheckinOp, uuid: hold.uuid, label: hold.label, client: client}
+		}
+	case ConflictOp:
+		if hold, found := g.heldLabel(""); found && g.held[hold] != client {
+			return &libraryOp{op: ConflictOp, uuid: hold.uuid, label: hold.label, client: client,
+				attrs: map[string]string{"holder": g.held[hold]}}
+		}
+	case ExpireOp:
+		if hold, found := g.heldLabel(""); found {
+			holder := g.held[hold]
+			g.release(hold)
+			return &libraryOp{op: ExpireOp, uuid: hold.uuid, label: hold.label, client: holder}
+		}
+	case PinOp:
+		uuid := g.uuids[g.rnd.Intn(len(g.uuids))]
+		hold := genHold{uuid, g.pools[uuid][g.rnd.Intn(len(g.pools[uuid]))]}
+		if !g.pinned[hold] {
+			g.pinned[hold] = true
+			g.pins = append(g.pins, hold)
+			return &libraryOp{op: PinOp, uuid: hold.uuid, label: hold.label, client: client,
+				attrs: map[string]string{"reason": "published"}}
+		}
+	case UnpinOp:
+		if len(g.pins) > 0 {
+			hold := g.pins[g.rnd.Intn(len(g.pins))]
+			g.unpin(hold)
+			return &libraryOp{op: UnpinOp, uuid: hold.uuid, label: hold.label, client: client}
+		}
+	case ResetOp:
+		uuid := g.uuids[g.rnd.Intn(len(g.uuids))]
+		for _, holder := range g.clients {
+			kept := g.holds[holder][:0]
+			for _, hold := range g.holds[holder] {
+				if hold.uuid == uuid {
+					delete(g.held, hold)
+				} else {
+					kept = append(kept, hold)
+				}
+			}
+			g.holds[holder] = kept
+		}
+		return &libraryOp{op: ResetOp, uuid: uuid, client: "n/a"}
+	}
+
+	// Check out a label no other client holds.
+	uuid := g.uuids[g.rnd.Intn(len(g.uuids))]
+	pool := g.pools[uuid]
+	hold := genHold{uuid, pool[g.rnd.Intn(len(pool))]}
+	for tries := 0; tries < 100; tries++ {
+		if holder, found := g.held[hold]; (!found || holder == client) && !g.pinned[hold] {
+			break
+		}
+		hold.label = pool[g.rnd.Intn(len(pool))]
+	}
+	holder, found := g.held[hold]
+	switch {
+	case found && holder != client:
+		return &libraryOp{op: ConflictOp, uuid: hold.uuid, label: hold.label, client: client,
+			attrs: map[string]string{"holder": holder}}
+	case g.pinned[hold]:
+		// Most of the pool is pinned, so free some of it.
+		g.unpin(hold)
+		return &libraryOp{op: UnpinOp, uuid: hold.uuid, label: hold.label, client: client}
+	}
+	if !found {
+		g.held[hold] = client
+		g.holds[client] = append(g.holds[client], hold)
+	}
+	return &libraryOp{op: CheckoutOp, uuid: hold.uuid, label: hold.label, client: client}
+}
+
+// Writes the log, injecting the given corruptions.
+func (g *genlogT) write(w io.Writer, times []time.Time, corrupt map[string]bool) error {
+	bw := bufio.NewWriter(w)
+	agents := make(map[string]string)
+	for i, t := range times {
+		op := g.next()
+		op.seq = uint64(i + 1)
+		if op.client != "n/a" {
+			if _, found := agents[op.client]; !found {
+				agents[op.client] = genlogAgents[g.rnd.Intn(len(genlogAgents))]
+			}
+			op.attrs = mergeAttrs(op.attrs, map[string]string{"agent": agents[op.client]})
+		}
+		line, err := formatLogLine(op, t)
+		if err != nil {
+			return err
+		}
+		switch {
+		case corrupt[GarbageCorruption] && i == len(times)/2:
+			line = fmt.Sprintf("%s %x\n", t.UTC().Format(time.RFC3339Nano), g.rnd.Uint64())
+		case corrupt[TruncateCorruption] && i == len(times)-1:
+			line = line[:len(line)/2]
+		}
+		if _, err := bw.WriteString(line); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func runGenlog(args []string) int {
+	fs := flag.NewFlagSet("genlog", flag.ExitOnError)
+	numUUIDs := fs.Int("uuids", 3, "")
+	numClients := fs.Int("clients", 10, "")
+	numLabels := fs.Int("labels", 10000, "")
+	numOps := fs.Int("ops", 10000, "")
+	duration := fs.Duration("duration", 30*24*time.Hour, "")
+	startStr := fs.String("start", "", "")
+	mix := fs.String("mix", DefaultGenlogMix, "")
+	corruptStr := fs.String("corrupt", "", "")
+	seed := fs.Int64("seed", 1, "")
+	outFile := fs.String("o", "", "")
+	fs.Usage = func() {
+		fmt.Printf(genlogHelp)
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil || len(positional) != 0 {
+		fs.Usage()
+		return 1
+	}
+	if *numUUIDs < 1 || *numClients < 1 || *numLabels < 1 || *numOps < 0 {
+		fmt.Fprintf(os.Stderr, "-uuids, -clients, and -labels must be at least 1, and -ops can't be negative\n")
+		return 1
+	}
+	if *duration <= 0 {
+		fmt.Fprintf(os.Stderr, "Bad -duration %s: must be positive\n", *duration)
+		return 1
+	}
+	start := time.Now().Add(-*duration)
+	if *startStr != "" {
+		if start, err = time.Parse(time.RFC3339, *startStr); err != nil {
+			if start, err = time.ParseInLocation(exportDateFmt, *startStr, time.Local); err != nil {
+				fmt.Fprintf(os.Stderr, "Bad -start %q: must be a date like \"2015-12-01\" or an RFC 3339 time\n", *startStr)
+				return 1
+			}
+		}
+	}
+	corrupt := make(map[string]bool)
+	for _, kind := range strings.Split(*corruptStr, ",") {
+		switch kind = strings.TrimSpace(kind); kind {
+		case "":
+		case TruncateCorruption, GarbageCorruption:
+			corrupt[kind] = true
+		default:
+			fmt.Fprintf(os.Stderr, "Bad -corrupt %q: must be %q or %q\n", kind, TruncateCorruption, GarbageCorruption)
+			return 1
+		}
+	}
+	g, err := newGenlog(*seed, *numUUIDs, *numClients, *numLabels, *mix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create log: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := g.write(w, g.times(start, *duration, *numOps), corrupt); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write log: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A small GraphQL executor for read-only queries of the library.  It handles query
+// operations with variables, aliases, arguments, and named or inline fragments.
+// Mutations, subscriptions, directives, and introspection other than __typename
+// are not supported.
+
+// gqlVar is a variable reference in a parsed argument value.
+type gqlVar string
+
+type gqlSelection struct {
+	alias    string // response key, which is the field name if no alias was given
+	name     string // field name, or fragment name for a spread
+	args     map[string]interface{}
+	sels     []*gqlSelection
+	spread   bool   // true for "...Name" and inline fragments
+	onType   string // type condition of a fragment, if any
+	fragment bool   // true if a spread of a named fragment
+}
+
+type gqlVarDef struct {
+	name       string
+	defaultVal interface{}
+	hasDefault bool
+	nonNull    bool
+}
+
+type gqlOperation struct {
+	name    string
+	varDefs []gqlVarDef
+	sels    []*gqlSelection
+}
+
+type gqlDocument struct {
+	ops   []*gqlOperation
+	frags map[string]*gqlSelection // fragment name -> inline fragment
+}
+
+type gqlToken struct {
+	kind byte // 'p' punctuator, 'n' name, 'i' int, 'f' float, 's' string, 0 end
+	val  string
+	pos  int
+}
+
+func lexGraphQL(src string) ([]gqlToken, error) {
+	var toks []gqlToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++ // commas are insignificant like whitespace
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.IndexByte("{}()[]:=!$@|&", c) >= 0:
+			toks = append(toks, gqlToken{'p', string(c), i})
+			i++
+		case strings.HasPrefix(src[i:], "..."):
+			toks = append(toks, gqlToken{'p', "...", i})
+			i += 3
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(src) && (src[i] == '_' || (src[i] >= 'a' && src[i] <= 'z') || (src[i] >= 'A' && src[i] <= 'Z') || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+			toks = append(toks, gqlToken{'n', src[start:i], start})
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			kind := byte('i')
+			i++
+			for i < len(src) && strings.IndexByte("0123456789.eE+-", src[i]) >= 0 {
+				if strings.IndexByte(".eE", src[i]) >= 0 {
+					kind = 'f'
+				}
+				i++
+			}
+			toks = append(toks, gqlToken{kind, src[start:i], start})
+		case c == '"':
+			if strings.HasPrefix(src[i:], `"""`) {
+				return nil, fmt.Errorf("block strings are not supported (position %d)", i)
+			}
+			start := i
+			i++
+			for i < len(src) && src[i] != '"' && src[i] != '\n' {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) || src[i] != '"' {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			var s string
+			if err := json.Unmarshal([]byte(src[start:i]), &s); err != nil {
+				return nil, fmt.Errorf("bad string at position %d: %v", start, err)
+			}
+			toks = append(toks, gqlToken{'s', s, start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+	return append(toks, gqlToken{0, "", len(src)}), nil
+}
+
+type gqlParser struct {
+	toks []gqlToken
+	i    int
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.toks[p.i]
+}
+
+func (p *gqlParser) next() gqlToken {
+	tok := p.toks[p.i]
+	if tok.kind != 0 {
+		p.i++
+	}
+	return tok
+}
+
+func (p *gqlParser) peekPunct(s string) bool {
+	tok := p.peek()
+	return tok.kind == 'p' && tok.val == s
+}
+
+func (p *gqlParser) expect(s string) error {
+	tok := p.next()
+	if tok.kind != 'p' || tok.val != s {
+		return p.unexpected(tok, fmt.Sprintf("%q", s))
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	tok := p.next()
+	if tok.kind != 'n' {
+		return "", p.unexpected(tok, "a name")
+	}
+	return tok.val, nil
+}
+
+func (p *gqlParser) unexpected(tok gqlToken, want string) error {
+	if tok.kind == 0 {
+		return fmt.Errorf("expected %s but query ended", want)
+	}
+	return fmt.Errorf("expected %s but found %q at position %d", want, tok.val, tok.pos)
+}
+
+// Parses a GraphQL query document.
+func parseGraphQL(src string) (*gqlDocument, error) {
+	toks, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{toks: toks}
+	doc := &gqlDocument{frags: make(map[string]*gqlSelection)}
+	for p.peek().kind != 0 {
+		tok := p.peek()
+		switch {
+		case tok.kind == 'p' && tok.val == "{":
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.ops = append(doc.ops, &gqlOperation{sels: sels})
+		case tok.kind == 'n' && tok.val == "query":
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.ops = append(doc.ops, op)
+		case tok.kind == 'n' && tok.val == "fragment":
+			p.next()
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if on, err := p.name(); err != nil || on != "on" {
+				return nil, fmt.Errorf("fragment %s needs a type condition", name)
+			}
+			onType, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			if _, found := doc.frags[name]; found {
+				return nil, fmt.Errorf("fragment %s is defined more than once", name)
+			}
+			doc.frags[name] = &gqlSelection{name: name, spread: true, onType: onType, sels: sels}
+		case tok.kind == 'n' && (tok.val == "mutation" || tok.val == "subscription"):
+			return nil, fmt.Errorf("%s operations are not supported", tok.val)
+		default:
+			return nil, p.unexpected(tok, "an operation or fragment")
+		}
+	}
+	if len(doc.ops) == 0 {
+		return nil, fmt.Errorf("no query operation given")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	p.next() // "query"
+	op := &gqlOperation{}
+	if p.peek().kind == 'n' {
+		op.name = p.next().val
+	}
+	if p.peekPunct("(") {
+		p.next()
+		for !p.peekPunct(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			var vd gqlVarDef
+			var err error
+			if vd.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if vd.nonNull, err = p.varType(); err != nil {
+				return nil, err
+			}
+			if p.peekPunct("=") {
+				p.next()
+				if vd.defaultVal, err = p.value(true); err != nil {
+					return nil, err
+				}
+				vd.hasDefault = true
+			}
+			op.varDefs = append(op.varDefs, vd)
+		}
+		p.next()
+	}
+	if p.peekPunct("@") {
+		return nil, fmt.Errorf("directives are not supported")
+	}
+	var err error
+	op.sels, err = p.selectionSet()
+	return op, err
+}
+
+// Parses a variable type like "String", "[Int!]", or "Int!", returning whether it is non-null.
+func (p *gqlParser) varType() (bool, error) {
+	if p.peekPunct("[") {
+		p.next()
+		if _, err := p.varType(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.peekPunct("!") {
+		p.next()
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for !p.peekPunct("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	p.next()
+	if len(sels) == 0 {
+		return nil, fmt.Errorf("empty selection set")
+	}
+	return sels, nil
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	if p.peekPunct("...") {
+		p.next()
+		sel := &gqlSelection{spread: true}
+		if tok := p.peek(); tok.kind == 'n' && tok.val != "on" {
+			sel.name = p.next().val
+			sel.fragment = true
+		} else {
+			if tok.kind == 'n' {
+				p.next()
+				var err error
+				if sel.onType, err = p.name(); err != nil {
+					return nil, err
+				}
+			}
+			var err error
+			if sel.sels, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		if p.peekPunct("@") {
+			return nil, fmt.Errorf("directives are not supported")
+		}
+		return sel, nil
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	sel := &gqlSelection{alias: name, name: name}
+	if p.peekPunct(":") {
+		p.next()
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peekPunct("(") {
+		p.next()
+		sel.args = make(map[string]interface{})
+		for !p.peekPunct(")") {
+			argName, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if sel.args[argName], err = p.value(false); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+	}
+	if p.peekPunct("@") {
+		return nil, fmt.Errorf("directives are not supported")
+	}
+	if p.peekPunct("{") {
+		if sel.sels, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+// Parses an argument value.  Variables aren't allowed in constant values like defaults.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	tok := p.next()
+	switch tok.kind {
+	case 'i':
+		n, err := strconv.ParseInt(tok.val, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad integer %q at position %d", tok.val, tok.pos)
+		}
+		return n, nil
+	case 'f':
+		f, err := strconv.ParseFloat(tok.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad float %q at position %d", tok.val, tok.pos)
+		}
+		return f, nil
+	case 's':
+		return tok.val, nil
+	case 'n':
+		switch tok.val {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return tok.val, nil // enum values are treated as strings
+	case 'p':
+		switch tok.val {
+		case "$":
+			if constant {
+				return nil, fmt.Errorf("variable not allowed at position %d", tok.pos)
+			}
+			name, err := p.name()
+			return gqlVar(name), err
+		case "[":
+			list := []interface{}{}
+			for !p.peekPunct("]") {
+				v, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			p.next()
+			return list, nil
+		case "{":
+			obj := make(map[string]interface{})
+			for !p.peekPunct("}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if obj[name], err = p.value(constant); err != nil {
+					return nil, err
+				}
+			}
+			p.next()
+			return obj, nil
+		}
+	}
+	return nil, p.unexpected(tok, "a value")
+}
+
+// gqlFieldDef describes a field of an object type in the schema.
+type gqlFieldDef struct {
+	typ     string   // object type of the value, or "" for a scalar
+	args    []string // names of accepted arguments
+	resolve func(src interface{}, args gqlArgs) (interface{}, error)
+}
+
+// gqlArgs holds the argument values of a field with variables substituted.
+type gqlArgs map[string]interface{}
+
+func (args gqlArgs) str(name string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("argument %q must be a string", name)
+	}
+}
+
+func (args gqlArgs) integer(name string) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return int(v), nil
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("argument %q must be an integer", name)
+		}
+		return int(n), nil
+	default:
+		return 0, fmt.Errorf("argument %q must be an integer", name)
+	}
+}
+
+func (args gqlArgs) boolean(name string) (bool, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	default:
+		return false, fmt.Errorf("argument %q must be a boolean", name)
+	}
+}
+
+// gqlObjectJSON is a result object whose fields are marshaled in selection order.
+type gqlObjectJSON []gqlFieldJSON
+
+type gqlFieldJSON struct {
+	key   string
+	value interface{}
+}
+
+func (obj gqlObjectJSON) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range obj {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		keyBytes, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		valueBytes, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(keyBytes)
+		buf.WriteByte(':')
+		buf.Write(valueBytes)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type gqlErrorJSON struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+type gqlResponseJSON struct {
+	Data   interface{}    `json:"data,omitempty"` // omitted if the query could not be run
+	Errors []gqlErrorJSON `json:"errors,omitempty"`
+}
+
+type gqlExec struct {
+	doc     *gqlDocument
+	vars    map[string]interface{}
+	errs    []gqlErrorJSON
+	invalid bool // query asked for unknown fields or arguments, so no data is returned
+}
+
+func (ex *gqlExec) fail(path []interface{}, invalid bool, format string, args ...interface{}) {
+	ex.errs = append(ex.errs, gqlErrorJSON{fmt.Sprintf(format, args...), append([]interface{}{}, path...)})
+	if invalid {
+		ex.invalid = true
+	}
+}
+
+// Runs a query against the schema.  The operation name is only needed if the
+// document has several operations.
+func runGraphQL(query, opName string, vars map[string]interface{}) *gqlResponseJSON {
+	doc, err := parseGraphQL(query)
+	if err != nil {
+		return &gqlResponseJSON{Errors: []gqlErrorJSON{{Message: err.Error()}}}
+	}
+	var op *gqlOperation
+	for _, o := range doc.ops {
+		if (opName == "" && len(doc.ops) == 1) || (opName != "" && o.name == opName) {
+			op = o
+		}
+	}
+	if op == nil {
+		if opName == "" {
+			return &gqlResponseJSON{Errors: []gqlErrorJSON{{Message: "operationName is required for documents with several operations"}}}
+		}
+		return &gqlResponseJSON{Errors: []gqlErrorJSON{{Message: fmt.Sprintf("no operation named %q", opName)}}}
+	}
+
+	ex := &gqlExec{doc: doc, vars: make(map[string]interface{})}
+	for _, vd := range op.varDefs {
+		v, found := vars[vd.name]
+		if !found && vd.hasDefault {
+			v, found = vd.defaultVal, true
+		}
+		if vd.nonNull && v == nil {
+			return &gqlResponseJSON{Errors: []gqlErrorJSON{{Message: fmt.Sprintf("variable $%s is required", vd.name)}}}
+		}
+		if found {
+			ex.vars[vd.name] = v
+		}
+	}
+	data := ex.object("Query", nil, op.sels, nil)
+	if ex.invalid {
+		return &gqlResponseJSON{Errors: ex.errs}
+	}
+	return &gqlResponseJSON{Data: data, Errors: ex.errs}
+}
+
+// Flattens fragments into the fields selected on an object type, merging fields with the
+// same response key.
+func (ex *gqlExec) collect(typeName string, sels []*gqlSelection, fields []*gqlSelection, visited map[string]bool) []*gqlSelection {
+	for _, sel := range sels {
+		if !sel.spread {
+			merged := false
+			for i, f := range fields {
+				if f.alias == sel.alias {
+					combined := *f
+					combined.sels = append(append([]*gqlSelection{}, f.sels...), sel.sels...)
+					fields[i] = &combined
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				fields = append(fields, sel)
+			}
+			continue
+		}
+		frag := sel
+		if sel.fragment {
+			if visited[sel.name] {
+				continue
+			}
+			var found bool
+			if frag, found = ex.doc.frags[sel.name]; !found {
+				ex.fail(nil, true, "unknown fragment %q", sel.name)
+				continue
+			}
+			visited[sel.name] = true
+		}
+		if frag.onType != "" {
+			if _, found := gqlSchema[frag.onType]; !found {
+				ex.fail(nil, true, "unknown type %q in fragment", frag.onType)
+				continue
+			}
+			if frag.onType != typeName {
+				continue
+			}
+		}
+		fields = ex.collect(typeName, frag.sels, fields, visited)
+	}
+	return fields
+}
+
+// Substitutes variables in an argument value.
+func (ex *gqlExec) argValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case gqlVar:
+		return ex.vars[string(v)]
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			list[i] = ex.argValue(elem)
+		}
+		return list
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			obj[key] = ex.argValue(elem)
+		}
+		return obj
+	}
+	return v
+}
+
+func (ex *gqlExec) object(typeName string, src interface{}, sels []*gqlSelection, path []interface{}) gqlObjectJSON {
+	fieldDefs := gqlSchema[typeName]
+	var obj gqlObjectJSON
+	for _, sel := range ex.collect(typeName, sels, nil, make(map[string]bool)) {
+		fieldPath := append(append([]interface{}{}, path...), sel.alias)
+		if sel.name == "__typename" {
+			obj = append(obj, gqlFieldJSON{sel.alias, typeName})
+			continue
+		}
+		def, found := fieldDefs[sel.name]
+		if !found {
+			ex.fail(fieldPath, true, "cannot query field %q on type %q", sel.name, typeName)
+			continue
+		}
+		args := make(gqlArgs, len(sel.args))
+		for name, v := range sel.args {
+			known := false
+			for _, argName := range def.args {
+				known = known || argName == name
+			}
+			if !known {
+				ex.fail(fieldPath, true, "unknown argument %q on field %q of type %q", name, sel.name, typeName)
+				continue
+			}
+			if gv, isVar := v.(gqlVar); isVar {
+				if _, defined := ex.vars[string(gv)]; !defined {
+					continue // unset variables leave the argument unset
+				}
+			}
+			args[name] = ex.argValue(v)
+		}
+		if def.typ == "" && len(sel.sels) != 0 {
+			ex.fail(fieldPath, true, "field %q of type %q is a scalar and can't have a selection", sel.name, typeName)
+			continue
+		}
+		if def.typ != "" && len(sel.sels) == 0 {
+			ex.fail(fieldPath, true, "field %q of type %q must have a selection", sel.name, typeName)
+			continue
+		}
+		if ex.invalid {
+			continue
+		}
+		value, err := def.resolve(src, args)
+		if err != nil {
+			ex.fail(fieldPath, false, "%v", err)
+			obj = append(obj, gqlFieldJSON{sel.alias, nil})
+			continue
+		}
+		obj = append(obj, gqlFieldJSON{sel.alias, ex.complete(def.typ, value, sel.sels, fieldPath)})
+	}
+	return obj
+}
+
+// Completes a resolved value, selecting fields of objects and lists of objects.
+func (ex *gqlExec) complete(typeName string, value interface{}, sels []*gqlSelection, path []interface{}) interface{} {
+	if typeName == "" || value == nil {
+		return value
+	}
+	if list, isList := value.([]interface{}); isList {
+		results := make([]interface{}, len(list))
+		for i, elem := range list {
+			results[i] = ex.complete(typeName, elem, sels, append(path, i))
+		}
+		return results
+	}
+	return ex.object(typeName, value, sels, path)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// GraphQLSchema documents the types that can be queried at /graphql.
+const GraphQLSchema = `
+type Query {
+	uuids(client: String): [UUID!]!      # UUIDs with checkouts, optionally only those held by a client
+	uuid(id: String!): UUID!
+	clients(active: Boolean): [Client!]! # clients seen, or only those holding checkouts if active
+	client(id: String!): Client!
+	stats: Stats!
+}
+
+type UUID {
+	id: String!
+	revision: Int!
+	checkouts(client: String): [Checkout!]!
+	checkoutCount: Int!
+	history(limit: Int, op: String, client: String): [Op!]!   # last ops, oldest first
+	meta: [Meta!]!
+	metaValue(key: String!): String
+	policy: Policy!
+}
+
+type Checkout {
+	uuid: String!
+	label: Label!
+	client: String!
+	since: Time!
+	expires: Time
+	ageSeconds: Float!
+}
+
+type Op {
+	time: Time!
+	op: String!
+	uuid: String!
+	label: Label       # checkout, checkin, expire, and conflict ops
+	client: String
+	key: String        # metadata ops
+	value: String
+	holder: String     # conflict ops
+	agent: String
+	tool: String
+	opID: String
+	ref: String        # external reference, e.g., a DVID mutation id (see X-Op-Ref)
+	task: String
+	context: String    # work context of the client (see /context)
+	expires: Time
+	principal: String  # authenticated subject that made the request, with -audit
+	ip: String         # source IP of the request, with -audit
+}
+
+type Client {
+	id: String!
+	checkouts(uuid: String): [Checkout!]!
+	checkoutCount: Int!
+	lastActive: Time
+	tools: [Tool!]!
+}
+
+type Tool {
+	agent: String
+	tool: String
+	firstSeen: Time!
+	lastSeen: Time!
+	ops: Int!
+}
+
+type Meta {
+	key: String!
+	value: String!
+}
+
+type Policy {
+	ttl: String
+	maxCheckoutsPerClient: Int!
+	disallowReset: Boolean!
+	labelFormats: [String!]!
+	labelOutput: String
+}
+
+type Stats {
+	uuids: Int!
+	checkouts: Int!
+	clients: Int!
+	revision: Int!
+}
+
+Label is a number, or a string if the UUID's policy sets a LabelOutput.
+Time is an RFC-3339 string.
+`
+
+type gqlCheckout struct {
+	uuid   string
+	label  uint64
+	co     checkoutT
+	format string
+}
+
+type gqlMeta struct {
+	key, value string
+}
+
+// gqlSchema maps each object type to its fields.
+var gqlSchema map[string]map[string]gqlFieldDef
+
+func init() {
+	gqlSchema = map[string]map[string]gqlFieldDef{
+		"Query": {
+			"uuids":   {"UUID", []string{"client"}, gqlUUIDs},
+			"uuid":    {"UUID", []string{"id"}, gqlRequiredID},
+			"clients": {"Client", []string{"active"}, gqlClients},
+			"client": {"Client", []string{"id"}, func(src interface{}, args gqlArgs) (interface{}, error) {
+				id, err := gqlRequiredID(src, args)
+				if err != nil {
+					return nil, err
+				}
+				return normalizeClientID(id.(string)), nil
+			}},
+			"stats": {"Stats", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return struct{}{}, nil }},
+		},
+		"UUID": {
+			"id": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src, nil }},
+			"revision": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				library.RLock()
+				defer library.RUnlock()
+				return library.revs[src.(string)], nil
+			}},
+			"checkouts": {"Checkout", []string{"client"}, func(src interface{}, args gqlArgs) (interface{}, error) {
+				client, err := args.str("client")
+				if err != nil {
+					return nil, err
+				}
+				return gqlCheckouts(src.(string), client), nil
+			}},
+			"checkoutCount": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				library.RLock()
+				defer library.RUnlock()
+				return len(library.vchk[src.(string)]), nil
+			}},
+			"history":   {"Op", []string{"limit", "op", "client"}, gqlHistory},
+			"meta":      {"Meta", nil, gqlMetas},
+			"metaValue": {"", []string{"key"}, gqlMetaValue},
+			"policy": {"Policy", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				return getPolicy(src.(string)), nil
+			}},
+		},
+		"Checkout": {
+			"uuid": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(gqlCheckout).uuid, nil }},
+			"label": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				c := src.(gqlCheckout)
+				return labelJSON{c.label, c.format}, nil
+			}},
+			"client": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(gqlCheckout).co.client, nil }},
+			"since":  {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(gqlCheckout).co.t, nil }},
+			"expires": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				if expires := src.(gqlCheckout).co.expires; !expires.IsZero() {
+					return expires, nil
+				}
+				return nil, nil
+			}},
+			"ageSeconds": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				return clock.Now().Sub(src.(gqlCheckout).co.t).Seconds(), nil
+			}},
+		},
+		"Op": {
+			"time": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(*libraryOp).t, nil }},
+			"op":   {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(*libraryOp).op.String(), nil }},
+			"uuid": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(*libraryOp).uuid, nil }},
+			"label": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				op := src.(*libraryOp)
+				switch op.op {
+				case CheckoutOp, CheckinOp, ExpireOp, ConflictOp, RenewOp:
+					return labelJSON{op.label, getPolicy(op.uuid).LabelOutput}, nil
+				}
+				return nil, nil
+			}},
+			"client": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				if client := src.(*libraryOp).client; client != "n/a" {
+					return client, nil
+				}
+				return nil, nil
+			}},
+			"key":       gqlOpAttr("key"),
+			"value":     gqlOpAttr("value"),
+			"holder":    gqlOpAttr("holder"),
+			"agent":     gqlOpAttr("agent"),
+			"tool":      gqlOpAttr("tool"),
+			"opID":      gqlOpAttr("opid"),
+			"ref":       gqlOpAttr("ref"),
+			"task":      gqlOpAttr("task"),
+			"context":   gqlOpAttr("context"),
+			"expires":   gqlOpAttr("expires"),
+			"principal": gqlOpAttr("principal"),
+			"ip":        gqlOpAttr("ip"),
+		},
+		"Client": {
+			"id": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src, nil }},
+			"checkouts": {"Checkout", []string{"uuid"}, func(src interface{}, args gqlArgs) (interface{}, error) {
+				uuid, err := args.str("uuid")
+				if err != nil {
+					return nil, err
+				}
+				if uuid != "" {
+					return gqlCheckouts(uuid, src.(string)), nil
+				}
+				var checkouts []interface{}
+				for _, uuid := range getUUIDsState().UUIDs {
+					checkouts = append(checkouts, gqlCheckouts(uuid, src.(string))...)
+				}
+				return gqlList(checkouts), nil
+			}},
+			"checkoutCount": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				library.RLock()
+				defer library.RUnlock()
+				n := 0
+				for _, checkouts := range library.vchk {
+					for _, co := range checkouts {
+						if co.client == src.(string) {
+							n++
+						}
+					}
+				}
+				return n, nil
+			}},
+			"lastActive": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				library.RLock()
+				defer library.RUnlock()
+				if stats, found := library.clients[src.(string)]; found && !stats.lastActive.IsZero() {
+					return stats.lastActive, nil
+				}
+				return nil, nil
+			}},
+			"tools": {"Tool", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				tools := getClientTools(src.(string)).Tools
+				list := make([]interface{}, len(tools))
+				for i, tool := range tools {
+					list[i] = tool
+				}
+				return list, nil
+			}},
+		},
+		"Tool": {
+			"agent": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				return gqlOptional(src.(toolJSON).Agent), nil
+			}},
+			"tool":      {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return gqlOptional(src.(toolJSON).Tool), nil }},
+			"firstSeen": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(toolJSON).FirstSeen, nil }},
+			"lastSeen":  {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(toolJSON).LastSeen, nil }},
+			"ops":       {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(toolJSON).Ops, nil }},
+		},
+		"Meta": {
+			"key":   {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(gqlMeta).key, nil }},
+			"value": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(gqlMeta).value, nil }},
+		},
+		"Policy": {
+			"ttl": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				return gqlOptional(src.(*policyJSON).TTL), nil
+			}},
+			"maxCheckoutsPerClient": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				return src.(*policyJSON).MaxCheckoutsPerClient, nil
+			}},
+			"disallowReset": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return src.(*policyJSON).DisallowReset, nil }},
+			"labelFormats": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				if formats := src.(*policyJSON).LabelFormats; formats != nil {
+					return formats, nil
+				}
+				return []string{}, nil
+			}},
+			"labelOutput": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				return gqlOptional(src.(*policyJSON).LabelOutput), nil
+			}},
+		},
+		"Stats": {
+			"uuids": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) { return len(getUUIDs()), nil }},
+			"checkouts": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				library.RLock()
+				defer library.RUnlock()
+				n := 0
+				for _, checkouts := range library.vchk {
+					n += len(checkouts)
+				}
+				return n, nil
+			}},
+			"clients": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				library.RLock()
+				defer library.RUnlock()
+				return len(library.clients), nil
+			}},
+			"revision": {"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+				library.RLock()
+				defer library.RUnlock()
+				return library.revision, nil
+			}},
+		},
+	}
+}
+
+// Returns nil for empty strings so optional fields are null.
+func gqlOptional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Returns a non-nil list so empty lists are [] rather than null.
+func gqlList(list []interface{}) []interface{} {
+	if list == nil {
+		return []interface{}{}
+	}
+	return list
+}
+
+func gqlOpAttr(name string) gqlFieldDef {
+	return gqlFieldDef{"", nil, func(src interface{}, args gqlArgs) (interface{}, error) {
+		return gqlOptional(src.(*libraryOp).attrs[name]), nil
+	}}
+}
+
+func gqlRequiredID(src interface{}, args gqlArgs) (interface{}, error) {
+	id, err := args.str("id")
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("argument \"id\" is required")
+	}
+	return id, nil
+}
+
+func gqlUUIDs(src interface{}, args gqlArgs) (interface{}, error) {
+	client, err := args.str("client")
+	if err != nil {
+		return nil, err
+	}
+	client = normalizeClientID(client)
+	var uuids []interface{}
+	for _, uuid := range getUUIDsState().UUIDs {
+		if client == "" || len(gqlCheckouts(uuid, client)) > 0 {
+			uuids = append(uuids, uuid)
+		}
+	}
+	return gqlList(uuids), nil
+}
+
+func gqlClients(src interface{}, args gqlArgs) (interface{}, error) {
+	active, err := args.boolean("active")
+	if err != nil {
+		return nil, err
+	}
+	library.RLock()
+	holding := make(map[string]bool)
+	for _, checkouts := range library.vchk {
+		for _, co := range checkouts {
+			holding[co.client] = true
+		}
+	}
+	var clients []string
+	for client := range library.clients {
+		if !active || holding[client] {
+			clients = append(clients, client)
+		}
+	}
+	library.RUnlock()
+
+	sort.Strings(clients)
+	list := make([]interface{}, len(clients))
+	for i, client := range clients {
+		list[i] = client
+	}
+	return list, nil
+}
+
+// Returns the checkouts of a uuid, sorted by label, optionally only those of a client.
+func gqlCheckouts(uuid, client string) []interface{} {
+	format := getPolicy(uuid).LabelOutput
+	client = normalizeClientID(client)
+
+	library.RLock()
+	var checkouts []gqlCheckout
+	for label, co := range library.vchk[uuid] {
+		if client == "" || co.client == client {
+			checkouts = append(checkouts, gqlCheckout{uuid, label, co, format})
+		}
+	}
+	library.RUnlock()
+
+	sort.Slice(checkouts, func(i, j int) bool { return checkouts[i].label < checkouts[j].label })
+	list := make([]interface{}, len(checkouts))
+	for i, c := range checkouts {
+		list[i] = c
+	}
+	return list
+}
+
+func gqlHistory(src interface{}, args gqlArgs) (interface{}, error) {
+	limit, err := args.integer("limit")
+	if err != nil {
+		return nil, err
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("argument \"limit\" cannot be negative")
+	}
+	opName, err := args.str("op")
+	if err != nil {
+		return nil, err
+	}
+	client, err := args.str("client")
+	if err != nil {
+		return nil, err
+	}
+	client = normalizeClientID(client)
+
+	var keep func(op *libraryOp) bool
+	if opName != "" || client != "" {
+		keep = func(op *libraryOp) bool {
+			return (opName == "" || op.op.String() == opName) && (client == "" || op.client == client)
+		}
+	}
+	ops, err := readHx(src.(string), limit, keep)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]interface{}, len(ops))
+	for i, op := range ops {
+		list[i] = op
+	}
+	return list, nil
+}
+
+func gqlMetas(src interface{}, args gqlArgs) (interface{}, error) {
+	library.RLock()
+	var metas []gqlMeta
+	for key, value := range library.meta[src.(string)] {
+		metas = append(metas, gqlMeta{key, value})
+	}
+	library.RUnlock()
+
+	sort.Slice(metas, func(i, j int) bool { return metas[i].key < metas[j].key })
+	list := make([]interface{}, len(metas))
+	for i, m := range metas {
+		list[i] = m
+	}
+	return list, nil
+}
+
+func gqlMetaValue(src interface{}, args gqlArgs) (interface{}, error) {
+	key, err := args.str("key")
+	if err != nil {
+		return nil, err
+	}
+	if value, found := getMeta(src.(string), key); found {
+		return value, nil
+	}
+	return nil, nil
+}
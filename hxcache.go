@@ -0,0 +1,315 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// History cache metrics, exported via expvar at /debug/vars.
+var (
+	hxCacheHitsVar   = expvar.NewInt("librarian_history_cache_hits")
+	hxCacheMissesVar = expvar.NewInt("librarian_history_cache_misses")
+	hxCacheBuildsVar = expvar.NewInt("librarian_history_cache_builds")
+	hxCacheUUIDsVar  = expvar.NewInt("librarian_history_cache_uuids")
+	hxCacheOpsVar    = expvar.NewInt("librarian_history_cache_ops")
+)
+
+// hxEntryT is the full history of a uuid materialized in memory, kept up to date as ops
+// are written.  Ops are only appended, so slices of them can be handed out.
+type hxEntryT struct {
+	ops      []*libraryOp
+	pending  []*libraryOp // ops written while the history was being read from the log
+	ready    bool
+	built    time.Time
+	buildDur time.Duration
+}
+
+// hxCacheT holds the full histories of the -historycache uuids queried most, counted with
+// a least-frequently-used policy whose counts halve every minute so recent queries weigh
+// more.
+type hxCacheT struct {
+	sync.Mutex
+	entries map[string]*hxEntryT
+	counts  map[string]float64 // uuid -> decayed number of full history queries
+}
+
+var hxCache = hxCacheT{entries: make(map[string]*hxEntryT), counts: make(map[string]float64)}
+
+// Returns the number of uuids whose histories are cached, or 0 if there's no cache.
+func hxCacheSize() int {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return *historyCache
+}
+
+// Adds an op written to the log to its uuid's cached history, if any.  Must be called with
+// library lock held.
+func noteCachedHx(op *libraryOp) {
+	hxCache.Lock()
+	defer hxCache.Unlock()
+
+	entry, found := hxCache.entries[op.uuid]
+	switch {
+	case !found:
+	case entry.ready:
+		entry.ops = append(entry.ops, op)
+		hxCacheOpsVar.Add(1)
+	default:
+		entry.pending = append(entry.pending, op)
+	}
+}
+
+// Returns the full cached history of a uuid with renamed clients given by their current
+// ids.  Counts the query toward caching the uuid, and if it's now among the most queried,
+// starts building its history in the background.
+func cachedHx(uuid string) ([]*libraryOp, bool) {
+	size := hxCacheSize()
+	if size == 0 {
+		return nil, false
+	}
+	hxCache.Lock()
+	hxCache.counts[uuid]++
+	entry, found := hxCache.entries[uuid]
+	var ops []*libraryOp
+	if found && entry.ready {
+		ops = entry.ops[:len(entry.ops):len(entry.ops)]
+	}
+	build := !found && hxCache.topLocked(size)[uuid] && !getMemory().OverCap
+	hxCache.Unlock()
+
+	if ops == nil {
+		hxCacheMissesVar.Add(1)
+		if build {
+			go func() {
+				if _, err := buildCachedHx(uuid); err != nil {
+					log.Printf("ERROR: unable to cache history of uuid %s: %v\n", uuid, err)
+				}
+			}()
+		}
+		return nil, false
+	}
+	hxCacheHitsVar.Add(1)
+
+	library.RLock()
+	defer library.RUnlock()
+	if len(library.aliases) > 0 {
+		aliased := make([]*libraryOp, len(ops))
+		for i, op := range ops {
+			aliased[i] = library.aliases.apply(op)
+		}
+		ops = aliased
+	}
+	return ops, true
+}
+
+// Returns the size uuids with the highest query counts.  Must be called with hxCache
+// locked.
+func (c *hxCacheT) topLocked(size int) map[string]bool {
+	uuids := make([]string, 0, len(c.counts))
+	for uuid := range c.counts {
+		uuids = append(uuids, uuid)
+	}
+	sort.Slice(uuids, func(i, j int) bool {
+		if c.counts[uuids[i]] != c.counts[uuids[j]] {
+			return c.counts[uuids[i]] > c.counts[uuids[j]]
+		}
+		return uuids[i] < uuids[j]
+	})
+	if len(uuids) > size {
+		uuids = uuids[:size]
+	}
+	top := make(map[string]bool, len(uuids))
+	for _, uuid := range uuids {
+		top[uuid] = true
+	}
+	return top
+}
+
+// Reads the full history of a uuid from the log into the cache, replacing any cached
+// history.  Ops written during the read are added after it.  Returns the ops cached.
+func buildCachedHx(uuid string) (int, error) {
+	hxCache.Lock()
+	if entry, found := hxCache.entries[uuid]; found && !entry.ready {
+		hxCache.Unlock()
+		return 0, fmt.Errorf("history of uuid %s is already being cached", uuid)
+	}
+	entry := &hxEntryT{}
+	if old, found := hxCache.entries[uuid]; found {
+		hxCacheOpsVar.Add(-int64(len(old.ops)))
+	}
+	hxCache.entries[uuid] = entry
+	hxCacheUUIDsVar.Set(int64(len(hxCache.entries)))
+	hxCache.Unlock()
+
+	start := time.Now()
+	fnames, err := historyFiles()
+	var ops []*libraryOp
+	var lastSeq uint64
+	opIDs := make(map[string]bool)
+	for _, fname := range fnames {
+		if err != nil {
+			break
+		}
+		err = readFileHx(fname, uuid, opIDs, func(op *libraryOp) error {
+			ops = append(ops, op)
+			if op.seq > lastSeq {
+				lastSeq = op.seq
+			}
+			return nil
+		})
+	}
+
+	hxCache.Lock()
+	defer hxCache.Unlock()
+	if hxCache.entries[uuid] != entry {
+		return 0, fmt.Errorf("history of uuid %s was dropped from the cache while being read", uuid)
+	}
+	if err != nil {
+		delete(hxCache.entries, uuid)
+		hxCacheUUIDsVar.Set(int64(len(hxCache.entries)))
+		return 0, err
+	}
+	for _, op := range entry.pending {
+		if op.seq > lastSeq {
+			ops = append(ops, op)
+		}
+	}
+	entry.ops, entry.pending, entry.ready = ops, nil, true
+	entry.built, entry.buildDur = clock.Now(), time.Since(start)
+	hxCacheBuildsVar.Add(1)
+	hxCacheOpsVar.Add(int64(len(ops)))
+	log.Printf("Cached %d history ops of uuid %s in %s\n", len(ops), uuid, entry.buildDur)
+	return len(ops), nil
+}
+
+// Drops a uuid's cached history.  Must be called with hxCache locked.
+func dropCachedHxLocked(uuid string) {
+	if entry, found := hxCache.entries[uuid]; found {
+		hxCacheOpsVar.Add(-int64(len(entry.ops)))
+		delete(hxCache.entries, uuid)
+		hxCacheUUIDsVar.Set(int64(len(hxCache.entries)))
+	}
+}
+
+// Drops every cached history, e.g., after history is imported before the cached ops.
+func clearCachedHx() {
+	hxCache.Lock()
+	defer hxCache.Unlock()
+	for uuid := range hxCache.entries {
+		dropCachedHxLocked(uuid)
+	}
+}
+
+// Run every minute: halves the query counts, drops the histories of uuids no longer among
+// the most queried, and builds those of the uuids that are unless the library is over
+// -maxmemory.
+func materializeHistory() {
+	size := hxCacheSize()
+	if getMemory().OverCap {
+		size = 0
+	}
+	hxCache.Lock()
+	for uuid, count := range hxCache.counts {
+		if count < 0.5 {
+			delete(hxCache.counts, uuid)
+		} else {
+			hxCache.counts[uuid] = count / 2
+		}
+	}
+	top := hxCache.topLocked(size)
+	var build []string
+	for uuid, entry := range hxCache.entries {
+		if !top[uuid] && entry.ready {
+			dropCachedHxLocked(uuid)
+		}
+	}
+	for uuid := range top {
+		if _, found := hxCache.entries[uuid]; !found {
+			build = append(build, uuid)
+		}
+	}
+	hxCache.Unlock()
+
+	sort.Strings(build)
+	for _, uuid := range build {
+		if _, err := buildCachedHx(uuid); err != nil {
+			log.Printf("ERROR: unable to cache history of uuid %s: %v\n", uuid, err)
+		}
+	}
+}
+
+type hxCacheUUIDJSON struct {
+	UUID      string
+	Queries   float64 // decayed count used to choose the cached uuids
+	Cached    bool
+	Ops       int        `json:",omitempty"`
+	Built     *time.Time `json:",omitempty"`
+	BuildTime string     `json:",omitempty"`
+}
+
+// hxCacheJSON describes the history cache for GET /admin/history-cache.
+type hxCacheJSON struct {
+	Size   int // -historycache
+	Hits   int64
+	Misses int64
+	Builds int64
+	Ops    int64
+	UUIDs  []hxCacheUUIDJSON
+}
+
+func getHxCache() hxCacheJSON {
+	hc := hxCacheJSON{
+		Size:   hxCacheSize(),
+		Hits:   hxCacheHitsVar.Value(),
+		Misses: hxCacheMissesVar.Value(),
+		Builds: hxCacheBuildsVar.Value(),
+		Ops:    hxCacheOpsVar.Value(),
+		UUIDs:  []hxCacheUUIDJSON{},
+	}
+	hxCache.Lock()
+	defer hxCache.Unlock()
+	uuids := make(map[string]bool)
+	for uuid := range hxCache.counts {
+		uuids[uuid] = true
+	}
+	for uuid := range hxCache.entries {
+		uuids[uuid] = true
+	}
+	for uuid := range uuids {
+		u := hxCacheUUIDJSON{UUID: uuid, Queries: hxCache.counts[uuid]}
+		if entry, found := hxCache.entries[uuid]; found && entry.ready {
+			built := entry.built
+			u.Cached, u.Ops, u.Built, u.BuildTime = true, len(entry.ops), &built, entry.buildDur.String()
+		}
+		hc.UUIDs = append(hc.UUIDs, u)
+	}
+	sort.Slice(hc.UUIDs, func(i, j int) bool {
+		if hc.UUIDs[i].Queries != hc.UUIDs[j].Queries {
+			return hc.UUIDs[i].Queries > hc.UUIDs[j].Queries
+		}
+		return hc.UUIDs[i].UUID < hc.UUIDs[j].UUID
+	})
+	return hc
+}
+
+// Builds a uuid's history in the cache now and counts it as queried once more than the
+// most queried uuid so it stays cached until queries of others outweigh it.
+func warmCachedHx(uuid string) (int, error) {
+	if hxCacheSize() == 0 {
+		return 0, fmt.Errorf("history cache is off; set -historycache")
+	}
+	hxCache.Lock()
+	max := 0.0
+	for _, count := range hxCache.counts {
+		if count > max {
+			max = count
+		}
+	}
+	hxCache.counts[uuid] = max + 1
+	hxCache.Unlock()
+	return buildCachedHx(uuid)
+}
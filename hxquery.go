@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MaxHxQueryLength is the longest history query in bytes.
+const MaxHxQueryLength = 2000
+
+// hxQueryDateFmt is a date in a history query, which is midnight in the -timezone.
+const hxQueryDateFmt = "2006-01-02"
+
+// hxPredT reports whether a history op matches a parsed history query.
+type hxPredT func(op *libraryOp) bool
+
+// hxQueryParser parses queries like `client=katzw AND op=checkout AND time>2024-01-01`:
+//
+//	query      = and { "OR" and }
+//	and        = not { "AND" not }
+//	not        = "NOT" not | "(" query ")" | comparison
+//	comparison = field ( "=" | "!=" | "<" | "<=" | ">" | ">=" | "~" ) value
+//
+// Keywords are case-insensitive and values with spaces or operators are double-quoted.
+type hxQueryParser struct {
+	uuid   string
+	tokens []string
+	pos    int
+}
+
+// Splits a history query into words, quoted strings, parentheses, and operators.
+func tokenizeHxQuery(q string) ([]string, error) {
+	var tokens []string
+	isOpChar := func(r rune) bool { return strings.ContainsRune("=!<>~", r) }
+	for i := 0; i < len(q); {
+		r := rune(q[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, string(r))
+			i++
+		case isOpChar(r):
+			j := i + 1
+			if j < len(q) && q[j] == '=' && r != '=' && r != '~' {
+				j++
+			}
+			tokens = append(tokens, q[i:j])
+			i = j
+		case r == '"':
+			s, err := strconv.QuotedPrefix(q[i:])
+			if err != nil {
+				return nil, fmt.Errorf("unterminated quoted value at %q", q[i:])
+			}
+			tokens = append(tokens, s)
+			i += len(s)
+		default:
+			j := i
+			for j < len(q) && !unicode.IsSpace(rune(q[j])) && !strings.ContainsRune(`()"`, rune(q[j])) && !isOpChar(rune(q[j])) {
+				j++
+			}
+			tokens = append(tokens, q[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// Parses a history query for a uuid, whose policy sets the accepted label formats.
+func parseHxQuery(uuid, q string) (hxPredT, error) {
+	if len(q) > MaxHxQueryLength {
+		return nil, fmt.Errorf("history query is over %d bytes", MaxHxQueryLength)
+	}
+	tokens, err := tokenizeHxQuery(q)
+	if err != nil {
+		return nil, fmt.Errorf("bad history query: %v", err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("history query is empty")
+	}
+	p := &hxQueryParser{uuid: uuid, tokens: tokens}
+	pred, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad history query %q: %v", q, err)
+	}
+	return pred, nil
+}
+
+func (p *hxQueryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// Returns the next token, or an error naming what was expected if there are none.
+func (p *hxQueryParser) next(expected string) (string, error) {
+	if p.pos == len(p.tokens) {
+		return "", fmt.Errorf("expected %s at end of query", expected)
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *hxQueryParser) keyword(kw string) bool {
+	if strings.EqualFold(p.peek(), kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *hxQueryParser) parseOr() (hxPredT, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(op *libraryOp) bool { return l(op) || right(op) }
+	}
+	return left, nil
+}
+
+func (p *hxQueryParser) parseAnd() (hxPredT, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(op *libraryOp) bool { return l(op) && right(op) }
+	}
+	return left, nil
+}
+
+func (p *hxQueryParser) parseNot() (hxPredT, error) {
+	if p.keyword("NOT") {
+		pred, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(op *libraryOp) bool { return !pred(op) }, nil
+	}
+	if p.peek() == "(" {
+		p.pos++
+		pred, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(`")"`); err != nil {
+			return nil, err
+		} else if tok != ")" {
+			return nil, fmt.Errorf(`expected ")" but got %q`, tok)
+		}
+		return pred, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *hxQueryParser) parseComparison() (hxPredT, error) {
+	field, err := p.next("a field")
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(field, `()"=!<>~`) {
+		return nil, fmt.Errorf("expected a field but got %q", field)
+	}
+	cmp, err := p.next("a comparison after " + field)
+	if err != nil {
+		return nil, err
+	}
+	switch cmp {
+	case "=", "!=", "<", "<=", ">", ">=", "~":
+	default:
+		return nil, fmt.Errorf("expected a comparison after %s but got %q", field, cmp)
+	}
+	value, err := p.next("a value after " + field + cmp)
+	if err != nil {
+		return nil, err
+	}
+	if value == "(" || value == ")" || strings.ContainsAny(value[:1], "=!<>~") {
+		return nil, fmt.Errorf("expected a value after %s%s but got %q", field, cmp, value)
+	}
+	if strings.HasPrefix(value, `"`) {
+		value, _ = strconv.Unquote(value) // checked by tokenizeHxQuery
+	}
+
+	switch strings.ToLower(field) {
+	case "op":
+		opT := opTypeFromString(value)
+		if opT == UnknownOp {
+			return nil, fmt.Errorf("bad op %q", value)
+		}
+		switch cmp {
+		case "=":
+			return func(op *libraryOp) bool { return op.op == opT }, nil
+		case "!=":
+			return func(op *libraryOp) bool { return op.op != opT }, nil
+		}
+		return nil, fmt.Errorf("op can only be compared with = or !=")
+	case "label":
+		label, err := parseLabel(p.uuid, value)
+		if err != nil {
+			return nil, err
+		}
+		match, err := compareUints(field, cmp, label)
+		if err != nil {
+			return nil, err
+		}
+		return func(op *libraryOp) bool {
+			if op.op == LabelResetOp {
+				for _, released := range op.resetLabels() {
+					if match(released) {
+						return true
+					}
+				}
+				return false
+			}
+			return op.label != 0 && match(op.label)
+		}, nil
+	case "seq":
+		seq, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("seq must be a sequence number, not %q", value)
+		}
+		match, err := compareUints(field, cmp, seq)
+		if err != nil {
+			return nil, err
+		}
+		return func(op *libraryOp) bool { return op.seq != 0 && match(op.seq) }, nil
+	case "time":
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			if t, err = time.ParseInLocation(hxQueryDateFmt, value, displayZone); err != nil {
+				return nil, fmt.Errorf("time must be like \"2015-12-19T16:39:57-08:00\" or \"2015-12-19\", not %q", value)
+			}
+		}
+		var match func(time.Time) bool
+		switch cmp {
+		case "=":
+			match = t.Equal
+		case "!=":
+			match = func(opT time.Time) bool { return !opT.Equal(t) }
+		case "<":
+			match = func(opT time.Time) bool { return opT.Before(t) }
+		case "<=":
+			match = func(opT time.Time) bool { return !opT.After(t) }
+		case ">":
+			match = func(opT time.Time) bool { return opT.After(t) }
+		case ">=":
+			match = func(opT time.Time) bool { return !opT.Before(t) }
+		default:
+			return nil, fmt.Errorf("time can't be compared with %s", cmp)
+		}
+		return func(op *libraryOp) bool { return match(op.t) }, nil
+	}
+
+	// Other fields are the client or op attributes, e.g., "agent" or "task", compared as text.
+	get := func(op *libraryOp) (string, bool) {
+		s, found := op.attrs[field]
+		return s, found
+	}
+	if strings.EqualFold(field, "client") {
+		get = func(op *libraryOp) (string, bool) { return op.client, true }
+	}
+	switch cmp {
+	case "=":
+		return func(op *libraryOp) bool { s, found := get(op); return found && s == value }, nil
+	case "!=":
+		return func(op *libraryOp) bool { s, found := get(op); return !found || s != value }, nil
+	case "~":
+		match, err := parsePattern(field, value)
+		if err != nil {
+			return nil, err
+		}
+		return func(op *libraryOp) bool { s, found := get(op); return found && match(s) }, nil
+	}
+	return nil, fmt.Errorf("%s can only be compared with =, !=, or ~", field)
+}
+
+// Returns a function comparing a number to n.
+func compareUints(field, cmp string, n uint64) (func(uint64) bool, error) {
+	switch cmp {
+	case "=":
+		return func(x uint64) bool { return x == n }, nil
+	case "!=":
+		return func(x uint64) bool { return x != n }, nil
+	case "<":
+		return func(x uint64) bool { return x < n }, nil
+	case "<=":
+		return func(x uint64) bool { return x <= n }, nil
+	case ">":
+		return func(x uint64) bool { return x > n }, nil
+	case ">=":
+		return func(x uint64) bool { return x >= n }, nil
+	}
+	return nil, fmt.Errorf("%s can't be compared with %s", field, cmp)
+}
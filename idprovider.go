@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UnknownClientCode is the error code of checkouts by client ids the -idprovider doesn't know.
+const UnknownClientCode = "UNKNOWN_CLIENT"
+
+const (
+	// How long a client id found in the -idprovider directory is trusted.
+	knownIdentityTTL = time.Hour
+
+	// How long a client id missing from the directory is refused before it's looked up
+	// again, so new accounts can check out soon after they are created.
+	unknownIdentityTTL = time.Minute
+)
+
+// identityT is a client's entry in the -idprovider directory.
+type identityT struct {
+	Name   string   `json:",omitempty"` // full name
+	Groups []string `json:",omitempty"`
+}
+
+// idProvider looks up client ids in a directory.  lookup returns nil without an error if
+// the directory has no such client.
+type idProvider interface {
+	lookup(clientid string) (*identityT, error)
+	String() string
+}
+
+type cachedIdentity struct {
+	id *identityT // nil if the client is unknown
+	t  time.Time
+}
+
+var identities = struct {
+	sync.Mutex
+	provider idProvider
+	cache    map[string]cachedIdentity
+}{cache: make(map[string]cachedIdentity)}
+
+// ErrUnknownClient is returned for client ids the -idprovider directory doesn't have.
+type ErrUnknownClient struct {
+	Client   string
+	Provider string
+}
+
+func (e *ErrUnknownClient) Error() string {
+	return fmt.Sprintf("client id %q is not in %s", e.Client, e.Provider)
+}
+
+// Sets up the -idprovider.  "ldap://host/basedn?attr" and "ldaps://" URLs use an LDAP or
+// Active Directory server.
+func initIDProvider(providerURL, bindFile string) error {
+	u, err := url.Parse(providerURL)
+	if err != nil {
+		return fmt.Errorf("bad -idprovider %q: %v", providerURL, err)
+	}
+	var provider idProvider
+	switch u.Scheme {
+	case "ldap", "ldaps":
+		if provider, err = newLDAPProvider(u, bindFile); err != nil {
+			return fmt.Errorf("bad -idprovider %q: %v", providerURL, err)
+		}
+	default:
+		return fmt.Errorf("bad -idprovider %q: unknown scheme %q, must be ldap or ldaps", providerURL, u.Scheme)
+	}
+	identities.Lock()
+	identities.provider = provider
+	identities.Unlock()
+	log.Printf("Checking client ids against %s\n", provider)
+	return nil
+}
+
+// Returns the directory entry of a client id, or nil if there's no -idprovider or the
+// client isn't in the directory.  Results are cached.
+func lookupIdentity(clientid string) (*identityT, error) {
+	identities.Lock()
+	provider := identities.provider
+	cached, found := identities.cache[clientid]
+	identities.Unlock()
+	if provider == nil {
+		return nil, nil
+	}
+	if found {
+		ttl := knownIdentityTTL
+		if cached.id == nil {
+			ttl = unknownIdentityTTL
+		}
+		if time.Since(cached.t) < ttl {
+			return cached.id, nil
+		}
+	}
+
+	id, err := provider.lookup(clientid)
+	if err != nil {
+		return nil, err
+	}
+	identities.Lock()
+	identities.cache[clientid] = cachedIdentity{id, time.Now()}
+	identities.Unlock()
+	return id, nil
+}
+
+// Returns an ErrUnknownClient if the -idprovider directory doesn't have a client id.  If
+// the directory can't be reached, clients are allowed so checkouts keep working.
+func checkIdentity(clientid string) error {
+	identities.Lock()
+	provider := identities.provider
+	identities.Unlock()
+	if provider == nil {
+		return nil
+	}
+	id, err := lookupIdentity(clientid)
+	if err != nil {
+		log.Printf("WARNING: unable to look up client id %q in %s, so it is allowed: %v\n", clientid, provider, err)
+		return nil
+	}
+	if id == nil {
+		return &ErrUnknownClient{clientid, provider.String()}
+	}
+	return nil
+}
+
+// Returns the directory entries of the clients holding checkouts, or nil if there's no
+// -idprovider.  Clients that aren't in the directory are left out, and none are looked
+// up after a lookup fails.
+func checkoutIdentities(checkouts []reserveJSON) map[string]identityT {
+	identities.Lock()
+	provider := identities.provider
+	identities.Unlock()
+	if provider == nil {
+		return nil
+	}
+	ids := make(map[string]identityT)
+	for _, rsv := range checkouts {
+		if _, found := ids[rsv.Client]; found {
+			continue
+		}
+		id, err := lookupIdentity(rsv.Client)
+		if err != nil {
+			// Don't wait on an unreachable directory for every client.
+			log.Printf("WARNING: unable to look up client id %q in %s: %v\n", rsv.Client, provider, err)
+			break
+		}
+		if id != nil {
+			ids[rsv.Client] = *id
+		}
+	}
+	return ids
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// MaxImportRows is the most rows imported by one POST /admin/import-history.  Longer audit
+// trails are imported in chunks.
+const MaxImportRows = 1 << 20
+
+// importSegmentSuffix ends the names of log segments holding imported history.
+const importSegmentSuffix = "-import"
+
+// Formats of times in imported audit trails.  Those without a zone are in the -timezone.
+var importTimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"1/2/2006 15:04:05",
+	"1/2/2006 15:04",
+}
+
+// Ops that can be imported, which are those of history that don't carry state.
+var importOps = map[opType]bool{
+	CheckoutOp: true,
+	CheckinOp:  true,
+	RenewOp:    true,
+	ExpireOp:   true,
+	ResetOp:    true,
+	ConflictOp: true,
+}
+
+// Alternate names of the required columns of an audit trail.
+var importColumnNames = map[string]string{
+	"timestamp": "time",
+	"date":      "time",
+	"user":      "client",
+}
+
+var importAttrRE = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// Imports are done one at a time since each must come before all history.
+var importMu sync.Mutex
+
+// importHistoryJSON describes the ops imported into a log segment.
+type importHistoryJSON struct {
+	Segment string
+	Ops     int
+	UUIDs   int
+	From    time.Time
+	To      time.Time
+}
+
+// Parses the time of an imported op.
+func parseImportTime(s string) (time.Time, error) {
+	for _, format := range importTimeFormats {
+		if t, err := time.ParseInLocation(format, s, displayZone); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q: must be like \"2015-12-19T16:39:57-08:00\" or \"2015-12-19 16:39:57\"", s)
+}
+
+// Reads the ops of a CSV audit trail with a header row naming its columns.  "time",
+// "uuid", "op", and "client" are required, "label" is optional, and any other columns are
+// kept as op attributes.  Ops are returned sorted by time.
+func readImportCSV(r io.Reader, source string) ([]*libraryOp, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("audit trail is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad header row: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	attrs := make(map[int]string)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if alias, found := importColumnNames[name]; found {
+			name = alias
+		}
+		switch name {
+		case "time", "uuid", "op", "label", "client":
+			if _, found := columns[name]; found {
+				return nil, fmt.Errorf("header row has column %q twice", name)
+			}
+			columns[name] = i
+		case SeqAttr, "import":
+			return nil, fmt.Errorf("column %q is reserved", name)
+		default:
+			if key := strings.Trim(importAttrRE.ReplaceAllString(name, "_"), "_"); key != "" {
+				attrs[i] = key
+			}
+		}
+	}
+	for _, name := range []string{"time", "uuid", "op", "client"} {
+		if _, found := columns[name]; !found {
+			return nil, fmt.Errorf("header row has no %q column", name)
+		}
+	}
+
+	var ops []*libraryOp
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(ops) == MaxImportRows {
+			return nil, fmt.Errorf("more than %d rows, so import the audit trail in chunks", MaxImportRows)
+		}
+		field := func(name string) string {
+			if i, found := columns[name]; found && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		op := &libraryOp{
+			op:    opTypeFromString(strings.ToLower(field("op"))),
+			uuid:  field("uuid"),
+			attrs: map[string]string{"import": source},
+		}
+		if !importOps[op.op] {
+			return nil, fmt.Errorf("row %d: op %q can't be imported", row, field("op"))
+		}
+		if op.t, err = parseImportTime(field("time")); err != nil {
+			return nil, fmt.Errorf("row %d: %v", row, err)
+		}
+		if op.uuid == "" || strings.IndexFunc(op.uuid, unicode.IsSpace) >= 0 {
+			return nil, fmt.Errorf("row %d: bad uuid %q", row, op.uuid)
+		}
+		if labelStr := field("label"); labelStr != "" && op.op != ResetOp {
+			if op.label, err = strconv.ParseUint(labelStr, 10, 64); err != nil {
+				return nil, fmt.Errorf("row %d: bad label %q", row, labelStr)
+			}
+		}
+		if op.client, err = checkClientID(field("client")); err != nil {
+			return nil, fmt.Errorf("row %d: %v", row, err)
+		}
+		for i, key := range attrs {
+			if i < len(record) && strings.TrimSpace(record[i]) != "" {
+				op.attrs[key] = strings.TrimSpace(record[i])
+			}
+		}
+		if holder, found := op.attrs["holder"]; found {
+			op.attrs["holder"] = normalizeClientID(holder)
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("audit trail has no ops")
+	}
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].t.Before(ops[j].t) })
+	return ops, nil
+}
+
+// Returns the time of the first op in history, or the zero time if there is none.
+func firstHistoryTime(files []string) (time.Time, error) {
+	for _, fname := range files {
+		f, err := openLogFile(fname)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadString('\n')
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return time.Time{}, err
+			}
+			op, err := parseLogLine(line)
+			if err != nil {
+				f.Close()
+				return time.Time{}, fmt.Errorf("%s: %v", fname, err)
+			}
+			if op.op != ChainOp {
+				f.Close()
+				return op.t, nil
+			}
+		}
+		f.Close()
+	}
+	return time.Time{}, nil
+}
+
+// Writes the ops of a CSV audit trail into a new log segment before all other history.
+// The trail must end before the first op in history, so a long trail split into chunks is
+// imported newest chunk first.
+func importHistory(r io.Reader, source string) (importHistoryJSON, error) {
+	var result importHistoryJSON
+	ops, err := readImportCSV(r, source)
+	if err != nil {
+		return result, err
+	}
+
+	importMu.Lock()
+	defer importMu.Unlock()
+
+	files, err := historyFiles()
+	if err != nil {
+		return result, err
+	}
+	first, err := firstHistoryTime(files)
+	if err != nil {
+		return result, fmt.Errorf("cannot read history: %v", err)
+	}
+	last := ops[len(ops)-1].t
+	if !first.IsZero() && !last.Before(first) {
+		return result, fmt.Errorf("audit trail ends at %s, but must end before the first op in history at %s",
+			last.In(displayZone).Format(time.RFC3339), first.In(displayZone).Format(time.RFC3339))
+	}
+	segment := fmt.Sprintf("%s.seg-%s%s", library.fname, ops[0].t.In(time.Local).Format(segmentTimeFmt), importSegmentSuffix)
+	if len(files) > 1 && strings.TrimSuffix(files[0], gzipSuffix) <= segment {
+		return result, fmt.Errorf("segment %q would not sort before segment %q, the oldest in history",
+			filepath.Base(segment), filepath.Base(files[0]))
+	}
+
+	tmpname := segment + ".tmp"
+	f, err := os.OpenFile(tmpname, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0664)
+	if err != nil {
+		return result, fmt.Errorf("cannot create imported log segment: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	uuids := make(map[string]bool)
+	for _, op := range ops {
+		line, err := formatLogLine(op, op.t)
+		if err == nil {
+			_, err = w.WriteString(line)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmpname)
+			return result, fmt.Errorf("cannot write imported log segment: %v", err)
+		}
+		uuids[op.uuid] = true
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, segment)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return result, fmt.Errorf("cannot write imported log segment: %v", err)
+	}
+
+	// History limits served from memory may now miss imported ops.
+	library.Lock()
+	library.recentComplete = false
+	library.Unlock()
+	clearCachedHx()
+
+	log.Printf("Imported %d ops of %d uuids from %q into log segment %q\n", len(ops), len(uuids), source, segment)
+	if *gzipSegments {
+		if err := compressSegment(segment); err != nil {
+			log.Printf("ERROR: unable to compress imported log segment %q: %v\n", segment, err)
+		}
+	}
+	result = importHistoryJSON{
+		Segment: filepath.Base(segment),
+		Ops:     len(ops),
+		UUIDs:   len(uuids),
+		From:    ops[0].t.In(displayZone),
+		To:      last.In(displayZone),
+	}
+	return result, nil
+}
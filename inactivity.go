@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// InactiveReason is the "reason" attribute of expire ops for checkouts released because
+// their holder was inactive for the UUID policy's InactivityCheckin.
+const InactiveReason = "inactive"
+
+// Heartbeats aren't logged, so clients are considered active when the server starts
+// rather than having their checkouts released for inactivity before a heartbeat arrives.
+var activityStart time.Time
+
+type heartbeatJSON struct {
+	Client     string
+	LastActive time.Time
+}
+
+// Notes a heartbeat from a client, which keeps its checkouts from being released for
+// inactivity without writing an op.
+func heartbeat(clientid string) time.Time {
+	library.Lock()
+	defer library.Unlock()
+
+	return library.clientStats(clientid, clock.Now()).lastActive
+}
+
+// Returns the time of a client's last op or heartbeat.  Must be called with library lock held.
+func (lib *libraryT) lastActive(clientid string) time.Time {
+	if stats, found := lib.clients[clientid]; found && stats.lastActive.After(activityStart) {
+		return stats.lastActive
+	}
+	return activityStart
+}
+
+// Releases a checkout if its holder has been inactive for the policy's InactivityCheckin,
+// or warns the holder once per period of inactivity that it soon will be.  Must be called
+// with library lock held.
+func (lib *libraryT) checkInactivity(now time.Time, uuid string, label uint64, policy *policyJSON) {
+	limit := policy.inactivityCheckin()
+	co, found := lib.vchk[uuid][label]
+	if limit == 0 || !found {
+		return
+	}
+	lastActive := lib.lastActive(co.client)
+	checkinAt := lastActive.Add(limit)
+	switch {
+	case !now.Before(checkinAt):
+		delete(lib.vchk[uuid], label)
+		lib.bumpRevision(uuid)
+		op := &libraryOp{
+			t:      now,
+			op:     ExpireOp,
+			uuid:   uuid,
+			label:  label,
+			client: co.client,
+			attrs:  map[string]string{"reason": InactiveReason},
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the release so state matches the log.
+			lib.vchk[uuid][label] = co
+			lib.unbumpRevision(uuid)
+			log.Printf("ERROR: unable to release inactive checkout of uuid %s, label %d: %v\n", uuid, label, err)
+			return
+		}
+		log.Printf("Checkout of uuid %s, label %d released since %s was inactive since %s\n", uuid, label, co.client, lastActive.Format(time.RFC3339))
+		publishInactivityEvent(InactivityCheckinEvent, uuid, labelJSON{label, policy.labelOutput()}, co, checkinAt)
+	case !co.inactivityWarned.Equal(lastActive) && checkinAt.Sub(now) <= policy.expiryWarning():
+		co.inactivityWarned = lastActive
+		lib.vchk[uuid][label] = co
+		publishInactivityEvent(InactivityWarningEvent, uuid, labelJSON{label, policy.labelOutput()}, co, checkinAt)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IntentLifetime is how long an intent lasts unless it is registered again.
+const IntentLifetime = 24 * time.Hour
+
+// intentT is a client's interest in a label it doesn't hold.
+type intentT struct {
+	since   time.Time
+	expires time.Time
+	holder  string // holder when the client was last told, or "" if free
+}
+
+// Registered intents by label and client.  Unlike checkouts they aren't logged, so they
+// don't survive a restart.
+var intents = struct {
+	sync.Mutex
+	registered map[waitKey]map[string]*intentT
+}{registered: make(map[waitKey]map[string]*intentT)}
+
+// intentJSON is a registered intent, listed by GET /state.
+type intentJSON struct {
+	Label   labelJSON
+	Client  string
+	Since   time.Time
+	Expires time.Time
+}
+
+// Registers a client's intent to check out a label, or renews it.
+func registerIntent(uuid string, label uint64, clientid string) (intentJSON, error) {
+	library.RLock()
+	co, held := library.vchk[uuid][label]
+	format := library.policies[uuid].labelOutput()
+	library.RUnlock()
+	if held && co.client == clientid {
+		return intentJSON{}, fmt.Errorf("client %s already has label %d of uuid %s checked out", clientid, label, uuid)
+	}
+
+	now := clock.Now()
+	key := waitKey{uuid, label}
+	intents.Lock()
+	defer intents.Unlock()
+	clients, found := intents.registered[key]
+	if !found {
+		clients = make(map[string]*intentT)
+		intents.registered[key] = clients
+	}
+	intent, found := clients[clientid]
+	if !found {
+		intent = &intentT{since: now, holder: co.client}
+		clients[clientid] = intent
+	}
+	intent.expires = now.Add(IntentLifetime)
+	return intentJSON{labelJSON{label, format}, clientid, intent.since, intent.expires}, nil
+}
+
+// Drops a client's intent, returning false if there was none.
+func dropIntent(uuid string, label uint64, clientid string) bool {
+	intents.Lock()
+	defer intents.Unlock()
+
+	key := waitKey{uuid, label}
+	_, found := intents.registered[key][clientid]
+	delete(intents.registered[key], clientid)
+	if len(intents.registered[key]) == 0 {
+		delete(intents.registered, key)
+	}
+	return found
+}
+
+// Drops intents that have expired without being registered again, so intents for labels
+// that never change don't pile up.
+func expireIntents() {
+	now := clock.Now()
+	intents.Lock()
+	defer intents.Unlock()
+
+	for key, clients := range intents.registered {
+		for clientid, intent := range clients {
+			if !now.Before(intent.expires) {
+				delete(clients, clientid)
+			}
+		}
+		if len(clients) == 0 {
+			delete(intents.registered, key)
+		}
+	}
+}
+
+// Returns the unexpired intents for a uuid's labels, sorted by label and then client.
+func getIntents(uuid string) []intentJSON {
+	format := getView(uuid).format
+	now := clock.Now()
+	var list []intentJSON
+
+	intents.Lock()
+	for key, clients := range intents.registered {
+		if key.uuid != uuid {
+			continue
+		}
+		for clientid, intent := range clients {
+			if now.Before(intent.expires) {
+				list = append(list, intentJSON{labelJSON{key.label, format}, clientid, intent.since, intent.expires})
+			}
+		}
+	}
+	intents.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Label.label != list[j].Label.label {
+			return list[i].Label.label < list[j].Label.label
+		}
+		return list[i].Client < list[j].Client
+	})
+	return list
+}
+
+// Sends a lock-changed event to clients with intents for labels whose holder was changed
+// by an op.  A client's own checkout fulfills its intent.  Must be called with library
+// lock held.
+func notifyIntents(op *libraryOp) {
+	var labels []uint64
+	switch op.op {
+	case CheckoutOp, RenewOp, CheckinOp, ExpireOp:
+		labels = []uint64{op.label}
+	case LabelResetOp:
+		labels = op.resetLabels()
+	case ResetOp, CommitResetOp:
+		// all labels of the uuid
+	default:
+		return
+	}
+
+	intents.Lock()
+	defer intents.Unlock()
+	if labels == nil {
+		for key := range intents.registered {
+			if key.uuid == op.uuid {
+				labels = append(labels, key.label)
+			}
+		}
+	}
+	now := clock.Now()
+	format := library.policies[op.uuid].labelOutput()
+	for _, label := range labels {
+		key := waitKey{op.uuid, label}
+		clients, found := intents.registered[key]
+		if !found {
+			continue
+		}
+		co := library.vchk[op.uuid][label]
+		for clientid, intent := range clients {
+			switch {
+			case !now.Before(intent.expires), co.client == clientid:
+				delete(clients, clientid)
+			case co.client != intent.holder:
+				intent.holder = co.client
+				sendEvent(eventJSON{Event: LockChangedEvent, UUID: op.uuid, Label: labelJSON{label, format}, Client: clientid, Expires: co.expires, Holder: co.client})
+			}
+		}
+		if len(clients) == 0 {
+			delete(intents.registered, key)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Label formats that can be set in a uuid's policy.  Any other format must be a prefix
+// ending in ":", e.g., "seg:" for labels like "seg:123".
+const (
+	DecimalLabels = "decimal" // 6699
+	HexLabels     = "hex"     // 0x1a2b
+)
+
+// Returns an error if the label format isn't decimal, hex, or a prefix.
+func checkLabelFormat(format string) error {
+	switch {
+	case format == DecimalLabels, format == HexLabels:
+		return nil
+	case len(format) > 1 && strings.HasSuffix(format, ":") && !strings.ContainsAny(format, "/ ?#%"):
+		return nil
+	}
+	return fmt.Errorf("label format %q must be %q, %q, or a prefix ending in \":\"", format, DecimalLabels, HexLabels)
+}
+
+func parseHexLabel(s string) (uint64, bool) {
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		return 0, false
+	}
+	label, err := strconv.ParseUint(s[2:], 16, 64)
+	return label, err == nil
+}
+
+// Parses a label in the given format.  Prefixed labels can be decimal or hex after the prefix.
+func parseLabelAs(s, format string) (uint64, bool) {
+	switch format {
+	case DecimalLabels:
+		label, err := strconv.ParseUint(s, 10, 64)
+		return label, err == nil
+	case HexLabels:
+		return parseHexLabel(s)
+	}
+	if !strings.HasPrefix(s, format) {
+		return 0, false
+	}
+	s = strings.TrimPrefix(s, format)
+	if label, ok := parseHexLabel(s); ok {
+		return label, true
+	}
+	label, err := strconv.ParseUint(s, 10, 64)
+	return label, err == nil
+}
+
+// Parses a label given in any format accepted by the uuid's policy.
+func parseLabel(uuid, s string) (uint64, error) {
+	formats := getPolicy(uuid).LabelFormats
+	if len(formats) == 0 {
+		formats = []string{DecimalLabels, HexLabels}
+	}
+	for _, format := range formats {
+		if label, ok := parseLabelAs(s, format); ok {
+			return label, nil
+		}
+	}
+	return 0, fmt.Errorf("label %q is not a 64-bit unsigned integer in an accepted format for uuid %s (%s)", s, uuid, strings.Join(formats, ", "))
+}
+
+// Returns the JSON for a label in the given output format.  Decimal labels are JSON
+// numbers and other formats are strings.
+func formatLabelJSON(label uint64, format string) string {
+	switch format {
+	case "", DecimalLabels:
+		return strconv.FormatUint(label, 10)
+	case HexLabels:
+		return strconv.Quote("0x" + strconv.FormatUint(label, 16))
+	}
+	return strconv.Quote(format + strconv.FormatUint(label, 10))
+}
+
+// labelJSON is a label written in a uuid's output format.
+type labelJSON struct {
+	label  uint64
+	format string
+}
+
+func (l labelJSON) MarshalJSON() ([]byte, error) {
+	return []byte(formatLabelJSON(l.label, l.format)), nil
+}
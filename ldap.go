@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Timeout for connecting to the LDAP server and for each lookup.
+const ldapTimeout = 10 * time.Second
+
+// LDAP result codes the lookup handles.
+const (
+	ldapSuccess           = 0
+	ldapSizeLimitExceeded = 4
+)
+
+// ldapProvider looks up client ids in an LDAP or Active Directory server using the LDAPv3
+// protocol (RFC 4511).  Each lookup uses its own connection since lookups are cached.
+type ldapProvider struct {
+	addr     string
+	useTLS   bool
+	baseDN   string
+	attr     string // attribute matched against client ids, e.g., "uid" or "sAMAccountName"
+	bindDN   string // empty for anonymous lookups
+	password string
+}
+
+// Parses an "ldap://host/basedn?attr" or "ldaps://" URL.  bindFile, if not empty, holds
+// the DN and password to bind with on separate lines.
+func newLDAPProvider(u *url.URL, bindFile string) (*ldapProvider, error) {
+	p := &ldapProvider{addr: u.Host, useTLS: u.Scheme == "ldaps", baseDN: strings.TrimPrefix(u.Path, "/"), attr: "uid"}
+	if u.Hostname() == "" || p.baseDN == "" {
+		return nil, fmt.Errorf("URL must have a host and base DN, e.g., \"ldap://ldap.example.org/ou=people,dc=example,dc=org?uid\"")
+	}
+	if u.Port() == "" {
+		if p.useTLS {
+			p.addr = net.JoinHostPort(u.Hostname(), "636")
+		} else {
+			p.addr = net.JoinHostPort(u.Hostname(), "389")
+		}
+	}
+	if u.RawQuery != "" {
+		if strings.Contains(u.RawQuery, "?") {
+			return nil, fmt.Errorf("only the client id attribute can follow the base DN, not %q", u.RawQuery)
+		}
+		p.attr = u.RawQuery
+	}
+	if bindFile != "" {
+		data, err := os.ReadFile(bindFile)
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.SplitN(strings.TrimRight(string(data), "\r\n"), "\n", 2)
+		if len(lines) != 2 {
+			return nil, fmt.Errorf("bind file %s must have a DN line and a password line", bindFile)
+		}
+		p.bindDN, p.password = strings.TrimSpace(lines[0]), strings.TrimRight(lines[1], "\r")
+	}
+	return p, nil
+}
+
+func (p *ldapProvider) String() string {
+	return fmt.Sprintf("LDAP server %s (%s under %s)", p.addr, p.attr, p.baseDN)
+}
+
+func (p *ldapProvider) lookup(clientid string) (*identityT, error) {
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	var conn net.Conn
+	var err error
+	if p.useTLS {
+		host, _, _ := net.SplitHostPort(p.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", p.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	r := bufio.NewReader(conn)
+
+	if p.bindDN != "" {
+		bind := berTLV(0x60, berInt(0x02, 3), berString(0x04, p.bindDN), berString(0x80, p.password))
+		if _, err := conn.Write(ldapMessage(1, bind)); err != nil {
+			return nil, err
+		}
+		resp, err := readLDAPResponse(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		if resp.tag != 0x61 {
+			return nil, fmt.Errorf("expected bind response, got tag 0x%x", resp.tag)
+		}
+		if code, msg := ldapResult(resp); code != ldapSuccess {
+			return nil, fmt.Errorf("bind as %q failed with result code %d: %s", p.bindDN, code, msg)
+		}
+	}
+
+	search := berTLV(0x63,
+		berString(0x04, p.baseDN),
+		berInt(0x0a, 2), // whole subtree
+		berInt(0x0a, 0), // never dereference aliases
+		berInt(0x02, 1), // size limit
+		berInt(0x02, int(ldapTimeout/time.Second)),
+		berTLV(0x01, []byte{0}), // attribute values, not just types
+		berTLV(0xa3, berString(0x04, p.attr), berString(0x04, clientid)),
+		berTLV(0x30, berString(0x04, "displayName"), berString(0x04, "cn"), berString(0x04, "memberOf")),
+	)
+	if _, err := conn.Write(ldapMessage(2, search)); err != nil {
+		return nil, err
+	}
+	var id *identityT
+	for {
+		resp, err := readLDAPResponse(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.tag {
+		case 0x64: // search result entry
+			if id, err = parseLDAPEntry(resp); err != nil {
+				return nil, err
+			}
+		case 0x73: // referral to another server, which isn't followed
+		case 0x65: // search done
+			conn.Write(ldapMessage(3, berTLV(0x42)))
+			switch code, msg := ldapResult(resp); code {
+			case ldapSuccess:
+				return id, nil
+			case ldapSizeLimitExceeded:
+				return nil, fmt.Errorf("more than one entry has %s=%s", p.attr, clientid)
+			default:
+				return nil, fmt.Errorf("search failed with result code %d: %s", code, msg)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response with tag 0x%x", resp.tag)
+		}
+	}
+}
+
+// Returns the name and groups of a search result entry.  The name is the displayName or
+// cn, and groups are the first RDN values of the memberOf DNs, e.g., "flyem" for
+// "cn=flyem,ou=groups,dc=example,dc=org".
+func parseLDAPEntry(entry berElement) (*identityT, error) {
+	fields, err := entry.children()
+	if err != nil || len(fields) < 2 {
+		return nil, fmt.Errorf("bad LDAP search result entry")
+	}
+	attrs, err := fields[1].children()
+	if err != nil {
+		return nil, err
+	}
+	id := &identityT{}
+	var cn string
+	for _, attr := range attrs {
+		parts, err := attr.children()
+		if err != nil || len(parts) < 2 {
+			return nil, fmt.Errorf("bad LDAP attribute in search result entry")
+		}
+		vals, err := parts[1].children()
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range vals {
+			switch name := string(parts[0].content); {
+			case strings.EqualFold(name, "displayName"):
+				id.Name = string(val.content)
+			case strings.EqualFold(name, "cn"):
+				if cn == "" {
+					cn = string(val.content)
+				}
+			case strings.EqualFold(name, "memberOf"):
+				group := string(val.content)
+				if rdn, _, _ := strings.Cut(group, ","); strings.Contains(rdn, "=") {
+					_, group, _ = strings.Cut(rdn, "=")
+				}
+				id.Groups = append(id.Groups, group)
+			}
+		}
+	}
+	if id.Name == "" {
+		id.Name = cn
+	}
+	sort.Strings(id.Groups)
+	return id, nil
+}
+
+// Returns the result code and diagnostic message of an LDAP result.
+func ldapResult(resp berElement) (int, string) {
+	fields, err := resp.children()
+	if err != nil || len(fields) < 3 {
+		return -1, "bad LDAP result"
+	}
+	code := 0
+	for _, b := range fields[0].content {
+		code = code<<8 | int(b)
+	}
+	return code, string(fields[2].content)
+}
+
+func ldapMessage(id int, op []byte) []byte {
+	return berTLV(0x30, berInt(0x02, id), op)
+}
+
+// Reads an LDAP message and returns its protocol op, which must answer message id.
+func readLDAPResponse(r *bufio.Reader, id int) (berElement, error) {
+	msg, err := readBER(r)
+	if err != nil {
+		return berElement{}, err
+	}
+	fields, err := msg.children()
+	if err != nil || len(fields) < 2 {
+		return berElement{}, fmt.Errorf("bad LDAP message")
+	}
+	msgID := 0
+	for _, b := range fields[0].content {
+		msgID = msgID<<8 | int(b)
+	}
+	if msgID == 0 && fields[1].tag == 0x78 {
+		_, msg := ldapResult(fields[1])
+		return berElement{}, fmt.Errorf("LDAP server disconnected: %s", msg)
+	}
+	if msgID != id {
+		return berElement{}, fmt.Errorf("got LDAP message %d, expected %d", msgID, id)
+	}
+	return fields[1], nil
+}
+
+// berElement is a BER-encoded ASN.1 value with a single-byte tag.
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+// Most bytes read for one LDAP message.
+const maxBERLength = 1 << 20
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+	n := 0
+	for _, c := range content {
+		n += len(c)
+	}
+	b := append([]byte{tag}, berLength(n)...)
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+// Encodes a non-negative integer.
+func berInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func readBER(r *bufio.Reader) (berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		if first&0x7f > 4 {
+			return berElement{}, fmt.Errorf("BER length of %d bytes is too long", first&0x7f)
+		}
+		n = 0
+		for i := 0; i < int(first&0x7f); i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berElement{}, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > maxBERLength {
+		return berElement{}, fmt.Errorf("BER value of %d bytes is too long", n)
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return berElement{}, err
+	}
+	return berElement{tag, content}, nil
+}
+
+// Parses the content of a constructed value into its elements.
+func (el berElement) children() ([]berElement, error) {
+	var elements []berElement
+	r := bufio.NewReader(bytes.NewReader(el.content))
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			break
+		}
+		child, err := readBER(r)
+		if err != nil {
+			return nil, fmt.Errorf("bad BER value with tag 0x%x: %v", el.tag, err)
+		}
+		elements = append(elements, child)
+	}
+	return elements, nil
+}
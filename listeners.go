@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// listenerT is one address the librarian serves its API on.
+type listenerT struct {
+	network  string // "tcp", "unix", or "systemd" for a socket passed by socket activation
+	address  string
+	certFile string // TLS is used if certFile and keyFile are set
+	keyFile  string
+	noAuth   bool // if true, JWT authentication is not required on this listener
+	admin    bool // if true, only the /admin and /reset endpoints and help page are served
+}
+
+func (l *listenerT) String() string {
+	if l.network == "unix" || l.network == "systemd" {
+		return l.network + ":" + l.address
+	}
+	if l.certFile != "" {
+		return "https://" + l.address
+	}
+	return l.address
+}
+
+// Parses a listener spec of the form "address[;cert=file;key=file;auth=none]" where
+// address is "host:port", "[ipv6]:port", "unix:/path/to/socket", or "systemd:name" for a
+// socket passed by systemd socket activation.
+func parseListener(spec string) (*listenerT, error) {
+	parts := strings.Split(spec, ";")
+	l := &listenerT{network: "tcp", address: parts[0]}
+	if strings.HasPrefix(l.address, "unix:") {
+		l.network = "unix"
+		l.address = strings.TrimPrefix(l.address, "unix:")
+	} else if strings.HasPrefix(l.address, "systemd:") {
+		l.network = "systemd"
+		l.address = strings.TrimPrefix(l.address, "systemd:")
+	}
+	if l.address == "" {
+		return nil, fmt.Errorf("no address given in listener %q", spec)
+	}
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad option %q in listener %q", opt, spec)
+		}
+		switch kv[0] {
+		case "cert":
+			l.certFile = kv[1]
+		case "key":
+			l.keyFile = kv[1]
+		case "auth":
+			switch kv[1] {
+			case "none":
+				l.noAuth = true
+			case "required":
+				l.noAuth = false
+			default:
+				return nil, fmt.Errorf("auth option in listener %q must be \"none\" or \"required\"", spec)
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q in listener %q", kv[0], spec)
+		}
+	}
+	if (l.certFile == "") != (l.keyFile == "") {
+		return nil, fmt.Errorf("listener %q needs both cert and key for TLS", spec)
+	}
+	return l, nil
+}
+
+// listenersFlag collects repeated -http options.
+type listenersFlag []*listenerT
+
+func (lf *listenersFlag) String() string {
+	specs := make([]string, len(*lf))
+	for i, l := range *lf {
+		specs[i] = l.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+func (lf *listenersFlag) Set(spec string) error {
+	l, err := parseListener(spec)
+	if err != nil {
+		return err
+	}
+	*lf = append(*lf, l)
+	return nil
+}
+
+func (l *listenerT) listen() (net.Listener, error) {
+	if l.network == "unix" {
+		// Remove any stale socket left by a previous run.
+		if err := os.Remove(l.address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	var ln net.Listener
+	var err error
+	if l.network == "systemd" {
+		ln, err = activatedListener(l.address)
+	} else {
+		ln, err = net.Listen(l.network, l.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("cannot load TLS cert for %s: %v", l, err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	return ln, nil
+}
+
+type listenerKeyT struct{}
+
+// Key in request context for the *listenerT that accepted the request.
+var listenerKey listenerKeyT
+
+// Returns a handler that tags requests with this listener.
+func (l *listenerT) handler(h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerKey, l)))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Returns true if the listener that accepted the request doesn't require authentication.
+func listenerNoAuth(r *http.Request) bool {
+	l, ok := r.Context().Value(listenerKey).(*listenerT)
+	return ok && l.noAuth
+}
+
+// Returns true if the request was accepted by an admin listener.
+func listenerAdmin(r *http.Request) bool {
+	l, ok := r.Context().Value(listenerKey).(*listenerT)
+	return ok && l.admin
+}
+
+// Returns true for the paths only served on admin listeners: the /admin endpoints, resets
+// and DVID hooks, which release labels whoever holds them, and replication, which gets all
+// state.
+func isAdminPath(path string) bool {
+	for _, prefix := range []string{"/admin", "/reset", "/hooks", "/replicate"} {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true for the paths served on all listeners.
+func sharedPath(path string) bool {
+	return path == "/" || path == "/healthz" || path == "/healthz/" || strings.HasPrefix(path, "/assets/")
+}
+
+// adminRouteHandler keeps the admin endpoints (see isAdminPath) off the general listeners
+// and everything but those endpoints, help page, its assets, and health check off admin
+// listeners.
+func adminRouteHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !sharedPath(r.URL.Path) && isAdminPath(r.URL.Path) != listenerAdmin(r) {
+			NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
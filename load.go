@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// LowPriorityWait is the longest a low-priority request waits for the number of
+	// in-flight requests to drop below -maxinflight before it is shed.
+	LowPriorityWait = 2 * time.Second
+
+	// ShedRetrySeconds is the Retry-After given with shed requests.
+	ShedRetrySeconds = 5
+)
+
+// Requests in flight and low-priority requests waiting to run.
+var load = struct {
+	sync.Mutex
+	inFlight int
+	lowRun   int // low-priority requests in flight
+	queued   int
+	shed     uint64
+	released chan struct{} // closed and replaced whenever a request finishes
+}{released: make(chan struct{})}
+
+type loadJSON struct {
+	MaxInFlight         int // 0 if requests are never shed
+	InFlight            int
+	LowPriorityInFlight int
+	Queued              int // low-priority requests waiting to run
+	Shed                uint64
+}
+
+// Returns true for requests that can be shed under load, e.g., history and reports
+// scraped for analytics, as opposed to interactive checkouts.
+func lowPriority(r *http.Request) bool {
+	if r.Method != "GET" && r.URL.Path != "/graphql" && r.URL.Path != "/graphql/" {
+		return false
+	}
+	for _, prefix := range []string{"/history/", "/search", "/diff/", "/stats/", "/report/", "/calendar/", "/graphql"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return r.URL.Path == "/uuids" && r.URL.Query().Get("detail") != ""
+}
+
+// Returns true if a low-priority request may run, waiting up to LowPriorityWait while
+// -maxinflight requests are in flight.  Returns false if the request should be shed.
+func admitLowPriority(max int) bool {
+	deadline := time.NewTimer(LowPriorityWait)
+	defer deadline.Stop()
+
+	load.Lock()
+	if load.inFlight >= max && load.queued >= max {
+		load.Unlock()
+		return false // queue is full
+	}
+	load.queued++
+	defer func() {
+		load.Lock()
+		load.queued--
+		load.Unlock()
+	}()
+	for load.inFlight >= max {
+		released := load.released
+		load.Unlock()
+		select {
+		case <-released:
+		case <-deadline.C:
+			return false
+		}
+		load.Lock()
+	}
+	load.inFlight++
+	load.lowRun++
+	load.Unlock()
+	return true
+}
+
+func doneRequest(low bool) {
+	load.Lock()
+	load.inFlight--
+	if low {
+		load.lowRun--
+	}
+	close(load.released)
+	load.released = make(chan struct{})
+	load.Unlock()
+}
+
+// loadHandler counts requests in flight and sheds low-priority requests with a 503 status
+// while -maxinflight requests are in flight, so checkouts stay fast during heavy scraping.
+// Other requests are never shed.  Event streams and WebSockets aren't counted since they
+// stay open.
+func loadHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/events/") || strings.HasPrefix(r.URL.Path, "/ws/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		configMu.RLock()
+		max := *maxInFlight
+		configMu.RUnlock()
+
+		low := max > 0 && lowPriority(r)
+		if low {
+			if !admitLowPriority(max) {
+				load.Lock()
+				load.shed++
+				load.Unlock()
+				log.Printf("ERROR: shed %s %s at -maxinflight %d\n", r.Method, r.URL.Path, max)
+				w.Header().Set("Retry-After", strconv.Itoa(ShedRetrySeconds))
+				writeError(w, http.StatusServiceUnavailable, "librarian is overloaded, try again later")
+				return
+			}
+		} else {
+			load.Lock()
+			load.inFlight++
+			load.Unlock()
+		}
+		defer doneRequest(low)
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func getLoad() loadJSON {
+	configMu.RLock()
+	max := *maxInFlight
+	configMu.RUnlock()
+
+	load.Lock()
+	defer load.Unlock()
+	return loadJSON{max, load.inFlight, load.lowRun, load.queued, load.shed}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MagicLinkTTL is how long a login link can be used.
+	MagicLinkTTL = 15 * time.Minute
+
+	// MagicLinkInterval is the minimum time between login links sent to a client.
+	MagicLinkInterval = 30 * time.Second
+
+	// SessionTTL is how long a login session lasts.
+	SessionTTL = 12 * time.Hour
+
+	// SessionCookie is the name of the login session cookie.
+	SessionCookie = "librarian_session"
+)
+
+// LoginLinkHTML is the page served by GET /login/{Secret}.  The link is only used when the
+// page's button POSTs it back, so chat apps that fetch links for previews don't use it up.
+const LoginLinkHTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Librarian login</title></head>
+<body>
+<h2>Librarian login</h2>
+<form method="POST">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`
+
+// sessionT is a pending login link or a login session of a client.
+type sessionT struct {
+	client  string
+	expires time.Time
+}
+
+// Pending login links and sessions, keyed by the SHA-256 of their secrets so secrets are
+// never kept in memory.  Neither survive a restart.
+var sessions = struct {
+	sync.Mutex
+	links    map[string]sessionT
+	sessions map[string]sessionT
+	sent     map[string]time.Time // last login link sent for each client
+}{
+	links:    make(map[string]sessionT),
+	sessions: make(map[string]sessionT),
+	sent:     make(map[string]time.Time),
+}
+
+// loginThrottledError is returned for a login link requested too soon after the last one.
+type loginThrottledError struct {
+	client string
+}
+
+func (e *loginThrottledError) Error() string {
+	return fmt.Sprintf("a login link was sent to %s less than %s ago", e.client, MagicLinkInterval)
+}
+
+type sessionJSON struct {
+	Client  string
+	Expires time.Time
+}
+
+// loginLinkJSON is posted to the -loginwebhook to send a client their login link.
+type loginLinkJSON struct {
+	Client  string
+	Link    string
+	Expires time.Time
+}
+
+// Returns a random secret and its key for the sessions maps.
+func newSecret() (secret, key string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = hex.EncodeToString(b)
+	return secret, secretKey(secret), nil
+}
+
+func secretKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Forgets expired login links and sessions.  Must be called with sessions lock held.
+func pruneSessions(now time.Time) {
+	for key, s := range sessions.links {
+		if !now.Before(s.expires) {
+			delete(sessions.links, key)
+		}
+	}
+	for key, s := range sessions.sessions {
+		if !now.Before(s.expires) {
+			delete(sessions.sessions, key)
+		}
+	}
+	for client, t := range sessions.sent {
+		if now.Sub(t) >= MagicLinkInterval {
+			delete(sessions.sent, client)
+		}
+	}
+}
+
+// Checks that a -baseurl, if given, is an absolute http or https URL.
+func checkBaseURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	if u, err := url.Parse(s); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad -baseurl %q: must be an http or https URL like \"https://librarian.example.org\"", s)
+	}
+	return nil
+}
+
+// Sends a login link built from -baseurl for a client through the -loginwebhook, e.g., a
+// chat bot that messages the user.  Returns an error if a link was sent to the client too
+// recently.
+func sendLoginLink(client string) error {
+	now := time.Now()
+	secret, key, err := newSecret()
+	if err != nil {
+		return err
+	}
+	sessions.Lock()
+	pruneSessions(now)
+	if _, found := sessions.sent[client]; found {
+		sessions.Unlock()
+		return &loginThrottledError{client}
+	}
+	link := loginLinkJSON{client, strings.TrimSuffix(*baseURL, "/") + "/login/" + secret, now.Add(MagicLinkTTL)}
+	sessions.links[key] = sessionT{client, link.Expires}
+	sessions.sent[client] = now
+	sessions.Unlock()
+
+	configMu.RLock()
+	webhook := *loginWebhook
+	configMu.RUnlock()
+	if err := postJSON(webhook, link); err != nil {
+		sessions.Lock()
+		delete(sessions.links, key)
+		delete(sessions.sent, client) // the client can try again at once
+		sessions.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Uses a login link, returning the secret of a new session for its client.
+func startSession(linkSecret string) (string, sessionJSON, error) {
+	now := time.Now()
+	secret, key, err := newSecret()
+	if err != nil {
+		return "", sessionJSON{}, err
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	pruneSessions(now)
+	link, found := sessions.links[secretKey(linkSecret)]
+	if !found {
+		return "", sessionJSON{}, fmt.Errorf("login link is invalid, used, or expired")
+	}
+	delete(sessions.links, secretKey(linkSecret))
+	s := sessionT{link.client, now.Add(SessionTTL)}
+	sessions.sessions[key] = s
+	return secret, sessionJSON{s.client, s.expires}, nil
+}
+
+// Returns the session of a request's cookie, if any.
+func requestSession(r *http.Request) (sessionJSON, bool) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return sessionJSON{}, false
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	s, found := sessions.sessions[secretKey(cookie.Value)]
+	if !found || !time.Now().Before(s.expires) {
+		return sessionJSON{}, false
+	}
+	return sessionJSON{s.client, s.expires}, true
+}
+
+func endSession(r *http.Request) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return
+	}
+	sessions.Lock()
+	delete(sessions.sessions, secretKey(cookie.Value))
+	sessions.Unlock()
+}
+
+// Returns the principal of a request's login session, which can act as its client.
+// Requests with a bearer token don't use any session.
+func sessionPrincipal(r *http.Request) *Principal {
+	if r.Header.Get("Authorization") != "" {
+		return nil
+	}
+	s, found := requestSession(r)
+	if !found {
+		return nil
+	}
+	return &Principal{Client: s.Client, Role: WriterRole}
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode, // cross-site requests can't use the session
+	})
+}
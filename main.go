@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 var (
@@ -16,14 +17,149 @@ var (
 	// Run in verbose mode if true.
 	runVerbose = flag.Bool("verbose", false, "")
 
+	// Print version and exit if true.
+	showVersion = flag.Bool("version", false, "")
+
+	// Check for a newer release at startup if true.
+	checkUpdate = flag.Bool("checkupdate", false, "")
+
+	// Time zone of times returned by the API.
+	timeZone = flag.String("timezone", "Local", "")
+
+	// If not empty, start time of a simulated clock for testing.
+	simClock = flag.String("simclock", "", "")
+
+	// If not empty, failures injected into requests for testing clients.
+	chaosSpec = flag.String("chaos", "", "")
+
+	// If true, the log is kept in a temporary directory removed at exit.
+	ephemeral = flag.Bool("ephemeral", false, "")
+
 	// Flag for clearing all locks at night.
 	dailyClear = flag.Bool("dailyclear", false, "")
 
-	// The HTTP address for help message and API
-	httpAddress = flag.String("http", DefaultWebAddress, "")
+	// The HTTP addresses for help message and API
+	httpListeners listenersFlag
+
+	// The HTTP addresses for the /admin and /reset endpoints, which aren't served on httpListeners.
+	adminListeners listenersFlag
+
+	// If not empty, file with a bearer token accepted on admin listeners.
+	adminTokenFile = flag.String("admintokenfile", "", "")
+
+	// If not empty, file of options re-read by POST /admin/reload and SIGHUP.
+	configFile = flag.String("config", "", "")
+
+	// HTTP read and write timeouts.
+	readTimeout  = flag.Duration("readtimeout", DefaultReadTimeout, "")
+	writeTimeout = flag.Duration("writetimeout", DefaultWriteTimeout, "")
 
 	// If not empty, save log file here every midnight.
 	backup = flag.String("backup", "", "")
+
+	// Size limit in MB for the librarian log.  Zero means no limit.
+	maxLogSize = flag.Int64("maxlogsize", 0, "")
+
+	// Cap in MB on the estimated memory of the library.  Zero means no cap.
+	maxMemory = flag.Int64("maxmemory", 0, "")
+
+	// What to do when the librarian log exceeds maxLogSize.
+	logSizeAction = flag.String("logsizeaction", WarnAction, "")
+
+	// How a checkout of a label the client already holds is logged and answered.
+	recheckout = flag.String("recheckout", RecheckoutLog, "")
+
+	// How ops in the log that are inconsistent with earlier ones are handled at startup.
+	replayMode = flag.String("replay", ReplayLenient, "")
+
+	// Number of most-queried uuids whose full histories are kept in memory, or 0 for none.
+	historyCache = flag.Int("historycache", 0, "")
+
+	// Compress compacted log segments with gzip if true.
+	gzipSegments = flag.Bool("gzipsegments", false, "")
+
+	// How often the librarian log is synced to disk, or 0 to leave it to the OS.
+	fsyncInterval = flag.Duration("fsync", time.Second, "")
+
+	// If not empty, the DVID server to poll for committed nodes.
+	dvidServer = flag.String("dvid", "", "")
+
+	// How often to poll the DVID server.
+	dvidPoll = flag.Duration("dvidpoll", time.Minute, "")
+
+	// If not empty, the DVID keyvalue instance each node's checkouts are written to.
+	dvidMirrorInstance = flag.String("dvidmirror", "", "")
+
+	// If not empty, the SQLite database mirroring the current state.
+	stateDB = flag.String("statedb", "", "")
+
+	// If not empty, the SQLite database written alongside the log and compared with it.
+	shadowDB = flag.String("shadowdb", "", "")
+
+	// Number of requests in flight at which low-priority requests are shed, or 0 for no limit.
+	maxInFlight = flag.Int("maxinflight", 0, "")
+
+	// Record the principal and source IP of requests in their ops.
+	auditOps = flag.Bool("audit", false, "")
+
+	// If not empty, the librarian that reads of unknown UUIDs are forwarded to.
+	proxyMissesURL = flag.String("proxymisses", "", "")
+
+	// If not empty, comma-separated URLs of librarians combined by GET /federated/state.
+	peers = flag.String("peers", "", "")
+
+	// If not empty, the NATS subject or Kafka topic URL to publish every op to.
+	opStreamURL = flag.String("opstream", "", "")
+
+	// Ops a follower can fall behind before a warning is logged, or 0 for no warnings.
+	replicationLag = flag.Int64("replicationlag", 10000, "")
+
+	// If not empty, the URL or file of a task list whose labels are reserved for clients.
+	assignSource = flag.String("assign", "", "")
+
+	// How often to pull the task list.
+	assignPoll = flag.Duration("assignpoll", 5*time.Minute, "")
+
+	// Daily digest recipients and delivery.
+	digestEmail   = flag.String("digestemail", "", "")
+	digestFrom    = flag.String("digestfrom", "librarian@localhost", "")
+	smtpServer    = flag.String("smtp", "localhost:25", "")
+	digestWebhook = flag.String("digestwebhook", "", "")
+	digestHour    = flag.Int("digesthour", 7, "")
+
+	// If not empty, URL to POST console login links to, e.g., a chat bot that messages users.
+	loginWebhook = flag.String("loginwebhook", "", "")
+
+	// External URL of the server that login links are built from.  Links aren't sent without it.
+	baseURL = flag.String("baseurl", "", "")
+
+	// Hosts and email domains that clients' own webhooks and emails may be sent to.
+	notifyHosts = flag.String("notifyhosts", "", "")
+
+	// Delivery of reminders set with PUT /remind besides the client's event stream.
+	remindWebhook = flag.String("remindwebhook", "", "")
+	remindEmail   = flag.String("remindemail", "", "")
+
+	// Client id normalization and allowed characters.
+	clientNorm  = flag.String("clientnorm", TrimClientIDs, "")
+	clientChars = flag.String("clientchars", "", "")
+
+	// If not empty, the LDAP directory that client ids must be in to check out labels.
+	idProviderURL  = flag.String("idprovider", "", "")
+	idProviderBind = flag.String("idproviderbind", "", "")
+
+	// If not empty, directory of pages and files that customize the help page and /console.
+	assetsDir = flag.String("assets", "", "")
+
+	// Message returned for requests refused in maintenance mode.
+	maintenanceMsg = flag.String("maintenancemsg", DefaultMaintenanceMessage, "")
+
+	// JWT authentication via shared secret or JWKS.
+	jwtSecretFile  = flag.String("jwtsecretfile", "", "")
+	jwksURL        = flag.String("jwks", "", "")
+	jwtAudience    = flag.String("jwtaudience", "", "")
+	jwtGroupsClaim = flag.String("jwtgroupsclaim", "groups", "")
+	jwtRoles       = flag.String("jwtroles", "", "")
 )
 
 const helpMessage = `
@@ -33,12 +169,233 @@ The client id is an arbitrary string, e.g., a user name.  All check-ins and chec
 recorded in a human-readable librarian log file.
 
 Usage: librarian [options] /path/to/librarian.log
+       librarian -ephemeral [options]
+       librarian analyze [options] /path/to/librarian.log
+       librarian normalize [options] /path/to/librarian.log
+       librarian export [options] /path/to/librarian.log
+       librarian simulate [options] /path/to/librarian.log
+       librarian verify /path/to/librarian.log
+       librarian genlog [options]
+       librarian router [options]
+       librarian cache [options]
+
+      -http          =string   Address for HTTP communication.  Default is "localhost:8000".
+                               Can be repeated to listen on several addresses, e.g.,
+                               -http=0.0.0.0:8000 -http=[::1]:8001 -http=unix:/tmp/librarian.sock
+                               "systemd:{Name}" serves a socket passed by systemd socket activation
+                               with that FileDescriptorName=, or index if unnamed, so connections
+                               queue while the log is replayed, e.g., -http=systemd:librarian.socket
+                               Per-listener options can follow the address separated by ";":
+                                 cert=file;key=file   serve HTTPS with the given cert and key
+                                 auth=none            don't require JWT auth on this listener
+                               The /admin, /reset, /hooks, and /replicate endpoints are only served
+                               on -adminhttp listeners.
+      -adminhttp     =string   Address for the /admin, /reset, /hooks, and /replicate endpoints.
+                               Default is "localhost:8001".
+                               Can be repeated and takes the same options as -http.
+      -admintokenfile =string  File with a bearer token that grants admin access on -adminhttp
+                               listeners.  Otherwise admin listeners require an admin JWT if
+                               authentication is enabled.
+      -config        =string   File of options, one "name=value" per line without the leading dash,
+                               e.g., "digesthour=6".  Command-line options take precedence.  The
+                               file is re-read on SIGHUP or POST /admin/reload, which apply auth,
+                               digest, -dailyclear, -backup, -maintenancemsg, and -verbose changes.
+      -readtimeout   =duration Maximum time to read an HTTP request.  Default is "5s".
+      -writetimeout  =duration Maximum time to write an HTTP response.  Default is "5s".
+                               Streamed responses like history extend this on each flush.
+      -backup        =string   Daily (midnight) backup copies librarian log to this file.
+      -dailyclear    (flag)    Clear all locks at 2 AM every night.
+      -maxlogsize    =number   Size limit in MB for the librarian log.  Default 0 is no limit.
+      -logsizeaction =string   Action when log exceeds -maxlogsize: "warn" (default) only logs
+                               a warning, "compact" moves history into a segment file and
+                               restarts the log with active checkouts, "refuse" rejects new
+                               checkouts.
+      -maxmemory     =number   Cap in MB on the estimated memory of checkouts, metadata, and
+                               recent history.  Once over, uuids without checkouts are pruned
+                               from memory along with the -historycache, and if still over,
+                               checkouts of new uuids are refused.  Checked every minute.
+                               Default 0 is no cap.
+      -recheckout    =string   Handling of a checkout of a label the client already holds: "log"
+                               (default) logs another "checkout" op, "dedupe" logs nothing,
+                               "renew" logs a "renew" op, and "held" logs nothing and answers
+                               {"AlreadyHeld": true, ...}.  Renewed leases are always logged.
+      -replay        =string   Handling of log ops inconsistent with earlier ones at startup,
+                               e.g., a checkin of a label not checked out or a checkout of a
+                               label held by another client, or of unrecognized types, e.g.,
+                               added by a newer librarian: "lenient" (default) logs a warning
+                               and skips the op, "strict" refuses to start.  A summary is
+                               logged and served at GET /admin/startup-report.
+      -gzipsegments  (flag)    Compress compacted log segments with gzip, including any older
+                               uncompressed segments at startup.  History reads decompress
+                               segments transparently.  Default is false, which keeps segments
+                               uncompressed so tools that read them directly still work.
+      -historycache  =number   Number of uuids whose full histories are kept in memory and updated
+                               as ops are written, chosen every minute as the uuids whose full
+                               or filtered GET /history requests are most frequent lately.
+                               Default 0 caches none (see GET /admin/history-cache).
+      -fsync         =duration How often the librarian log is synced to disk.  Default is "1s";
+                               0 leaves syncing to the OS.  The time of the last sync is in the
+                               librarian_log_last_fsync expvar.
+      -dvid          =string   DVID server URL, e.g., "http://emdata:8000".  When set, the server
+                               is polled and all checkouts on committed nodes are reset.  A
+                               UUID abbreviating more than one node is skipped with a warning.
+                               All repo nodes are listed by GET /uuids?all=true.
+      -dvidpoll      =duration How often to poll the DVID server.  Default is "1m".
+      -dvidmirror    =string   Name of a DVID keyvalue instance, e.g., "locks", to write the
+                               checkouts of each UUID into on its node after every change, so
+                               DVID tools can read them.  The key "librarian-checkouts" holds the
+                               GET /state JSON plus the UUID's "Revision" and "Updated" time.
+                               Writes that fail are retried, and all UUIDs are rewritten at
+                               startup.  Requires -dvid.
+      -statedb       =string   SQLite database file that mirrors the current state so startup doesn't
+                               replay the whole log.  Requires building with "-tags sqlite".
+      -shadowdb      =string   SQLite database file written like -statedb but never loaded, to trial
+                               it before use.  Every 10 minutes, its state is compared with the
+                               state replayed from the log, and differences are listed by
+                               GET /admin/shadow.  Requires building with "-tags sqlite".
+      -maxinflight   =number   Number of requests in flight at which low-priority requests, i.e.,
+                               GET /history, /search, /diff, /stats, /report, /calendar,
+                               /uuids?detail=true, and /graphql, wait up to 2 seconds and are then
+                               refused with a 503 status so checkouts stay fast.  Default is 0,
+                               which never refuses.
+      -audit         (flag)    Record the authenticated principal (JWT subject) and source IP of
+                               each request in its ops, so ops made with another person's client
+                               id can be found.  Behind a reverse proxy, the IP is the proxy's.
+      -proxymisses   =string   Librarian to forward reads of UUIDs this server has never seen to,
+                               e.g., "http://central:8000", so a remote site can run a local
+                               server without replicating the central one.  Responses are cached
+                               for 10 seconds.
+      -peers         =string   Comma-separated URLs of other librarians, e.g., one per dataset,
+                               whose checkouts are combined with this server's by
+                               GET /federated/state/{UUID}.
+      -opstream      =string   Publish every op as a JSON message to a NATS subject, e.g.,
+                               "nats://localhost:4222/librarian.ops", or a Kafka topic through a
+                               Kafka REST proxy, e.g., "kafka://localhost:8082/librarian-ops".  Ops
+                               are buffered and retried while the broker is unreachable.  Each
+                               message has the op's "Seq", so consumers can order ops and skip
+                               ones already applied.
+      -replicationlag =number  Ops a follower can fall behind, as acknowledged with POST
+                               /replicate/ack, before a warning is logged.  Default is 10000;
+                               0 disables the warnings.
+      -assign        =string   URL or file of a JSON task list, {"Tasks": [{"ID": "t1", "UUID": "3af902",
+                               "Client": "katzw", "Labels": [1, 2], "Done": false}, ...]}.  Labels of
+                               open tasks are checked out for their clients and checked back in
+                               when tasks are done.
+      -assignpoll    =duration How often to pull the task list.  Default is "5m".
+      -digestemail   =string   Comma-separated email addresses for a daily digest of the previous
+                               day's ops, old locks, top clients, and conflicts.
+      -digestfrom    =string   From address for digest email.  Default is "librarian@localhost".
+      -smtp          =string   SMTP server for digest email.  Default is "localhost:25".
+      -digestwebhook =string   URL to POST the daily digest to as JSON.  Failed digest and reminder
+                               deliveries are retried (see /admin/notifications).
+      -digesthour    =number   Hour of the day (0-23) to send the digest.  Default is 7.
+      -loginwebhook  =string   URL to POST login links for /console to as JSON, e.g., a chat bot
+                               that messages each client id.  Following a link starts a session
+                               that attributes the browser's requests to that client.  Requires
+                               -baseurl.
+      -baseurl       =string   External URL of the server, e.g., "https://librarian.example.org",
+                               that login links are built from.  The request's Host header is
+                               never used, so login links are only sent when this is set.
+      -notifyhosts   =string   Comma-separated hosts that clients' own webhooks may post to and
+                               email domains their own emails may be sent to (see
+                               /clients/{Client}/notifications).  A name starting with "."
+                               matches that domain and its subdomains, e.g., ".example.org".
+                               Without it, clients can't set their own webhooks or emails.
+      -remindwebhook =string   URL to POST reminders set with PUT /remind to as JSON when they fire.
+      -remindemail   =string   Email address for reminders with "{client}" replaced by the client
+                               id, e.g., "{client}@example.org".  Sent through -smtp.
+      -clientnorm    =string   Comma-separated normalizations of client ids: "trim" removes
+                               surrounding whitespace and "lower" folds to lower case.
+                               Applied to requests and when reading the log.  Default is "trim".
+      -clientchars   =string   Regexp that client ids in requests must match, e.g., "[a-z0-9._-]+".
+      -idprovider    =string   LDAP or Active Directory URL, e.g.,
+                               "ldap://ldap.example.org/ou=people,dc=example,dc=org?uid", whose
+                               entries client ids are looked up in, matching the attribute after
+                               "?" ("uid" by default, or "sAMAccountName" for AD).  Checkouts by
+                               client ids not in the directory are refused, and GET /state adds
+                               the full names and groups of clients.  Use "ldaps://" for TLS.
+      -idproviderbind =string  File with the DN and password, one per line, to bind to the
+                               -idprovider with.  Default is to look up client ids anonymously.
+      -maintenancemsg =string  Message returned with the 503 status for requests refused in
+                               maintenance mode (see POST /admin/maintenance).
+      -assets        =string   Directory of pages and files customizing the help page and
+                               /console without recompiling.  "help.html" and "console.html"
+                               replace the embedded pages, and "help-header.html" and
+                               "console-header.html" are added to their tops, e.g., for site
+                               instructions and contacts.  Each can have language variants,
+                               e.g., "help.de.html", chosen by Accept-Language.  Other files
+                               are served at /assets/{Name}.  Files are read on each request.
+      -jwtsecretfile =string   File with shared secret for HS256 JWTs.  Enables authentication.
+      -jwks          =string   JWKS URL for RS256 JWTs.  Enables authentication.
+                               With either, JWTs without an "exp" claim are refused.
+      -jwtaudience   =string   If set, JWTs must have this audience.
+      -jwtgroupsclaim =string  JWT claim holding the client's groups.  Default is "groups".
+      -jwtroles      =string   Maps groups to roles, e.g., "flyem:writer,flyem-admin:admin".
+                               Authenticated clients are at least readers.
+      -timezone      =string   Time zone of times returned by the API, e.g., "UTC" or
+                               "America/New_York".  Default is "Local", the server's zone.
+                               Times in the log are always written in UTC.
+      -simclock      =string   For testing, use a simulated clock starting at this RFC 3339 time or
+                               "now".  Time only moves, running scheduled jobs like lease
+                               expiration and -dailyclear, when advanced by POST /admin/clock.
+      -chaos         =string   For testing clients' retries and conflict handling, inject failures
+                               given as comma-separated name=value pairs, e.g.,
+                               "conflict=0.1,delay=0.2,maxdelay=2s,drop=0.05,skew=-90s":
+                                 conflict=rate   refuse checkouts with a 409 status as if held
+                                                 by "chaos", without changing any lock
+                                 delay=rate      delay requests by up to maxdelay, default "1s"
+                                 drop=rate       close connections before handling requests
+                                 dropafter=rate  close connections after handling requests, so
+                                                 clients don't know if their op was applied
+                                 skew=duration   shift times in responses and their Date header
+                                                 as if the server clock were off, e.g., "-90s",
+                                                 while ops are still logged at the real time
+                                 seed=number     seed the random failures for repeatable tests
+                               Rates are fractions of requests from 0 to 1.  /admin, /healthz, and
+                               /debug requests aren't affected.  Injected responses have an
+                               X-Librarian-Chaos header.  Requires -ephemeral, so failures are
+                               never injected into a server with a real log.
+      -ephemeral     (flag)    For testing, keep the log and the files kept beside it in a new
+                               temporary directory that is removed at exit, instead of giving
+                               a log file.
+      -checkupdate   (flag)    At startup, log a notice if a newer GitHub release is available.
+      -verbose       (flag)    Run in verbose mode.
+      -version       (flag)    Print version information and exit.
+  -h, -help          (flag)    Show help message
+
+The "analyze" command produces an offline report on a librarian log.  Run "librarian analyze -h"
+for its options.
+
+The "normalize" command rewrites a librarian log with normalized client ids, e.g., so "KatzW"
+and "katzw" are one client.  Run "librarian normalize -h" for its options.
+
+The "export" command writes the op history of a librarian log as Parquet files partitioned
+by date for analytics, e.g., with DuckDB or Spark.  Run "librarian export -h" for its options.
+
+The "simulate" command replays the checkouts and checkins of a librarian log against a server
+at an adjustable speed, reporting throughput and conflict rates for capacity planning.  Run
+"librarian simulate -h" for its options.
+
+The "verify" command checks the hash chain linking a librarian log to its compacted segments,
+which shows the history hasn't been changed since it was logged.  Run "librarian verify -h"
+for details.
 
-      -http       =string   Address for HTTP communication.
-      -backup     =string   Daily (midnight) backup copies librarian log to this file.
-      -dailyclear (flag)    Clear all locks at 2 AM every night.
-      -verbose    (flag)    Run in verbose mode.
-  -h, -help       (flag)    Show help message
+The "genlog" command writes a synthetic but realistic librarian log for benchmarks, tests,
+and demos, optionally with corruption injected.  Run "librarian genlog -h" for its options.
+
+The "router" command serves one address for several librarians sharded by UUID, forwarding
+requests to shards by consistent hashing and combining /uuids and /stats/conflicts across
+them.  Run "librarian router -h" for its options.
+
+The "cache" command serves a nearby read cache of a librarian for remote sites, answering
+GET /state and /checkout from a short-lived cache that is refreshed in the background and
+forwarding changes upstream.  Run "librarian cache -h" for its options.
+
+Under systemd with Type=notify, the librarian reports replay progress while it starts, which
+extends TimeoutStartSec= while ops are still being replayed so long replays aren't killed but
+stalled ones are, and READY=1 once it's serving on at least one listener.  With WatchdogSec=,
+it pings the watchdog at half that interval while the library can be read, so a hung server is
+restarted.
 
 To get more information on the REST API, visit the http address with a web browser.
 `
@@ -56,11 +413,43 @@ func currentDir() string {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		os.Exit(runAnalyze(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "normalize" {
+		os.Exit(runNormalize(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExport(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(runSimulate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "genlog" {
+		os.Exit(runGenlog(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "router" {
+		os.Exit(runRouter(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		os.Exit(runCache(os.Args[2:]))
+	}
+
 	flag.BoolVar(showHelp, "h", false, "Show help message")
+	flag.Var(&httpListeners, "http", "")
+	flag.Var(&adminListeners, "adminhttp", "")
 	flag.Usage = usage
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	if *showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	if flag.NArg() != 1 && !(*ephemeral && flag.NArg() == 0) {
 		*showHelp = true
 	}
 
@@ -69,23 +458,210 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			fmt.Printf("Unable to read config file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *digestHour < 0 || *digestHour > 23 {
+		fmt.Printf("Bad -digesthour %d: must be from 0 to 23\n", *digestHour)
+		os.Exit(1)
+	}
+
+	if err := initClientIDs(*clientNorm, *clientChars); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	if *idProviderURL != "" {
+		if err := initIDProvider(*idProviderURL, *idProviderBind); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if !validLogSizeAction(*logSizeAction) {
+		fmt.Printf("Bad -logsizeaction %q: must be %q, %q, or %q\n", *logSizeAction, WarnAction, CompactAction, RefuseAction)
+		os.Exit(1)
+	}
+
+	if !validRecheckout(*recheckout) {
+		fmt.Printf("Bad -recheckout %q: must be %q, %q, %q, or %q\n", *recheckout, RecheckoutLog, RecheckoutDedupe, RecheckoutRenew, RecheckoutHeld)
+		os.Exit(1)
+	}
+
+	if *maxMemory < 0 {
+		fmt.Printf("Bad -maxmemory %d: must be 0 or more MB\n", *maxMemory)
+		os.Exit(1)
+	}
+
+	if *historyCache < 0 {
+		fmt.Printf("Bad -historycache %d: must be 0 or more uuids\n", *historyCache)
+		os.Exit(1)
+	}
+
+	if err := checkBaseURL(*baseURL); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	if *fsyncInterval < 0 {
+		fmt.Printf("Bad -fsync %s: must be 0 or more\n", *fsyncInterval)
+		os.Exit(1)
+	}
+
+	if *replicationLag < 0 {
+		fmt.Printf("Bad -replicationlag %d: must be 0 or more ops\n", *replicationLag)
+		os.Exit(1)
+	}
+
+	if !validReplayMode(*replayMode) {
+		fmt.Printf("Bad -replay %q: must be %q or %q\n", *replayMode, ReplayLenient, ReplayStrict)
+		os.Exit(1)
+	}
+
+	if *dvidMirrorInstance != "" && *dvidServer == "" {
+		fmt.Printf("Bad -dvidmirror %q: requires -dvid server\n", *dvidMirrorInstance)
+		os.Exit(1)
+	}
+
 	// Capture ctrl+c and other interrupts.  Then handle graceful shutdown.
-	stopSig := make(chan os.Signal)
+	stopSig := make(chan os.Signal, 1)
 	go func() {
 		for sig := range stopSig {
 			log.Printf("Stop signal captured: %q.  Shutting down...\n", sig)
+			notifySystemd("STOPPING=1")
+			closeSubscriptions()
+			writeNotifications()
+			removeEphemeralDir()
 			os.Exit(0)
 		}
 	}()
 	signal.Notify(stopSig, os.Interrupt, os.Kill, syscall.SIGTERM)
 
+	if err := initAuth(); err != nil {
+		log.Printf("Unable to set up JWT authentication: %v\n", err)
+		os.Exit(1)
+	}
+
+	log.Printf("Starting %s\n", versionString())
+	if *checkUpdate {
+		go checkForUpdate()
+	}
+
+	if err := initDisplayZone(*timeZone); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	if *simClock != "" {
+		if err := initSimClock(*simClock); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *chaosSpec != "" {
+		if !*ephemeral {
+			fmt.Printf("Bad -chaos %q: requires -ephemeral so failures are never injected into a server with a real log\n", *chaosSpec)
+			os.Exit(1)
+		}
+		if err := initChaos(*chaosSpec); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *proxyMissesURL != "" {
+		if err := initProxyMisses(*proxyMissesURL); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *peers != "" {
+		if err := initPeers(*peers); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *opStreamURL != "" {
+		if err := initOpStream(*opStreamURL); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := initSocketActivation(); err != nil {
+		log.Printf("Unable to use sockets from systemd: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Load the log
-	logfile := flag.Args()[0]
+	var logfile string
+	if *ephemeral {
+		var err error
+		if logfile, err = initEphemeralDir(); err != nil {
+			log.Printf("Unable to create temporary directory for -ephemeral: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		logfile = flag.Args()[0]
+	}
+	stopReplayStatus := notifyReplay()
 	if err := initLibrary(logfile); err != nil {
-		log.Printf("Unable to open librarian log file (%s): %s\n", err.Error())
+		log.Printf("Unable to open librarian log file (%s): %s\n", logfile, err.Error())
 		os.Exit(1)
 	}
+	stopReplayStatus()
+	if err := initNotifications(logfile); err != nil {
+		log.Printf("Unable to load notifications to retry: %v\n", err)
+		os.Exit(1)
+	}
+	if err := initClientNotify(logfile); err != nil {
+		log.Printf("Unable to load client notification preferences: %v\n", err)
+		os.Exit(1)
+	}
+	if err := initGuestTokens(logfile); err != nil {
+		log.Printf("Unable to load guest tokens: %v\n", err)
+		os.Exit(1)
+	}
+
+	checkMemory()
+
+	if *fsyncInterval > 0 {
+		go syncLogEvery(*fsyncInterval)
+	}
+
+	if *gzipSegments {
+		go compressSegments(logfile)
+	}
+
+	// Reload options on SIGHUP.
+	reloadSig := make(chan os.Signal, 1)
+	go func() {
+		for range reloadSig {
+			log.Printf("Reload signal captured.  Reloading options...\n")
+			if _, err := reloadConfig(); err != nil {
+				log.Printf("ERROR: unable to reload options: %v\n", err)
+			}
+		}
+	}()
+	signal.Notify(reloadSig, syscall.SIGHUP)
 
 	// Run the HTTP server
-	serveHttp(*httpAddress)
+	if len(httpListeners) == 0 {
+		httpListeners.Set(DefaultWebAddress)
+	}
+	if len(adminListeners) == 0 {
+		adminListeners.Set(DefaultAdminAddress)
+	}
+	for _, l := range adminListeners {
+		l.admin = true
+	}
+	serveHttp(append(httpListeners, adminListeners...))
+	removeEphemeralDir()
 }
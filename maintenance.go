@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// DefaultMaintenanceMessage is returned for refused requests if no message is configured.
+const DefaultMaintenanceMessage = "librarian is in maintenance mode, try again later"
+
+// MaintenanceRetrySeconds is the Retry-After given with requests refused for maintenance.
+const MaintenanceRetrySeconds = 60
+
+// In maintenance mode, mutating requests are refused and background jobs that change
+// the log are paused, e.g., during log migrations.  Reads continue.
+var maintenance struct {
+	sync.RWMutex
+	on      bool
+	message string
+	since   time.Time
+}
+
+type maintenanceJSON struct {
+	Maintenance bool
+	Message     string     `json:",omitempty"`
+	Since       *time.Time `json:",omitempty"`
+}
+
+type healthJSON struct {
+	Status string // "ok" or "maintenance"
+	maintenanceJSON
+}
+
+func getMaintenance() maintenanceJSON {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+
+	if !maintenance.on {
+		return maintenanceJSON{}
+	}
+	since := maintenance.since
+	return maintenanceJSON{true, maintenance.message, &since}
+}
+
+func setMaintenance(on bool, message string) {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+
+	if message == "" {
+		configMu.RLock()
+		message = *maintenanceMsg
+		configMu.RUnlock()
+	}
+	if on && !maintenance.on {
+		maintenance.since = clock.Now()
+	}
+	maintenance.on = on
+	maintenance.message = message
+	if on {
+		log.Printf("Maintenance mode on: %s\n", message)
+	} else {
+		log.Printf("Maintenance mode off\n")
+	}
+}
+
+func inMaintenance() bool {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	return maintenance.on
+}
+
+// Returns true if the request can change the library.  /admin requests are allowed so
+// maintenance mode can be turned off, and GraphQL queries are read-only.
+func mutatingRequest(r *http.Request) bool {
+	switch {
+	case r.Method == "GET", r.Method == "HEAD", r.Method == "OPTIONS":
+		return false
+	case r.URL.Path == "/admin", strings.HasPrefix(r.URL.Path, "/admin/"):
+		return false
+	case r.URL.Path == "/graphql", r.URL.Path == "/graphql/":
+		return false
+	}
+	return true
+}
+
+// maintenanceHandler refuses mutating requests with a 503 status in maintenance mode.
+func maintenanceHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if mutatingRequest(r) {
+			if m := getMaintenance(); m.Maintenance {
+				log.Printf("ERROR: refused %s %s during maintenance\n", r.Method, r.URL.Path)
+				w.Header().Set("Retry-After", strconv.Itoa(MaintenanceRetrySeconds))
+				writeError(w, http.StatusServiceUnavailable, m.Message)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
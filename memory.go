@@ -0,0 +1,226 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryCapCode is the error code of checkouts refused because they would add a new UUID
+// while the library is over its -maxmemory cap.
+const MemoryCapCode = "MEMORY_CAP"
+
+// Approximate sizes in bytes used to estimate the memory of a UUID's state.  They include
+// Go's map overhead, so they're closer to the heap used than to the sizes of the structs.
+const (
+	memEntryBytes    = 48  // a key and value slot in a map
+	memCheckoutBytes = 96  // a checkoutT without its client id
+	memOpBytes       = 112 // a libraryOp without its strings and attributes
+	memStructBytes   = 64  // a pin, comment, or freeze without its strings
+	memUUIDBytes     = 256 // the entries of a UUID in revs, uuidBytes, views, and the like
+)
+
+// Memory estimates, exported via expvar at /debug/vars.
+var (
+	memoryBytesVar   = expvar.NewInt("librarian_memory_bytes")
+	memoryUUIDsVar   = expvar.NewMap("librarian_memory_uuid_bytes")
+	memoryHeapVar    = expvar.NewInt("librarian_memory_heap_bytes")
+	memoryOverCapVar = expvar.NewInt("librarian_memory_over_cap")
+)
+
+// uuidMemoryJSON is the estimated memory of a UUID's state.
+type uuidMemoryJSON struct {
+	UUID      string
+	Bytes     int64
+	Checkouts int
+	RecentOps int // history ops kept in memory
+}
+
+// memoryJSON is the estimated memory of the library, listed by GET /stats/memory.
+type memoryJSON struct {
+	Measured    time.Time
+	Bytes       int64  // all UUIDs
+	MaxBytes    int64  `json:",omitempty"` // -maxmemory in bytes
+	OverCap     bool   // new UUIDs are refused
+	HeapBytes   uint64 // Go heap in use by the whole server
+	PrunedUUIDs int    // empty UUIDs pruned since startup
+	UUIDs       []uuidMemoryJSON
+}
+
+var memory struct {
+	sync.RWMutex
+	report memoryJSON
+	pruned int
+}
+
+// Returns the -maxmemory cap in bytes, or 0 if there is no cap.
+func maxMemoryBytes() int64 {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return *maxMemory * 1024 * 1024
+}
+
+// Returns the estimated memory of a uuid's state.  Must be called with library lock held.
+func (lib *libraryT) uuidMemory(uuid string) uuidMemoryJSON {
+	um := uuidMemoryJSON{UUID: uuid, Bytes: memUUIDBytes + 4*int64(len(uuid))}
+	for _, co := range lib.vchk[uuid] {
+		um.Bytes += memEntryBytes + memCheckoutBytes + int64(len(co.client))
+		um.Checkouts++
+	}
+	for key, value := range lib.meta[uuid] {
+		um.Bytes += memEntryBytes + int64(len(key)+len(value))
+	}
+	for _, pin := range lib.pins[uuid] {
+		um.Bytes += memEntryBytes + memStructBytes + int64(len(pin.reason)+len(pin.client))
+	}
+	for _, comments := range lib.comments[uuid] {
+		um.Bytes += memEntryBytes
+		for _, c := range comments {
+			um.Bytes += memStructBytes + int64(len(c.client)+len(c.text))
+		}
+	}
+	for name, f := range lib.freezes[uuid] {
+		um.Bytes += memEntryBytes + memStructBytes + int64(len(name)+len(f.schedule)+len(f.reason)+len(f.client))
+	}
+	um.Bytes += int64(len(lib.superseded[uuid])) * memEntryBytes
+	if ro, found := lib.recent[uuid]; found {
+		for _, op := range ro.ops {
+			um.Bytes += memOpBytes + int64(len(op.client))
+			for key, value := range op.attrs {
+				um.Bytes += memEntryBytes + int64(len(key)+len(value))
+			}
+		}
+		um.RecentOps = len(ro.ops)
+	}
+	return um
+}
+
+// Returns the estimated memory of every uuid, largest first, and their total.  Must be
+// called with library lock held.
+func (lib *libraryT) measureMemory() ([]uuidMemoryJSON, int64) {
+	uuids := make(map[string]bool, len(lib.revs))
+	for uuid := range lib.revs {
+		uuids[uuid] = true
+	}
+	for uuid := range lib.vchk {
+		uuids[uuid] = true
+	}
+	var total int64
+	usage := make([]uuidMemoryJSON, 0, len(uuids))
+	for uuid := range uuids {
+		um := lib.uuidMemory(uuid)
+		usage = append(usage, um)
+		total += um.Bytes
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Bytes != usage[j].Bytes {
+			return usage[i].Bytes > usage[j].Bytes
+		}
+		return usage[i].UUID < usage[j].UUID
+	})
+	return usage, total
+}
+
+// Drops the state of uuids without checkouts that is only kept to speed up reads: their
+// empty checkout maps, recent history, and cached views.  Their history is then read from
+// the log.  Returns the number of uuids pruned.  Must be called with library lock held.
+func (lib *libraryT) pruneMemory() int {
+	pruned := make(map[string]bool)
+	for uuid, checkouts := range lib.vchk {
+		if len(checkouts) == 0 {
+			delete(lib.vchk, uuid)
+			pruned[uuid] = true
+		}
+	}
+	for uuid := range lib.recent {
+		if len(lib.vchk[uuid]) == 0 {
+			delete(lib.recent, uuid)
+			lib.recentComplete = false
+			pruned[uuid] = true
+		}
+	}
+	for uuid := range pruned {
+		invalidateView(uuid)
+	}
+	return len(pruned)
+}
+
+// Estimates the memory of the library, and if it's over -maxmemory, prunes empty uuids.
+// If still over, checkouts of new uuids are refused until it's back under.  Logs a
+// warning once per crossing of the cap.
+func checkMemory() {
+	max := maxMemoryBytes()
+
+	library.RLock()
+	usage, total := library.measureMemory()
+	library.RUnlock()
+
+	pruned := 0
+	if max > 0 && total > max {
+		library.Lock()
+		pruned = library.pruneMemory()
+		if pruned > 0 {
+			usage, total = library.measureMemory()
+		}
+		library.Unlock()
+		if pruned > 0 {
+			log.Printf("Pruned %d empty uuids since estimated library memory was over -maxmemory\n", pruned)
+		}
+		clearCachedHx()
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	memory.Lock()
+	defer memory.Unlock()
+	memory.pruned += pruned
+	wasOver := memory.report.OverCap
+	memory.report = memoryJSON{
+		Measured:    clock.Now(),
+		Bytes:       total,
+		MaxBytes:    max,
+		OverCap:     max > 0 && total > max,
+		HeapBytes:   ms.HeapAlloc,
+		PrunedUUIDs: memory.pruned,
+		UUIDs:       usage,
+	}
+	memoryBytesVar.Set(total)
+	memoryHeapVar.Set(int64(ms.HeapAlloc))
+	memoryUUIDsVar.Init()
+	for _, um := range usage {
+		v := new(expvar.Int)
+		v.Set(um.Bytes)
+		memoryUUIDsVar.Set(um.UUID, v)
+	}
+	switch {
+	case memory.report.OverCap && !wasOver:
+		memoryOverCapVar.Set(1)
+		log.Printf("WARNING: estimated library memory of %d bytes is over -maxmemory of %d bytes after pruning, so checkouts of new uuids are refused\n", total, max)
+	case !memory.report.OverCap && wasOver:
+		memoryOverCapVar.Set(0)
+		log.Printf("Estimated library memory of %d bytes is back under -maxmemory\n", total)
+	}
+}
+
+// Returns the last memory estimate.
+func getMemory() memoryJSON {
+	memory.RLock()
+	defer memory.RUnlock()
+	return memory.report
+}
+
+// Returns an error if a checkout would add a new uuid while the library is over its
+// -maxmemory cap.  UUIDs that have had any op are still allowed.
+func checkMemoryCap(uuid string) error {
+	memory.RLock()
+	overCap, bytes, max := memory.report.OverCap, memory.report.Bytes, memory.report.MaxBytes
+	memory.RUnlock()
+	if !overCap || knownUUID(uuid) {
+		return nil
+	}
+	return fmt.Errorf("uuid %s is new but the library's estimated memory of %d bytes is over the -maxmemory cap of %d bytes", uuid, bytes, max)
+}
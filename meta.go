@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// MaxMetaValueSize is the largest value in bytes that can be stored under a metadata key.
+// Values are written into the librarian log so should be kept small.
+const MaxMetaValueSize = 64 * 1024
+
+func setMeta(uuid, key, value, clientid string, attrs map[string]string, modifyLog bool) error {
+	return setMetaAt(clock.Now(), uuid, key, value, clientid, attrs, modifyLog)
+}
+
+// Sets metadata as of time t, which is the op time when replaying the log.
+func setMetaAt(t time.Time, uuid, key, value, clientid string, attrs map[string]string, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+
+	return library.setMeta(t, uuid, key, value, clientid, attrs, modifyLog)
+}
+
+// Sets metadata as of time t.  Must be called with library lock held.
+func (lib *libraryT) setMeta(t time.Time, uuid, key, value, clientid string, attrs map[string]string, modifyLog bool) error {
+	if key == "" {
+		return fmt.Errorf("metadata key cannot be empty")
+	}
+	if len(value) > MaxMetaValueSize {
+		return fmt.Errorf("metadata value for key %q is %d bytes, exceeding maximum of %d bytes", key, len(value), MaxMetaValueSize)
+	}
+	if modifyLog {
+		if err := lib.checkOpID(MetaSetOp, uuid, 0, clientid, key, attrs); err != nil {
+			return err
+		}
+	}
+	kv, found := lib.meta[uuid]
+	if !found {
+		kv = make(map[string]string)
+		lib.meta[uuid] = kv
+	}
+	prev, prevFound := kv[key]
+	kv[key] = value
+	lib.bumpRevision(uuid)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     MetaSetOp,
+			uuid:   uuid,
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"key": key, "value": value}),
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the change so state matches the log.
+			if prevFound {
+				kv[key] = prev
+			} else if delete(kv, key); len(kv) == 0 {
+				delete(lib.meta, uuid)
+			}
+			lib.unbumpRevision(uuid)
+			return err
+		}
+	}
+	lib.noteTool(clientid, attrs, t)
+	return nil
+}
+
+func deleteMeta(uuid, key, clientid string, attrs map[string]string, modifyLog bool) error {
+	return deleteMetaAt(clock.Now(), uuid, key, clientid, attrs, modifyLog)
+}
+
+// Deletes metadata as of time t, which is the op time when replaying the log.
+func deleteMetaAt(t time.Time, uuid, key, clientid string, attrs map[string]string, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+
+	if modifyLog {
+		if err := library.checkOpID(MetaDeleteOp, uuid, 0, clientid, key, attrs); err != nil {
+			return err
+		}
+	}
+	kv, found := library.meta[uuid]
+	if !found {
+		return fmt.Errorf("uuid %s has no metadata", uuid)
+	}
+	if _, found := kv[key]; !found {
+		return fmt.Errorf("uuid %s has no metadata key %q", uuid, key)
+	}
+	prev := kv[key]
+	delete(kv, key)
+	if len(kv) == 0 {
+		delete(library.meta, uuid)
+	}
+	library.bumpRevision(uuid)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     MetaDeleteOp,
+			uuid:   uuid,
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"key": key}),
+		}
+		if err := library.write(op); err != nil {
+			// Undo the deletion so state matches the log.
+			kv[key] = prev
+			library.meta[uuid] = kv
+			library.unbumpRevision(uuid)
+			return err
+		}
+	}
+	library.noteTool(clientid, attrs, t)
+	return nil
+}
+
+func getMeta(uuid, key string) (value string, found bool) {
+	library.RLock()
+	defer library.RUnlock()
+
+	value, found = library.meta[uuid][key]
+	return
+}
+
+// Returns JSON object of all metadata for a uuid.
+func getMetaJSON(uuid string) ([]byte, error) {
+	library.RLock()
+	defer library.RUnlock()
+
+	kv, found := library.meta[uuid]
+	if !found {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(kv)
+}
+
+// Writes all metadata into a compacted log.  Must be called with library lock held.
+func (lib *libraryT) writeMetaRestores() error {
+	for uuid, kv := range lib.meta {
+		for key, value := range kv {
+			op := &libraryOp{
+				op:     MetaRestoreOp,
+				uuid:   uuid,
+				client: "n/a",
+				attrs:  map[string]string{"key": key, "value": value},
+			}
+			if err := lib.write(op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// migratedJSON is a checkout moved, or that would be moved, to another uuid.
+type migratedJSON struct {
+	Label       labelJSON
+	Client      string
+	AlreadyHeld bool `json:",omitempty"` // client already had the label under the new uuid
+}
+
+// skippedJSON is a checkout left under the old uuid and why.
+type skippedJSON struct {
+	Label  labelJSON
+	Client string
+	Reason string
+}
+
+type migrateJSON struct {
+	From    string
+	To      string
+	DryRun  bool
+	Moved   []migratedJSON
+	Skipped []skippedJSON
+}
+
+// Moves the checkouts of one uuid to another, e.g., from a DVID node to its child, so
+// the locks follow the work.  If clientid isn't empty, only its checkouts are moved, and if
+// labels isn't nil, only those labels.  Each checkout is logged as a checkout under the new
+// uuid with a "migrated-from" attribute and a checkin under the old one with "migrated-to".
+// A checkout is skipped if the label is held by another client, pinned, or frozen under the
+// new uuid.  Nothing is moved if the moves would go over the new uuid's policy or quotas,
+// and moves already logged are rolled back if a later one can't be.  If dryRun, only returns
+// what would be moved.
+func migrateCheckouts(from, to, clientid string, labels []uint64, dryRun bool, attrs map[string]string) (migrateJSON, error) {
+	result := migrateJSON{From: from, To: to, DryRun: dryRun, Moved: []migratedJSON{}, Skipped: []skippedJSON{}}
+	if from == to {
+		return result, fmt.Errorf("uuid %s can't be migrated to itself", from)
+	}
+	now := clock.Now()
+
+	// The migration groups the ops, so an op id isn't recorded for each.
+	attrs = mergeAttrs(attrs, nil)
+	delete(attrs, "opid")
+
+	library.Lock()
+	defer library.Unlock()
+
+	var wanted map[uint64]bool
+	if labels != nil {
+		wanted = make(map[uint64]bool, len(labels))
+		for _, label := range labels {
+			wanted[label] = true
+		}
+	}
+	var matching []uint64
+	for label, co := range library.vchk[from] {
+		if (clientid == "" || co.client == clientid) && (wanted == nil || wanted[label]) {
+			matching = append(matching, label)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i] < matching[j] })
+
+	// Find the checkouts to move before changing anything.
+	fromFormat := library.policies[from].labelOutput()
+	toFormat := library.policies[to].labelOutput()
+	grace := library.policies[to].grace()
+	var moves []migrationT
+	var adding []uint64
+	byClient := make(map[string][]uint64)
+	for _, label := range matching {
+		co := library.vchk[from][label]
+		skip := func(reason string) {
+			result.Skipped = append(result.Skipped, skippedJSON{labelJSON{label, fromFormat}, co.client, reason})
+		}
+		if err := library.checkPinned(to, label); err != nil {
+			skip(err.Error())
+			continue
+		}
+		if err := library.checkFrozen(now, to, label); err != nil {
+			skip(err.Error())
+			continue
+		}
+		held := false
+		if other, found := library.vchk[to][label]; found && !other.expired(now, grace) {
+			if other.client != co.client {
+				skip(fmt.Sprintf("checked out by %s under uuid %s", other.client, to))
+				continue
+			}
+			held = true
+		}
+		result.Moved = append(result.Moved, migratedJSON{labelJSON{label, toFormat}, co.client, held})
+		moves = append(moves, migrationT{label: label, co: co, held: held})
+		if !held {
+			adding = append(adding, label)
+			byClient[co.client] = append(byClient[co.client], label)
+		}
+	}
+	for client, clientLabels := range byClient {
+		if err := library.checkCheckoutPolicy(to, client, clientLabels); err != nil {
+			return result, err
+		}
+	}
+	if err := library.checkCheckoutQuota(to, "", adding); err != nil {
+		return result, err
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	// The new checkout is logged first so a crash between the ops leaves the label locked.
+	var done []migrationT
+	for _, m := range moves {
+		if !m.held {
+			checkoutAttrs := mergeAttrs(attrs, map[string]string{"migrated-from": from})
+			if !m.co.expires.IsZero() {
+				expires, _ := m.co.expires.UTC().MarshalText()
+				checkoutAttrs["expires"] = string(expires)
+			}
+			if _, err := library.checkout(now, to, m.label, m.co.client, checkoutAttrs, true); err != nil {
+				err = fmt.Errorf("unable to check out uuid %s, label %d for %s: %w", to, m.label, m.co.client, err)
+				return result, library.rollbackMigration(now, from, to, done, attrs, err)
+			}
+		}
+		checkinAttrs := mergeAttrs(attrs, map[string]string{"migrated-to": to})
+		if err := library.checkin(now, from, m.label, m.co.client, checkinAttrs, true); err != nil {
+			err = fmt.Errorf("unable to check in uuid %s, label %d for %s: %w", from, m.label, m.co.client, err)
+			if !m.held {
+				done = append(done, m)
+			}
+			return result, library.rollbackMigration(now, from, to, done, attrs, err)
+		}
+		m.checkedIn = true
+		done = append(done, m)
+	}
+	if len(result.Moved) > 0 {
+		log.Printf("Migrated %d checkouts from uuid %s to %s\n", len(result.Moved), from, to)
+	}
+	return result, nil
+}
+
+// migrationT is a checkout being moved by migrateCheckouts.
+type migrationT struct {
+	label     uint64
+	co        checkoutT // checkout under the old uuid
+	held      bool      // client already had the label under the new uuid
+	checkedIn bool      // checkin under the old uuid was logged
+}
+
+// Undoes the moves of a failed migration, newest first, checking the labels back out under
+// the old uuid and in under the new one.  A label that can't be checked out again under the
+// old uuid is left checked out under the new one.  Returns the error that failed the
+// migration, noting any labels that couldn't be restored.  Must be called with library lock
+// held.
+func (lib *libraryT) rollbackMigration(t time.Time, from, to string, done []migrationT, attrs map[string]string, cause error) error {
+	var failed []string
+	for i := len(done) - 1; i >= 0; i-- {
+		m := done[i]
+		if m.checkedIn {
+			checkoutAttrs := mergeAttrs(attrs, map[string]string{"migrated-from": to, "rollback": "true"})
+			if !m.co.expires.IsZero() {
+				expires, _ := m.co.expires.UTC().MarshalText()
+				checkoutAttrs["expires"] = string(expires)
+			}
+			if _, err := lib.checkout(t, from, m.label, m.co.client, checkoutAttrs, true); err != nil {
+				failed = append(failed, fmt.Sprintf("label %d: %v", m.label, err))
+				continue
+			}
+		}
+		if m.held {
+			continue
+		}
+		checkinAttrs := mergeAttrs(attrs, map[string]string{"migrated-to": from, "rollback": "true"})
+		if err := lib.checkin(t, to, m.label, m.co.client, checkinAttrs, true); err != nil {
+			failed = append(failed, fmt.Sprintf("label %d: %v", m.label, err))
+		}
+	}
+	if len(failed) > 0 {
+		log.Printf("ERROR: unable to roll back migration from uuid %s to %s: %s\n", from, to, strings.Join(failed, "; "))
+		return fmt.Errorf("%w; unable to roll back %s", cause, strings.Join(failed, "; "))
+	}
+	if len(done) > 0 {
+		log.Printf("Rolled back %d checkouts migrated from uuid %s to %s\n", len(done), from, to)
+	}
+	return cause
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Converts JSON into the equivalent MessagePack (https://msgpack.org) encoding.  Going
+// through JSON keeps a single definition of each response.  Object keys are sorted.
+func jsonToMsgpack(jsonBytes []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(jsonBytes))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeMsgpack(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		return writeMsgpackNumber(buf, v)
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, elem := range v {
+			if err := writeMsgpack(buf, elem); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeMsgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			writeMsgpack(buf, key)
+			if err := writeMsgpack(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode %T as msgpack", v)
+	}
+	return nil
+}
+
+// Writes the type and length prefix for strings, arrays, and maps.  The 8-bit length
+// form (code8) only exists for strings and is skipped if 0.
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackNumber(buf *bytes.Buffer, num json.Number) error {
+	if u, err := strconv.ParseUint(string(num), 10, 64); err == nil {
+		switch {
+		case u <= 0x7f:
+			buf.WriteByte(byte(u))
+		case u <= math.MaxUint8:
+			buf.WriteByte(0xcc)
+			buf.WriteByte(byte(u))
+		case u <= math.MaxUint16:
+			buf.WriteByte(0xcd)
+			binary.Write(buf, binary.BigEndian, uint16(u))
+		case u <= math.MaxUint32:
+			buf.WriteByte(0xce)
+			binary.Write(buf, binary.BigEndian, uint32(u))
+		default:
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, u)
+		}
+		return nil
+	}
+	if i, err := strconv.ParseInt(string(num), 10, 64); err == nil {
+		switch {
+		case i >= -32:
+			buf.WriteByte(byte(i))
+		case i >= math.MinInt8:
+			buf.WriteByte(0xd0)
+			buf.WriteByte(byte(i))
+		case i >= math.MinInt16:
+			buf.WriteByte(0xd1)
+			binary.Write(buf, binary.BigEndian, int16(i))
+		case i >= math.MinInt32:
+			buf.WriteByte(0xd2)
+			binary.Write(buf, binary.BigEndian, int32(i))
+		default:
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, i)
+		}
+		return nil
+	}
+	f, err := num.Float64()
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, f)
+	return nil
+}
+
+// MsgpackContentType is the media type used for MessagePack responses.
+const MsgpackContentType = "application/msgpack"
+
+// Returns true if the request's Accept header prefers msgpack to JSON.
+func acceptsMsgpack(r *http.Request) bool {
+	var msgpackQ, jsonQ float64
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			params := strings.Split(mediaRange, ";")
+			mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+			q := 1.0
+			for _, param := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) == 2 && kv[0] == "q" {
+					if value, err := strconv.ParseFloat(kv[1], 64); err == nil {
+						q = value
+					}
+				}
+			}
+			switch mediaType {
+			case MsgpackContentType, "application/x-msgpack":
+				msgpackQ = math.Max(msgpackQ, q)
+			case "application/json", "application/*", "*/*":
+				jsonQ = math.Max(jsonQ, q)
+			}
+		}
+	}
+	return msgpackQ > 0 && msgpackQ >= jsonQ
+}
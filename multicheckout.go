@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxMultiCheckoutLabels is the most labels one POST /checkout-multi can check out.
+const MaxMultiCheckoutLabels = 1000
+
+// multiLabelBodyJSON is a label in the JSON request body of POST /checkout-multi.
+type multiLabelBodyJSON struct {
+	UUID  string
+	Label json.RawMessage // number or string in a format accepted by the uuid's policy
+}
+
+// multiCheckoutBodyJSON is the JSON request body of POST /checkout-multi.  Field names are
+// matched case-insensitively.
+type multiCheckoutBodyJSON struct {
+	Client string
+	TTL    string // checkout lease of every label, e.g., "2h"
+	Labels []multiLabelBodyJSON
+}
+
+// multiLabelT is a label to check out in a transaction with the attributes of its checkout.
+type multiLabelT struct {
+	uuid  string
+	label uint64
+	attrs map[string]string
+}
+
+type multiCheckedOutJSON struct {
+	UUID        string
+	Label       labelJSON
+	AlreadyHeld bool `json:",omitempty"` // client already had the label before the transaction
+}
+
+type multiCheckoutJSON struct {
+	Txn    string // transaction id logged as the "txn" attribute of each checkout
+	Client string
+	Labels []multiCheckedOutJSON
+}
+
+// multiCheckoutError is the failed checkout of one label that rolled back a transaction.
+type multiCheckoutError struct {
+	uuid     string
+	label    uint64
+	err      error
+	unlogged []multiLabelT // rolled back labels whose checkins couldn't be logged
+}
+
+func (e *multiCheckoutError) Error() string {
+	if len(e.unlogged) == 0 {
+		return e.err.Error()
+	}
+	held := make([]string, len(e.unlogged))
+	for i, ml := range e.unlogged {
+		held[i] = fmt.Sprintf("uuid %s, label %d", ml.uuid, ml.label)
+	}
+	return fmt.Sprintf("%v; rollback couldn't log checkins of %s, which are still checked out in the librarian log and will be again after a restart",
+		e.err, strings.Join(held, "; "))
+}
+
+func (e *multiCheckoutError) Unwrap() error {
+	return e.err
+}
+
+// Checks out labels of any uuids for a client all at once, e.g., a body grounded in both a
+// DVID node and its child.  Every label is checked for conflicts, pins, and freezes before
+// any checkout is logged, so a refused transaction logs nothing.  Policy and quota limits
+// count all of the transaction's labels of each uuid.  If a checkout still fails, e.g.,
+// because the log can't be written, the labels already checked out are rolled back.  Each
+// op is logged with the same "txn" attribute.
+func checkoutMulti(clientid string, labels []multiLabelT) (multiCheckoutJSON, error) {
+	t := clock.Now()
+	txn := strconv.FormatInt(t.UnixNano(), 36)
+
+	library.Lock()
+	defer library.Unlock()
+
+	var uuids []string
+	byUUID := make(map[string][]uint64)
+	for _, ml := range labels {
+		if _, found := byUUID[ml.uuid]; !found {
+			uuids = append(uuids, ml.uuid)
+		}
+		byUUID[ml.uuid] = append(byUUID[ml.uuid], ml.label)
+	}
+	for _, uuid := range uuids {
+		if err := library.checkCheckoutPolicy(uuid, clientid, byUUID[uuid]); err != nil {
+			return multiCheckoutJSON{}, err
+		}
+		if err := library.checkCheckoutQuota(uuid, clientid, byUUID[uuid]); err != nil {
+			return multiCheckoutJSON{}, err
+		}
+	}
+	for _, ml := range labels {
+		if err := library.checkPinned(ml.uuid, ml.label); err != nil {
+			return multiCheckoutJSON{}, &multiCheckoutError{uuid: ml.uuid, label: ml.label, err: err}
+		}
+		if err := library.checkFrozen(t, ml.uuid, ml.label); err != nil {
+			return multiCheckoutJSON{}, &multiCheckoutError{uuid: ml.uuid, label: ml.label, err: err}
+		}
+		co, found := library.vchk[ml.uuid][ml.label]
+		if found && co.client != clientid && !co.expired(t, library.policies[ml.uuid].grace()) {
+			return multiCheckoutJSON{}, &multiCheckoutError{uuid: ml.uuid, label: ml.label, err: &ErrAlreadyCheckedOut{ml.uuid, ml.label, co.client}}
+		}
+	}
+
+	result := multiCheckoutJSON{Txn: txn, Client: clientid, Labels: []multiCheckedOutJSON{}}
+	var acquired []multiLabelT
+	for _, ml := range labels {
+		attrs := mergeAttrs(ml.attrs, map[string]string{"txn": txn})
+		held, err := library.checkout(t, ml.uuid, ml.label, clientid, attrs, true)
+		if err != nil {
+			unlogged := library.rollbackMulti(t, txn, clientid, acquired)
+			return multiCheckoutJSON{}, &multiCheckoutError{ml.uuid, ml.label, err, unlogged}
+		}
+		if !held {
+			acquired = append(acquired, ml)
+		}
+		format := library.policies[ml.uuid].labelOutput()
+		result.Labels = append(result.Labels, multiCheckedOutJSON{ml.uuid, labelJSON{ml.label, format}, held})
+	}
+	log.Printf("Checked out %d labels for %s in transaction %s\n", len(labels), clientid, txn)
+	return result, nil
+}
+
+// Checks back in the labels checked out by a failed transaction, newest first.  All are
+// released in memory before their checkins are logged with a "rollback" attribute, so a
+// log that can't be written doesn't leave any held.  Returns the labels whose checkins
+// couldn't be logged.  Must be called with library lock held.
+func (lib *libraryT) rollbackMulti(t time.Time, txn, clientid string, acquired []multiLabelT) []multiLabelT {
+	ops := make([]*libraryOp, 0, len(acquired))
+	rolledBack := make([]multiLabelT, 0, len(acquired))
+	for i := len(acquired) - 1; i >= 0; i-- {
+		ml := acquired[i]
+		attrs := mergeAttrs(ml.attrs, map[string]string{"txn": txn, "rollback": "true"})
+		delete(attrs, "expires")
+		if err := lib.checkin(t, ml.uuid, ml.label, clientid, attrs, false); err != nil {
+			log.Printf("ERROR: unable to roll back checkout of uuid %s, label %d by %s in transaction %s: %v\n",
+				ml.uuid, ml.label, clientid, txn, err)
+			continue
+		}
+		ops = append(ops, &libraryOp{t: t, op: CheckinOp, uuid: ml.uuid, label: ml.label, client: clientid, attrs: attrs})
+		rolledBack = append(rolledBack, ml)
+	}
+	var unlogged []multiLabelT
+	for i, op := range ops {
+		if err := lib.write(op); err != nil {
+			log.Printf("ERROR: unable to log rollback of checkout of uuid %s, label %d by %s in transaction %s: %v\n",
+				op.uuid, op.label, clientid, txn, err)
+			unlogged = append(unlogged, rolledBack[i])
+		}
+	}
+	if len(acquired) > 0 {
+		log.Printf("Rolled back %d checkouts by %s in transaction %s\n", len(acquired), clientid, txn)
+	}
+	return unlogged
+}
+
+// Returns the labels of a POST /checkout-multi request body with the attributes of their
+// checkouts.  Labels must be unique.
+func (body *multiCheckoutBodyJSON) labels(attrs map[string]string) ([]multiLabelT, error) {
+	if len(body.Labels) == 0 {
+		return nil, fmt.Errorf("JSON request body must list labels")
+	}
+	if len(body.Labels) > MaxMultiCheckoutLabels {
+		return nil, fmt.Errorf("JSON request body lists over %d labels", MaxMultiCheckoutLabels)
+	}
+	labels := make([]multiLabelT, 0, len(body.Labels))
+	seen := make(map[string]bool, len(body.Labels))
+	for i, item := range body.Labels {
+		if item.UUID == "" {
+			return nil, fmt.Errorf("labels[%d] in JSON request body has no uuid", i)
+		}
+		if len(item.Label) == 0 {
+			return nil, fmt.Errorf("labels[%d] in JSON request body has no label", i)
+		}
+		label, err := parseLabelJSON(item.UUID, item.Label)
+		if err != nil {
+			return nil, err
+		}
+		key := item.UUID + "/" + strconv.FormatUint(label, 10)
+		if seen[key] {
+			return nil, fmt.Errorf("uuid %s, label %d is listed more than once", item.UUID, label)
+		}
+		seen[key] = true
+		var ttl time.Duration
+		if body.TTL != "" {
+			if ttl, err = requestedTTL(item.UUID, body.TTL); err != nil {
+				return nil, err
+			}
+		}
+		labels = append(labels, multiLabelT{item.UUID, label, checkoutAttrs(item.UUID, ttl, attrs)})
+	}
+	return labels, nil
+}
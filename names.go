@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// LabelNameMetaPrefix starts the metadata keys holding label display names, e.g.,
+	// "label-name:34890", so names are logged and compacted like other metadata.
+	LabelNameMetaPrefix = "label-name:"
+
+	// MaxLabelNameLength is the longest label display name in bytes.
+	MaxLabelNameLength = 200
+)
+
+type labelNameJSON struct {
+	Label labelJSON
+	Name  string
+}
+
+type labelNamesJSON struct {
+	UUID  string
+	Names []labelNameJSON
+}
+
+func labelNameKey(label uint64) string {
+	return LabelNameMetaPrefix + strconv.FormatUint(label, 10)
+}
+
+// Returns the labels and names held in a uuid's metadata.  Must be called with library
+// lock held.
+func (lib *libraryT) labelNames(uuid string) map[uint64]string {
+	var names map[uint64]string
+	for key, value := range lib.meta[uuid] {
+		labelStr, found := strings.CutPrefix(key, LabelNameMetaPrefix)
+		if !found {
+			continue
+		}
+		label, err := strconv.ParseUint(labelStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		if names == nil {
+			names = make(map[uint64]string)
+		}
+		names[label] = value
+	}
+	return names
+}
+
+// Returns the display names of a uuid's labels, or nil if there are none.
+func getLabelNamesMap(uuid string) map[uint64]string {
+	library.RLock()
+	defer library.RUnlock()
+	return library.labelNames(uuid)
+}
+
+// Returns the display name of a label, if it has one.
+func getLabelName(uuid string, label uint64) (string, bool) {
+	return getMeta(uuid, labelNameKey(label))
+}
+
+// Returns the display names of a uuid's labels sorted by label.
+func getLabelNames(uuid string) labelNamesJSON {
+	format := getPolicy(uuid).LabelOutput
+	list := labelNamesJSON{UUID: uuid, Names: []labelNameJSON{}}
+	for label, name := range getLabelNamesMap(uuid) {
+		list.Names = append(list.Names, labelNameJSON{labelJSON{label, format}, name})
+	}
+	sort.Slice(list.Names, func(i, j int) bool { return list.Names[i].Label.label < list.Names[j].Label.label })
+	return list
+}
+
+// Sets the display name of a label, e.g., "Mi1 candidate #4".
+func setLabelName(uuid string, label uint64, name, clientid string, attrs map[string]string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("label name cannot be empty")
+	}
+	if len(name) > MaxLabelNameLength {
+		return fmt.Errorf("label name is over %d bytes", MaxLabelNameLength)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("label name %q has control characters", name)
+		}
+	}
+	return setMeta(uuid, labelNameKey(label), name, clientid, attrs, true)
+}
+
+// Removes the display name of a label.
+func deleteLabelName(uuid string, label uint64, clientid string, attrs map[string]string) error {
+	if _, found := getLabelName(uuid, label); !found {
+		return fmt.Errorf("uuid %s, label %d has no name", uuid, label)
+	}
+	return deleteMeta(uuid, labelNameKey(label), clientid, attrs, true)
+}
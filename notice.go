@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ClosingEventDelay is how long a stopping server waits after sending "server-closing"
+// events so they reach subscribers before connections drop.
+const ClosingEventDelay = time.Second
+
+// The banner returned by GET /notice for UIs to display, e.g., before a planned shutdown.
+var notice struct {
+	sync.RWMutex
+	message  string
+	set      time.Time
+	closesAt time.Time // zero unless a shutdown is planned by POST /admin/drain
+}
+
+type noticeJSON struct {
+	Message  string     `json:",omitempty"`
+	Set      *time.Time `json:",omitempty"`
+	ClosesAt *time.Time `json:",omitempty"` // planned shutdown
+}
+
+func getNotice() noticeJSON {
+	notice.RLock()
+	defer notice.RUnlock()
+
+	if notice.message == "" {
+		return noticeJSON{}
+	}
+	set := notice.set
+	n := noticeJSON{Message: notice.message, Set: &set}
+	if !notice.closesAt.IsZero() {
+		closesAt := notice.closesAt
+		n.ClosesAt = &closesAt
+	}
+	return n
+}
+
+// Sets the banner, clearing it if message is empty.  A non-zero closesAt marks a planned
+// shutdown.
+func setNotice(message string, closesAt time.Time) {
+	notice.Lock()
+	defer notice.Unlock()
+
+	notice.message = message
+	notice.set = clock.Now()
+	notice.closesAt = closesAt
+	if message == "" {
+		notice.closesAt = time.Time{}
+		log.Printf("Notice cleared\n")
+	} else {
+		log.Printf("Notice set: %s\n", message)
+	}
+}
+
+// Plans a shutdown in the given time: sets the banner, defaulting to a message giving the
+// time, and sends a "server-closing" event to every subscriber.  Returns the subscribers
+// told.
+func drain(in time.Duration, message string) int {
+	closesAt := clock.Now().Add(in)
+	if message == "" {
+		message = fmt.Sprintf("librarian will shut down at %s", closesAt.Format(time.Kitchen))
+	}
+	setNotice(message, closesAt)
+	return broadcastClosing(message, closesAt)
+}
+
+// Sends a "server-closing" event to every subscription without blocking.  Returns the
+// number of subscriptions sent the event.
+func broadcastClosing(message string, closesAt time.Time) int {
+	subscriptions.Lock()
+	defer subscriptions.Unlock()
+
+	sent := 0
+	for client, subs := range subscriptions.clients {
+		ev := eventJSON{Event: ServerClosingEvent, Client: client, Notice: message, ClosesAt: &closesAt}
+		for ch := range subs {
+			select {
+			case ch <- ev:
+				sent++
+			default:
+				log.Printf("WARNING: dropped %s event to slow subscriber %s\n", ev.Event, client)
+			}
+		}
+	}
+	if sent > 0 {
+		log.Printf("Sent %s event to %d subscribers\n", ServerClosingEvent, sent)
+	}
+	return sent
+}
+
+// Tells subscribers the server is stopping now and gives the events time to be sent.
+func closeSubscriptions() {
+	message := getNotice().Message
+	if message == "" {
+		message = "librarian is shutting down"
+	}
+	if broadcastClosing(message, clock.Now()) > 0 {
+		time.Sleep(ClosingEventDelay)
+	}
+}
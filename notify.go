@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// NotifyRetrySchedule is the cron spec for retrying failed notifications that are due.
+	NotifyRetrySchedule = "30 * * * * *"
+
+	// Wait before the first retry of a notification, doubled after each failure up to
+	// NotifyRetryMaxWait.
+	NotifyRetryWait    = time.Minute
+	NotifyRetryMaxWait = 6 * time.Hour
+
+	// MaxNotifyAttempts is the number of deliveries of a notification before it is moved to
+	// the failed list.
+	MaxNotifyAttempts = 10
+
+	// MaxFailedNotifications is the most failed notifications kept.  The oldest are dropped.
+	MaxFailedNotifications = 1000
+
+	// NotifySaveDelay is how long after a change the notifications file is written, so a
+	// burst of changes is saved once.
+	NotifySaveDelay = time.Second
+)
+
+// Kinds of notifications.
+const (
+	WebhookNotification = "webhook"
+	EmailNotification   = "email"
+)
+
+// notificationsSuffix is added to the log file name for the file of queued notifications.
+const notificationsSuffix = ".notifications"
+
+var (
+	notifyPendingVar = expvar.NewInt("librarian_notifications_pending")
+	notifyFailedVar  = expvar.NewInt("librarian_notifications_failed")
+)
+
+// notificationT is a webhook post or email whose delivery failed.
+type notificationT struct {
+	ID          string
+	Kind        string
+	What        string    // e.g., "daily digest for 2015-12-19"
+	To          []string  // webhook URL or email recipients
+	From        string    `json:",omitempty"` // email sender
+	Body        []byte    // JSON posted or email message
+	Created     time.Time // when first delivered
+	Attempts    int
+	LastError   string
+	NextAttempt time.Time `json:",omitempty"`
+}
+
+// notificationJSON describes a queued or failed notification without its body.
+type notificationJSON struct {
+	ID          string
+	Kind        string
+	What        string
+	To          []string
+	Created     time.Time
+	Attempts    int
+	LastError   string
+	NextAttempt *time.Time `json:",omitempty"` // omitted for failed notifications
+}
+
+type notificationsJSON struct {
+	Pending []notificationJSON
+	Failed  []notificationJSON
+}
+
+// Notifications waiting for a retry and those that failed every attempt, saved in a file
+// next to the log so they survive a restart.
+var notifications = struct {
+	sync.Mutex
+	fname   string
+	pending []*notificationT
+	failed  []*notificationT
+	saving  *time.Timer // pending write of the file, or nil
+}{}
+
+// Held while retrying so a slow retry isn't overlapped by the next.
+var notifyRetryMu sync.Mutex
+
+// Held while writing the notifications file so writes don't overlap.
+var notifySaveMu sync.Mutex
+
+// Loads the notifications saved next to a log file.
+func initNotifications(logfile string) error {
+	notifications.Lock()
+	defer notifications.Unlock()
+
+	notifications.fname = logfile + notificationsSuffix
+	data, err := os.ReadFile(notifications.fname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved struct{ Pending, Failed []*notificationT }
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("bad notifications file %q: %v", notifications.fname, err)
+	}
+	notifications.pending, notifications.failed = saved.Pending, saved.Failed
+	notifyPendingVar.Set(int64(len(saved.Pending)))
+	notifyFailedVar.Set(int64(len(saved.Failed)))
+	if len(saved.Pending) > 0 {
+		log.Printf("Loaded %d notifications to retry from %q\n", len(saved.Pending), notifications.fname)
+	}
+	return nil
+}
+
+// Notes a change to the notifications and schedules writing them to their file after
+// NotifySaveDelay.  Must be called with notifications locked.
+func saveNotifications() {
+	notifyPendingVar.Set(int64(len(notifications.pending)))
+	notifyFailedVar.Set(int64(len(notifications.failed)))
+	if notifications.fname == "" || notifications.saving != nil {
+		return
+	}
+	notifications.saving = time.AfterFunc(NotifySaveDelay, writeNotifications)
+}
+
+// Writes the notifications to their file if there are unsaved changes.  The file is written
+// without holding the notifications lock, so deliveries aren't held up by the disk.
+func writeNotifications() {
+	notifySaveMu.Lock()
+	defer notifySaveMu.Unlock()
+
+	notifications.Lock()
+	if notifications.saving == nil {
+		notifications.Unlock()
+		return
+	}
+	notifications.saving.Stop()
+	notifications.saving = nil
+	fname := notifications.fname
+	data, err := json.Marshal(struct{ Pending, Failed []*notificationT }{notifications.pending, notifications.failed})
+	notifications.Unlock()
+
+	if err == nil {
+		tmpname := fname + ".tmp"
+		if err = os.WriteFile(tmpname, data, 0664); err == nil {
+			err = os.Rename(tmpname, fname)
+		}
+	}
+	if err != nil {
+		log.Printf("ERROR: unable to save notifications to %q: %v\n", fname, err)
+	}
+}
+
+// Delivers a notification once.
+func (n *notificationT) deliver() error {
+	switch n.Kind {
+	case WebhookNotification:
+		return postBody(n.To[0], n.Body)
+	case EmailNotification:
+		configMu.RLock()
+		server := *smtpServer
+		configMu.RUnlock()
+		return smtp.SendMail(server, nil, n.From, n.To, n.Body)
+	}
+	return fmt.Errorf("unknown kind of notification %q", n.Kind)
+}
+
+// Returns the wait before the next retry of a notification delivered attempts times.
+func notifyRetryWait(attempts int) time.Duration {
+	wait := NotifyRetryWait
+	for i := 1; i < attempts && wait < NotifyRetryMaxWait; i++ {
+		wait *= 2
+	}
+	if wait > NotifyRetryMaxWait {
+		wait = NotifyRetryMaxWait
+	}
+	return wait
+}
+
+// Delivers a notification, queueing it for retries if it fails.  The error of the first
+// attempt is returned.
+func notify(n *notificationT) error {
+	n.Created = clock.Now()
+	err := n.deliver()
+	n.Attempts = 1
+	if err == nil {
+		return nil
+	}
+	n.LastError = err.Error()
+	n.NextAttempt = n.Created.Add(notifyRetryWait(1))
+
+	notifications.Lock()
+	n.ID = strconv.FormatInt(n.Created.UnixNano(), 36)
+	for notificationIndex(notifications.pending, n.ID) >= 0 || notificationIndex(notifications.failed, n.ID) >= 0 {
+		n.ID += "x"
+	}
+	notifications.pending = append(notifications.pending, n)
+	saveNotifications()
+	notifications.Unlock()
+	return fmt.Errorf("%v; will retry at %s", err, n.NextAttempt.Format(time.RFC3339))
+}
+
+// Posts JSON to a webhook, retrying later if it fails.
+func notifyWebhook(what, url string, v interface{}) error {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return notify(&notificationT{Kind: WebhookNotification, What: what, To: []string{url}, Body: jsonBytes})
+}
+
+// Emails a message through the -smtp server, retrying later if it fails.
+func notifyEmail(what, from string, to []string, msg []byte) error {
+	return notify(&notificationT{Kind: EmailNotification, What: what, To: to, From: from, Body: msg})
+}
+
+func notificationIndex(list []*notificationT, id string) int {
+	for i, n := range list {
+		if n.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Retries the notifications that are due, moving those out of attempts to the failed list.
+func retryNotifications() {
+	if !notifyRetryMu.TryLock() {
+		return
+	}
+	defer notifyRetryMu.Unlock()
+
+	now := clock.Now()
+	notifications.Lock()
+	var due []*notificationT
+	for _, n := range notifications.pending {
+		if !now.Before(n.NextAttempt) {
+			due = append(due, n)
+		}
+	}
+	notifications.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	for _, n := range due {
+		err := n.deliver()
+
+		notifications.Lock()
+		i := notificationIndex(notifications.pending, n.ID)
+		if i < 0 {
+			// Dropped meanwhile through the admin API.
+			notifications.Unlock()
+			continue
+		}
+		n.Attempts++
+		switch {
+		case err == nil:
+			notifications.pending = append(notifications.pending[:i], notifications.pending[i+1:]...)
+			log.Printf("Delivered %s by %s to %s after %d attempts\n", n.What, n.Kind, strings.Join(n.To, ", "), n.Attempts)
+		case n.Attempts >= MaxNotifyAttempts:
+			n.LastError = err.Error()
+			notifications.pending = append(notifications.pending[:i], notifications.pending[i+1:]...)
+			notifications.failed = append(notifications.failed, n)
+			if len(notifications.failed) > MaxFailedNotifications {
+				notifications.failed = notifications.failed[len(notifications.failed)-MaxFailedNotifications:]
+			}
+			log.Printf("WARNING: gave up on %s by %s to %s after %d attempts: %v\n", n.What, n.Kind, strings.Join(n.To, ", "), n.Attempts, err)
+		default:
+			n.LastError = err.Error()
+			n.NextAttempt = clock.Now().Add(notifyRetryWait(n.Attempts))
+			log.Printf("ERROR: unable to deliver %s by %s to %s on attempt %d, retrying at %s: %v\n",
+				n.What, n.Kind, strings.Join(n.To, ", "), n.Attempts, n.NextAttempt.Format(time.RFC3339), err)
+		}
+		saveNotifications()
+		notifications.Unlock()
+	}
+}
+
+func (n *notificationT) describe(pending bool) notificationJSON {
+	desc := notificationJSON{ID: n.ID, Kind: n.Kind, What: n.What, To: n.To, Created: n.Created, Attempts: n.Attempts, LastError: n.LastError}
+	if pending {
+		next := n.NextAttempt
+		desc.NextAttempt = &next
+	}
+	return desc
+}
+
+// Returns the pending and failed notifications, oldest first.
+func getNotifications() notificationsJSON {
+	notifications.Lock()
+	defer notifications.Unlock()
+
+	list := notificationsJSON{Pending: []notificationJSON{}, Failed: []notificationJSON{}}
+	for _, n := range notifications.pending {
+		list.Pending = append(list.Pending, n.describe(true))
+	}
+	for _, n := range notifications.failed {
+		list.Failed = append(list.Failed, n.describe(false))
+	}
+	sort.SliceStable(list.Pending, func(i, j int) bool { return list.Pending[i].Created.Before(list.Pending[j].Created) })
+	return list
+}
+
+// Queues a failed notification for another round of attempts, or a pending one to be
+// retried at the next check.
+func requeueNotification(id string) (notificationJSON, error) {
+	notifications.Lock()
+	defer notifications.Unlock()
+
+	now := clock.Now()
+	if i := notificationIndex(notifications.pending, id); i >= 0 {
+		n := notifications.pending[i]
+		n.NextAttempt = now
+		saveNotifications()
+		return n.describe(true), nil
+	}
+	i := notificationIndex(notifications.failed, id)
+	if i < 0 {
+		return notificationJSON{}, fmt.Errorf("no notification with id %q", id)
+	}
+	n := notifications.failed[i]
+	notifications.failed = append(notifications.failed[:i], notifications.failed[i+1:]...)
+	n.Attempts = 0
+	n.NextAttempt = now
+	notifications.pending = append(notifications.pending, n)
+	saveNotifications()
+	return n.describe(true), nil
+}
+
+// Drops a pending or failed notification, returning false if there was none.
+func dropNotification(id string) bool {
+	notifications.Lock()
+	defer notifications.Unlock()
+
+	if i := notificationIndex(notifications.pending, id); i >= 0 {
+		notifications.pending = append(notifications.pending[:i], notifications.pending[i+1:]...)
+	} else if i := notificationIndex(notifications.failed, id); i >= 0 {
+		notifications.failed = append(notifications.failed[:i], notifications.failed[i+1:]...)
+	} else {
+		return false
+	}
+	saveNotifications()
+	return true
+}
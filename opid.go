@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// OpIDHeader is the optional request header with a client-generated id, e.g., a UUID,
+	// for a checkout, checkin, reset, metadata, or policy change.  Retries with the same
+	// id are applied only once.
+	OpIDHeader = "X-Op-ID"
+
+	// MaxOpIDLength is the maximum length in bytes of an op id.
+	MaxOpIDLength = 128
+
+	// OpIDRetention is how long op ids are remembered for deduplicating retries.
+	OpIDRetention = 24 * time.Hour
+)
+
+// opIDT is the op applied for a client-generated op id.
+type opIDT struct {
+	op     opType
+	uuid   string
+	label  uint64
+	client string
+	key    string // metadata key for metadata ops
+	t      time.Time
+}
+
+func (o opIDT) matches(op opType, uuid string, label uint64, clientid, key string) bool {
+	if o.op == RenewOp {
+		o.op = CheckoutOp // repeated checkout logged as a renewal
+	}
+	return o.op == op && o.uuid == uuid && o.label == label && o.client == clientid && o.key == key
+}
+
+// Remembers the op id of an applied op.  Returns false if the op id was already used.
+// Ops without an op id always return true.  Must be called with library lock held.
+func (lib *libraryT) noteOpID(op *libraryOp, t time.Time) bool {
+	id := op.attrs["opid"]
+	if id == "" || op.op == ConflictOp {
+		return true
+	}
+	if _, found := lib.opIDs[id]; found {
+		return false
+	}
+	lib.opIDs[id] = opIDT{op.op, op.uuid, op.label, op.client, op.attrs["key"], t}
+	return true
+}
+
+// Forgets op ids older than OpIDRetention.  Must be called with library lock held.
+func (lib *libraryT) pruneOpIDs(now time.Time) {
+	for id, o := range lib.opIDs {
+		if now.Sub(o.t) > OpIDRetention {
+			delete(lib.opIDs, id)
+		}
+	}
+	if lib.db != nil {
+		if err := lib.db.pruneOpIDs(now.Add(-OpIDRetention)); err != nil {
+			log.Printf("ERROR: unable to prune op ids in state db: %v\n", err)
+		}
+	}
+	if lib.shadow != nil {
+		noteShadowWrite(lib.shadow.pruneOpIDs(now.Add(-OpIDRetention)), "pruning op ids")
+	}
+}
+
+func pruneOpIDs() {
+	library.Lock()
+	defer library.Unlock()
+
+	library.pruneOpIDs(clock.Now())
+}
+
+// opIDUsedError is returned for an op whose op id was already used, either by the same
+// op, which was already applied, or by a different one.
+type opIDUsedError struct {
+	id    string
+	prior opIDT
+	same  bool // prior op is the op being retried
+}
+
+func (e *opIDUsedError) Error() string {
+	if e.same {
+		return fmt.Sprintf("op id %q for %s of uuid %s, label %d by %s was already applied at %s",
+			e.id, e.prior.op, e.prior.uuid, e.prior.label, e.prior.client, e.prior.t.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("op id %q was already used for %s of uuid %s, label %d by %s", e.id, e.prior.op, e.prior.uuid, e.prior.label, e.prior.client)
+}
+
+// Returns an *opIDUsedError if the op id in attrs, if any, was already used, where key is
+// only used for metadata ops.  Must be called with library lock held, in the same locked
+// section that applies and logs the op, so concurrent retries can't both apply it.
+func (lib *libraryT) checkOpID(op opType, uuid string, label uint64, clientid, key string, attrs map[string]string) error {
+	id := attrs["opid"]
+	if id == "" {
+		return nil
+	}
+	prior, found := lib.opIDs[id]
+	if !found {
+		return nil
+	}
+	return &opIDUsedError{id, prior, prior.matches(op, uuid, label, clientid, key)}
+}
+
+// Checks the length of the op id, if any, of a request.  Returns false if an error response
+// has been written.
+func validOpID(w http.ResponseWriter, r *http.Request) bool {
+	if id := r.Header.Get(OpIDHeader); len(id) > MaxOpIDLength {
+		BadRequest(w, r, "%s header is over %d bytes", OpIDHeader, MaxOpIDLength)
+		return false
+	}
+	return true
+}
+
+// Writes the response to an op refused with an *opIDUsedError: success if the op was
+// already applied, or a 400 status if the op id was used by another op.  Returns false if
+// err isn't an *opIDUsedError, so no response has been written.
+func writeOpIDUsed(w http.ResponseWriter, r *http.Request, err error) bool {
+	var used *opIDUsedError
+	if !errors.As(err, &used) {
+		return false
+	}
+	if !used.same {
+		BadRequest(w, r, "%v", err)
+		return true
+	}
+	log.Printf("Op id %q for %s of uuid %s, label %d by %s was already applied at %s\n",
+		used.id, used.prior.op, used.prior.uuid, used.prior.label, used.prior.client, used.prior.t.Format(time.RFC3339))
+	writeOK(w)
+	return true
+}
+
+// Writes the op ids still remembered into a compacted log, so retries are deduplicated
+// across compactions.  Must be called with library lock held.
+func (lib *libraryT) writeOpIDRestores() error {
+	now := clock.Now()
+	for id, o := range lib.opIDs {
+		if now.Sub(o.t) > OpIDRetention {
+			continue
+		}
+		op := &libraryOp{
+			t:      o.t,
+			op:     OpIDRestoreOp,
+			uuid:   o.uuid,
+			label:  o.label,
+			client: o.client,
+			attrs:  map[string]string{"id": id, "op": o.op.String()},
+		}
+		if o.key != "" {
+			op.attrs["key"] = o.key
+		}
+		if err := lib.write(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remembers an op id carried over into a compacted log.
+func restoreOpID(op *libraryOp) error {
+	id := op.attrs["id"]
+	opT := opTypeFromString(op.attrs["op"])
+	if id == "" || opT == UnknownOp {
+		return fmt.Errorf("bad op id %q for %q op in librarian log", id, op.attrs["op"])
+	}
+	library.Lock()
+	defer library.Unlock()
+
+	library.opIDs[id] = opIDT{opT, op.uuid, op.label, op.client, op.attrs["key"], op.t}
+	return nil
+}
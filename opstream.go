@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of ops buffered for the -opstream while it is slow or unreachable.  Ops beyond
+	// this are dropped.
+	opStreamBufferSize = 10000
+
+	// Most ops sent to the -opstream in one batch.
+	opStreamBatchSize = 100
+
+	// Longest wait between retries of a failed batch.
+	opStreamMaxBackoff = time.Minute
+)
+
+// opStreamJSON is the message published to the -opstream for each op.
+type opStreamJSON struct {
+	Seq    uint64
+	Time   time.Time
+	Op     string
+	UUID   string
+	Label  uint64
+	Client string
+	Attrs  map[string]string `json:",omitempty"`
+}
+
+type opStreamStatsJSON struct {
+	URL       string
+	Buffered  int
+	Sent      uint64
+	Dropped   uint64
+	LastError string     `json:",omitempty"`
+	ErrorTime *time.Time `json:",omitempty"`
+}
+
+// opPublisher sends batches of JSON messages to a message broker.
+type opPublisher interface {
+	publish(msgs [][]byte) error
+	close()
+}
+
+var opStream = struct {
+	sync.Mutex
+	url       string
+	ch        chan []byte
+	sent      uint64
+	dropped   uint64
+	dropping  bool
+	lastError string
+	errorTime time.Time
+}{}
+
+// Parses the -opstream URL into a publisher.  "nats://host:4222/subject" publishes to a
+// NATS subject, and "kafka://host:8082/topic" publishes to a Kafka topic through a Kafka
+// REST proxy ("kafka+https://" for a proxy using TLS).
+func newOpPublisher(streamURL string) (opPublisher, error) {
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.Trim(u.Path, "/")
+	if u.Host == "" || name == "" {
+		return nil, fmt.Errorf("URL must have a host and a subject or topic, e.g., \"nats://localhost:4222/librarian.ops\"")
+	}
+	switch u.Scheme {
+	case "nats":
+		return &natsPublisher{addr: u.Host, subject: name}, nil
+	case "kafka", "kafka+http", "kafka+https":
+		scheme := "http"
+		if u.Scheme == "kafka+https" {
+			scheme = "https"
+		}
+		endpoint := fmt.Sprintf("%s://%s/topics/%s", scheme, u.Host, url.PathEscape(name))
+		return &kafkaRESTPublisher{endpoint: endpoint, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheme %q: must be nats, kafka, or kafka+https", u.Scheme)
+	}
+}
+
+// Starts publishing ops to the -opstream in the background.
+func initOpStream(streamURL string) error {
+	pub, err := newOpPublisher(streamURL)
+	if err != nil {
+		return fmt.Errorf("bad -opstream %q: %v", streamURL, err)
+	}
+	opStream.Lock()
+	opStream.url = streamURL
+	opStream.ch = make(chan []byte, opStreamBufferSize)
+	opStream.Unlock()
+
+	go runOpStream(pub, opStream.ch)
+	log.Printf("Publishing ops to %s\n", streamURL)
+	return nil
+}
+
+// Queues an op for the -opstream without blocking.  Ops that only carry state into a
+// compacted log aren't published.  Must be called with library lock held.
+func shipOp(op *libraryOp, t time.Time) {
+	if opStream.ch == nil || op.op.restore() {
+		return
+	}
+	msg, err := json.Marshal(opStreamJSON{op.seq, t, op.op.String(), op.uuid, op.label, op.client, op.attrs})
+	if err != nil {
+		log.Printf("ERROR: unable to encode %s op of uuid %s for -opstream: %v\n", op.op, op.uuid, err)
+		return
+	}
+	select {
+	case opStream.ch <- msg:
+		opStream.Lock()
+		opStream.dropping = false
+		opStream.Unlock()
+	default:
+		opStream.Lock()
+		opStream.dropped++
+		if !opStream.dropping {
+			log.Printf("WARNING: -opstream buffer is full so ops are being dropped\n")
+			opStream.dropping = true
+		}
+		opStream.Unlock()
+	}
+}
+
+// Sends buffered ops in batches, retrying a failed batch with backoff so ops are published
+// in order.
+func runOpStream(pub opPublisher, ch chan []byte) {
+	backoff := time.Second
+	for msg := range ch {
+		batch := [][]byte{msg}
+	fill:
+		for len(batch) < opStreamBatchSize {
+			select {
+			case msg := <-ch:
+				batch = append(batch, msg)
+			default:
+				break fill
+			}
+		}
+		for {
+			err := pub.publish(batch)
+			opStream.Lock()
+			if err == nil {
+				opStream.sent += uint64(len(batch))
+				opStream.Unlock()
+				backoff = time.Second
+				break
+			}
+			opStream.lastError = err.Error()
+			opStream.errorTime = time.Now()
+			opStream.Unlock()
+
+			log.Printf("ERROR: unable to publish %d ops to -opstream, retrying in %s: %v\n", len(batch), backoff, err)
+			pub.close()
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > opStreamMaxBackoff {
+				backoff = opStreamMaxBackoff
+			}
+		}
+	}
+}
+
+func getOpStreamStats() opStreamStatsJSON {
+	opStream.Lock()
+	defer opStream.Unlock()
+
+	stats := opStreamStatsJSON{
+		URL:       opStream.url,
+		Buffered:  len(opStream.ch),
+		Sent:      opStream.sent,
+		Dropped:   opStream.dropped,
+		LastError: opStream.lastError,
+	}
+	if !opStream.errorTime.IsZero() {
+		errorTime := opStream.errorTime
+		stats.ErrorTime = &errorTime
+	}
+	return stats
+}
+
+// natsPublisher publishes to a NATS subject using the NATS text protocol.
+type natsPublisher struct {
+	addr    string
+	subject string
+	conn    net.Conn
+	r       *bufio.Reader
+}
+
+func (p *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("expected INFO from NATS server, got %q", strings.TrimSpace(line))
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"librarian\"}\r\n"); err != nil {
+		conn.Close()
+		return err
+	}
+	p.conn, p.r = conn, r
+	return nil
+}
+
+// Publishes the messages, then waits for the server to answer a PING so errors are seen
+// before the batch is considered sent.
+func (p *natsPublisher) publish(msgs [][]byte) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	p.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		fmt.Fprintf(&buf, "PUB %s %d\r\n", p.subject, len(msg))
+		buf.Write(msg)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("PING\r\n")
+	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server error: %s", line)
+		}
+	}
+}
+
+func (p *natsPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// kafkaRESTPublisher publishes to a Kafka topic through a Kafka REST proxy.
+type kafkaRESTPublisher struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (p *kafkaRESTPublisher) publish(msgs [][]byte) error {
+	type record struct {
+		Value json.RawMessage `json:"value"`
+	}
+	records := struct {
+		Records []record `json:"records"`
+	}{make([]record, len(msgs))}
+	for i, msg := range msgs {
+		records.Records[i].Value = msg
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Post(p.endpoint, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status %d from %s", resp.StatusCode, p.endpoint)
+	}
+	return nil
+}
+
+func (p *kafkaRESTPublisher) close() {}
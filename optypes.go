@@ -0,0 +1,227 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+type opType uint8
+
+const (
+	UnknownOp opType = iota
+	CheckoutOp
+	CheckinOp
+	ResetOp
+	RestoreOp     // checkout carried over into a compacted log
+	CommitResetOp // reset because the DVID node was committed
+	MetaSetOp
+	MetaDeleteOp
+	MetaRestoreOp // metadata carried over into a compacted log
+	RevisionOp    // revision of a UUID carried over into a compacted log
+	ExpireOp      // checkout released because its lease ran out
+	PolicySetOp
+	PolicyRestoreOp // policy carried over into a compacted log
+	ConflictOp      // refused checkout of a label held by another client
+	ContextOpenOp   // client opened a work context
+	ContextCloseOp
+	ContextRestoreOp   // open work context carried over into a compacted log
+	SupersedeOp        // label superseded by another, e.g., after a merge
+	SupersedeRestoreOp // superseded label carried over into a compacted log
+	ClientRenameOp
+	ClientAliasRestoreOp // client renamed with history carried over into a compacted log
+	PinOp                // label locked against all checkouts, e.g., a published body
+	UnpinOp
+	PinRestoreOp // pinned label carried over into a compacted log
+	RenewOp      // checkout of a label already held by the client (see -recheckout)
+	ChainOp      // hash of the log segment a compacted log was made from
+	LabelResetOp // release of a set of labels regardless of holder
+	ViewSaveOp   // named query saved through POST /views
+	ViewDeleteOp
+	ViewRestoreOp    // saved view carried over into a compacted log
+	CommentOp        // note left on a label through POST /comments
+	CommentRestoreOp // comment carried over into a compacted log
+	FreezeSetOp      // scheduled freeze of a UUID set through /admin/freeze
+	FreezeDeleteOp
+	FreezeRestoreOp // freeze carried over into a compacted log
+	OpIDRestoreOp   // client-generated op id carried over into a compacted log
+	AssignRestoreOp // label reserved for an assignment task carried over into a compacted log
+)
+
+// LogLineVersion is the newest log line format this librarian reads.  Lines are written
+// without a version, which means version 1: "{Time} {UUID} {Op} {Label} {Client} {Attrs}".
+// A later format starts its lines with "v{N} " followed by the version 1 fields, putting
+// anything new in attributes, so older librarians can still read them during upgrades.
+const LogLineVersion = 1
+
+// RestoreOpSuffix ends the names of ops that only carry state into a compacted log.  Op
+// types unknown to this librarian with such names are kept out of history.
+const RestoreOpSuffix = "-restore"
+
+type opFlags uint8
+
+const (
+	opRestore  opFlags = 1 << iota // only carries state into a compacted log, so isn't history
+	opUUIDless                     // isn't about any uuid, so logged with the uuid "n/a"
+)
+
+type opTypeInfo struct {
+	name  string
+	flags opFlags
+}
+
+// knownOpTypes describes the op types this librarian can apply, indexed by type.  Names
+// are written to the log, so they must never change.
+var knownOpTypes = [...]opTypeInfo{
+	UnknownOp:            {"unknown-op", 0},
+	CheckoutOp:           {"checkout", 0},
+	CheckinOp:            {"checkin", 0},
+	ResetOp:              {"reset", 0},
+	RestoreOp:            {"restore", opRestore},
+	CommitResetOp:        {"reset-committed", 0},
+	MetaSetOp:            {"meta-set", 0},
+	MetaDeleteOp:         {"meta-delete", 0},
+	MetaRestoreOp:        {"meta-restore", opRestore},
+	RevisionOp:           {"revision", opRestore},
+	ExpireOp:             {"expire", 0},
+	PolicySetOp:          {"policy-set", 0},
+	PolicyRestoreOp:      {"policy-restore", opRestore},
+	ConflictOp:           {"conflict", 0},
+	ContextOpenOp:        {"context-open", opUUIDless},
+	ContextCloseOp:       {"context-close", opUUIDless},
+	ContextRestoreOp:     {"context-restore", opRestore | opUUIDless},
+	SupersedeOp:          {"supersede", 0},
+	SupersedeRestoreOp:   {"supersede-restore", opRestore},
+	ClientRenameOp:       {"rename-client", opUUIDless},
+	ClientAliasRestoreOp: {"client-alias-restore", opRestore | opUUIDless},
+	PinOp:                {"pin", 0},
+	UnpinOp:              {"unpin", 0},
+	PinRestoreOp:         {"pin-restore", opRestore},
+	RenewOp:              {"renew", 0},
+	ChainOp:              {"chain", opRestore | opUUIDless},
+	LabelResetOp:         {"reset-labels", 0},
+	ViewSaveOp:           {"view-save", opUUIDless},
+	ViewDeleteOp:         {"view-delete", opUUIDless},
+	ViewRestoreOp:        {"view-restore", opRestore | opUUIDless},
+	CommentOp:            {"comment", 0},
+	CommentRestoreOp:     {"comment-restore", opRestore},
+	FreezeSetOp:          {"freeze", 0},
+	FreezeDeleteOp:       {"unfreeze", 0},
+	FreezeRestoreOp:      {"freeze-restore", opRestore},
+	OpIDRestoreOp:        {"opid-restore", opRestore},
+	AssignRestoreOp:      {"assign-restore", opRestore},
+}
+
+// opTypes registers the op types found in logs written by newer librarians after the
+// known ones, so their ops keep their names in history and rewritten logs.
+var opTypes = struct {
+	sync.RWMutex
+	added  []opTypeInfo // types after the known ones
+	byName map[string]opType
+	warned map[int]bool // newer line versions warned about
+}{byName: knownOpTypesByName(), warned: make(map[int]bool)}
+
+func knownOpTypesByName() map[string]opType {
+	byName := make(map[string]opType, len(knownOpTypes))
+	for op, info := range knownOpTypes {
+		if opType(op) != UnknownOp {
+			byName[info.name] = opType(op)
+		}
+	}
+	return byName
+}
+
+func (op opType) info() opTypeInfo {
+	if int(op) < len(knownOpTypes) {
+		return knownOpTypes[op]
+	}
+	opTypes.RLock()
+	defer opTypes.RUnlock()
+	if i := int(op) - len(knownOpTypes); i < len(opTypes.added) {
+		return opTypes.added[i]
+	}
+	return knownOpTypes[UnknownOp]
+}
+
+func (op opType) String() string {
+	return op.info().name
+}
+
+// Returns the op type with a name, including those registered from the log, or UnknownOp.
+func opTypeFromString(s string) opType {
+	opTypes.RLock()
+	defer opTypes.RUnlock()
+	if op, found := opTypes.byName[s]; found {
+		return op
+	}
+	return UnknownOp
+}
+
+// Returns the op type of a name read from the log, registering names written by newer
+// librarians as new types.  Returns UnknownOp for names that aren't op names, e.g.,
+// corrupted bytes, or if no more types can be registered.
+func parseOpType(s string) opType {
+	if op := opTypeFromString(s); op != UnknownOp {
+		return op
+	}
+	if !validOpName(s) {
+		return UnknownOp
+	}
+	opTypes.Lock()
+	defer opTypes.Unlock()
+	if op, found := opTypes.byName[s]; found {
+		return op
+	}
+	n := len(knownOpTypes) + len(opTypes.added)
+	if n > int(^opType(0)) {
+		return UnknownOp
+	}
+	info := opTypeInfo{name: s}
+	if strings.HasSuffix(s, RestoreOpSuffix) {
+		info.flags |= opRestore
+	}
+	opTypes.added = append(opTypes.added, info)
+	opTypes.byName[s] = opType(n)
+	return opType(n)
+}
+
+// Returns true if s could be the name of an op: lowercase letters and '-', starting and
+// ending with a letter.
+func validOpName(s string) bool {
+	if s == "" || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if (s[i] < 'a' || s[i] > 'z') && s[i] != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Notes a log line in a format newer than LogLineVersion, warning once per version.
+func noteLineVersion(version int) {
+	opTypes.Lock()
+	defer opTypes.Unlock()
+	if !opTypes.warned[version] {
+		opTypes.warned[version] = true
+		log.Printf("WARNING: librarian log has version %d lines, newer than version %d read by this librarian, so only their version %d fields are used\n",
+			version, LogLineVersion, LogLineVersion)
+	}
+}
+
+// Returns true for ops that only carry state into a compacted log and are not part
+// of a UUID's history.
+func (op opType) restore() bool {
+	return op.info().flags&opRestore != 0
+}
+
+// Returns true for op types registered from a log written by a newer librarian.
+func (op opType) newer() bool {
+	return int(op) >= len(knownOpTypes)
+}
+
+// Returns true for ops that aren't about any uuid.  They are logged with the uuid "n/a".
+func (op opType) uuidless() bool {
+	return op.info().flags&opUUIDless != 0
+}
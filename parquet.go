@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A minimal writer of Parquet files (https://parquet.apache.org/docs/file-format/) with
+// required, non-nested columns, one gzipped PLAIN data page per column, and a single row
+// group, which is enough for DuckDB, Spark, and pandas to read exported history.
+
+// Parquet physical types.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+)
+
+// Parquet converted types.
+const (
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+	parquetUint64          = 14
+)
+
+const (
+	parquetMagic      = "PAR1"
+	parquetRequired   = 0 // field repetition type
+	parquetPlain      = 0 // encoding
+	parquetRLE        = 3 // encoding of levels, which required columns don't have
+	parquetGzip       = 2 // compression codec
+	parquetDataPage   = 0 // page type
+	parquetFileFormat = 1 // version in file metadata
+)
+
+// parquetColumn is a required column of PLAIN-encoded values.
+type parquetColumn struct {
+	name      string
+	ptype     int32
+	converted int32
+	values    bytes.Buffer
+	n         int
+}
+
+func newParquetColumn(name string, ptype, converted int32) *parquetColumn {
+	return &parquetColumn{name: name, ptype: ptype, converted: converted}
+}
+
+func (c *parquetColumn) addInt64(v int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	c.values.Write(b[:])
+	c.n++
+}
+
+func (c *parquetColumn) addString(s string) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(s)))
+	c.values.Write(b[:])
+	c.values.WriteString(s)
+	c.n++
+}
+
+func (c *parquetColumn) reset() {
+	c.values.Reset()
+	c.n = 0
+}
+
+// Writes a Parquet file of the given columns, which must all have the same number of values.
+func writeParquet(w io.Writer, columns []*parquetColumn, createdBy string) error {
+	rows := 0
+	if len(columns) > 0 {
+		rows = columns[0].n
+	}
+	type chunkT struct {
+		offset       int64
+		compressed   int64
+		uncompressed int64
+	}
+	chunks := make([]chunkT, len(columns))
+	var offset int64
+	n, err := io.WriteString(w, parquetMagic)
+	if err != nil {
+		return err
+	}
+	offset += int64(n)
+
+	for i, c := range columns {
+		if c.n != rows {
+			return fmt.Errorf("parquet column %q has %d values, not %d", c.name, c.n, rows)
+		}
+		var page bytes.Buffer
+		zw := gzip.NewWriter(&page)
+		if _, err := zw.Write(c.values.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		var t thriftWriter
+		t.i32(1, parquetDataPage)
+		t.i32(2, int32(c.values.Len()))
+		t.i32(3, int32(page.Len()))
+		t.beginStruct(5) // data page header
+		t.i32(1, int32(rows))
+		t.i32(2, parquetPlain)
+		t.i32(3, parquetRLE)
+		t.i32(4, parquetRLE)
+		t.endStruct()
+		t.stop()
+
+		chunks[i] = chunkT{
+			offset:       offset,
+			compressed:   int64(t.buf.Len() + page.Len()),
+			uncompressed: int64(t.buf.Len() + c.values.Len()),
+		}
+		for _, b := range [][]byte{t.buf.Bytes(), page.Bytes()} {
+			n, err := w.Write(b)
+			if err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+	}
+
+	// File metadata
+	var t thriftWriter
+	t.i32(1, parquetFileFormat)
+	t.list(2, thriftStruct, len(columns)+1)
+	t.beginElem()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(columns)))
+	t.endStruct()
+	for _, c := range columns {
+		t.beginElem()
+		t.i32(1, c.ptype)
+		t.i32(3, parquetRequired)
+		t.binary(4, c.name)
+		t.i32(6, c.converted)
+		t.endStruct()
+	}
+	t.i64(3, int64(rows))
+	t.list(4, thriftStruct, 1)
+	t.beginElem() // row group
+	t.list(1, thriftStruct, len(columns))
+	var total int64
+	for i, c := range columns {
+		chunk := chunks[i]
+		total += chunk.uncompressed
+		t.beginElem() // column chunk
+		t.i64(2, chunk.offset)
+		t.beginStruct(3) // column metadata
+		t.i32(1, c.ptype)
+		t.list(2, thriftI32, 1)
+		t.varint(parquetPlain)
+		t.list(3, thriftBinary, 1)
+		t.str(c.name)
+		t.i32(4, parquetGzip)
+		t.i64(5, int64(rows))
+		t.i64(6, chunk.uncompressed)
+		t.i64(7, chunk.compressed)
+		t.i64(9, chunk.offset)
+		t.endStruct()
+		t.endStruct()
+	}
+	t.i64(2, total)
+	t.i64(3, int64(rows))
+	t.endStruct()
+	t.binary(6, createdBy)
+	t.stop()
+
+	var footer [4]byte
+	binary.LittleEndian.PutUint32(footer[:], uint32(t.buf.Len()))
+	for _, b := range [][]byte{t.buf.Bytes(), footer[:], []byte(parquetMagic)} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Thrift compact protocol types used by Parquet metadata.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes Thrift structs with the compact protocol.
+type thriftWriter struct {
+	buf   bytes.Buffer
+	last  int16   // id of the last field written in the current struct
+	outer []int16 // last field ids of enclosing structs
+}
+
+func (t *thriftWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v) // zigzag
+	t.buf.Write(b[:n])
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	t.buf.Write(b[:n])
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) str(s string) {
+	t.uvarint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.str(s)
+}
+
+// Starts a list field whose n elements are written next.
+func (t *thriftWriter) list(id int16, elemType byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.uvarint(uint64(n))
+	}
+}
+
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginElem()
+}
+
+// Starts a struct that is a list element.
+func (t *thriftWriter) beginElem() {
+	t.outer = append(t.outer, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.last = t.outer[len(t.outer)-1]
+	t.outer = t.outer[:len(t.outer)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MaxPinReasonLength is the longest reason for pinning a label in bytes.
+const MaxPinReasonLength = 256
+
+// PinnedCode is the error code of a checkout refused because its label is pinned.
+const PinnedCode = "PINNED"
+
+// pinT records why and by whom a label was pinned, i.e., locked against all checkouts.
+type pinT struct {
+	reason string
+	client string
+	t      time.Time
+}
+
+type pinJSON struct {
+	Reason string
+	Client string // who pinned the label
+	Since  time.Time
+}
+
+type pinnedLabelJSON struct {
+	Label labelJSON
+	pinJSON
+}
+
+type pinnedListJSON struct {
+	UUID   string
+	Pinned []pinnedLabelJSON
+}
+
+// pinnedError is returned for a checkout of a pinned label.
+type pinnedError struct {
+	uuid   string
+	label  uint64
+	reason string
+}
+
+func (e *pinnedError) Error() string {
+	if e.reason == "" {
+		return fmt.Sprintf("uuid %s, label %d - pinned", e.uuid, e.label)
+	}
+	return fmt.Sprintf("uuid %s, label %d - pinned (%s)", e.uuid, e.label, e.reason)
+}
+
+// Returns an error if the label is pinned.  Must be called with library lock held.
+func (lib *libraryT) checkPinned(uuid string, label uint64) error {
+	if pin, found := lib.pins[uuid][label]; found {
+		return &pinnedError{uuid, label, pin.reason}
+	}
+	return nil
+}
+
+// Pins a label so it can't be checked out, e.g., because its body was published.  Any
+// current checkout is left for its holder to check in.
+func pinLabel(uuid string, label uint64, reason, clientid string, attrs map[string]string) (pinnedLabelJSON, error) {
+	if len(reason) > MaxPinReasonLength {
+		return pinnedLabelJSON{}, fmt.Errorf("pin reason is over %d bytes", MaxPinReasonLength)
+	}
+	format := getPolicy(uuid).LabelOutput
+	t := clock.Now()
+
+	library.Lock()
+	defer library.Unlock()
+	if err := library.setPin(PinOp, t, uuid, label, reason, clientid, attrs, true); err != nil {
+		return pinnedLabelJSON{}, err
+	}
+	return pinnedLabelJSON{labelJSON{label, format}, pinJSON{reason, clientid, t}}, nil
+}
+
+// Sets a label's pin, e.g., when replaying the log.  Must be called with library lock held.
+func (lib *libraryT) setPin(opT opType, t time.Time, uuid string, label uint64, reason, clientid string, attrs map[string]string, modifyLog bool) error {
+	m, found := lib.pins[uuid]
+	if !found {
+		m = make(map[uint64]pinT)
+		lib.pins[uuid] = m
+	}
+	prev, prevFound := m[label]
+	m[label] = pinT{reason, clientid, t}
+	lib.bumpRevision(uuid)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     opT,
+			uuid:   uuid,
+			label:  label,
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"reason": reason}),
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the pin so state matches the log.
+			if prevFound {
+				m[label] = prev
+			} else if delete(m, label); len(m) == 0 {
+				delete(lib.pins, uuid)
+			}
+			lib.unbumpRevision(uuid)
+			return err
+		}
+	}
+	return nil
+}
+
+func unpinLabel(uuid string, label uint64, clientid string, attrs map[string]string) error {
+	return unpinAt(clock.Now(), uuid, label, clientid, attrs, true)
+}
+
+// Unpins a label as of time t, which is the op time when replaying the log.
+func unpinAt(t time.Time, uuid string, label uint64, clientid string, attrs map[string]string, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+
+	return library.unpin(t, uuid, label, clientid, attrs, modifyLog)
+}
+
+// Unpins a label as of time t.  Must be called with library lock held.
+func (lib *libraryT) unpin(t time.Time, uuid string, label uint64, clientid string, attrs map[string]string, modifyLog bool) error {
+	pin, found := lib.pins[uuid][label]
+	if !found {
+		return fmt.Errorf("uuid %s, label %d is not pinned", uuid, label)
+	}
+	delete(lib.pins[uuid], label)
+	if len(lib.pins[uuid]) == 0 {
+		delete(lib.pins, uuid)
+	}
+	lib.bumpRevision(uuid)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     UnpinOp,
+			uuid:   uuid,
+			label:  label,
+			client: clientid,
+			attrs:  attrs,
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the unpin so state matches the log.
+			if lib.pins[uuid] == nil {
+				lib.pins[uuid] = make(map[uint64]pinT)
+			}
+			lib.pins[uuid][label] = pin
+			lib.unbumpRevision(uuid)
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies a pin read from the log.
+func restorePin(op *libraryOp) {
+	library.Lock()
+	defer library.Unlock()
+	library.setPin(op.op, op.t, op.uuid, op.label, op.attrs["reason"], op.client, op.attrs, false)
+}
+
+// Returns the pin of a label, if any.
+func getPin(uuid string, label uint64) (pinJSON, bool) {
+	pin, found := getView(uuid).pins[label]
+	if !found {
+		return pinJSON{}, false
+	}
+	return pinJSON{pin.reason, pin.client, pin.t}, true
+}
+
+// Returns the pinned labels of a uuid sorted by label.
+func getPins(uuid string) []pinnedLabelJSON {
+	view := getView(uuid)
+	pins := make([]pinnedLabelJSON, 0, len(view.pins))
+	for label, pin := range view.pins {
+		pins = append(pins, pinnedLabelJSON{labelJSON{label, view.format}, pinJSON{pin.reason, pin.client, pin.t}})
+	}
+
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Label.label < pins[j].Label.label })
+	return pins
+}
+
+// Writes all pinned labels into a compacted log.  Must be called with library lock held.
+func (lib *libraryT) writePinRestores() error {
+	for uuid, m := range lib.pins {
+		for label, pin := range m {
+			op := &libraryOp{
+				t:      pin.t,
+				op:     PinRestoreOp,
+				uuid:   uuid,
+				label:  label,
+				client: pin.client,
+				attrs:  map[string]string{"reason": pin.reason},
+			}
+			if err := lib.write(op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
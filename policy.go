@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// policyJSON holds per-UUID rules applied to checkouts and resets.  Zero values mean
+// no restriction, so UUIDs without a policy behave as they always have.
+type policyJSON struct {
+	// Default lease for new checkouts, e.g., "24h".  Empty means checkouts never expire.
+	TTL string `json:",omitempty"`
+
+	// Maximum number of labels a client can have checked out at once.  0 is unlimited.
+	MaxCheckoutsPerClient int
+
+	// Quotas on the labels checked out at once and the bytes of the UUID's ops in the
+	// current librarian log.  0 is unlimited.
+	MaxCheckouts int   `json:",omitempty"`
+	MaxLogBytes  int64 `json:",omitempty"`
+
+	// If true, PUT /reset is refused with a 403 status.
+	DisallowReset bool
+
+	// Label formats accepted in URLs, e.g., ["hex", "seg:"].  Empty accepts decimal and hex.
+	LabelFormats []string `json:",omitempty"`
+
+	// Format of labels in JSON responses.  Empty is decimal.
+	LabelOutput string `json:",omitempty"`
+
+	// Time after a lease runs out during which only the holder can renew it, e.g., "10m".
+	GracePeriod string `json:",omitempty"`
+
+	// How long before a lease runs out to send a "lease-expiring" event.  Empty is 5m.
+	ExpiryWarning string `json:",omitempty"`
+
+	// Time without activity by a client after which its checkouts are released, e.g., "8h".
+	// Empty means checkouts are never released for inactivity.
+	InactivityCheckin string `json:",omitempty"`
+}
+
+// DefaultExpiryWarning is used for policies without an ExpiryWarning.
+const DefaultExpiryWarning = 5 * time.Minute
+
+// Durations are validated in parsePolicy.
+func (p *policyJSON) ttl() time.Duration {
+	if p == nil || p.TTL == "" {
+		return 0
+	}
+	ttl, _ := time.ParseDuration(p.TTL)
+	return ttl
+}
+
+func (p *policyJSON) labelOutput() string {
+	if p == nil {
+		return ""
+	}
+	return p.LabelOutput
+}
+
+func (p *policyJSON) grace() time.Duration {
+	if p == nil || p.GracePeriod == "" {
+		return 0
+	}
+	grace, _ := time.ParseDuration(p.GracePeriod)
+	return grace
+}
+
+func (p *policyJSON) expiryWarning() time.Duration {
+	if p == nil || p.ExpiryWarning == "" {
+		return DefaultExpiryWarning
+	}
+	warning, _ := time.ParseDuration(p.ExpiryWarning)
+	return warning
+}
+
+func (p *policyJSON) inactivityCheckin() time.Duration {
+	if p == nil || p.InactivityCheckin == "" {
+		return 0
+	}
+	limit, _ := time.ParseDuration(p.InactivityCheckin)
+	return limit
+}
+
+func parsePolicy(policyStr string) (*policyJSON, error) {
+	var policy policyJSON
+	if err := json.Unmarshal([]byte(policyStr), &policy); err != nil {
+		return nil, fmt.Errorf("bad policy JSON: %v", err)
+	}
+	if policy.TTL != "" {
+		ttl, err := time.ParseDuration(policy.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("bad policy TTL %q: %v", policy.TTL, err)
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("policy TTL must be positive, not %q", policy.TTL)
+		}
+	}
+	if policy.InactivityCheckin != "" {
+		if limit, err := time.ParseDuration(policy.InactivityCheckin); err != nil || limit <= 0 {
+			return nil, fmt.Errorf("bad policy InactivityCheckin %q: must be a positive duration", policy.InactivityCheckin)
+		}
+	}
+	for name, d := range map[string]string{"GracePeriod": policy.GracePeriod, "ExpiryWarning": policy.ExpiryWarning} {
+		if d == "" {
+			continue
+		}
+		if dur, err := time.ParseDuration(d); err != nil || dur < 0 {
+			return nil, fmt.Errorf("bad policy %s %q: must be a non-negative duration", name, d)
+		}
+	}
+	if policy.MaxCheckoutsPerClient < 0 {
+		return nil, fmt.Errorf("policy MaxCheckoutsPerClient cannot be negative")
+	}
+	if policy.MaxCheckouts < 0 || policy.MaxLogBytes < 0 {
+		return nil, fmt.Errorf("policy MaxCheckouts and MaxLogBytes cannot be negative")
+	}
+	for _, format := range policy.LabelFormats {
+		if err := checkLabelFormat(format); err != nil {
+			return nil, fmt.Errorf("bad policy LabelFormats: %v", err)
+		}
+	}
+	if policy.LabelOutput != "" {
+		if err := checkLabelFormat(policy.LabelOutput); err != nil {
+			return nil, fmt.Errorf("bad policy LabelOutput: %v", err)
+		}
+	}
+	return &policy, nil
+}
+
+// Sets the policy for a uuid from JSON.
+func setPolicy(uuid, policyStr, clientid string, attrs map[string]string, modifyLog bool) error {
+	policy, err := parsePolicy(policyStr)
+	if err != nil {
+		return err
+	}
+	library.Lock()
+	defer library.Unlock()
+
+	return library.setPolicy(uuid, policy, clientid, attrs, modifyLog)
+}
+
+// Sets the policy for a uuid.  Must be called with library lock held.
+func (lib *libraryT) setPolicy(uuid string, policy *policyJSON, clientid string, attrs map[string]string, modifyLog bool) error {
+	normalized, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	if modifyLog {
+		if err := lib.checkOpID(PolicySetOp, uuid, 0, clientid, "", attrs); err != nil {
+			return err
+		}
+	}
+	prev, prevFound := lib.policies[uuid]
+	lib.policies[uuid] = policy
+	lib.bumpRevision(uuid)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			op:     PolicySetOp,
+			uuid:   uuid,
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"policy": string(normalized)}),
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the policy so state matches the log.
+			if prevFound {
+				lib.policies[uuid] = prev
+			} else {
+				delete(lib.policies, uuid)
+			}
+			lib.unbumpRevision(uuid)
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the policy for a uuid.  UUIDs without a set policy get the unrestricted default.
+func getPolicy(uuid string) *policyJSON {
+	library.RLock()
+	defer library.RUnlock()
+
+	if policy, found := library.policies[uuid]; found {
+		return policy
+	}
+	return &policyJSON{}
+}
+
+// policyError is returned for a checkout that would give a client more checkouts of a
+// uuid than the MaxCheckoutsPerClient of its policy.
+type policyError struct {
+	uuid   string
+	client string
+	held   int // checkouts the client already has
+	adding int // labels requested that the client doesn't hold
+}
+
+func (e *policyError) Error() string {
+	if e.adding == 1 {
+		return fmt.Sprintf("client %s already has %d checkouts on uuid %s, the maximum allowed by policy", e.client, e.held, e.uuid)
+	}
+	return fmt.Sprintf("client %s has %d checkouts on uuid %s, so %d more would exceed the maximum allowed by policy", e.client, e.held, e.uuid, e.adding)
+}
+
+// Returns an error if checking out the labels of a uuid would give the client more
+// checkouts than the uuid's policy allows.  Labels the client already holds are renewals,
+// which are always allowed.  Must be called with library lock held, in the same locked
+// section as the checkouts so concurrent checkouts can't both take the last one allowed.
+func (lib *libraryT) checkCheckoutPolicy(uuid, clientid string, labels []uint64) error {
+	policy := lib.policies[uuid]
+	if policy == nil || policy.MaxCheckoutsPerClient == 0 {
+		return nil
+	}
+	adding := 0
+	for _, label := range labels {
+		if co, found := lib.vchk[uuid][label]; !found || co.client != clientid {
+			adding++
+		}
+	}
+	if adding == 0 {
+		return nil
+	}
+	held := 0
+	for _, co := range lib.vchk[uuid] {
+		if co.client == clientid {
+			held++
+		}
+	}
+	if held+adding > policy.MaxCheckoutsPerClient {
+		return &policyError{uuid, clientid, held, adding}
+	}
+	return nil
+}
+
+// Parses a lease requested for a checkout, which can be shorter but not longer than
+// the uuid's policy TTL.
+func requestedTTL(uuid, ttlStr string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(ttlStr)
+	if err != nil {
+		return 0, fmt.Errorf("bad TTL %q: %v", ttlStr, err)
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("TTL must be positive, not %q", ttlStr)
+	}
+	if max := getPolicy(uuid).ttl(); max > 0 && ttl > max {
+		return 0, fmt.Errorf("TTL %q exceeds the policy TTL %s for uuid %s", ttlStr, max, uuid)
+	}
+	return ttl, nil
+}
+
+// Returns the op attributes for a new checkout, adding an expiration if a TTL is
+// given or the uuid's policy has a TTL.
+func checkoutAttrs(uuid string, ttl time.Duration, attrs map[string]string) map[string]string {
+	library.RLock()
+	defer library.RUnlock()
+	return library.checkoutAttrs(clock.Now(), uuid, ttl, attrs)
+}
+
+// Returns the op attributes for a checkout at time t.  Must be called with library lock held.
+func (lib *libraryT) checkoutAttrs(t time.Time, uuid string, ttl time.Duration, attrs map[string]string) map[string]string {
+	if ttl == 0 {
+		ttl = lib.policies[uuid].ttl()
+	}
+	if ttl > 0 {
+		expires, err := t.Add(ttl).UTC().MarshalText()
+		if err == nil {
+			attrs = mergeAttrs(attrs, map[string]string{"expires": string(expires)})
+		}
+	}
+	return attrs
+}
+
+// Writes all policies into a compacted log.  Must be called with library lock held.
+func (lib *libraryT) writePolicyRestores() error {
+	for uuid, policy := range lib.policies {
+		policyBytes, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		op := &libraryOp{
+			op:     PolicyRestoreOp,
+			uuid:   uuid,
+			client: "n/a",
+			attrs:  map[string]string{"policy": string(policyBytes)},
+		}
+		if err := lib.write(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Releases a checkout whose lease and grace period have run out.  Must be called with
+// library lock held.
+func (lib *libraryT) expire(t time.Time, uuid string, label uint64, modifyLog bool) error {
+	co, found := lib.vchk[uuid][label]
+	if !found {
+		return nil
+	}
+	delete(lib.vchk[uuid], label)
+	lib.bumpRevision(uuid)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     ExpireOp,
+			uuid:   uuid,
+			label:  label,
+			client: co.client,
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the release so state matches the log.
+			lib.vchk[uuid][label] = co
+			lib.unbumpRevision(uuid)
+			return err
+		}
+		log.Printf("Checkout of uuid %s, label %d by %s expired\n", uuid, label, co.client)
+		publishEvent(LeaseExpiredEvent, uuid, labelJSON{label, lib.policies[uuid].labelOutput()}, co)
+	}
+	return nil
+}
+
+func expireAt(t time.Time, uuid string, label uint64, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+
+	return library.expire(t, uuid, label, modifyLog)
+}
+
+// Releases all checkouts whose leases and grace periods have run out or whose holders
+// have been inactive too long, and warns holders of checkouts that will soon be released.
+func expireLocks() {
+	if inMaintenance() {
+		return
+	}
+	library.Lock()
+	defer library.Unlock()
+
+	now := clock.Now()
+	for uuid, checkouts := range library.vchk {
+		policy := library.policies[uuid]
+		for label, co := range checkouts {
+			switch {
+			case co.expired(now, policy.grace()):
+				if err := library.expire(now, uuid, label, true); err != nil {
+					log.Printf("ERROR: unable to expire checkout of uuid %s, label %d: %v\n", uuid, label, err)
+				}
+				continue
+			case !co.warned && !co.expires.IsZero() && co.expires.Sub(now) <= policy.expiryWarning():
+				co.warned = true
+				checkouts[label] = co
+				publishEvent(LeaseExpiringEvent, uuid, labelJSON{label, policy.labelOutput()}, co)
+			}
+			library.checkInactivity(now, uuid, label, policy)
+		}
+	}
+}
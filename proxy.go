@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// ProxyCacheTTL is how long responses from the -proxymisses server are reused.
+	ProxyCacheTTL = 10 * time.Second
+
+	// ProxiedHeader is the response header that is "miss" for a read forwarded to the
+	// -proxymisses server and "hit" for one answered from the cache of its responses.
+	ProxiedHeader = "X-Librarian-Proxied"
+
+	// Largest proxied response body that is cached, and most cached responses.
+	proxyCacheMaxBody    = 1 << 20
+	proxyCacheMaxEntries = 1000
+)
+
+var proxyClient = &http.Client{Timeout: dvidTimeout}
+
+// Headers copied from proxied requests and responses.
+var (
+	proxyRequestHeaders  = []string{"Accept", "Authorization", "User-Agent", "X-Tool-Version"}
+	proxyResponseHeaders = []string{"Content-Type", "Retry-After", UUIDKnownHeader}
+)
+
+type proxyResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+var proxyMisses = struct {
+	sync.Mutex
+	server string
+	cache  map[string]*proxyResponse
+}{}
+
+// Forwards reads of uuids this server doesn't know to another librarian.
+func initProxyMisses(server string) error {
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad -proxymisses %q: must be a URL like \"http://central:8000\"", server)
+	}
+	proxyMisses.Lock()
+	proxyMisses.server = strings.TrimSuffix(server, "/")
+	proxyMisses.cache = make(map[string]*proxyResponse)
+	proxyMisses.Unlock()
+
+	log.Printf("Forwarding reads of unknown UUIDs to %s\n", server)
+	return nil
+}
+
+// Returns the uuid of a GET request that reads a uuid's state or history, or "" for
+// other requests.
+func proxiedUUID(r *http.Request) string {
+	if r.Method != "GET" {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	switch parts[0] {
+	case "checkout":
+		if len(parts) == 3 {
+			return parts[1]
+		}
+	case "history", "diff", "state":
+		if len(parts) == 2 {
+			return parts[1]
+		}
+	case "meta":
+		if len(parts) <= 3 {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// proxyMissHandler answers reads of uuids with no local history from the -proxymisses
+// server, caching its responses briefly.
+func proxyMissHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		proxyMisses.Lock()
+		server := proxyMisses.server
+		proxyMisses.Unlock()
+
+		if server == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if uuid := proxiedUUID(r); uuid == "" || knownUUID(uuid) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		key := r.URL.RequestURI() + "\n" + r.Header.Get("Accept") + "\n" + r.Header.Get("Authorization")
+		if resp := getProxyCache(key); resp != nil {
+			resp.write(w, "hit")
+			return
+		}
+		resp, err := forwardRead(server, r)
+		if err != nil {
+			log.Printf("ERROR: unable to forward %s to %s: %v\n", r.URL.Path, server, err)
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("unable to reach %s for unknown uuid: %v", server, err))
+			return
+		}
+		if resp.status == http.StatusOK || resp.status == http.StatusNotFound {
+			putProxyCache(key, resp)
+		}
+		resp.write(w, "miss")
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Forwards a read to the -proxymisses server and reads its response.
+func forwardRead(server string, r *http.Request) (*proxyResponse, error) {
+	req, err := http.NewRequest("GET", server+r.URL.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range proxyRequestHeaders {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, resp.Body); err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	for _, name := range proxyResponseHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	return &proxyResponse{resp.StatusCode, header, body.Bytes(), time.Now().Add(ProxyCacheTTL)}, nil
+}
+
+func (resp *proxyResponse) write(w http.ResponseWriter, proxied string) {
+	for name, values := range resp.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(ProxiedHeader, proxied)
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+func getProxyCache(key string) *proxyResponse {
+	proxyMisses.Lock()
+	defer proxyMisses.Unlock()
+
+	resp, found := proxyMisses.cache[key]
+	if !found {
+		return nil
+	}
+	if time.Now().After(resp.expires) {
+		delete(proxyMisses.cache, key)
+		return nil
+	}
+	return resp
+}
+
+// Caches a response unless it is too large or the cache is full of unexpired responses.
+func putProxyCache(key string, resp *proxyResponse) {
+	if len(resp.body) > proxyCacheMaxBody {
+		return
+	}
+	proxyMisses.Lock()
+	defer proxyMisses.Unlock()
+
+	if len(proxyMisses.cache) >= proxyCacheMaxEntries {
+		now := time.Now()
+		for k, cached := range proxyMisses.cache {
+			if now.After(cached.expires) {
+				delete(proxyMisses.cache, k)
+			}
+		}
+		if len(proxyMisses.cache) >= proxyCacheMaxEntries {
+			return
+		}
+	}
+	proxyMisses.cache[key] = resp
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// QuotaExceededCode is the error code of checkouts refused because a UUID is at its
+// MaxCheckouts or MaxLogBytes policy quota.
+const QuotaExceededCode = "QUOTA_EXCEEDED"
+
+// QuotaWarningFraction is the fraction of a quota at which a warning is logged.
+const QuotaWarningFraction = 0.9
+
+// Quota levels of a UUID.
+const (
+	QuotaOK       = "ok"
+	QuotaWarning  = "warning"
+	QuotaExceeded = "exceeded"
+)
+
+// Levels of UUIDs that are near or at a quota, for alerting.
+var quotaLevelVar = expvar.NewMap("librarian_quota_levels")
+
+// quotaJSON is the usage of a UUID with quotas, listed by GET /admin/storage.
+type quotaJSON struct {
+	UUID         string
+	Checkouts    int
+	MaxCheckouts int `json:",omitempty"`
+	LogBytes     int64
+	MaxLogBytes  int64 `json:",omitempty"`
+	Level        string
+}
+
+// Returns the quota level of a uuid and a description of the quota that set it.  Must be
+// called with library lock held.
+func (lib *libraryT) quotaLevel(uuid string) (level, reason string) {
+	policy := lib.policies[uuid]
+	if policy == nil {
+		return QuotaOK, ""
+	}
+	level = QuotaOK
+	if max := policy.MaxCheckouts; max > 0 {
+		n := len(lib.vchk[uuid])
+		switch {
+		case n >= max:
+			return QuotaExceeded, fmt.Sprintf("%d checkouts, the MaxCheckouts quota", n)
+		case float64(n) >= QuotaWarningFraction*float64(max):
+			level, reason = QuotaWarning, fmt.Sprintf("%d of %d checkouts allowed", n, max)
+		}
+	}
+	if max := policy.MaxLogBytes; max > 0 {
+		n := lib.uuidBytes[uuid]
+		switch {
+		case n >= max:
+			return QuotaExceeded, fmt.Sprintf("%d bytes of ops in the librarian log, over the MaxLogBytes quota of %d", n, max)
+		case float64(n) >= QuotaWarningFraction*float64(max):
+			level, reason = QuotaWarning, fmt.Sprintf("%d of %d bytes of ops allowed in the librarian log", n, max)
+		}
+	}
+	return level, reason
+}
+
+// Logs a change in a uuid's quota level.  Must be called with library lock held.
+func (lib *libraryT) checkQuota(uuid string) {
+	if lib.compacting {
+		return
+	}
+	level, reason := lib.quotaLevel(uuid)
+	prev, found := lib.quotaLevels[uuid]
+	if !found {
+		prev = QuotaOK
+	}
+	if level == prev {
+		return
+	}
+	if level == QuotaOK {
+		delete(lib.quotaLevels, uuid)
+		quotaLevelVar.Delete(uuid)
+		log.Printf("Uuid %s is back under its quotas\n", uuid)
+		return
+	}
+	lib.quotaLevels[uuid] = level
+	quotaLevelVar.Set(uuid, stringVar(level))
+	if level == QuotaExceeded {
+		log.Printf("WARNING: uuid %s has %s, so new checkouts are refused\n", uuid, reason)
+	} else {
+		log.Printf("WARNING: uuid %s is near its quota with %s\n", uuid, reason)
+	}
+}
+
+// Rechecks the quota levels of all uuids with quotas, e.g., after compaction.  Must be
+// called with library lock held.
+func (lib *libraryT) checkQuotas() {
+	for uuid := range lib.policies {
+		lib.checkQuota(uuid)
+	}
+}
+
+func stringVar(s string) *expvar.String {
+	v := new(expvar.String)
+	v.Set(s)
+	return v
+}
+
+// quotaError refuses checkouts that would go over a uuid's quotas.
+type quotaError struct {
+	status int // 429 for MaxCheckouts and 507 for MaxLogBytes
+	msg    string
+}
+
+func (e *quotaError) Error() string {
+	return e.msg
+}
+
+// Returns a *quotaError if checking out labels of a uuid would go over the uuid's quotas.
+// Checkouts of labels the client already holds are allowed so leases can be renewed.
+// Must be called with library lock held, in the same locked section as the checkouts.
+func (lib *libraryT) checkCheckoutQuota(uuid, clientid string, labels []uint64) error {
+	policy := lib.policies[uuid]
+	if policy == nil || (policy.MaxCheckouts == 0 && policy.MaxLogBytes == 0) {
+		return nil
+	}
+	adding := 0
+	for _, label := range labels {
+		if co, found := lib.vchk[uuid][label]; !found || co.client != clientid {
+			adding++
+		}
+	}
+	if adding == 0 {
+		return nil
+	}
+	if n := len(lib.vchk[uuid]); policy.MaxCheckouts > 0 && n+adding > policy.MaxCheckouts {
+		if adding == 1 {
+			return &quotaError{http.StatusTooManyRequests, fmt.Sprintf("uuid %s already has %d checkouts, its MaxCheckouts quota", uuid, n)}
+		}
+		return &quotaError{http.StatusTooManyRequests, fmt.Sprintf("uuid %s has %d checkouts, so %d more would exceed its MaxCheckouts quota of %d", uuid, n, adding, policy.MaxCheckouts)}
+	}
+	if n := lib.uuidBytes[uuid]; policy.MaxLogBytes > 0 && n >= policy.MaxLogBytes {
+		return &quotaError{http.StatusInsufficientStorage, fmt.Sprintf("uuid %s has %d bytes of ops in the librarian log, over its MaxLogBytes quota of %d", uuid, n, policy.MaxLogBytes)}
+	}
+	return nil
+}
+
+// Returns the usage of uuids with quotas, sorted by uuid.
+func getQuotas() []quotaJSON {
+	library.RLock()
+	var quotas []quotaJSON
+	for uuid, policy := range library.policies {
+		if policy.MaxCheckouts == 0 && policy.MaxLogBytes == 0 {
+			continue
+		}
+		level, _ := library.quotaLevel(uuid)
+		quotas = append(quotas, quotaJSON{
+			UUID:         uuid,
+			Checkouts:    len(library.vchk[uuid]),
+			MaxCheckouts: policy.MaxCheckouts,
+			LogBytes:     library.uuidBytes[uuid],
+			MaxLogBytes:  policy.MaxLogBytes,
+			Level:        level,
+		})
+	}
+	library.RUnlock()
+
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].UUID < quotas[j].UUID })
+	return quotas
+}
+
+// Adds up the bytes of each uuid's ops in the first size bytes of a log, which a state db
+// load skips.
+func countLogBytes(fname string, size int64) (map[string]int64, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	counts := make(map[string]int64)
+	r := bufio.NewReader(io.LimitReader(f, size))
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fields := strings.SplitN(line, " ", 3); len(fields) == 3 {
+			counts[fields[1]] += int64(len(line))
+		}
+	}
+	return counts, nil
+}
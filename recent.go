@@ -0,0 +1,75 @@
+package main
+
+import "time"
+
+// RecentHistorySize is the number of most recent history ops kept in memory for each uuid
+// so GET /history/{UUID}?limit=N doesn't read the log when N is at most this size.
+const RecentHistorySize = 100
+
+// recentOpsT is a ring buffer of a uuid's most recent history ops.
+type recentOpsT struct {
+	ops   []*libraryOp
+	next  int // index of the oldest op once the buffer is full
+	total int // number of ops ever added
+}
+
+func (ro *recentOpsT) add(op *libraryOp) {
+	if len(ro.ops) < RecentHistorySize {
+		ro.ops = append(ro.ops, op)
+	} else {
+		ro.ops[ro.next] = op
+		ro.next = (ro.next + 1) % RecentHistorySize
+	}
+	ro.total++
+}
+
+// Returns up to the last n ops, oldest first.
+func (ro *recentOpsT) last(n int) []*libraryOp {
+	if n > len(ro.ops) {
+		n = len(ro.ops)
+	}
+	ops := make([]*libraryOp, 0, n)
+	for i := len(ro.ops) - n; i < len(ro.ops); i++ {
+		ops = append(ops, ro.ops[(ro.next+i)%len(ro.ops)])
+	}
+	return ops
+}
+
+// Adds an op done at time t to its uuid's recent history.  Must be called with library
+// lock held.
+func (lib *libraryT) noteRecent(op *libraryOp, t time.Time) {
+	if op.op.restore() || op.op.uuidless() {
+		return
+	}
+	ro, found := lib.recent[op.uuid]
+	if !found {
+		ro = &recentOpsT{}
+		lib.recent[op.uuid] = ro
+	}
+	recentOp := *op
+	recentOp.t = t
+	ro.add(&recentOp)
+	noteCachedHx(&recentOp)
+}
+
+// Returns the last limit history ops of a uuid if they are all in memory.
+func recentHx(uuid string, limit int) ([]*libraryOp, bool) {
+	if limit <= 0 || limit > RecentHistorySize {
+		return nil, false
+	}
+	library.RLock()
+	defer library.RUnlock()
+
+	ro, found := library.recent[uuid]
+	if !found {
+		return nil, library.recentComplete
+	}
+	if len(ro.ops) >= limit || (library.recentComplete && ro.total == len(ro.ops)) {
+		ops := ro.last(limit)
+		for i, op := range ops {
+			ops[i] = library.aliases.apply(op)
+		}
+		return ops, true
+	}
+	return nil, false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"unicode"
+
+	"github.com/zenazn/goji/web"
+)
+
+const (
+	// OpRefHeader is the optional request header with an external reference for an op,
+	// e.g., a DVID mutation id or a task URL, which is stored in the librarian log and shown
+	// in history so the op can be traced to what it was done for.
+	OpRefHeader = "X-Op-Ref"
+
+	// MaxOpRefLength is the maximum length in bytes of an op reference.
+	MaxOpRefLength = 512
+)
+
+// Returns an error if an op reference is too long or has control characters.
+func checkOpRef(ref string) error {
+	if len(ref) > MaxOpRefLength {
+		return fmt.Errorf("op reference is over %d bytes", MaxOpRefLength)
+	}
+	for _, r := range ref {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("op reference %q has control characters", ref)
+		}
+	}
+	return nil
+}
+
+// Middleware that refuses requests with a bad X-Op-Ref header.
+func opRefHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if ref := r.Header.Get(OpRefHeader); ref != "" {
+			if err := checkOpRef(ref); err != nil {
+				BadRequest(w, r, "bad %s header: %v", OpRefHeader, err)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Options that POST /admin/reload and SIGHUP apply without restarting the server.
+var reloadableOptions = map[string]bool{
+	"admintokenfile": true,
+	"jwtsecretfile":  true,
+	"jwks":           true,
+	"jwtaudience":    true,
+	"jwtgroupsclaim": true,
+	"jwtroles":       true,
+	"digestemail":    true,
+	"digestfrom":     true,
+	"smtp":           true,
+	"digestwebhook":  true,
+	"digesthour":     true,
+	"dailyclear":     true,
+	"maxmemory":      true,
+	"backup":         true,
+	"maintenancemsg": true,
+	"maxinflight":    true,
+	"loginwebhook":   true,
+	"remindwebhook":  true,
+	"remindemail":    true,
+	"notifyhosts":    true,
+	"verbose":        true,
+	"assets":         true,
+	"historycache":   true,
+}
+
+var (
+	// Guards reloadable options.  Code that reads them after startup holds it for reading.
+	configMu sync.RWMutex
+
+	// Serializes reloads.
+	reloadMu sync.Mutex
+
+	// Options read from the -config file, and those given on the command line, which
+	// take precedence.
+	configOptions  map[string][]string
+	cmdlineOptions map[string]bool
+)
+
+type reloadJSON struct {
+	Changed         []string // reloadable options changed in the config file
+	RestartRequired []string // options changed in the config file that need a restart
+}
+
+// Reads a config file of "name=value" lines, where names are command-line options without
+// the leading dash.  Boolean options can be given without a value.  Blank lines and lines
+// starting with "#" are ignored.
+func readConfig(fname string) (map[string][]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	options := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		name := strings.TrimLeft(strings.TrimSpace(parts[0]), "-")
+		value := "true"
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		switch name {
+		case "config", "h", "help":
+			return nil, fmt.Errorf("line %d of %s: option %q can't be set in a config file", lineNum, fname, name)
+		}
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("line %d of %s: unknown option %q", lineNum, fname, name)
+		}
+		options[name] = append(options[name], strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// Applies the -config file at startup.  Must be called after flag.Parse().
+func loadConfig(fname string) error {
+	options, err := readConfig(fname)
+	if err != nil {
+		return err
+	}
+	cmdlineOptions = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		cmdlineOptions[f.Name] = true
+	})
+	for name, values := range options {
+		if cmdlineOptions[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("bad option %s in %s: %v", name, fname, err)
+			}
+		}
+	}
+	configOptions = options
+	return nil
+}
+
+// Re-reads the -config file, if any, and applies changes to reloadable options.  Files
+// named by auth options are always re-read and cron jobs rescheduled.  If anything is
+// invalid, the previous options stay in effect.
+func reloadConfig() (reloadJSON, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	result := reloadJSON{Changed: []string{}, RestartRequired: []string{}}
+	options := configOptions
+	if *configFile != "" {
+		var err error
+		if options, err = readConfig(*configFile); err != nil {
+			return result, err
+		}
+	}
+
+	var changed []string
+	for name := range options {
+		if !equalValues(options[name], configOptions[name]) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range configOptions {
+		if _, found := options[name]; !found {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	old := make(map[string]string)
+	restore := func() {
+		for name, value := range old {
+			flag.Set(name, value)
+		}
+	}
+	for _, name := range changed {
+		if cmdlineOptions[name] {
+			continue
+		}
+		if !reloadableOptions[name] {
+			result.RestartRequired = append(result.RestartRequired, name)
+			continue
+		}
+		f := flag.Lookup(name)
+		old[name] = f.Value.String()
+		values, found := options[name]
+		if !found {
+			values = []string{f.DefValue}
+		}
+		for _, value := range values {
+			if err := f.Value.Set(value); err != nil {
+				restore()
+				return result, fmt.Errorf("bad option %s: %v", name, err)
+			}
+		}
+		result.Changed = append(result.Changed, name)
+	}
+	if *digestHour < 0 || *digestHour > 23 {
+		err := fmt.Errorf("bad digesthour %d: must be from 0 to 23", *digestHour)
+		restore()
+		return result, err
+	}
+	a, token, err := loadAuth()
+	if err != nil {
+		restore()
+		return result, err
+	}
+	setAuth(a, token)
+	scheduleCronJobs()
+	configOptions = options
+
+	for _, name := range result.RestartRequired {
+		log.Printf("WARNING: option %s changed in config file but requires a restart\n", name)
+	}
+	if len(result.Changed) == 0 {
+		log.Printf("Reloaded options, none changed\n")
+	} else {
+		log.Printf("Reloaded options, changed: %s\n", strings.Join(result.Changed, ", "))
+	}
+	return result, nil
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxReminderDelay is the longest a reminder can be scheduled ahead.
+const MaxReminderDelay = 30 * 24 * time.Hour
+
+type reminderKey struct {
+	uuid   string
+	label  uint64
+	client string
+}
+
+// Pending reminders to check labels back in.  They don't survive a restart.
+var reminders = struct {
+	sync.Mutex
+	due map[reminderKey]time.Time
+}{due: make(map[reminderKey]time.Time)}
+
+// reminderJSON is returned for a scheduled reminder and posted to the -remindwebhook when
+// it fires.
+type reminderJSON struct {
+	UUID   string
+	Label  labelJSON
+	Client string
+	Due    time.Time
+	Since  *time.Time `json:",omitempty"` // when the label was checked out, once fired
+}
+
+// Schedules a reminder for the holder of a label, replacing any earlier one for it.
+func setReminder(uuid string, label uint64, clientid string, in time.Duration) (reminderJSON, error) {
+	if in <= 0 || in > MaxReminderDelay {
+		return reminderJSON{}, fmt.Errorf("reminder must be due in a positive time up to %s, not %s", MaxReminderDelay, in)
+	}
+	library.RLock()
+	co, found := library.vchk[uuid][label]
+	format := library.policies[uuid].labelOutput()
+	library.RUnlock()
+	if !found || co.client != clientid {
+		return reminderJSON{}, fmt.Errorf("client %s does not have label %d of uuid %s checked out", clientid, label, uuid)
+	}
+
+	due := clock.Now().Add(in)
+	reminders.Lock()
+	reminders.due[reminderKey{uuid, label, clientid}] = due
+	reminders.Unlock()
+	return reminderJSON{UUID: uuid, Label: labelJSON{label, format}, Client: clientid, Due: due}, nil
+}
+
+// Cancels a reminder, returning false if there was none.
+func cancelReminder(uuid string, label uint64, clientid string) bool {
+	reminders.Lock()
+	defer reminders.Unlock()
+
+	key := reminderKey{uuid, label, clientid}
+	_, found := reminders.due[key]
+	delete(reminders.due, key)
+	return found
+}
+
+// Sends the reminders that are due for labels their clients still hold, and drops those
+// for labels that were checked in.
+func sendReminders() {
+	now := clock.Now()
+	var fired []reminderJSON
+
+	reminders.Lock()
+	library.RLock()
+	for key, due := range reminders.due {
+		co, found := library.vchk[key.uuid][key.label]
+		if !found || co.client != key.client {
+			delete(reminders.due, key)
+			continue
+		}
+		if now.Before(due) {
+			continue
+		}
+		delete(reminders.due, key)
+		label := labelJSON{key.label, library.policies[key.uuid].labelOutput()}
+		since := co.t
+		fired = append(fired, reminderJSON{UUID: key.uuid, Label: label, Client: key.client, Due: due, Since: &since})
+		publishEvent(ReminderEvent, key.uuid, label, co)
+	}
+	library.RUnlock()
+	reminders.Unlock()
+
+	if len(fired) == 0 {
+		return
+	}
+	configMu.RLock()
+	webhook, emailFmt := *remindWebhook, *remindEmail
+	configMu.RUnlock()
+	for _, rmd := range fired {
+		if webhook != "" {
+			what := fmt.Sprintf("reminder of uuid %s, label %d for %s", rmd.UUID, rmd.Label.label, rmd.Client)
+			if err := notifyWebhook(what, webhook, rmd); err != nil {
+				log.Printf("ERROR: unable to post reminder for uuid %s, label %d to %s: %v\n", rmd.UUID, rmd.Label.label, rmd.Client, err)
+			}
+		}
+		if emailFmt != "" {
+			if err := emailReminder(strings.ReplaceAll(emailFmt, "{client}", rmd.Client), rmd); err != nil {
+				log.Printf("ERROR: unable to email reminder for uuid %s, label %d to %s: %v\n", rmd.UUID, rmd.Label.label, rmd.Client, err)
+			}
+		}
+	}
+	log.Printf("Sent %d reminders to check in labels\n", len(fired))
+}
+
+// Emails a reminder through the -smtp server.
+func emailReminder(to string, rmd reminderJSON) error {
+	configMu.RLock()
+	from := *digestFrom
+	configMu.RUnlock()
+
+	label := strings.Trim(formatLabelJSON(rmd.Label.label, rmd.Label.format), `"`)
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: Reminder: label %s of %s is still checked out\r\n", label, rmd.UUID)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "You asked to be reminded that label %s of uuid %s, checked out by %s since %s,\r\n",
+		label, rmd.UUID, rmd.Client, rmd.Since.Format(time.RFC1123))
+	fmt.Fprintf(&msg, "is still checked out.  Check it back in when you're done with it.\r\n")
+	what := fmt.Sprintf("reminder of uuid %s, label %d for %s", rmd.UUID, rmd.Label.label, rmd.Client)
+	return notifyEmail(what, from, []string{to}, []byte(msg.String()))
+}
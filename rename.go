@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// renameRequestJSON is the body of POST /admin/rename-client.  Field names are matched
+// case-insensitively, so "from" and "From" both work.
+type renameRequestJSON struct {
+	From    string
+	To      string
+	History bool // also attribute past ops of From to To in history and digests
+}
+
+type renameJSON struct {
+	From      string
+	To        string
+	Checkouts int // active checkouts reassigned to To
+	History   bool
+}
+
+// clientAliasesT maps client ids renamed with history to their current ids.
+type clientAliasesT map[string]string
+
+// Returns the op with any renamed client ids replaced by their current ids.  The op is
+// copied if changed since ops may be shared with the recent history.
+func (aliases clientAliasesT) apply(op *libraryOp) *libraryOp {
+	if len(aliases) == 0 {
+		return op
+	}
+	client, renamed := aliases[op.client]
+	holder, holderRenamed := aliases[op.attrs["holder"]]
+	if !renamed && !holderRenamed {
+		return op
+	}
+	cp := *op
+	if renamed {
+		cp.client = client
+	}
+	if holderRenamed {
+		cp.attrs = mergeAttrs(op.attrs, map[string]string{"holder": holder})
+	}
+	return &cp
+}
+
+// Returns a copy of the client aliases, or nil if no clients were renamed with history.
+func getClientAliases() clientAliasesT {
+	library.RLock()
+	defer library.RUnlock()
+
+	if len(library.aliases) == 0 {
+		return nil
+	}
+	aliases := make(clientAliasesT, len(library.aliases))
+	for from, to := range library.aliases {
+		aliases[from] = to
+	}
+	return aliases
+}
+
+// Renames a client, reassigning its active checkouts, open work context, and activity to
+// the new id.  If history, past ops of the client are attributed to the new id as well.
+func renameClient(from, to string, history bool, attrs map[string]string) (renameJSON, error) {
+	n, err := renameClientAt(clock.Now(), from, to, history, attrs, true)
+	return renameJSON{from, to, n, history}, err
+}
+
+// Renames a client as of time t, which is the op time when replaying the log.  Returns the
+// number of checkouts reassigned.
+func renameClientAt(t time.Time, from, to string, history bool, attrs map[string]string, modifyLog bool) (int, error) {
+	library.Lock()
+	defer library.Unlock()
+
+	if from == to {
+		return 0, fmt.Errorf("client %s can't be renamed to itself", from)
+	}
+	if _, found := library.clients[from]; modifyLog && !found && !library.holdsCheckouts(from) {
+		return 0, fmt.Errorf("client %s has no activity to rename", from)
+	}
+	undo := library.snapshotRename(from, to)
+
+	n := 0
+	for uuid, checkouts := range library.vchk {
+		var labels []uint64
+		for label, co := range checkouts {
+			if co.client == from {
+				co.client = to
+				checkouts[label] = co
+				labels = append(labels, label)
+				n++
+			}
+		}
+		if len(labels) != 0 {
+			library.bumpRevision(uuid)
+			undo.labels[uuid] = labels
+		}
+	}
+	if fromStats, found := library.clients[from]; found {
+		stats := library.clientStats(to, fromStats.lastActive)
+		stats.holds += fromStats.holds
+		stats.holdTime += fromStats.holdTime
+		delete(library.clients, from)
+	}
+	if fromTools, found := library.tools[from]; found {
+		tools, found := library.tools[to]
+		if !found {
+			tools = make(map[toolKey]*toolT)
+			library.tools[to] = tools
+		}
+		for key, fromTool := range fromTools {
+			tool, found := tools[key]
+			if !found {
+				tools[key] = fromTool
+				continue
+			}
+			if fromTool.firstSeen.Before(tool.firstSeen) {
+				tool.firstSeen = fromTool.firstSeen
+			}
+			if fromTool.lastSeen.After(tool.lastSeen) {
+				tool.lastSeen = fromTool.lastSeen
+			}
+			tool.ops += fromTool.ops
+		}
+		delete(library.tools, from)
+	}
+	if ctx, found := library.contexts[from]; found {
+		if _, found := library.contexts[to]; !found {
+			library.contexts[to] = ctx
+		}
+		delete(library.contexts, from)
+	}
+	if history {
+		library.setAlias(from, to)
+	}
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     ClientRenameOp,
+			uuid:   "n/a",
+			client: from,
+			attrs:  mergeAttrs(attrs, map[string]string{"to": to}),
+		}
+		if history {
+			op.attrs["history"] = "true"
+		}
+		if err := library.write(op); err != nil {
+			library.undoRename(undo)
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// renameUndoT holds what a client rename changes so it can be undone if the rename can't
+// be logged.
+type renameUndoT struct {
+	from, to  string
+	labels    map[string][]uint64 // uuid -> checkouts reassigned
+	fromStats *clientStatsT
+	toStats   *clientStatsT // copy, or nil if to had no stats
+	fromTools map[toolKey]*toolT
+	toTools   map[toolKey]*toolT // copy, or nil if to had no tools
+	fromCtx   *contextT
+	toCtx     *contextT
+	aliases   clientAliasesT
+}
+
+// Returns true if a client holds any checkout.  Must be called with library lock held.
+func (lib *libraryT) holdsCheckouts(clientid string) bool {
+	for _, checkouts := range lib.vchk {
+		for _, co := range checkouts {
+			if co.client == clientid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the state a rename of a client changes besides its checkouts.  Must be called
+// with library lock held.
+func (lib *libraryT) snapshotRename(from, to string) *renameUndoT {
+	undo := &renameUndoT{
+		from:      from,
+		to:        to,
+		labels:    make(map[string][]uint64),
+		fromStats: lib.clients[from],
+		fromTools: lib.tools[from],
+		fromCtx:   lib.contexts[from],
+		toCtx:     lib.contexts[to],
+		aliases:   make(clientAliasesT, len(lib.aliases)),
+	}
+	if stats, found := lib.clients[to]; found {
+		cp := *stats
+		undo.toStats = &cp
+	}
+	if tools, found := lib.tools[to]; found {
+		undo.toTools = make(map[toolKey]*toolT, len(tools))
+		for key, tool := range tools {
+			cp := *tool
+			undo.toTools[key] = &cp
+		}
+	}
+	for old, current := range lib.aliases {
+		undo.aliases[old] = current
+	}
+	return undo
+}
+
+// Undoes a client rename that couldn't be logged.  Must be called with library lock held.
+func (lib *libraryT) undoRename(undo *renameUndoT) {
+	for uuid, labels := range undo.labels {
+		for _, label := range labels {
+			co := lib.vchk[uuid][label]
+			co.client = undo.from
+			lib.vchk[uuid][label] = co
+		}
+		lib.unbumpRevision(uuid)
+	}
+	if undo.fromStats != nil {
+		lib.clients[undo.from] = undo.fromStats
+	}
+	if undo.toStats != nil {
+		lib.clients[undo.to] = undo.toStats
+	} else {
+		delete(lib.clients, undo.to)
+	}
+	if undo.fromTools != nil {
+		lib.tools[undo.from] = undo.fromTools
+	}
+	if undo.toTools != nil {
+		lib.tools[undo.to] = undo.toTools
+	} else {
+		delete(lib.tools, undo.to)
+	}
+	if undo.fromCtx != nil {
+		lib.contexts[undo.from] = undo.fromCtx
+	}
+	if undo.toCtx != nil {
+		lib.contexts[undo.to] = undo.toCtx
+	} else {
+		delete(lib.contexts, undo.to)
+	}
+	lib.aliases = undo.aliases
+}
+
+// Attributes past ops of a client to a new id, including ops of clients earlier renamed
+// to it.  Must be called with library lock held.
+func (lib *libraryT) setAlias(from, to string) {
+	for old, current := range lib.aliases {
+		if current == from {
+			lib.aliases[old] = to
+		}
+	}
+	lib.aliases[from] = to
+	delete(lib.aliases, to) // to is a current id again
+}
+
+// Writes all client aliases into a compacted log.  Must be called with library lock held.
+func (lib *libraryT) writeClientAliasRestores() error {
+	for from, to := range lib.aliases {
+		op := &libraryOp{
+			op:     ClientAliasRestoreOp,
+			uuid:   "n/a",
+			client: from,
+			attrs:  map[string]string{"to": to},
+		}
+		if err := lib.write(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies a client rename or alias read from the log.
+func restoreRename(op *libraryOp) error {
+	to := op.attrs["to"]
+	if to == "" {
+		return fmt.Errorf("%s of client %s has no new client id", op.op, op.client)
+	}
+	if op.op == ClientAliasRestoreOp {
+		library.Lock()
+		library.aliases[op.client] = to
+		library.Unlock()
+		return nil
+	}
+	_, err := renameClientAt(op.t, op.client, to, op.attrs["history"] == "true", op.attrs, false)
+	return err
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// replicationT is where the ops sent to a replica start: after a snapshot, or after the
+// replica's own sequence number if those ops are all still in the current log.
+type replicationT struct {
+	snap      *snapshotT // nil if the replica only needs ops
+	fromSeq   uint64     // ops after this are sent
+	offset    int64      // position in the log to read ops from
+	firstLine string     // first line of the log the ops are read from
+}
+
+// Returns the sequence number of the first op in a log, or 0 if the log is empty or was
+// written before sequence numbers.
+func firstSeq(firstLine string) uint64 {
+	if firstLine == "" {
+		return 0
+	}
+	op, err := parseLogLine(firstLine)
+	if err != nil {
+		return 0
+	}
+	return op.seq
+}
+
+// Starts a transfer to a replica that has applied ops up to sinceSeq, or to a new replica
+// if since is false.  A snapshot is only taken if ops the replica needs were compacted away.
+func startReplication(sinceSeq uint64, since bool) (*replicationT, error) {
+	library.RLock()
+	seq, firstLine := library.seq, library.firstLine
+	library.RUnlock()
+
+	if since && sinceSeq > seq {
+		return nil, fmt.Errorf("since-seq %d is after the last op, %d", sinceSeq, seq)
+	}
+	if since {
+		if first := firstSeq(firstLine); (first != 0 && sinceSeq+1 >= first) || (firstLine == "" && sinceSeq == seq) {
+			return &replicationT{fromSeq: sinceSeq, firstLine: firstLine}, nil
+		}
+	}
+	snap := takeSnapshot()
+	return &replicationT{snap: snap, fromSeq: snap.seq, offset: snap.logSize, firstLine: snap.firstLine}, nil
+}
+
+// Writes the snapshot, if any, and then every op logged after it, including ops logged
+// while the snapshot was being sent:
+//
+//	{"Snapshot": {...}, "Ops": [{"Seq": 1042, ...}, ...], "Seq": 1043}
+//
+// Returns an error if the log was compacted since the transfer started.
+func (rep *replicationT) write(w io.Writer) error {
+	fmt.Fprintf(w, `{"Snapshot":`)
+	if rep.snap == nil {
+		fmt.Fprintf(w, "null")
+	} else if err := rep.snap.write(w); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, `, "Ops":[`)
+
+	library.RLock()
+	fname, firstLine, size := library.fname, library.firstLine, library.size
+	library.RUnlock()
+	if firstLine != rep.firstLine {
+		return fmt.Errorf("log was compacted during transfer; retry with since-seq %d", rep.fromSeq)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(rep.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Only complete lines up to the log size read above are sent, so a partly written op
+	// is left for the next transfer or the -opstream.
+	lastSeq := rep.fromSeq
+	first := true
+	r := bufio.NewReader(io.LimitReader(f, size-rep.offset))
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		op, err := parseLogLine(line)
+		if err != nil {
+			return err
+		}
+		if op.seq <= rep.fromSeq {
+			continue
+		}
+		msg, err := json.Marshal(opStreamJSON{op.seq, op.t, op.op.String(), op.uuid, op.label, op.client, op.attrs})
+		if err != nil {
+			return err
+		}
+		if !first {
+			fmt.Fprintf(w, ",")
+		}
+		first = false
+		fmt.Fprintf(w, "\n  %s", msg)
+		lastSeq = op.seq
+	}
+	fmt.Fprintf(w, "\n], \"Seq\":%d}\n", lastSeq)
+	return nil
+}
+
+var followerNameRE = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+var (
+	replicationLagVar    = expvar.NewMap("librarian_replication_lag")
+	replicationBehindVar = expvar.NewInt("librarian_replication_followers_behind")
+)
+
+// followerT is a replica that has acknowledged the ops it applied.
+type followerT struct {
+	seq    uint64    // last op applied
+	acked  time.Time // when seq was acknowledged
+	behind bool      // lag was over -replicationlag when last checked
+}
+
+// Followers by name, which are forgotten on restart until they acknowledge again.
+var followers = struct {
+	sync.Mutex
+	m map[string]*followerT
+}{
+	m: make(map[string]*followerT),
+}
+
+type replicationOffsetJSON struct {
+	Seq      uint64 // last op logged
+	FirstSeq uint64 // first op in the current log, or 0 if unknown
+}
+
+type followerJSON struct {
+	Name     string
+	Seq      uint64
+	LagOps   uint64 // ops logged after Seq
+	LastAck  time.Time
+	SinceAck string
+	Behind   bool
+}
+
+type replicationStatsJSON struct {
+	Seq       uint64
+	MaxLagOps uint64 // -replicationlag, or 0 if no alerts
+	Followers []followerJSON
+}
+
+// Returns the primary's last sequence number and the first still in the log, so a follower
+// can tell if it can catch up with since-seq or needs a snapshot.
+func replicationOffset() replicationOffsetJSON {
+	library.RLock()
+	defer library.RUnlock()
+	return replicationOffsetJSON{library.seq, firstSeq(library.firstLine)}
+}
+
+// Records that a follower has applied ops up to seq, returning its lag.
+func ackReplication(name string, seq uint64) (followerJSON, error) {
+	if !followerNameRE.MatchString(name) {
+		return followerJSON{}, fmt.Errorf("follower name %q must be up to 128 letters, digits, '.', '_', ':', or '-'", name)
+	}
+	library.RLock()
+	primarySeq := library.seq
+	library.RUnlock()
+	if seq > primarySeq {
+		return followerJSON{}, fmt.Errorf("seq %d is after the last op, %d", seq, primarySeq)
+	}
+
+	followers.Lock()
+	defer followers.Unlock()
+	f, found := followers.m[name]
+	if !found {
+		f = new(followerT)
+		followers.m[name] = f
+		log.Printf("New follower %s acknowledged seq %d\n", name, seq)
+	}
+	if seq > f.seq || !found {
+		f.seq = seq
+	}
+	f.acked = clock.Now()
+	checkFollowerLag(name, f, primarySeq)
+	return f.toJSON(name, primarySeq, f.acked), nil
+}
+
+func (f *followerT) toJSON(name string, primarySeq uint64, now time.Time) followerJSON {
+	return followerJSON{name, f.seq, primarySeq - f.seq, f.acked, now.Sub(f.acked).Round(time.Second).String(), f.behind}
+}
+
+// Updates a follower's lag metric and logs a warning when it falls more than
+// -replicationlag ops behind, or catches up again.  Must be called with followers locked.
+func checkFollowerLag(name string, f *followerT, primarySeq uint64) {
+	lag := primarySeq - f.seq
+	lagVar := new(expvar.Int)
+	lagVar.Set(int64(lag))
+	replicationLagVar.Set(name, lagVar)
+
+	behind := *replicationLag > 0 && lag > uint64(*replicationLag)
+	if behind == f.behind {
+		return
+	}
+	f.behind = behind
+	if behind {
+		replicationBehindVar.Add(1)
+		log.Printf("WARNING: follower %s is %d ops behind at seq %d, over -replicationlag of %d\n", name, lag, f.seq, *replicationLag)
+	} else {
+		replicationBehindVar.Add(-1)
+		log.Printf("Follower %s caught up to within %d ops\n", name, lag)
+	}
+}
+
+// Rechecks the lag of every follower, which grows as ops are logged even if a follower
+// stops acknowledging.
+func checkReplicationLag() {
+	library.RLock()
+	primarySeq := library.seq
+	library.RUnlock()
+
+	followers.Lock()
+	defer followers.Unlock()
+	for name, f := range followers.m {
+		checkFollowerLag(name, f, primarySeq)
+	}
+}
+
+// Returns the lag of each follower sorted by name.
+func getReplicationStats() replicationStatsJSON {
+	library.RLock()
+	primarySeq := library.seq
+	library.RUnlock()
+
+	followers.Lock()
+	defer followers.Unlock()
+	now := clock.Now()
+	stats := replicationStatsJSON{primarySeq, uint64(*replicationLag), make([]followerJSON, 0, len(followers.m))}
+	for name, f := range followers.m {
+		stats.Followers = append(stats.Followers, f.toJSON(name, primarySeq, now))
+	}
+	sort.Slice(stats.Followers, func(i, j int) bool { return stats.Followers[i].Name < stats.Followers[j].Name })
+	return stats
+}
@@ -2,85 +2,230 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
 	logFmt = "%s %s %d %s"
-)
 
-type opType uint8
+	// SeqAttr is the attribute holding an op's sequence number, which increases by one
+	// with each op logged, so ops are ordered by it rather than by their times.
+	SeqAttr = "seq"
+)
 
-func (op opType) String() string {
-	switch op {
-	case CheckoutOp:
-		return "checkout"
-	case CheckinOp:
-		return "checkin"
-	case ResetOp:
-		return "reset"
-	default:
-		return "unknown-op"
-	}
-}
+// Handling of a checkout of a label the client already holds, set by -recheckout.
+const (
+	RecheckoutLog    = "log"    // log another checkout op
+	RecheckoutDedupe = "dedupe" // log nothing unless a lease is renewed
+	RecheckoutRenew  = "renew"  // log a renew op
+	RecheckoutHeld   = "held"   // like dedupe, but the response says the label was already held
+)
 
-func opTypeFromString(s string) opType {
+func validRecheckout(s string) bool {
 	switch s {
-	case "checkout":
-		return CheckoutOp
-	case "checkin":
-		return CheckinOp
-	case "reset":
-		return ResetOp
+	case RecheckoutLog, RecheckoutDedupe, RecheckoutRenew, RecheckoutHeld:
+		return true
 	default:
-		return UnknownOp
+		return false
 	}
 }
 
-const (
-	UnknownOp opType = iota
-	CheckoutOp
-	CheckinOp
-	ResetOp
-)
-
 type libraryOp struct {
 	t      time.Time
 	op     opType
 	uuid   string
 	label  uint64
 	client string
+	attrs  map[string]string // optional key="value" fields at end of log line
+	seq    uint64            // position among all ops ever logged, or 0 if logged before seqs
+
+	version int // log line version if newer than version 1, kept when lines are rewritten
 }
 
 type reserveJSON struct {
+	Label      labelJSON
+	Client     string
+	Superseded *labelJSON `json:",omitempty"` // label checked out if Label is its current id
+	Pinned     *pinJSON   `json:",omitempty"`
+	Name       string     `json:",omitempty"` // display name set with PUT /names
+}
+
+// Returns the label actually checked out.
+func (rsv reserveJSON) held() uint64 {
+	if rsv.Superseded != nil {
+		return rsv.Superseded.label
+	}
+	return rsv.Label.label
+}
+
+// checkoutT records who holds a label and since when.
+type checkoutT struct {
+	client  string
+	t       time.Time
+	expires time.Time // zero if checkout has no lease
+	warned  bool      // true if a lease-expiring event was sent for this lease
+
+	inactivityWarned time.Time // holder's last activity when an inactivity-warning event was sent
+}
+
+// Returns true if the lease and any grace period after it have run out.
+func (co checkoutT) expired(now time.Time, grace time.Duration) bool {
+	return !co.expires.IsZero() && !now.Before(co.expires.Add(grace))
+}
+
+type checkoutsT map[uint64]checkoutT
+
+// Error codes for refused checkouts and checkins, given in the "Code" of error responses.
+const (
+	AlreadyCheckedOutCode = "ALREADY_CHECKED_OUT"
+	NotCheckedOutCode     = "NOT_CHECKED_OUT"
+	WrongClientCode       = "WRONG_CLIENT"
+	StorageFailureCode    = "STORAGE_FAILURE"
+)
+
+// ErrAlreadyCheckedOut is returned for a checkout of a label held by another client.
+type ErrAlreadyCheckedOut struct {
+	UUID   string
+	Label  uint64
+	Holder string
+}
+
+func (e *ErrAlreadyCheckedOut) Error() string {
+	return fmt.Sprintf("uuid %s, label %d - already checked out by %s", e.UUID, e.Label, e.Holder)
+}
+
+// ErrNotCheckedOut is wrapped by errors for checkins of labels no one holds.
+var ErrNotCheckedOut = errors.New("not been checked out")
+
+// ErrWrongClient is returned for a checkin of a label held by another client.
+type ErrWrongClient struct {
+	UUID   string
 	Label  uint64
+	Holder string
 	Client string
 }
 
-type checkoutsT map[uint64]string
+func (e *ErrWrongClient) Error() string {
+	return fmt.Sprintf("uuid %s, label %d checked out to %s, not %s so cannot checkin", e.UUID, e.Label, e.Holder, e.Client)
+}
+
+// ErrStorageFailure is returned when an op couldn't be written to the log, e.g., because
+// the disk is full.  The op isn't applied.
+type ErrStorageFailure struct {
+	Err error
+}
 
-func (c checkoutsT) MarshalJSON() ([]byte, error) {
-	reserves := make([]reserveJSON, len(c))
-	i := 0
-	for label, client := range c {
-		reserves[i] = reserveJSON{label, client}
-		i++
-	}
-	return json.Marshal(reserves)
+func (e *ErrStorageFailure) Error() string {
+	return fmt.Sprintf("unable to write librarian log: %v", e.Err)
+}
+
+func (e *ErrStorageFailure) Unwrap() error {
+	return e.Err
+}
+
+type stateJSON struct {
+	UUID      string
+	Checkouts []reserveJSON
+	Pinned    []pinnedLabelJSON    `json:",omitempty"`
+	Intents   []intentJSON         `json:",omitempty"`
+	Clients   map[string]identityT `json:",omitempty"` // -idprovider entries of clients
+}
+
+// statePageJSON is a page of a uuid's checkouts out of Total checkouts.
+type statePageJSON struct {
+	UUID      string
+	Total     int
+	Offset    int
+	Checkouts []reserveJSON
+	Pinned    []pinnedLabelJSON    `json:",omitempty"`
+	Intents   []intentJSON         `json:",omitempty"`
+	Clients   map[string]identityT `json:",omitempty"` // -idprovider entries of clients
+}
+
+type stateCountJSON struct {
+	UUID  string
+	Total int
+}
+
+// Orders of checkouts in GET /state.
+const (
+	SortByLabel  = "label"
+	SortByClient = "client"
+	SortByAge    = "age" // oldest checkouts first
+)
+
+type uuidsJSON struct {
+	UUIDs []string
+}
+
+type historicalUUIDsJSON struct {
+	UUIDs      []string
+	Historical []string // UUIDs with past ops but no checkouts now
+}
+
+// clientStatsT tracks a client's activity for estimating when its locks will free up.
+type clientStatsT struct {
+	lastActive time.Time
+	holds      int           // number of completed checkouts
+	holdTime   time.Duration // total time of completed checkouts
 }
 
 // map of UUID -> checkouts
 type libraryT struct {
 	sync.RWMutex
 
-	vchk  map[string]checkoutsT
-	fname string
-	w     *bufio.Writer // Append-only log writer
+	vchk    map[string]checkoutsT
+	meta    map[string]map[string]string // UUID -> key -> value
+	clients map[string]*clientStatsT
+
+	tools    map[string]map[toolKey]*toolT // client -> tools used
+	policies map[string]*policyJSON
+	contexts map[string]*contextT // client -> open work context
+
+	savedViews map[string]*savedViewT // name -> query saved through POST /views
+
+	superseded map[string]map[uint64]uint64     // UUID -> old label -> superseding label
+	aliases    clientAliasesT                   // client renamed with history -> current client
+	pins       map[string]map[uint64]pinT       // UUID -> pinned label -> pin
+	comments   map[string]map[uint64][]commentT // UUID -> label -> comments, oldest first
+	freezes    map[string]map[string]*freezeT   // UUID -> name -> scheduled freeze
+
+	opIDs    map[string]opIDT       // client-generated op id -> applied op
+	assigned map[assignKey]bool     // labels reserved for assignment tasks
+	recent   map[string]*recentOpsT // UUID -> most recent history ops
+	revs     map[string]uint64      // UUID -> number of ops applied to that UUID
+	revision uint64                 // total of all UUID revisions
+	seq      uint64                 // sequence number of the last op logged
+	fname    string
+	f        *os.File
+	w        *bufio.Writer // Append-only log writer
+
+	db        stateStore // optional mirror of state, see -statedb
+	shadow    stateStore // optional store being trialed, see -shadowdb
+	firstLine string     // first line of log, used to match it with the state db and replicas
+
+	// True if the recent ops were built from all history, so uuids with fewer ops than
+	// RecentHistorySize have all their history in memory.
+	recentComplete bool
+
+	size          int64  // Current size of log file in bytes
+	crc           uint32 // Rolling CRC-32C of log file, see checksum.go
+	overLimit     bool   // True if size exceeds -maxlogsize
+	compacting    bool
+	writeFailures int // log writes that failed in a row
+
+	uuidBytes   map[string]int64  // UUID -> bytes of its ops in the current log
+	quotaLevels map[string]string // UUID -> quota level if near or at a quota
 }
 
 var (
@@ -88,56 +233,129 @@ var (
 )
 
 func (lib *libraryT) write(op *libraryOp) error {
-	timeBytes, err := time.Now().MarshalText()
+	t := op.t
+	if t.IsZero() {
+		t = clock.Now()
+	}
+	lib.tagContext(op)
+	op.seq = lib.seq + 1
+	line, err := formatLogLine(op, t)
 	if err != nil {
 		return err
 	}
-	line := fmt.Sprintf("%s %s %s %d %s\n", string(timeBytes), op.uuid, op.op, op.label, op.client)
 	if _, err := lib.w.WriteString(line); err != nil {
-		return err
+		return lib.writeFailed(op, err)
 	}
 	if err := lib.w.Flush(); err != nil {
-		return err
+		return lib.writeFailed(op, err)
+	}
+	lib.writeFailures = 0
+	lib.crc = crc32.Update(lib.crc, crcTable, []byte(line))
+	logCRCVar.Set(int64(lib.crc))
+	if lib.size == 0 {
+		lib.firstLine = line
+	}
+	lib.size += int64(len(line))
+	lib.uuidBytes[op.uuid] += int64(len(line))
+	lib.seq = op.seq
+	lib.noteOpID(op, t)
+	lib.noteRecent(op, t)
+	shipOp(op, t)
+	mirrorOp(op)
+	wakeWaiters(op)
+	notifyIntents(op)
+	lib.checkQuota(op.uuid)
+
+	// A compacted log is written to the state db all at once when done.
+	if lib.db != nil && !lib.compacting {
+		if err := lib.db.syncOp(lib, op); err != nil {
+			log.Printf("ERROR: unable to update state db for %s of uuid %s: %v\n", op.op, op.uuid, err)
+		}
 	}
+	lib.shadowOp(op)
+	lib.checkLogSize()
 	return nil
 }
 
+// Makes empty state for the library.
+func (lib *libraryT) init() {
+	lib.vchk = make(map[string]checkoutsT, 100)
+	lib.meta = make(map[string]map[string]string)
+	lib.clients = make(map[string]*clientStatsT)
+	lib.revs = make(map[string]uint64)
+	lib.revision = 0
+	lib.seq = 0
+	lib.tools = make(map[string]map[toolKey]*toolT)
+	lib.policies = make(map[string]*policyJSON)
+	lib.contexts = make(map[string]*contextT)
+	lib.savedViews = make(map[string]*savedViewT)
+	lib.superseded = make(map[string]map[uint64]uint64)
+	lib.aliases = make(clientAliasesT)
+	lib.pins = make(map[string]map[uint64]pinT)
+	lib.comments = make(map[string]map[uint64][]commentT)
+	lib.freezes = make(map[string]map[string]*freezeT)
+	lib.opIDs = make(map[string]opIDT)
+	lib.assigned = make(map[assignKey]bool)
+	lib.recent = make(map[string]*recentOpsT)
+	lib.recentComplete = false
+	lib.uuidBytes = make(map[string]int64)
+	lib.quotaLevels = make(map[string]string)
+	if lib == &library {
+		invalidateViews()
+	}
+}
+
 // This is the only time we read from log file, then rest of time we write.
 func initLibrary(fname string) error {
 	library.fname = fname
-	library.vchk = make(map[string]checkoutsT, 100)
+	library.init()
+	beginStartupReport(fname)
 
 	// Read-only mode
 	f, err := os.OpenFile(fname, os.O_CREATE|os.O_RDONLY, 0664)
 	if err != nil {
 		return fmt.Errorf("cannot create/open librarian log file: %v", err)
 	}
-	r := bufio.NewReader(f)
+	defer f.Close()
 
-	// Load every entry in, populating our library of reserved labels.
-	modifyLog := false
-	for {
-		line, err := r.ReadString('\n')
-		if err == io.EOF {
-			break
+	// With a state db, only ops written after the db was last updated need replay.
+	loaded := false
+	if *stateDB != "" {
+		if loaded, err = library.loadState(f); err != nil {
+			return err
 		}
+	}
+	if loaded {
+		// Quotas need the bytes of ops the state db load skipped.
+		offset, err := f.Seek(0, io.SeekCurrent)
 		if err != nil {
 			return err
 		}
-		op, err := parseLogLine(line)
-		if err != nil {
+		if library.uuidBytes, err = countLogBytes(fname, offset); err != nil {
 			return err
 		}
-		switch op.op {
-		case CheckoutOp:
-			checkout(op.uuid, op.label, op.client, modifyLog)
-		case CheckinOp:
-			checkin(op.uuid, op.label, op.client, modifyLog)
-		case ResetOp:
-			reset(op.uuid, modifyLog)
-		default:
-			return fmt.Errorf("bad log op found in initLibrary!  Should not happen.")
+	}
+
+	// Load every entry in, populating our library of reserved labels.  Recent history
+	// is complete unless earlier history is in a state db or log segments.
+	segments, err := logSegments(fname)
+	if err != nil {
+		return err
+	}
+	library.recentComplete = !loaded && len(segments) == 0
+	replayed, err := replayLog(bufio.NewReader(f))
+	truncated, wasTruncated := err.(*truncatedLineError)
+	if wasTruncated {
+		if err = recoverTruncatedLine(fname, truncated); err != nil {
+			return err
 		}
+		wasTruncated = !truncated.complete
+	}
+	if err != nil {
+		return err
+	}
+	if library.crc, err = initLogChecksums(fname, segments); err != nil {
+		return err
 	}
 
 	// After full read, open the file os.O_APPEND|os.O_CREATE rather than use os.Create.
@@ -146,204 +364,1335 @@ func initLibrary(fname string) error {
 	if err != nil {
 		return fmt.Errorf("cannot open librarian log file: %v", err)
 	}
+	fi, err := w.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat librarian log file: %v", err)
+	}
+	library.f = w
 	library.w = bufio.NewWriter(w)
+	library.size = fi.Size()
+	library.pruneOpIDs(clock.Now())
+	if library.firstLine, err = readFirstLine(fname); err != nil {
+		return err
+	}
+	if library.db != nil {
+		if !loaded || replayed > 0 {
+			if err := library.db.syncAll(&library); err != nil {
+				return fmt.Errorf("cannot update state db: %v", err)
+			}
+		}
+		log.Printf("Loaded state db %q and replayed %d ops from librarian log\n", *stateDB, replayed)
+	}
+	if *shadowDB != "" {
+		if err := library.openShadow(*shadowDB); err != nil {
+			return err
+		}
+	}
+	library.checkLogSize()
+	library.checkQuotas()
+	finishStartupReport(loaded, len(segments), replayed, wasTruncated)
 	return nil
 }
 
-func parseLogLine(line string) (*libraryOp, error) {
-	var timeStr, uuid, opStr, client string
-	var label uint64
-	n, err := fmt.Sscanf(line, "%s %s %s %d %s", &timeStr, &uuid, &opStr, &label, &client)
+// truncatedLineError is returned by replayLog for a final log line that is unterminated or
+// malformed, e.g., because the librarian died while writing it.
+type truncatedLineError struct {
+	line     string
+	err      error
+	complete bool // line parsed and was applied, so only its newline is missing
+}
+
+func (e *truncatedLineError) Error() string {
+	return fmt.Sprintf("truncated last line of librarian log %q: %v", e.line, e.err)
+}
+
+// Truncates a partially written last line from the librarian log so it can be appended to.
+// A complete last line missing only its newline is kept and terminated instead.
+func recoverTruncatedLine(fname string, truncated *truncatedLineError) error {
+	if truncated.complete {
+		f, err := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0664)
+		if err != nil {
+			return fmt.Errorf("cannot open librarian log file: %v", err)
+		}
+		if _, err := f.WriteString("\n"); err != nil {
+			f.Close()
+			return fmt.Errorf("cannot terminate last line of librarian log: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("cannot terminate last line of librarian log: %v", err)
+		}
+		log.Printf("WARNING: added missing newline to last line of librarian log %s\n", fname)
+		return nil
+	}
+	fi, err := os.Stat(fname)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse log line %q: %v", line, err)
+		return fmt.Errorf("cannot stat librarian log file: %v", err)
 	}
-	if n != 5 {
-		return nil, fmt.Errorf("could not parse log line %q", line)
+	size := fi.Size() - int64(len(truncated.line))
+	if err := os.Truncate(fname, size); err != nil {
+		return fmt.Errorf("cannot remove truncated last line of librarian log: %v", err)
 	}
-	var t time.Time
-	if err := t.UnmarshalText([]byte(timeStr)); err != nil {
-		return nil, err
+	truncationsVar.Add(1)
+	log.Printf("WARNING: removed %d-byte truncated last line from librarian log %s: %v\n", len(truncated.line), fname, truncated.err)
+	return nil
+}
+
+// Applies the ops read from a librarian log, returning the number of ops.  A bad or
+// unterminated last line returns a *truncatedLineError after all earlier ops, and the
+// line itself if it parses, are applied.  Ops inconsistent
+// with earlier ones, e.g., a checkin of a label that isn't checked out, are handled as set
+// by -replay.
+func replayLog(r *bufio.Reader) (int, error) {
+	modifyLog := false
+	n := 0
+	var unterminated string
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			if line == "" {
+				break
+			}
+			unterminated = line
+		} else if err != nil {
+			return n, err
+		}
+		op, err := parseLogLine(line)
+		if err != nil {
+			if unterminated != "" {
+				return n, &truncatedLineError{line, fmt.Errorf("no terminating newline: %v", err), false}
+			}
+			if _, peekErr := r.Peek(1); peekErr == io.EOF {
+				return n, &truncatedLineError{line, err, false}
+			}
+			return n, err
+		}
+		library.uuidBytes[op.uuid] += int64(len(line))
+		if !library.noteOpID(op, op.t) {
+			log.Printf("WARNING: skipping duplicate %s of uuid %s, label %d with op id %q in librarian log\n", op.op, op.uuid, op.label, op.attrs["opid"])
+			continue
+		}
+		n++
+		if n%ReplayProgressOps == 0 {
+			replayProgress.Store(int64(n))
+		}
+		if op.seq > library.seq {
+			library.seq = op.seq
+		}
+		if op.op.restore() {
+			library.recentComplete = false // earlier history is in log segments
+		}
+		library.noteRecent(op, op.t)
+		switch op.op {
+		case CheckoutOp, RestoreOp, RenewOp:
+			if _, err := checkoutAt(op.t, op.uuid, op.label, op.client, op.attrs, modifyLog); err != nil {
+				if err = replayInconsistency(op, err); err != nil {
+					return n, err
+				}
+			}
+		case CheckinOp:
+			if err := checkinAt(op.t, op.uuid, op.label, op.client, op.attrs, modifyLog); err != nil {
+				if err = replayInconsistency(op, err); err != nil {
+					return n, err
+				}
+			}
+		case ResetOp, CommitResetOp:
+			reset(op.uuid, op.attrs, modifyLog)
+		case MetaSetOp, MetaRestoreOp:
+			setMetaAt(op.t, op.uuid, op.attrs["key"], op.attrs["value"], op.client, op.attrs, modifyLog)
+		case MetaDeleteOp:
+			deleteMetaAt(op.t, op.uuid, op.attrs["key"], op.client, op.attrs, modifyLog)
+		case RevisionOp:
+			if err := restoreRevision(op); err != nil {
+				return n, err
+			}
+		case ExpireOp:
+			if err := expireAt(op.t, op.uuid, op.label, modifyLog); err != nil {
+				return n, err
+			}
+		case PolicySetOp, PolicyRestoreOp:
+			if err := setPolicy(op.uuid, op.attrs["policy"], op.client, op.attrs, modifyLog); err != nil {
+				return n, err
+			}
+		case ContextOpenOp, ContextRestoreOp:
+			if err := openContextAt(op.t, op.op, op.client, op.attrs["context"], op.attrs["name"], op.attrs, modifyLog); err != nil {
+				return n, err
+			}
+		case ContextCloseOp:
+			if err := closeContextAt(op.t, op.client, op.attrs, modifyLog); err != nil {
+				if err = replayInconsistency(op, err); err != nil {
+					return n, err
+				}
+			}
+		case ViewSaveOp, ViewRestoreOp:
+			if err := saveViewAt(op.t, op.op, op.attrs["name"], op.attrs["path"], op.client, op.attrs, modifyLog); err != nil {
+				return n, err
+			}
+		case ViewDeleteOp:
+			if err := deleteViewAt(op.t, op.attrs["name"], op.client, op.attrs, modifyLog); err != nil {
+				if err = replayInconsistency(op, err); err != nil {
+					return n, err
+				}
+			}
+		case SupersedeOp, SupersedeRestoreOp:
+			if err := restoreSuperseded(op); err != nil {
+				return n, err
+			}
+		case ClientRenameOp, ClientAliasRestoreOp:
+			if err := restoreRename(op); err != nil {
+				return n, err
+			}
+		case PinOp, PinRestoreOp:
+			restorePin(op)
+		case UnpinOp:
+			if err := unpinAt(op.t, op.uuid, op.label, op.client, op.attrs, modifyLog); err != nil {
+				if err = replayInconsistency(op, err); err != nil {
+					return n, err
+				}
+			}
+		case CommentOp, CommentRestoreOp:
+			if err := restoreComment(op); err != nil {
+				return n, err
+			}
+		case FreezeSetOp, FreezeRestoreOp:
+			if err := restoreFreeze(op); err != nil {
+				return n, err
+			}
+		case FreezeDeleteOp:
+			if err := deleteFreezeAt(op.t, op.uuid, op.attrs["name"], op.client, op.attrs, modifyLog); err != nil {
+				if err = replayInconsistency(op, err); err != nil {
+					return n, err
+				}
+			}
+		case ConflictOp:
+			// Conflicts are recorded for history and analysis but don't change state.
+		case LabelResetOp:
+			labels, err := parseLabelList(op.attrs["labels"])
+			if err != nil {
+				return n, err
+			}
+			resetLabelsAt(op.t, op.uuid, labels, op.client, op.attrs, modifyLog)
+		case AssignRestoreOp:
+			restoreAssignment(op)
+		case OpIDRestoreOp:
+			if err := restoreOpID(op); err != nil {
+				return n, err
+			}
+		case ChainOp:
+			// Links the log to the segment it was compacted from, which "librarian verify" checks.
+		default:
+			// Ops added by newer librarians stay in history but can't be applied.
+			if op.op.newer() {
+				err = replayUnknownOp(op)
+			} else {
+				err = replayInconsistency(op, fmt.Errorf("unrecognized op type"))
+			}
+			if err != nil {
+				return n, err
+			}
+		}
 	}
-	op := &libraryOp{
-		t:      t,
-		op:     opTypeFromString(opStr),
-		uuid:   uuid,
-		label:  label,
-		client: client,
+	if unterminated != "" {
+		return n, &truncatedLineError{unterminated, fmt.Errorf("no terminating newline"), true}
 	}
-	return op, nil
+	return n, nil
 }
 
-// Writes JSON of history for a UUID into a writer.
-func writeHx(uuid string, w io.Writer) error {
-	// Read-only mode
-	f, err := os.OpenFile(library.fname, os.O_RDONLY, 0664)
+// Calls fn for each op in a librarian log file.
+func readLogOps(fname string, fn func(op *libraryOp)) error {
+	f, err := openLogFile(fname)
 	if err != nil {
-		return fmt.Errorf("cannot open librarian log file: %v", err)
+		return err
 	}
 	defer f.Close()
 	r := bufio.NewReader(f)
-
-	// Load every entry in, populating our library of reserved labels.
-	fmt.Fprintf(w, "[\n")
-	first := true
 	for {
 		line, err := r.ReadString('\n')
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
 			return err
 		}
 		op, err := parseLogLine(line)
 		if err != nil {
-			return err
-		}
-		if op.uuid == uuid {
-			tbytes, err := op.t.MarshalText()
-			if err != nil {
-				return err
-			}
-			if first {
-				fmt.Fprintf(w, "\n  {")
-			} else {
-				fmt.Fprintf(w, ",\n  {")
-			}
-			fmt.Fprintf(w, `"Time":%q, "Op":%q`, string(tbytes), op.op)
-			switch op.op {
-			case CheckoutOp, CheckinOp:
-				fmt.Fprintf(w, `, "Label":%d, "Client":%q`, op.label, op.client)
-			}
-			fmt.Fprintf(w, "}")
-			first = false
+			return fmt.Errorf("%s: %v", fname, err)
 		}
+		fn(op)
 	}
-	fmt.Fprintf(w, "]\n")
-	return nil
 }
 
-func checkout(uuid string, label uint64, clientid string, modifyLog bool) error {
-	library.Lock()
-	defer library.Unlock()
+// Returns the log line for an op done at time t.
+func formatLogLine(op *libraryOp, t time.Time) (string, error) {
+	timeBytes, err := t.UTC().MarshalText()
+	if err != nil {
+		return "", err
+	}
+	attrs := op.attrs
+	if op.seq != 0 {
+		attrs = mergeAttrs(attrs, map[string]string{SeqAttr: strconv.FormatUint(op.seq, 10)})
+	}
+	var version string
+	if op.version > 1 {
+		version = fmt.Sprintf("v%d ", op.version)
+	}
+	return fmt.Sprintf("%s%s %s %s %d %s%s\n", version, string(timeBytes), op.uuid, op.op, op.label, op.client, formatAttrs(attrs)), nil
+}
 
-	// Append to in-memory map
-	checkouts, found := library.vchk[uuid]
-	if found {
-		client, labelUsed := checkouts[label]
-		if labelUsed {
-			if client != clientid {
-				return fmt.Errorf("uuid %s, label %d - already checked out by %s", uuid, label, client)
-			}
-		} else {
-			checkouts[label] = clientid
+// Parses a log line, normalizing client ids as set by -clientnorm.  Lines of a newer
+// version than LogLineVersion are read by their version 1 fields, and ops of types added
+// by newer librarians are given new op types (see parseOpType).
+func parseLogLine(line string) (*libraryOp, error) {
+	line = strings.TrimSpace(line)
+	version := 1
+	if versionStr, rest, found := strings.Cut(line, " "); found && strings.HasPrefix(versionStr, "v") {
+		v, err := strconv.Atoi(versionStr[1:])
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("could not parse log line %q: bad version %q", line, versionStr)
 		}
-	} else {
-		checkouts = make(map[uint64]string, 100)
-		checkouts[label] = clientid
-		library.vchk[uuid] = checkouts
+		if v > LogLineVersion {
+			noteLineVersion(v)
+		}
+		version, line = v, rest
 	}
-
-	// Append to log
-	if modifyLog {
-		op := &libraryOp{
-			op:     CheckoutOp,
-			uuid:   uuid,
-			label:  label,
-			client: clientid,
+	fields := strings.SplitN(line, " ", 6)
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("could not parse log line %q", line)
+	}
+	label, err := strconv.ParseUint(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse log line %q: %v", line, err)
+	}
+	var t time.Time
+	if err := t.UnmarshalText([]byte(fields[0])); err != nil {
+		return nil, err
+	}
+	op := &libraryOp{
+		t:      t.In(displayZone),
+		op:     parseOpType(fields[2]),
+		uuid:   fields[1],
+		label:  label,
+		client: normalizeClientID(fields[4]),
+	}
+	if version > 1 {
+		op.version = version
+	}
+	if len(fields) == 6 {
+		if op.attrs, err = parseAttrs(fields[5]); err != nil {
+			if strings.Contains(fields[5], `="`) {
+				return nil, fmt.Errorf("could not parse log line %q: %v", line, err)
+			}
+			// Lines written before attributes ended at the client, ignoring anything after it.
+			op.attrs = nil
+		}
+		if holder, found := op.attrs["holder"]; found {
+			op.attrs["holder"] = normalizeClientID(holder)
+		}
+		if seqStr, found := op.attrs[SeqAttr]; found {
+			if op.seq, err = strconv.ParseUint(seqStr, 10, 64); err != nil {
+				return nil, fmt.Errorf("could not parse log line %q: bad seq: %v", line, err)
+			}
+			delete(op.attrs, SeqAttr)
 		}
-		library.write(op)
 	}
-	return nil
+	return op, nil
 }
 
-func getUUIDs() []string {
-	library.RLock()
-	defer library.RUnlock()
-
-	uuids := make([]string, len(library.vchk))
-	i := 0
-	for uuid := range library.vchk {
-		uuids[i] = uuid
-		i++
+// Formats optional op attributes as space-separated key="value" fields, sorted by key.
+func formatAttrs(attrs map[string]string) string {
+	if len(attrs) == 0 {
+		return ""
 	}
-	return uuids
-}
-
-func getUUIDsJSON() (string, error) {
-	uuids := getUUIDs()
-	jsonBytes, err := json.Marshal(uuids)
-	return string(jsonBytes), err
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%q", key, attrs[key])
+	}
+	return b.String()
 }
 
-func getCheckout(uuid string, label uint64) (client string, found bool) {
-	library.RLock()
-	defer library.RUnlock()
-
-	checkouts, uuidFound := library.vchk[uuid]
-	if uuidFound {
-		client, found = checkouts[label]
-	} else {
-		found = false
+// Returns a new map with the attributes of both maps, with b taking precedence.
+func mergeAttrs(a, b map[string]string) map[string]string {
+	merged := make(map[string]string, len(a)+len(b))
+	for key, value := range a {
+		merged[key] = value
 	}
-	return
+	for key, value := range b {
+		merged[key] = value
+	}
+	return merged
 }
 
-func getCheckouts(uuid string) (checkouts checkoutsT, found bool) {
-	library.RLock()
-	defer library.RUnlock()
-
-	checkouts, found = library.vchk[uuid]
-	return
+func parseAttrs(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return attrs, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("bad attribute %q", s)
+		}
+		key := s[:eq]
+		quoted, err := strconv.QuotedPrefix(s[eq+1:])
+		if err != nil {
+			return nil, fmt.Errorf("bad value for attribute %q: %v", key, err)
+		}
+		if attrs[key], err = strconv.Unquote(quoted); err != nil {
+			return nil, err
+		}
+		s = s[eq+1+len(quoted):]
+	}
 }
 
-func checkin(uuid string, label uint64, clientid string, modifyLog bool) error {
-	library.Lock()
+// Writes the JSON history of a uuid.  History spans any compacted log segments as well
+// as the current log.  If limit is positive, only the last limit ops are written, and
+// they come from memory if possible, as does all history of uuids in the history cache.
+func writeHx(uuid string, limit int, w io.Writer) error {
+	format := getPolicy(uuid).LabelOutput
+	if limit > 0 {
+		ops, err := readHx(uuid, limit, nil)
+		if err != nil {
+			return err
+		}
+		return writeHxOps(uuid, format, ops, w)
+	}
+	if ops, ok := cachedHx(uuid); ok {
+		return writeHxOps(uuid, format, ops, w)
+	}
+	fnames, err := historyFiles()
+	if err != nil {
+		return err
+	}
+
+	names := getLabelNamesMap(uuid)
+	fmt.Fprintf(w, "{\"UUID\":%q, \"History\":[", uuid)
+	first := true
+	opIDs := make(map[string]bool) // op ids seen so duplicated ops are skipped
+	for _, fname := range fnames {
+		err := readFileHx(fname, uuid, opIDs, func(op *libraryOp) error {
+			return writeHxOp(w, op, format, names, &first)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "\n]}\n")
+	return nil
+}
+
+// Returns the last limit history ops of a uuid, or all of them if limit isn't positive.
+// Only ops for which keep returns true are counted unless keep is nil, in which case
+// ops are read from memory when possible.  Cached histories are used either way.
+func readHx(uuid string, limit int, keep func(op *libraryOp) bool) ([]*libraryOp, error) {
+	if keep == nil {
+		if ops, ok := recentHx(uuid, limit); ok {
+			return ops, nil
+		}
+	}
+	if cached, ok := cachedHx(uuid); ok {
+		var ops []*libraryOp
+		for _, op := range cached {
+			if keep == nil || keep(op) {
+				ops = append(ops, op)
+			}
+		}
+		if limit > 0 && len(ops) > limit {
+			ops = ops[len(ops)-limit:]
+		}
+		return ops, nil
+	}
+	fnames, err := historyFiles()
+	if err != nil {
+		return nil, err
+	}
+	var ops []*libraryOp
+	opIDs := make(map[string]bool)
+	for _, fname := range fnames {
+		err := readFileHx(fname, uuid, opIDs, func(op *libraryOp) error {
+			if keep != nil && !keep(op) {
+				return nil
+			}
+			ops = append(ops, op)
+			if limit > 0 && len(ops) >= 2*limit {
+				ops = append(ops[:0], ops[len(ops)-limit:]...)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if limit > 0 && len(ops) > limit {
+		ops = ops[len(ops)-limit:]
+	}
+	return ops, nil
+}
+
+func writeHxOps(uuid, format string, ops []*libraryOp, w io.Writer) error {
+	names := getLabelNamesMap(uuid)
+	fmt.Fprintf(w, "{\"UUID\":%q, \"History\":[", uuid)
+	first := true
+	for _, op := range ops {
+		if err := writeHxOp(w, op, format, names, &first); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "\n]}\n")
+	return nil
+}
+
+// Calls fn for each history op of a uuid, or of every uuid if uuid is "", in a log file.
+// Ops with an op id already in opIDs are skipped.  Clients renamed with history are given by their current ids.
+func readFileHx(fname, uuid string, opIDs map[string]bool, fn func(op *libraryOp) error) error {
+	f, err := openLogFile(fname)
+	if err != nil {
+		return fmt.Errorf("cannot open librarian log file: %v", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	aliases := getClientAliases()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		op, err := parseLogLine(line)
+		if err != nil {
+			return err
+		}
+		if id := op.attrs["opid"]; id != "" && op.op != ConflictOp {
+			if opIDs[id] {
+				continue
+			}
+			opIDs[id] = true
+		}
+		// Restored ops are already in the history of an earlier segment.
+		if (op.uuid == uuid || (uuid == "" && !op.op.uuidless())) && !op.op.restore() {
+			if err := fn(aliases.apply(op)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeHxOp(w io.Writer, op *libraryOp, format string, names map[uint64]string, first *bool) error {
+	tbytes, err := op.t.MarshalText()
+	if err != nil {
+		return err
+	}
+	if *first {
+		fmt.Fprintf(w, "\n  {")
+	} else {
+		fmt.Fprintf(w, ",\n  {")
+	}
+	fmt.Fprintf(w, `"Time":%q`, string(tbytes))
+	if op.seq != 0 {
+		fmt.Fprintf(w, `, "Seq":%d`, op.seq)
+	}
+	fmt.Fprintf(w, `, "Op":%q`, op.op)
+	switch op.op {
+	case CheckoutOp, CheckinOp, RenewOp:
+		fmt.Fprintf(w, `, "Label":%s, "Client":%q`, formatLabelJSON(op.label, format), op.client)
+	case MetaSetOp:
+		fmt.Fprintf(w, `, "Key":%q, "Value":%q, "Client":%q`, op.attrs["key"], op.attrs["value"], op.client)
+	case MetaDeleteOp:
+		fmt.Fprintf(w, `, "Key":%q, "Client":%q`, op.attrs["key"], op.client)
+	case LabelResetOp:
+		labels := op.resetLabels()
+		strs := make([]string, len(labels))
+		for i, label := range labels {
+			strs[i] = formatLabelJSON(label, format)
+		}
+		fmt.Fprintf(w, `, "Labels":[%s], "Client":%q`, strings.Join(strs, ","), op.client)
+	case ExpireOp:
+		fmt.Fprintf(w, `, "Label":%s, "Client":%q`, formatLabelJSON(op.label, format), op.client)
+		if reason, found := op.attrs["reason"]; found {
+			fmt.Fprintf(w, `, "Reason":%q`, reason)
+		}
+	case ConflictOp:
+		fmt.Fprintf(w, `, "Label":%s, "Client":%q, "Holder":%q`, formatLabelJSON(op.label, format), op.client, op.attrs["holder"])
+	case PolicySetOp:
+		fmt.Fprintf(w, `, "Policy":%s, "Client":%q`, op.attrs["policy"], op.client)
+	case PinOp:
+		fmt.Fprintf(w, `, "Label":%s, "Reason":%q, "Client":%q`, formatLabelJSON(op.label, format), op.attrs["reason"], op.client)
+	case UnpinOp:
+		fmt.Fprintf(w, `, "Label":%s, "Client":%q`, formatLabelJSON(op.label, format), op.client)
+	case CommentOp:
+		fmt.Fprintf(w, `, "Label":%s, "Comment":%q, "Client":%q`, formatLabelJSON(op.label, format), op.attrs["text"], op.client)
+	case FreezeSetOp:
+		fmt.Fprintf(w, `, "Freeze":%q, "Schedule":%q, "Duration":%q, "Client":%q`, op.attrs["name"], op.attrs["schedule"], op.attrs["duration"], op.client)
+	case FreezeDeleteOp:
+		fmt.Fprintf(w, `, "Freeze":%q, "Client":%q`, op.attrs["name"], op.client)
+	case SupersedeOp:
+		newLabel, _ := strconv.ParseUint(op.attrs["new"], 10, 64)
+		fmt.Fprintf(w, `, "Label":%s, "SupersededBy":%s, "Client":%q`, formatLabelJSON(op.label, format), formatLabelJSON(newLabel, format), op.client)
+	default:
+		if op.op.newer() {
+			fmt.Fprintf(w, `, "Label":%s, "Client":%q`, formatLabelJSON(op.label, format), op.client)
+		}
+	}
+	if name, found := names[op.label]; found && op.label != 0 {
+		fmt.Fprintf(w, `, "Name":%q`, name)
+	}
+	if expiresStr, found := op.attrs["expires"]; found {
+		var expires time.Time
+		if err := expires.UnmarshalText([]byte(expiresStr)); err == nil {
+			expiresBytes, _ := expires.In(displayZone).MarshalText()
+			expiresStr = string(expiresBytes)
+		}
+		fmt.Fprintf(w, `, "Expires":%q`, expiresStr)
+	}
+	if agent, found := op.attrs["agent"]; found {
+		fmt.Fprintf(w, `, "Agent":%q`, agent)
+	}
+	if tool, found := op.attrs["tool"]; found {
+		fmt.Fprintf(w, `, "Tool":%q`, tool)
+	}
+	if principal, found := op.attrs["principal"]; found {
+		fmt.Fprintf(w, `, "Principal":%q`, principal)
+	}
+	if ip, found := op.attrs["ip"]; found {
+		fmt.Fprintf(w, `, "IP":%q`, ip)
+	}
+	if opID, found := op.attrs["opid"]; found {
+		fmt.Fprintf(w, `, "OpID":%q`, opID)
+	}
+	if ref, found := op.attrs["ref"]; found {
+		fmt.Fprintf(w, `, "Ref":%q`, ref)
+	}
+	if task, found := op.attrs["task"]; found {
+		fmt.Fprintf(w, `, "Task":%q`, task)
+	}
+	if ctx, found := op.attrs["context"]; found {
+		fmt.Fprintf(w, `, "Context":%q`, ctx)
+	}
+	if txn, found := op.attrs["txn"]; found {
+		fmt.Fprintf(w, `, "Txn":%q`, txn)
+	}
+	if op.attrs["rollback"] == "true" {
+		fmt.Fprintf(w, `, "Rollback":true`)
+	}
+	fmt.Fprintf(w, "}")
+	*first = false
+	return nil
+}
+
+// Notes an op applied to a uuid.  Must be called with library lock held.
+func (lib *libraryT) bumpRevision(uuid string) {
+	lib.revs[uuid]++
+	lib.revision++
+	invalidateView(uuid)
+}
+
+// Reverts bumpRevision for a change undone because its op couldn't be logged.  Must be
+// called with library lock held.
+func (lib *libraryT) unbumpRevision(uuid string) {
+	if lib.revs[uuid]--; lib.revs[uuid] == 0 {
+		delete(lib.revs, uuid)
+	}
+	lib.revision--
+	invalidateView(uuid)
+}
+
+// Sets a uuid's revision from a compacted log.
+func restoreRevision(op *libraryOp) error {
+	rev, err := strconv.ParseUint(op.attrs["rev"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad revision for uuid %s: %v", op.uuid, err)
+	}
+	library.Lock()
 	defer library.Unlock()
 
-	// Remove from in-memory map
-	checkouts, found := library.vchk[uuid]
+	library.revision += rev - library.revs[op.uuid]
+	library.revs[op.uuid] = rev
+	invalidateView(op.uuid)
+	return nil
+}
+
+// Writes all uuid revisions into a compacted log.  Must be called with library lock held.
+func (lib *libraryT) writeRevisionRestores() error {
+	for uuid, rev := range lib.revs {
+		op := &libraryOp{
+			op:     RevisionOp,
+			uuid:   uuid,
+			client: "n/a",
+			attrs:  map[string]string{"rev": strconv.FormatUint(rev, 10)},
+		}
+		if err := lib.write(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkout(uuid string, label uint64, clientid string, attrs map[string]string, modifyLog bool) (bool, error) {
+	return checkoutAt(clock.Now(), uuid, label, clientid, attrs, modifyLog)
+}
+
+// Notes client activity at time t.  Must be called with library lock held.
+func (lib *libraryT) clientStats(clientid string, t time.Time) *clientStatsT {
+	stats, found := lib.clients[clientid]
+	if !found {
+		stats = &clientStatsT{}
+		lib.clients[clientid] = stats
+	}
+	if t.After(stats.lastActive) {
+		stats.lastActive = t
+	}
+	return stats
+}
+
+// Checks out a label as of time t, which is the op time when replaying the log.  Returns
+// true if the client already held the label, which is logged as set by -recheckout.
+func checkoutAt(t time.Time, uuid string, label uint64, clientid string, attrs map[string]string, modifyLog bool) (bool, error) {
+	library.Lock()
+	defer library.Unlock()
+	return library.checkout(t, uuid, label, clientid, attrs, modifyLog)
+}
+
+// checkoutReqT is a checkout requested by a client.
+type checkoutReqT struct {
+	uuid    string
+	label   uint64
+	client  string
+	ttl     time.Duration     // overrides the policy TTL if not zero
+	attrs   map[string]string // request attributes, without the expiration added at checkout
+	meta    map[string]string // metadata set along with the checkout
+	resolve bool              // check out a superseded label as its current id
+}
+
+// Checks out a label for a client request, setting any metadata given with it, and returns
+// the label checked out, which is the current id of a superseded label if resolving.  The
+// label is resolved, its holder, any op id, and the uuid's policy checked, and the metadata
+// set in the same locked section as the checkout.
+func requestCheckout(req *checkoutReqT) (label uint64, held bool, err error) {
+	library.Lock()
+	defer library.Unlock()
+
+	uuid, label, clientid := req.uuid, req.label, req.client
+	if req.resolve {
+		label = library.resolveLabel(uuid, label)
+		if holder, heldLabel, found := library.resolvedHolder(uuid, label, clientid); found {
+			return label, false, &ErrAlreadyCheckedOut{uuid, heldLabel, holder}
+		}
+	}
+	if err := library.checkOpID(CheckoutOp, uuid, label, clientid, "", req.attrs); err != nil {
+		return label, false, err
+	}
+	if err := library.checkCheckoutPolicy(uuid, clientid, []uint64{label}); err != nil {
+		return label, false, err
+	}
+	if err := library.checkCheckoutQuota(uuid, clientid, []uint64{label}); err != nil {
+		return label, false, err
+	}
+	// The expiration is from now, not the request, which may have waited for the label.
+	t := clock.Now()
+	attrs := library.checkoutAttrs(t, uuid, req.ttl, req.attrs)
+	held, err = library.checkout(t, uuid, label, clientid, attrs, true)
+	if err != nil || len(req.meta) == 0 {
+		return label, held, err
+	}
+
+	// The op id belongs to the checkout, so it isn't recorded for the metadata ops.
+	metaAttrs := mergeAttrs(req.attrs, nil)
+	delete(metaAttrs, "opid")
+	keys := make([]string, 0, len(req.meta))
+	for key := range req.meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := library.setMeta(t, uuid, key, req.meta[key], clientid, metaAttrs, true); err != nil {
+			return label, held, fmt.Errorf("checked out but unable to set metadata: %w", err)
+		}
+	}
+	return label, held, nil
+}
+
+// Checks out a label as of time t.  Must be called with library lock held.
+func (lib *libraryT) checkout(t time.Time, uuid string, label uint64, clientid string, attrs map[string]string, modifyLog bool) (bool, error) {
+	if modifyLog {
+		if err := lib.checkPinned(uuid, label); err != nil {
+			return false, err
+		}
+		if err := lib.checkFrozen(t, uuid, label); err != nil {
+			return false, err
+		}
+	}
+	var expires time.Time
+	if expiresStr, found := attrs["expires"]; found {
+		if err := expires.UnmarshalText([]byte(expiresStr)); err != nil {
+			return false, fmt.Errorf("bad expiration %q for uuid %s, label %d: %v", expiresStr, uuid, label, err)
+		}
+		expires = expires.In(displayZone)
+	}
+
+	// Append to in-memory map
+	held := false
+	prev, prevFound := lib.vchk[uuid][label]
+	checkouts, found := lib.vchk[uuid]
 	if found {
-		client, labelUsed := checkouts[label]
+		co, labelUsed := checkouts[label]
+		if labelUsed && co.client != clientid && modifyLog && co.expired(t, lib.policies[uuid].grace()) {
+			if err := lib.expire(t, uuid, label, modifyLog); err != nil {
+				return false, err
+			}
+			labelUsed, prevFound = false, false
+		}
 		if labelUsed {
-			if client != clientid {
-				return fmt.Errorf("uuid %s, label %d checked out to %s, not %s so cannot checkin", uuid, label, client, clientid)
+			if co.client != clientid {
+				return false, &ErrAlreadyCheckedOut{uuid, label, co.client}
+			}
+			held = true
+			if !expires.IsZero() {
+				co.expires = expires // renewal extends the lease
+				co.warned = false
+				checkouts[label] = co
 			}
-			delete(library.vchk[uuid], label)
 		} else {
-			return fmt.Errorf("uuid %s, label %d has not been checked out so can't be checked in by %s", uuid, label, client)
+			checkouts[label] = checkoutT{client: clientid, t: t, expires: expires}
 		}
 	} else {
-		return fmt.Errorf("uuid %s has no active checkout so can't checkin label %d, client %s", uuid, label, clientid)
+		checkouts = make(checkoutsT, 100)
+		checkouts[label] = checkoutT{client: clientid, t: t, expires: expires}
+		lib.vchk[uuid] = checkouts
+	}
+
+	opT := CheckoutOp
+	if held && modifyLog {
+		switch *recheckout {
+		case RecheckoutRenew:
+			opT = RenewOp
+		case RecheckoutDedupe, RecheckoutHeld:
+			if expires.IsZero() {
+				lib.clientStats(clientid, t)
+				return true, nil // nothing changed
+			}
+			opT = RenewOp
+		}
+	}
+	lib.bumpRevision(uuid)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     opT,
+			uuid:   uuid,
+			label:  label,
+			client: clientid,
+			attrs:  attrs,
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the checkout so state matches the log.
+			if prevFound {
+				checkouts[label] = prev
+			} else if delete(checkouts, label); !found {
+				delete(lib.vchk, uuid)
+			}
+			lib.unbumpRevision(uuid)
+			return false, err
+		}
+	}
+	lib.clientStats(clientid, t)
+	lib.noteTool(clientid, attrs, t)
+	lib.noteAssignment(uuid, label, attrs)
+	return held, nil
+}
+
+func getUUIDs() []string {
+	library.RLock()
+	defer library.RUnlock()
+
+	uuids := make([]string, len(library.vchk))
+	i := 0
+	for uuid := range library.vchk {
+		uuids[i] = uuid
+		i++
+	}
+	return uuids
+}
+
+// Returns the UUIDs with reserved labels, sorted.
+func getUUIDsState() uuidsJSON {
+	library.RLock()
+	uuids := make([]string, 0, len(library.vchk))
+	for uuid, checkouts := range library.vchk {
+		if len(checkouts) > 0 {
+			uuids = append(uuids, uuid)
+		}
+	}
+	library.RUnlock()
+
+	sort.Strings(uuids)
+	return uuidsJSON{uuids}
+}
+
+// Returns the UUIDs with reserved labels and those that only have history, both sorted.
+func getHistoricalUUIDs() historicalUUIDsJSON {
+	state := historicalUUIDsJSON{UUIDs: getUUIDsState().UUIDs, Historical: []string{}}
+
+	library.RLock()
+	for uuid := range library.revs {
+		if len(library.vchk[uuid]) == 0 {
+			state.Historical = append(state.Historical, uuid)
+		}
+	}
+	library.RUnlock()
+
+	sort.Strings(state.Historical)
+	return state
+}
+
+// Returns true if any op has been applied to the uuid, even if it has no checkouts now.
+func knownUUID(uuid string) bool {
+	return getView(uuid).known
+}
+
+func getCheckout(uuid string, label uint64) (client string, found bool) {
+	co, found := getView(uuid).holders[label]
+	return co.client, found
+}
+
+// Records a refused checkout in the log and sends a conflict event to the holder.
+func logConflict(uuid string, label uint64, clientid, holder string, attrs map[string]string) {
+	library.Lock()
+	defer library.Unlock()
+
+	op := &libraryOp{
+		op:     ConflictOp,
+		uuid:   uuid,
+		label:  label,
+		client: clientid,
+		attrs:  mergeAttrs(attrs, map[string]string{"holder": holder}),
 	}
+	library.write(op)
+
+	if co, found := library.vchk[uuid][label]; found && co.client == holder {
+		ev := checkoutEvent(ConflictEvent, uuid, labelJSON{label, library.policies[uuid].labelOutput()}, co)
+		ev.Requester = clientid
+		sendEvent(ev)
+	}
+}
+
+// Bounds on the estimated time until a conflicting lock is released.
+const (
+	MinRetryAfter     = 5 * time.Second
+	DefaultRetryAfter = 30 * time.Second
+)
+
+// conflictJSON describes a conflicting lock so clients can back off intelligently.
+type conflictJSON struct {
+	Error             string
+	Code              string // AlreadyCheckedOutCode
+	Label             labelJSON
+	Client            string     // current holder of the lock
+	Since             time.Time  // when the lock was acquired
+	Expires           *time.Time `json:",omitempty"` // when the lock's lease runs out
+	GraceEnds         *time.Time `json:",omitempty"` // when others can check out the label
+	AgeSeconds        float64
+	HolderLastActive  time.Time
+	EstimatedRelease  time.Time
+	RetryAfterSeconds int
+}
+
+// Returns information on the current lock of a label, including an estimated release
+// time based on how long the holder has kept previous locks.
+func getConflict(uuid string, label uint64) (conflict *conflictJSON, found bool) {
+	policy := getPolicy(uuid)
+	format := policy.LabelOutput
+
+	library.RLock()
+	defer library.RUnlock()
+
+	co, found := library.vchk[uuid][label]
+	if !found {
+		return nil, false
+	}
+	release := co.expires // others can check out the label after any grace period
+	if !release.IsZero() {
+		release = release.Add(policy.grace())
+	}
+	now := clock.Now()
+	age := now.Sub(co.t)
+	retry := DefaultRetryAfter
+	stats := library.clients[co.client]
+	if stats != nil && stats.holds > 0 {
+		retry = stats.holdTime/time.Duration(stats.holds) - age
+	}
+	if retry < MinRetryAfter {
+		retry = MinRetryAfter
+	}
+	if !release.IsZero() && release.Sub(now) < retry {
+		retry = release.Sub(now)
+		if retry < time.Second {
+			retry = time.Second
+		}
+	}
+	conflict = &conflictJSON{
+		Label:             labelJSON{label, format},
+		Client:            co.client,
+		Since:             co.t,
+		AgeSeconds:        age.Seconds(),
+		EstimatedRelease:  now.Add(retry),
+		RetryAfterSeconds: int((retry + time.Second - 1) / time.Second),
+	}
+	if stats != nil {
+		conflict.HolderLastActive = stats.lastActive
+	}
+	if !co.expires.IsZero() {
+		conflict.Expires = &co.expires
+		if !release.Equal(co.expires) {
+			conflict.GraceEnds = &release
+		}
+	}
+	return conflict, true
+}
+
+// Returns the checkouts for a uuid sorted by label.  A uuid without checkouts has an
+// empty list.
+func getState(uuid string) stateJSON {
+	return stateJSON{UUID: uuid, Checkouts: sortedCheckouts(uuid, SortByLabel, false)}
+}
+
+// Returns up to limit checkouts for a uuid, after skipping offset of them, in the given
+// order.  If limit isn't positive, all checkouts after offset are returned.
+func getStatePage(uuid, sortBy string, offset, limit int, resolve bool) statePageJSON {
+	checkouts := sortedCheckouts(uuid, sortBy, resolve)
+	page := statePageJSON{UUID: uuid, Total: len(checkouts), Offset: offset, Pinned: getPins(uuid), Intents: getIntents(uuid)}
+	if offset > len(checkouts) {
+		offset = len(checkouts)
+	}
+	checkouts = checkouts[offset:]
+	if limit > 0 && limit < len(checkouts) {
+		checkouts = checkouts[:limit]
+	}
+	page.Checkouts = checkouts
+	return page
+}
+
+func getStateCount(uuid string) stateCountJSON {
+	return stateCountJSON{uuid, len(getView(uuid).labels)}
+}
+
+// Returns the checkouts for a uuid in the given order, which must be SortByLabel,
+// SortByClient, or SortByAge.  Ties are broken by label.  If resolve, superseded labels are
+// listed under their current id.
+func sortedCheckouts(uuid, sortBy string, resolve bool) []reserveJSON {
+	if !resolve {
+		return viewCheckouts(getView(uuid), sortBy)
+	}
+	format := getPolicy(uuid).LabelOutput
+
+	library.RLock()
+	checkouts := make([]reserveJSON, 0, len(library.vchk[uuid]))
+	since := make(map[uint64]time.Time, len(library.vchk[uuid]))
+	names := library.labelNames(uuid)
+	for label, co := range library.vchk[uuid] {
+		rsv := reserveJSON{Label: labelJSON{label, format}, Client: co.client}
+		if current := library.resolveLabel(uuid, label); resolve && current != label {
+			rsv.Label.label = current
+			rsv.Superseded = &labelJSON{label, format}
+		}
+		rsv.Name = names[rsv.Label.label]
+		checkouts = append(checkouts, rsv)
+		since[label] = co.t
+	}
+	library.RUnlock()
+
+	sort.Slice(checkouts, func(i, j int) bool {
+		a, b := checkouts[i], checkouts[j]
+		switch sortBy {
+		case SortByClient:
+			if a.Client != b.Client {
+				return a.Client < b.Client
+			}
+		case SortByAge:
+			if ta, tb := since[a.held()], since[b.held()]; !ta.Equal(tb) {
+				return ta.Before(tb)
+			}
+		}
+		if a.Label.label != b.Label.label {
+			return a.Label.label < b.Label.label
+		}
+		return a.held() < b.held()
+	})
+	return checkouts
+}
+
+func checkin(uuid string, label uint64, clientid string, attrs map[string]string, modifyLog bool) error {
+	return checkinAt(clock.Now(), uuid, label, clientid, attrs, modifyLog)
+}
+
+// Checks in a label as of time t, which is the op time when replaying the log.
+func checkinAt(t time.Time, uuid string, label uint64, clientid string, attrs map[string]string, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+	if modifyLog {
+		if err := library.checkOpID(CheckinOp, uuid, label, clientid, "", attrs); err != nil {
+			return err
+		}
+	}
+	return library.checkin(t, uuid, label, clientid, attrs, modifyLog)
+}
+
+// Checks in a label as of time t.  Must be called with library lock held.
+func (lib *libraryT) checkin(t time.Time, uuid string, label uint64, clientid string, attrs map[string]string, modifyLog bool) error {
+	// Remove from in-memory map
+	co, found := lib.vchk[uuid][label]
+	if !found {
+		return fmt.Errorf("uuid %s, label %d has %w so can't be checked in by %s", uuid, label, ErrNotCheckedOut, clientid)
+	}
+	if co.client != clientid {
+		return &ErrWrongClient{uuid, label, co.client, clientid}
+	}
+	delete(lib.vchk[uuid], label)
+	lib.bumpRevision(uuid)
 
 	// Append to log
 	if modifyLog {
 		op := &libraryOp{
+			t:      t,
 			op:     CheckinOp,
 			uuid:   uuid,
 			label:  label,
 			client: clientid,
+			attrs:  attrs,
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the checkin so state matches the log.
+			lib.vchk[uuid][label] = co
+			lib.unbumpRevision(uuid)
+			return err
 		}
-		library.write(op)
 	}
+	stats := lib.clientStats(clientid, t)
+	stats.holds++
+	stats.holdTime += t.Sub(co.t)
+	lib.noteTool(clientid, attrs, t)
 	return nil
 }
 
-func reset(uuid string, modifyLog bool) error {
+// releasedJSON is a checkout released regardless of its holder.
+type releasedJSON struct {
+	Label  labelJSON
+	Client string
+}
+
+type resetLabelsJSON struct {
+	UUID          string
+	Released      []releasedJSON
+	NotCheckedOut []labelJSON
+}
+
+// Parses the comma-separated decimal labels of a reset-labels op.
+func parseLabelList(s string) ([]uint64, error) {
+	var labels []uint64
+	for _, labelStr := range strings.Split(s, ",") {
+		label, err := strconv.ParseUint(labelStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad label %q in label list: %v", labelStr, err)
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// Returns the labels released by a reset-labels op.
+func (op *libraryOp) resetLabels() []uint64 {
+	labels, _ := parseLabelList(op.attrs["labels"])
+	return labels
+}
+
+func formatLabelList(labels []uint64) string {
+	strs := make([]string, len(labels))
+	for i, label := range labels {
+		strs[i] = strconv.FormatUint(label, 10)
+	}
+	return strings.Join(strs, ",")
+}
+
+func resetLabels(uuid string, labels []uint64, clientid string, attrs map[string]string, modifyLog bool) (resetLabelsJSON, error) {
+	return resetLabelsAt(clock.Now(), uuid, labels, clientid, attrs, modifyLog)
+}
+
+// Releases the given labels of a uuid whoever holds them, logging them all as one op by
+// the client doing the reset.  Nothing is logged if none of the labels were checked out.
+func resetLabelsAt(t time.Time, uuid string, labels []uint64, clientid string, attrs map[string]string, modifyLog bool) (resetLabelsJSON, error) {
+	library.Lock()
+	defer library.Unlock()
+
+	if modifyLog {
+		if err := library.checkOpID(LabelResetOp, uuid, 0, clientid, "", attrs); err != nil {
+			return resetLabelsJSON{}, err
+		}
+	}
+	format := library.policies[uuid].labelOutput()
+	result := resetLabelsJSON{UUID: uuid, Released: []releasedJSON{}, NotCheckedOut: []labelJSON{}}
+	var released []uint64
+	var cos []checkoutT
+	for _, label := range labels {
+		co, found := library.vchk[uuid][label]
+		if !found {
+			result.NotCheckedOut = append(result.NotCheckedOut, labelJSON{label, format})
+			continue
+		}
+		delete(library.vchk[uuid], label)
+		released = append(released, label)
+		cos = append(cos, co)
+		result.Released = append(result.Released, releasedJSON{labelJSON{label, format}, co.client})
+	}
+	if len(released) == 0 {
+		return result, nil
+	}
+	library.bumpRevision(uuid)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     LabelResetOp,
+			uuid:   uuid,
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"labels": formatLabelList(released)}),
+		}
+		if err := library.write(op); err != nil {
+			// Undo the releases so state matches the log.
+			for i, label := range released {
+				library.vchk[uuid][label] = cos[i]
+			}
+			library.unbumpRevision(uuid)
+			return resetLabelsJSON{}, err
+		}
+		for i, label := range released {
+			if cos[i].client != clientid {
+				publishReleaseEvent(uuid, labelJSON{label, format}, cos[i], clientid)
+			}
+		}
+		log.Printf("Reset %d labels of uuid %s for %s\n", len(released), uuid, clientid)
+	}
+	return result, nil
+}
+
+// staleCheckoutJSON is a checkout released, or that would be released, by releaseStale.
+type staleCheckoutJSON struct {
+	Label      labelJSON
+	Client     string
+	CheckedOut time.Time
+	Age        string
+}
+
+type releaseStaleJSON struct {
+	UUID      string
+	OlderThan string
+	DryRun    bool
+	Released  []staleCheckoutJSON
+}
+
+// Checks in all labels of a uuid checked out for at least olderThan, logging each as a
+// checkin by its holder.  If dryRun, only returns the labels that would be checked in.
+func releaseStale(uuid string, olderThan time.Duration, dryRun bool, attrs map[string]string) releaseStaleJSON {
 	library.Lock()
 	defer library.Unlock()
 
+	result := releaseStaleJSON{UUID: uuid, OlderThan: olderThan.String(), DryRun: dryRun, Released: []staleCheckoutJSON{}}
+	now := clock.Now()
+	format := library.policies[uuid].labelOutput()
+	var labels []uint64
+	for label, co := range library.vchk[uuid] {
+		if now.Sub(co.t) >= olderThan {
+			labels = append(labels, label)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+
+	for _, label := range labels {
+		co := library.vchk[uuid][label]
+		age := now.Sub(co.t).Round(time.Second)
+		result.Released = append(result.Released, staleCheckoutJSON{labelJSON{label, format}, co.client, co.t, age.String()})
+		if dryRun {
+			continue
+		}
+		delete(library.vchk[uuid], label)
+		library.bumpRevision(uuid)
+
+		op := &libraryOp{
+			t:      now,
+			op:     CheckinOp,
+			uuid:   uuid,
+			label:  label,
+			client: co.client,
+			attrs:  attrs,
+		}
+		if err := library.write(op); err != nil {
+			// Undo the release so state matches the log, and stop releasing.
+			library.vchk[uuid][label] = co
+			library.unbumpRevision(uuid)
+			log.Printf("ERROR: unable to release stale checkout of uuid %s, label %d: %v\n", uuid, label, err)
+			result.Released = result.Released[:len(result.Released)-1]
+			break
+		}
+		stats := library.clientStats(co.client, now)
+		stats.holds++
+		stats.holdTime += now.Sub(co.t)
+		publishReleaseEvent(uuid, labelJSON{label, format}, co, attrs["released-by"])
+	}
+	if !dryRun && len(result.Released) > 0 {
+		log.Printf("Released %d checkouts of uuid %s older than %s\n", len(result.Released), uuid, olderThan)
+	}
+	return result
+}
+
+func reset(uuid string, attrs map[string]string, modifyLog bool) error {
+	return resetAs(ResetOp, uuid, attrs, modifyLog)
+}
+
+// Resets all checkouts for a uuid, recording the given reset op type in the log.
+func resetAs(opT opType, uuid string, attrs map[string]string, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+
+	if modifyLog {
+		if err := library.checkOpID(opT, uuid, 0, "n/a", "", attrs); err != nil {
+			return err
+		}
+	}
+
 	// Delete all in-memory checkouts for this uuid
+	checkouts, found := library.vchk[uuid]
 	delete(library.vchk, uuid)
+	library.bumpRevision(uuid)
 
 	// Append to log
 	if modifyLog {
 		op := &libraryOp{
-			op:     ResetOp,
+			op:     opT,
 			uuid:   uuid,
 			client: "n/a",
+			attrs:  attrs,
+		}
+		if err := library.write(op); err != nil {
+			// Undo the reset so state matches the log.
+			if found {
+				library.vchk[uuid] = checkouts
+			}
+			library.unbumpRevision(uuid)
+			return err
+		}
+		format := library.policies[uuid].labelOutput()
+		for label, co := range checkouts {
+			publishReleaseEvent(uuid, labelJSON{label, format}, co, "")
 		}
-		library.write(op)
 	}
 	return nil
 }
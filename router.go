@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const routerHelp = `
+Usage: librarian router [options]
+
+Serves one address for librarians sharded by UUID, forwarding each request on a UUID to its
+shard.  New UUIDs are placed by consistent hashing of the shard URLs, so adding or removing
+a shard only moves about 1/N of them.  UUIDs a shard already has, with checkouts or history,
+keep going to it when shards are added, so locks on a UUID are never split across shards.
+The UUIDs of each shard are refetched every -refresh and before shards change.  UUIDs of a
+removed shard go to the shard picked by hashing, and their count is logged.
+
+Requests on a UUID, like /checkout/{UUID}/{Label}/{Client}, /state/{UUID}, and the PUT
+/checkout, /checkin, and /reset JSON bodies, are forwarded with their headers, including
+any Authorization, and answered with an X-Librarian-Shard header.  GET /uuids and GET
+/stats/conflicts are sent to every shard and the results combined, including paging of
+/uuids?detail=true.  Other requests, like /events or /admin, aren't on a UUID and return a
+404 status, so send them to a shard.  UUIDs are hashed as given, so clients must not mix
+abbreviated and full UUIDs.
+
+The router also serves:
+
+  GET /router/shards             The shards, the UUIDs known on each, and any error listing them.
+  GET /router/shard/{UUID}       The shard a UUID goes to.
+
+      -http          =string   Address for HTTP communication.  Default is "localhost:8000".
+      -shards        =string   Comma-separated shard URLs, e.g., "http://lib1:8000,http://lib2:8000".
+      -shardfile     =string   File with a shard URL per line, used instead of -shards and
+                                 checked for changes every -refresh.  Lines starting with "#"
+                                 are ignored.
+      -replicas      =number   Points of each shard on the hash ring.  Default 128.
+      -refresh       =duration How often UUIDs of shards are refetched.  Default "1m".
+      -tokenfile     =string   File with a bearer token the router uses to list UUIDs on
+                                 shards that require auth.
+  -h, -help          (flag)    Show help message
+`
+
+const (
+	// DefaultRouterReplicas is the default number of points of each shard on the hash ring.
+	DefaultRouterReplicas = 128
+
+	// RouterTimeout is the longest the router waits for a shard to list or count UUIDs.
+	RouterTimeout = 30 * time.Second
+
+	// RouterShardHeader is the response header with the URL of the shard that answered.
+	RouterShardHeader = "X-Librarian-Shard"
+)
+
+// First path elements of requests that have the uuid as the second element.
+var routedPaths = map[string]bool{
+	"state":    true,
+	"checkout": true,
+	"checkin":  true,
+	"reset":    true,
+	"history":  true,
+	"meta":     true,
+	"diff":     true,
+	"remind":   true,
+	"intent":   true,
+	"comments": true,
+	"names":    true,
+}
+
+type ringPointT struct {
+	hash  uint64
+	shard string
+}
+
+// routerT forwards requests to shards by uuid.
+type routerT struct {
+	sync.RWMutex
+	shards    []string
+	ring      []ringPointT
+	placed    map[string]string // shard that has each uuid
+	proxies   map[string]*httputil.ReverseProxy
+	errors    map[string]string // error listing each shard's uuids at the last refresh
+	refreshed time.Time
+
+	replicas int
+	token    string
+	client   *http.Client
+}
+
+type routerShardJSON struct {
+	URL   string
+	UUIDs int
+	Error string `json:",omitempty"`
+}
+
+type routerShardsJSON struct {
+	Shards    []routerShardJSON
+	Replicas  int
+	Refreshed time.Time
+}
+
+type routedUUIDKey struct{}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Returns the points of shards on a hash ring, sorted.
+func hashRing(shards []string, replicas int) []ringPointT {
+	ring := make([]ringPointT, 0, len(shards)*replicas)
+	for _, shard := range shards {
+		for i := 0; i < replicas; i++ {
+			ring = append(ring, ringPointT{ringHash(shard + "#" + strconv.Itoa(i)), shard})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].shard < ring[j].shard
+	})
+	return ring
+}
+
+// Returns the shard of the first ring point at or after a uuid's hash, or "" if there
+// are no shards.
+func ringShard(ring []ringPointT, uuid string) string {
+	if len(ring) == 0 {
+		return ""
+	}
+	h := ringHash(uuid)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].shard
+}
+
+// Checks and sorts shard URLs, ignoring blank lines and "#" comments.
+func parseShards(list []string) ([]string, error) {
+	found := make(map[string]bool)
+	var shards []string
+	for _, shard := range list {
+		shard = strings.TrimSpace(shard)
+		if shard == "" || strings.HasPrefix(shard, "#") {
+			continue
+		}
+		u, err := url.Parse(shard)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("bad shard %q: must be a URL like \"http://lib1:8000\"", shard)
+		}
+		shard = strings.TrimSuffix(shard, "/")
+		if !found[shard] {
+			found[shard] = true
+			shards = append(shards, shard)
+		}
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards given")
+	}
+	sort.Strings(shards)
+	return shards, nil
+}
+
+func readShardFile(fname string) ([]string, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return parseShards(strings.Split(string(data), "\n"))
+}
+
+// Returns the shard a uuid goes to: the one that has it, or else the one picked by hashing.
+func (rt *routerT) shardFor(uuid string) string {
+	rt.RLock()
+	defer rt.RUnlock()
+	if shard, found := rt.placed[uuid]; found {
+		return shard
+	}
+	return ringShard(rt.ring, uuid)
+}
+
+// Notes that a shard now has a uuid, e.g., after the first checkout of a new uuid.
+func (rt *routerT) notePlaced(uuid, shard string) {
+	rt.Lock()
+	defer rt.Unlock()
+	if _, found := rt.placed[uuid]; !found {
+		rt.placed[uuid] = shard
+	}
+}
+
+// Sends a GET to a shard with the Authorization of a request, or the router's token if
+// the request is nil, and returns the body of a 200 response.
+func (rt *routerT) get(shard, path string, r *http.Request) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, shard+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if r != nil {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+	} else if rt.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rt.token)
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errJSON errorJSON
+		if json.Unmarshal(body, &errJSON) == nil && errJSON.Error != "" {
+			return nil, fmt.Errorf("%s returned status %d: %s", shard, resp.StatusCode, errJSON.Error)
+		}
+		return nil, fmt.Errorf("%s returned status %d", shard, resp.StatusCode)
+	}
+	return body, nil
+}
+
+// Sends a GET to every shard at once, returning the bodies in shard order or the first
+// error.
+func (rt *routerT) getAll(path string, r *http.Request) ([][]byte, error) {
+	rt.RLock()
+	shards := rt.shards
+	rt.RUnlock()
+
+	bodies := make([][]byte, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard string) {
+			defer wg.Done()
+			bodies[i], errs[i] = rt.get(shard, path, r)
+		}(i, shard)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bodies, nil
+}
+
+// Sets the shards after refetching the uuids each has.  A shard whose uuids can't be
+// listed keeps those it had.
+func (rt *routerT) refresh(shards []string) {
+	uuids := make([][]string, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard string) {
+			defer wg.Done()
+			body, err := rt.get(shard, "/uuids?include-historical=true", nil)
+			if err == nil {
+				var listing historicalUUIDsJSON
+				if err = json.Unmarshal(body, &listing); err == nil {
+					uuids[i] = append(listing.UUIDs, listing.Historical...)
+				}
+			}
+			errs[i] = err
+		}(i, shard)
+	}
+	wg.Wait()
+
+	ring := hashRing(shards, rt.replicas)
+	rt.Lock()
+	defer rt.Unlock()
+
+	member := make(map[string]bool, len(shards))
+	placed := make(map[string]string, len(rt.placed))
+	errors := make(map[string]string)
+	for i, shard := range shards {
+		member[shard] = true
+		if errs[i] != nil {
+			errors[shard] = errs[i].Error()
+			log.Printf("ERROR: unable to list UUIDs of shard %s: %v\n", shard, errs[i])
+		}
+	}
+	for uuid, shard := range rt.placed {
+		if member[shard] && errors[shard] != "" {
+			placed[uuid] = shard
+		}
+	}
+	for i, shard := range shards {
+		for _, uuid := range uuids[i] {
+			if other, found := placed[uuid]; found && other != shard {
+				log.Printf("WARNING: uuid %s is on shards %s and %s\n", uuid, other, shard)
+				if ringShard(ring, uuid) != shard {
+					continue
+				}
+			}
+			placed[uuid] = shard
+		}
+	}
+	moved := 0
+	for uuid, shard := range rt.placed {
+		if _, found := placed[uuid]; !found && !member[shard] {
+			moved++
+		}
+	}
+	if moved > 0 {
+		log.Printf("WARNING: %d UUIDs of removed shards now go to the shards picked by hashing\n", moved)
+	}
+	if strings.Join(shards, ",") != strings.Join(rt.shards, ",") {
+		log.Printf("Routing to %d shards: %s\n", len(shards), strings.Join(shards, ", "))
+	}
+
+	proxies := make(map[string]*httputil.ReverseProxy, len(shards))
+	for _, shard := range shards {
+		if proxy, found := rt.proxies[shard]; found {
+			proxies[shard] = proxy
+		} else {
+			proxies[shard] = rt.newProxy(shard)
+		}
+	}
+	rt.shards, rt.ring, rt.placed, rt.proxies, rt.errors = shards, ring, placed, proxies, errors
+	rt.refreshed = time.Now()
+}
+
+func (rt *routerT) newProxy(shard string) *httputil.ReverseProxy {
+	u, _ := url.Parse(shard)
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.FlushInterval = -1
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		resp.Header.Set(RouterShardHeader, shard)
+		uuid, _ := resp.Request.Context().Value(routedUUIDKey{}).(string)
+		if uuid != "" && resp.Request.Method != http.MethodGet && resp.StatusCode < 300 {
+			rt.notePlaced(uuid, shard)
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		errorMsg := fmt.Sprintf("unable to reach shard %s: %v (%s).", shard, err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusBadGateway, errorMsg)
+	}
+	return proxy
+}
+
+func (rt *routerT) getShards() routerShardsJSON {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	counts := make(map[string]int)
+	for _, shard := range rt.placed {
+		counts[shard]++
+	}
+	shards := routerShardsJSON{Replicas: rt.replicas, Refreshed: rt.refreshed}
+	for _, shard := range rt.shards {
+		shards.Shards = append(shards.Shards, routerShardJSON{shard, counts[shard], rt.errors[shard]})
+	}
+	return shards
+}
+
+// Returns the uuid of a request on one, or "" for other requests.  The PUT /checkout,
+// /checkin, and /reset JSON bodies are read for their uuid and left to be forwarded.
+func routedUUID(r *http.Request) (string, error) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) >= 3 && parts[0] == "federated" && parts[1] == "state" {
+		return parts[2], nil
+	}
+	if !routedPaths[parts[0]] {
+		return "", nil
+	}
+	if len(parts) >= 2 {
+		return parts[1], nil
+	}
+	if r.Method != http.MethodPut {
+		return "", nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxOpBodySize+1))
+	if err != nil {
+		return "", fmt.Errorf("unable to read request body: %v", err)
+	}
+	if len(body) > MaxOpBodySize {
+		return "", fmt.Errorf("request body is over %d bytes", MaxOpBodySize)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var op opBodyJSON
+	if err := json.Unmarshal(body, &op); err != nil {
+		return "", fmt.Errorf("bad JSON request body: %v", err)
+	}
+	if op.UUID == "" {
+		return "", fmt.Errorf("JSON request body has no UUID")
+	}
+	return op.UUID, nil
+}
+
+func (rt *routerT) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if r.Method == http.MethodGet {
+		switch {
+		case path == "/router/shards":
+			writeJSON(w, r, rt.getShards())
+			return
+		case strings.HasPrefix(path, "/router/shard/"):
+			uuid := strings.TrimPrefix(path, "/router/shard/")
+			writeJSON(w, r, struct{ UUID, Shard string }{uuid, rt.shardFor(uuid)})
+			return
+		case path == "/uuids":
+			rt.uuidsHandler(w, r)
+			return
+		case path == "/stats/conflicts":
+			rt.conflictStatsHandler(w, r)
+			return
+		}
+	}
+
+	uuid, err := routedUUID(r)
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if uuid == "" {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s %s isn't on a UUID, so send it to a shard listed by GET /router/shards.", r.Method, r.URL.Path))
+		return
+	}
+	shard := rt.shardFor(uuid)
+	rt.RLock()
+	proxy := rt.proxies[shard]
+	rt.RUnlock()
+	if proxy == nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("no shards to route uuid %s to (%s).", uuid, r.URL.Path))
+		return
+	}
+	proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routedUUIDKey{}, uuid)))
+}
+
+// Combines the /uuids responses of all shards.
+func (rt *routerT) uuidsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	flags := make(map[string]bool)
+	for _, name := range []string{"detail", "all", "include-historical"} {
+		if s := query.Get(name); s != "" {
+			value, err := strconv.ParseBool(s)
+			if err != nil {
+				BadRequest(w, r, "%s must be true or false, not %q", name, s)
+				return
+			}
+			flags[name] = value
+		}
+	}
+
+	if flags["detail"] {
+		sortBy := query.Get("sort")
+		switch sortBy {
+		case "":
+			sortBy = SortUUIDsByUUID
+		case SortUUIDsByUUID, SortUUIDsByCheckouts, SortUUIDsByClients, SortUUIDsByAge, SortUUIDsByActivity, SortUUIDsByBranch:
+		default:
+			BadRequest(w, r, "sort must be uuid, checkouts, clients, age, activity, or branch, not %q", sortBy)
+			return
+		}
+		limit, offset, ok := pageParams(w, r)
+		if !ok {
+			return
+		}
+		query.Del("limit")
+		query.Del("offset")
+		bodies, err := rt.getAll("/uuids?"+query.Encode(), r)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("unable to list UUIDs: %v (%s).", err, r.URL.Path))
+			return
+		}
+		details := []uuidDetailJSON{}
+		for _, body := range bodies {
+			var page uuidsDetailJSON
+			if err := json.Unmarshal(body, &page); err != nil {
+				writeError(w, http.StatusBadGateway, fmt.Sprintf("bad UUID list from a shard: %v (%s).", err, r.URL.Path))
+				return
+			}
+			details = append(details, page.UUIDs...)
+		}
+		writeJSON(w, r, pageUUIDDetails(details, sortBy, offset, limit))
+		return
+	}
+
+	bodies, err := rt.getAll("/uuids?"+query.Encode(), r)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("unable to list UUIDs: %v (%s).", err, r.URL.Path))
+		return
+	}
+	var result interface{}
+	switch {
+	case flags["all"]:
+		result, err = mergeAllUUIDs(bodies)
+	case flags["include-historical"]:
+		result, err = mergeHistoricalUUIDs(bodies)
+	default:
+		var listing historicalUUIDsJSON
+		listing, err = mergeHistoricalUUIDs(bodies)
+		result = uuidsJSON{listing.UUIDs}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("bad UUID list from a shard: %v (%s).", err, r.URL.Path))
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mergeHistoricalUUIDs(bodies [][]byte) (historicalUUIDsJSON, error) {
+	uuids := make(map[string]bool)
+	historical := make(map[string]bool)
+	for _, body := range bodies {
+		var listing historicalUUIDsJSON
+		if err := json.Unmarshal(body, &listing); err != nil {
+			return historicalUUIDsJSON{}, err
+		}
+		for _, uuid := range listing.UUIDs {
+			uuids[uuid] = true
+		}
+		for _, uuid := range listing.Historical {
+			historical[uuid] = true
+		}
+	}
+	for uuid := range uuids {
+		delete(historical, uuid)
+	}
+	return historicalUUIDsJSON{sortedKeys(uuids), sortedKeys(historical)}, nil
+}
+
+// Merges the /uuids?all=true responses of shards.  Nodes of the same DVID repos are
+// listed by every shard, so their checkouts and library UUIDs are combined.
+func mergeAllUUIDs(bodies [][]byte) (allUUIDsJSON, error) {
+	nodes := make(map[string]*uuidNodeJSON)
+	var updated *time.Time
+	for _, body := range bodies {
+		var all allUUIDsJSON
+		if err := json.Unmarshal(body, &all); err != nil {
+			return allUUIDsJSON{}, err
+		}
+		for _, node := range all.Nodes {
+			merged, found := nodes[node.UUID]
+			if !found {
+				node := node
+				nodes[node.UUID] = &node
+				continue
+			}
+			merged.Checkouts += node.Checkouts
+			merged.LibraryUUIDs = append(merged.LibraryUUIDs, node.LibraryUUIDs...)
+			merged.InDVID = merged.InDVID || node.InDVID
+		}
+		if all.DVIDUpdated != nil && (updated == nil || all.DVIDUpdated.Before(*updated)) {
+			updated = all.DVIDUpdated
+		}
+	}
+
+	uuids := make(map[string]bool)
+	merged := allUUIDsJSON{Nodes: make([]uuidNodeJSON, 0, len(nodes)), DVIDUpdated: updated}
+	for _, node := range nodes {
+		sort.Strings(node.LibraryUUIDs)
+		for _, uuid := range node.LibraryUUIDs {
+			uuids[uuid] = true
+		}
+		if !node.InDVID || len(node.LibraryUUIDs) == 0 {
+			uuids[node.UUID] = true
+		}
+		merged.Nodes = append(merged.Nodes, *node)
+	}
+	merged.UUIDs = sortedKeys(uuids)
+	sort.Slice(merged.Nodes, func(i, j int) bool { return merged.Nodes[i].UUID < merged.Nodes[j].UUID })
+	return merged, nil
+}
+
+// Combines the /stats/conflicts responses of all shards.  Shards have different UUIDs, so
+// counts of a client pair's conflicts and labels are summed.
+func (rt *routerT) conflictStatsHandler(w http.ResponseWriter, r *http.Request) {
+	bodies, err := rt.getAll("/stats/conflicts?"+r.URL.RawQuery, r)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("unable to get conflict stats: %v (%s).", err, r.URL.Path))
+		return
+	}
+	merged := conflictStatsJSON{Pairs: []conflictPairJSON{}}
+	pairs := make(map[[2]string]*conflictPairJSON)
+	for i, body := range bodies {
+		var stats conflictStatsJSON
+		if err := json.Unmarshal(body, &stats); err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("bad conflict stats from a shard: %v (%s).", err, r.URL.Path))
+			return
+		}
+		if i == 0 || stats.Since.Before(merged.Since) {
+			merged.Since = stats.Since
+		}
+		if stats.Until.After(merged.Until) {
+			merged.Until = stats.Until
+		}
+		merged.Window = stats.Window
+		merged.Conflicts += stats.Conflicts
+		for _, pair := range stats.Pairs {
+			key := [2]string{pair.Client1, pair.Client2}
+			sum, found := pairs[key]
+			if !found {
+				pair := pair
+				pairs[key] = &pair
+				continue
+			}
+			sum.Conflicts += pair.Conflicts
+			sum.Refused1 += pair.Refused1
+			sum.Refused2 += pair.Refused2
+			sum.Labels += pair.Labels
+			if pair.Last.After(sum.Last) {
+				sum.Last = pair.Last
+			}
+		}
+	}
+	for _, pair := range pairs {
+		merged.Pairs = append(merged.Pairs, *pair)
+	}
+	sortConflictPairs(merged.Pairs)
+	writeJSON(w, r, merged)
+}
+
+// Runs the router subcommand and returns the exit code.
+func runRouter(args []string) int {
+	fs := flag.NewFlagSet("router", flag.ExitOnError)
+	addr := fs.String("http", "localhost:8000", "")
+	shardList := fs.String("shards", "", "")
+	shardFile := fs.String("shardfile", "", "")
+	replicas := fs.Int("replicas", DefaultRouterReplicas, "")
+	refresh := fs.Duration("refresh", time.Minute, "")
+	tokenFile := fs.String("tokenfile", "", "")
+	fs.Usage = func() {
+		fmt.Printf(routerHelp)
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil || len(positional) != 0 {
+		fs.Usage()
+		return 1
+	}
+	if (*shardList == "") == (*shardFile == "") {
+		fmt.Fprintf(os.Stderr, "Exactly one of -shards or -shardfile must be given\n")
+		return 1
+	}
+	if *replicas < 1 || *refresh <= 0 {
+		fmt.Fprintf(os.Stderr, "-replicas must be at least 1 and -refresh positive\n")
+		return 1
+	}
+
+	var shards []string
+	if *shardFile != "" {
+		shards, err = readShardFile(*shardFile)
+	} else {
+		shards, err = parseShards(strings.Split(*shardList, ","))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to get shards: %v\n", err)
+		return 1
+	}
+	rt := &routerT{
+		placed:   make(map[string]string),
+		proxies:  make(map[string]*httputil.ReverseProxy),
+		replicas: *replicas,
+		client:   &http.Client{Timeout: RouterTimeout},
+	}
+	if *tokenFile != "" {
+		tokenBytes, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read -tokenfile: %v\n", err)
+			return 1
+		}
+		rt.token = strings.TrimSpace(string(tokenBytes))
+	}
+	rt.refresh(shards)
+
+	go func() {
+		for range time.Tick(*refresh) {
+			if *shardFile != "" {
+				newShards, err := readShardFile(*shardFile)
+				if err != nil {
+					log.Printf("ERROR: unable to read -shardfile, so keeping the current shards: %v\n", err)
+				} else {
+					shards = newShards
+				}
+			}
+			rt.refresh(shards)
+		}
+	}()
+
+	log.Printf("Routing requests on %s to shards by UUID\n", *addr)
+	if err := http.ListenAndServe(*addr, rt); err != nil {
+		fmt.Fprintf(os.Stderr, "Router stopped: %v\n", err)
+		return 1
+	}
+	return 0
+}
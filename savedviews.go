@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxViewNameLength is the longest saved view name in bytes.
+const MaxViewNameLength = 64
+
+// Saved view names can be used in URL paths as is.
+var viewNameRE = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Paths of the read requests a view can save.
+var viewPathPrefixes = []string{"/state/", "/federated/state/", "/history/", "/search", "/diff/", "/uuids", "/stats/", "/report/", "/graphql"}
+
+// savedViewT is a named read request, e.g., GET /search with filters, saved so common
+// reports don't need their parameters given again.
+type savedViewT struct {
+	path  string // path and query of the request
+	owner string // client that saved it
+	saved time.Time
+}
+
+type savedViewJSON struct {
+	Name  string
+	Path  string
+	Owner string
+	Saved time.Time
+}
+
+type savedViewRequestJSON struct {
+	Name   string
+	Path   string
+	Client string // owner, which defaults to the authenticated client
+}
+
+// Returns true for ops that save or delete views.  They are logged with the uuid "n/a".
+func (op opType) viewOp() bool {
+	return op == ViewSaveOp || op == ViewDeleteOp || op == ViewRestoreOp
+}
+
+// Returns an error if a view name or path can't be saved.
+func checkView(name, path string) error {
+	if len(name) > MaxViewNameLength || !viewNameRE.MatchString(name) {
+		return fmt.Errorf("view name %q must be up to %d letters, digits, '.', '_', or '-'", name, MaxViewNameLength)
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return fmt.Errorf("bad view path %q: %v", path, err)
+	}
+	if u.IsAbs() || u.Host != "" {
+		return fmt.Errorf("view path %q must be a path on this server, like \"/search?client=katzw\"", path)
+	}
+	for _, elem := range strings.Split(u.Path, "/") {
+		if elem == "." || elem == ".." {
+			return fmt.Errorf("view path %q can't have \".\" or \"..\" elements", path)
+		}
+	}
+	for _, prefix := range viewPathPrefixes {
+		if strings.HasPrefix(u.Path, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("view path %q must be a GET of one of %s", path, strings.Join(viewPathPrefixes, ", "))
+}
+
+// Saves a view for a client, replacing any view of the same name.
+func saveView(name, path, clientid string, attrs map[string]string) (savedViewJSON, error) {
+	if err := checkView(name, path); err != nil {
+		return savedViewJSON{}, err
+	}
+	t := clock.Now()
+	if err := saveViewAt(t, ViewSaveOp, name, path, clientid, attrs, true); err != nil {
+		return savedViewJSON{}, err
+	}
+	return savedViewJSON{name, path, clientid, t}, nil
+}
+
+// Saves a view as of time t, which is the op time when replaying the log.
+func saveViewAt(t time.Time, opT opType, name, path, clientid string, attrs map[string]string, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+
+	prev, prevFound := library.savedViews[name]
+	library.savedViews[name] = &savedViewT{path, clientid, t}
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     opT,
+			uuid:   "n/a",
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"name": name, "path": path}),
+		}
+		if err := library.write(op); err != nil {
+			// Undo the change so state matches the log.
+			if prevFound {
+				library.savedViews[name] = prev
+			} else {
+				delete(library.savedViews, name)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteView(name, clientid string, attrs map[string]string) error {
+	return deleteViewAt(clock.Now(), name, clientid, attrs, true)
+}
+
+// Deletes a view as of time t, which is the op time when replaying the log.
+func deleteViewAt(t time.Time, name, clientid string, attrs map[string]string, modifyLog bool) error {
+	library.Lock()
+	defer library.Unlock()
+
+	view, found := library.savedViews[name]
+	if !found {
+		return fmt.Errorf("no view named %q", name)
+	}
+	delete(library.savedViews, name)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     ViewDeleteOp,
+			uuid:   "n/a",
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"name": name}),
+		}
+		if err := library.write(op); err != nil {
+			library.savedViews[name] = view // undo so state matches the log
+			return err
+		}
+	}
+	return nil
+}
+
+func getSavedView(name string) (savedViewJSON, bool) {
+	library.RLock()
+	defer library.RUnlock()
+
+	view, found := library.savedViews[name]
+	if !found {
+		return savedViewJSON{}, false
+	}
+	return savedViewJSON{name, view.path, view.owner, view.saved}, true
+}
+
+// Returns all saved views sorted by name.
+func getSavedViews() []savedViewJSON {
+	library.RLock()
+	views := make([]savedViewJSON, 0, len(library.savedViews))
+	for name, view := range library.savedViews {
+		views = append(views, savedViewJSON{name, view.path, view.owner, view.saved})
+	}
+	library.RUnlock()
+
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	return views
+}
+
+// Answers a request with the response to a view's saved request, made with the same
+// credentials and Accept header.
+func serveSavedView(w http.ResponseWriter, r *http.Request, view savedViewJSON) {
+	u, err := url.Parse(view.Path)
+	if err != nil {
+		BadRequest(w, r, "bad path %q of view %q: %v", view.Path, view.Name, err)
+		return
+	}
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.URL = u
+	req.RequestURI = u.RequestURI()
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	webMux.ServeHTTP(w, req)
+}
+
+// Writes all saved views into a compacted log.  Must be called with library lock held.
+func (lib *libraryT) writeSavedViewRestores() error {
+	for name, view := range lib.savedViews {
+		op := &libraryOp{
+			t:      view.saved,
+			op:     ViewRestoreOp,
+			uuid:   "n/a",
+			client: view.owner,
+			attrs:  map[string]string{"name": name, "path": view.path},
+		}
+		if err := lib.write(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSearchLimit is the number of matches returned by GET /search without a limit.
+	DefaultSearchLimit = 100
+
+	// MaxSearchLimit is the most matches returned by one GET /search.
+	MaxSearchLimit = 1000
+)
+
+// searchQueryT selects history ops across all UUIDs.  Unset fields match every op.
+type searchQueryT struct {
+	uuid     func(string) bool
+	client   func(string) bool
+	ops      map[opType]bool
+	labels   bool // only ops on labels from labelMin to labelMax
+	labelMin uint64
+	labelMax uint64
+	since    time.Time // only ops at or after this time, if set
+}
+
+type searchMatchJSON struct {
+	UUID   string
+	Time   time.Time
+	Seq    uint64 `json:",omitempty"`
+	Op     string
+	Label  *labelJSON  `json:",omitempty"`
+	Labels []labelJSON `json:",omitempty"` // labels released by a "reset-labels" op
+	Client string
+}
+
+type searchJSON struct {
+	Total   int
+	Offset  int
+	Matches []searchMatchJSON
+}
+
+// Parses a pattern that is a regular expression if it starts with "~" and otherwise a glob
+// like "3af*".  Either must match the whole string.
+func parsePattern(name, pattern string) (func(string) bool, error) {
+	if re, isRegexp := strings.CutPrefix(pattern, "~"); isRegexp {
+		if _, err := regexp.Compile(re); err != nil {
+			return nil, fmt.Errorf("bad %s regular expression %q: %v", name, re, err)
+		}
+		return regexp.MustCompile("^(?:" + re + ")$").MatchString, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad %s glob %q: %v", name, pattern, err)
+	}
+	return func(s string) bool {
+		matched, _ := path.Match(pattern, s)
+		return matched
+	}, nil
+}
+
+// Parses a label or an inclusive range of labels like "1000-2000".
+func parseLabelRange(s string) (min, max uint64, err error) {
+	minStr, maxStr, isRange := strings.Cut(s, "-")
+	if min, err = strconv.ParseUint(minStr, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("bad label %q: must be a label or range like \"1000-2000\"", s)
+	}
+	if !isRange {
+		return min, min, nil
+	}
+	if max, err = strconv.ParseUint(maxStr, 10, 64); err != nil || max < min {
+		return 0, 0, fmt.Errorf("bad label range %q: must be a range like \"1000-2000\"", s)
+	}
+	return min, max, nil
+}
+
+// Returns the labels an op was done on, or nil if it isn't on particular labels.
+func opLabels(op *libraryOp) []uint64 {
+	switch op.op {
+	case CheckoutOp, RenewOp, CheckinOp, ExpireOp, ConflictOp, PinOp, UnpinOp, SupersedeOp, CommentOp:
+		return []uint64{op.label}
+	case LabelResetOp:
+		return op.resetLabels()
+	}
+	return nil
+}
+
+func (q *searchQueryT) matches(op *libraryOp) bool {
+	if q.ops != nil && !q.ops[op.op] {
+		return false
+	}
+	if !q.since.IsZero() && op.t.Before(q.since) {
+		return false
+	}
+	if q.uuid != nil && !q.uuid(op.uuid) {
+		return false
+	}
+	if q.client != nil && !q.client(op.client) {
+		return false
+	}
+	if !q.labels {
+		return true
+	}
+	for _, label := range opLabels(op) {
+		if label >= q.labelMin && label <= q.labelMax {
+			return true
+		}
+	}
+	return false
+}
+
+// Scans the history of all UUIDs, oldest first, and returns the page of matching ops
+// from offset along with the total number of matches.
+func searchHistory(q *searchQueryT, offset, limit int) (searchJSON, error) {
+	result := searchJSON{Offset: offset, Matches: []searchMatchJSON{}}
+	fnames, err := historyFiles()
+	if err != nil {
+		return result, err
+	}
+	formats := make(map[string]string)
+	opIDs := make(map[string]bool)
+	for _, fname := range fnames {
+		err := readFileHx(fname, "", opIDs, func(op *libraryOp) error {
+			if !q.matches(op) {
+				return nil
+			}
+			result.Total++
+			if result.Total <= offset || len(result.Matches) >= limit {
+				return nil
+			}
+			format, found := formats[op.uuid]
+			if !found {
+				format = getPolicy(op.uuid).LabelOutput
+				formats[op.uuid] = format
+			}
+			match := searchMatchJSON{UUID: op.uuid, Time: op.t, Seq: op.seq, Op: op.op.String(), Client: op.client}
+			if op.op == LabelResetOp {
+				for _, label := range op.resetLabels() {
+					match.Labels = append(match.Labels, labelJSON{label, format})
+				}
+			} else if labels := opLabels(op); labels != nil {
+				match.Label = &labelJSON{labels[0], format}
+			}
+			result.Matches = append(result.Matches, match)
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
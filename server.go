@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -47,7 +51,94 @@ const WebHelp = `
 		like a librarian, allowing check-in and check-out of (uuid, label) tuples given a client id.
 		The client id is an arbitrary string, e.g., a user name.  All check-ins and check-outs are
 		recorded in a human-readable librarian log file.</p>
+
+		<p>Client ids are normalized as set by the -clientnorm option, e.g., "KatzW " becomes "katzw"
+		with "-clientnorm=trim,lower".  Client ids cannot contain whitespace and, if -clientchars is set,
+		must match that regexp.  Otherwise a 400 status is returned.</p>
 		
+		<h3>Authentication</h3>
+
+		<p>If the librarian was started with -jwtsecretfile or -jwks, all requests except this help page
+		require an "Authorization: Bearer {JWT}" header.  The JWT must have an "exp" claim.  Its
+		subject is the client id, and the groups claim is mapped to a role via -jwtroles:</p>
+
+<pre>
+	reader   GET requests
+	writer   checkout and checkin, where {Client} must match the JWT subject
+	admin    resets, /admin endpoints, and checkout/checkin for any client
+</pre>
+
+		<p>Missing or invalid tokens return a 401 status.  Insufficient roles return a 403 status.</p>
+		<p>Admins can also mint guest tokens for external reviewers with POST /admin/tokens.  Guest tokens
+		start with "lgt_", are accepted whether or not JWTs are required, and only work for their UUIDs
+		until they expire.</p>
+		<p>Listeners given with "auth=none" in their -http option, e.g., a local Unix socket, do not
+		require tokens.</p>
+
+		<h3>Admin API</h3>
+
+		<p>The /admin, /reset, /hooks, and /replicate endpoints are only served on the admin listeners
+		given by -adminhttp, which default to "localhost:8001", and return a 404 status on other
+		listeners.  Admin listeners serve only those endpoints, GET /healthz, and this help page.  If -admintokenfile is set, admin
+		listeners require its token as a bearer token instead of a JWT.</p>
+
+		<h3>Responses</h3>
+
+		<p>All endpoints except this help page, GET /meta/{UUID}/{key}, GET /calendar, GET /graphql/schema,
+		and text or HTML reports return a JSON object.  Requests without other results return the empty object "{}".
+		Errors return a JSON object with the message:</p>
+
+<pre>
+	{ "Error": "could not do checkout: ..." }
+</pre>
+
+		<p>Some errors also have a "Code" field that clients can test, e.g., "PINNED" for a checkout
+		of a pinned label.</p>
+
+		<p>GET /state and GET /checkout also return MessagePack if the request's Accept header prefers
+		"application/msgpack".  MessagePack responses have the same fields as the JSON responses.</p>
+
+		<p>Any endpoint can also be requested under /v1, e.g., GET /v1/state/{UUID}, to have its JSON
+		response wrapped in an envelope with the server's time, the request id, the response status, and,
+		for endpoints with a UUID in their path, the UUID's revision after the request.  The revision
+		counts the ops applied to the UUID, so clients can tell whether anything changed between two
+		requests:</p>
+
+<pre>
+	{ "ServerTime": "2015-12-19T16:39:57-08:00", "RequestID": "host/Xk3a9-000042", "Status": 200,
+	  "UUID": "3af902", "Revision": 117, "Data": { "UUID": "3af902", "Checkouts": [ ... ] } }
+</pre>
+
+		<p>Errors have the error object in "Data" and keep their HTTP status.  "Revision" is omitted for
+		UUIDs with no history.  MessagePack, text, and HTML responses, /events, and /ws are never wrapped,
+		and wrapped responses are sent all at once rather than streamed.</p>
+
+		<h3>Retries</h3>
+
+		<p>Checkouts, checkins, resets, and metadata and policy changes can include an "X-Op-ID" header with
+		a client-generated id of up to 128 bytes, e.g., a UUID.  The op id is stored in the librarian log,
+		and a retry with the same op id returns the original success without applying the op again.  Reusing
+		an op id for a different op returns a 400 status.  Op ids are remembered for 24 hours, including
+		across compactions and restarts, and concurrent retries with the same op id apply the op only once.</p>
+
+		<h3>Provenance</h3>
+
+		<p>Any op request can include an "X-Op-Ref" header with an external reference of up to 512 bytes,
+		e.g., the DVID mutation id a checkin corresponds to or the URL of an assignment ticket.  It is
+		stored with the op in the librarian log and shown as "Ref" in history, so ops can be found by
+		reference with GET /history/{UUID}?q=ref=... .  A reference with control characters returns a
+		400 status.</p>
+
+		<h3>Remote Sites</h3>
+
+		<p>If -proxymisses is set, GET /checkout, /history, /diff, /state, and /meta requests for a UUID
+		this server has never seen are forwarded to that librarian, along with the request's Authorization
+		header.  Its responses are cached for 10 seconds and have an "X-Librarian-Proxied" header that is
+		"miss" if forwarded or "hit" if cached.  Checkouts and other changes are never forwarded.</p>
+
+		<p>If -peers is set, GET /federated/state/{UUID} combines the checkouts of this server and
+		each peer librarian, e.g., for organizations running a librarian per dataset.</p>
+
 		<h3>HTTP API</h3>
 
 <pre>
@@ -55,40 +146,354 @@ GET  /
 
 	The current help page.
 
+GET  /console
+
+	A page for checking out, checking in, and looking up a label from a browser, with the
+	label's current holder, conflict details, and recent history.  The page itself doesn't
+	require authentication; a token entered on the page is sent with its requests.  With
+	-loginwebhook and -baseurl, users can instead sign in with a login link (see POST /login).
+
+GET  /assets/{Name}
+
+	Returns a file from the -assets directory, e.g., a logo or style sheet used by custom
+	pages.  With -assets, this help page and /console can be replaced by "help.html" and
+	"console.html" or have "help-header.html" and "console-header.html" added to their tops,
+	each optionally in languages chosen by the Accept-Language header or a "lang" query,
+	e.g., "console.de.html" for ?lang=de.  Replacement pages are HTML templates given
+	{{.Hostname}}, {{.Version}}, and {{.Lang}}.  Assets don't require authentication.
+
+POST   /login?client={Client}
+GET    /login/{Secret}
+POST   /login/{Secret}
+GET    /session
+DELETE /session
+
+	Passwordless login for browsers.  POST /login sends a login link for the client through
+	the -loginwebhook, e.g., a chat bot that messages the user, as JSON with the link built
+	from -baseurl, never from the request:
+
+	{ "Client": "katzw", "Link": "https://librarian:8000/login/9c1e...", "Expires": "..." }
+
+	The link can be used once within 15 minutes and only one link is sent to a client every
+	30 seconds, with a 429 status otherwise.  Following the link shows a page with a sign-in
+	button, which POSTs the link back so previews fetched by chat apps don't use it up.  The
+	POST sets a session cookie that lasts 12 hours and redirects to /console.  Requests with
+	the cookie and no bearer token act as the client with the writer role, so their ops are
+	attributed to the client.  GET /session returns the current session, or a 404 status
+	without one, and DELETE /session signs out:
+
+	{ "Client": "katzw", "Expires": "..." }
+
+	Without both -loginwebhook and -baseurl, POST /login returns a 404 status.  Sessions don't survive a restart.
+
+GET  /healthz
+
+	Returns the server status, which doesn't require authentication and is served on admin
+	listeners too:
+
+	{ "Status": "ok", "Maintenance": false }
+
+	During maintenance, "Status" is "maintenance" and the maintenance "Message" and "Since" are
+	included (see /admin/maintenance).
+
+GET  /notice
+
+	Returns the banner set by an admin for UIs to display, which doesn't require
+	authentication:
+
+	{ "Message": "librarian will shut down at 6:00PM", "Set": "2015-12-19T17:50:00-08:00",
+	  "ClosesAt": "2015-12-19T18:00:00-08:00" }
+
+	"ClosesAt" is only given for a shutdown planned with POST /admin/drain.  Returns {} if
+	there is no banner.  The dashboard at /console shows the banner.
+
+GET  /version
+
+	Returns the version of this server:
+
+	{ "Version": "v0.4.0", "Commit": "8c1e0f2...", "GoVersion": "go1.22.5", "BuildDate": "2015-12-19T16:39:57Z" }
+
+	Builds made with "make" or "make release" have the version, git commit, and build date set.
+	Otherwise "Version" is "dev" and the commit and date are included if Go recorded them.
+
 GET  /uuids
 
 	Returns JSON of the UUIDS that have reserved labels:
 
-	[ "3af902", "d944bc", ... ]
+	{ "UUIDs": [ "3af902", "d944bc", ... ] }
+
+GET  /uuids?include-historical=true
+
+	Also lists the UUIDs that have history but no reserved labels now:
+
+	{ "UUIDs": [ "3af902", "d944bc", ... ], "Historical": [ "28841c", ... ] }
+
+GET  /uuids?detail=true[&include-historical=true][&sort={uuid|checkouts|clients|age|activity|branch}][&limit=N][&offset=N]
+
+	Returns a summary of each UUID with reserved labels, and with "include-historical=true"
+	also those with only history:
+
+	{
+		"Total": 42, "Offset": 0,
+		"UUIDs": [
+			{ "UUID": "3af902", "Checkouts": 812, "Clients": 14, "OldestLockAgeSeconds": 190233.5,
+			  "LastActivity": "2015-12-19T17:02:11-08:00" },
+			...
+		]
+	}
+
+	"sort" orders UUIDs by UUID (the default), most checkouts, most distinct clients holding
+	checkouts, oldest lock, or most recent activity.  With "limit" and "offset", at most N UUIDs
+	after skipping "offset" of them are returned.  "LastActivity" is omitted if the UUID has no
+	checkouts or ops since the log was last compacted.
+
+	With the -dvid option, each UUID found in a DVID repo also has its place in the repo's
+	version tree, and the UUIDs of the page are grouped by branch, root first, so UIs can draw
+	the locks as a version tree:
+
+	{
+		"Total": 42, "Offset": 0,
+		"UUIDs": [
+			{ "UUID": "3af902", "Checkouts": 812, ...,
+			  "DVID": { "Repo": "28841c8277e044a7b187dda03e18da13", "RepoAlias": "hemibrain",
+			            "Node": "3af902e1c4b04d6f8a7e2b9c0d1e5f43", "Version": 7, "Branch": "master",
+			            "Committed": false, "Parents": [ "d944bc..." ], "Children": [] } },
+			...
+		],
+		"Branches": [
+			{ "Repo": "28841c8277e044a7b187dda03e18da13", "Branch": "master", "UUIDs": [ "d944bc", "3af902" ] },
+			...
+		]
+	}
+
+	"sort=branch" orders UUIDs by repo, then branch, then version, so each branch's UUIDs are
+	together root first, followed by UUIDs not found in DVID.  Parents and children are given
+	by their full DVID UUIDs, which may not have checkouts.  Nodes are fetched every -dvidpoll.
+
+GET  /uuids?all=true
+
+	Also includes every node of the repos on the DVID server given by the -dvid option, even
+	those without checkouts, so UIs can offer a complete version picker:
+
+	{
+		"UUIDs": [ "3af902", "7b21c0d4e6a84f2e9b1c5a3d8e0f6b72", ... ],
+		"Nodes": [
+			{
+				"UUID": "3af902e1c4b04d6f8a7e2b9c0d1e5f43",
+				"Repo": "28841c8277e044a7b187dda03e18da13",
+				"RepoAlias": "hemibrain",
+				"Branch": "master",
+				"Committed": false,
+				"Note": "proofreading round 4",
+				"LibraryUUIDs": [ "3af902" ],
+				"Checkouts": 12,
+				"InDVID": true
+			},
+			...
+		],
+		"DVIDUpdated": "2015-12-19T17:10:28-08:00"
+	}
+
+	UUIDs with checkouts can abbreviate DVID node UUIDs and are listed in the node's
+	"LibraryUUIDs".  "UUIDs" has the librarian UUIDs with checkouts and the full UUIDs of
+	other nodes.  UUIDs with checkouts not found in DVID have "InDVID" false.  Nodes are
+	fetched every -dvidpoll, and "DVIDUpdated" is omitted if they haven't been fetched.
 
 GET  /state/{UUID}
 
-	Returns JSON describing all reserved labels for the given UUID:
+	Returns JSON describing all reserved labels for the given UUID, sorted by label:
+
+	{
+		"UUID": "3af902",
+		"Checkouts": [
+			{ "Label": 1, "Client": "katzw" },
+			{ "Label": 2019, "Client": "zhaot" },
+			...
+		]
+	}
+
+	Labels pinned through /admin/pin are listed separately in "Pinned", which is omitted if
+	there are none.  If no checkouts are present for UUID, "Checkouts" is the empty list "[]".  The X-UUID-Known
+	response header is "true" if the UUID has any history, even if it has no checkouts now, and
+	"false" if it has never been seen, e.g., because of a mistyped UUID.  Intents registered
+	through PUT /intent are listed in "Intents", which is also omitted if there are none.
+
+	With -idprovider, "Clients" gives the full name and groups in the directory of each client
+	holding a checkout:
+
+	"Clients": { "katzw": { "Name": "William Katz", "Groups": [ "flyem" ] }, ... }
+
+GET  /state/{UUID}[?sort={label|client|age}][&limit=N][&offset=N]
+GET  /state/{UUID}?count-only=true
+
+	Large states can be sorted and paged.  "sort" orders checkouts by label (the default),
+	client, or age with the oldest checkouts first.  With "limit" or "offset", at most N
+	checkouts after skipping "offset" of them are returned along with the total:
+
+	{ "UUID": "3af902", "Total": 23817, "Offset": 200, "Checkouts": [ ... ] }
+
+	With "count-only=true", only the number of checkouts is returned:
 
-	[
-		{ "Label": 1, "Client": "katzw" },
-		{ "Label": 2019, "Client": "zhaot" },
-		...
-	]
+	{ "UUID": "3af902", "Total": 23817 }
 
-	If no checkouts are present for UUID, returns the empty list "[]".
+GET  /federated/state/{UUID}
 
-GET  /history/{UUID}
+	Returns the checkouts of the UUID on this server and every -peers librarian, labeled by the
+	server holding each lock, with "local" for this one.  The request's Authorization header is
+	passed to peers.  Peers that can't be reached have an "Error" in "Servers" and the rest are
+	still returned:
+
+	{
+		"UUID": "3af902",
+		"Checkouts": [
+			{ "Server": "local", "Label": 1, "Client": "katzw" },
+			{ "Server": "http://other:8000", "Label": 2019, "Client": "zhaot" },
+			...
+		],
+		"Servers": [
+			{ "Server": "local", "Checkouts": 1 },
+			{ "Server": "http://other:8000", "Checkouts": 12 },
+			{ "Server": "http://down:8000", "Checkouts": 0, "Error": "..." }
+		]
+	}
+
+	Without -peers, only this server's checkouts are returned.
+
+GET  /state/{UUID}?resolve=true
+GET  /checkout/{UUID}/{Label}?resolve=true
+PUT  /checkout/{UUID}/{Label}/{Client}?resolve=true
+
+	With "resolve=true", labels superseded through POST /admin/supersede/{UUID}, e.g., by body
+	merges, are resolved to their current id.  Checkouts of superseded labels are listed under
+	their current id with the label actually checked out in "Superseded":
+
+	{ "Label": 2019, "Client": "katzw", "Superseded": 1 }
+
+	A checkout of a superseded label reserves its current id and returns a 409 status if
+	another client holds the current id or any label it supersedes.  This also works with the
+	PUT /checkout JSON request body below.
+
+PUT  /checkout/{UUID}/{Label}/{Client}?block={Duration}
+
+	With "block", e.g., "30s", a checkout of a label held by another client waits up to that
+	long, at most 5m, for the label to be checked in, expire, or be reset and then checks it
+	out, instead of returning a 409 status right away.  Checkouts waiting for the same label
+	get it in the order they arrived, though a checkout that doesn't wait can still take it
+	first.  If the label is still held when the wait ends, the usual 409 response is returned.
+	This also works with the PUT /checkout JSON request body below.  Waits aren't logged, since
+	each is the open request of a client that is still waiting for the response.  A restart
+	closes those requests, so their clients see a dropped connection and retry, rejoining the
+	waitlist in the order their retries arrive.
+
+	A blocked checkout that would wait forever returns a 409 status with an error "Code" of
+	"DEADLOCK" instead, e.g., when client A holds label 1 and waits for 2 while B holds 2 and
+	waits for 1.  Blocked checkouts form a wait-for graph from each waiting client to the holder
+	of its label, which is checked for cycles when a checkout starts waiting and every second
+	while it waits, since labels can change hands.  Only one checkout of a cycle is refused.
+
+GET  /history/{UUID}[?limit=N][&label={Label}][&q={Query}]
 
  	Returns a list of all operations done on this UUID in the following JSON format:
 
- 	[
- 		{ "Time": "2015-12-19T16:39:57-08:00", "Op": "checkout", "Label": 2310, "Client": "katzw"},
- 		{ "Time": "2015-12-19T16:40:07-08:00", "Op": "checkout", "Label": 1029, "Client": "plazas"},
- 		{ "Time": "2015-12-19T16:49:10-08:00", "Op": "checkin", "Label": 1029, "Client": "plazas"},
- 		{ "Time": "2015-12-19T16:56:01-08:00", "Op": "checkin", "Label": 2310, "Client": "katzw"},
- 		{ "Time": "2015-12-19T16:57:07-08:00", "Op": "checkout", "Label": 1029, "Client": "rivlinp"},
- 		{ "Time": "2015-12-19T17:10:28-08:00", "Op": "reset"},
- 	]
+ 	{ "UUID": "3af902", "History": [
+ 		{ "Time": "2015-12-19T16:39:57-08:00", "Seq": 201, "Op": "checkout", "Label": 2310, "Client": "katzw"},
+ 		{ "Time": "2015-12-19T16:40:07-08:00", "Seq": 202, "Op": "checkout", "Label": 1029, "Client": "plazas"},
+ 		{ "Time": "2015-12-19T16:49:10-08:00", "Seq": 205, "Op": "checkin", "Label": 1029, "Client": "plazas"},
+ 		{ "Time": "2015-12-19T16:56:01-08:00", "Seq": 209, "Op": "checkin", "Label": 2310, "Client": "katzw"},
+ 		{ "Time": "2015-12-19T16:57:07-08:00", "Seq": 210, "Op": "checkout", "Label": 1029, "Client": "rivlinp"},
+ 		{ "Time": "2015-12-19T17:10:28-08:00", "Seq": 214, "Op": "reset"},
+ 	]}
+
+ 	The history is streamed in chunks so large histories are not limited by -writetimeout.
+
+ 	With "?limit=N", only the last N ops are returned.  The last 100 ops of each UUID are kept
+ 	in memory, so limits up to 100 usually don't read the log, and the full histories of the
+ 	most requested UUIDs can be cached too (see /admin/history-cache).  With "label", only ops
+ 	on that label and resets of the UUID, or of that label, are returned.
+
+ 	With "q", only ops matching a query are returned, e.g.,
+ 	"?q=client=katzw AND op=checkout AND time>2024-01-01" (URL-encoded).  A query compares
+ 	fields with =, !=, <, <=, >, >=, or ~ and combines comparisons with AND, OR, NOT, and
+ 	parentheses.  Values with spaces or operators must be double-quoted.  Fields are:
+
+ 	op      an op name like "checkout", compared with = or !=.
+ 	client  the client id.  ~ matches a glob like "katz*" or a quoted regexp starting with
+ 	        "~", e.g., client~"~katz|zhao".
+ 	label   a label in a format the UUID's policy accepts.  Matches labels released by a
+ 	        "reset-labels" op; ops without a label, e.g., "reset", never match.
+ 	time    an RFC-3339 time or a date like "2024-01-01", which is midnight in the -timezone.
+ 	seq     a sequence number.  Ops without one never match.
+ 	other   any other field is an op attribute like "agent" or "task", compared as text.
+ 	        Ops without the attribute only match !=.
 
- 	Time: RFC-3339 format.
- 	Op: one of "checkout", "checkin", and "reset"
- 	Label: uint64 of the label id.
+ 	For example, "op=conflict AND (client=katzw OR holder=katzw) AND label>=1000".  A bad
+ 	query returns a 400 status describing where it failed.
+
+ 	Time: RFC-3339 format in the -timezone.
+ 	Seq: sequence number of the op, which increases by one with each op logged on the server.
+ 	     Ops logged before sequence numbers were added have none.
+ 	Agent and Tool: the User-Agent and X-Tool-Version headers of the request, if given.
+ 	Principal and IP: with -audit, the JWT subject and source IP of the request, if known.
+ 	OpID: the X-Op-ID header of the request, if given.
+ 	Ref: the X-Op-Ref header of the request, if given, e.g., a DVID mutation id or task URL.
+ 	Task: the id of the task a checkout or checkin was done for (see -assign option).
+ 	Context: the id of the client's work context when the op was done (see /context).
+ 	Op: one of "checkout", "checkin", "renew", "expire", "conflict", "reset", "reset-committed",
+ 	    "reset-labels", "meta-set", "meta-delete", and "policy-set".  A "renew" is a checkout of
+ 	    a label the client already held (see -recheckout option).  A "conflict" is a refused
+ 	    checkout and includes the "Holder" of the label.  An "expire" includes a "Reason" of
+ 	    "inactive" if the holder was inactive too long (see InactivityCheckin policy).
+ 	    A "reset-committed" is a reset done automatically because the DVID node was committed
+ 	    (see -dvid option).  A "reset-labels" includes the "Labels" it released and the
+ 	    "Client" that did it (see POST /reset/{UUID}).  Metadata ops include "Key" and, for
+ 	    "meta-set", "Value".
+ 	Label: uint64 of the label id, or a string if the UUID's policy sets a LabelOutput.
+
+GET  /search[?uuid={Pattern}][&client={Pattern}][&label={Label}[-{Label}]][&op={Op}[,{Op}...]][&since={Duration}][&limit=N][&offset=N]
+
+	Searches the history of all UUIDs, e.g., to find who ever touched a label in any version:
+
+	GET /search?client=~kat.*&label=1000-2000&op=checkout&uuid=3af*
+
+	{
+		"Total": 2,
+		"Offset": 0,
+		"Matches": [
+			{ "UUID": "3af902", "Time": "2015-12-19T16:39:57-08:00", "Seq": 201, "Op": "checkout", "Label": 1029, "Client": "katzw" },
+			{ "UUID": "3af9c1", "Time": "2015-12-20T09:12:40-08:00", "Seq": 388, "Op": "checkout", "Label": 1500, "Client": "katz" }
+		]
+	}
+
+	UUID and client patterns are globs, or regular expressions if they start with "~", and
+	must match the whole id.  Labels are decimal, and ops not on particular labels, like
+	resets, don't match a label search.  "op" takes the op names of GET /history.  "since",
+	e.g., "168h", only matches ops done within that long before the search.  Matches are
+	oldest first, 100 at a time unless "limit" is given, up to 1000.  All log segments are
+	scanned, so searches can take a while on a long history.
+
+GET  /diff/{UUID}?from={Time}[&to={Time}]
+GET  /diff/{UUID}?fromseq={Seq}[&toseq={Seq}]
+
+	Returns JSON of the labels whose lock state differs between two RFC-3339 times, e.g., to
+	reconcile an external task database after an outage.  "to" defaults to now.  Since op
+	times can repeat or go back with clock changes, a diff can instead be taken between two
+	op sequence numbers (see "Seq" in GET /history), where "toseq" defaults to the latest op
+	and the response has "FromSeq" and "ToSeq" instead of "From" and "To".
+
+	{
+		"UUID": "3af902",
+		"From": "2015-12-19T16:00:00-08:00",
+		"To": "2015-12-19T18:00:00-08:00",
+		"Changes": [
+			{ "Label": 1029, "Change": "changed-owner", "Before": "plazas", "After": "rivlinp" },
+			{ "Label": 2019, "Change": "acquired", "After": "zhaot" },
+			{ "Label": 2310, "Change": "released", "Before": "katzw" },
+			...
+		]
+	}
+
+	Changes are computed by replaying the history, so only the holders at the two times are
+	compared.  A label released and checked out again by the same client in between isn't listed.
 
 GET  /checkout/{UUID}/{Label}
 
@@ -104,341 +509,3878 @@ GET  /checkout/{UUID}/{Label}
 PUT  /checkout/{UUID}/{Label}/{Client}
 
  	Reserves a label for the given UUID for a given client id.   If that label is available for that client, 
- 	a 200 is returned.  If not, a status 409 (Conflict) is returned.
+ 	a 200 is returned.  If not, a status 409 (Conflict) is returned with a Retry-After header giving
+ 	the estimated seconds until the label frees up and JSON describing the current lock:
+
+	{
+		"Error": "could not do checkout: ...",
+		"Code": "ALREADY_CHECKED_OUT",
+		"Label": 34890,
+		"Client": "katzw",
+		"Since": "2015-12-19T16:39:57-08:00",
+		"AgeSeconds": 1830.5,
+		"HolderLastActive": "2015-12-19T17:02:11-08:00",
+		"EstimatedRelease": "2015-12-19T17:15:40-08:00",
+		"RetryAfterSeconds": 313
+	}
+
+	The estimate is based on how long the holder has kept previous locks.  If the lock has a
+	lease (see /admin/policy), an "Expires" time is included and the estimate is no later
+	than the expiration.  If the policy has a grace period, "GraceEnds" is when other clients
+	can check out the label.
+
+	A checkout of a label pinned through /admin/pin returns a 423 (Locked) status with an error
+	"Code" of "PINNED".  A checkout while the label's UUID is in a freeze set through
+	/admin/freeze returns a 423 status with an error "Code" of "FROZEN" and a Retry-After header
+	giving the seconds until the freeze ends.
+
+	With -idprovider, a checkout by a client id that isn't in the directory, e.g., a mistyped
+	one, returns a 403 status with an error "Code" of "UNKNOWN_CLIENT".  Client ids are cached
+	for an hour, and unknown ones are looked up again after a minute.  If the directory can't
+	be reached, checkouts are allowed.
+
+	Checking out a label the client already holds succeeds and, by default, logs another
+	"checkout" op.  With -recheckout=dedupe nothing is logged, with -recheckout=renew a "renew"
+	op is logged, and with -recheckout=held nothing is logged and the 200 response says so:
+
+	{ "AlreadyHeld": true, "Since": "2015-12-19T16:39:57-08:00" }
+
+	A repeated checkout that extends a lease is always logged, as a "renew" op unless
+	-recheckout is "log", and "held" responses then include the new "Expires" time.
 
 PUT  /checkin/{UUID}/{Label}/{Client}
 
 	Checks back in the given label/uuid.  The client id must match the id used to checkout the label.
 	If either the client id is incorrect or the given label/uuid was never checked out, a 400 status is returned.
+	Its error "Code" is "WRONG_CLIENT" or "NOT_CHECKED_OUT", respectively.
+
+	If a checkout or checkin can't be written to the log, e.g., because the disk is full, it
+	isn't applied and a 500 status is returned with the error "Code" "STORAGE_FAILURE".  After
+	3 failed log writes in a row, the server switches to maintenance mode so later changes are
+	refused until the problem is fixed and maintenance mode is turned off.
 
 PUT  /reset/{UUID}
 
- 	Resets all reservations made for the given UUID.  Any checkouts will be deleted.
+ 	Resets all reservations made for the given UUID.  Any checkouts will be deleted.  Like the
+	other /reset endpoints, this is only served on admin listeners (see -adminhttp).
 
-</pre>
+POST /reset/{UUID}
 
-		<h3>Licensing</h3>
-		<p><a href="https://github.com/janelia-flyem/librarian">Librarian</a> is released under the
-			<a href="http://janelia-flyem.github.com/janelia_farm_license.html">Janelia Farm license</a>, a
-			<a href="http://en.wikipedia.org/wiki/BSD_license#3-clause_license_.28.22New_BSD_License.22_or_.22Modified_BSD_License.22.29">
-			3-clause BSD license</a>.
-		</p>
-	  </section>
-	</div>
+	Releases only the labels listed in the JSON request body, whoever holds them, as a single
+	"reset-labels" op logged with the labels that were checked out:
 
-	<!-- FOOTER  -->
-	<div id="footer_wrap" class="outer">
-	  <footer class="inner">
-	  </footer>
-	</div>
-  </body>
-</html>
-`
+	{ "Labels": [ 34890, 20157, 8812 ] }
 
-const (
-	// WebAPIVersion is the string version of the API.  Once DVID is somewhat stable,
-	// this will be "v1/", "v2/", etc.
-	WebAPIVersion = ""
+	Unlike a full reset, this isn't refused by a DisallowReset policy.  Returns the labels
+	released and the clients that held them, and any labels that weren't checked out:
 
-	// The relative URL path to our Level 2 REST API
-	WebAPIPath = "/" + WebAPIVersion
+	{
+		"UUID": "3af902",
+		"Released": [ { "Label": 20157, "Client": "katzw" }, { "Label": 34890, "Client": "fred" } ],
+		"NotCheckedOut": [ 8812 ]
+	}
 
-	// WriteTimeout is the maximum time in seconds DVID will wait to write data down HTTP connection.
-	WriteTimeout = 5 * time.Second
+PUT  /checkout
+PUT  /checkin
+PUT  /reset
 
-	// ReadTimeout is the maximum time in seconds DVID will wait to read data from HTTP connection.
-	ReadTimeout = 5 * time.Second
+	Same as the endpoints above but with parameters given in a JSON request body instead of the path:
 
-	DefaultWebAddress = "localhost:8000"
-)
+	{
+		"uuid": "3af902",
+		"label": 34890,
+		"client": "katzw",
+		"ttl": "2h",
+		"meta": { "proofreading-task": "focused-1093" },
+		"opid": "6f1c2a9e-3b51-4d1e-9a0e-52c1f8a3d7b4",
+		"ref": "dvid-mutation-1093452"
+	}
 
-type WebMux struct {
-	*web.Mux
-	sync.Mutex
-	routesSetup bool
-}
+	Only "uuid" and "ref" are used for resets, and only "uuid", "label", "client", "opid", and
+	"ref" for checkins.
+	"label" can be a number or a string in a format accepted by the UUID's policy.
+	"ttl" sets the checkout's lease, which can be shorter but not longer than the policy TTL.
+	"meta" key-value pairs are set as the UUID's metadata by the client once the checkout succeeds.
+	"opid" is the same as the X-Op-ID header and "ref" the X-Op-Ref header.  Unknown fields return
+	a 400 status.
 
-var (
-	webMux   WebMux
-	cronJobs *cron.Cron
-)
+POST /checkout-multi
 
-func init() {
-	webMux.Mux = web.New()
-	webMux.Use(middleware.RequestID)
-	cronJobs = cron.New()
-}
+	Checks out labels of one or more UUIDs for a client as a single transaction, e.g., for an
+	edit grounded in both a DVID node and its child.  Either every label is checked out or none
+	are.  Takes a JSON request body with up to 1000 labels and an optional "ttl" for each lease:
 
-// ServeSingleHTTP fulfills one request using the default web Mux.
-func ServeSingleHTTP(w http.ResponseWriter, r *http.Request) {
-	if !webMux.routesSetup {
-		initRoutes()
+	{
+		"client": "katzw",
+		"ttl": "2h",
+		"labels": [ { "uuid": "3af902", "label": 34890 }, { "uuid": "7c31e0", "label": 34890 } ]
 	}
 
-	// Allow cross-origin resource sharing.
-	w.Header().Add("Access-Control-Allow-Origin", "*")
+	Returns the transaction id, which is logged as a "txn" attribute of each checkout and shown
+	as "Txn" in history, and the labels checked out:
 
-	webMux.ServeHTTP(w, r)
-}
+	{
+		"Txn": "1i8p3nb0mk2yo",
+		"Client": "katzw",
+		"Labels": [
+			{ "UUID": "3af902", "Label": 34890 },
+			{ "UUID": "7c31e0", "Label": 34890, "AlreadyHeld": true }
+		]
+	}
 
-func serveHttp(address string) {
-	log.Printf("Librarian server listening at %s ...\n", address)
-	if !webMux.routesSetup {
-		initRoutes()
+	All labels are checked before any checkout is logged, so if one is held by another client,
+	pinned, or frozen, no checkout is logged and the error status of PUT /checkout for that label is
+	returned, e.g., a 409 status with its current lock.  A UUID's MaxCheckoutsPerClient policy and
+	MaxCheckouts quota count all of the request's labels of that UUID.  If a checkout fails after
+	others were logged, e.g., because the log can't be written, those labels are released and
+	checked back in with the same "Txn" and "Rollback": true.  Any whose checkins can't be logged
+	are listed in the error, since they are checked out again after a restart.  The UUIDs must all
+	be on this librarian, so the request isn't forwarded by "librarian router".
+
+GET  /clients/{Client}/tools
+
+	Returns JSON for the tools used by the client, most recently used first:
+
+	{
+		"Client": "katzw",
+		"Tools": [
+			{
+				"Agent": "NeuTu/2019.02.13",
+				"Tool": "neu3 1.2.0",
+				"FirstSeen": "2015-12-19T16:39:57-08:00",
+				"LastSeen": "2015-12-20T11:02:31-08:00",
+				"Ops": 412
+			},
+			...
+		]
+	}
+
+	Agent is the User-Agent header and Tool is the optional X-Tool-Version header sent with
+	checkouts, checkins, resets, and metadata changes.  Both are also recorded in history.
+	Tools are tracked from ops in the current librarian log, so uses before the last
+	compaction only appear in history.
+
+POST /context/{Client}
+GET  /context/{Client}
+DELETE /context/{Client}
+GET  /context
+
+	Opens, returns, or closes a client's work context, e.g., a proofreading campaign.  POST takes
+	a JSON body with the context name and returns the opened context:
+
+	{ "Client": "katzw", "ID": "1i8p3nb0mk2yo", "Name": "orphan sweep #12", "Opened": "2015-12-19T16:39:57-08:00" }
+
+	While a context is open, the client's checkouts, checkins, conflicts, and metadata and policy
+	changes are recorded in history with its "Context" id, so ops can be grouped by campaign.
+	Opening a context replaces any open one.  Open contexts are kept across restarts.  GET of
+	a client without an open context returns a 404 status.  GET /context returns all open
+	contexts: { "Contexts": [ ... ] }.  "librarian analyze" reports ops by context.
+
+GET  /views
+POST /views
+GET  /views/{Name}
+DELETE /views/{Name}
+
+	Saves, lists, runs, or deletes named views, so common reports don't need their filters
+	given again.  A view is a GET request of /state/, /federated/state/, /history/, /search,
+	/diff/, /uuids, /stats/, /report/, or /graphql.  POST takes a JSON body and returns the
+	saved view:
+
+	{ "Name": "team-a-week", "Path": "/search?client=~teama.*&since=168h", "Client": "katzw" }
+
+	{ "Name": "team-a-week", "Path": "/search?client=~teama.*&since=168h", "Owner": "katzw", "Saved": "..." }
+
+	Names are up to 64 letters, digits, '.', '_', or '-'.  The owner defaults to the
+	authenticated client, and saving over or deleting another client's view needs the admin
+	role.  GET /views returns all views sorted by name: { "Views": [ ... ] }.  GET of a view
+	returns what a GET of its Path returns now, made with the caller's credentials and Accept
+	header, so a view of /state/{UUID} returns msgpack if the caller asks for it.  The query
+	string of GET /views/{Name} is ignored.  Views are logged as "view-save" and "view-delete"
+	ops, so they are kept across restarts and compaction.  The dashboard at /console lists the views and shows the
+	results of the one picked.
+
+GET  /report/daily/{Date}
+
+	Returns a digest of ops on the given date, e.g., "2015-12-19", in the -timezone:
+
+	{
+		"Date": "2015-12-19",
+		"Made": "2015-12-20T07:00:00-08:00",
+		"Ops": 1843, "Checkouts": 802, "Checkins": 780, "Expired": 3, "Resets": 1, "Conflicts": 57,
+		"TopClients": [ { "Client": "katzw", "Ops": 402, "Checkouts": 190, "Checkins": 188, "Conflicts": 24 }, ... ],
+		"OldLocks": [ { "UUID": "3af902", "Label": 2310, "Client": "zhaot", "Since": "...", "AgeHours": 51.2 }, ... ],
+		"ConflictOps": [ { "Time": "...", "UUID": "3af902", "Label": 2310, "Client": "katzw", "Holder": "zhaot" }, ... ]
+	}
+
+	OldLocks are locks held over 24 hours as of when the digest is made.  TopClients lists
+	up to 10 clients and ConflictOps up to 50 conflicts.  Use the query string "?format=text"
+	or "?format=html" for a text or HTML report.  The digest for the previous day is sent
+	daily by email and/or webhook if the -digestemail or -digestwebhook options are set.
+
+GET  /stats/conflicts[?window={Duration}]
+
+	Returns how often each pair of clients conflicted over the given window ending now, e.g.,
+	"7d" (the default), "36h", or "1d12h", with the pairs that conflicted most first:
+
+	{
+		"Window": "7d", "Since": "...", "Until": "...", "Conflicts": 57,
+		"Pairs": [ { "Client1": "katzw", "Client2": "zhaot", "Conflicts": 31, "Refused1": 24,
+			     "Refused2": 7, "Labels": 12, "Last": "..." }, ... ]
+	}
+
+	Refused1 counts conflicts where Client1 was refused a label held by Client2, and Refused2
+	the reverse.  Labels is the number of distinct labels the pair conflicted on.
+
+GET  /stats/replication
+
+	Returns how far each follower that acknowledged ops with POST /replicate/ack is behind
+	this server, the primary:
+
+	{
+		"Seq": 48220, "MaxLagOps": 10000,
+		"Followers": [ { "Name": "standby-1", "Seq": 48213, "LagOps": 7, "LastAck": "...",
+				 "SinceAck": "4s", "Behind": false }, ... ]
+	}
+
+	Behind is true if LagOps is over -replicationlag.  The lag of each follower is also in the
+	librarian_replication_lag expvar at /debug/vars, and librarian_replication_followers_behind
+	counts followers that are behind.  Followers are listed after a restart once they ack again.
+
+GET  /stats/memory
+
+	Returns the estimated memory of the library's state, measured every minute, with each
+	UUID's share, largest first:
+
+	{
+		"Measured": "...", "Bytes": 5242880, "MaxBytes": 8388608, "OverCap": false,
+		"HeapBytes": 9437184, "PrunedUUIDs": 12,
+		"UUIDs": [ { "UUID": "3af902", "Bytes": 1048576, "Checkouts": 8120, "RecentOps": 100 }, ... ]
+	}
+
+	Bytes estimates checkouts, metadata, pins, comments, freezes, supersessions, and recent
+	history.  HeapBytes is the Go heap of the whole server.  If Bytes is over -maxmemory, the
+	checkout maps, recent history, and cached views of UUIDs without checkouts are pruned, so
+	their history is read from the log.  If still over, OverCap is true and checkouts of UUIDs
+	that have never had an op return a 507 status with Code "MEMORY_CAP".  The estimates are
+	also the librarian_memory_bytes and librarian_memory_uuid_bytes expvars at /debug/vars.
+
+GET  /calendar/{Client}.ics
+
+	Returns an iCalendar feed with an event at the expiration of each of the client's checkouts
+	that has a lease (see /admin/policy).  Calendar apps can subscribe to the feed to see upcoming
+	lock expirations.  Checkouts without a lease never expire and are not included.
+
+GET  /graphql?query={Query}[&variables={JSON}][&operationName={Name}]
+POST /graphql
+
+	Runs a read-only GraphQL query over UUIDs, checkouts, history, clients, and stats.  POST
+	requests send the query as JSON:
+
+	{
+		"query": "query($id: String!) { uuid(id: $id) { checkouts { label client } history(limit: 5) { time op client } } }",
+		"variables": { "id": "3af902" }
+	}
+
+	The response follows GraphQL conventions with "data" and any "errors":
+
+	{ "data": { "uuid": { "checkouts": [ { "label": 34890, "client": "katzw" } ], "history": [ ... ] } } }
+
+	Queries can use variables, aliases, and fragments.  Mutations, directives, and introspection
+	are not supported.  Queries need only the reader role.
+
+GET  /graphql/schema
+
+	Returns the GraphQL schema as text.
+
+GET  /events/{Client}
+
+	Streams events for the client's checkouts as server-sent events (text/event-stream):
+
+	event: lease-expiring
+	data: {"Event":"lease-expiring","UUID":"3af902","Label":34890,"Client":"katzw","Expires":"2015-12-19T17:15:40-08:00","GraceEnds":"2015-12-19T17:30:40-08:00"}
+
+	"lease-expiring" is sent once per lease when it is within the policy's ExpiryWarning of
+	running out.  Renewing the checkout starts a new lease.  "lease-expired" is sent when the
+	lease and any grace period have run out and the label was released.  "GraceEnds" is only
+	included if the UUID's policy has a GracePeriod.  Comments are sent every 30 seconds to
+	keep idle connections open.  Events for a subscriber that falls far behind are dropped.
+
+	If the UUID's policy has an InactivityCheckin, "inactivity-warning" is sent when the client
+	will be inactive that long within the policy's ExpiryWarning, and "inactivity-checkin" when
+	the label was released for inactivity.  Both include "CheckinAt", the time of release.
+	"reminder" is sent when a reminder set with PUT /remind is due.
+
+	"conflict" is sent when another client is refused a checkout of one of the client's labels,
+	with the refused client in "Requester".
+
+	"freeze-warning" is sent for each of the client's labels in a UUID about to be frozen by
+	/admin/freeze, with the freeze's name in "Freeze" and its window in "Starts" and "Ends".
+
+	"force-released" is sent when one of the client's labels is released without the client
+	checking it in: by a reset of its UUID, by POST /reset/{UUID} for the label, or by
+	/admin/release-stale.  "ReleasedBy" gives the client that released it, if known.
+
+	"label-mutated" is sent when one of the client's labels is merged, cleaved, or split in DVID
+	(see POST /hooks/dvid), with the "Mutation", DVID "MutationID", and the "NewLabel" the body
+	was merged into or split off.  "Moved" is true if the client now holds the NewLabel.
+
+	"server-closing" is sent to every subscriber, whatever its labels, when a shutdown is
+	planned with POST /admin/drain and again when the server is stopped by a signal, with the
+	banner in "Notice" and the shutdown time in "ClosesAt".  UUID is empty and Label is 0.
+
+PUT    /clients/{Client}/notifications
+GET    /clients/{Client}/notifications
+DELETE /clients/{Client}/notifications
+
+	Sets, returns, or removes the client's own notification preferences, so the client's events
+	are also posted to its webhook or emailed through -smtp while it isn't subscribed.  PUT a
+	JSON body with a "Webhook" URL, an "Email" address, or both, and the events to send:
+
+	{ "Webhook": "https://chat.example.org/hooks/katzw", "Email": "katzw@example.org",
+	  "Events": ["force-released", "lock-changed", "lease-expiring"] }
+
+	Any event of /events/{Client} can be chosen, e.g., "force-released" when a label the client
+	holds is released by someone else, "lock-changed" when a label it registered an intent for
+	with /intent frees up, or "lease-expiring" when a lease is near expiry.  The webhook's host
+	and the email's domain must be allowed by -notifyhosts, and webhooks to loopback or
+	link-local addresses are refused, returning a 400 status.  Webhooks get the event JSON as
+	sent to /events, and failed deliveries are retried (see /admin/notifications).  Each
+	client's events are delivered in order, and while 100 are waiting, more are dropped and
+	counted by the librarian_client_notifications_dropped expvar.
+	The preferences are returned with the normalized "Client" and the time they were "Updated",
+	are kept in the librarian log's file plus ".clientnotify", and replace any set before.
+	Requires the writer role for the client.  GET and DELETE return a 404 status if the client
+	has no preferences.
+
+GET  /ws/{Client}
+
+	Opens a WebSocket over which the client can check out and check in labels without a
+	request per op, and that also receives the client's events.  Commands are JSON text
+	messages with the fields of the PUT /checkout and /checkin JSON request bodies plus an "op"
+	of "checkout" or "checkin", an optional "id", and, for checkouts, an optional "resolve":
+
+	{ "id": 17, "op": "checkout", "uuid": "3af902", "label": 34890, "ttl": "2h" }
+
+	"client" defaults to the WebSocket's client.  Commands are run in the order they are sent,
+	and each is answered with an ack giving the command's "id" and the status and any JSON
+	response the equivalent PUT request would have returned, e.g., for a conflict:
+
+	{ "Type": "ack", "ID": 17, "Status": 409, "Response": { "Error": "could not do checkout: ...", "Code": "ALREADY_CHECKED_OUT", ... } }
+
+	Events are sent as they happen:
+
+	{ "Type": "event", "Event": { "Event": "conflict", "UUID": "3af902", "Label": 34890, "Client": "katzw", "Requester": "fred", ... } }
+
+	Opening the WebSocket needs the writer role.  The server pings every 30 seconds, and
+	connections that don't answer within a minute are closed.
+
+POST /migrate/{FromUUID}/{ToUUID}[?client={Client}][&labels={Labels}][&dryrun=true]
+
+	Moves checkouts from one UUID to another at once, e.g., when work moves from a DVID node to
+	its child, so the locks follow it.  "client" only moves that client's checkouts and "labels"
+	only the given comma-separated labels.  Without "client", the admin role is needed.  Each
+	checkout is logged as a pair of ops: a "checkout" under the new UUID with a "migrated-from"
+	attribute and any lease kept, then a "checkin" under the old one with "migrated-to".
+	Returns what was moved and what was left under the old UUID:
+
+	{
+		"From": "3af902", "To": "9b2f11", "DryRun": false,
+		"Moved": [ { "Label": 34890, "Client": "katzw" }, ... ],
+		"Skipped": [ { "Label": 2310, "Client": "fred", "Reason": "checked out by zhaot under uuid 9b2f11" } ]
+	}
+
+	Checkouts of labels held by another client, pinned, or frozen under the new UUID are
+	skipped.  If the client already holds the label under the new UUID, the old checkout is
+	just checked in and "AlreadyHeld" is true.  Nothing is moved if the moves would go over the
+	new UUID's policy, returning a 403 status, or its quotas, returning a 429 or 507 status
+	with the "Code" "QUOTA_EXCEEDED", or if the new UUID would be added over -maxmemory,
+	returning a 507 status.  If a pair of ops can't be logged, the pairs already logged are rolled back with
+	"rollback" attributes and a 500 status is returned.  With "dryrun=true", nothing is
+	changed, but the policy and quota checks are still applied.
+
+POST /hooks/dvid
+
+	Adjusts locks after a DVID labelmap mutation.  The body is a mutation notification as
+	written to DVID's mutation log, or a JSON array of them applied in order:
+
+	{ "Action": "merge", "UUID": "3af902", "MutationID": 1093452, "Target": 34890, "Labels": [2310, 2311] }
+	{ "Action": "cleave", "UUID": "3af902", "MutationID": 1093453, "OrigLabel": 34890, "CleavedLabel": 40012 }
+	{ "Action": "split", "UUID": "3af902", "MutationID": 1093454, "Target": 34890, "NewLabel": 40013 }
+
+	For a merge, each of the Labels that is checked out is checked in for its holder, who is given
+	a checkout of the Target unless another client holds it, and the Labels are recorded as
+	superseded by the Target (see /admin/supersede).  For a cleave or split, the holder of the
+	label is also given a checkout of the new label, so both bodies stay locked.  New checkouts
+	keep the old lease and are logged with a "mutated-from" attribute, checkins with
+	"merged-into", and both with a "Ref" of "dvid-mutation-{MutationID}" unless the request has
+	an X-Op-Ref.  Each holder gets a "label-mutated" event.  Other actions are ignored.  Only
+	served on admin listeners (see -adminhttp), so point DVID's mutation hook at one, and
+	requires the admin role.  Returns for each mutation:
+
+	{
+		"UUID": "3af902", "Action": "merge", "MutationID": 1093452,
+		"Released": [ { "Label": 2310, "Client": "katzw" } ],
+		"Transferred": [ { "From": 2310, "To": 34890, "Client": "katzw" } ]
+	}
+
+	"AlreadyHeld" is true if the holder already had the new label, and "Skipped" says why it
+	couldn't be checked out, e.g., it's held by another client or pinned.
+
+PUT  /remind/{UUID}/{Label}/{Client}?in={Duration}
+DELETE /remind/{UUID}/{Label}/{Client}
+
+	Schedules a reminder for the client, which must have the label checked out, e.g., "?in=4h".
+	If the label is still checked out by the client when the reminder is due, a "reminder" event
+	is sent to its /events subscriptions, the reminder is posted to the -remindwebhook, and it is
+	emailed to the -remindemail address.  Reminders can be due up to 30 days ahead.  Setting a
+	reminder replaces any earlier one for the label.  Returns the reminder:
+
+	{ "UUID": "3af902", "Label": 34890, "Client": "katzw", "Due": "2015-12-19T20:39:57-08:00" }
+
+	Posted reminders also include "Since", when the label was checked out.  DELETE cancels the
+	reminder, returning a 404 status if there was none.  Reminders are checked every minute and
+	are dropped when the label is checked in.  They aren't kept across restarts.
+
+PUT  /intent/{UUID}/{Label}/{Client}
+DELETE /intent/{UUID}/{Label}/{Client}
+
+	Registers the client's intent to work on a label without checking it out, so others can
+	see the interest in GET /state while still being able to check out the label.  Returns the
+	intent:
+
+	{ "Label": 34890, "Client": "fred", "Since": "2015-12-19T16:39:57-08:00", "Expires": "2015-12-20T16:39:57-08:00" }
+
+	Whenever the label is checked out by another client or released, a "lock-changed" event
+	with the new "Holder", omitted if the label is free, is sent to the client's /events and
+	/ws subscriptions.  Unlike a checkout with "block", nothing waits for the label.  Checking
+	out the label drops the client's intent, and intents lapse after 24 hours unless
+	registered again.  Registering an intent for a label the client holds returns a 400
+	status.  DELETE drops the intent, returning a 404 status if there was none.  Intents
+	aren't logged, so they aren't kept across restarts.
+
+GET  /comments/{UUID}/{Label}
+POST /comments/{UUID}/{Label}
+
+	Leaves a short comment on a label, e.g., for whoever checks out the body next, or lists the
+	label's comments.  POST takes a JSON body with the text, up to 2000 bytes, and optionally the
+	id of a comment on the label being replied to, and returns the comment:
+
+	{ "Text": "split at the soma looks wrong, check before merging", "ReplyTo": 0, "Client": "katzw" }
+
+	{ "ID": 3, "Author": "katzw", "Time": "2015-12-19T16:39:57-08:00", "Text": "split at the soma looks wrong, ..." }
+
+	The author defaults to the authenticated client.  Ids count up from 1 for each label, and
+	replies have "ReplyTo" set.  GET returns the label's comments oldest first:
+
+	{ "UUID": "3af902", "Label": 34890, "Comments": [ { "ID": 1, ... }, { "ID": 2, "ReplyTo": 1, ... } ] }
+
+	Up to 100 comments are kept on a label, dropping the oldest.  Comments appear in the UUID's
+	history with "Op" of "comment" and are kept across restarts, resets, and compaction.  The
+	dashboard at /console shows the comments on a label when it is looked up.
+
+GET    /names/{UUID}
+GET    /names/{UUID}/{Label}
+PUT    /names/{UUID}/{Label}
+DELETE /names/{UUID}/{Label}
+
+	Sets, returns, or removes a human-readable display name for a label, since raw ids mean
+	little to coordinators.  PUT takes the name as a JSON string of up to 200 bytes, e.g.,
+	"Mi1 candidate #4".  GET of a label returns its name, or a 404 status if it has none, and
+	GET of a UUID lists all its named labels:
+
+	{ "UUID": "3af902", "Names": [ { "Label": 34890, "Name": "Mi1 candidate #4" }, ... ] }
+
+	Names are stored as metadata under keys like "label-name:34890", so they appear in
+	GET /meta/{UUID} and history as "meta-set" ops and are kept across resets and compaction.
+	Named labels have a "Name" in /state, GET /checkout/{UUID}/{Label}, and each history op on
+	the label, and the dashboard at /console shows the name of a label when it is looked up.
+
+POST /heartbeat/{Client}
+
+	Notes that the client is active without making an op, which keeps its checkouts from being
+	released by an InactivityCheckin policy.  Any op by the client also counts as activity.
+	Returns the client and its last activity:
+
+	{ "Client": "katzw", "LastActive": "2015-12-19T16:39:57-08:00" }
+
+	Heartbeats aren't logged, so all clients are considered active when the server starts.
+
+GET  /meta/{UUID}
+
+	Returns a JSON object of all metadata key-value pairs stored for the given UUID:
+
+	{ "task-list": "http://tasks.example.org/list/23", "round": "4" }
+
+	If no metadata is stored for the UUID, returns the empty object "{}".
+
+GET  /meta/{UUID}/{key}
+
+	Returns the value stored under the key for the given UUID.  If no value was stored,
+	a 404 status is returned.
+
+PUT  /meta/{UUID}/{key}
+
+	Stores the request body as the value for the key, replacing any previous value.
+	Values are limited to 64 KB.  Metadata is kept across resets and compactions and
+	metadata changes appear in the UUID's history with "Op" of "meta-set" or "meta-delete".
+
+DELETE /meta/{UUID}/{key}
+
+	Deletes the key for the given UUID.  If the key does not exist, a 404 status is returned.
+
+GET  /admin/policy/{UUID}
+
+	Returns JSON for the policy applied to checkouts and resets of the given UUID:
+
+	{
+		"TTL": "24h",
+		"MaxCheckoutsPerClient": 50,
+		"MaxCheckouts": 20000,
+		"MaxLogBytes": 52428800,
+		"DisallowReset": true,
+		"LabelFormats": [ "decimal", "seg:" ],
+		"LabelOutput": "seg:",
+		"GracePeriod": "15m",
+		"ExpiryWarning": "10m",
+		"InactivityCheckin": "8h"
+	}
+
+	TTL: lease for new checkouts as a Go duration string.  Checkouts are released with an
+	     "expire" op once their lease runs out.  Checking out a label again renews its lease.
+	     If empty or omitted, checkouts never expire.
+	MaxCheckoutsPerClient: checkouts beyond this number for one client return a 403 status.
+	     If 0, there is no limit.
+	MaxCheckouts: quota on the labels of the UUID checked out at once by all clients, so one
+	     runaway project can't use up the server's memory.  Checkouts beyond it return a 429
+	     status with an error "Code" of "QUOTA_EXCEEDED".  If 0 or omitted, there is no quota.
+	MaxLogBytes: quota on the bytes of the UUID's ops in the librarian log since it was last
+	     compacted.  Once the UUID's ops reach it, checkouts return a 507 status with an error
+	     "Code" of "QUOTA_EXCEEDED" until compaction.  If 0 or omitted, there is no quota.
+	     For both quotas, checkouts of labels the client already holds are allowed, and a
+	     warning is logged when the UUID reaches 90%% of a quota and again at the quota.  The
+	     librarian_quota_levels expvar at /debug/vars maps UUIDs near or at a quota to
+	     "warning" or "exceeded", and GET /admin/storage lists usage under "Quotas".
+	DisallowReset: if true, resets of the UUID return a 403 status.
+	LabelFormats: formats accepted for {Label} in URLs.  "decimal" is 6699, "hex" is 0x1a2b,
+	     and a prefix ending in ":" like "seg:" accepts "seg:6699" or "seg:0x1a2b".  If empty
+	     or omitted, decimal and hex labels are accepted.
+	LabelOutput: format of labels in /state, /checkout, and /history responses.  Decimal
+	     labels are JSON numbers, while "hex" and prefixed labels are strings like "0x1a2b"
+	     and "seg:6699".  If empty or omitted, labels are decimal.  Labels are always stored
+	     as 64-bit unsigned integers, so formats can be changed at any time.
+	GracePeriod: time after a lease runs out during which the holder can still renew it by
+	     checking out the label again, while other clients get a 409 status.  The label is
+	     released once the grace period ends.  If empty or omitted, there is no grace period.
+	ExpiryWarning: how long before a lease runs out to send a "lease-expiring" event to the
+	     holder (see /events).  If empty or omitted, the warning is 5 minutes before.
+	InactivityCheckin: time without ops or heartbeats (see /heartbeat) by a client after which
+	     its checkouts of the UUID are released, whatever their leases, with an "expire" op
+	     whose "reason" is "inactive".  The client is sent an "inactivity-warning" event the
+	     ExpiryWarning before.  If empty or omitted, checkouts aren't released for inactivity.
+
+	UUIDs without a policy return the default, unrestricted policy.
+
+PUT  /admin/policy/{UUID}
+
+	Sets the policy for the given UUID using JSON of the above form in the request body.
+	Policies are stored in the librarian log and changes appear in the UUID's history with
+	"Op" of "policy-set".
+
+POST /admin/rename-client
+
+	Renames a client, e.g., after a username change, using a JSON request body:
+
+	{ "From": "zhaot", "To": "tzhao", "History": true }
+
+	All active checkouts, any open work context, and activity of "From" are reassigned to "To"
+	at once, and a "rename-client" op is recorded in the log.  "To" can be a client that has
+	already been used, in which case its open work context, if any, is kept.  If "History" is
+	true, past ops of "From" are also attributed to "To" in /history, digests, and the offline
+	analyze report.  Otherwise history still shows the old id.  Returns:
+
+	{ "From": "zhaot", "To": "tzhao", "Checkouts": 12, "History": true }
+
+	A client without any recorded activity returns a 400 status.
+
+GET    /admin/pin/{UUID}
+PUT    /admin/pin/{UUID}/{Label}[?reason={Reason}]
+DELETE /admin/pin/{UUID}/{Label}
+
+	Pins a label so all checkouts of it are refused, e.g., for a published or frozen body, until
+	it is unpinned.  A current checkout of the label is left for its holder to check in.  PUT
+	returns the pin, and GET returns all pinned labels of the UUID:
+
+	{ "UUID": "3af902", "Pinned": [ { "Label": 2310, "Reason": "published", "Client": "katzw", "Since": "..." }, ... ] }
+
+	Pinned labels are also listed under "Pinned" in GET /state and the "Pinned" field of GET
+	/checkout.  DELETE returns a 404 status if the label isn't pinned.  Pins appear in the UUID's
+	history with "Op" of "pin" or "unpin" and survive resets.
+
+GET    /admin/freeze/{UUID}
+POST   /admin/freeze/{UUID}
+DELETE /admin/freeze/{UUID}/{Name}
+
+	Schedules windows during which all checkouts of the UUID's labels are refused, e.g., while
+	a release is made from it.  POST takes a JSON body giving the freeze a name, a cron spec
+	with seconds for the starts of its windows in the server's time zone, and their duration:
+
+	{ "Name": "friday-release", "Schedule": "0 0 14 * * FRI", "Duration": "2h", "Reason": "weekly release" }
+
+	"Warning" is how long before a window starts to send a "freeze-warning" event (see
+	/events) to the holders of the UUID's labels, which defaults to "15m".  Windows last up to
+	a week.  Saving a freeze with the name of an existing one replaces it.  POST returns the
+	freeze, and GET returns all freezes of the UUID with their current or next window:
+
+	{
+		"UUID": "9b2f",
+		"Freezes": [
+			{
+				"Name": "friday-release", "Schedule": "0 0 14 * * FRI", "Duration": "2h0m0s",
+				"Warning": "15m0s", "Reason": "weekly release", "Client": "admin", "Set": "...",
+				"Active": false, "Start": "2015-12-25T14:00:00-08:00", "End": "2015-12-25T16:00:00-08:00"
+			}
+		]
+	}
+
+	Current checkouts are left for their holders to check in, but no label can be checked out
+	while a window is active.  DELETE drops a freeze, returning a 404 status if there is none.
+	Freezes appear in the UUID's history with "Op" of "freeze" or "unfreeze" and survive resets
+	and restarts.
+
+GET  /admin/supersede/{UUID}
+POST /admin/supersede/{UUID}
+
+	Records that labels of the given UUID have been superseded, e.g., after bodies were merged
+	in DVID, using a JSON request body of old to new label mappings:
+
+	{ "Mappings": [ { "Old": 1, "New": 2019 }, { "Old": 77, "New": 2019 } ] }
+
+	Labels can be given in any format accepted by the UUID's policy.  Mappings are chained, so if
+	2019 is later superseded by 3001, label 1 resolves to 3001.  A mapping that would make a label
+	supersede itself returns a 400 status and none of the mappings are applied.  Mappings appear
+	in the UUID's history with "Op" of "supersede" and are only used by requests with
+	"resolve=true" (see above).  GET returns all mappings with each label's current id:
+
+	{
+		"UUID": "3af902",
+		"Mappings": [
+			{ "Old": 1, "New": 2019, "Current": 3001 },
+			{ "Old": 2019, "New": 3001, "Current": 3001 },
+			...
+		]
+	}
+
+GET  /admin/export-config
+POST /admin/import-config[?replace=true&skipoptions=true]
+
+	Exports or imports the configuration of the librarian as one versioned JSON document, e.g.,
+	to copy it to a new server or keep it in version control:
+
+	{
+		"Version": 1,
+		"Exported": "...",
+		"Policies": { "3af902": { "TTL": "24h", "MaxCheckoutsPerClient": 0, ... }, ... },
+		"Pins": { "3af902": [ { "Label": 2310, "Reason": "published", "Client": "katzw", "Since": "..." }, ... ] },
+		"Options": { "digestwebhook": "https://...", "dailyclear": "", "backup": "", ... }
+	}
+
+	"Options" holds the reloadable options (see /admin/reload), such as the webhooks and the
+	-dailyclear and -backup schedules.  They aren't applied on import since the -config file
+	sets them, so a bundle whose options differ here returns a 400 status naming them unless
+	"skipoptions=true" is given.  The librarian has no namespaces or ACLs to bundle, and a
+	bundle with any other section also returns a 400 status.  Import sets the bundle's policies
+	and pins, logged as usual under the importing client, and returns what changed along with
+	any options skipped because they differ here:
+
+	{ "Policies": 2, "Pinned": 14, "Unpinned": 0, "Reset": [], "Differing": [ "digesthour" ] }
+
+	With "replace=true", labels pinned here but not in the bundle are unpinned and UUIDs with a
+	policy here but not in the bundle have it reset to the default.  The import is all or
+	nothing: a bundle of another version or with a bad policy or pin returns a 400 status and
+	nothing is applied, and if a change can't be logged, those already made are undone and a
+	500 status is returned with the error "Code" "STORAGE_FAILURE".
+
+POST /admin/import-history[?source={Name}]
+
+	Imports a CSV audit trail from before the librarian, e.g., an exported spreadsheet, into
+	history so it can be searched, diffed, and exported along with later ops.  The first row
+	names the columns:
+
+	time,uuid,op,label,client,holder,note
+	2014-03-02 09:15:00,3af902,checkout,2310,katzw,,
+	2014-03-02 11:40:12,3af902,conflict,2310,plazas,katzw,asked on slack
+
+	"time" (or "timestamp" or "date"), "uuid", "op", and "client" (or "user") are required.
+	Times are RFC-3339 or like "2014-03-02 09:15:00" or "3/2/2014 09:15" in the -timezone.
+	Ops are "checkout", "checkin", "renew", "expire", "reset", or "conflict", and other
+	columns, like "holder" of a conflict, are kept as op attributes.  Each op also gets an
+	"import" attribute with the source name, "csv" by default.  Rows can be in any order and
+	the body can be sent with chunked transfer encoding.  Any bad row returns a 400 status and
+	nothing is imported.
+
+	Imported ops only add history and never change checkouts.  They are written, sorted by
+	time, into a new log segment before all others and must end before the first op in
+	history, so a trail too long for one request (over 1048576 rows) is imported in chunks,
+	newest first.  GET /history limits are then read from the log rather than memory so they
+	include imported ops.  Returns the segment written:
+
+	{ "Segment": "librarian.log.seg-20140302T091500-import", "Ops": 18022, "UUIDs": 4,
+	  "From": "2014-03-02T09:15:00-08:00", "To": "2015-06-30T17:02:44-07:00" }
+
+	"librarian verify" reports import segments as imported since they aren't in the chain.
+
+GET  /admin/export?format=parquet[&from={Date}][&to={Date}]
+
+	Returns a zip archive of the op history as Parquet files partitioned by date, e.g.,
+	"date=2015-12-19/ops-0.parquet", like the "librarian export" command.  Dates are like
+	"2015-12-19" in UTC and both are inclusive.  Run "librarian export -h" for the columns.
+
+GET  /admin/load
+
+	Returns the requests in flight, including low-priority requests, and the low-priority
+	requests waiting to run or shed since startup (see -maxinflight):
+
+	{ "MaxInFlight": 64, "InFlight": 12, "LowPriorityInFlight": 3, "Queued": 0, "Shed": 118 }
+
+GET  /admin/opstream
+
+	Returns JSON describing publishing of ops to the -opstream NATS subject or Kafka topic:
+
+	{
+		"URL": "nats://localhost:4222/librarian.ops",
+		"Buffered": 0,
+		"Sent": 10392,
+		"Dropped": 0,
+		"LastError": "dial tcp 127.0.0.1:4222: connect: connection refused",
+		"ErrorTime": "2015-12-19T16:39:57-08:00"
+	}
+
+	Each op is published as a message like:
+
+	{ "Time": "2015-12-19T16:39:57-08:00", "Op": "checkout", "UUID": "0c8bc", "Label": 6699,
+	  "Client": "alice", "Attrs": { "agent": "neu3/1.2" } }
+
+	Ops are buffered while the broker is unreachable and retried in order.  Up to 10000 ops
+	are buffered, after which ops are dropped and counted in "Dropped".
+
+POST /admin/release-stale/{UUID}?olderthan={Duration}[&dryrun=true]
+
+	Checks in all labels of the given UUID that have been checked out for at least the given
+	Go duration, e.g., "168h" for a weekly cleanup, and returns what was released:
+
+	{
+		"UUID": "0c8bc",
+		"OlderThan": "168h0m0s",
+		"DryRun": false,
+		"Released": [
+			{ "Label": 6699, "Client": "alice", "CheckedOut": "2015-12-10T16:39:57-08:00", "Age": "213h5m2s" },
+			...
+		]
+	}
+
+	Each release appears in the UUID's history as a "checkin" by the holder with a "released-by"
+	field naming the admin client.  If dryrun=true, only returns what would be released.
+
+GET  /admin/storage
+
+	Returns JSON describing the librarian log's disk usage:
+
+	{
+		"LogFile": "/path/to/librarian.log",
+		"LogBytes": 1048576,
+		"SegmentBytes": 524288000,
+		"Segments": 3,
+		"LimitBytes": 104857600,
+		"Action": "compact",
+		"OverLimit": false,
+		"DiskAvailable": 21474836480,
+		"DiskTotal": 107374182400,
+		"TruncationsRecovered": 0,
+		"WriteFailures": 0,
+		"LogCRC32": "5b0e9a1c",
+		"SegmentCRC32": { "librarian.log.seg-20151203T020000": "e3069283", ... },
+		"CorruptSegments": [],
+		"LastFsync": "2015-12-10T08:14:59-08:00",
+		"Quotas": [
+			{ "UUID": "3af902", "Checkouts": 18211, "MaxCheckouts": 20000, "LogBytes": 48103212,
+			  "MaxLogBytes": 52428800, "Level": "warning" }
+		]
+	}
+
+	LimitBytes is 0 if no -maxlogsize was set.  Segments are older portions of the log
+	created by compaction and are still used for history requests.  If the librarian died
+	while writing an op, the partial last line is removed from the log at startup with a
+	warning, and TruncationsRecovered and the librarian_log_truncations_recovered expvar
+	at /debug/vars count these recoveries.  WriteFailures and the librarian_log_write_failures
+	expvar count ops that couldn't be written to the log, e.g., because the disk was full.
+
+	LogCRC32 is a rolling CRC-32C of the current log, updated as ops are written, and
+	SegmentCRC32 gives the CRC-32C of each segment's uncompressed contents.  Compaction records
+	the CRC of the log in the chain op of the new log, which SegmentCRC32 gives until the
+	segment is read.  After startup, every segment is checked against it in the background, so
+	silent corruption of the disk, e.g., on an NFS volume, is caught early.
+	The log's own CRC is also checked against what was written when it's compacted.
+	Mismatches are logged as errors and listed in CorruptSegments.  LastFsync is when the
+	log was last synced to disk (see -fsync).  The librarian_log_crc32,
+	librarian_log_segment_crc32, librarian_log_segments_corrupt, and librarian_log_last_fsync
+	(Unix seconds) expvars at /debug/vars export the same for monitoring.
+
+GET  /admin/history-cache
+POST /admin/history-cache/{UUID}
+
+	With -historycache=N, the full histories of the N UUIDs whose unlimited or filtered
+	GET /history requests are most frequent are kept in memory and updated as ops are
+	written, so even the first request for a big UUID's history after it's cached doesn't
+	read the log.  Request counts halve every minute, when UUIDs that are no longer among
+	the N most requested are dropped and those that now are get built in the background.
+	GET returns the cache's state:
+
+	{ "Size": 4, "Hits": 1892, "Misses": 21, "Builds": 5, "Ops": 2381007, "UUIDs": [
+		{ "UUID": "3af902", "Queries": 37.5, "Cached": true, "Ops": 2104410,
+		  "Built": "2015-12-19T16:40:07-08:00", "BuildTime": "4.81s" },
+		{ "UUID": "b2c1d4", "Queries": 0.5, "Cached": false } ] }
+
+	POST builds a UUID's history now, counting it as requested once more than the most
+	requested UUID so it stays cached, e.g., before a review of a big UUID, and returns
+	{ "UUID": "3af902", "Ops": 2104410 }.  The librarian_history_cache_hits, _misses,
+	_builds, _uuids, and _ops expvars at /debug/vars give the same counts.  The cache is
+	cleared while the library is over -maxmemory.
+
+GET  /admin/startup-report
+
+	Returns JSON describing how the librarian log was loaded at startup:
+
+	{
+		"Started": "2015-12-10T08:00:01-08:00",
+		"Elapsed": "1.204s",
+		"LogFile": "/path/to/librarian.log",
+		"ReplayMode": "lenient",
+		"StateDB": false,
+		"Segments": 2,
+		"OpsReplayed": 183022,
+		"TruncatedLine": false,
+		"Warnings": 1,
+		"WarningList": [
+			"checkin op of uuid 3af902, label 23 by alice at 2015-12-09T17:20:44-08:00: uuid 3af902, label 23 has not been checked out so can't be checked in by alice"
+		],
+		"Checkouts": 212,
+		"Clients": 9,
+		"Locks": { "3af902": 198, "b2c1d4": 14 }
+	}
+
+	Warnings counts ops inconsistent with earlier ones, e.g., a checkin of a label that isn't
+	checked out or a checkout of a label held by another client, which -replay=lenient skips
+	and -replay=strict refuses to start on.  Only the first 100 are in WarningList.  StateDB
+	is true if most state was loaded from the -statedb so only later ops were replayed.  Locks
+	gives the checkouts of each UUID after replay.
+
+	During staged upgrades, a log can have ops of types added by a newer librarian.  These are
+	skipped with a warning and counted by type in "UnknownOps", e.g., { "transfer": 12 }, but
+	still appear in history.  The log isn't compacted while it has any.  With -replay=strict,
+	the librarian refuses to start on them instead.  Ops whose names aren't lowercase letters
+	and "-", e.g., corrupted lines, are handled as inconsistent ops.  Log lines in a newer
+	format start with a version like "v2 " and are read by their original fields.
+
+POST   /admin/tokens
+GET    /admin/tokens
+DELETE /admin/tokens/{ID}
+
+	Mints, lists, and revokes guest tokens, which let external collaborators view or lock a
+	narrow slice of the data without full credentials.  POST a JSON body like:
+
+	{ "Client": "smith-lab", "UUIDs": ["3af902"], "Labels": [23, 1002], "TTL": "72h",
+	  "Note": "review of the lobula" }
+
+	to get the token, which is only returned this once:
+
+	{ "ID": "5d0c2a9b71e4", "Token": "lgt_9c1e...", "Client": "smith-lab", "UUIDs": ["3af902"],
+	  "Labels": [23, 1002], "ReadOnly": false, "Note": "review of the lobula",
+	  "CreatedBy": "katzw", "Created": "...", "Expires": "..." }
+
+	The token is used as an "Authorization: Bearer lgt_..." header.  It only allows requests with
+	one of its UUIDs in the path, e.g., GET /state/3af902, and PUT /checkout/{UUID}/{label}/{Client}
+	and /checkin for its client.  If "Labels" is given, only those labels can be checked out and in;
+	if "ReadOnly" is true, only GET requests are allowed.  Other requests return a 403 status.
+	"Client" defaults to "guest-{ID}" and "TTL" can be at most 30 days.  Expired tokens return a
+	401 status and are revoked within a minute.  GET /admin/tokens lists unexpired tokens without
+	their secrets, oldest expiration first, and DELETE revokes one at once.  Tokens are kept, with
+	only a hash of their secrets, in the librarian log's file plus ".tokens" and survive restarts.
+	"Quotas" gives the usage of UUIDs whose policies have quotas (see /admin/policy), and
+	"Level" is "ok", "warning" at 90%% of a quota, or "exceeded".
+
+GET  /admin/snapshot
+
+	Returns a consistent JSON snapshot of all UUIDs with their checkouts, metadata, and revisions:
+
+	{
+		"Time": "2015-12-19T17:10:28-08:00",
+		"Seq": 48213,
+		"Revision": 20391,
+		"UUIDs": [
+			{
+				"UUID": "3af902",
+				"Revision": 1845,
+				"Checkouts": [ { "Label": 1, "Client": "katzw", "Since": "2015-12-19T16:39:57-08:00" }, ... ],
+				"Meta": { "round": "4" }
+			},
+			...
+		]
+	}
+
+	Checkouts with a lease (see /admin/policy) also have an "Expires" time.
+	A UUID's revision is the number of ops applied to it, and the top-level revision is the
+	total for all UUIDs.  Revisions are preserved across compactions.  "Seq" is the sequence
+	number of the last op in the snapshot, so a replica can load the snapshot and then apply
+	only -opstream ops with higher sequence numbers.  Neither depends on op times.  The
+	snapshot is copied in memory and then streamed, so checkouts are only blocked for the copy.
+
+GET  /replicate/snapshot[?since-seq={Seq}]
+
+	Returns what a warm standby needs to catch up with this server, the primary.  Like the other
+	/replicate endpoints, this is only served on admin listeners (see -adminhttp).  A new replica
+	gets a snapshot like GET /admin/snapshot, then every op logged while it was being sent, in
+	the -opstream message format:
+
+	{"Snapshot": { "Time": ..., "Seq": 48213, "Revision": 20391, "UUIDs": [...] }, "Ops": [
+	  {"Seq": 48214, "Time": "2015-12-19T17:10:29-08:00", "Op": "checkout", "UUID": "3af902", ...},
+	  ...
+	], "Seq": 48220}
+
+	A replica that already applied ops up to "since-seq", e.g., a restarted follower, gets a
+	null "Snapshot" and only the ops after it, if they are all still in the current log.  If
+	they were compacted away, it gets a snapshot as above.  The final "Seq" is the last op
+	sent, from which the replica continues with the -opstream or another request.  Requires
+	the admin role.  A 400 status is returned if "since-seq" is after the last op, and the
+	response is cut short if the log is compacted during the transfer.
+
+GET  /replicate/offset
+
+	Returns the sequence number of the last op and of the first op in the current log, or 0 if
+	unknown, so a follower can tell whether "since-seq" still works or it needs a snapshot:
+
+	{ "Seq": 48220, "FirstSeq": 41007 }
+
+POST /replicate/ack?follower={Name}&seq={Seq}
+
+	Records that a follower, e.g., "standby-1", has applied every op up to "seq", and returns its
+	lag as listed by GET /stats/replication.  Followers should ack after each transfer or batch of
+	-opstream ops.  A warning is logged when a follower falls more than -replicationlag ops behind,
+	which is rechecked every minute so a follower that stops acking is caught, and again when it
+	catches up.  Requires the admin role.  A 400 status is returned if "seq" is after the last op.
+
+POST /admin/compact
+
+	Moves the current librarian log into a segment file and starts a new log containing only
+	the active checkouts.  This is done automatically when -logsizeaction=compact.  With
+	-gzipsegments, the segment is then compressed in the background into a ".gz" file.
+	The new log starts with a "chain" op holding the SHA-256 of the segment, so the segments
+	form a hash chain that "librarian verify" checks for changes to history.
+
+	While the log has ops of types added by a newer librarian (see "UnknownOps" in GET
+	/admin/startup-report), compaction is refused with a 409 status (Conflict), since this
+	librarian can't carry their state into the new log.  Compact with the newer librarian.
+
+	If -logsizeaction=refuse and the log exceeds -maxlogsize, checkouts return a 507 status
+	(Insufficient Storage).  Checkins and resets are still allowed.
+
+GET  /admin/shadow
+POST /admin/shadow
+
+	Reports on the -shadowdb, which is written after every op like the -statedb but never
+	loaded, so it can be trusted before switching to it.  Its state is compared with the
+	state replayed from the log every 10 minutes, and POST compares it right away:
+
+	{
+		"DB": "/data/shadow.db",
+		"Writes": 18234,
+		"WriteFailures": 1,
+		"LastWriteError": "checkout of uuid 3af902: disk I/O error",
+		"LastCheck": "2015-12-19T17:10:00-08:00",
+		"CheckedSeq": 48213,
+		"Divergences": 1,
+		"Details": [
+			{ "Kind": "checkout", "UUID": "3af902", "Key": "34890",
+			  "Log": "katzw since 2015-12-20T00:39:57Z, expires never", "Shadow": "" }
+		]
+	}
+
+	"Kind" is "checkout", "meta", "policy", "revision", "pin", "superseded", "context",
+	"alias", "view", or "seq".  "Log" and "Shadow" are "" if the state is missing from that
+	side.  At most 100 divergences are listed, and the librarian_shadow_divergences expvar
+	counts all of them.  The shadow db is refilled from the log at startup and after compaction.  Failed
+	writes are logged but never fail an op.  POST returns a 400 status without a -shadowdb.
+
+GET  /admin/notifications
+GET  /admin/notifications/failed
+POST /admin/notifications/{ID}/retry
+DELETE /admin/notifications/{ID}
+
+	Lists notifications that failed to be delivered: daily digests and reminders sent by
+	webhook (-digestwebhook, -remindwebhook) or email (-digestemail, -remindemail).  A failed
+	delivery is retried after 1 minute, with the wait doubling after each failure up to 6
+	hours.  After 10 attempts it is moved to the failed list, which keeps the last 1000:
+
+	{
+		"Pending": [
+			{ "ID": "1i8p3nb0mk2yo", "Kind": "webhook", "What": "daily digest for 2015-12-19",
+			  "To": [ "https://hooks.slack.com/..." ], "Created": "2015-12-20T07:00:00-08:00",
+			  "Attempts": 3, "LastError": "bad status 503 from https://hooks.slack.com/...",
+			  "NextAttempt": "2015-12-20T07:07:00-08:00" }
+		],
+		"Failed": [ ... ]
+	}
+
+	GET /admin/notifications/failed returns only the failed list: { "Failed": [ ... ] }.
+	Both lists are saved in a file next to the log with a ".notifications" suffix a second
+	after they change and when the librarian stops, so deliveries are still retried after a
+	restart.  POST retry queues a failed notification
+	for another 10 attempts starting at the next check, which is every minute, or moves a
+	pending one's next attempt up to then.  DELETE drops a notification.  The
+	librarian_notifications_pending and librarian_notifications_failed expvars count the
+	lists.  Console login links aren't retried since the request for them returns the error.
+
+GET  /admin/maintenance
+POST /admin/maintenance?on={true|false}[&message={Message}]
+
+	Returns or sets maintenance mode, e.g., for log migrations or storage maintenance:
+
+	{ "Maintenance": true, "Message": "log migration until 3pm", "Since": "2015-12-19T13:02:11-08:00" }
+
+	In maintenance mode, requests that change state return a 503 status (Service Unavailable) with
+	the message, which defaults to the -maintenancemsg option, and a Retry-After header.  Reads,
+	GraphQL queries, and /admin requests continue.  Lease expiration, -dailyclear, -dvid resets,
+	and -assign task list pulls are paused.  Maintenance mode is not kept across restarts.
+	It is turned on automatically after repeated log write failures (see PUT /checkin).
+
+POST   /admin/notice?message={Message}
+DELETE /admin/notice
+
+	Sets or clears the banner returned by GET /notice, e.g., "DVID upgrade tonight, save your
+	work by 6pm".  Banners are not kept across restarts.
+
+POST /admin/drain?in={Duration}[&message={Message}]
+
+	Plans a shutdown in the given duration, e.g., "10m", so proofreaders get warning rather than
+	sudden connection errors.  Sets the GET /notice banner to the message, which defaults to
+	"librarian will shut down at {Time}", with "ClosesAt" the planned time, and sends a
+	"server-closing" event to every subscriber of /events and /ws.  The server keeps running
+	until it's stopped, and when stopped by a signal it sends "server-closing" again and waits
+	a second before exiting.  Returns the notice and the number of subscriptions told:
+
+	{ "Message": "librarian will shut down at 6:00PM", "Set": "2015-12-19T17:50:00-08:00",
+	  "ClosesAt": "2015-12-19T18:00:00-08:00", "Subscribers": 14 }
+
+GET  /admin/clock
+POST /admin/clock?advance={Duration}
+POST /admin/clock?to={Time}
+
+	Returns or advances the clock used for op times, leases, and scheduled jobs:
+
+	{ "Time": "2015-12-19T16:39:57-08:00", "Simulated": true }
+
+	The clock can only be advanced if the server was started with -simclock, e.g., for tests
+	of lease expiration, -dailyclear, and digests.  Advancing runs each scheduled job, such as
+	lease expiration every minute, at the simulated times it falls due, in order, and returns
+	once they are done.  The clock can't go backward.
+
+POST /admin/reload
+
+	Re-reads the -config file and applies changed options without restarting or dropping
+	connections.  Sending the server a SIGHUP does the same.  Returns the options that changed:
+
+	{ "Changed": [ "digesthour", "jwtroles" ], "RestartRequired": [ "http" ] }
+
+	The admin token, JWT, digest, -loginwebhook, -remindwebhook, -remindemail, -notifyhosts,
+	-dailyclear, -backup, -maintenancemsg, -maxinflight, -assets, and -verbose options are
+	applied, and the -admintokenfile and -jwtsecretfile files and -jwks keys are re-read even
+	if unchanged, so tokens can be rotated.  Other options, listed in "RestartRequired", need a
+	restart.  Options given on the command line override the config file and aren't reloaded.
+	If any option is invalid, a 500 status is returned and the previous options stay in effect.
+
+</pre>
+
+		<h3>Licensing</h3>
+		<p><a href="https://github.com/janelia-flyem/librarian">Librarian</a> is released under the
+			<a href="http://janelia-flyem.github.com/janelia_farm_license.html">Janelia Farm license</a>, a
+			<a href="http://en.wikipedia.org/wiki/BSD_license#3-clause_license_.28.22New_BSD_License.22_or_.22Modified_BSD_License.22.29">
+			3-clause BSD license</a>.
+		</p>
+	  </section>
+	</div>
+
+	<!-- FOOTER  -->
+	<div id="footer_wrap" class="outer">
+	  <footer class="inner">
+	  </footer>
+	</div>
+  </body>
+</html>
+`
+
+const (
+	// WebAPIVersion is the string version of the API.  Once DVID is somewhat stable,
+	// this will be "v1/", "v2/", etc.
+	WebAPIVersion = ""
+
+	// The relative URL path to our Level 2 REST API
+	WebAPIPath = "/" + WebAPIVersion
+
+	// DefaultWriteTimeout is the default maximum time the librarian will wait to write data
+	// down HTTP connection.  Streamed responses extend this deadline on each flush.
+	DefaultWriteTimeout = 5 * time.Second
+
+	// DefaultReadTimeout is the default maximum time the librarian will wait to read data
+	// from HTTP connection.
+	DefaultReadTimeout = 5 * time.Second
+
+	// StreamFlushInterval is how often streamed responses like history are flushed.
+	StreamFlushInterval = time.Second
+
+	DefaultWebAddress = "localhost:8000"
+
+	// UUIDKnownHeader is the GET /state response header that is "true" if the UUID has any
+	// history and "false" if it has never been seen.
+	UUIDKnownHeader = "X-UUID-Known"
+
+	// DefaultAdminAddress is the default address for the /admin and /reset endpoints.
+	DefaultAdminAddress = "localhost:8001"
+)
+
+type WebMux struct {
+	*web.Mux
+	sync.Mutex
+	routesSetup bool
+}
+
+var (
+	webMux   WebMux
+	cronJobs *cron.Cron
+)
+
+func init() {
+	webMux.Mux = web.New()
+	webMux.Use(middleware.RequestID)
+	cronJobs = cron.New()
+}
+
+// ServeSingleHTTP fulfills one request using the default web Mux.
+func ServeSingleHTTP(w http.ResponseWriter, r *http.Request) {
+	if !webMux.routesSetup {
+		initRoutes()
+	}
+
+	// Allow cross-origin resource sharing.
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+
+	webMux.ServeHTTP(w, r)
+}
+
+func serveHttp(listeners []*listenerT) {
+	if !webMux.routesSetup {
+		initRoutes()
+	}
+
+	activityStart = clock.Now()
+	configMu.Lock()
+	scheduleCronJobs()
+	configMu.Unlock()
+
+	if *dvidServer != "" {
+		go watchDVIDCommits(*dvidServer, *dvidPoll)
+		if *dvidMirrorInstance != "" {
+			startDVIDMirror(*dvidServer, *dvidMirrorInstance)
+		}
+	}
+	if *assignSource != "" {
+		go watchTaskList(*assignSource, *assignPoll)
+	}
+
+	// Install our handler at the root of the standard net/http default mux.
+	// This allows packages like expvar to continue working as expected.  (From goji.go)
+	http.Handle("/", &webMux)
+
+	graceful.HandleSignals()
+	var wg sync.WaitGroup
+	listening := 0
+	for _, l := range listeners {
+		ln, err := l.listen()
+		if err != nil {
+			log.Printf("CRITICAL: unable to listen on %s: %v\n", l, err)
+			continue
+		}
+		listening++
+		if l.admin {
+			log.Printf("Librarian admin API listening at %s ...\n", l)
+		} else {
+			log.Printf("Librarian server listening at %s ...\n", l)
+		}
+		srv := &graceful.Server{
+			Handler:      l.handler(http.DefaultServeMux),
+			ReadTimeout:  *readTimeout,
+			WriteTimeout: *writeTimeout,
+		}
+		wg.Add(1)
+		go func(l *listenerT) {
+			defer wg.Done()
+			if err := srv.Serve(ln); err != nil {
+				log.Printf("CRITICAL: serving on %s: %v\n", l, err)
+			}
+		}(l)
+	}
+	closeUnusedSockets()
+	notifyReady(listening)
+	wg.Wait()
+	graceful.Wait()
+	configMu.RLock()
+	cronJobs.Stop()
+	configMu.RUnlock()
+}
+
+// Starts cron jobs for the current options, replacing any running ones.  Must be called
+// with configMu locked for writing.
+func scheduleCronJobs() {
+	var jobs []cronJobT
+	if *dailyClear {
+		jobs = append(jobs, cronJobT{"0 0 2 * * *", resetLocks})
+	}
+	if *backup != "" {
+		jobs = append(jobs, cronJobT{"0 0 0 * * *", backupLog})
+	}
+	jobs = append(jobs, cronJobT{"0 * * * * *", expireLocks})
+	jobs = append(jobs, cronJobT{"0 * * * * *", sendReminders})
+	jobs = append(jobs, cronJobT{"0 * * * * *", warnFreezes})
+	jobs = append(jobs, cronJobT{"0 * * * * *", expireGuestTokens})
+	jobs = append(jobs, cronJobT{"0 * * * * *", expireIntents})
+	jobs = append(jobs, cronJobT{"0 * * * * *", checkReplicationLag})
+	jobs = append(jobs, cronJobT{"0 * * * * *", checkMemory})
+	jobs = append(jobs, cronJobT{"0 * * * * *", materializeHistory})
+	jobs = append(jobs, cronJobT{"0 30 * * * *", pruneOpIDs})
+	jobs = append(jobs, cronJobT{NotifyRetrySchedule, retryNotifications})
+	if *shadowDB != "" {
+		jobs = append(jobs, cronJobT{ShadowCheckSchedule, checkShadowJob})
+	}
+	if *digestEmail != "" || *digestWebhook != "" {
+		jobs = append(jobs, cronJobT{fmt.Sprintf("0 0 %d * * *", *digestHour), sendDigest})
+	}
+
+	// A simulated clock runs the jobs as it is advanced.
+	if clock.Simulated() {
+		if err := clock.schedule(jobs); err != nil {
+			log.Printf("ERROR: unable to schedule jobs on simulated clock: %v\n", err)
+		}
+		return
+	}
+	c := cron.New()
+	for _, job := range jobs {
+		c.AddFunc(job.spec, job.fn)
+	}
+	c.Start()
+	cronJobs.Stop()
+	cronJobs = c
+}
+
+func resetLocks() {
+	if inMaintenance() {
+		log.Printf("Skipping daily clear of locks during maintenance\n")
+		return
+	}
+	modifyLog := true
+	for _, uuid := range getUUIDs() {
+		if err := reset(uuid, nil, modifyLog); err != nil {
+			log.Printf("ERROR: unable to clear locks of uuid %s: %v\n", uuid, err)
+		}
+	}
+}
+
+func backupLog() {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	in, err := os.OpenFile(library.fname, os.O_RDONLY, 0664)
+	if err != nil {
+		log.Printf("ERROR: cannot open librarian log file for backup: %v\n", err)
+		return
+	}
+	defer in.Close()
+
+	out, err := os.Create(*backup)
+	if err != nil {
+		log.Printf("ERROR: unable to open backup file %q: %v\n", *backup, err)
+		return
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		log.Printf("ERROR: during backup to %q: %v\n", *backup, err)
+		return
+	}
+	log.Printf("Created backup of librarian log from %q to %q\n", library.fname, *backup)
+}
+
+// High-level switchboard
+func initRoutes() {
+	webMux.Lock()
+	defer webMux.Unlock()
+
+	if webMux.routesSetup {
+		return
+	}
+
+	mainMux := web.New()
+	webMux.Handle("/*", mainMux)
+	mainMux.Use(middleware.Logger)
+	mainMux.Use(middleware.AutomaticOptions)
+	mainMux.Use(recoverHandler)
+	mainMux.Use(corsHandler)
+	mainMux.Use(envelopeHandler)
+	mainMux.Use(loadHandler)
+	mainMux.Use(adminRouteHandler)
+	mainMux.Use(authHandler)
+	mainMux.Use(auditHandler)
+	mainMux.Use(opRefHandler)
+	mainMux.Use(maintenanceHandler)
+	mainMux.Use(proxyMissHandler)
+	mainMux.Use(chaosHandler)
+
+	mainMux.Put("/checkin/:uuid/:label/:client", putCheckinHandler)
+	mainMux.Put("/checkin/:uuid/:label/:client/", putCheckinHandler)
+
+	mainMux.Put("/checkout/:uuid/:label/:client", putCheckoutHandler)
+	mainMux.Put("/checkout/:uuid/:label/:client/", putCheckoutHandler)
+
+	mainMux.Get("/checkout/:uuid/:label", getCheckoutClientHandler)
+	mainMux.Get("/checkout/:uuid/:label/", getCheckoutClientHandler)
+
+	mainMux.Put("/checkin", putCheckinBodyHandler)
+	mainMux.Put("/checkin/", putCheckinBodyHandler)
+
+	mainMux.Put("/checkout", putCheckoutBodyHandler)
+	mainMux.Put("/checkout/", putCheckoutBodyHandler)
+	mainMux.Post("/checkout-multi", postCheckoutMultiHandler)
+	mainMux.Post("/checkout-multi/", postCheckoutMultiHandler)
+
+	mainMux.Put("/reset", resetBodyHandler)
+	mainMux.Put("/reset/", resetBodyHandler)
+
+	mainMux.Put("/reset/:uuid", resetHandler)
+	mainMux.Put("/reset/:uuid/", resetHandler)
+	mainMux.Post("/reset/:uuid", resetLabelsHandler)
+	mainMux.Post("/reset/:uuid/", resetLabelsHandler)
+
+	mainMux.Get("/search", searchHandler)
+	mainMux.Get("/search/", searchHandler)
+	mainMux.Get("/history/:uuid", historyHandler)
+	mainMux.Get("/history/:uuid/", historyHandler)
+
+	mainMux.Get("/diff/:uuid", diffHandler)
+	mainMux.Get("/diff/:uuid/", diffHandler)
+
+	mainMux.Get("/federated/state/:uuid", federatedStateHandler)
+	mainMux.Get("/federated/state/:uuid/", federatedStateHandler)
+
+	mainMux.Get("/state/:uuid", stateHandler)
+	mainMux.Get("/state/:uuid/", stateHandler)
+
+	mainMux.Get("/uuids", uuidsHandler)
+	mainMux.Get("/uuids/", uuidsHandler)
+
+	mainMux.Get("/clients/:client/tools", clientToolsHandler)
+	mainMux.Get("/clients/:client/tools/", clientToolsHandler)
+	mainMux.Get("/clients/:client/notifications", getClientNotifyHandler)
+	mainMux.Get("/clients/:client/notifications/", getClientNotifyHandler)
+	mainMux.Put("/clients/:client/notifications", putClientNotifyHandler)
+	mainMux.Put("/clients/:client/notifications/", putClientNotifyHandler)
+	mainMux.Delete("/clients/:client/notifications", deleteClientNotifyHandler)
+	mainMux.Delete("/clients/:client/notifications/", deleteClientNotifyHandler)
+
+	mainMux.Get("/calendar/:client", calendarHandler) // client ids can have dots, so ".ics" is cut by the handler
+
+	mainMux.Get("/context", contextsHandler)
+	mainMux.Get("/context/", contextsHandler)
+	mainMux.Get("/context/:client", getContextHandler)
+	mainMux.Get("/context/:client/", getContextHandler)
+	mainMux.Post("/context/:client", postContextHandler)
+	mainMux.Post("/context/:client/", postContextHandler)
+	mainMux.Delete("/context/:client", deleteContextHandler)
+	mainMux.Delete("/context/:client/", deleteContextHandler)
+
+	mainMux.Get("/views", getViewsHandler)
+	mainMux.Get("/views/", getViewsHandler)
+	mainMux.Post("/views", postViewHandler)
+	mainMux.Post("/views/", postViewHandler)
+	mainMux.Get("/views/:name", getViewHandler)
+	mainMux.Get("/views/:name/", getViewHandler)
+	mainMux.Delete("/views/:name", deleteViewHandler)
+	mainMux.Delete("/views/:name/", deleteViewHandler)
+
+	mainMux.Get("/events/:client", eventsHandler)
+	mainMux.Get("/events/:client/", eventsHandler)
+	mainMux.Get("/ws/:client", webSocketHandler)
+	mainMux.Get("/ws/:client/", webSocketHandler)
+	mainMux.Post("/migrate/:from/:to", migrateHandler)
+	mainMux.Post("/migrate/:from/:to/", migrateHandler)
+	mainMux.Post("/hooks/dvid", dvidHookHandler)
+	mainMux.Post("/hooks/dvid/", dvidHookHandler)
+	mainMux.Put("/remind/:uuid/:label/:client", putRemindHandler)
+	mainMux.Put("/remind/:uuid/:label/:client/", putRemindHandler)
+	mainMux.Delete("/remind/:uuid/:label/:client", deleteRemindHandler)
+	mainMux.Delete("/remind/:uuid/:label/:client/", deleteRemindHandler)
+	mainMux.Put("/intent/:uuid/:label/:client", putIntentHandler)
+	mainMux.Put("/intent/:uuid/:label/:client/", putIntentHandler)
+	mainMux.Delete("/intent/:uuid/:label/:client", deleteIntentHandler)
+	mainMux.Delete("/intent/:uuid/:label/:client/", deleteIntentHandler)
+	mainMux.Get("/comments/:uuid/:label", getCommentsHandler)
+	mainMux.Get("/comments/:uuid/:label/", getCommentsHandler)
+	mainMux.Post("/comments/:uuid/:label", postCommentHandler)
+	mainMux.Post("/comments/:uuid/:label/", postCommentHandler)
+	mainMux.Get("/names/:uuid", getLabelNamesHandler)
+	mainMux.Get("/names/:uuid/", getLabelNamesHandler)
+	mainMux.Get("/names/:uuid/:label", getLabelNameHandler)
+	mainMux.Get("/names/:uuid/:label/", getLabelNameHandler)
+	mainMux.Put("/names/:uuid/:label", putLabelNameHandler)
+	mainMux.Put("/names/:uuid/:label/", putLabelNameHandler)
+	mainMux.Delete("/names/:uuid/:label", deleteLabelNameHandler)
+	mainMux.Delete("/names/:uuid/:label/", deleteLabelNameHandler)
+	mainMux.Post("/heartbeat/:client", heartbeatHandler)
+	mainMux.Post("/heartbeat/:client/", heartbeatHandler)
+
+	mainMux.Get("/graphql", graphqlHandler)
+	mainMux.Get("/graphql/", graphqlHandler)
+	mainMux.Post("/graphql", graphqlHandler)
+	mainMux.Post("/graphql/", graphqlHandler)
+	mainMux.Get("/graphql/schema", graphqlSchemaHandler)
+
+	mainMux.Get("/report/daily/:date", dailyReportHandler)
+	mainMux.Get("/report/daily/:date/", dailyReportHandler)
+
+	mainMux.Get("/stats/conflicts", conflictStatsHandler)
+	mainMux.Get("/stats/conflicts/", conflictStatsHandler)
+	mainMux.Get("/stats/replication", replicationStatsHandler)
+	mainMux.Get("/stats/replication/", replicationStatsHandler)
+	mainMux.Get("/stats/memory", memoryStatsHandler)
+	mainMux.Get("/stats/memory/", memoryStatsHandler)
+
+	mainMux.Get("/meta/:uuid/:key", getMetaHandler)
+	mainMux.Get("/meta/:uuid/:key/", getMetaHandler)
+	mainMux.Put("/meta/:uuid/:key", putMetaHandler)
+	mainMux.Put("/meta/:uuid/:key/", putMetaHandler)
+	mainMux.Delete("/meta/:uuid/:key", deleteMetaHandler)
+	mainMux.Delete("/meta/:uuid/:key/", deleteMetaHandler)
+
+	mainMux.Get("/meta/:uuid", getMetasHandler)
+	mainMux.Get("/meta/:uuid/", getMetasHandler)
+
+	mainMux.Get("/admin/policy/:uuid", getPolicyHandler)
+	mainMux.Get("/admin/policy/:uuid/", getPolicyHandler)
+	mainMux.Put("/admin/policy/:uuid", putPolicyHandler)
+	mainMux.Put("/admin/policy/:uuid/", putPolicyHandler)
+
+	mainMux.Post("/admin/rename-client", renameClientHandler)
+	mainMux.Post("/admin/rename-client/", renameClientHandler)
+
+	mainMux.Get("/admin/pin/:uuid", getPinsHandler)
+	mainMux.Get("/admin/pin/:uuid/", getPinsHandler)
+	mainMux.Put("/admin/pin/:uuid/:label", putPinHandler)
+	mainMux.Put("/admin/pin/:uuid/:label/", putPinHandler)
+	mainMux.Delete("/admin/pin/:uuid/:label", deletePinHandler)
+	mainMux.Delete("/admin/pin/:uuid/:label/", deletePinHandler)
+	mainMux.Get("/admin/freeze/:uuid", getFreezesHandler)
+	mainMux.Get("/admin/freeze/:uuid/", getFreezesHandler)
+	mainMux.Post("/admin/freeze/:uuid", postFreezeHandler)
+	mainMux.Post("/admin/freeze/:uuid/", postFreezeHandler)
+	mainMux.Delete("/admin/freeze/:uuid/:name", deleteFreezeHandler)
+	mainMux.Delete("/admin/freeze/:uuid/:name/", deleteFreezeHandler)
+
+	mainMux.Get("/admin/supersede/:uuid", getSupersededHandler)
+	mainMux.Get("/admin/supersede/:uuid/", getSupersededHandler)
+	mainMux.Post("/admin/supersede/:uuid", postSupersedeHandler)
+	mainMux.Post("/admin/supersede/:uuid/", postSupersedeHandler)
+
+	mainMux.Get("/admin/export", exportHistoryHandler)
+	mainMux.Get("/admin/export/", exportHistoryHandler)
+	mainMux.Get("/admin/export-config", exportConfigHandler)
+	mainMux.Get("/admin/export-config/", exportConfigHandler)
+	mainMux.Post("/admin/import-config", importConfigHandler)
+	mainMux.Post("/admin/import-config/", importConfigHandler)
+	mainMux.Post("/admin/import-history", importHistoryHandler)
+	mainMux.Post("/admin/import-history/", importHistoryHandler)
+
+	mainMux.Get("/admin/load", loadStatsHandler)
+	mainMux.Get("/admin/load/", loadStatsHandler)
+
+	mainMux.Get("/admin/opstream", opStreamHandler)
+	mainMux.Get("/admin/opstream/", opStreamHandler)
+
+	mainMux.Post("/admin/release-stale/:uuid", releaseStaleHandler)
+	mainMux.Post("/admin/release-stale/:uuid/", releaseStaleHandler)
+
+	mainMux.Get("/admin/storage", storageHandler)
+	mainMux.Get("/admin/storage/", storageHandler)
+	mainMux.Get("/admin/history-cache", getHxCacheHandler)
+	mainMux.Get("/admin/history-cache/", getHxCacheHandler)
+	mainMux.Post("/admin/history-cache/:uuid", warmHxCacheHandler)
+	mainMux.Post("/admin/history-cache/:uuid/", warmHxCacheHandler)
+
+	mainMux.Get("/admin/startup-report", startupReportHandler)
+	mainMux.Get("/admin/startup-report/", startupReportHandler)
+
+	mainMux.Get("/admin/tokens", getGuestTokensHandler)
+	mainMux.Get("/admin/tokens/", getGuestTokensHandler)
+	mainMux.Post("/admin/tokens", postGuestTokenHandler)
+	mainMux.Post("/admin/tokens/", postGuestTokenHandler)
+	mainMux.Delete("/admin/tokens/:id", deleteGuestTokenHandler)
+	mainMux.Delete("/admin/tokens/:id/", deleteGuestTokenHandler)
+
+	mainMux.Get("/admin/snapshot", snapshotHandler)
+	mainMux.Get("/admin/snapshot/", snapshotHandler)
+	mainMux.Get("/replicate/snapshot", replicateSnapshotHandler)
+	mainMux.Get("/replicate/snapshot/", replicateSnapshotHandler)
+	mainMux.Get("/replicate/offset", replicateOffsetHandler)
+	mainMux.Get("/replicate/offset/", replicateOffsetHandler)
+	mainMux.Post("/replicate/ack", replicateAckHandler)
+	mainMux.Post("/replicate/ack/", replicateAckHandler)
+
+	mainMux.Get("/admin/maintenance", getMaintenanceHandler)
+	mainMux.Get("/admin/maintenance/", getMaintenanceHandler)
+	mainMux.Post("/admin/maintenance", postMaintenanceHandler)
+	mainMux.Post("/admin/maintenance/", postMaintenanceHandler)
+
+	mainMux.Get("/healthz", healthHandler)
+	mainMux.Get("/healthz/", healthHandler)
+
+	mainMux.Get("/notice", getNoticeHandler)
+	mainMux.Get("/notice/", getNoticeHandler)
+	mainMux.Post("/admin/notice", postNoticeHandler)
+	mainMux.Post("/admin/notice/", postNoticeHandler)
+	mainMux.Delete("/admin/notice", deleteNoticeHandler)
+	mainMux.Delete("/admin/notice/", deleteNoticeHandler)
+	mainMux.Post("/admin/drain", drainHandler)
+	mainMux.Post("/admin/drain/", drainHandler)
+
+	mainMux.Get("/version", versionHandler)
+	mainMux.Get("/version/", versionHandler)
+
+	mainMux.Get("/admin/clock", getClockHandler)
+	mainMux.Get("/admin/clock/", getClockHandler)
+	mainMux.Post("/admin/clock", postClockHandler)
+	mainMux.Post("/admin/clock/", postClockHandler)
+
+	mainMux.Post("/admin/reload", reloadHandler)
+	mainMux.Post("/admin/reload/", reloadHandler)
+
+	mainMux.Post("/admin/compact", compactHandler)
+	mainMux.Post("/admin/compact/", compactHandler)
+
+	mainMux.Get("/admin/notifications", getNotificationsHandler)
+	mainMux.Get("/admin/notifications/", getNotificationsHandler)
+	mainMux.Get("/admin/notifications/failed", getFailedNotificationsHandler)
+	mainMux.Get("/admin/notifications/failed/", getFailedNotificationsHandler)
+	mainMux.Post("/admin/notifications/:id/retry", retryNotificationHandler)
+	mainMux.Post("/admin/notifications/:id/retry/", retryNotificationHandler)
+	mainMux.Delete("/admin/notifications/:id", deleteNotificationHandler)
+	mainMux.Delete("/admin/notifications/:id/", deleteNotificationHandler)
+
+	mainMux.Get("/admin/shadow", getShadowHandler)
+	mainMux.Get("/admin/shadow/", getShadowHandler)
+	mainMux.Post("/admin/shadow", postShadowHandler)
+	mainMux.Post("/admin/shadow/", postShadowHandler)
+
+	mainMux.Get("/", helpHandler)
+
+	mainMux.Get("/console", consoleHandler)
+	mainMux.Get("/console/", consoleHandler)
+	mainMux.Get("/assets/:name", assetHandler)
+
+	mainMux.Post("/login", loginHandler)
+	mainMux.Post("/login/", loginHandler)
+	mainMux.Get("/login/:secret", getLoginLinkHandler)
+	mainMux.Get("/login/:secret/", getLoginLinkHandler)
+	mainMux.Post("/login/:secret", postLoginLinkHandler)
+	mainMux.Post("/login/:secret/", postLoginLinkHandler)
+	mainMux.Get("/session", getSessionHandler)
+	mainMux.Get("/session/", getSessionHandler)
+	mainMux.Delete("/session", deleteSessionHandler)
+	mainMux.Delete("/session/", deleteSessionHandler)
+	mainMux.Get("/*", NotFound)
+
+	webMux.routesSetup = true
+}
+
+// Middleware that recovers from panics and log issues.
+func recoverHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		reqID := middleware.GetReqID(*c)
+
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err) // closes the connection without a response, e.g., for -chaos
+				}
+				buf := make([]byte, 1<<16)
+				size := runtime.Stack(buf, false)
+				stackTrace := string(buf[0:size])
+				message := fmt.Sprintf("Panic detected on request %s:\n%+v\nIP: %v, URL: %s\nStack trace:\n%s\n",
+					reqID, err, r.RemoteAddr, r.URL.Path, stackTrace)
+				log.Printf("CRITICAL: %s\n", message)
+				writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			}
+		}()
+
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// errorJSON is the body of all error responses.
+type errorJSON struct {
+	Error string
+	Code  string `json:",omitempty"` // machine-readable reason for some errors, e.g., PinnedCode
+}
+
+// Writes an error response as a JSON object with an "Error" field.
+func writeError(w http.ResponseWriter, status int, errorMsg string) {
+	writeErrorCode(w, status, "", errorMsg)
+}
+
+// Writes an error response with an error code in a "Code" field.
+func writeErrorCode(w http.ResponseWriter, status int, code, errorMsg string) {
+	jsonBytes, err := json.Marshal(errorJSON{errorMsg, code})
+	if err != nil {
+		http.Error(w, errorMsg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+	fmt.Fprintln(w)
+}
+
+// Writes a response as JSON.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		BadRequest(w, r, "error marshaling JSON: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+	fmt.Fprintln(w)
+}
+
+// Writes a response as JSON, or as msgpack if the request's Accept header prefers it.
+func writeNegotiated(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Add("Vary", "Accept")
+	if !acceptsMsgpack(r) {
+		writeJSON(w, r, v)
+		return
+	}
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		BadRequest(w, r, "error marshaling JSON: %v", err)
+		return
+	}
+	msgpackBytes, err := jsonToMsgpack(jsonBytes)
+	if err != nil {
+		BadRequest(w, r, "error encoding msgpack: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", MsgpackContentType)
+	w.Write(msgpackBytes)
+}
+
+// Writes the empty JSON object returned by successful requests without other results.
+func writeOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, "{}")
+}
+
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	errorMsg := fmt.Sprintf("Could not find the URL: %s", r.URL.Path)
+	log.Printf("INFO: %s\n", errorMsg)
+	writeError(w, http.StatusNotFound, errorMsg)
+}
+
+func BadRequest(w http.ResponseWriter, r *http.Request, message string, args ...interface{}) {
+	if len(args) > 0 {
+		message = fmt.Sprintf(message, args...)
+	}
+	errorMsg := fmt.Sprintf("%s (%s).", message, r.URL.Path)
+	log.Printf("ERROR: %s\n", errorMsg)
+	writeError(w, http.StatusBadRequest, errorMsg)
+}
+
+func Forbidden(w http.ResponseWriter, r *http.Request, message string, args ...interface{}) {
+	if len(args) > 0 {
+		message = fmt.Sprintf(message, args...)
+	}
+	errorMsg := fmt.Sprintf("%s (%s).", message, r.URL.Path)
+	log.Printf("ERROR: %s\n", errorMsg)
+	writeError(w, http.StatusForbidden, errorMsg)
+}
+
+// ---- Middleware -------------
+
+// corsHandler adds CORS support via header
+func corsHandler(c *web.C, h http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// Allow cross-origin resource sharing.
+		w.Header().Add("Access-Control-Allow-Origin", "*")
+
+		h.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func helpHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "Unknown host"
+	}
+
+	// Return the help page from -assets or the embedded one.
+	if writeAssetPage(w, r, HelpAsset) {
+		return
+	}
+	page := addAssetHeader(fmt.Sprintf(WebHelp, hostname), "<body>", HelpHeaderAsset, r)
+	fmt.Fprint(w, page)
+}
+
+func uuidsHandler(w http.ResponseWriter, r *http.Request) {
+	if detailStr := r.URL.Query().Get("detail"); detailStr != "" {
+		detail, err := strconv.ParseBool(detailStr)
+		if err != nil {
+			BadRequest(w, r, "detail must be true or false, not %q", detailStr)
+			return
+		}
+		if detail {
+			uuidsDetailHandler(w, r)
+			return
+		}
+	}
+	if allStr := r.URL.Query().Get("all"); allStr != "" {
+		all, err := strconv.ParseBool(allStr)
+		if err != nil {
+			BadRequest(w, r, "all must be true or false, not %q", allStr)
+			return
+		}
+		if all {
+			writeJSON(w, r, getAllUUIDs())
+			return
+		}
+	}
+	if histStr := r.URL.Query().Get("include-historical"); histStr != "" {
+		historical, err := strconv.ParseBool(histStr)
+		if err != nil {
+			BadRequest(w, r, "include-historical must be true or false, not %q", histStr)
+			return
+		}
+		if historical {
+			writeJSON(w, r, getHistoricalUUIDs())
+			return
+		}
+	}
+	writeJSON(w, r, getUUIDsState())
+}
+
+func uuidsDetailHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var historical bool
+	if histStr := query.Get("include-historical"); histStr != "" {
+		var err error
+		if historical, err = strconv.ParseBool(histStr); err != nil {
+			BadRequest(w, r, "include-historical must be true or false, not %q", histStr)
+			return
+		}
+	}
+	sortBy := SortUUIDsByUUID
+	if sortStr := query.Get("sort"); sortStr != "" {
+		switch sortStr {
+		case SortUUIDsByUUID, SortUUIDsByCheckouts, SortUUIDsByClients, SortUUIDsByAge, SortUUIDsByActivity, SortUUIDsByBranch:
+			sortBy = sortStr
+		default:
+			BadRequest(w, r, "sort must be %q, %q, %q, %q, %q, or %q, not %q", SortUUIDsByUUID, SortUUIDsByCheckouts,
+				SortUUIDsByClients, SortUUIDsByAge, SortUUIDsByActivity, SortUUIDsByBranch, sortStr)
+			return
+		}
+	}
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, getUUIDsDetail(historical, sortBy, offset, limit))
+}
+
+// Returns the limit and offset query parameters for paging, which are 0 if not given.
+// Returns false if an error response has been written.
+func pageParams(w http.ResponseWriter, r *http.Request) (limit, offset int, ok bool) {
+	limitStr, offsetStr := r.URL.Query().Get("limit"), r.URL.Query().Get("offset")
+	if limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			BadRequest(w, r, "limit must be a positive integer, not %q", limitStr)
+			return 0, 0, false
+		}
+	}
+	if offsetStr != "" {
+		var err error
+		if offset, err = strconv.Atoi(offsetStr); err != nil || offset < 0 {
+			BadRequest(w, r, "offset must be a non-negative integer, not %q", offsetStr)
+			return 0, 0, false
+		}
+	}
+	return limit, offset, true
+}
+
+func stateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	query := r.URL.Query()
+	w.Header().Set(UUIDKnownHeader, strconv.FormatBool(knownUUID(uuid)))
+
+	if countStr := query.Get("count-only"); countStr != "" {
+		countOnly, err := strconv.ParseBool(countStr)
+		if err != nil {
+			BadRequest(w, r, "count-only must be true or false, not %q", countStr)
+			return
+		}
+		if countOnly {
+			writeNegotiated(w, r, getStateCount(uuid))
+			return
+		}
+	}
+	resolve, ok := resolveParam(w, r)
+	if !ok {
+		return
+	}
+	sortBy := SortByLabel
+	if sortStr := query.Get("sort"); sortStr != "" {
+		switch sortStr {
+		case SortByLabel, SortByClient, SortByAge:
+			sortBy = sortStr
+		default:
+			BadRequest(w, r, "sort must be %q, %q, or %q, not %q", SortByLabel, SortByClient, SortByAge, sortStr)
+			return
+		}
+	}
+	if query.Get("limit") == "" && query.Get("offset") == "" {
+		checkouts := sortedCheckouts(uuid, sortBy, resolve)
+		writeNegotiated(w, r, stateJSON{UUID: uuid, Checkouts: checkouts, Pinned: getPins(uuid), Intents: getIntents(uuid), Clients: checkoutIdentities(checkouts)})
+		return
+	}
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	page := getStatePage(uuid, sortBy, offset, limit, resolve)
+	page.Clients = checkoutIdentities(page.Checkouts)
+	writeNegotiated(w, r, page)
+}
+
+func federatedStateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getFederatedState(c.URLParams["uuid"], r))
+}
+
+func resetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	doReset(w, r, c.URLParams["uuid"])
+}
+
+func resetBodyHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeOpBody(w, r)
+	if !ok {
+		return
+	}
+	doReset(w, r, body.UUID)
+}
+
+func doReset(w http.ResponseWriter, r *http.Request, uuid string) {
+	if getPolicy(uuid).DisallowReset {
+		Forbidden(w, r, "policy for uuid %s does not allow reset", uuid)
+		return
+	}
+	if !validOpID(w, r) {
+		return
+	}
+	if err := reset(uuid, requestAttrs(r), true); err != nil {
+		if writeOpIDUsed(w, r, err) || writeStorageFailure(w, r, "unable to reset uuid "+uuid, err) {
+			return
+		}
+		BadRequest(w, r, "unable to reset uuid %s: %v", uuid, err)
+		return
+	}
+	writeOK(w)
+}
+
+type resetLabelsRequestJSON struct {
+	Labels []json.RawMessage
+}
+
+// Releases only the labels given in the request body, whoever holds them.  Unlike a full
+// reset, this isn't refused by a DisallowReset policy.
+func resetLabelsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	var body resetLabelsRequestJSON
+	dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		BadRequest(w, r, "bad JSON request body: %v", err)
+		return
+	}
+	if len(body.Labels) == 0 {
+		BadRequest(w, r, "no labels given to reset for uuid %s", uuid)
+		return
+	}
+	labels := make([]uint64, len(body.Labels))
+	for i, raw := range body.Labels {
+		label, err := parseLabelJSON(uuid, raw)
+		if err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+		labels[i] = label
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+	if !validOpID(w, r) {
+		return
+	}
+	result, err := resetLabels(uuid, labels, requestClient(c), requestAttrs(r), true)
+	if err != nil {
+		if !writeOpIDUsed(w, r, err) && !writeStorageFailure(w, r, "unable to reset labels of uuid "+uuid, err) {
+			BadRequest(w, r, "unable to reset labels of uuid %s: %v", uuid, err)
+		}
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+// streamWriter periodically flushes a response and pushes back its write deadline so
+// large responses are sent in chunks and not cut off by the server's write timeout.
+type streamWriter struct {
+	w         http.ResponseWriter
+	rc        *http.ResponseController
+	interval  time.Duration
+	lastFlush time.Time
+}
+
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	sw := &streamWriter{
+		w:         w,
+		rc:        http.NewResponseController(w),
+		interval:  StreamFlushInterval,
+		lastFlush: time.Now(),
+	}
+	// Flush well before the deadline in case a write blocks on a slow client.
+	if *writeTimeout > 0 && *writeTimeout/2 < sw.interval {
+		sw.interval = *writeTimeout / 2
+	}
+	sw.extendDeadline()
+	return sw
+}
+
+func (sw *streamWriter) extendDeadline() {
+	if *writeTimeout > 0 {
+		// Not all writers support deadlines, in which case the server timeout stands.
+		sw.rc.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	}
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if time.Since(sw.lastFlush) >= sw.interval {
+		if err := sw.rc.Flush(); err != nil {
+			return n, err
+		}
+		sw.extendDeadline()
+		sw.lastFlush = time.Now()
+	}
+	return n, nil
+}
+
+func historyHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			BadRequest(w, r, "limit must be a positive integer, not %q", limitStr)
+			return
+		}
+	}
+	var preds []hxPredT
+	if labelStr := r.URL.Query().Get("label"); labelStr != "" {
+		label, err := parseLabel(uuid, labelStr)
+		if err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+		preds = append(preds, func(op *libraryOp) bool {
+			if op.op == LabelResetOp {
+				for _, released := range op.resetLabels() {
+					if released == label {
+						return true
+					}
+				}
+				return false
+			}
+			return op.label == label || op.op == ResetOp || op.op == CommitResetOp
+		})
+	}
+	if q := r.URL.Query().Get("q"); q != "" {
+		pred, err := parseHxQuery(uuid, q)
+		if err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+		preds = append(preds, pred)
+	}
+	if len(preds) > 0 {
+		ops, err := readHx(uuid, limit, func(op *libraryOp) bool {
+			for _, pred := range preds {
+				if !pred(op) {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			BadRequest(w, r, "can't get history for uuid %s: %v", uuid, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeHxOps(uuid, getPolicy(uuid).LabelOutput, ops, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := writeHx(uuid, limit, newStreamWriter(w)); err != nil {
+		BadRequest(w, r, "can't get history for uuid %s: %v", uuid, err)
+	}
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var q searchQueryT
+	var err error
+	if pattern := query.Get("uuid"); pattern != "" {
+		if q.uuid, err = parsePattern("uuid", pattern); err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+	}
+	if pattern := query.Get("client"); pattern != "" {
+		if q.client, err = parsePattern("client", pattern); err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+	}
+	if labelStr := query.Get("label"); labelStr != "" {
+		if q.labelMin, q.labelMax, err = parseLabelRange(labelStr); err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+		q.labels = true
+	}
+	if sinceStr := query.Get("since"); sinceStr != "" {
+		since, err := time.ParseDuration(sinceStr)
+		if err != nil || since <= 0 {
+			BadRequest(w, r, "since must be a positive duration like \"168h\", not %q", sinceStr)
+			return
+		}
+		q.since = clock.Now().Add(-since)
+	}
+	if opStr := query.Get("op"); opStr != "" {
+		q.ops = make(map[opType]bool)
+		for _, name := range strings.Split(opStr, ",") {
+			op := opTypeFromString(name)
+			if op == UnknownOp {
+				BadRequest(w, r, "bad op %q", name)
+				return
+			}
+			q.ops[op] = true
+		}
+	}
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		BadRequest(w, r, "limit must be at most %d, not %d", MaxSearchLimit, limit)
+		return
+	}
+	result, err := searchHistory(&q, offset, limit)
+	if err != nil {
+		BadRequest(w, r, "can't search history: %v", err)
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+func diffHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	query := r.URL.Query()
+	var dr diffRangeT
+	var err error
+	if fromSeqStr := query.Get("fromseq"); fromSeqStr != "" {
+		dr.bySeq = true
+		if dr.fromSeq, err = strconv.ParseUint(fromSeqStr, 10, 64); err != nil {
+			BadRequest(w, r, "fromseq must be a sequence number, not %q", fromSeqStr)
+			return
+		}
+		library.RLock()
+		dr.toSeq = library.seq
+		library.RUnlock()
+		if toSeqStr := query.Get("toseq"); toSeqStr != "" {
+			if dr.toSeq, err = strconv.ParseUint(toSeqStr, 10, 64); err != nil {
+				BadRequest(w, r, "toseq must be a sequence number, not %q", toSeqStr)
+				return
+			}
+		}
+		if dr.toSeq < dr.fromSeq {
+			BadRequest(w, r, "toseq (%d) is before fromseq (%d)", dr.toSeq, dr.fromSeq)
+			return
+		}
+	} else {
+		if dr.from, err = time.Parse(time.RFC3339Nano, query.Get("from")); err != nil {
+			BadRequest(w, r, "from must be an RFC 3339 time, not %q", query.Get("from"))
+			return
+		}
+		dr.to = clock.Now()
+		if toStr := query.Get("to"); toStr != "" {
+			if dr.to, err = time.Parse(time.RFC3339Nano, toStr); err != nil {
+				BadRequest(w, r, "to must be an RFC 3339 time, not %q", toStr)
+				return
+			}
+		}
+		if dr.to.Before(dr.from) {
+			BadRequest(w, r, "to (%s) is before from (%s)", dr.to.Format(time.RFC3339), dr.from.Format(time.RFC3339))
+			return
+		}
+	}
+	diff, err := diffState(uuid, dr)
+	if err != nil {
+		BadRequest(w, r, "can't get diff for uuid %s: %v", uuid, err)
+		return
+	}
+	writeJSON(w, r, diff)
+}
+
+func putCheckoutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	label, err := parseLabel(uuid, c.URLParams["label"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	client, err := checkClientID(c.URLParams["client"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to checkout: %v", err)
+		return
+	}
+	resolve, ok := resolveParam(w, r)
+	if !ok {
+		return
+	}
+	if !validOpID(w, r) {
+		return
+	}
+	block, ok := blockParam(w, r)
+	if !ok {
+		return
+	}
+	doCheckout(w, r, uuid, label, client, 0, nil, resolve, block)
+}
+
+func putCheckoutBodyHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeOpBody(w, r)
+	if !ok {
+		return
+	}
+	label, client, ok := body.labelClient(w, r)
+	if !ok {
+		return
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to checkout: %v", err)
+		return
+	}
+	var ttl time.Duration
+	if body.TTL != "" {
+		var err error
+		if ttl, err = requestedTTL(body.UUID, body.TTL); err != nil {
+			BadRequest(w, r, "unable to checkout: %v", err)
+			return
+		}
+	}
+	for key, value := range body.Meta {
+		if key == "" || len(value) > MaxMetaValueSize {
+			BadRequest(w, r, "unable to checkout: metadata keys must be non-empty with values of at most %d bytes", MaxMetaValueSize)
+			return
+		}
+	}
+	resolve, ok := resolveParam(w, r)
+	if !ok {
+		return
+	}
+	block, ok := blockParam(w, r)
+	if !ok {
+		return
+	}
+	if !validOpID(w, r) {
+		return
+	}
+	doCheckout(w, r, body.UUID, label, client, ttl, body.Meta, resolve, block)
+}
+
+// Checks out labels of several uuids at once for POST /checkout-multi.
+func postCheckoutMultiHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	var body multiCheckoutBodyJSON
+	dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		BadRequest(w, r, "bad JSON request body: %v", err)
+		return
+	}
+	client, err := checkClientID(body.Client)
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to checkout: %v", err)
+		return
+	}
+	// The transaction id groups the checkouts, so an op id isn't recorded for each.
+	attrs := requestAttrs(r)
+	delete(attrs, "opid")
+	labels, err := body.labels(attrs)
+	if err != nil {
+		BadRequest(w, r, "unable to checkout: %v", err)
+		return
+	}
+	if refuseCheckouts() {
+		errorMsg := fmt.Sprintf("librarian log exceeds size limit so checkouts are refused (%s).", r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusInsufficientStorage, errorMsg)
+		return
+	}
+	if err := checkIdentity(client); err != nil {
+		errorMsg := fmt.Sprintf("unable to checkout: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeErrorCode(w, http.StatusForbidden, UnknownClientCode, errorMsg)
+		return
+	}
+	for _, ml := range labels {
+		if err := checkMemoryCap(ml.uuid); err != nil {
+			errorMsg := fmt.Sprintf("unable to checkout: %v (%s).", err, r.URL.Path)
+			log.Printf("ERROR: %s\n", errorMsg)
+			writeErrorCode(w, http.StatusInsufficientStorage, MemoryCapCode, errorMsg)
+			return
+		}
+	}
+	result, err := checkoutMulti(client, labels)
+	if err != nil {
+		writeCheckoutError(w, r, client, err)
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+// Does a checkout with an optional TTL overriding the policy TTL, setting any metadata
+// given with it, and writes the response.  If resolve, a superseded label is checked out as
+// its current id, which conflicts with checkouts of any label it supersedes.
+func doCheckout(w http.ResponseWriter, r *http.Request, uuid string, label uint64, client string, ttl time.Duration, meta map[string]string, resolve bool, block time.Duration) {
+	if refuseCheckouts() {
+		errorMsg := fmt.Sprintf("librarian log exceeds size limit so checkouts are refused (%s).", r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusInsufficientStorage, errorMsg)
+		return
+	}
+	if err := checkMemoryCap(uuid); err != nil {
+		errorMsg := fmt.Sprintf("unable to checkout: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeErrorCode(w, http.StatusInsufficientStorage, MemoryCapCode, errorMsg)
+		return
+	}
+	if err := checkIdentity(client); err != nil {
+		errorMsg := fmt.Sprintf("unable to checkout: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeErrorCode(w, http.StatusForbidden, UnknownClientCode, errorMsg)
+		return
+	}
+
+	req := &checkoutReqT{
+		uuid:    uuid,
+		label:   label,
+		client:  client,
+		ttl:     ttl,
+		attrs:   requestAttrs(r),
+		meta:    meta,
+		resolve: resolve,
+	}
+	label, held, err := blockingCheckout(r.Context(), req, block)
+	if block > 0 && *writeTimeout > 0 {
+		// The wait shouldn't use up the time to write the response.
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(*writeTimeout))
+	}
+	if err != nil {
+		writeCheckoutError(w, r, client, err)
+		return
+	}
+	writeCheckedOut(w, r, uuid, label, held)
+}
+
+// Logs a failed checkout by a client and writes an error response for its cause.
+func writeCheckoutError(w http.ResponseWriter, r *http.Request, client string, err error) {
+	if writeOpIDUsed(w, r, err) {
+		return
+	}
+	errorMsg := fmt.Sprintf("could not do checkout: %v (%s).", err, r.URL.Path)
+	log.Printf("ERROR: %s\n", errorMsg)
+	var pinned *pinnedError
+	var frozen *frozenError
+	var policy *policyError
+	var quota *quotaError
+	var conflict *ErrAlreadyCheckedOut
+	var deadlock *deadlockError
+	var storage *ErrStorageFailure
+	switch {
+	case errors.As(err, &pinned):
+		writeErrorCode(w, http.StatusLocked, PinnedCode, errorMsg)
+	case errors.As(err, &frozen):
+		retryAfter := (frozen.end.Sub(clock.Now()) + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+		writeErrorCode(w, http.StatusLocked, FrozenCode, errorMsg)
+	case errors.As(err, &policy):
+		writeError(w, http.StatusForbidden, errorMsg)
+	case errors.As(err, &quota):
+		writeErrorCode(w, quota.status, QuotaExceededCode, errorMsg)
+	case errors.As(err, &conflict):
+		writeConflict(w, r, conflict.UUID, conflict.Label, client, errorMsg)
+	case errors.As(err, &deadlock):
+		writeErrorCode(w, http.StatusConflict, DeadlockCode, errorMsg)
+	case errors.As(err, &storage):
+		writeErrorCode(w, http.StatusInternalServerError, StorageFailureCode, errorMsg)
+	default:
+		// Other refused checkouts keep the 409 status they always had.
+		writeError(w, http.StatusConflict, errorMsg)
+	}
+}
+
+// Logs an op that couldn't be written to the log and writes a 500 response with the error
+// "Code" "STORAGE_FAILURE".  Returns false if err isn't an *ErrStorageFailure, so no
+// response has been written.
+func writeStorageFailure(w http.ResponseWriter, r *http.Request, action string, err error) bool {
+	var storage *ErrStorageFailure
+	if !errors.As(err, &storage) {
+		return false
+	}
+	errorMsg := fmt.Sprintf("%s: %v (%s).", action, err, r.URL.Path)
+	log.Printf("ERROR: %s\n", errorMsg)
+	writeErrorCode(w, http.StatusInternalServerError, StorageFailureCode, errorMsg)
+	return true
+}
+
+// heldJSON answers a checkout of a label the client already holds with -recheckout=held.
+type heldJSON struct {
+	AlreadyHeld bool
+	Since       time.Time  // when the client checked out the label
+	Expires     *time.Time `json:",omitempty"` // when the lease runs out
+}
+
+// Writes the response to a successful checkout.
+func writeCheckedOut(w http.ResponseWriter, r *http.Request, uuid string, label uint64, held bool) {
+	if !held || *recheckout != RecheckoutHeld {
+		writeOK(w)
+		return
+	}
+	conflict, found := getConflict(uuid, label)
+	if !found {
+		writeOK(w) // released since our checkout
+		return
+	}
+	writeJSON(w, r, heldJSON{true, conflict.Since, conflict.Expires})
+}
+
+// Logs a refused checkout and writes a 409 response describing the conflicting lock.
+func writeConflict(w http.ResponseWriter, r *http.Request, uuid string, label uint64, client, errorMsg string) {
+	conflict, found := getConflict(uuid, label)
+	if !found {
+		// Lock was released since our checkout attempt.
+		writeErrorCode(w, http.StatusConflict, AlreadyCheckedOutCode, errorMsg)
+		return
+	}
+	conflict.Error = errorMsg
+	conflict.Code = AlreadyCheckedOutCode
+	logConflict(uuid, label, client, conflict.Client, requestAttrs(r))
+	jsonBytes, err := json.Marshal(conflict)
+	if err != nil {
+		writeError(w, http.StatusConflict, errorMsg)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(conflict.RetryAfterSeconds))
+	w.WriteHeader(http.StatusConflict)
+	w.Write(jsonBytes)
+}
+
+// Returns the value of the resolve query parameter.  Returns false if an error response
+// has been written.
+func resolveParam(w http.ResponseWriter, r *http.Request) (resolve, ok bool) {
+	resolveStr := r.URL.Query().Get("resolve")
+	if resolveStr == "" {
+		return false, true
+	}
+	resolve, err := strconv.ParseBool(resolveStr)
+	if err != nil {
+		BadRequest(w, r, "resolve must be true or false, not %q", resolveStr)
+		return false, false
+	}
+	return resolve, true
+}
+
+// Returns how long a checkout may wait for a held label to be released, or 0 if it
+// shouldn't wait.
+func blockParam(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	blockStr := r.URL.Query().Get("block")
+	if blockStr == "" {
+		return 0, true
+	}
+	block, err := time.ParseDuration(blockStr)
+	if err != nil || block <= 0 || block > MaxCheckoutBlock {
+		BadRequest(w, r, "block must be a positive duration up to %s, not %q", MaxCheckoutBlock, blockStr)
+		return 0, false
+	}
+	return block, true
+}
+
+func getCheckoutClientHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	label, err := parseLabel(uuid, c.URLParams["label"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+
+	resolve, ok := resolveParam(w, r)
+	if !ok {
+		return
+	}
+	format := getPolicy(uuid).LabelOutput
+	var client string
+	var found bool
+	held := label
+	if resolve {
+		label = resolveLabel(uuid, label)
+		client, held, found = resolvedHolder(uuid, label, "")
+	} else {
+		client, found = getCheckout(uuid, label)
+	}
+	pin, pinned := getPin(uuid, label)
+	if !found && !pinned {
+		writeNegotiated(w, r, struct{}{})
+		return
+	}
+	rsv := reserveJSON{Label: labelJSON{label, format}, Client: client}
+	rsv.Name, _ = getLabelName(uuid, label)
+	if found && held != label {
+		rsv.Superseded = &labelJSON{held, format}
+	}
+	if pinned {
+		rsv.Pinned = &pin
+	}
+	writeNegotiated(w, r, rsv)
+}
+
+func renameClientHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	var body renameRequestJSON
+	dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		BadRequest(w, r, "bad JSON request body: %v", err)
+		return
+	}
+	from, err := checkClientID(body.From)
+	if err != nil {
+		BadRequest(w, r, "bad from client: %v", err)
+		return
+	}
+	to, err := checkClientID(body.To)
+	if err != nil {
+		BadRequest(w, r, "bad to client: %v", err)
+		return
+	}
+	result, err := renameClient(from, to, body.History, requestAttrs(r))
+	if writeStorageFailure(w, r, "unable to rename client", err) {
+		return
+	}
+	if err != nil {
+		BadRequest(w, r, "unable to rename client: %v", err)
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+func getSupersededHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getSuperseded(c.URLParams["uuid"]))
+}
+
+func getPinsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	writeJSON(w, r, pinnedListJSON{uuid, getPins(uuid)})
+}
+
+func putPinHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	label, err := parseLabel(uuid, c.URLParams["label"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	pinned, err := pinLabel(uuid, label, r.URL.Query().Get("reason"), requestClient(c), requestAttrs(r))
+	if writeStorageFailure(w, r, "unable to pin", err) {
+		return
+	}
+	if err != nil {
+		BadRequest(w, r, "unable to pin uuid %s, label %d: %v", uuid, label, err)
+		return
+	}
+	writeJSON(w, r, pinned)
+}
+
+func deletePinHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	label, err := parseLabel(uuid, c.URLParams["label"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := unpinLabel(uuid, label, requestClient(c), requestAttrs(r)); err != nil {
+		if writeStorageFailure(w, r, "unable to unpin", err) {
+			return
+		}
+		errorMsg := fmt.Sprintf("unable to unpin: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusNotFound, errorMsg)
+		return
+	}
+	writeOK(w)
+}
+
+func getFreezesHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getFreezes(c.URLParams["uuid"]))
+}
+
+func postFreezeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	var body freezeRequestJSON
+	dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		BadRequest(w, r, "bad JSON request body: %v", err)
+		return
+	}
+	freeze, err := setFreeze(uuid, body, requestClient(c), requestAttrs(r))
+	if err != nil {
+		if writeStorageFailure(w, r, "unable to freeze uuid "+uuid, err) {
+			return
+		}
+		BadRequest(w, r, "unable to freeze uuid %s: %v", uuid, err)
+		return
+	}
+	writeJSON(w, r, freeze)
+}
+
+func deleteFreezeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if err := deleteFreeze(c.URLParams["uuid"], c.URLParams["name"], requestClient(c), requestAttrs(r)); err != nil {
+		if writeStorageFailure(w, r, "unable to unfreeze", err) {
+			return
+		}
+		errorMsg := fmt.Sprintf("unable to unfreeze: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusNotFound, errorMsg)
+		return
+	}
+	writeOK(w)
+}
+
+func postSupersedeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	mappings, err := decodeSupersede(uuid, r.Body)
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := supersede(uuid, mappings, requestClient(c), requestAttrs(r)); err != nil {
+		if writeStorageFailure(w, r, "unable to supersede labels of uuid "+uuid, err) {
+			return
+		}
+		BadRequest(w, r, "unable to supersede labels of uuid %s: %v", uuid, err)
+		return
+	}
+	writeOK(w)
+}
+
+func putCheckinHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	client, err := checkClientID(c.URLParams["client"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	label, err := parseLabel(uuid, c.URLParams["label"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	doCheckin(c, w, r, uuid, label, client)
+}
+
+func putCheckinBodyHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	body, ok := decodeOpBody(w, r)
+	if !ok {
+		return
+	}
+	label, client, ok := body.labelClient(w, r)
+	if !ok {
+		return
+	}
+	doCheckin(c, w, r, body.UUID, label, client)
+}
+
+func doCheckin(c web.C, w http.ResponseWriter, r *http.Request, uuid string, label uint64, client string) {
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to checkin: %v", err)
+		return
+	}
+	if !validOpID(w, r) {
+		return
+	}
+
+	if err := checkin(uuid, label, client, requestAttrs(r), true); err != nil {
+		if writeOpIDUsed(w, r, err) {
+			return
+		}
+		errorMsg := fmt.Sprintf("unable to checkin: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		var wrongClient *ErrWrongClient
+		var storage *ErrStorageFailure
+		switch {
+		case errors.Is(err, ErrNotCheckedOut):
+			writeErrorCode(w, http.StatusBadRequest, NotCheckedOutCode, errorMsg)
+		case errors.As(err, &wrongClient):
+			writeErrorCode(w, http.StatusBadRequest, WrongClientCode, errorMsg)
+		case errors.As(err, &storage):
+			writeErrorCode(w, http.StatusInternalServerError, StorageFailureCode, errorMsg)
+		default:
+			writeError(w, http.StatusBadRequest, errorMsg)
+		}
+		return
+	}
+	writeOK(w)
+}
+
+func getPolicyHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+
+	writeJSON(w, r, getPolicy(uuid))
+}
+
+func putPolicyHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+
+	if !validOpID(w, r) {
+		return
+	}
+	policyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		BadRequest(w, r, "unable to read policy: %v", err)
+		return
+	}
+	if err := setPolicy(uuid, string(policyBytes), requestClient(c), requestAttrs(r), true); err != nil {
+		if writeOpIDUsed(w, r, err) || writeStorageFailure(w, r, "unable to set policy", err) {
+			return
+		}
+		BadRequest(w, r, "unable to set policy for uuid %s: %v", uuid, err)
+		return
+	}
+	writeOK(w)
+}
+
+func getHxCacheHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getHxCache())
+}
+
+func warmHxCacheHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	ops, err := warmCachedHx(uuid)
+	if err != nil {
+		BadRequest(w, r, "unable to cache history of uuid %s: %v", uuid, err)
+		return
+	}
+	writeJSON(w, r, struct {
+		UUID string
+		Ops  int
+	}{uuid, ops})
+}
+
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	storage, err := getStorage()
+	if err != nil {
+		BadRequest(w, r, "unable to get storage info: %v", err)
+		return
+	}
+	writeJSON(w, r, storage)
+}
+
+func startupReportHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getStartupReport())
+}
+
+func getGuestTokensHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getGuestTokens())
+}
+
+func postGuestTokenHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	var body guestTokenRequestJSON
+	dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		BadRequest(w, r, "bad JSON request body: %v", err)
+		return
+	}
+	token, err := mintGuestToken(body, requestClient(c))
+	if err != nil {
+		BadRequest(w, r, "unable to mint guest token: %v", err)
+		return
+	}
+	writeJSON(w, r, token)
+}
+
+func deleteGuestTokenHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if err := revokeGuestToken(c.URLParams["id"], requestClient(c)); err != nil {
+		errorMsg := fmt.Sprintf("unable to revoke guest token: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusNotFound, errorMsg)
+		return
+	}
+	writeOK(w)
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	snap := takeSnapshot()
+	w.Header().Set("Content-Type", "application/json")
+	if err := snap.write(newStreamWriter(w)); err != nil {
+		BadRequest(w, r, "unable to write snapshot: %v", err)
+	}
+}
+
+func replicateSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	var sinceSeq uint64
+	sinceStr := r.URL.Query().Get("since-seq")
+	if sinceStr != "" {
+		var err error
+		if sinceSeq, err = strconv.ParseUint(sinceStr, 10, 64); err != nil {
+			BadRequest(w, r, "since-seq must be a sequence number, not %q", sinceStr)
+			return
+		}
+	}
+	rep, err := startReplication(sinceSeq, sinceStr != "")
+	if err != nil {
+		BadRequest(w, r, "unable to replicate: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := rep.write(newStreamWriter(w)); err != nil {
+		BadRequest(w, r, "unable to replicate: %v", err)
+	}
+}
+
+func replicateOffsetHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, replicationOffset())
+}
+
+func replicateAckHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	seq, err := strconv.ParseUint(query.Get("seq"), 10, 64)
+	if err != nil {
+		BadRequest(w, r, "seq must be a sequence number, not %q", query.Get("seq"))
+		return
+	}
+	follower, err := ackReplication(query.Get("follower"), seq)
+	if err != nil {
+		BadRequest(w, r, "unable to acknowledge replication: %v", err)
+		return
+	}
+	writeJSON(w, r, follower)
+}
+
+func replicationStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getReplicationStats())
+}
+
+func memoryStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getMemory())
+}
+
+func getMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getMaintenance())
+}
+
+func postMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	on, err := strconv.ParseBool(query.Get("on"))
+	if err != nil {
+		BadRequest(w, r, "query string must have on=true or on=false, not %q", query.Get("on"))
+		return
+	}
+	setMaintenance(on, query.Get("message"))
+	writeJSON(w, r, getMaintenance())
+}
+
+func getNoticeHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getNotice())
+}
+
+func postNoticeHandler(w http.ResponseWriter, r *http.Request) {
+	message := strings.TrimSpace(r.URL.Query().Get("message"))
+	if message == "" {
+		BadRequest(w, r, "query string must have a message")
+		return
+	}
+	setNotice(message, time.Time{})
+	writeJSON(w, r, getNotice())
+}
+
+func deleteNoticeHandler(w http.ResponseWriter, r *http.Request) {
+	setNotice("", time.Time{})
+	writeOK(w)
+}
+
+type drainJSON struct {
+	noticeJSON
+	Subscribers int // subscriptions sent a server-closing event
+}
+
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	in, err := time.ParseDuration(query.Get("in"))
+	if err != nil || in < 0 {
+		BadRequest(w, r, "in must be a non-negative duration like \"10m\", not %q", query.Get("in"))
+		return
+	}
+	sent := drain(in, strings.TrimSpace(query.Get("message")))
+	writeJSON(w, r, drainJSON{getNotice(), sent})
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := reloadConfig()
+	if err != nil {
+		errorMsg := fmt.Sprintf("unable to reload options: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusInternalServerError, errorMsg)
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+func getClockHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, clock.state())
+}
+
+func postClockHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var t time.Time
+	switch advanceStr, toStr := query.Get("advance"), query.Get("to"); {
+	case advanceStr != "" && toStr == "":
+		d, err := time.ParseDuration(advanceStr)
+		if err != nil || d < 0 {
+			BadRequest(w, r, "advance must be a non-negative duration like \"90m\", not %q", advanceStr)
+			return
+		}
+		t = clock.Now().Add(d)
+	case toStr != "" && advanceStr == "":
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, toStr); err != nil {
+			BadRequest(w, r, "to must be an RFC 3339 time, not %q", toStr)
+			return
+		}
+	default:
+		BadRequest(w, r, "query string must have either advance or to")
+		return
+	}
+	if err := clock.advance(t); err != nil {
+		BadRequest(w, r, "unable to advance clock: %v", err)
+		return
+	}
+	writeJSON(w, r, clock.state())
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getVersion())
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	health := healthJSON{"ok", getMaintenance()}
+	if health.Maintenance {
+		health.Status = "maintenance"
+	}
+	writeJSON(w, r, health)
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	configMu.RLock()
+	enabled := *loginWebhook != "" && *baseURL != ""
+	configMu.RUnlock()
+	if !enabled {
+		errorMsg := fmt.Sprintf("login links are not enabled, see -loginwebhook and -baseurl (%s).", r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusNotFound, errorMsg)
+		return
+	}
+	client, err := checkClientID(r.URL.Query().Get("client"))
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := sendLoginLink(client); err != nil {
+		errorMsg := fmt.Sprintf("unable to send login link: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		if _, ok := err.(*loginThrottledError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(MagicLinkInterval.Seconds())))
+			writeError(w, http.StatusTooManyRequests, errorMsg)
+			return
+		}
+		writeError(w, http.StatusBadGateway, errorMsg)
+		return
+	}
+	writeOK(w)
+}
+
+func getLoginLinkHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Write([]byte(LoginLinkHTML))
+}
+
+func postLoginLinkHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	secret, session, err := startSession(c.URLParams["secret"])
+	if err != nil {
+		Forbidden(w, r, "%v", err)
+		return
+	}
+	log.Printf("Started login session for %s\n", session.Client)
+	setSessionCookie(w, r, secret, int(SessionTTL.Seconds()))
+	http.Redirect(w, r, "/console", http.StatusSeeOther)
+}
+
+func getSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session, found := requestSession(r)
+	if !found {
+		errorMsg := fmt.Sprintf("no login session (%s).", r.URL.Path)
+		writeError(w, http.StatusNotFound, errorMsg)
+		return
+	}
+	writeJSON(w, r, session)
+}
+
+func deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	endSession(r)
+	setSessionCookie(w, r, "", -1)
+	writeOK(w)
+}
+
+func exportHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if format := query.Get("format"); format != ExportFormatParquet {
+		BadRequest(w, r, "format must be %q, not %q", ExportFormatParquet, format)
+		return
+	}
+	from, to, err := parseExportDates(query.Get("from"), query.Get("to"))
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="librarian-history.zip"`)
+	if err := exportHistoryZip(from, to, newStreamWriter(w)); err != nil {
+		log.Printf("ERROR: unable to export history: %v\n", err)
+	}
+}
+
+func exportConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, exportConfig())
+}
+
+func importConfigHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	var replace, skipOptions bool
+	for name, value := range map[string]*bool{"replace": &replace, "skipoptions": &skipOptions} {
+		if s := r.URL.Query().Get(name); s != "" {
+			var err error
+			if *value, err = strconv.ParseBool(s); err != nil {
+				BadRequest(w, r, "%s must be true or false, not %q", name, s)
+				return
+			}
+		}
+	}
+	bundle, pins, err := decodeConfigBundle(r.Body)
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	result, err := importConfig(bundle, pins, replace, skipOptions, requestClient(c), requestAttrs(r))
+	if writeStorageFailure(w, r, "unable to import config", err) {
+		return
+	}
+	if err != nil {
+		BadRequest(w, r, "unable to import config: %v", err)
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+func importHistoryHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		source = "csv"
+	}
+	result, err := importHistory(r.Body, source)
+	if err != nil {
+		BadRequest(w, r, "unable to import history: %v", err)
+		return
+	}
+	log.Printf("Client %s imported history from %q\n", requestClient(c), source)
+	writeJSON(w, r, result)
+}
+
+func loadStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getLoad())
+}
+
+func opStreamHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getOpStreamStats())
+}
+
+func releaseStaleHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	query := r.URL.Query()
+
+	olderStr := query.Get("olderthan")
+	if olderStr == "" {
+		BadRequest(w, r, "olderthan must be given as a duration like \"168h\"")
+		return
+	}
+	olderThan, err := time.ParseDuration(olderStr)
+	if err != nil || olderThan <= 0 {
+		BadRequest(w, r, "olderthan must be a positive duration like \"168h\", not %q", olderStr)
+		return
+	}
+	dryRun := false
+	if dryStr := query.Get("dryrun"); dryStr != "" {
+		if dryRun, err = strconv.ParseBool(dryStr); err != nil {
+			BadRequest(w, r, "dryrun must be true or false, not %q", dryStr)
+			return
+		}
+	}
+	attrs := map[string]string{"released-by": requestClient(c)}
+	writeJSON(w, r, releaseStale(uuid, olderThan, dryRun, attrs))
+}
+
+func compactHandler(w http.ResponseWriter, r *http.Request) {
+	if err := compactLog(); err != nil {
+		errorMsg := fmt.Sprintf("unable to compact librarian log: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		status := http.StatusInternalServerError
+		var unknown *unknownOpsError
+		if errors.As(err, &unknown) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, errorMsg)
+		return
+	}
+	writeOK(w)
+}
+
+func getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getNotifications())
+}
+
+func getFailedNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, struct{ Failed []notificationJSON }{getNotifications().Failed})
+}
+
+func retryNotificationHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	n, err := requeueNotification(c.URLParams["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%v (%s).", err, r.URL.Path))
+		return
+	}
+	writeJSON(w, r, n)
+}
+
+func deleteNotificationHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !dropNotification(c.URLParams["id"]) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no notification with id %q (%s).", c.URLParams["id"], r.URL.Path))
+		return
+	}
+	writeOK(w)
+}
+
+func getShadowHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getShadow())
+}
+
+func postShadowHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkShadow(); err != nil {
+		BadRequest(w, r, "unable to check shadow db: %v", err)
+		return
+	}
+	writeJSON(w, r, getShadow())
+}
+
+func clientToolsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	client, err := checkClientID(c.URLParams["client"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+
+	writeJSON(w, r, getClientTools(client))
+}
+
+// Returns the client of a /clients/{Client}/notifications request, or writes an error
+// response and returns false if it's bad or the request may not act for it.
+func notifyClientParam(c web.C, w http.ResponseWriter, r *http.Request) (string, bool) {
+	client, err := checkClientID(c.URLParams["client"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return "", false
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "%v", err)
+		return "", false
+	}
+	return client, true
+}
+
+func getClientNotifyHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	client, ok := notifyClientParam(c, w, r)
+	if !ok {
+		return
+	}
+	prefs, found := getClientNotify(client)
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("client %s has no notification preferences (%s).", client, r.URL.Path))
+		return
+	}
+	writeJSON(w, r, prefs)
+}
+
+func putClientNotifyHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	client, ok := notifyClientParam(c, w, r)
+	if !ok {
+		return
+	}
+	var body clientNotifyJSON
+	dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		BadRequest(w, r, "bad JSON request body: %v", err)
+		return
+	}
+	prefs, err := setClientNotify(client, body)
+	if err != nil {
+		BadRequest(w, r, "unable to set notifications for %s: %v", client, err)
+		return
+	}
+	writeJSON(w, r, prefs)
+}
+
+func deleteClientNotifyHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	client, ok := notifyClientParam(c, w, r)
+	if !ok {
+		return
+	}
+	if !deleteClientNotify(client) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("client %s has no notification preferences (%s).", client, r.URL.Path))
+		return
+	}
+	writeOK(w)
+}
+
+func contextsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, struct{ Contexts []contextJSON }{getContexts()})
+}
+
+func getContextHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	client, err := checkClientID(c.URLParams["client"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	ctx, found := getContext(client)
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("client %s has no open work context (%s).", client, r.URL.Path))
+		return
+	}
+	writeJSON(w, r, ctx)
+}
+
+func postContextHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	client, err := checkClientID(c.URLParams["client"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to open work context: %v", err)
+		return
+	}
+	var body contextRequestJSON
+	dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		BadRequest(w, r, "bad JSON request body: %v", err)
+		return
+	}
+	ctx, err := openContext(client, body.Name, requestAttrs(r))
+	if err != nil {
+		if writeStorageFailure(w, r, "unable to open work context", err) {
+			return
+		}
+		BadRequest(w, r, "unable to open work context: %v", err)
+		return
+	}
+	writeJSON(w, r, ctx)
+}
+
+func deleteContextHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	client, err := checkClientID(c.URLParams["client"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to close work context: %v", err)
+		return
+	}
+	if err := closeContext(client, requestAttrs(r)); err != nil {
+		if writeStorageFailure(w, r, "unable to close work context", err) {
+			return
+		}
+		errorMsg := fmt.Sprintf("unable to close work context: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusNotFound, errorMsg)
+		return
+	}
+	writeOK(w)
+}
+
+func getViewsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, struct{ Views []savedViewJSON }{getSavedViews()})
+}
+
+func postViewHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	var body savedViewRequestJSON
+	dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		BadRequest(w, r, "bad JSON request body: %v", err)
+		return
+	}
+	client := requestClient(c)
+	if body.Client != "" {
+		var err error
+		if client, err = checkClientID(body.Client); err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to save view: %v", err)
+		return
 	}
-
-	// Setup any cron jobs
-	if *dailyClear {
-		cronJobs.AddFunc("0 0 2 * * *", resetLocks)
+	if old, found := getSavedView(body.Name); found {
+		if err := authorizeClient(c, old.Owner); err != nil {
+			Forbidden(w, r, "unable to replace view %q: %v", body.Name, err)
+			return
+		}
 	}
-	if *backup != "" {
-		cronJobs.AddFunc("0 0 0 * * *", backupLog)
+	view, err := saveView(body.Name, body.Path, client, requestAttrs(r))
+	if err != nil {
+		if writeStorageFailure(w, r, "unable to save view", err) {
+			return
+		}
+		BadRequest(w, r, "unable to save view: %v", err)
+		return
 	}
-	cronJobs.Start()
-
-	// Install our handler at the root of the standard net/http default mux.
-	// This allows packages like expvar to continue working as expected.  (From goji.go)
-	http.Handle("/", webMux)
+	writeJSON(w, r, view)
+}
 
-	graceful.HandleSignals()
-	if err := graceful.ListenAndServe(address, http.DefaultServeMux); err != nil {
-		log.Printf("CRITICAL: %v\n", err)
+func getViewHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	view, found := getSavedView(c.URLParams["name"])
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no view named %q (%s).", c.URLParams["name"], r.URL.Path))
+		return
 	}
-	graceful.Wait()
-	cronJobs.Stop()
+	serveSavedView(w, r, view)
 }
 
-func resetLocks() {
-	modifyLog := true
-	for _, uuid := range getUUIDs() {
-		reset(uuid, modifyLog)
+func deleteViewHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	name := c.URLParams["name"]
+	view, found := getSavedView(name)
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no view named %q (%s).", name, r.URL.Path))
+		return
+	}
+	if err := authorizeClient(c, view.Owner); err != nil {
+		Forbidden(w, r, "unable to delete view %q: %v", name, err)
+		return
+	}
+	if err := deleteView(name, requestClient(c), requestAttrs(r)); err != nil {
+		if writeStorageFailure(w, r, "unable to delete view", err) {
+			return
+		}
+		errorMsg := fmt.Sprintf("unable to delete view: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusNotFound, errorMsg)
+		return
 	}
+	writeOK(w)
 }
 
-func backupLog() {
-	in, err := os.OpenFile(library.fname, os.O_RDONLY, 0664)
+func conflictStatsHandler(w http.ResponseWriter, r *http.Request) {
+	window := DefaultConflictWindow
+	windowStr := r.URL.Query().Get("window")
+	if windowStr == "" {
+		windowStr = "7d"
+	} else {
+		var err error
+		if window, err = parseWindow(windowStr); err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+		if window <= 0 {
+			BadRequest(w, r, "window must be positive, not %q", windowStr)
+			return
+		}
+	}
+	stats, err := getConflictStats(window, windowStr)
 	if err != nil {
-		log.Printf("ERROR: cannot open librarian log file for backup: %v\n", err)
+		BadRequest(w, r, "unable to get conflict stats: %v", err)
 		return
 	}
-	defer in.Close()
+	writeJSON(w, r, stats)
+}
 
-	out, err := os.Create(*backup)
+func dailyReportHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	dateStr := c.URLParams["date"]
+	day, err := time.ParseInLocation(DigestDateFmt, dateStr, displayZone)
 	if err != nil {
-		log.Printf("ERROR: unable to open backup file %q: %v\n", *backup, err)
+		BadRequest(w, r, "date %q must be in YYYY-MM-DD format", dateStr)
 		return
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, in)
+	dg, err := makeDigest(day)
 	if err != nil {
-		log.Printf("ERROR: during backup to %q: %v\n", *backup, err)
+		BadRequest(w, r, "unable to make report for %s: %v", dateStr, err)
 		return
 	}
-	log.Printf("Created backup of librarian log from %q to %q\n", library.fname, *backup)
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, r, dg)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		dg.writeText(w)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		dg.writeHTML(w)
+	default:
+		BadRequest(w, r, "format %q must be json, text, or html", format)
+	}
 }
 
-// High-level switchboard
-func initRoutes() {
-	webMux.Lock()
-	defer webMux.Unlock()
-
-	if webMux.routesSetup {
-		return
+// Returns the uuid, label, and client of a request on behalf of the client.  Returns false
+// if an error response has been written.
+func labelClientParams(c web.C, w http.ResponseWriter, r *http.Request, action string) (string, uint64, string, bool) {
+	uuid := c.URLParams["uuid"]
+	client, err := checkClientID(c.URLParams["client"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return "", 0, "", false
 	}
-
-	mainMux := web.New()
-	webMux.Handle("/*", mainMux)
-	mainMux.Use(middleware.Logger)
-	mainMux.Use(middleware.AutomaticOptions)
-	mainMux.Use(recoverHandler)
-	mainMux.Use(corsHandler)
-
-	mainMux.Put("/checkin/:uuid/:label/:client", putCheckinHandler)
-	mainMux.Put("/checkin/:uuid/:label/:client/", putCheckinHandler)
-
-	mainMux.Put("/checkout/:uuid/:label/:client", putCheckoutHandler)
-	mainMux.Put("/checkout/:uuid/:label/:client/", putCheckoutHandler)
-
-	mainMux.Get("/checkout/:uuid/:label", getCheckoutClientHandler)
-	mainMux.Get("/checkout/:uuid/:label/", getCheckoutClientHandler)
-
-	mainMux.Put("/reset/:uuid", resetHandler)
-	mainMux.Put("/reset/:uuid/", resetHandler)
-
-	mainMux.Get("/history/:uuid", historyHandler)
-	mainMux.Get("/history/:uuid/", historyHandler)
-
-	mainMux.Get("/state/:uuid", stateHandler)
-	mainMux.Get("/state/:uuid/", stateHandler)
-
-	mainMux.Get("/uuids", uuidsHandler)
-	mainMux.Get("/uuids/", uuidsHandler)
-
-	mainMux.Get("/", helpHandler)
-	mainMux.Get("/*", NotFound)
-
-	webMux.routesSetup = true
+	label, err := parseLabel(uuid, c.URLParams["label"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return "", 0, "", false
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to %s: %v", action, err)
+		return "", 0, "", false
+	}
+	return uuid, label, client, true
 }
 
-// Middleware that recovers from panics and log issues.
-func recoverHandler(c *web.C, h http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		reqID := middleware.GetReqID(*c)
+func migrateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	from, to := c.URLParams["from"], c.URLParams["to"]
+	query := r.URL.Query()
 
-		defer func() {
-			if err := recover(); err != nil {
-				buf := make([]byte, 1<<16)
-				size := runtime.Stack(buf, false)
-				stackTrace := string(buf[0:size])
-				message := fmt.Sprintf("Panic detected on request %s:\n%+v\nIP: %v, URL: %s\nStack trace:\n%s\n",
-					reqID, err, r.RemoteAddr, r.URL.Path, stackTrace)
-				log.Printf("CRITICAL: %s\n", message)
-				http.Error(w, http.StatusText(500), 500)
+	var client string
+	if clientStr := query.Get("client"); clientStr != "" {
+		var err error
+		if client, err = checkClientID(clientStr); err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+		if err := authorizeClient(c, client); err != nil {
+			Forbidden(w, r, "unable to migrate checkouts: %v", err)
+			return
+		}
+	} else if p := getPrincipal(c); p != nil && p.Role != AdminRole {
+		Forbidden(w, r, "unable to migrate checkouts of all clients without the admin role, so give \"client\"")
+		return
+	}
+	var labels []uint64
+	if labelsStr := query.Get("labels"); labelsStr != "" {
+		for _, labelStr := range strings.Split(labelsStr, ",") {
+			label, err := parseLabel(from, labelStr)
+			if err != nil {
+				BadRequest(w, r, "%v", err)
+				return
 			}
-		}()
-
-		h.ServeHTTP(w, r)
+			labels = append(labels, label)
+		}
 	}
-	return http.HandlerFunc(fn)
+	dryRun := false
+	if dryStr := query.Get("dryrun"); dryStr != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(dryStr); err != nil {
+			BadRequest(w, r, "dryrun must be true or false, not %q", dryStr)
+			return
+		}
+	}
+	if err := checkMemoryCap(to); err != nil && !dryRun {
+		errorMsg := fmt.Sprintf("unable to migrate checkouts: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeErrorCode(w, http.StatusInsufficientStorage, MemoryCapCode, errorMsg)
+		return
+	}
+	result, err := migrateCheckouts(from, to, client, labels, dryRun, requestAttrs(r))
+	if err != nil {
+		if writeStorageFailure(w, r, "unable to migrate checkouts", err) {
+			return
+		}
+		errorMsg := fmt.Sprintf("unable to migrate checkouts: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		var policy *policyError
+		var quota *quotaError
+		switch {
+		case errors.As(err, &policy):
+			writeError(w, http.StatusForbidden, errorMsg)
+		case errors.As(err, &quota):
+			writeErrorCode(w, quota.status, QuotaExceededCode, errorMsg)
+		default:
+			writeError(w, http.StatusBadRequest, errorMsg)
+		}
+		return
+	}
+	writeJSON(w, r, result)
 }
 
-func NotFound(w http.ResponseWriter, r *http.Request) {
-	errorMsg := fmt.Sprintf("Could not find the URL: %s", r.URL.Path)
-	log.Printf("INFO: %s\n", errorMsg)
-	http.Error(w, errorMsg, http.StatusNotFound)
+// Applies a DVID mutation notification, or a JSON array of them, to the locks.
+func dvidHookHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, MaxOpBodySize+1))
+	if err != nil {
+		BadRequest(w, r, "unable to read request body: %v", err)
+		return
+	}
+	if len(data) > MaxOpBodySize {
+		BadRequest(w, r, "request body is over %d bytes", MaxOpBodySize)
+		return
+	}
+	data = bytes.TrimSpace(data)
+	batch := len(data) > 0 && data[0] == '['
+	var mutations []dvidMutationJSON
+	if batch {
+		err = json.Unmarshal(data, &mutations)
+	} else {
+		mutations = make([]dvidMutationJSON, 1)
+		err = json.Unmarshal(data, &mutations[0])
+	}
+	if err != nil {
+		BadRequest(w, r, "bad DVID mutation: %v", err)
+		return
+	}
+	results := make([]dvidHookJSON, 0, len(mutations))
+	for _, m := range mutations {
+		result, err := applyDVIDMutation(m, requestAttrs(r))
+		if err != nil {
+			BadRequest(w, r, "unable to apply DVID %s mutation %d: %v", m.Action, m.MutationID, err)
+			return
+		}
+		results = append(results, result)
+	}
+	if batch {
+		writeJSON(w, r, results)
+	} else {
+		writeJSON(w, r, results[0])
+	}
 }
 
-func BadRequest(w http.ResponseWriter, r *http.Request, message string, args ...interface{}) {
-	if len(args) > 0 {
-		message = fmt.Sprintf(message, args...)
+func putRemindHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid, label, client, ok := labelClientParams(c, w, r, "manage reminder")
+	if !ok {
+		return
 	}
-	errorMsg := fmt.Sprintf("%s (%s).", message, r.URL.Path)
-	log.Printf("ERROR: %s\n", errorMsg)
-	http.Error(w, errorMsg, http.StatusBadRequest)
+	in, err := time.ParseDuration(r.URL.Query().Get("in"))
+	if err != nil {
+		BadRequest(w, r, "bad \"in\" duration %q: %v", r.URL.Query().Get("in"), err)
+		return
+	}
+	rmd, err := setReminder(uuid, label, client, in)
+	if err != nil {
+		BadRequest(w, r, "unable to set reminder: %v", err)
+		return
+	}
+	writeJSON(w, r, rmd)
 }
 
-// ---- Middleware -------------
-
-// corsHandler adds CORS support via header
-func corsHandler(c *web.C, h http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Allow cross-origin resource sharing.
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-
-		h.ServeHTTP(w, r)
+func deleteRemindHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid, label, client, ok := labelClientParams(c, w, r, "manage reminder")
+	if !ok {
+		return
 	}
-	return http.HandlerFunc(fn)
+	if !cancelReminder(uuid, label, client) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("client %s has no reminder for label %d of uuid %s (%s).", client, label, uuid, r.URL.Path))
+		return
+	}
+	writeOK(w)
 }
 
-func helpHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-	hostname, err := os.Hostname()
+func putIntentHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid, label, client, ok := labelClientParams(c, w, r, "register intent")
+	if !ok {
+		return
+	}
+	intent, err := registerIntent(uuid, label, client)
 	if err != nil {
-		hostname = "Unknown host"
+		BadRequest(w, r, "unable to register intent: %v", err)
+		return
 	}
-
-	// Return the embedded help page.
-	fmt.Fprintf(w, fmt.Sprintf(WebHelp, hostname))
+	writeJSON(w, r, intent)
 }
 
-func uuidsHandler(w http.ResponseWriter, r *http.Request) {
-	jsonStr, err := getUUIDsJSON()
-	if err != nil {
-		BadRequest(w, r, "error marshaling JSON: %v", err)
+func deleteIntentHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid, label, client, ok := labelClientParams(c, w, r, "drop intent")
+	if !ok {
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, jsonStr)
+	if !dropIntent(uuid, label, client) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("client %s has no intent for label %d of uuid %s (%s).", client, label, uuid, r.URL.Path))
+		return
+	}
+	writeOK(w)
 }
 
-func stateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	uuid := c.URLParams["uuid"]
+func getLabelNamesHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, getLabelNames(c.URLParams["uuid"]))
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	checkouts, found := getCheckouts(uuid)
+func getLabelNameHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	label, err := parseLabel(uuid, c.URLParams["label"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	name, found := getLabelName(uuid, label)
 	if !found {
-		fmt.Fprintf(w, "[]")
+		errorMsg := fmt.Sprintf("uuid %s, label %d has no name (%s).", uuid, label, r.URL.Path)
+		writeError(w, http.StatusNotFound, errorMsg)
 		return
 	}
+	writeJSON(w, r, labelNameJSON{labelJSON{label, getPolicy(uuid).LabelOutput}, name})
+}
 
-	jsonBytes, err := checkouts.MarshalJSON()
+func putLabelNameHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	label, err := parseLabel(uuid, c.URLParams["label"])
 	if err != nil {
-		BadRequest(w, r, "error marshaling JSON: %v", err)
+		BadRequest(w, r, "%v", err)
 		return
 	}
-
-	fmt.Fprintf(w, string(jsonBytes))
+	var name string
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize)).Decode(&name); err != nil {
+		BadRequest(w, r, "request body must be the name as a JSON string: %v", err)
+		return
+	}
+	if err := setLabelName(uuid, label, name, requestClient(c), requestAttrs(r)); err != nil {
+		if writeOpIDUsed(w, r, err) {
+			return
+		}
+		BadRequest(w, r, "unable to name label: %v", err)
+		return
+	}
+	writeOK(w)
 }
 
-func resetHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+func deleteLabelNameHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	uuid := c.URLParams["uuid"]
-
-	if err := reset(uuid, true); err != nil {
-		BadRequest(w, r, "unable to reset uuid %s: %v", uuid, err)
+	label, err := parseLabel(uuid, c.URLParams["label"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := deleteLabelName(uuid, label, requestClient(c), requestAttrs(r)); err != nil {
+		if writeOpIDUsed(w, r, err) {
+			return
+		}
+		errorMsg := fmt.Sprintf("unable to delete label name: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusNotFound, errorMsg)
+		return
 	}
+	writeOK(w)
 }
 
-func historyHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+func getCommentsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	uuid := c.URLParams["uuid"]
-
-	if err := writeHx(uuid, w); err != nil {
-		BadRequest(w, r, "can't get history for uuid %s: %v", uuid, err)
+	label, err := parseLabel(uuid, c.URLParams["label"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
 	}
+	writeJSON(w, r, getComments(uuid, label))
 }
 
-func putCheckoutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+func postCommentHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	uuid := c.URLParams["uuid"]
-	labelStr := c.URLParams["label"]
-	label, err := strconv.ParseUint(labelStr, 10, 64)
+	label, err := parseLabel(uuid, c.URLParams["label"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	var body commentRequestJSON
+	dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		BadRequest(w, r, "bad JSON request body: %v", err)
+		return
+	}
+	client := requestClient(c)
+	if body.Client != "" {
+		if client, err = checkClientID(body.Client); err != nil {
+			BadRequest(w, r, "%v", err)
+			return
+		}
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to comment: %v", err)
+		return
+	}
+	cmt, err := addComment(uuid, label, body.Text, body.ReplyTo, client, requestAttrs(r))
 	if err != nil {
-		BadRequest(w, r, "label %q cannot be parsed as 64-bit unsigned integer: %v", labelStr, err)
+		if writeStorageFailure(w, r, "unable to comment", err) {
+			return
+		}
+		BadRequest(w, r, "unable to comment on uuid %s, label %d: %v", uuid, label, err)
 		return
 	}
-	client := c.URLParams["client"]
+	writeJSON(w, r, cmt)
+}
 
-	if err := checkout(uuid, label, client, true); err != nil {
-		errorMsg := fmt.Sprintf("could not do checkout: %v (%s).", err, r.URL.Path)
-		log.Printf("ERROR: %s\n", errorMsg)
-		http.Error(w, errorMsg, http.StatusConflict)
+func heartbeatHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	client, err := checkClientID(c.URLParams["client"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to note heartbeat: %v", err)
+		return
 	}
+	writeJSON(w, r, heartbeatJSON{client, heartbeat(client)})
 }
 
-func getCheckoutClientHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	uuid := c.URLParams["uuid"]
-	labelStr := c.URLParams["label"]
-	label, err := strconv.ParseUint(labelStr, 10, 64)
+// Streams a client's events as server-sent events until the client disconnects.
+func eventsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	client, err := checkClientID(c.URLParams["client"])
 	if err != nil {
-		BadRequest(w, r, "label %q cannot be parsed as 64-bit unsigned integer: %v", labelStr, err)
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to subscribe: %v", err)
+		return
+	}
+	ch := subscribe(client)
+	defer unsubscribe(client, ch)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	heartbeat := time.NewTicker(EventHeartbeat)
+	defer heartbeat.Stop()
+
+	msg := ": subscribed\n\n"
+	for {
+		// Events can be far apart, so each write gets the full -writetimeout.
+		if *writeTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		}
+		if _, err := fmt.Fprint(w, msg); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			msg = ": keepalive\n\n"
+		case ev := <-ch:
+			jsonBytes, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("ERROR: unable to marshal %s event: %v\n", ev.Event, err)
+				msg = ""
+				continue
+			}
+			msg = fmt.Sprintf("event: %s\ndata: %s\n\n", ev.Event, jsonBytes)
+		}
+	}
+}
+
+// graphQLRequestJSON is the body of POST /graphql.
+type graphQLRequestJSON struct {
+	Query         string
+	OperationName string
+	Variables     map[string]interface{}
+}
+
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequestJSON
+	if r.Method == "POST" {
+		dec := json.NewDecoder(io.LimitReader(r.Body, MaxOpBodySize))
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			BadRequest(w, r, "bad GraphQL request body: %v", err)
+			return
+		}
+	} else {
+		query := r.URL.Query()
+		req.Query = query.Get("query")
+		req.OperationName = query.Get("operationName")
+		if vars := query.Get("variables"); vars != "" {
+			dec := json.NewDecoder(strings.NewReader(vars))
+			dec.UseNumber()
+			if err := dec.Decode(&req.Variables); err != nil {
+				BadRequest(w, r, "bad GraphQL variables: %v", err)
+				return
+			}
+		}
+	}
+	if req.Query == "" {
+		BadRequest(w, r, "no GraphQL query given")
 		return
 	}
+	writeJSON(w, r, runGraphQL(req.Query, req.OperationName, req.Variables))
+}
+
+func graphqlSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, GraphQLSchema)
+}
 
-	client, found := getCheckout(uuid, label)
+func calendarHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	clientStr, found := strings.CutSuffix(c.URLParams["client"], ".ics")
 	if !found {
-		BadRequest(w, r, "no checkout exists for uuid %s, label %d", uuid, label)
+		writeError(w, http.StatusNotFound, fmt.Sprintf("calendars end in \".ics\" (%s).", r.URL.Path))
 		return
 	}
-	jsonBytes, err := json.Marshal(reserveJSON{label, client})
+	client, err := checkClientID(clientStr)
 	if err != nil {
-		BadRequest(w, r, "error marshaling JSON: %v", err)
+		BadRequest(w, r, "%v", err)
 		return
 	}
 
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	writeCalendar(w, client)
+}
+
+func getMetasHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+
+	jsonBytes, err := getMetaJSON(uuid)
+	if err != nil {
+		BadRequest(w, r, "error marshaling JSON: %v", err)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintf(w, string(jsonBytes))
 }
 
-func putCheckinHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+func getMetaHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	key := c.URLParams["key"]
+
+	value, found := getMeta(uuid, key)
+	if !found {
+		errorMsg := fmt.Sprintf("no metadata for uuid %s, key %q (%s).", uuid, key, r.URL.Path)
+		writeError(w, http.StatusNotFound, errorMsg)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, value)
+}
+
+func putMetaHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	uuid := c.URLParams["uuid"]
-	client := c.URLParams["client"]
-	labelStr := c.URLParams["label"]
-	label, err := strconv.ParseUint(labelStr, 10, 64)
+	key := c.URLParams["key"]
+
+	if !validOpID(w, r) {
+		return
+	}
+	value, err := io.ReadAll(io.LimitReader(r.Body, MaxMetaValueSize+1))
 	if err != nil {
-		BadRequest(w, r, "label %q cannot be parsed as 64-bit unsigned integer: %v", labelStr, err)
+		BadRequest(w, r, "unable to read metadata value: %v", err)
+		return
+	}
+	if err := setMeta(uuid, key, string(value), requestClient(c), requestAttrs(r), true); err != nil {
+		if writeOpIDUsed(w, r, err) || writeStorageFailure(w, r, "unable to set metadata", err) {
+			return
+		}
+		BadRequest(w, r, "unable to set metadata: %v", err)
 		return
 	}
+	writeOK(w)
+}
+
+func deleteMetaHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	key := c.URLParams["key"]
 
-	if err := checkin(uuid, label, client, true); err != nil {
-		BadRequest(w, r, "unable to checkin: %v", err)
+	if !validOpID(w, r) {
+		return
+	}
+	if err := deleteMeta(uuid, key, requestClient(c), requestAttrs(r), true); err != nil {
+		if writeOpIDUsed(w, r, err) || writeStorageFailure(w, r, "unable to delete metadata", err) {
+			return
+		}
+		errorMsg := fmt.Sprintf("unable to delete metadata: %v (%s).", err, r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusNotFound, errorMsg)
+		return
 	}
+	writeOK(w)
 }
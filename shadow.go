@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ShadowCheckSchedule is the cron spec for comparing the -shadowdb with the state replayed
+// from the log.
+const ShadowCheckSchedule = "0 */10 * * * *"
+
+// Most divergences listed in a shadow report.  All are counted.
+const MaxShadowDivergences = 100
+
+// Times a check is retried if ops are written while the shadow db is read.
+const shadowCheckAttempts = 3
+
+var shadowDivergencesVar = expvar.NewInt("librarian_shadow_divergences")
+
+// divergenceJSON is a piece of state that differs between the log and the -shadowdb.
+type divergenceJSON struct {
+	Kind   string // "checkout", "meta", "policy", "revision", "pin", "superseded", "context", "alias", "view", "comment", "freeze", or "seq"
+	UUID   string `json:",omitempty"`
+	Key    string `json:",omitempty"` // label, metadata key, client, view or freeze name, or label/comment id
+	Log    string // state replayed from the log, or "" if missing
+	Shadow string // state in the shadow db, or "" if missing
+}
+
+// shadowJSON reports on the -shadowdb for GET /admin/shadow.
+type shadowJSON struct {
+	DB             string
+	Writes         int64
+	WriteFailures  int64
+	LastWriteError string     `json:",omitempty"`
+	LastCheck      *time.Time `json:",omitempty"`
+	CheckedSeq     uint64     `json:",omitempty"` // seq of the last op when checked
+	Divergences    int
+	Details        []divergenceJSON `json:",omitempty"`
+}
+
+var shadow = struct {
+	sync.Mutex
+	report shadowJSON
+}{}
+
+// Opens the -shadowdb and fills it with the current state.  Must be called with library
+// lock held.
+func (lib *libraryT) openShadow(fname string) error {
+	if fname == *stateDB {
+		return fmt.Errorf("-shadowdb must be a different file than -statedb")
+	}
+	store, err := openStateStore(fname)
+	if err != nil {
+		return fmt.Errorf("cannot open shadow db %q: %v", fname, err)
+	}
+	if err := store.syncAll(lib); err != nil {
+		return fmt.Errorf("cannot fill shadow db %q: %v", fname, err)
+	}
+	lib.shadow = store
+	shadow.Lock()
+	shadow.report.DB = fname
+	shadow.Unlock()
+	log.Printf("Writing state to shadow db %q\n", fname)
+	return nil
+}
+
+// Notes the result of a write to the -shadowdb, which never fails an op.
+func noteShadowWrite(err error, what string) {
+	shadow.Lock()
+	defer shadow.Unlock()
+
+	shadow.report.Writes++
+	if err != nil {
+		shadow.report.WriteFailures++
+		shadow.report.LastWriteError = fmt.Sprintf("%s: %v", what, err)
+		log.Printf("ERROR: unable to update shadow db for %s: %v\n", what, err)
+	}
+}
+
+// Writes the state changed by an op to the -shadowdb.  Must be called with library lock
+// held.
+func (lib *libraryT) shadowOp(op *libraryOp) {
+	if lib.shadow == nil || lib.compacting {
+		return
+	}
+	noteShadowWrite(lib.shadow.syncOp(lib, op), fmt.Sprintf("%s of uuid %s", op.op, op.uuid))
+}
+
+// Replaces the -shadowdb state with the library's, e.g., after compaction.  Must be called
+// with library lock held.
+func (lib *libraryT) shadowAll() {
+	if lib.shadow != nil {
+		noteShadowWrite(lib.shadow.syncAll(lib), "all state")
+	}
+}
+
+type stateKey struct {
+	kind, uuid, key string
+}
+
+// Returns the state kept by state stores as strings, so two libraries can be compared.
+func flattenState(lib *libraryT) map[stateKey]string {
+	state := make(map[stateKey]string)
+	timeStr := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	for uuid, checkouts := range lib.vchk {
+		for label, co := range checkouts {
+			state[stateKey{"checkout", uuid, strconv.FormatUint(label, 10)}] = fmt.Sprintf("%s since %s, expires %s", co.client, timeStr(co.t), timeStr(co.expires))
+		}
+	}
+	for uuid, kv := range lib.meta {
+		for key, value := range kv {
+			state[stateKey{"meta", uuid, key}] = value
+		}
+	}
+	for uuid, policy := range lib.policies {
+		policyBytes, err := json.Marshal(policy)
+		if err != nil {
+			policyBytes = []byte(err.Error())
+		}
+		state[stateKey{"policy", uuid, ""}] = string(policyBytes)
+	}
+	for uuid, rev := range lib.revs {
+		state[stateKey{"revision", uuid, ""}] = strconv.FormatUint(rev, 10)
+	}
+	for uuid, pins := range lib.pins {
+		for label, pin := range pins {
+			state[stateKey{"pin", uuid, strconv.FormatUint(label, 10)}] = fmt.Sprintf("%s since %s: %s", pin.client, timeStr(pin.t), pin.reason)
+		}
+	}
+	for uuid, m := range lib.superseded {
+		for old, newLabel := range m {
+			state[stateKey{"superseded", uuid, strconv.FormatUint(old, 10)}] = strconv.FormatUint(newLabel, 10)
+		}
+	}
+	for client, ctx := range lib.contexts {
+		state[stateKey{"context", "", client}] = fmt.Sprintf("%s %q opened %s", ctx.id, ctx.name, timeStr(ctx.opened))
+	}
+	for client, current := range lib.aliases {
+		state[stateKey{"alias", "", client}] = current
+	}
+	for uuid, m := range lib.comments {
+		for label, thread := range m {
+			for _, cmt := range thread {
+				key := fmt.Sprintf("%d/%d", label, cmt.id)
+				state[stateKey{"comment", uuid, key}] = fmt.Sprintf("%s at %s, reply to %d: %s", cmt.client, timeStr(cmt.t), cmt.replyTo, cmt.text)
+			}
+		}
+	}
+	for uuid, m := range lib.freezes {
+		for name, f := range m {
+			state[stateKey{"freeze", uuid, name}] = fmt.Sprintf("%s for %s, warning %s, by %s at %s: %s", f.schedule, f.duration, f.warning, f.client, timeStr(f.t), f.reason)
+		}
+	}
+	for name, view := range lib.savedViews {
+		state[stateKey{"view", "", name}] = fmt.Sprintf("%s saved by %s at %s", view.path, view.owner, timeStr(view.saved))
+	}
+	state[stateKey{"seq", "", ""}] = strconv.FormatUint(lib.seq, 10)
+	return state
+}
+
+// Returns the differences between state replayed from the log and shadow state, sorted.
+func compareStates(logState, shadowState map[stateKey]string) []divergenceJSON {
+	var divergences []divergenceJSON
+	for key, value := range logState {
+		if shadowValue := shadowState[key]; shadowValue != value {
+			divergences = append(divergences, divergenceJSON{key.kind, key.uuid, key.key, value, shadowValue})
+		}
+	}
+	for key, value := range shadowState {
+		if _, found := logState[key]; !found {
+			divergences = append(divergences, divergenceJSON{key.kind, key.uuid, key.key, "", value})
+		}
+	}
+	sort.Slice(divergences, func(i, j int) bool {
+		a, b := divergences[i], divergences[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.UUID != b.UUID {
+			return a.UUID < b.UUID
+		}
+		return a.Key < b.Key
+	})
+	return divergences
+}
+
+// Compares the -shadowdb with the library and records the divergences.  The db is read
+// without the library lock, so the check is retried if ops were written meanwhile.
+func checkShadow() error {
+	library.RLock()
+	store, seq := library.shadow, library.seq
+	library.RUnlock()
+	if store == nil {
+		return fmt.Errorf("no -shadowdb was given")
+	}
+
+	for attempt := 0; attempt < shadowCheckAttempts; attempt++ {
+		var shadowLib libraryT
+		shadowLib.init()
+		if _, _, _, err := store.load(&shadowLib); err != nil {
+			return fmt.Errorf("cannot load shadow db: %v", err)
+		}
+
+		library.RLock()
+		if library.seq != seq || library.compacting {
+			seq = library.seq
+			library.RUnlock()
+			continue
+		}
+		logState := flattenState(&library)
+		library.RUnlock()
+
+		divergences := compareStates(logState, flattenState(&shadowLib))
+		now := clock.Now()
+		shadow.Lock()
+		shadow.report.LastCheck = &now
+		shadow.report.CheckedSeq = seq
+		shadow.report.Divergences = len(divergences)
+		shadow.report.Details = divergences
+		if len(divergences) > MaxShadowDivergences {
+			shadow.report.Details = divergences[:MaxShadowDivergences]
+		}
+		shadow.Unlock()
+		shadowDivergencesVar.Set(int64(len(divergences)))
+		if len(divergences) > 0 {
+			first := divergences[0]
+			log.Printf("WARNING: shadow db differs from librarian log in %d places, e.g., %s of uuid %q, key %q: %q in log, %q in shadow db\n",
+				len(divergences), first.Kind, first.UUID, first.Key, first.Log, first.Shadow)
+		}
+		return nil
+	}
+	return fmt.Errorf("ops kept being written during %d attempts", shadowCheckAttempts)
+}
+
+func checkShadowJob() {
+	if err := checkShadow(); err != nil {
+		log.Printf("ERROR: unable to check shadow db: %v\n", err)
+	}
+}
+
+func getShadow() shadowJSON {
+	shadow.Lock()
+	defer shadow.Unlock()
+	return shadow.report
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const simulateHelp = `
+Usage: librarian simulate [options] /path/to/librarian.log
+
+Replays the checkouts, checkins, and resets of a librarian log and its compacted segments
+against a server, reporting throughput, latency, and conflict rates, e.g., to check that a
+new storage backend can handle peak proofreading load.  Ops are sent at the pace they were
+logged, sped up by -speed, with ops on the same label sent in order.  Conflicts in the log
+are replayed as checkouts, and expirations as checkins since the target's leases don't
+follow the log's timing.  Other ops like metadata and policy changes are skipped.
+
+Without -target, the ops are replayed against an in-process server with default options
+whose log is written in -dir.  A real target is changed by the replay, so its UUIDs are
+prefixed by -uuidprefix to keep them apart from real work.  Use a new prefix for each run
+against the same target since labels left checked out by one run conflict in the next.
+
+      -target        =string   URL of the server to replay against, e.g., "http://localhost:8000".
+      -tokenfile     =string   File with a bearer token for the target with the admin role, so
+                                 it can act for all clients and reset UUIDs.
+      -speed         =number   Replay speed relative to the logged pace, e.g., 60 replays an
+                                 hour in a minute.  0 sends ops as fast as possible.  Default 1.
+      -concurrency   =number   Number of requests in flight at once.  Default 8.
+      -uuidprefix    =string   Prefix added to UUIDs.  Default "sim-".
+      -dir           =string   Directory for the in-process server's log, e.g., on the
+                                 storage being evaluated.  Default is a temporary directory.
+      -from          =string   Only replay ops on or after this date, e.g., "2015-12-01".
+      -to            =string   Only replay ops on or before this date.
+      -report        =string   Report format: "text" (default) or "json".
+  -h, -help          (flag)    Show help message
+`
+
+// SimulateTimeout is the longest a replayed request can take before it is counted as failed.
+const SimulateTimeout = 30 * time.Second
+
+// simRequest is a logged op to send to the target at its due time.
+type simRequest struct {
+	method string
+	path   string
+	stats  *simOpStats
+	due    time.Time
+}
+
+// simOpStats counts the responses to one kind of replayed op.
+type simOpStats struct {
+	Sent      int
+	OK        int
+	Conflicts int // 409 status
+	Refused   int // other 4xx status, e.g., checkins of labels not held
+	Failed    int // 5xx status or no response
+}
+
+type simulateReport struct {
+	Target          string
+	Speed           float64
+	Concurrency     int
+	LogOps          int // ops in the log between -from and -to
+	Skipped         int // ops that aren't replayed
+	First           time.Time
+	Last            time.Time
+	Elapsed         time.Duration
+	Throughput      float64 // requests per second
+	Checkouts       simOpStats
+	Checkins        simOpStats
+	Resets          simOpStats
+	ConflictRate    float64 // conflicts of replayed checkouts
+	LogConflictRate float64 // conflicts of checkouts in the log
+	LatencyP50      time.Duration
+	LatencyP95      time.Duration
+	LatencyP99      time.Duration
+	LatencyMax      time.Duration
+	MaxLag          time.Duration // furthest a request was sent behind its due time, if paced
+}
+
+// simulator replays logged ops through a worker per -concurrency.  Ops on a label always go
+// to the same worker so they're sent in the logged order.
+type simulator struct {
+	send       func(method, path string) (int, error)
+	speed      float64
+	uuidPrefix string
+	from, to   time.Time
+
+	mu        sync.Mutex
+	report    simulateReport
+	latencies []time.Duration
+	workers   []chan simRequest
+	wg        sync.WaitGroup
+
+	logCheckouts, logConflicts int
+	base, start                time.Time // time of the first op and when it was sent
+}
+
+func newSimulator(send func(method, path string) (int, error), speed float64, concurrency int, uuidPrefix string) *simulator {
+	s := &simulator{send: send, speed: speed, uuidPrefix: uuidPrefix}
+	s.report.Speed = speed
+	s.report.Concurrency = concurrency
+	for i := 0; i < concurrency; i++ {
+		ch := make(chan simRequest, 16)
+		s.workers = append(s.workers, ch)
+		s.wg.Add(1)
+		go s.work(ch)
+	}
+	return s
+}
+
+func (s *simulator) work(ch chan simRequest) {
+	defer s.wg.Done()
+	for req := range ch {
+		began := time.Now()
+		status, err := s.send(req.method, req.path)
+		latency := time.Since(began)
+
+		s.mu.Lock()
+		if lag := began.Sub(req.due); s.speed > 0 && lag > s.report.MaxLag {
+			s.report.MaxLag = lag
+		}
+		s.latencies = append(s.latencies, latency)
+		req.stats.Sent++
+		switch {
+		case err != nil || status >= 500:
+			req.stats.Failed++
+		case status == http.StatusConflict:
+			req.stats.Conflicts++
+		case status >= 400:
+			req.stats.Refused++
+		default:
+			req.stats.OK++
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Sends a logged op to its worker once it is due, waiting to keep the logged pace.
+func (s *simulator) add(op *libraryOp) {
+	if op.op.restore() {
+		return
+	}
+	if (!s.from.IsZero() && op.t.Before(s.from)) || (!s.to.IsZero() && !op.t.Before(s.to)) {
+		return
+	}
+	s.report.LogOps++
+	if s.report.First.IsZero() {
+		s.report.First = op.t
+		s.base = op.t
+		s.start = time.Now()
+	}
+	s.report.Last = op.t
+
+	uuid := url.PathEscape(s.uuidPrefix + op.uuid)
+	label := strconv.FormatUint(op.label, 10)
+	client := url.PathEscape(op.client)
+	var req simRequest
+	switch op.op {
+	case CheckoutOp, RenewOp, ConflictOp:
+		req = simRequest{method: "PUT", path: "/checkout/" + uuid + "/" + label + "/" + client, stats: &s.report.Checkouts}
+		s.logCheckouts++
+		if op.op == ConflictOp {
+			s.logConflicts++
+		}
+	case CheckinOp, ExpireOp:
+		req = simRequest{method: "PUT", path: "/checkin/" + uuid + "/" + label + "/" + client, stats: &s.report.Checkins}
+	case ResetOp, CommitResetOp:
+		req = simRequest{method: "PUT", path: "/reset/" + uuid, stats: &s.report.Resets}
+	default:
+		s.report.Skipped++
+		return
+	}
+
+	req.due = s.start
+	if s.speed > 0 {
+		req.due = s.start.Add(time.Duration(float64(op.t.Sub(s.base)) / s.speed))
+		if wait := time.Until(req.due); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(uuid))
+	if req.stats != &s.report.Resets {
+		h.Write([]byte(label))
+	}
+	s.workers[h.Sum32()%uint32(len(s.workers))] <- req
+}
+
+func (s *simulator) addFile(fname string) error {
+	return readLogOps(fname, s.add)
+}
+
+// Waits for all sent ops and returns the report.
+func (s *simulator) finish() *simulateReport {
+	for _, ch := range s.workers {
+		close(ch)
+	}
+	s.wg.Wait()
+
+	rpt := &s.report
+	if !s.start.IsZero() {
+		rpt.Elapsed = time.Since(s.start)
+	}
+	sent := rpt.Checkouts.Sent + rpt.Checkins.Sent + rpt.Resets.Sent
+	if rpt.Elapsed > 0 {
+		rpt.Throughput = float64(sent) / rpt.Elapsed.Seconds()
+	}
+	rpt.ConflictRate = conflictRate(rpt.Checkouts.Conflicts, rpt.Checkouts.Sent-rpt.Checkouts.Conflicts)
+	rpt.LogConflictRate = conflictRate(s.logConflicts, s.logCheckouts-s.logConflicts)
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	rpt.LatencyP50 = percentile(s.latencies, 50)
+	rpt.LatencyP95 = percentile(s.latencies, 95)
+	rpt.LatencyP99 = percentile(s.latencies, 99)
+	rpt.LatencyMax = percentile(s.latencies, 100)
+	return rpt
+}
+
+func (rpt *simulateReport) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "Replayed %d of %d logged ops from %s to %s against %s\n", rpt.LogOps-rpt.Skipped, rpt.LogOps,
+		rpt.First.Format(time.RFC3339), rpt.Last.Format(time.RFC3339), rpt.Target)
+	speed := fmt.Sprintf("%gx", rpt.Speed)
+	if rpt.Speed == 0 {
+		speed = "as fast as possible"
+	}
+	fmt.Fprintf(w, "Speed: %s, concurrency: %d, elapsed: %s, throughput: %.1f requests/sec\n", speed,
+		rpt.Concurrency, rpt.Elapsed.Round(time.Millisecond), rpt.Throughput)
+	fmt.Fprintf(w, "Conflict rate: %.1f%% replayed, %.1f%% in log\n", 100*rpt.ConflictRate, 100*rpt.LogConflictRate)
+	fmt.Fprintf(w, "Latency median: %s, 95th percentile: %s, 99th percentile: %s, max: %s\n", rpt.LatencyP50,
+		rpt.LatencyP95, rpt.LatencyP99, rpt.LatencyMax)
+	if rpt.Speed > 0 {
+		fmt.Fprintf(w, "Max lag behind logged pace: %s\n", rpt.MaxLag.Round(time.Millisecond))
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Op\tSent\tOK\tConflicts\tRefused\tFailed\n")
+	for _, row := range []struct {
+		name  string
+		stats simOpStats
+	}{{"checkout", rpt.Checkouts}, {"checkin", rpt.Checkins}, {"reset", rpt.Resets}} {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\n", row.name, row.stats.Sent, row.stats.OK, row.stats.Conflicts,
+			row.stats.Refused, row.stats.Failed)
+	}
+	return tw.Flush()
+}
+
+// Returns a function sending requests to a target server with an optional bearer token.
+func targetSender(target, token string, concurrency int) func(method, path string) (int, error) {
+	client := &http.Client{
+		Timeout:   SimulateTimeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: concurrency},
+	}
+	target = strings.TrimSuffix(target, "/")
+	return func(method, path string) (int, error) {
+		req, err := http.NewRequest(method, target+path, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("User-Agent", "librarian-simulate/"+Version)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+}
+
+// Sends requests to this process's handlers, which serve a library logged in dir.
+func inProcessSender(dir string) (func(method, path string) (int, error), error) {
+	if err := initLibrary(filepath.Join(dir, "librarian.log")); err != nil {
+		return nil, err
+	}
+	log.SetOutput(io.Discard) // request logging would swamp the report
+	return func(method, path string) (int, error) {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("User-Agent", "librarian-simulate/"+Version)
+		w := httptest.NewRecorder()
+		ServeSingleHTTP(w, req)
+		return w.Code, nil
+	}, nil
+}
+
+// Runs the simulate subcommand and returns the exit code.
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	target := fs.String("target", "", "")
+	tokenFile := fs.String("tokenfile", "", "")
+	speed := fs.Float64("speed", 1, "")
+	concurrency := fs.Int("concurrency", 8, "")
+	uuidPrefix := fs.String("uuidprefix", "sim-", "")
+	dir := fs.String("dir", "", "")
+	fromStr := fs.String("from", "", "")
+	toStr := fs.String("to", "", "")
+	reportFmt := fs.String("report", "text", "")
+	fs.Usage = func() {
+		fmt.Printf(simulateHelp)
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil || len(positional) != 1 {
+		fs.Usage()
+		return 1
+	}
+	if *speed < 0 {
+		fmt.Fprintf(os.Stderr, "Bad -speed %g: cannot be negative\n", *speed)
+		return 1
+	}
+	if *concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "Bad -concurrency %d: must be at least 1\n", *concurrency)
+		return 1
+	}
+	if *reportFmt != "text" && *reportFmt != "json" {
+		fmt.Fprintf(os.Stderr, "Bad -report %q: must be \"text\" or \"json\"\n", *reportFmt)
+		return 1
+	}
+	from, to, err := parseExportDates(*fromStr, *toStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	segments, err := logSegments(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find librarian log segments: %v\n", err)
+		return 1
+	}
+
+	var send func(method, path string) (int, error)
+	if *target != "" {
+		u, err := url.Parse(*target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "Bad -target %q: must be like \"http://localhost:8000\"\n", *target)
+			return 1
+		}
+		var token string
+		if *tokenFile != "" {
+			tokenBytes, err := os.ReadFile(*tokenFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to read -tokenfile: %v\n", err)
+				return 1
+			}
+			token = strings.TrimSpace(string(tokenBytes))
+		}
+		send = targetSender(*target, token, *concurrency)
+	} else {
+		*target = "in-process server"
+		if *dir == "" {
+			tmpDir, err := os.MkdirTemp("", "librarian-simulate-")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to make directory for in-process log: %v\n", err)
+				return 1
+			}
+			defer os.RemoveAll(tmpDir)
+			*dir = tmpDir
+		}
+		if send, err = inProcessSender(*dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start in-process server: %v\n", err)
+			return 1
+		}
+	}
+
+	s := newSimulator(send, *speed, *concurrency, *uuidPrefix)
+	s.from, s.to = from, to
+	s.report.Target = *target
+	for _, fname := range append(segments, positional[0]) {
+		if err := s.addFile(fname); err != nil {
+			s.finish()
+			fmt.Fprintf(os.Stderr, "Unable to replay librarian log: %v\n", err)
+			return 1
+		}
+	}
+	rpt := s.finish()
+
+	if *reportFmt == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rpt)
+	} else {
+		err = rpt.writeText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write report: %v\n", err)
+		return 1
+	}
+	return 0
+}
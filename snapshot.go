@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+type snapshotCheckoutJSON struct {
+	Label   uint64
+	Client  string
+	Since   time.Time
+	Expires *time.Time `json:",omitempty"`
+}
+
+type snapshotUUIDJSON struct {
+	UUID      string
+	Revision  uint64
+	Checkouts []snapshotCheckoutJSON
+	Meta      map[string]string `json:",omitempty"`
+}
+
+// snapshotT is a point-in-time copy of the library that can be written without locks.
+type snapshotT struct {
+	time     time.Time
+	seq      uint64 // sequence number of the last op in the snapshot
+	revision uint64
+	uuids    []snapshotUUIDJSON
+
+	logSize   int64  // size of the log when taken, where later ops start
+	firstLine string // first line of the log, which changes when the log is compacted
+}
+
+// Copies the full library state.  Writers are blocked only for the in-memory copy,
+// not while the snapshot is being sent to a client.
+func takeSnapshot() *snapshotT {
+	library.RLock()
+	defer library.RUnlock()
+
+	snap := &snapshotT{
+		time:      clock.Now(),
+		seq:       library.seq,
+		revision:  library.revision,
+		uuids:     make([]snapshotUUIDJSON, 0, len(library.revs)),
+		logSize:   library.size,
+		firstLine: library.firstLine,
+	}
+	for uuid, rev := range library.revs {
+		su := snapshotUUIDJSON{
+			UUID:      uuid,
+			Revision:  rev,
+			Checkouts: make([]snapshotCheckoutJSON, 0, len(library.vchk[uuid])),
+		}
+		for label, co := range library.vchk[uuid] {
+			sc := snapshotCheckoutJSON{Label: label, Client: co.client, Since: co.t}
+			if !co.expires.IsZero() {
+				expires := co.expires
+				sc.Expires = &expires
+			}
+			su.Checkouts = append(su.Checkouts, sc)
+		}
+		if kv, found := library.meta[uuid]; found {
+			su.Meta = make(map[string]string, len(kv))
+			for key, value := range kv {
+				su.Meta[key] = value
+			}
+		}
+		snap.uuids = append(snap.uuids, su)
+	}
+	return snap
+}
+
+// Writes the snapshot as JSON, one UUID at a time, sorted by UUID and label.
+func (snap *snapshotT) write(w io.Writer) error {
+	tbytes, err := snap.time.MarshalText()
+	if err != nil {
+		return err
+	}
+	sort.Slice(snap.uuids, func(i, j int) bool { return snap.uuids[i].UUID < snap.uuids[j].UUID })
+	fmt.Fprintf(w, "{\"Time\":%q, \"Seq\":%d, \"Revision\":%d, \"UUIDs\":[", string(tbytes), snap.seq, snap.revision)
+	for i := range snap.uuids {
+		su := &snap.uuids[i]
+		sort.Slice(su.Checkouts, func(a, b int) bool { return su.Checkouts[a].Label < su.Checkouts[b].Label })
+		jsonBytes, err := json.Marshal(su)
+		if err != nil {
+			return err
+		}
+		if i != 0 {
+			fmt.Fprintf(w, ",")
+		}
+		fmt.Fprintf(w, "\n  ")
+		if _, err := w.Write(jsonBytes); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "]}\n")
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handling of ops in the librarian log that don't agree with the ops before them, e.g., a
+// checkin of a label that isn't checked out, set by -replay.
+const (
+	ReplayLenient = "lenient" // log a warning, skip the op, and continue
+	ReplayStrict  = "strict"  // refuse to start
+)
+
+// MaxStartupWarnings is the most replay warnings listed in the startup report.
+const MaxStartupWarnings = 100
+
+// ReplayProgressOps is how many ops are replayed between updates of replayProgress.
+const ReplayProgressOps = 10000
+
+// Ops replayed so far by the current load, sent to systemd while it waits for startup.
+var replayProgress atomic.Int64
+
+func validReplayMode(s string) bool {
+	return s == ReplayLenient || s == ReplayStrict
+}
+
+// startupReportJSON describes how the library was loaded at startup.
+type startupReportJSON struct {
+	Started       time.Time
+	Elapsed       string
+	LogFile       string
+	ReplayMode    string
+	StateDB       bool // most state came from the -statedb rather than replay
+	Segments      int
+	OpsReplayed   int
+	TruncatedLine bool // a partial last line was removed from the log
+	Warnings      int
+	WarningList   []string       // the first MaxStartupWarnings
+	UnknownOps    map[string]int `json:",omitempty"` // skipped ops of types added by newer librarians
+	Checkouts     int            // after replay
+	Clients       int            // holding checkouts
+	Locks         map[string]int // checkouts by uuid
+}
+
+var startup struct {
+	sync.RWMutex
+	report startupReportJSON
+	began  time.Time // wall clock, which -simclock doesn't stop
+}
+
+// Starts a new startup report for loading a librarian log.
+func beginStartupReport(fname string) {
+	startup.Lock()
+	defer startup.Unlock()
+	startup.report = startupReportJSON{
+		Started:     clock.Now(),
+		LogFile:     fname,
+		ReplayMode:  *replayMode,
+		WarningList: []string{},
+	}
+	startup.began = time.Now()
+	replayProgress.Store(0)
+}
+
+// Handles an op read from the librarian log that is inconsistent with the ops before it.
+// With -replay=strict, returns an error that stops the load.  Otherwise logs a warning,
+// counts it in the startup report, and returns nil so replay continues.
+func replayInconsistency(op *libraryOp, err error) error {
+	msg := fmt.Sprintf("%s op of uuid %s, label %d by %s at %s: %v", op.op, op.uuid, op.label, op.client, op.t.Format(time.RFC3339Nano), err)
+	if *replayMode == ReplayStrict {
+		return fmt.Errorf("inconsistent %s (use -replay=%s to skip)", msg, ReplayLenient)
+	}
+	log.Printf("WARNING: skipped inconsistent %s\n", msg)
+
+	startup.Lock()
+	defer startup.Unlock()
+	startup.report.Warnings++
+	if len(startup.report.WarningList) < MaxStartupWarnings {
+		startup.report.WarningList = append(startup.report.WarningList, msg)
+	}
+	return nil
+}
+
+// Handles an op of a type added by a newer librarian, which can't be applied.  With
+// -replay=strict, returns an error that stops the load.  Otherwise the op is skipped,
+// counted in the startup report, and a warning is logged for the first op of each type.
+func replayUnknownOp(op *libraryOp) error {
+	if *replayMode == ReplayStrict {
+		return fmt.Errorf("%s op of uuid %s, label %d by %s at %s was written by a newer librarian and can't be applied (use -replay=%s to skip)",
+			op.op, op.uuid, op.label, op.client, op.t.Format(time.RFC3339Nano), ReplayLenient)
+	}
+	startup.Lock()
+	defer startup.Unlock()
+	if startup.report.UnknownOps == nil {
+		startup.report.UnknownOps = make(map[string]int)
+	}
+	name := op.op.String()
+	if startup.report.UnknownOps[name] == 0 {
+		log.Printf("WARNING: skipping %s ops in librarian log, which were written by a newer librarian and can't be applied\n", name)
+	}
+	startup.report.UnknownOps[name]++
+	return nil
+}
+
+// Completes the startup report with the replay results and final checkouts, and logs a
+// summary.
+func finishStartupReport(loaded bool, segments, replayed int, truncated bool) {
+	library.RLock()
+	locks := make(map[string]int, len(library.vchk))
+	clients := make(map[string]bool)
+	checkouts := 0
+	for uuid, m := range library.vchk {
+		if len(m) == 0 {
+			continue
+		}
+		locks[uuid] = len(m)
+		checkouts += len(m)
+		for _, co := range m {
+			clients[co.client] = true
+		}
+	}
+	library.RUnlock()
+
+	startup.Lock()
+	defer startup.Unlock()
+	r := &startup.report
+	elapsed := time.Since(startup.began)
+	r.Elapsed = elapsed.String()
+	r.StateDB = loaded
+	r.Segments = segments
+	r.OpsReplayed = replayed
+	r.TruncatedLine = truncated
+	r.Checkouts = checkouts
+	r.Clients = len(clients)
+	r.Locks = locks
+	log.Printf("Startup: replayed %d ops from %s in %s with %d warnings; %d checkouts of %d uuids by %d clients\n",
+		replayed, r.LogFile, elapsed, r.Warnings, checkouts, len(locks), len(clients))
+}
+
+// Returns the report of the last load of the librarian log.
+func getStartupReport() startupReportJSON {
+	startup.RLock()
+	defer startup.RUnlock()
+	return startup.report
+}
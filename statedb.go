@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// stateStore mirrors the library state, e.g., in SQLite, so the server can start without
+// replaying the whole log.  The log remains the record of every op.
+type stateStore interface {
+	// Loads state into the library.  Returns the log size and first log line as of the
+	// last update, or found = false if the store is empty.
+	load(lib *libraryT) (offset int64, firstLine string, found bool, err error)
+
+	// Updates the state changed by an op just written to the log.
+	syncOp(lib *libraryT, op *libraryOp) error
+
+	// Replaces all stored state with the library's.
+	syncAll(lib *libraryT) error
+
+	pruneOpIDs(before time.Time) error
+	unassign(key assignKey) error
+}
+
+// Returns the first line of a file or "" if the file is empty.
+func readFirstLine(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err == io.EOF {
+		return "", nil
+	}
+	return line, err
+}
+
+// Opens the state db and loads state from it if it matches the log, leaving f at the
+// first op not yet in the db.  Otherwise the library stays empty and f is at the start of
+// the log so it is fully replayed.
+func (lib *libraryT) loadState(f *os.File) (loaded bool, err error) {
+	if lib.db, err = openStateStore(*stateDB); err != nil {
+		return false, fmt.Errorf("cannot open state db %q: %v", *stateDB, err)
+	}
+	offset, firstLine, found, err := lib.db.load(lib)
+	if err != nil {
+		return false, fmt.Errorf("cannot load state db %q: %v", *stateDB, err)
+	}
+	if !found {
+		log.Printf("State db %q is empty so it will be built from the librarian log\n", *stateDB)
+		return false, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	logFirstLine, err := readFirstLine(lib.fname)
+	if err != nil {
+		return false, err
+	}
+	if offset > fi.Size() || logFirstLine != firstLine {
+		log.Printf("WARNING: state db %q does not match librarian log so it will be rebuilt from the log\n", *stateDB)
+		lib.init()
+		return false, nil
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,9 @@
+//go:build !sqlite
+
+package main
+
+import "fmt"
+
+func openStateStore(fname string) (stateStore, error) {
+	return nil, fmt.Errorf("librarian was built without SQLite support, rebuild with \"-tags sqlite\"")
+}
@@ -0,0 +1,733 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS log (id INTEGER PRIMARY KEY CHECK (id = 0), offset INTEGER, first_line TEXT);
+CREATE TABLE IF NOT EXISTS checkouts (uuid TEXT, label INTEGER, client TEXT, since TEXT, expires TEXT, PRIMARY KEY (uuid, label));
+CREATE TABLE IF NOT EXISTS meta (uuid TEXT, key TEXT, value TEXT, PRIMARY KEY (uuid, key));
+CREATE TABLE IF NOT EXISTS policies (uuid TEXT PRIMARY KEY, policy TEXT);
+CREATE TABLE IF NOT EXISTS revisions (uuid TEXT PRIMARY KEY, rev INTEGER);
+CREATE TABLE IF NOT EXISTS opids (id TEXT PRIMARY KEY, op TEXT, uuid TEXT, label INTEGER, client TEXT, key TEXT, t TEXT);
+CREATE TABLE IF NOT EXISTS assigned (task TEXT, uuid TEXT, label INTEGER, PRIMARY KEY (task, uuid, label));
+CREATE TABLE IF NOT EXISTS contexts (client TEXT PRIMARY KEY, id TEXT, name TEXT, opened TEXT);
+CREATE TABLE IF NOT EXISTS superseded (uuid TEXT, old INTEGER, new INTEGER, PRIMARY KEY (uuid, old));
+CREATE TABLE IF NOT EXISTS aliases (client TEXT PRIMARY KEY, current TEXT);
+CREATE TABLE IF NOT EXISTS seq (id INTEGER PRIMARY KEY CHECK (id = 0), seq INTEGER);
+CREATE TABLE IF NOT EXISTS pins (uuid TEXT, label INTEGER, reason TEXT, client TEXT, since TEXT, PRIMARY KEY (uuid, label));
+CREATE TABLE IF NOT EXISTS saved_views (name TEXT PRIMARY KEY, path TEXT, owner TEXT, saved TEXT);
+CREATE TABLE IF NOT EXISTS comments (uuid TEXT, label INTEGER, id INTEGER, reply_to INTEGER, client TEXT, t TEXT, text TEXT, PRIMARY KEY (uuid, label, id));
+CREATE TABLE IF NOT EXISTS freezes (uuid TEXT, name TEXT, schedule TEXT, duration TEXT, warning TEXT, reason TEXT, client TEXT, since TEXT, PRIMARY KEY (uuid, name));
+`
+
+// sqliteStore keeps state in an SQLite database in WAL mode.  Labels are stored as
+// int64 with the same bits since SQLite integers are signed.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openStateStore(fname string) (stateStore, error) {
+	db, err := sql.Open("sqlite3", fname+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db}, nil
+}
+
+func formatDBTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseDBTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t.In(displayZone), err
+}
+
+func (s *sqliteStore) load(lib *libraryT) (offset int64, firstLine string, found bool, err error) {
+	err = s.db.QueryRow("SELECT offset, first_line FROM log WHERE id = 0").Scan(&offset, &firstLine)
+	if err == sql.ErrNoRows {
+		return 0, "", false, nil
+	}
+	if err != nil {
+		return
+	}
+	// A db written before sequence numbers is rebuilt so the next op's seq is known.
+	var seq int64
+	err = s.db.QueryRow("SELECT seq FROM seq WHERE id = 0").Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, "", false, nil
+	}
+	if err != nil {
+		return
+	}
+	lib.seq = uint64(seq)
+
+	rows, err := s.db.Query("SELECT uuid, label, client, since, expires FROM checkouts")
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var uuid, client, since, expires string
+		var label int64
+		var co checkoutT
+		if err = rows.Scan(&uuid, &label, &client, &since, &expires); err != nil {
+			rows.Close()
+			return
+		}
+		co.client = client
+		if co.t, err = parseDBTime(since); err != nil {
+			rows.Close()
+			return
+		}
+		if co.expires, err = parseDBTime(expires); err != nil {
+			rows.Close()
+			return
+		}
+		checkouts, found := lib.vchk[uuid]
+		if !found {
+			checkouts = make(checkoutsT)
+			lib.vchk[uuid] = checkouts
+		}
+		checkouts[uint64(label)] = co
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT uuid, key, value FROM meta"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var uuid, key, value string
+		if err = rows.Scan(&uuid, &key, &value); err != nil {
+			rows.Close()
+			return
+		}
+		kv, found := lib.meta[uuid]
+		if !found {
+			kv = make(map[string]string)
+			lib.meta[uuid] = kv
+		}
+		kv[key] = value
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT uuid, policy FROM policies"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var uuid, policyStr string
+		if err = rows.Scan(&uuid, &policyStr); err != nil {
+			rows.Close()
+			return
+		}
+		var policy policyJSON
+		if err = json.Unmarshal([]byte(policyStr), &policy); err != nil {
+			rows.Close()
+			return
+		}
+		lib.policies[uuid] = &policy
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT uuid, rev FROM revisions"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var uuid string
+		var rev int64
+		if err = rows.Scan(&uuid, &rev); err != nil {
+			rows.Close()
+			return
+		}
+		lib.revs[uuid] = uint64(rev)
+		lib.revision += uint64(rev)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT id, op, uuid, label, client, key, t FROM opids"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var id, op, t string
+		var label int64
+		var o opIDT
+		if err = rows.Scan(&id, &op, &o.uuid, &label, &o.client, &o.key, &t); err != nil {
+			rows.Close()
+			return
+		}
+		o.op = opTypeFromString(op)
+		o.label = uint64(label)
+		if o.t, err = parseDBTime(t); err != nil {
+			rows.Close()
+			return
+		}
+		lib.opIDs[id] = o
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT task, uuid, label FROM assigned"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var key assignKey
+		var label int64
+		if err = rows.Scan(&key.task, &key.uuid, &label); err != nil {
+			rows.Close()
+			return
+		}
+		key.label = uint64(label)
+		lib.assigned[key] = true
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT client, id, name, opened FROM contexts"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var client, opened string
+		var ctx contextT
+		if err = rows.Scan(&client, &ctx.id, &ctx.name, &opened); err != nil {
+			rows.Close()
+			return
+		}
+		if ctx.opened, err = parseDBTime(opened); err != nil {
+			rows.Close()
+			return
+		}
+		lib.contexts[client] = &ctx
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT uuid, old, new FROM superseded"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var uuid string
+		var old, newLabel int64
+		if err = rows.Scan(&uuid, &old, &newLabel); err != nil {
+			rows.Close()
+			return
+		}
+		m, found := lib.superseded[uuid]
+		if !found {
+			m = make(map[uint64]uint64)
+			lib.superseded[uuid] = m
+		}
+		m[uint64(old)] = uint64(newLabel)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT client, current FROM aliases"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var client, current string
+		if err = rows.Scan(&client, &current); err != nil {
+			rows.Close()
+			return
+		}
+		lib.aliases[client] = current
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT uuid, label, reason, client, since FROM pins"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var uuid, since string
+		var label int64
+		var pin pinT
+		if err = rows.Scan(&uuid, &label, &pin.reason, &pin.client, &since); err != nil {
+			rows.Close()
+			return
+		}
+		if pin.t, err = parseDBTime(since); err != nil {
+			rows.Close()
+			return
+		}
+		m, found := lib.pins[uuid]
+		if !found {
+			m = make(map[uint64]pinT)
+			lib.pins[uuid] = m
+		}
+		m[uint64(label)] = pin
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT name, path, owner, saved FROM saved_views"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var name, saved string
+		var view savedViewT
+		if err = rows.Scan(&name, &view.path, &view.owner, &saved); err != nil {
+			rows.Close()
+			return
+		}
+		if view.saved, err = parseDBTime(saved); err != nil {
+			rows.Close()
+			return
+		}
+		lib.savedViews[name] = &view
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT uuid, label, id, reply_to, client, t, text FROM comments ORDER BY uuid, label, id"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var uuid, t string
+		var label int64
+		var cmt commentT
+		if err = rows.Scan(&uuid, &label, &cmt.id, &cmt.replyTo, &cmt.client, &t, &cmt.text); err != nil {
+			rows.Close()
+			return
+		}
+		if cmt.t, err = parseDBTime(t); err != nil {
+			rows.Close()
+			return
+		}
+		m, found := lib.comments[uuid]
+		if !found {
+			m = make(map[uint64][]commentT)
+			lib.comments[uuid] = m
+		}
+		m[uint64(label)] = append(m[uint64(label)], cmt)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if rows, err = s.db.Query("SELECT uuid, name, schedule, duration, warning, reason, client, since FROM freezes"); err != nil {
+		return
+	}
+	for rows.Next() {
+		var uuid, name, schedule, duration, warning, reason, client, since string
+		if err = rows.Scan(&uuid, &name, &schedule, &duration, &warning, &reason, &client, &since); err != nil {
+			rows.Close()
+			return
+		}
+		var f *freezeT
+		if f, err = parseFreeze(schedule, duration, warning); err != nil {
+			rows.Close()
+			return
+		}
+		f.reason, f.client = reason, client
+		if f.t, err = parseDBTime(since); err != nil {
+			rows.Close()
+			return
+		}
+		m, found := lib.freezes[uuid]
+		if !found {
+			m = make(map[string]*freezeT)
+			lib.freezes[uuid] = m
+		}
+		m[name] = f
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return offset, firstLine, true, nil
+}
+
+// Writes the checkout, if any, of a label.
+func syncCheckout(tx *sql.Tx, lib *libraryT, uuid string, label uint64) error {
+	co, found := lib.vchk[uuid][label]
+	if !found {
+		_, err := tx.Exec("DELETE FROM checkouts WHERE uuid = ? AND label = ?", uuid, int64(label))
+		return err
+	}
+	_, err := tx.Exec("INSERT OR REPLACE INTO checkouts (uuid, label, client, since, expires) VALUES (?, ?, ?, ?, ?)",
+		uuid, int64(label), co.client, formatDBTime(co.t), formatDBTime(co.expires))
+	return err
+}
+
+func syncMeta(tx *sql.Tx, lib *libraryT, uuid, key string) error {
+	value, found := lib.meta[uuid][key]
+	if !found {
+		_, err := tx.Exec("DELETE FROM meta WHERE uuid = ? AND key = ?", uuid, key)
+		return err
+	}
+	_, err := tx.Exec("INSERT OR REPLACE INTO meta (uuid, key, value) VALUES (?, ?, ?)", uuid, key, value)
+	return err
+}
+
+func syncPolicy(tx *sql.Tx, lib *libraryT, uuid string) error {
+	policy, found := lib.policies[uuid]
+	if !found {
+		_, err := tx.Exec("DELETE FROM policies WHERE uuid = ?", uuid)
+		return err
+	}
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO policies (uuid, policy) VALUES (?, ?)", uuid, string(policyBytes))
+	return err
+}
+
+func syncRevision(tx *sql.Tx, lib *libraryT, uuid string) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO revisions (uuid, rev) VALUES (?, ?)", uuid, int64(lib.revs[uuid]))
+	return err
+}
+
+func syncOpID(tx *sql.Tx, id string, o opIDT) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO opids (id, op, uuid, label, client, key, t) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		id, o.op.String(), o.uuid, int64(o.label), o.client, o.key, formatDBTime(o.t))
+	return err
+}
+
+func syncAssigned(tx *sql.Tx, key assignKey) error {
+	_, err := tx.Exec("INSERT OR IGNORE INTO assigned (task, uuid, label) VALUES (?, ?, ?)", key.task, key.uuid, int64(key.label))
+	return err
+}
+
+func syncContext(tx *sql.Tx, lib *libraryT, clientid string) error {
+	ctx, found := lib.contexts[clientid]
+	if !found {
+		_, err := tx.Exec("DELETE FROM contexts WHERE client = ?", clientid)
+		return err
+	}
+	_, err := tx.Exec("INSERT OR REPLACE INTO contexts (client, id, name, opened) VALUES (?, ?, ?, ?)",
+		clientid, ctx.id, ctx.name, formatDBTime(ctx.opened))
+	return err
+}
+
+func syncSuperseded(tx *sql.Tx, lib *libraryT, uuid string, old uint64) error {
+	newLabel, found := lib.superseded[uuid][old]
+	if !found {
+		_, err := tx.Exec("DELETE FROM superseded WHERE uuid = ? AND old = ?", uuid, int64(old))
+		return err
+	}
+	_, err := tx.Exec("INSERT OR REPLACE INTO superseded (uuid, old, new) VALUES (?, ?, ?)", uuid, int64(old), int64(newLabel))
+	return err
+}
+
+func syncPin(tx *sql.Tx, lib *libraryT, uuid string, label uint64) error {
+	pin, found := lib.pins[uuid][label]
+	if !found {
+		_, err := tx.Exec("DELETE FROM pins WHERE uuid = ? AND label = ?", uuid, int64(label))
+		return err
+	}
+	_, err := tx.Exec("INSERT OR REPLACE INTO pins (uuid, label, reason, client, since) VALUES (?, ?, ?, ?, ?)",
+		uuid, int64(label), pin.reason, pin.client, formatDBTime(pin.t))
+	return err
+}
+
+func syncSavedView(tx *sql.Tx, lib *libraryT, name string) error {
+	view, found := lib.savedViews[name]
+	if !found {
+		_, err := tx.Exec("DELETE FROM saved_views WHERE name = ?", name)
+		return err
+	}
+	_, err := tx.Exec("INSERT OR REPLACE INTO saved_views (name, path, owner, saved) VALUES (?, ?, ?, ?)",
+		name, view.path, view.owner, formatDBTime(view.saved))
+	return err
+}
+
+// Writes a label's comments, replacing any dropped as the oldest.
+func syncComments(tx *sql.Tx, lib *libraryT, uuid string, label uint64) error {
+	if _, err := tx.Exec("DELETE FROM comments WHERE uuid = ? AND label = ?", uuid, int64(label)); err != nil {
+		return err
+	}
+	for _, cmt := range lib.comments[uuid][label] {
+		if _, err := tx.Exec("INSERT INTO comments (uuid, label, id, reply_to, client, t, text) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			uuid, int64(label), cmt.id, cmt.replyTo, cmt.client, formatDBTime(cmt.t), cmt.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncFreeze(tx *sql.Tx, lib *libraryT, uuid, name string) error {
+	f, found := lib.freezes[uuid][name]
+	if !found {
+		_, err := tx.Exec("DELETE FROM freezes WHERE uuid = ? AND name = ?", uuid, name)
+		return err
+	}
+	_, err := tx.Exec("INSERT OR REPLACE INTO freezes (uuid, name, schedule, duration, warning, reason, client, since) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		uuid, name, f.schedule, f.duration.String(), f.warning.String(), f.reason, f.client, formatDBTime(f.t))
+	return err
+}
+
+// Writes the state changed by a client rename: the renamed client's checkouts and work
+// context, and all client aliases.
+func syncRename(tx *sql.Tx, lib *libraryT, from, to string) error {
+	for uuid, checkouts := range lib.vchk {
+		renamed := false
+		for label, co := range checkouts {
+			if co.client == to {
+				if err := syncCheckout(tx, lib, uuid, label); err != nil {
+					return err
+				}
+				renamed = true
+			}
+		}
+		if renamed {
+			if err := syncRevision(tx, lib, uuid); err != nil {
+				return err
+			}
+		}
+	}
+	if err := syncContext(tx, lib, from); err != nil {
+		return err
+	}
+	if err := syncContext(tx, lib, to); err != nil {
+		return err
+	}
+	return syncAliases(tx, lib)
+}
+
+func syncAliases(tx *sql.Tx, lib *libraryT) error {
+	if _, err := tx.Exec("DELETE FROM aliases"); err != nil {
+		return err
+	}
+	for client, current := range lib.aliases {
+		if _, err := tx.Exec("INSERT INTO aliases (client, current) VALUES (?, ?)", client, current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncLogPosition(tx *sql.Tx, lib *libraryT) error {
+	if _, err := tx.Exec("INSERT OR REPLACE INTO log (id, offset, first_line) VALUES (0, ?, ?)", lib.size, lib.firstLine); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT OR REPLACE INTO seq (id, seq) VALUES (0, ?)", int64(lib.seq))
+	return err
+}
+
+func (s *sqliteStore) syncOp(lib *libraryT, op *libraryOp) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	switch op.op {
+	case CheckoutOp, CheckinOp, ExpireOp, RestoreOp, RenewOp:
+		err = syncCheckout(tx, lib, op.uuid, op.label)
+	case ResetOp, CommitResetOp:
+		if _, err = tx.Exec("DELETE FROM checkouts WHERE uuid = ?", op.uuid); err == nil {
+			for label := range lib.vchk[op.uuid] {
+				if err = syncCheckout(tx, lib, op.uuid, label); err != nil {
+					break
+				}
+			}
+		}
+	case LabelResetOp:
+		for _, label := range op.resetLabels() {
+			if err = syncCheckout(tx, lib, op.uuid, label); err != nil {
+				break
+			}
+		}
+	case MetaSetOp, MetaDeleteOp, MetaRestoreOp:
+		err = syncMeta(tx, lib, op.uuid, op.attrs["key"])
+	case PolicySetOp, PolicyRestoreOp:
+		err = syncPolicy(tx, lib, op.uuid)
+	case ContextOpenOp, ContextCloseOp, ContextRestoreOp:
+		err = syncContext(tx, lib, op.client)
+	case SupersedeOp, SupersedeRestoreOp:
+		err = syncSuperseded(tx, lib, op.uuid, op.label)
+	case ClientRenameOp, ClientAliasRestoreOp:
+		err = syncRename(tx, lib, op.client, op.attrs["to"])
+	case PinOp, UnpinOp, PinRestoreOp:
+		err = syncPin(tx, lib, op.uuid, op.label)
+	case ViewSaveOp, ViewDeleteOp, ViewRestoreOp:
+		err = syncSavedView(tx, lib, op.attrs["name"])
+	case CommentOp, CommentRestoreOp:
+		err = syncComments(tx, lib, op.uuid, op.label)
+	case FreezeSetOp, FreezeDeleteOp, FreezeRestoreOp:
+		err = syncFreeze(tx, lib, op.uuid, op.attrs["name"])
+	}
+	if err != nil {
+		return err
+	}
+	if op.op != ConflictOp && !op.op.uuidless() {
+		if err := syncRevision(tx, lib, op.uuid); err != nil {
+			return err
+		}
+	}
+	if id := op.attrs["opid"]; id != "" {
+		if o, found := lib.opIDs[id]; found {
+			if err := syncOpID(tx, id, o); err != nil {
+				return err
+			}
+		}
+	}
+	if task := op.attrs["task"]; task != "" && op.op == CheckoutOp {
+		if err := syncAssigned(tx, assignKey{task, op.uuid, op.label}); err != nil {
+			return err
+		}
+	}
+	if err := syncLogPosition(tx, lib); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) syncAll(lib *libraryT) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"checkouts", "meta", "policies", "revisions", "opids", "assigned", "contexts", "superseded", "aliases", "pins", "saved_views", "comments", "freezes"} {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			return err
+		}
+	}
+	for uuid, checkouts := range lib.vchk {
+		for label := range checkouts {
+			if err := syncCheckout(tx, lib, uuid, label); err != nil {
+				return err
+			}
+		}
+	}
+	for uuid, kv := range lib.meta {
+		for key := range kv {
+			if err := syncMeta(tx, lib, uuid, key); err != nil {
+				return err
+			}
+		}
+	}
+	for uuid := range lib.policies {
+		if err := syncPolicy(tx, lib, uuid); err != nil {
+			return err
+		}
+	}
+	for uuid := range lib.revs {
+		if err := syncRevision(tx, lib, uuid); err != nil {
+			return err
+		}
+	}
+	for id, o := range lib.opIDs {
+		if err := syncOpID(tx, id, o); err != nil {
+			return err
+		}
+	}
+	for key := range lib.assigned {
+		if err := syncAssigned(tx, key); err != nil {
+			return err
+		}
+	}
+	for clientid := range lib.contexts {
+		if err := syncContext(tx, lib, clientid); err != nil {
+			return err
+		}
+	}
+	for uuid, m := range lib.superseded {
+		for old := range m {
+			if err := syncSuperseded(tx, lib, uuid, old); err != nil {
+				return err
+			}
+		}
+	}
+	if err := syncAliases(tx, lib); err != nil {
+		return err
+	}
+	for uuid, m := range lib.pins {
+		for label := range m {
+			if err := syncPin(tx, lib, uuid, label); err != nil {
+				return err
+			}
+		}
+	}
+	for name := range lib.savedViews {
+		if err := syncSavedView(tx, lib, name); err != nil {
+			return err
+		}
+	}
+	for uuid, m := range lib.comments {
+		for label := range m {
+			if err := syncComments(tx, lib, uuid, label); err != nil {
+				return err
+			}
+		}
+	}
+	for uuid, m := range lib.freezes {
+		for name := range m {
+			if err := syncFreeze(tx, lib, uuid, name); err != nil {
+				return err
+			}
+		}
+	}
+	if err := syncLogPosition(tx, lib); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) pruneOpIDs(before time.Time) error {
+	rows, err := s.db.Query("SELECT id, t FROM opids")
+	if err != nil {
+		return err
+	}
+	var old []string
+	for rows.Next() {
+		var id, tStr string
+		if err := rows.Scan(&id, &tStr); err != nil {
+			rows.Close()
+			return err
+		}
+		if t, err := parseDBTime(tStr); err == nil && t.Before(before) {
+			old = append(old, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range old {
+		if _, err := s.db.Exec("DELETE FROM opids WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) unassign(key assignKey) error {
+	_, err := s.db.Exec("DELETE FROM assigned WHERE task = ? AND uuid = ? AND label = ?", key.task, key.uuid, int64(key.label))
+	return err
+}
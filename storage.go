@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Suffix format for compacted log segments.  Lexical order matches time order.
+	segmentTimeFmt = "20060102T150405"
+
+	// Suffix added to log segments compressed with gzip.
+	gzipSuffix = ".gz"
+
+	// Actions that can be taken when the librarian log exceeds -maxlogsize.
+	WarnAction    = "warn"
+	CompactAction = "compact"
+	RefuseAction  = "refuse"
+)
+
+var (
+	// Exported via expvar at /debug/vars.
+	logBytesVar      = expvar.NewInt("librarian_log_bytes")
+	overLimitVar     = expvar.NewInt("librarian_log_over_limit")
+	compactionsVar   = expvar.NewInt("librarian_compactions")
+	truncationsVar   = expvar.NewInt("librarian_log_truncations_recovered")
+	writeFailuresVar = expvar.NewInt("librarian_log_write_failures")
+)
+
+// MaxWriteFailures is the number of log writes in a row that can fail before the server
+// switches to maintenance mode, refusing changes until it's turned off.
+const MaxWriteFailures = 3
+
+type storageJSON struct {
+	LogFile       string
+	LogBytes      int64
+	SegmentBytes  int64
+	Segments      int
+	LimitBytes    int64
+	Action        string
+	OverLimit     bool
+	DiskAvailable uint64
+	DiskTotal     uint64
+
+	// Truncated last log lines removed at startup, e.g., after a crash mid-write.
+	TruncationsRecovered int64
+
+	// Ops that couldn't be written to the log, e.g., because the disk was full.
+	WriteFailures int64
+
+	// Usage of UUIDs whose policies have quotas.
+	Quotas []quotaJSON `json:",omitempty"`
+
+	logChecksumsJSON
+}
+
+// Returns the log size limit in bytes or 0 if there is no limit.
+func logSizeLimit() int64 {
+	return *maxLogSize * 1024 * 1024
+}
+
+func validLogSizeAction(action string) bool {
+	switch action {
+	case WarnAction, CompactAction, RefuseAction:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns true if the log is over its size limit and new checkouts should be refused.
+// Notes a failed write of an op to the log, dropping any part of its line that was written,
+// and switches to maintenance mode after MaxWriteFailures failures in a row.  Must be
+// called with library lock held.
+func (lib *libraryT) writeFailed(op *libraryOp, err error) error {
+	writeFailuresVar.Add(1)
+	lib.writeFailures++
+	log.Printf("ERROR: unable to write %s op of uuid %s to librarian log: %v\n", op.op, op.uuid, err)
+	if err := lib.f.Truncate(lib.size); err != nil {
+		log.Printf("ERROR: unable to remove partly written op from librarian log: %v\n", err)
+	}
+	lib.w.Reset(lib.f)
+	if lib.writeFailures == MaxWriteFailures && !inMaintenance() {
+		setMaintenance(true, fmt.Sprintf("librarian log can't be written (%v), so changes are refused", err))
+	}
+	return &ErrStorageFailure{err}
+}
+
+func refuseCheckouts() bool {
+	if *logSizeAction != RefuseAction {
+		return false
+	}
+	library.RLock()
+	defer library.RUnlock()
+	return library.overLimit
+}
+
+// Called with library lock held after every write to the log.  Alerts once per
+// crossing of the size limit and may kick off a compaction.
+func (lib *libraryT) checkLogSize() {
+	logBytesVar.Set(lib.size)
+	limit := logSizeLimit()
+	if limit == 0 {
+		return
+	}
+	over := lib.size > limit
+	if over == lib.overLimit {
+		return
+	}
+	lib.overLimit = over
+	if !over {
+		overLimitVar.Set(0)
+		return
+	}
+	overLimitVar.Set(1)
+	log.Printf("WARNING: librarian log %q is %d bytes, exceeding limit of %d bytes\n", lib.fname, lib.size, limit)
+	if *logSizeAction == CompactAction && !lib.compacting {
+		go func() {
+			if err := compactLog(); err != nil {
+				log.Printf("ERROR: unable to compact librarian log: %v\n", err)
+			}
+		}()
+	}
+}
+
+// Returns the compacted segments of the librarian log in time order.  If a segment is
+// being compressed, the uncompressed file is returned until compression is done.
+func logSegments(fname string) ([]string, error) {
+	matches, err := filepath.Glob(fname + ".seg-*")
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(matches))
+	for _, match := range matches {
+		found[match] = true
+	}
+	var segments []string
+	for _, match := range matches {
+		if strings.HasSuffix(match, ".tmp") {
+			continue
+		}
+		if strings.HasSuffix(match, gzipSuffix) && found[strings.TrimSuffix(match, gzipSuffix)] {
+			continue
+		}
+		segments = append(segments, match)
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// Opens a librarian log or segment for reading.  Segments ending in ".gz" are decompressed.
+func openLogFile(fname string) (io.ReadCloser, error) {
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) && strings.Contains(filepath.Base(fname), ".seg-") && !strings.HasSuffix(fname, gzipSuffix) {
+		// The segment was compressed since it was listed.
+		fname += gzipSuffix
+		f, err = os.Open(fname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(fname, gzipSuffix) {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot read compressed segment %q: %v", fname, err)
+	}
+	return gzipFile{zr, f}, nil
+}
+
+// Returns an unused name for a segment of the librarian log compacted at time t.  Segments
+// compacted in the same second are given a sequence suffix, which sorts after the earlier
+// segment whether or not it was compressed.  Must be called with library lock held.
+func newSegmentName(fname string, t time.Time) string {
+	base := fmt.Sprintf("%s.seg-%s", fname, t.Format(segmentTimeFmt))
+	segment := base
+	for n := 1; segmentExists(segment); n++ {
+		segment = fmt.Sprintf("%s_%02d", base, n)
+	}
+	return segment
+}
+
+// Returns true if a segment exists, compressed or not.
+func segmentExists(segment string) bool {
+	for _, name := range []string{segment, segment + gzipSuffix} {
+		if _, err := os.Lstat(name); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serializes compression of log segments.
+var compressMu sync.Mutex
+
+// Compresses a log segment with gzip, replacing it with a ".gz" file once the compressed
+// copy is safely on disk.
+func compressSegment(segment string) error {
+	compressMu.Lock()
+	defer compressMu.Unlock()
+
+	in, err := os.Open(segment)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	gzname := segment + gzipSuffix
+	tmpname := gzname + ".tmp"
+	out, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, gzname)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	if err := os.Remove(segment); err != nil {
+		return err
+	}
+	log.Printf("Compressed log segment %q into %q\n", segment, gzname)
+	return nil
+}
+
+// Compresses any uncompressed segments of the librarian log, e.g., those compacted before
+// -gzipsegments was set.
+func compressSegments(fname string) {
+	segments, err := logSegments(fname)
+	if err != nil {
+		log.Printf("ERROR: unable to list log segments to compress: %v\n", err)
+		return
+	}
+	for _, segment := range segments {
+		if strings.HasSuffix(segment, gzipSuffix) {
+			continue
+		}
+		if err := compressSegment(segment); err != nil {
+			log.Printf("ERROR: unable to compress log segment %q: %v\n", segment, err)
+		}
+	}
+}
+
+// Returns all files, oldest first, that make up the full history of the librarian log.
+func historyFiles() ([]string, error) {
+	segments, err := logSegments(library.fname)
+	if err != nil {
+		return nil, err
+	}
+	return append(segments, library.fname), nil
+}
+
+// unknownOpsError is returned for a compaction of a log with ops of types added by a
+// newer librarian.
+type unknownOpsError struct {
+	ops map[string]int // count by op type
+}
+
+func (e *unknownOpsError) Error() string {
+	names := make([]string, 0, len(e.ops))
+	for name := range e.ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("librarian log has %s ops written by a newer librarian, which compaction would drop", strings.Join(names, ", "))
+}
+
+// Moves the current librarian log into a read-only segment and starts a new log
+// holding only the active checkouts.  History reads span all segments while
+// startup only needs to replay the new, small log.  The new log starts with a chain
+// op holding the segment's hash (see "librarian verify").  Refuses with an
+// *unknownOpsError while the log has ops of types added by a newer librarian, since
+// their state would be lost from the new log.
+func compactLog() error {
+	if unknown := getStartupReport().UnknownOps; len(unknown) != 0 {
+		return &unknownOpsError{unknown}
+	}
+	library.Lock()
+	defer library.Unlock()
+
+	library.compacting = true
+	defer func() {
+		library.compacting = false
+		library.checkQuotas()
+	}()
+
+	if err := library.w.Flush(); err != nil {
+		return err
+	}
+	segment := newSegmentName(library.fname, time.Now())
+	digest, err := digestLogFile(library.fname)
+	if err != nil {
+		return fmt.Errorf("cannot hash librarian log for segment %q: %v", segment, err)
+	}
+	if digest.crc32 != library.crc {
+		noteCorruptSegment(filepath.Base(segment), fmt.Sprintf("CRC-32C of log is %s, not %s as written", formatCRC(digest.crc32), formatCRC(library.crc)))
+	}
+
+	// Write the new log to a temp file first so the old log stays in place until
+	// the active checkouts are safely on disk.
+	tmpname := library.fname + ".tmp"
+	f, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
+	if err != nil {
+		return fmt.Errorf("cannot create compacted librarian log: %v", err)
+	}
+	oldf, oldw, oldsize, oldCRC, oldFirstLine, oldBytes := library.f, library.w, library.size, library.crc, library.firstLine, library.uuidBytes
+	library.f, library.w, library.size, library.crc, library.uuidBytes = f, bufio.NewWriter(f), 0, 0, make(map[string]int64)
+	restoreOldLog := func() {
+		f.Close()
+		os.Remove(tmpname)
+		library.f, library.w, library.size, library.crc, library.firstLine, library.uuidBytes = oldf, oldw, oldsize, oldCRC, oldFirstLine, oldBytes
+		logCRCVar.Set(int64(oldCRC))
+	}
+	err = library.write(chainOp(segment, digest))
+	for uuid, checkouts := range library.vchk {
+		if err != nil {
+			break
+		}
+		for label, co := range checkouts {
+			op := &libraryOp{
+				t:      co.t,
+				op:     RestoreOp,
+				uuid:   uuid,
+				label:  label,
+				client: co.client,
+			}
+			if !co.expires.IsZero() {
+				expires, _ := co.expires.UTC().MarshalText()
+				op.attrs = map[string]string{"expires": string(expires)}
+			}
+			if err = library.write(op); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = library.writeMetaRestores()
+	}
+	if err == nil {
+		err = library.writePolicyRestores()
+	}
+	if err == nil {
+		err = library.writeSupersededRestores()
+	}
+	if err == nil {
+		err = library.writePinRestores()
+	}
+	if err == nil {
+		err = library.writeClientAliasRestores()
+	}
+	if err == nil {
+		err = library.writeRevisionRestores()
+	}
+	if err == nil {
+		err = library.writeContextRestores()
+	}
+	if err == nil {
+		err = library.writeSavedViewRestores()
+	}
+	if err == nil {
+		err = library.writeCommentRestores()
+	}
+	if err == nil {
+		err = library.writeFreezeRestores()
+	}
+	if err == nil {
+		err = library.writeOpIDRestores()
+	}
+	if err == nil {
+		err = library.writeAssignmentRestores()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		restoreOldLog()
+		return fmt.Errorf("cannot write compacted librarian log: %v", err)
+	}
+
+	// The old log stays open until both renames are done, so if either fails, ops are
+	// still appended to the old log rather than to a temp file that is never replayed.
+	noteFsync()
+	if err := os.Rename(library.fname, segment); err != nil {
+		restoreOldLog()
+		return fmt.Errorf("cannot move librarian log to segment %q: %v", segment, err)
+	}
+	if err := os.Rename(tmpname, library.fname); err != nil {
+		if undoErr := os.Rename(segment, library.fname); undoErr != nil {
+			log.Printf("ERROR: unable to move segment %q back to librarian log %q: %v\n", segment, library.fname, undoErr)
+		}
+		restoreOldLog()
+		return fmt.Errorf("cannot move compacted librarian log into place: %v", err)
+	}
+	oldf.Close()
+	if library.db != nil {
+		if err := library.db.syncAll(&library); err != nil {
+			log.Printf("ERROR: unable to update state db after compaction: %v\n", err)
+		}
+	}
+	library.shadowAll()
+	library.checkLogSize()
+	compactionsVar.Add(1)
+	setSegmentCRC(segment, digest.crc32)
+	log.Printf("Compacted librarian log %q into segment %q\n", library.fname, segment)
+	if *gzipSegments {
+		go func() {
+			if err := compressSegment(segment); err != nil {
+				log.Printf("ERROR: unable to compress log segment %q: %v\n", segment, err)
+			}
+		}()
+	}
+	return nil
+}
+
+func getStorage() (*storageJSON, error) {
+	library.RLock()
+	s := &storageJSON{
+		LogFile:    library.fname,
+		LogBytes:   library.size,
+		LimitBytes: logSizeLimit(),
+		Action:     *logSizeAction,
+		OverLimit:  library.overLimit,
+
+		TruncationsRecovered: truncationsVar.Value(),
+		WriteFailures:        writeFailuresVar.Value(),
+	}
+	library.RUnlock()
+	s.Quotas = getQuotas()
+	s.logChecksumsJSON = getLogChecksums()
+
+	segments, err := logSegments(s.LogFile)
+	if err != nil {
+		return nil, err
+	}
+	s.Segments = len(segments)
+	for _, segment := range segments {
+		fi, err := os.Stat(segment)
+		if err != nil {
+			return nil, err
+		}
+		s.SegmentBytes += fi.Size()
+	}
+	s.DiskAvailable, s.DiskTotal, err = diskSpace(filepath.Dir(s.LogFile))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+)
+
+var errTestWrite = errors.New("disk full")
+
+// failAfterWriter passes through n writes and fails the rest.
+type failAfterWriter struct {
+	w io.Writer
+	n int
+}
+
+func (fw *failAfterWriter) Write(p []byte) (int, error) {
+	if fw.n <= 0 {
+		return 0, errTestWrite
+	}
+	fw.n--
+	return fw.w.Write(p)
+}
+
+// libraryStateT is the state that an op which can't be logged must leave unchanged.
+type libraryStateT struct {
+	vchk     map[string]checkoutsT
+	revs     map[string]uint64
+	revision uint64
+	clients  map[string]clientStatsT
+}
+
+func snapshotLibrary() libraryStateT {
+	library.RLock()
+	defer library.RUnlock()
+	state := libraryStateT{
+		vchk:     make(map[string]checkoutsT, len(library.vchk)),
+		revs:     make(map[string]uint64, len(library.revs)),
+		revision: library.revision,
+		clients:  make(map[string]clientStatsT, len(library.clients)),
+	}
+	for uuid, checkouts := range library.vchk {
+		cp := make(checkoutsT, len(checkouts))
+		for label, co := range checkouts {
+			cp[label] = co
+		}
+		state.vchk[uuid] = cp
+	}
+	for uuid, rev := range library.revs {
+		state.revs[uuid] = rev
+	}
+	for client, stats := range library.clients {
+		state.clients[client] = *stats
+	}
+	return state
+}
+
+// Starts a library with checkouts of two uuids whose log can only be written the given
+// number of times.  Later writes fail as on a full disk, including after writeFailed resets
+// the writer to the log file.  Returns the writable log file.
+func initFailingLibrary(t *testing.T, writes int) *os.File {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	fname := filepath.Join(t.TempDir(), "librarian.log")
+	if err := initLibrary(fname); err != nil {
+		t.Fatal(err)
+	}
+	for _, co := range []struct {
+		uuid   string
+		label  uint64
+		client string
+	}{{"u1", 1, "alice"}, {"u1", 2, "alice"}, {"u2", 3, "bob"}, {"u2", 4, "alice"}} {
+		if _, err := checkout(co.uuid, co.label, co.client, nil, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readOnly, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	library.Lock()
+	writable := library.f
+	library.f = readOnly
+	library.w = bufio.NewWriter(&failAfterWriter{writable, writes})
+	library.Unlock()
+	t.Cleanup(func() {
+		writable.Close()
+		readOnly.Close()
+		setMaintenance(false, "")
+	})
+	return writable
+}
+
+func checkUnchanged(t *testing.T, before libraryStateT) {
+	t.Helper()
+	after := snapshotLibrary()
+	if !reflect.DeepEqual(before.vchk, after.vchk) {
+		t.Errorf("checkouts changed from %v to %v", before.vchk, after.vchk)
+	}
+	if !reflect.DeepEqual(before.revs, after.revs) || before.revision != after.revision {
+		t.Errorf("revisions changed from %v (%d) to %v (%d)", before.revs, before.revision, after.revs, after.revision)
+	}
+	if !reflect.DeepEqual(before.clients, after.clients) {
+		t.Errorf("client stats changed from %v to %v", before.clients, after.clients)
+	}
+}
+
+var storageFailureOps = []struct {
+	name string
+	op   func() error
+}{
+	{"checkout", func() error {
+		_, err := checkout("u1", 10, "alice", nil, true)
+		return err
+	}},
+	{"checkout of new uuid", func() error {
+		_, err := checkout("u3", 10, "alice", nil, true)
+		return err
+	}},
+	{"renewal", func() error {
+		_, err := checkout("u1", 1, "alice", nil, true)
+		return err
+	}},
+	{"checkin", func() error {
+		return checkin("u1", 1, "alice", nil, true)
+	}},
+	{"rename", func() error {
+		_, err := renameClient("alice", "carol", false, nil)
+		return err
+	}},
+	{"rename with history", func() error {
+		_, err := renameClient("alice", "bob", true, nil)
+		return err
+	}},
+	{"migrate", func() error {
+		_, err := migrateCheckouts("u1", "u3", "", nil, false, nil)
+		return err
+	}},
+	{"checkout-multi", func() error {
+		_, err := checkoutMulti("alice", []multiLabelT{{"u1", 11, nil}, {"u3", 12, nil}})
+		return err
+	}},
+}
+
+func TestStorageFailureLeavesState(t *testing.T) {
+	for _, tc := range storageFailureOps {
+		t.Run(tc.name, func(t *testing.T) {
+			initFailingLibrary(t, 0)
+			before := snapshotLibrary()
+			err := tc.op()
+			var storage *ErrStorageFailure
+			if !errors.As(err, &storage) {
+				t.Fatalf("expected storage failure, got %v", err)
+			}
+			checkUnchanged(t, before)
+		})
+	}
+}
+
+func TestMultiCheckoutRollback(t *testing.T) {
+	labels := []multiLabelT{{"u1", 11, nil}, {"u3", 12, nil}, {"u2", 13, nil}}
+
+	t.Run("logged", func(t *testing.T) {
+		writable := initFailingLibrary(t, 1)
+		library.Lock()
+		library.f = writable // writes work again once writeFailed resets the writer
+		library.Unlock()
+		before := snapshotLibrary()
+		_, err := checkoutMulti("alice", labels)
+		var multi *multiCheckoutError
+		if !errors.As(err, &multi) || len(multi.unlogged) != 0 {
+			t.Fatalf("expected rolled back transaction, got %v", err)
+		}
+		after := snapshotLibrary()
+		if !reflect.DeepEqual(before.vchk, after.vchk) {
+			t.Errorf("checkouts changed from %v to %v", before.vchk, after.vchk)
+		}
+	})
+
+	t.Run("unlogged", func(t *testing.T) {
+		initFailingLibrary(t, 1)
+		library.Lock()
+		library.w = bufio.NewWriter(&failAfterWriter{library.w, 1})
+		library.Unlock()
+		before := snapshotLibrary()
+		_, err := checkoutMulti("alice", labels)
+		var multi *multiCheckoutError
+		if !errors.As(err, &multi) {
+			t.Fatalf("expected failed transaction, got %v", err)
+		}
+		if len(multi.unlogged) != 1 || multi.unlogged[0].uuid != "u1" || multi.unlogged[0].label != 11 {
+			t.Errorf("expected u1, label 11 reported as still checked out in the log, got %v", multi.unlogged)
+		}
+		after := snapshotLibrary()
+		if !reflect.DeepEqual(before.vchk, after.vchk) {
+			t.Errorf("checkouts changed from %v to %v", before.vchk, after.vchk)
+		}
+	})
+}
+
+func TestStorageFailureResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(web.C, http.ResponseWriter, *http.Request)
+		method  string
+		path    string
+		params  map[string]string
+		body    string
+	}{
+		{"checkout", putCheckoutHandler, "PUT", "/checkout/u1/10/alice", map[string]string{"uuid": "u1", "label": "10", "client": "alice"}, ""},
+		{"checkin", putCheckinHandler, "PUT", "/checkin/u1/1/alice", map[string]string{"uuid": "u1", "label": "1", "client": "alice"}, ""},
+		{"rename", renameClientHandler, "POST", "/admin/rename-client", nil, `{"From": "alice", "To": "carol"}`},
+		{"migrate", migrateHandler, "POST", "/migrate/u1/u3", map[string]string{"from": "u1", "to": "u3"}, ""},
+		{"checkout-multi", postCheckoutMultiHandler, "POST", "/checkout-multi", nil,
+			`{"Client": "alice", "Labels": [{"UUID": "u1", "Label": 11}, {"UUID": "u3", "Label": 12}]}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			initFailingLibrary(t, 0)
+			before := snapshotLibrary()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			tc.handler(web.C{URLParams: tc.params, Env: map[interface{}]interface{}{}}, w, r)
+			var resp struct{ Code string }
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("bad response %q: %v", w.Body.String(), err)
+			}
+			if w.Code != http.StatusInternalServerError || resp.Code != StorageFailureCode {
+				t.Errorf("expected 500 status with code %s, got %d: %s", StorageFailureCode, w.Code, w.Body.String())
+			}
+			checkUnchanged(t, before)
+		})
+	}
+}
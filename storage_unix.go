@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// Returns the available and total bytes on the file system holding dir.
+func diskSpace(dir string) (avail, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(dir, &st); err != nil {
+		return
+	}
+	avail = uint64(st.Bavail) * uint64(st.Bsize)
+	total = uint64(st.Blocks) * uint64(st.Bsize)
+	return
+}
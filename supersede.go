@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// supersedeRequestJSON is the body of POST /admin/supersede/{UUID}.  Labels can be numbers
+// or strings in a format accepted by the uuid's policy.
+type supersedeRequestJSON struct {
+	Mappings []struct {
+		Old json.RawMessage
+		New json.RawMessage
+	}
+}
+
+type supersededJSON struct {
+	Old     labelJSON
+	New     labelJSON
+	Current labelJSON // end of the chain of superseding labels
+}
+
+type supersededListJSON struct {
+	UUID     string
+	Mappings []supersededJSON
+}
+
+// Decodes a supersede request into old -> new label mappings in request order.
+func decodeSupersede(uuid string, r io.Reader) ([][2]uint64, error) {
+	var body supersedeRequestJSON
+	dec := json.NewDecoder(io.LimitReader(r, MaxOpBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		return nil, fmt.Errorf("bad JSON request body: %v", err)
+	}
+	if len(body.Mappings) == 0 {
+		return nil, fmt.Errorf("JSON request body must have at least one mapping")
+	}
+	mappings := make([][2]uint64, len(body.Mappings))
+	for i, m := range body.Mappings {
+		var err error
+		if mappings[i][0], err = parseLabelJSON(uuid, m.Old); err != nil {
+			return nil, fmt.Errorf("mapping %d: %v", i, err)
+		}
+		if mappings[i][1], err = parseLabelJSON(uuid, m.New); err != nil {
+			return nil, fmt.Errorf("mapping %d: %v", i, err)
+		}
+	}
+	return mappings, nil
+}
+
+// Follows a label through superseding labels to its current id.  Must be called with
+// library lock held.
+func (lib *libraryT) resolveLabel(uuid string, label uint64) uint64 {
+	m := lib.superseded[uuid]
+	for i := 0; i <= len(m); i++ {
+		next, found := m[label]
+		if !found {
+			break
+		}
+		label = next
+	}
+	return label
+}
+
+// Returns the current id of a label that may have been superseded, e.g., by a merge.
+func resolveLabel(uuid string, label uint64) uint64 {
+	library.RLock()
+	defer library.RUnlock()
+	return library.resolveLabel(uuid, label)
+}
+
+// Returns the client holding a label or any label it supersedes, other than the given
+// client, and the label it holds.
+func resolvedHolder(uuid string, label uint64, clientid string) (holder string, held uint64, found bool) {
+	library.RLock()
+	defer library.RUnlock()
+	return library.resolvedHolder(uuid, label, clientid)
+}
+
+// Returns the client holding a label or any label it supersedes, other than the given
+// client, and the label it holds.  Must be called with library lock held.
+func (lib *libraryT) resolvedHolder(uuid string, label uint64, clientid string) (holder string, held uint64, found bool) {
+	current := lib.resolveLabel(uuid, label)
+	for l, co := range lib.vchk[uuid] {
+		if co.client != clientid && lib.resolveLabel(uuid, l) == current {
+			return co.client, l, true
+		}
+	}
+	return "", 0, false
+}
+
+// Records that old labels of a uuid have been superseded by new ones.  No mappings are
+// applied if any would make a label supersede itself.
+func supersede(uuid string, mappings [][2]uint64, clientid string, attrs map[string]string) error {
+	library.Lock()
+	defer library.Unlock()
+
+	tentative := make(map[uint64]uint64, len(library.superseded[uuid])+len(mappings))
+	for old, newLabel := range library.superseded[uuid] {
+		tentative[old] = newLabel
+	}
+	for _, m := range mappings {
+		tentative[m[0]] = m[1]
+	}
+	for _, m := range mappings {
+		label := m[0]
+		for i := 0; i <= len(tentative); i++ {
+			next, found := tentative[label]
+			if !found {
+				break
+			}
+			if next == m[0] {
+				return fmt.Errorf("label %d superseded by %d would supersede itself", m[0], m[1])
+			}
+			label = next
+		}
+	}
+
+	t := clock.Now()
+	for i, m := range mappings {
+		if err := library.setSuperseded(SupersedeOp, t, uuid, m[0], m[1], clientid, attrs, true); err != nil {
+			if i > 0 {
+				return fmt.Errorf("only the first %d of %d mappings were applied: %w", i, len(mappings), err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets a label's superseding label, e.g., when replaying the log.  Must be called with
+// library lock held.
+func (lib *libraryT) setSuperseded(opT opType, t time.Time, uuid string, old, newLabel uint64, clientid string, attrs map[string]string, modifyLog bool) error {
+	m, found := lib.superseded[uuid]
+	if !found {
+		m = make(map[uint64]uint64)
+		lib.superseded[uuid] = m
+	}
+	prev, prevFound := m[old]
+	m[old] = newLabel
+	lib.bumpRevision(uuid)
+
+	// Append to log
+	if modifyLog {
+		op := &libraryOp{
+			t:      t,
+			op:     opT,
+			uuid:   uuid,
+			label:  old,
+			client: clientid,
+			attrs:  mergeAttrs(attrs, map[string]string{"new": strconv.FormatUint(newLabel, 10)}),
+		}
+		if err := lib.write(op); err != nil {
+			// Undo the change so state matches the log.
+			if prevFound {
+				m[old] = prev
+			} else if delete(m, old); !found {
+				delete(lib.superseded, uuid)
+			}
+			lib.unbumpRevision(uuid)
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies a supersede op read from the log.
+func restoreSuperseded(op *libraryOp) error {
+	newLabel, err := strconv.ParseUint(op.attrs["new"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad superseding label %q for uuid %s, label %d: %v", op.attrs["new"], op.uuid, op.label, err)
+	}
+	library.Lock()
+	defer library.Unlock()
+
+	return library.setSuperseded(op.op, op.t, op.uuid, op.label, newLabel, op.client, op.attrs, false)
+}
+
+// Returns the superseded labels of a uuid sorted by old label.
+func getSuperseded(uuid string) supersededListJSON {
+	format := getPolicy(uuid).LabelOutput
+
+	library.RLock()
+	defer library.RUnlock()
+
+	list := supersededListJSON{UUID: uuid, Mappings: []supersededJSON{}}
+	for old, newLabel := range library.superseded[uuid] {
+		current := library.resolveLabel(uuid, old)
+		list.Mappings = append(list.Mappings, supersededJSON{labelJSON{old, format}, labelJSON{newLabel, format}, labelJSON{current, format}})
+	}
+	sort.Slice(list.Mappings, func(i, j int) bool { return list.Mappings[i].Old.label < list.Mappings[j].Old.label })
+	return list
+}
+
+// Writes all superseded labels into a compacted log.  Must be called with library lock held.
+func (lib *libraryT) writeSupersededRestores() error {
+	for uuid, m := range lib.superseded {
+		for old, newLabel := range m {
+			op := &libraryOp{
+				op:     SupersedeRestoreOp,
+				uuid:   uuid,
+				label:  old,
+				client: "n/a",
+				attrs:  map[string]string{"new": strconv.FormatUint(newLabel, 10)},
+			}
+			if err := lib.write(op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
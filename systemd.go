@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ListenFDsStart is the first file descriptor passed by systemd socket activation.
+const ListenFDsStart = 3
+
+// ReplayStatusInterval is how often systemd is told how replay is progressing.  Its start
+// timeout is extended if ops were replayed since the last update, so long replays of big
+// logs aren't killed but stalled ones are.
+const ReplayStatusInterval = 5 * time.Second
+
+// activatedSocketT is a listening socket passed by systemd socket activation.
+type activatedSocketT struct {
+	name string // FileDescriptorName= of the socket unit, or its index if systemd gave none
+	file *os.File
+	used bool
+}
+
+var activatedSockets struct {
+	sync.Mutex
+	sockets []*activatedSocketT
+}
+
+// Takes the listening sockets passed by systemd socket activation, if any, so listeners
+// like "systemd:librarian.socket" can serve them.  The LISTEN_* variables are cleared so
+// processes started by the librarian don't take the sockets too.
+func initSocketActivation() error {
+	pidStr, fdsStr, namesStr := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fdsStr == "" {
+		return nil
+	}
+	if pid, err := strconv.Atoi(pidStr); err != nil || pid != os.Getpid() {
+		return nil // passed to another process
+	}
+	n, err := strconv.Atoi(fdsStr)
+	if err != nil || n < 0 {
+		return fmt.Errorf("bad LISTEN_FDS %q from systemd", fdsStr)
+	}
+	var names []string
+	if namesStr != "" {
+		names = strings.Split(namesStr, ":")
+	}
+
+	activatedSockets.Lock()
+	defer activatedSockets.Unlock()
+	for i := 0; i < n; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(ListenFDsStart+i), name)
+		activatedSockets.sockets = append(activatedSockets.sockets, &activatedSocketT{name: name, file: f})
+	}
+	log.Printf("Received %d sockets from systemd\n", n)
+	return nil
+}
+
+// Returns a listener for the first unused socket passed by systemd with the given name, or
+// index if the name is a number.  Sockets of a unit with several ListenStream= lines share
+// a name, so naming it again takes the next one.
+func activatedListener(name string) (net.Listener, error) {
+	activatedSockets.Lock()
+	defer activatedSockets.Unlock()
+
+	var socket *activatedSocketT
+	for _, s := range activatedSockets.sockets {
+		if s.name == name && !s.used {
+			socket = s
+			break
+		}
+	}
+	if socket == nil {
+		if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(activatedSockets.sockets) && !activatedSockets.sockets[i].used {
+			socket = activatedSockets.sockets[i]
+		}
+	}
+	if socket == nil {
+		return nil, fmt.Errorf("no unused socket named %q was passed by systemd socket activation", name)
+	}
+	socket.used = true
+	ln, err := net.FileListener(socket.file)
+	socket.file.Close() // the listener has its own copy
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on socket %q from systemd: %v", name, err)
+	}
+	return ln, nil
+}
+
+// Closes the sockets passed by systemd that no listener serves, logging a warning for each.
+func closeUnusedSockets() {
+	activatedSockets.Lock()
+	defer activatedSockets.Unlock()
+	for _, s := range activatedSockets.sockets {
+		if !s.used {
+			log.Printf("WARNING: socket %q from systemd isn't served by any -http or -adminhttp listener, so it was closed\n", s.name)
+			s.file.Close()
+			s.used = true
+		}
+	}
+}
+
+// Sends a state like "READY=1" to systemd if it started the librarian with Type=notify.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Sends a state to systemd, logging any error.
+func notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		log.Printf("ERROR: unable to notify systemd of %q: %v\n", state, err)
+	}
+}
+
+// Tells systemd how replay is progressing every ReplayStatusInterval, extending its start
+// timeout only if more ops were replayed.  Returns a function that stops the updates.
+func notifyReplay() func() {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return func() {}
+	}
+	last := int64(-1)
+	notify := func() {
+		n := replayProgress.Load()
+		if n == last {
+			notifySystemd(fmt.Sprintf("STATUS=Replaying librarian log: %d ops, no progress in %s", n, ReplayStatusInterval))
+			return
+		}
+		last = n
+		notifySystemd(fmt.Sprintf("STATUS=Replaying librarian log: %d ops\nEXTEND_TIMEOUT_USEC=%d",
+			n, (3 * ReplayStatusInterval).Microseconds()))
+	}
+	notify()
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(ReplayStatusInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				notify()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Tells systemd the librarian is serving requests and starts watchdog pings if systemd
+// asked for them with WatchdogSec=.  Nothing is sent if no listener could be started, so
+// systemd doesn't consider a librarian that can't serve to be up.
+func notifyReady(listening int) {
+	if os.Getenv("NOTIFY_SOCKET") == "" || listening == 0 {
+		return
+	}
+	notifySystemd(fmt.Sprintf("READY=1\nSTATUS=Serving on %d listeners", listening))
+	if interval := watchdogInterval(); interval > 0 {
+		log.Printf("Sending systemd watchdog pings every %s\n", interval/2)
+		go pingWatchdog(interval / 2)
+	}
+}
+
+// Returns the WatchdogSec= of the service, or 0 if systemd doesn't watch the librarian.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		if pid, err := strconv.Atoi(pidStr); err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Pings the systemd watchdog every interval while the library can be read, so a server
+// hung holding the library lock stops pinging and is restarted.
+func pingWatchdog(interval time.Duration) {
+	for range time.Tick(interval) {
+		library.RLock()
+		library.RUnlock()
+		notifySystemd("WATCHDOG=1")
+	}
+}
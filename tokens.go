@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// GuestTokenPrefix starts guest tokens so they're told apart from JWTs.
+	GuestTokenPrefix = "lgt_"
+
+	// MaxGuestTokenTTL is the longest a guest token can last.
+	MaxGuestTokenTTL = 30 * 24 * time.Hour
+
+	// guestTokensSuffix is appended to the librarian log name for the guest tokens file.
+	guestTokensSuffix = ".tokens"
+)
+
+// guestTokenT is a scoped, expiring bearer token minted by an admin, e.g., for an external
+// reviewer who shouldn't get full credentials.  Only the SHA-256 of its secret is kept.
+type guestTokenT struct {
+	ID        string
+	Key       string // SHA-256 of the secret
+	Client    string
+	UUIDs     []string
+	Labels    []uint64 `json:",omitempty"` // checkouts and checkins allowed; all if empty
+	ReadOnly  bool
+	Note      string `json:",omitempty"`
+	CreatedBy string
+	Created   time.Time
+	Expires   time.Time
+}
+
+type guestTokenRequestJSON struct {
+	Client   string   // guest client id, which defaults to "guest-{ID}"
+	UUIDs    []string // the only UUIDs the token can be used for
+	Labels   []uint64 // if not empty, the only labels that can be checked out or in
+	ReadOnly bool
+	TTL      string
+	Note     string
+}
+
+type guestTokenJSON struct {
+	ID        string
+	Token     string `json:",omitempty"` // only returned when minted
+	Client    string
+	UUIDs     []string
+	Labels    []uint64
+	ReadOnly  bool
+	Note      string `json:",omitempty"`
+	CreatedBy string
+	Created   time.Time
+	Expires   time.Time
+}
+
+// Guest tokens by Key, saved to a file beside the librarian log so they survive restarts.
+var guestTokens = struct {
+	sync.RWMutex
+	fname  string
+	tokens map[string]*guestTokenT
+}{
+	tokens: make(map[string]*guestTokenT),
+}
+
+func (gt *guestTokenT) toJSON() guestTokenJSON {
+	labels := gt.Labels
+	if labels == nil {
+		labels = []uint64{}
+	}
+	return guestTokenJSON{gt.ID, "", gt.Client, gt.UUIDs, labels, gt.ReadOnly, gt.Note, gt.CreatedBy, gt.Created, gt.Expires}
+}
+
+// Loads the guest tokens saved beside a librarian log, dropping any that have expired.
+func initGuestTokens(logfile string) error {
+	guestTokens.Lock()
+	defer guestTokens.Unlock()
+
+	guestTokens.fname = logfile + guestTokensSuffix
+	data, err := os.ReadFile(guestTokens.fname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []*guestTokenT
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("bad guest tokens file %q: %v", guestTokens.fname, err)
+	}
+	now := clock.Now()
+	for _, gt := range saved {
+		if now.Before(gt.Expires) {
+			guestTokens.tokens[gt.Key] = gt
+		}
+	}
+	if len(saved) > len(guestTokens.tokens) {
+		saveGuestTokens()
+	}
+	return nil
+}
+
+// Writes the guest tokens to their file.  Must be called with guestTokens locked.
+func saveGuestTokens() {
+	if guestTokens.fname == "" {
+		return
+	}
+	saved := make([]*guestTokenT, 0, len(guestTokens.tokens))
+	for _, gt := range guestTokens.tokens {
+		saved = append(saved, gt)
+	}
+	data, err := json.Marshal(saved)
+	if err == nil {
+		tmpname := guestTokens.fname + ".tmp"
+		if err = os.WriteFile(tmpname, data, 0600); err == nil {
+			err = os.Rename(tmpname, guestTokens.fname)
+		}
+	}
+	if err != nil {
+		log.Printf("ERROR: unable to save guest tokens to %q: %v\n", guestTokens.fname, err)
+	}
+}
+
+// Mints a guest token, returning it with its secret, which isn't kept.
+func mintGuestToken(req guestTokenRequestJSON, createdBy string) (guestTokenJSON, error) {
+	if len(req.UUIDs) == 0 {
+		return guestTokenJSON{}, fmt.Errorf("guest token needs at least one uuid in UUIDs")
+	}
+	for _, uuid := range req.UUIDs {
+		if uuid == "" || strings.ContainsAny(uuid, "/ ") {
+			return guestTokenJSON{}, fmt.Errorf("bad uuid %q in UUIDs", uuid)
+		}
+	}
+	if req.ReadOnly && len(req.Labels) > 0 {
+		return guestTokenJSON{}, fmt.Errorf("a read-only guest token can't give Labels to check out")
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 || ttl > MaxGuestTokenTTL {
+		return guestTokenJSON{}, fmt.Errorf("bad TTL %q: must be positive and at most %s", req.TTL, MaxGuestTokenTTL)
+	}
+	secret, key, err := newSecret()
+	if err != nil {
+		return guestTokenJSON{}, err
+	}
+	gt := &guestTokenT{
+		ID:        key[:12],
+		Key:       key,
+		UUIDs:     req.UUIDs,
+		Labels:    req.Labels,
+		ReadOnly:  req.ReadOnly,
+		Note:      req.Note,
+		CreatedBy: createdBy,
+		Created:   clock.Now(),
+	}
+	gt.Expires = gt.Created.Add(ttl)
+	if req.Client == "" {
+		gt.Client = "guest-" + gt.ID
+	} else if gt.Client, err = checkClientID(req.Client); err != nil {
+		return guestTokenJSON{}, err
+	}
+
+	guestTokens.Lock()
+	guestTokens.tokens[key] = gt
+	saveGuestTokens()
+	guestTokens.Unlock()
+
+	log.Printf("Guest token %s minted by %s for %s on uuids %s until %s\n", gt.ID, createdBy, gt.Client, strings.Join(gt.UUIDs, ","), gt.Expires.Format(time.RFC3339))
+	tokenJSON := gt.toJSON()
+	tokenJSON.Token = GuestTokenPrefix + secret
+	return tokenJSON, nil
+}
+
+// Returns the unexpired guest tokens sorted by expiration.
+func getGuestTokens() []guestTokenJSON {
+	now := clock.Now()
+	guestTokens.RLock()
+	defer guestTokens.RUnlock()
+
+	tokens := make([]guestTokenJSON, 0, len(guestTokens.tokens))
+	for _, gt := range guestTokens.tokens {
+		if now.Before(gt.Expires) {
+			tokens = append(tokens, gt.toJSON())
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Expires.Before(tokens[j].Expires) })
+	return tokens
+}
+
+// Revokes a guest token by its id.
+func revokeGuestToken(id, clientid string) error {
+	guestTokens.Lock()
+	defer guestTokens.Unlock()
+
+	for key, gt := range guestTokens.tokens {
+		if gt.ID == id {
+			delete(guestTokens.tokens, key)
+			saveGuestTokens()
+			log.Printf("Guest token %s for %s revoked by %s\n", id, gt.Client, clientid)
+			return nil
+		}
+	}
+	return fmt.Errorf("no guest token %q", id)
+}
+
+// Revokes guest tokens that have expired.
+func expireGuestTokens() {
+	now := clock.Now()
+	guestTokens.Lock()
+	defer guestTokens.Unlock()
+
+	expired := 0
+	for key, gt := range guestTokens.tokens {
+		if !now.Before(gt.Expires) {
+			delete(guestTokens.tokens, key)
+			log.Printf("Guest token %s for %s expired\n", gt.ID, gt.Client)
+			expired++
+		}
+	}
+	if expired > 0 {
+		saveGuestTokens()
+	}
+}
+
+// Returns the unexpired guest token with the given secret.
+func lookupGuestToken(token string) (*guestTokenT, bool) {
+	key := secretKey(strings.TrimPrefix(token, GuestTokenPrefix))
+	guestTokens.RLock()
+	defer guestTokens.RUnlock()
+
+	gt, found := guestTokens.tokens[key]
+	if !found || !clock.Now().Before(gt.Expires) {
+		return nil, false
+	}
+	return gt, true
+}
+
+// Returns an error if a request is outside a guest token's scope.  Guests may only read
+// paths of their UUIDs, e.g., /state/{UUID}, and unless read-only, check out and check in
+// their labels with PUT /checkout/{UUID}/{label}/{client} and /checkin.
+func (gt *guestTokenT) authorize(r *http.Request) error {
+	uuid := envelopeUUID(r.URL.Path)
+	allowed := false
+	for _, u := range gt.UUIDs {
+		allowed = allowed || u == uuid
+	}
+	if !allowed {
+		return fmt.Errorf("guest token %s is only for uuids %s", gt.ID, strings.Join(gt.UUIDs, ", "))
+	}
+	if requiredRole(r) <= ReaderRole {
+		return nil
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if gt.ReadOnly || r.Method != "PUT" || len(parts) != 4 || (parts[0] != "checkout" && parts[0] != "checkin") {
+		return fmt.Errorf("guest token %s may only check out and check in labels with PUT /checkout and /checkin", gt.ID)
+	}
+	if len(gt.Labels) == 0 {
+		return nil
+	}
+	label, err := parseLabel(uuid, parts[2])
+	if err != nil {
+		return err
+	}
+	for _, l := range gt.Labels {
+		if l == label {
+			return nil
+		}
+	}
+	return fmt.Errorf("guest token %s may not check out or check in label %d", gt.ID, label)
+}
+
+// Returns the principal of a request's guest token, or writes an error response and
+// returns nil if the token is unknown, expired, or doesn't cover the request.
+func guestPrincipal(w http.ResponseWriter, r *http.Request, token string) *Principal {
+	gt, found := lookupGuestToken(token)
+	if !found {
+		log.Printf("ERROR: rejected guest token for %s\n", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="librarian", error="invalid_token"`)
+		writeError(w, http.StatusUnauthorized, "invalid token: guest token is unknown, revoked, or expired")
+		return nil
+	}
+	if err := gt.authorize(r); err != nil {
+		Forbidden(w, r, "%v", err)
+		return nil
+	}
+	role := WriterRole
+	if gt.ReadOnly {
+		role = ReaderRole
+	}
+	return &Principal{Client: gt.Client, Role: role}
+}
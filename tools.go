@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ToolVersionHeader is an optional request header giving the client tool and version,
+// e.g., "NeuTu 2019.02.13".
+const ToolVersionHeader = "X-Tool-Version"
+
+type toolKey struct {
+	agent   string
+	version string
+}
+
+// toolT records use of a particular user agent and tool version by a client.
+type toolT struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	ops       int
+}
+
+type toolJSON struct {
+	Agent     string
+	Tool      string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Ops       int
+}
+
+// Returns the op attributes describing the tool making a request, its op id and external
+// reference if given, and, with -audit, who made it.
+func requestAttrs(r *http.Request) map[string]string {
+	attrs := make(map[string]string)
+	if agent := r.Header.Get("User-Agent"); agent != "" {
+		attrs["agent"] = agent
+	}
+	if tool := r.Header.Get(ToolVersionHeader); tool != "" {
+		attrs["tool"] = tool
+	}
+	if opID := r.Header.Get(OpIDHeader); opID != "" {
+		attrs["opid"] = opID
+	}
+	if ref := r.Header.Get(OpRefHeader); ref != "" {
+		attrs["ref"] = ref
+	}
+	addAuditAttrs(r, attrs)
+	return attrs
+}
+
+// Records a client's use of the tool given in op attributes.  Must be called with
+// library lock held.
+func (lib *libraryT) noteTool(clientid string, attrs map[string]string, t time.Time) {
+	key := toolKey{attrs["agent"], attrs["tool"]}
+	if clientid == "n/a" || (key.agent == "" && key.version == "") {
+		return
+	}
+	tools, found := lib.tools[clientid]
+	if !found {
+		tools = make(map[toolKey]*toolT)
+		lib.tools[clientid] = tools
+	}
+	tool, found := tools[key]
+	if !found {
+		tool = &toolT{firstSeen: t}
+		tools[key] = tool
+	}
+	if t.After(tool.lastSeen) {
+		tool.lastSeen = t
+	}
+	tool.ops++
+}
+
+type clientToolsJSON struct {
+	Client string
+	Tools  []toolJSON
+}
+
+// Returns the tools used by a client, most recently used first.
+func getClientTools(clientid string) clientToolsJSON {
+	library.RLock()
+	tools := make([]toolJSON, 0, len(library.tools[clientid]))
+	for key, tool := range library.tools[clientid] {
+		tools = append(tools, toolJSON{key.agent, key.version, tool.firstSeen, tool.lastSeen, tool.ops})
+	}
+	library.RUnlock()
+
+	sort.Slice(tools, func(i, j int) bool { return tools[i].LastSeen.After(tools[j].LastSeen) })
+	return clientToolsJSON{clientid, tools}
+}
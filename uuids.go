@@ -0,0 +1,193 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Orders of UUIDs in GET /uuids?detail=true.
+const (
+	SortUUIDsByUUID      = "uuid"
+	SortUUIDsByCheckouts = "checkouts"
+	SortUUIDsByClients   = "clients"
+	SortUUIDsByAge       = "age"
+	SortUUIDsByActivity  = "activity"
+	SortUUIDsByBranch    = "branch" // DVID repo, then branch, then version from root to tips
+)
+
+// uuidDetailJSON summarizes the checkouts and activity of a UUID.
+type uuidDetailJSON struct {
+	UUID                 string
+	Checkouts            int
+	Clients              int           // distinct clients with checkouts
+	OldestLockAgeSeconds float64       // 0 if there are no checkouts
+	LastActivity         *time.Time    `json:",omitempty"` // omitted if unknown, e.g., after compaction
+	DVID                 *uuidDVIDJSON `json:",omitempty"` // omitted if not found in the -dvid repos
+}
+
+// uuidDVIDJSON places a UUID in the version tree of its DVID repo.
+type uuidDVIDJSON struct {
+	Repo      string // root UUID of the DVID repo
+	RepoAlias string `json:",omitempty"`
+	Node      string // full UUID of the DVID node, which the UUID can abbreviate
+	Version   uint32 // DVID version id, which increases from the root to the tips
+	Branch    string
+	Committed bool
+	Parents   []string // full UUIDs of the parent nodes
+	Children  []string
+}
+
+// uuidBranchJSON lists the UUIDs of a page on one branch of a DVID repo, root first.
+type uuidBranchJSON struct {
+	Repo   string
+	Branch string
+	UUIDs  []string
+}
+
+// uuidsDetailJSON is a page of UUID summaries out of Total UUIDs.
+type uuidsDetailJSON struct {
+	Total    int
+	Offset   int
+	UUIDs    []uuidDetailJSON
+	Branches []uuidBranchJSON `json:",omitempty"` // UUIDs of the page grouped by DVID branch
+}
+
+// Returns a page of summaries of UUIDs with checkouts, and those with only history if
+// historical, in the given order.  Ties are broken by UUID.
+func getUUIDsDetail(historical bool, sortBy string, offset, limit int) uuidsDetailJSON {
+	now := clock.Now()
+
+	library.RLock()
+	details := make([]uuidDetailJSON, 0, len(library.vchk))
+	for uuid := range library.revs {
+		checkouts := library.vchk[uuid]
+		if len(checkouts) == 0 && !historical {
+			continue
+		}
+		detail := uuidDetailJSON{UUID: uuid, Checkouts: len(checkouts)}
+		var last time.Time
+		clients := make(map[string]bool)
+		for _, co := range checkouts {
+			clients[co.client] = true
+			if age := now.Sub(co.t).Seconds(); age > detail.OldestLockAgeSeconds {
+				detail.OldestLockAgeSeconds = age
+			}
+			if co.t.After(last) {
+				last = co.t
+			}
+		}
+		detail.Clients = len(clients)
+		if ro, found := library.recent[uuid]; found && len(ro.ops) > 0 {
+			if t := ro.last(1)[0].t; t.After(last) {
+				last = t
+			}
+		}
+		if !last.IsZero() {
+			detail.LastActivity = &last
+		}
+		details = append(details, detail)
+	}
+	library.RUnlock()
+
+	if *dvidServer != "" {
+		uuids := make([]string, len(details))
+		for i, detail := range details {
+			uuids[i] = detail.UUID
+		}
+		placed := getDVIDPlacements(uuids)
+		for i := range details {
+			details[i].DVID = placed[details[i].UUID]
+		}
+	}
+	return pageUUIDDetails(details, sortBy, offset, limit)
+}
+
+// Returns true if the first UUID comes before the second in its DVID repo's version tree,
+// with UUIDs not in DVID last.  Returns false for ties.
+func dvidBefore(pi, pj *uuidDVIDJSON) bool {
+	switch {
+	case pi == nil || pj == nil:
+		return pi != nil && pj == nil
+	case pi.Repo != pj.Repo:
+		return pi.Repo < pj.Repo
+	case pi.Branch != pj.Branch:
+		return pi.Branch < pj.Branch
+	}
+	return pi.Version < pj.Version
+}
+
+// Sorts UUID summaries in the given order and returns a page of them.
+func pageUUIDDetails(details []uuidDetailJSON, sortBy string, offset, limit int) uuidsDetailJSON {
+	sort.Slice(details, func(i, j int) bool {
+		di, dj := details[i], details[j]
+		switch sortBy {
+		case SortUUIDsByCheckouts:
+			if di.Checkouts != dj.Checkouts {
+				return di.Checkouts > dj.Checkouts
+			}
+		case SortUUIDsByClients:
+			if di.Clients != dj.Clients {
+				return di.Clients > dj.Clients
+			}
+		case SortUUIDsByAge:
+			if di.OldestLockAgeSeconds != dj.OldestLockAgeSeconds {
+				return di.OldestLockAgeSeconds > dj.OldestLockAgeSeconds
+			}
+		case SortUUIDsByBranch:
+			if dvidBefore(di.DVID, dj.DVID) {
+				return true
+			}
+			if dvidBefore(dj.DVID, di.DVID) {
+				return false
+			}
+		case SortUUIDsByActivity:
+			ti, tj := di.LastActivity, dj.LastActivity
+			switch {
+			case ti != nil && tj != nil && !ti.Equal(*tj):
+				return ti.After(*tj)
+			case ti != nil && tj == nil:
+				return true
+			case ti == nil && tj != nil:
+				return false
+			}
+		}
+		return di.UUID < dj.UUID
+	})
+
+	page := uuidsDetailJSON{Total: len(details), Offset: offset}
+	if offset > len(details) {
+		offset = len(details)
+	}
+	details = details[offset:]
+	if limit > 0 && limit < len(details) {
+		details = details[:limit]
+	}
+	page.UUIDs = details
+	page.Branches = groupUUIDBranches(details)
+	return page
+}
+
+// Groups UUIDs found in DVID by repo and branch, each root first.  Returns nil if none were
+// found.
+func groupUUIDBranches(details []uuidDetailJSON) []uuidBranchJSON {
+	var placed []uuidDetailJSON
+	for _, detail := range details {
+		if detail.DVID != nil {
+			placed = append(placed, detail)
+		}
+	}
+	if len(placed) == 0 {
+		return nil
+	}
+	sort.SliceStable(placed, func(i, j int) bool { return dvidBefore(placed[i].DVID, placed[j].DVID) })
+
+	var branches []uuidBranchJSON
+	for _, detail := range placed {
+		p := detail.DVID
+		if n := len(branches); n == 0 || branches[n-1].Repo != p.Repo || branches[n-1].Branch != p.Branch {
+			branches = append(branches, uuidBranchJSON{Repo: p.Repo, Branch: p.Branch})
+		}
+		branches[len(branches)-1].UUIDs = append(branches[len(branches)-1].UUIDs, detail.UUID)
+	}
+	return branches
+}
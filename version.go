@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Build information set at link time, e.g.,
+//
+//	go build -ldflags "-X main.Version=v0.4.0 -X main.GitCommit=$(git rev-parse HEAD) -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// See the Makefile.  Without them, the commit and date come from the Go build info if present.
+var (
+	Version   = "dev"
+	GitCommit = ""
+	BuildDate = ""
+)
+
+// LatestReleaseURL is the GitHub API URL for the latest librarian release.
+const LatestReleaseURL = "https://api.github.com/repos/janelia-flyem/librarian/releases/latest"
+
+type versionJSON struct {
+	Version   string
+	Commit    string `json:",omitempty"`
+	GoVersion string
+	BuildDate string `json:",omitempty"`
+}
+
+func getVersion() versionJSON {
+	v := versionJSON{Version, GitCommit, runtime.Version(), BuildDate}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && v.Commit == "":
+				v.Commit = setting.Value
+			case setting.Key == "vcs.time" && v.BuildDate == "":
+				v.BuildDate = setting.Value
+			}
+		}
+	}
+	return v
+}
+
+// Parses a semantic version like "v1.2.3" or "1.2.3-rc1" into its major, minor, and
+// patch numbers.  Any pre-release or build suffix is ignored.
+func parseSemver(s string) (nums [3]int, ok bool) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return nums, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nums, false
+		}
+		nums[i] = n
+	}
+	return nums, true
+}
+
+// Returns true if semantic version a is older than b.
+func olderVersion(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// Logs a notice if a newer librarian release than this build is available.
+func checkForUpdate() {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(LatestReleaseURL)
+	if err != nil {
+		log.Printf("WARNING: unable to check for librarian update: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("WARNING: unable to check for librarian update: bad status %d from %s\n", resp.StatusCode, LatestReleaseURL)
+		return
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		log.Printf("WARNING: unable to check for librarian update: %v\n", err)
+		return
+	}
+	latest, ok := parseSemver(release.TagName)
+	if !ok {
+		log.Printf("WARNING: latest librarian release has unknown version %q\n", release.TagName)
+		return
+	}
+	current, ok := parseSemver(Version)
+	switch {
+	case !ok:
+		log.Printf("Running librarian %s build; latest release is %s (%s)\n", Version, release.TagName, release.HTMLURL)
+	case olderVersion(current, latest):
+		log.Printf("NOTICE: librarian %s is available, this is %s.  See %s\n", release.TagName, Version, release.HTMLURL)
+	default:
+		log.Printf("Librarian %s is the latest release\n", Version)
+	}
+}
+
+func versionString() string {
+	v := getVersion()
+	s := fmt.Sprintf("librarian %s (%s)", v.Version, v.GoVersion)
+	if v.Commit != "" {
+		s += " commit " + v.Commit
+	}
+	if v.BuildDate != "" {
+		s += " built " + v.BuildDate
+	}
+	return s
+}
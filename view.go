@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// uuidViewT is an immutable copy of a uuid's checkouts, pins, and label names that GET
+// handlers read without taking the library lock, so heavy polling of /state doesn't hold up
+// checkouts.
+type uuidViewT struct {
+	labels  []uint64 // checked out labels in order
+	holders map[uint64]viewCheckoutT
+	pins    map[uint64]pinT
+	names   map[uint64]string // display names of labels, if any
+	format  string            // label output format of the uuid's policy
+	known   bool              // true if the uuid has any history
+}
+
+type viewCheckoutT struct {
+	client string
+	t      time.Time
+}
+
+// Current views by uuid.  A uuid's view is dropped whenever an op changes it and rebuilt by
+// the next read.
+var views sync.Map // uuid -> *uuidViewT
+
+var emptyView = &uuidViewT{}
+
+// Drops the view of a uuid after a change.  Must be called with library lock held.
+func invalidateView(uuid string) {
+	views.Delete(uuid)
+}
+
+// Drops all views.  Must be called with library lock held.
+func invalidateViews() {
+	views.Range(func(uuid, _ interface{}) bool {
+		views.Delete(uuid)
+		return true
+	})
+}
+
+// Returns the current view of a uuid, building it if it changed since it was last read.
+func getView(uuid string) *uuidViewT {
+	if view, found := views.Load(uuid); found {
+		return view.(*uuidViewT)
+	}
+
+	// The view is stored before the read lock is released, so it can't miss a change.
+	library.RLock()
+	defer library.RUnlock()
+	if library.revs[uuid] == 0 {
+		return emptyView // not stored so mistyped uuids don't pile up
+	}
+	checkouts := library.vchk[uuid]
+	view := &uuidViewT{
+		labels:  make([]uint64, 0, len(checkouts)),
+		holders: make(map[uint64]viewCheckoutT, len(checkouts)),
+		pins:    make(map[uint64]pinT, len(library.pins[uuid])),
+		names:   library.labelNames(uuid),
+		format:  library.policies[uuid].labelOutput(),
+		known:   true,
+	}
+	for label, co := range checkouts {
+		view.labels = append(view.labels, label)
+		view.holders[label] = viewCheckoutT{co.client, co.t}
+	}
+	sort.Slice(view.labels, func(i, j int) bool { return view.labels[i] < view.labels[j] })
+	for label, pin := range library.pins[uuid] {
+		view.pins[label] = pin
+	}
+	views.Store(uuid, view)
+	return view
+}
+
+// Returns the checkouts in a view in the given order, like sortedCheckouts.
+func viewCheckouts(view *uuidViewT, sortBy string) []reserveJSON {
+	checkouts := make([]reserveJSON, len(view.labels))
+	for i, label := range view.labels {
+		checkouts[i] = reserveJSON{Label: labelJSON{label, view.format}, Client: view.holders[label].client, Name: view.names[label]}
+	}
+	switch sortBy {
+	case SortByClient:
+		sort.SliceStable(checkouts, func(i, j int) bool { return checkouts[i].Client < checkouts[j].Client })
+	case SortByAge:
+		sort.SliceStable(checkouts, func(i, j int) bool {
+			return view.holders[checkouts[i].Label.label].t.Before(view.holders[checkouts[j].Label.label].t)
+		})
+	}
+	return checkouts
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchCheckouts is the number of labels held while benchmarking checkouts.
+const BenchCheckouts = 1000
+
+// Checks out and in a label of a uuid with BenchCheckouts other labels checked out while
+// pollers read the uuid's checkouts as fast as they can, reporting the p99 latency of the
+// checkouts.  With locked polling, the pollers read under the library read lock as GET
+// /state and /checkout did before views, for comparison.
+func BenchmarkCheckoutWhilePolling(b *testing.B) {
+	b.Run("views", func(b *testing.B) {
+		benchmarkCheckoutWhilePolling(b, func(uuid string, label uint64) {
+			getCheckout(uuid, label)
+			sortedCheckouts(uuid, SortByLabel, false)
+		})
+	})
+	b.Run("locked", func(b *testing.B) {
+		benchmarkCheckoutWhilePolling(b, func(uuid string, label uint64) {
+			library.RLock()
+			_ = library.vchk[uuid][label].client
+			labels := make([]uint64, 0, len(library.vchk[uuid]))
+			for l := range library.vchk[uuid] {
+				labels = append(labels, l)
+			}
+			library.RUnlock()
+			sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+		})
+	})
+}
+
+func benchmarkCheckoutWhilePolling(b *testing.B, poll func(uuid string, label uint64)) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	if err := initLibrary(filepath.Join(b.TempDir(), "librarian.log")); err != nil {
+		b.Fatal(err)
+	}
+	defer library.f.Close()
+
+	const uuid = "bench"
+	for label := uint64(1); label <= BenchCheckouts; label++ {
+		if _, err := checkout(uuid, label, "client"+strconv.FormatUint(label%10, 10), nil, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					poll(uuid, BenchCheckouts+1)
+				}
+			}
+		}()
+	}
+
+	latencies := make([]time.Duration, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		if _, err := checkout(uuid, BenchCheckouts+1, "writer", nil, true); err != nil {
+			b.Fatal(err)
+		}
+		if err := checkin(uuid, BenchCheckouts+1, "writer", nil, true); err != nil {
+			b.Fatal(err)
+		}
+		latencies[i] = time.Since(start)
+	}
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns/op")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxCheckoutBlock is the longest a checkout can wait for a label held by another client.
+const MaxCheckoutBlock = 5 * time.Minute
+
+// DeadlockCheckInterval is how often a blocked checkout checks whether it's deadlocked, in
+// case the holders of the labels it waits for have changed.
+const DeadlockCheckInterval = time.Second
+
+// DeadlockCode is the error code of a blocked checkout refused because it would wait
+// forever for a client that waits for it.
+const DeadlockCode = "DEADLOCK"
+
+type waitKey struct {
+	uuid  string
+	label uint64
+}
+
+// waiterT is a blocked checkout, woken when the label may have been released.
+type waiterT struct {
+	client string
+	wake   chan struct{}
+}
+
+// Blocked checkouts of each label in the order they arrived.  Only the first waiter is
+// woken when a label is released, so waiters get the label in turn.  Waitlists are only
+// kept in memory: each waiter is an open request, which a restart closes anyway.
+var waitlists = struct {
+	sync.Mutex
+	waiting map[waitKey][]*waiterT
+}{waiting: make(map[waitKey][]*waiterT)}
+
+func (wt *waiterT) notify() {
+	select {
+	case wt.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deadlockError is returned for a blocked checkout of a label whose holder waits, directly
+// or through other clients, for a label held by the client checking out.
+type deadlockError struct {
+	uuid   string
+	label  uint64
+	holder string
+	cycle  []string // clients waiting for each other, starting with the holder
+}
+
+func (e *deadlockError) Error() string {
+	return fmt.Sprintf("uuid %s, label %d - held by %s, so waiting would deadlock: clients %s would wait for each other",
+		e.uuid, e.label, e.holder, strings.Join(e.cycle, ", "))
+}
+
+// Returns the clients holding the labels a client waits for.  Must be called with library
+// lock and waitlists locked.
+func waitsFor(clientid string) []string {
+	var holders []string
+	for key, waiters := range waitlists.waiting {
+		for _, wt := range waiters {
+			if wt.client != clientid {
+				continue
+			}
+			if co, found := library.vchk[key.uuid][key.label]; found {
+				holders = append(holders, co.client)
+			}
+			break
+		}
+	}
+	return holders
+}
+
+// Returns a *deadlockError if a client waiting for a label would wait for itself through
+// the wait-for graph of blocked checkouts, i.e., the label's holder waits, directly or
+// through other clients, for a label the client holds.  Must be called with library lock
+// and waitlists locked.
+func findDeadlock(key waitKey, clientid string) error {
+	co, found := library.vchk[key.uuid][key.label]
+	if !found || co.client == clientid {
+		return nil
+	}
+	// Breadth-first search of the wait-for graph, remembering how each client was reached.
+	from := map[string]string{co.client: ""}
+	queue := []string{co.client}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, holder := range waitsFor(cur) {
+			if holder == clientid {
+				var cycle []string
+				for c := cur; c != ""; c = from[c] {
+					cycle = append([]string{c}, cycle...)
+				}
+				return &deadlockError{key.uuid, key.label, co.client, append(cycle, clientid)}
+			}
+			if _, seen := from[holder]; !seen {
+				from[holder] = cur
+				queue = append(queue, holder)
+			}
+		}
+	}
+	return nil
+}
+
+// Adds a blocked checkout to the waitlist of a label unless it would deadlock.
+func joinWaitlist(key waitKey, clientid string) (*waiterT, error) {
+	library.RLock()
+	defer library.RUnlock()
+	waitlists.Lock()
+	defer waitlists.Unlock()
+
+	if err := findDeadlock(key, clientid); err != nil {
+		return nil, err
+	}
+	wt := &waiterT{client: clientid, wake: make(chan struct{}, 1)}
+	waitlists.waiting[key] = append(waitlists.waiting[key], wt)
+	return wt, nil
+}
+
+// Removes a waiter from the waitlist of a label if it's now deadlocked, e.g., because the
+// label changed hands, and returns the *deadlockError.  Checking and removing together
+// means only one of the deadlocked checkouts fails.
+func checkDeadlock(key waitKey, wt *waiterT) error {
+	library.RLock()
+	defer library.RUnlock()
+	waitlists.Lock()
+	defer waitlists.Unlock()
+
+	err := findDeadlock(key, wt.client)
+	if err != nil {
+		removeWaiter(key, wt)
+	}
+	return err
+}
+
+// Removes a waiter and, if it was first, wakes the next one in case the label is free.
+func leaveWaitlist(key waitKey, wt *waiterT) {
+	waitlists.Lock()
+	defer waitlists.Unlock()
+	removeWaiter(key, wt)
+}
+
+// Removes a waiter if it's still waiting, waking the next one if it was first.  Must be
+// called with waitlists locked.
+func removeWaiter(key waitKey, wt *waiterT) {
+	waiters := waitlists.waiting[key]
+	for i, other := range waiters {
+		if other != wt {
+			continue
+		}
+		waiters = append(waiters[:i], waiters[i+1:]...)
+		if i == 0 && len(waiters) > 0 {
+			waiters[0].notify()
+		}
+		break
+	}
+	if len(waiters) == 0 {
+		delete(waitlists.waiting, key)
+	} else {
+		waitlists.waiting[key] = waiters
+	}
+}
+
+// Wakes the first waiter for each label an op may have released.  Must be called with
+// library lock held.
+func wakeWaiters(op *libraryOp) {
+	var labels []uint64
+	switch op.op {
+	case CheckinOp, ExpireOp, UnpinOp:
+		labels = []uint64{op.label}
+	case LabelResetOp:
+		labels = op.resetLabels()
+	case ResetOp, CommitResetOp:
+		// all labels of the uuid
+	default:
+		return
+	}
+
+	waitlists.Lock()
+	defer waitlists.Unlock()
+	if labels == nil {
+		for key, waiters := range waitlists.waiting {
+			if key.uuid == op.uuid {
+				waiters[0].notify()
+			}
+		}
+		return
+	}
+	for _, label := range labels {
+		if waiters, found := waitlists.waiting[waitKey{op.uuid, label}]; found {
+			waiters[0].notify()
+		}
+	}
+}
+
+// Checks out a label along with any metadata, waiting up to block for another client to
+// release it.  Returns the label checked out and the last conflict if the label is still
+// held when the wait ends or ctx is done, or a *deadlockError if the holder waits for the
+// client, e.g., each holds a label the other is blocked on.
+func blockingCheckout(ctx context.Context, req *checkoutReqT, block time.Duration) (uint64, bool, error) {
+	label, held, err := requestCheckout(req)
+	var conflict *ErrAlreadyCheckedOut
+	if block <= 0 || !errors.As(err, &conflict) {
+		return label, held, err
+	}
+
+	key := waitKey{conflict.UUID, conflict.Label}
+	wt, deadlock := joinWaitlist(key, req.client)
+	if deadlock != nil {
+		return label, false, deadlock
+	}
+	defer leaveWaitlist(key, wt)
+	timeout := time.NewTimer(block)
+	defer timeout.Stop()
+	ticker := time.NewTicker(DeadlockCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wt.wake:
+		case <-ticker.C:
+			if deadlock := checkDeadlock(key, wt); deadlock != nil {
+				return label, false, deadlock
+			}
+			continue
+		case <-timeout.C:
+			return label, false, err
+		case <-ctx.Done():
+			return label, false, err
+		}
+		if label, held, err = requestCheckout(req); !errors.As(err, &conflict) {
+			return label, held, err
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Commands a client can send over its WebSocket at /ws/{Client}.
+const (
+	WebSocketCheckout = "checkout"
+	WebSocketCheckin  = "checkin"
+)
+
+// Types of messages sent over a WebSocket.
+const (
+	WebSocketAck   = "ack"   // result of a command
+	WebSocketEvent = "event" // same events as /events/{Client}
+)
+
+// GUID appended to a client's key to accept a WebSocket handshake (RFC 6455).
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WebSocket close status codes.
+const (
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooBig      = 1009
+)
+
+// wsCommandJSON is a command sent by a client, which has the same fields as the PUT
+// /checkout and /checkin JSON request bodies.  A missing client is the connection's client.
+type wsCommandJSON struct {
+	ID      json.RawMessage // echoed in the ack
+	Op      string          // WebSocketCheckout or WebSocketCheckin
+	Resolve bool            // same as resolve=true
+	opBodyJSON
+}
+
+// wsMessageJSON is an ack or event sent to a client.
+type wsMessageJSON struct {
+	Type     string
+	ID       json.RawMessage `json:",omitempty"` // ID of the acked command
+	Status   int             `json:",omitempty"` // HTTP status the command would have returned
+	Response json.RawMessage `json:",omitempty"` // JSON the command would have returned, if not "{}"
+	Event    *eventJSON      `json:",omitempty"`
+}
+
+// wsConn is a server-side WebSocket connection.  Frames are written under a mutex so acks
+// and events can be sent from different goroutines.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex
+}
+
+// Completes a WebSocket handshake and takes over the connection.  Returns nil if the
+// handshake failed.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) *wsConn {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		BadRequest(w, r, "not a WebSocket handshake")
+		return nil
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		errorMsg := fmt.Sprintf("unsupported WebSocket version %q (%s).", r.Header.Get("Sec-WebSocket-Version"), r.URL.Path)
+		log.Printf("ERROR: %s\n", errorMsg)
+		writeError(w, http.StatusUpgradeRequired, errorMsg)
+		return nil
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		BadRequest(w, r, "WebSocket handshake has no Sec-WebSocket-Key")
+		return nil
+	}
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	w.Header().Set("Upgrade", "websocket")
+	w.Header().Set("Connection", "Upgrade")
+	w.Header().Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sum[:]))
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("ERROR: unable to take over connection for WebSocket (%s): %v\n", r.URL.Path, err)
+		return nil
+	}
+
+	// The server's read and write timeouts still apply to the hijacked connection.
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, r: brw.Reader}
+}
+
+// Returns true if a comma-separated header includes a token, ignoring case.
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ws *wsConn) setWriteDeadline() {
+	if *writeTimeout > 0 {
+		ws.conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	}
+}
+
+// Writes a single unmasked frame.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	ws.setWriteDeadline()
+	if _, err := ws.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ws *wsConn) writeJSON(v interface{}) error {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(wsText, jsonBytes)
+}
+
+// Sends a close frame with a status code and reason.
+func (ws *wsConn) close(code int, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	ws.writeFrame(wsClose, append(payload, reason...))
+}
+
+// errWebSocketClosed is returned by readMessage when the client closes the connection.
+var errWebSocketClosed = errors.New("WebSocket closed by client")
+
+// Reads the next text message, answering pings along the way.  Protocol errors close the
+// connection with the appropriate status.
+func (ws *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		// Clients must answer the pings sent every EventHeartbeat.
+		ws.conn.SetReadDeadline(time.Now().Add(2 * EventHeartbeat))
+		var header [2]byte
+		if _, err := io.ReadFull(ws.r, header[:]); err != nil {
+			return nil, err
+		}
+		fin, opcode := header[0]&0x80 != 0, header[0]&0x0f
+		if header[1]&0x80 == 0 {
+			ws.close(wsCloseProtocol, "client frames must be masked")
+			return nil, fmt.Errorf("unmasked WebSocket frame")
+		}
+		n := uint64(header[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n > MaxOpBodySize-uint64(len(msg)) {
+			ws.close(wsCloseTooBig, fmt.Sprintf("messages must be at most %d bytes", MaxOpBodySize))
+			return nil, fmt.Errorf("WebSocket message over %d bytes", MaxOpBodySize)
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(ws.r, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			ws.close(wsCloseNormal, "")
+			return nil, errWebSocketClosed
+		case wsText, wsContinuation:
+			if (opcode == wsText) != (msg == nil) {
+				ws.close(wsCloseProtocol, "bad message fragmentation")
+				return nil, fmt.Errorf("bad WebSocket message fragmentation")
+			}
+			if msg == nil {
+				msg = make([]byte, 0, len(payload))
+			}
+			msg = append(msg, payload...)
+			if fin {
+				return msg, nil
+			}
+		case wsBinary:
+			ws.close(wsCloseUnsupported, "commands must be JSON text messages")
+			return nil, fmt.Errorf("binary WebSocket message")
+		default:
+			ws.close(wsCloseProtocol, fmt.Sprintf("unknown opcode %d", opcode))
+			return nil, fmt.Errorf("unknown WebSocket opcode %d", opcode)
+		}
+	}
+}
+
+// wsResponse collects the response a handler writes for a WebSocket command.
+type wsResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (resp *wsResponse) Header() http.Header {
+	return resp.header
+}
+
+func (resp *wsResponse) WriteHeader(status int) {
+	if resp.status == 0 {
+		resp.status = status
+	}
+}
+
+func (resp *wsResponse) Write(p []byte) (int, error) {
+	resp.WriteHeader(http.StatusOK)
+	return resp.body.Write(p)
+}
+
+// Runs a command through the handler of the equivalent PUT request, so it gets the same
+// checks, logging, and responses.
+func runWebSocketCommand(c web.C, r *http.Request, client string, msg []byte) wsMessageJSON {
+	resp := &wsResponse{header: make(http.Header)}
+	var cmd wsCommandJSON
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&cmd)
+
+	req := r.Clone(r.Context()) // keeps the agent and audit attributes of the connection
+	req.Method = http.MethodPut
+	req.URL = &url.URL{Path: "/" + cmd.Op}
+	if cmd.Resolve {
+		req.URL.RawQuery = "resolve=true"
+	}
+	req.Header.Del(OpIDHeader)
+	req.Header.Del(OpRefHeader)
+	var handler func(web.C, http.ResponseWriter, *http.Request)
+	switch cmd.Op {
+	case WebSocketCheckout:
+		handler = putCheckoutBodyHandler
+	case WebSocketCheckin:
+		handler = putCheckinBodyHandler
+	}
+
+	switch m := getMaintenance(); {
+	case err != nil:
+		req.URL.Path = r.URL.Path
+		BadRequest(resp, req, "bad JSON command: %v", err)
+	case handler == nil:
+		req.URL.Path = r.URL.Path
+		BadRequest(resp, req, "command op must be %q or %q, not %q", WebSocketCheckout, WebSocketCheckin, cmd.Op)
+	case m.Maintenance:
+		log.Printf("ERROR: refused WebSocket %s by %s during maintenance\n", cmd.Op, client)
+		writeError(resp, http.StatusServiceUnavailable, m.Message)
+	default:
+		if cmd.Client == "" {
+			cmd.Client = client
+		}
+		body, err := json.Marshal(cmd.opBodyJSON)
+		if err != nil {
+			BadRequest(resp, req, "bad JSON command: %v", err)
+			break
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		handler(c, resp, req)
+	}
+
+	ack := wsMessageJSON{Type: WebSocketAck, ID: cmd.ID, Status: resp.status}
+	if body := bytes.TrimSpace(resp.body.Bytes()); len(body) > 0 && string(body) != "{}" && json.Valid(body) {
+		ack.Response = body
+	}
+	return ack
+}
+
+func webSocketHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	client, err := checkClientID(c.URLParams["client"])
+	if err != nil {
+		BadRequest(w, r, "%v", err)
+		return
+	}
+	if err := authorizeClient(c, client); err != nil {
+		Forbidden(w, r, "unable to open WebSocket: %v", err)
+		return
+	}
+	ws := upgradeWebSocket(w, r)
+	if ws == nil {
+		return
+	}
+	defer ws.conn.Close()
+	ch := subscribe(client)
+	defer unsubscribe(client, ch)
+
+	// Commands are run in order, so a checkin sent right after a checkout applies to it.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			msg, err := ws.readMessage()
+			if err != nil {
+				if err != errWebSocketClosed && !errors.Is(err, io.EOF) {
+					log.Printf("WebSocket for client %s closed: %v\n", client, err)
+				}
+				return
+			}
+			if err := ws.writeJSON(runWebSocketCommand(c, r, client, msg)); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(EventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-heartbeat.C:
+			if err := ws.writeFrame(wsPing, nil); err != nil {
+				return
+			}
+		case ev := <-ch:
+			if err := ws.writeJSON(wsMessageJSON{Type: WebSocketEvent, Event: &ev}); err != nil {
+				return
+			}
+		}
+	}
+}